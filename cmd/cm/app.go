@@ -2,43 +2,190 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/daviddao/clockmail/pkg/clock"
+	"github.com/daviddao/clockmail/pkg/config"
 	"github.com/daviddao/clockmail/pkg/model"
 	"github.com/daviddao/clockmail/pkg/store"
+	"github.com/daviddao/clockmail/pkg/trace"
+	"github.com/daviddao/clockmail/pkg/worktree"
 )
 
 // app holds shared state for all CLI subcommands.
 type app struct {
 	store   *store.Store
-	agentID string // default agent from CLOCKMAIL_AGENT
+	cfg     *config.Config   // .clockmail/config.toml; nil means all defaults
+	agentID string           // default agent from CLOCKMAIL_AGENT
+	prov    model.Provenance // recorded on every event this invocation writes
+	tracer  *trace.Tracer    // from CLOCKMAIL_OTEL_ENDPOINT; nil when tracing is off
+	span    *trace.Span      // the running command's span; nil when tracing is off
+	log     *slog.Logger     // diagnostics (see logging.go); nil means warnings on stderr
+	quiet   bool             // global --quiet
+	// allBranches is the global --all-branches: a branch-scoped
+	// invocation (prov.Branch set) sees every branch's locks and messages.
+	allBranches bool
+	// repo is the git working tree lock paths are relative to (see
+	// lockpath.go); nil outside one. It is looked up on first use, unless
+	// repoKnown already.
+	repo      *worktree.Repo
+	repoKnown bool
 }
 
-// newApp opens the database and resolves the default agent identity.
-// Creates the .clockmail/ directory if using the default DB path.
-func newApp() (*app, error) {
-	dbPath := envOr("CLOCKMAIL_DB", defaultDB)
-	if dbPath == defaultDB {
-		if err := os.MkdirAll(defaultDir, 0755); err != nil {
-			return nil, fmt.Errorf("cannot create %s: %w", defaultDir, err)
+// newApp opens the database for command, loads the project configuration
+// and resolves the default agent identity. CLOCKMAIL_DSN (e.g. a
+// postgres:// URL, or the global --db flag) takes precedence over the
+// SQLite path in CLOCKMAIL_DB; without either, the database is the one in
+// the workspace found by searching up from the working directory (see
+// workspace.go), and it is an error if there is none. cm init instead
+// creates the workspace in the working directory if there is none. The
+// schema is brought up to date except for cm migrate, which does it
+// itself, and cm doctor, which reports on it.
+func newApp(command string) (*app, error) {
+	open := store.Open
+	if command == "migrate" || command == "doctor" {
+		open = store.OpenUnmigrated
+	}
+	found, err := useWorkspace()
+	if err != nil {
+		return nil, err
+	}
+	if command == "init" {
+		if err := markWorkspace(); err != nil {
+			return nil, fmt.Errorf("cannot create %s: %w", workspacePath(""), err)
 		}
+		found = true
 	}
-	s, err := store.New(dbPath)
+	var s *store.Store
+	if dsn := os.Getenv("CLOCKMAIL_DSN"); dsn != "" {
+		if s, err = open(dsn); err != nil {
+			return nil, fmt.Errorf("cannot open database %q: %w", dbLocation(), err)
+		}
+	} else {
+		dbPath := os.Getenv("CLOCKMAIL_DB")
+		if dbPath == "" {
+			if !found {
+				return nil, errNoWorkspace()
+			}
+			dbPath = workspacePath("clockmail.db")
+		}
+		if s, err = open(dbPath); err != nil {
+			return nil, fmt.Errorf("cannot open database %q: %w", dbPath, err)
+		}
+	}
+	cfg, err := config.Load(configPath())
 	if err != nil {
-		return nil, fmt.Errorf("cannot open database %q: %w", dbPath, err)
+		s.Close()
+		return nil, fmt.Errorf("config: %w", err)
 	}
+	if err := s.SetPool(store.PoolOptions{
+		MaxOpenConns:    cfg.Int("db.max_conns"),
+		DedicatedWriter: cfg.Int("db.dedicated_writer") != 0,
+	}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("database pool: %w", err)
+	}
+	s.SetSigner(localSigner())
+	s.SetSessions(localSessions())
+	s.SetActiveWindow(presenceSetting(cfg, "active"))
+	tracer := trace.FromEnv("clockmail", version)
+	s.SetTracer(tracer)
+	agentID := envOr("CLOCKMAIL_AGENT", "")
+	s.SetActor(agentID)
 	return &app{
 		store:   s,
-		agentID: envOr("CLOCKMAIL_AGENT", ""),
+		cfg:     cfg,
+		agentID: agentID,
+		prov:    envProvenance(),
+		tracer:  tracer,
 	}, nil
 }
 
+// envProvenance reads default event provenance from CLOCKMAIL_TOOL and
+// CLOCKMAIL_RUN_ID.
+func envProvenance() model.Provenance {
+	return model.Provenance{Tool: os.Getenv("CLOCKMAIL_TOOL"), RunID: os.Getenv("CLOCKMAIL_RUN_ID")}
+}
+
+// splitProvenance removes the global --tool and --run-id flags from a
+// command's arguments, wherever they appear before a "--" terminator, and
+// returns them with the remaining arguments. Unset fields keep the values
+// from def.
+func splitProvenance(args []string, def model.Provenance) (model.Provenance, []string, error) {
+	prov := def
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || (name != "tool" && name != "run-id") {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return prov, nil, fmt.Errorf("flag needs an argument: %s", arg)
+			}
+			i++
+			value = args[i]
+		}
+		if name == "tool" {
+			prov.Tool = value
+		} else {
+			prov.RunID = value
+		}
+	}
+	return prov, rest, nil
+}
+
+// insertEvent appends e to the log, tagged with the invocation's
+// provenance unless e already carries its own.
+func (a *app) insertEvent(e *model.Event) (int64, error) {
+	if e.Provenance == (model.Provenance{}) {
+		e.Provenance = a.prov
+	}
+	return a.store.InsertEvent(e)
+}
+
+// insertEvents appends events to the log in one transaction, each tagged
+// like insertEvent does.
+func (a *app) insertEvents(events []*model.Event) ([]int64, error) {
+	for _, e := range events {
+		if e.Provenance == (model.Provenance{}) {
+			e.Provenance = a.prov
+		}
+	}
+	return a.store.InsertEvents(events)
+}
+
 // Close releases the database connection.
 func (a *app) Close() { a.store.Close() }
 
+// endSpan ends the command's span with its exit code and exports the
+// invocation's spans. Exit code 2 is an answer (lock denied, gate shut),
+// not a failure. Export errors are reported but never change the exit code.
+func (a *app) endSpan(code int) {
+	a.span.Set(trace.Int("clockmail.exit_code", int64(code)))
+	if code == 1 {
+		a.span.Fail("exit status 1")
+	}
+	a.span.End(nil)
+	if err := a.tracer.Flush(); err != nil {
+		a.logger().Warn("export trace spans", "err", err)
+	}
+}
+
 // resolveAgent returns the agent ID from the flag (if non-empty), falling
 // back to the CLOCKMAIL_AGENT environment variable.
 func (a *app) resolveAgent(flagVal string) (string, error) {
@@ -51,10 +198,19 @@ func (a *app) resolveAgent(flagVal string) (string, error) {
 	return "", fmt.Errorf("no agent ID: pass --agent or set CLOCKMAIL_AGENT")
 }
 
+// actAs makes agentID, if set, the agent the store checks privileged
+// operations against and logs as doing them, in place of the default
+// agent (see store.SetActor).
+func (a *app) actAs(agentID string) {
+	if agentID != "" {
+		a.store.SetActor(agentID)
+	}
+}
+
 // getClock returns a Lamport clock seeded from the agent's persisted value.
-// Each agent owns its clock exclusively — no two processes should operate
-// as the same agent concurrently, matching Lamport's model where each
-// process has its own local clock.
+// It is a read-only snapshot: timestamps are handed out by the store (see
+// tick and inboxReceipt), which keeps two processes acting as the same
+// agent from racing on it.
 func (a *app) getClock(agentID string) *clock.Clock {
 	c := &clock.Clock{}
 	if ag, err := a.store.GetAgent(agentID); err == nil {
@@ -88,6 +244,53 @@ func (a *app) resolveEpochRound(agentID string, flagEpoch, flagRound int64) (int
 	return ep, rn
 }
 
+// parseAt returns the timestamp given by --at (dotted coordinates such as
+// 3.2.7), for commands that take it besides --epoch and --round. ok is
+// false if --at is unset; combining it with --epoch or --round is an
+// error.
+func parseAt(flags *flag.FlagSet, at string) (ts model.Timestamp, ok bool, err error) {
+	if at == "" {
+		return ts, false, nil
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "epoch" || f.Name == "round" {
+			err = fmt.Errorf("--at cannot be combined with --%s", f.Name)
+		}
+	})
+	if err != nil {
+		return ts, false, err
+	}
+	ts, err = model.ParseTimestamp(at)
+	return ts, err == nil, err
+}
+
+// recordEvent applies IR1 for agentID (tick, persist at the agent's
+// current position) and appends an event of the given kind. Returns the
+// event's Lamport timestamp.
+func (a *app) recordEvent(agentID string, kind model.EventKind, target, body string) (int64, error) {
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	ts := a.tick(agentID, ep, rn)
+	_, err := a.insertEvent(&model.Event{
+		AgentID:   agentID,
+		LamportTS: ts,
+		Epoch:     ep,
+		Round:     rn,
+		Kind:      kind,
+		Target:    target,
+		Body:      body,
+		CreatedAt: time.Now().UTC(),
+	})
+	return ts, err
+}
+
+// recordFrontier adds the current frontier to the frontier history if it
+// has changed. Failures are logged but never fail the command.
+func (a *app) recordFrontier() {
+	if _, _, err := a.store.RecordFrontier(); err != nil {
+		a.logger().Warn("record frontier history", "err", err)
+	}
+}
+
 // peekInbox checks for pending messages without advancing the cursor.
 // Returns the messages and count. Used by commands that want to show
 // pending messages as a side effect (send, lock, etc.).
@@ -95,11 +298,11 @@ func (a *app) peekInbox(agentID string) ([]model.Event, int) {
 	if agentID == "" {
 		return nil, 0
 	}
-	cursor := a.store.GetCursor(agentID)
-	msgs, err := a.store.ListEventsForAgent(agentID, cursor, 100)
+	msgs, err := a.store.ListUnread(agentID, "", 100)
 	if err != nil {
 		return nil, 0
 	}
+	openSealed(agentID, msgs)
 	return msgs, len(msgs)
 }
 
@@ -107,28 +310,142 @@ func (a *app) peekInbox(agentID string) ([]model.Event, int) {
 // cursor, and returns the messages. This is the "receive" side effect that
 // send, lock, and other commands use to force bidirectional communication.
 func (a *app) drainInbox(agentID string, c *clock.Clock) []model.Event {
+	r := a.readInbox(agentID, c)
+	if err := a.store.WithTx(r.write); err != nil {
+		a.logger().Warn("record inbox receipt", "agent", agentID, "err", err)
+	}
+	return r.msgs
+}
+
+// inboxReceipt is what receiving an agent's pending messages writes: the
+// deliveries, IR2 applied to the stored clock for each message, and the
+// advanced cursor. Commands that also write something themselves include
+// it in their own transaction, so a crash cannot leave the cursor past
+// messages the clock never saw.
+type inboxReceipt struct {
+	agentID     string
+	from        string        // if set, only the cursor for this sender moves
+	held        int64         // if set, the lowest timestamp left unread: the cursor stays at or below it
+	msgs        []model.Event // as shown: urgent first
+	deliveredAt int64         // the clock before receiving
+	received    []int64       // the messages' timestamps, in Lamport order
+	clock       int64         // the clock after receiving; the stored one after write
+}
+
+// newInboxReceipt records receiving msgs, which must be in Lamport order,
+// at clock deliveredAt.
+func newInboxReceipt(agentID string, deliveredAt int64, msgs []model.Event) *inboxReceipt {
+	r := &inboxReceipt{agentID: agentID, msgs: msgs, deliveredAt: deliveredAt}
+	var c clock.Clock
+	c.Set(deliveredAt)
+	for _, e := range msgs {
+		r.received = append(r.received, e.LamportTS)
+		c.Receive(e.LamportTS)
+	}
+	r.clock = c.Value()
+	return r
+}
+
+// readInbox fetches agentID's pending messages, leaving the writes to the
+// returned receipt. c is advanced as the receipt will advance the stored
+// clock, for agents with none.
+func (a *app) readInbox(agentID string, c *clock.Clock) *inboxReceipt {
 	if agentID == "" {
-		return nil
+		return &inboxReceipt{}
 	}
-	cursor := a.store.GetCursor(agentID)
-	msgs, err := a.store.ListEventsForAgent(agentID, cursor, 100)
+	msgs, err := a.store.ListUnread(agentID, "", 100)
 	if err != nil || len(msgs) == 0 {
-		return nil
+		return &inboxReceipt{agentID: agentID}
 	}
-	var maxTS int64
+	r := newInboxReceipt(agentID, c.Value(), msgs)
 	for _, e := range msgs {
 		c.Receive(e.LamportTS)
-		if e.LamportTS > maxTS {
-			maxTS = e.LamportTS
+	}
+	openSealed(agentID, msgs)
+	sortByPriority(msgs)
+	return r
+}
+
+// write records the receipt within tx. IR2 is applied by the store, one
+// message at a time, so it composes with anything else moving the clock.
+func (r *inboxReceipt) write(tx store.TxStore) error {
+	if len(r.msgs) == 0 {
+		return nil
+	}
+	if err := tx.RecordDeliveries(r.agentID, r.deliveredAt, r.msgs); err != nil {
+		return err
+	}
+	var maxTS int64
+	for _, ts := range r.received {
+		clk, err := tx.ReceiveAgent(r.agentID, ts)
+		switch {
+		case errors.Is(err, store.ErrNotRegistered):
+			// No stored clock to advance.
+		case err != nil:
+			return err
+		default:
+			r.clock = clk
 		}
+		maxTS = max(maxTS, ts)
 	}
-	if ag, _ := a.store.GetAgent(agentID); ag != nil {
-		_ = a.store.UpdateAgentClock(agentID, c.Value(), ag.Epoch, ag.Round)
+	cursor := maxTS + 1
+	if r.held > 0 {
+		// Received messages past the cursor are known by their deliveries.
+		cursor = min(cursor, r.held)
 	}
-	if maxTS > 0 {
-		_ = a.store.SetCursor(agentID, maxTS+1)
+	if r.from != "" {
+		return tx.SetSenderCursor(r.agentID, r.from, cursor)
 	}
-	return msgs
+	return tx.AdvanceCursor(r.agentID, cursor)
+}
+
+// tick applies IR1 to agentID's stored clock and moves the agent to
+// (ep, rn), returning the new timestamp. The store increments the clock
+// in one statement, so two invocations acting as the same agent never
+// hand out the same timestamp. An unregistered agent, with no stored
+// clock, ticks from zero.
+func (a *app) tick(agentID string, ep, rn int64) int64 {
+	ts, err := a.store.TickAgent(agentID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotRegistered) {
+			a.logger().Warn("tick clock", "agent", agentID, "err", err)
+		}
+		return a.getClock(agentID).Tick()
+	}
+	if err := a.store.SetAgentPosition(agentID, ep, rn); err != nil {
+		a.logger().Warn("update position", "agent", agentID, "err", err)
+	}
+	return ts
+}
+
+// tickIn is tick within tx. c is the invocation's local clock, used for
+// an unregistered agent.
+func tickIn(tx store.TxStore, agentID string, c *clock.Clock, ep, rn int64) (int64, error) {
+	ts, err := tx.TickAgent(agentID)
+	switch {
+	case errors.Is(err, store.ErrNotRegistered):
+		return c.Value() + 1, nil
+	case err != nil:
+		return 0, err
+	}
+	return ts, tx.SetAgentPosition(agentID, ep, rn)
+}
+
+// sortByPriority orders messages urgent first, keeping Lamport order
+// within each priority. Clocks are advanced before sorting, so this only
+// affects presentation.
+func sortByPriority(msgs []model.Event) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Priority.Rank() > msgs[j].Priority.Rank()
+	})
+}
+
+// priorityTag returns a display marker for non-normal priorities.
+func priorityTag(e model.Event) string {
+	if e.Priority == "" || e.Priority == model.PriorityNormal {
+		return ""
+	}
+	return "[" + string(e.Priority) + "] "
 }
 
 // printInbox prints received messages to stderr so they don't interfere
@@ -139,19 +456,23 @@ func printInbox(msgs []model.Event) int {
 	}
 	fmt.Fprintf(os.Stderr, "\n=== %d pending message(s) ===\n", len(msgs))
 	for _, e := range msgs {
-		body := e.Body
+		body := displayBody(e)
 		if len(body) > 120 {
 			body = body[:120] + "..."
 		}
-		fmt.Fprintf(os.Stderr, "  [ts=%d] %s: %s\n", e.LamportTS, e.AgentID, body)
+		fmt.Fprintf(os.Stderr, "  [ts=%d] %s%s: %s\n", e.LamportTS, priorityTag(e), e.AgentID, body)
 	}
 	fmt.Fprintf(os.Stderr, "============================\n\n")
 	return len(msgs)
 }
 
 // resolveRecipients expands the recipient string. The special value "all"
-// (case-insensitive) expands to all registered agents except the sender.
-// Otherwise it splits on comma as before.
+// (case-insensitive) expands to all registered agents except the sender
+// and departed agents.
+// Otherwise it splits on comma as before; an entry "@<capability>" expands
+// to every other agent advertising that capability (see cm register
+// --capabilities), and "role:<name>" to every other agent holding that
+// role (cm register --role). Duplicates are dropped.
 func (a *app) resolveRecipients(to, senderID string) ([]string, error) {
 	if strings.EqualFold(strings.TrimSpace(to), "all") {
 		agents, err := a.store.ListAgents()
@@ -160,7 +481,7 @@ func (a *app) resolveRecipients(to, senderID string) ([]string, error) {
 		}
 		var recipients []string
 		for _, ag := range agents {
-			if ag.ID != senderID {
+			if ag.ID != senderID && ag.DepartedAt == nil {
 				recipients = append(recipients, ag.ID)
 			}
 		}
@@ -172,7 +493,42 @@ func (a *app) resolveRecipients(to, senderID string) ([]string, error) {
 	var recipients []string
 	for _, r := range strings.Split(to, ",") {
 		r = strings.TrimSpace(r)
-		if r != "" {
+		if r == "" {
+			continue
+		}
+		var ids []string
+		var err error
+		var none string
+		if capability, ok := strings.CutPrefix(r, "@"); ok {
+			capability = strings.ToLower(capability)
+			if ids, err = a.store.AgentsWithCapability(capability); err != nil {
+				return nil, fmt.Errorf("resolve @%s: %w", capability, err)
+			}
+			none = fmt.Sprintf("no other agents advertise capability %q", capability)
+		} else if role, ok := strings.CutPrefix(r, "role:"); ok {
+			role = strings.ToLower(role)
+			if ids, err = a.store.AgentsWithRole(role); err != nil {
+				return nil, fmt.Errorf("resolve role:%s: %w", role, err)
+			}
+			none = fmt.Sprintf("no other agents hold role %q", role)
+		}
+		if none != "" {
+			matched := false
+			for _, id := range ids {
+				if id == senderID {
+					continue
+				}
+				matched = true
+				if !slices.Contains(recipients, id) {
+					recipients = append(recipients, id)
+				}
+			}
+			if !matched {
+				return nil, errors.New(none)
+			}
+			continue
+		}
+		if !slices.Contains(recipients, r) {
 			recipients = append(recipients, r)
 		}
 	}
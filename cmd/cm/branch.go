@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/worktree"
+)
+
+// branchScope is how an invocation sees git branches: with scoped, the
+// events and locks it writes are tagged with the checked-out branch, and
+// locks and messages from other branches are out of its sight unless all.
+type branchScope struct {
+	scoped bool // --branch-scoped, or branch.scoped = 1
+	all    bool // --all-branches
+}
+
+// splitBranchFlags removes the global --branch-scoped and --all-branches
+// flags from a command's arguments, wherever they appear before a "--"
+// terminator, and returns them with the remaining arguments. scoped is
+// the default from the configuration.
+func splitBranchFlags(args []string, scoped bool) (branchScope, []string) {
+	sc := branchScope{scoped: scoped}
+	rest := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "-") {
+			switch strings.TrimLeft(arg, "-") {
+			case "branch-scoped":
+				sc.scoped = true
+				continue
+			case "all-branches":
+				sc.all = true
+				continue
+			}
+		}
+		rest = append(rest, arg)
+	}
+	return sc, rest
+}
+
+// currentBranch returns the branch to scope to: CLOCKMAIL_BRANCH, or the
+// branch checked out in the working directory's repository.
+func currentBranch() (string, error) {
+	if b := os.Getenv("CLOCKMAIL_BRANCH"); b != "" {
+		return b, nil
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	repo, err := worktree.Open(dir)
+	if err != nil {
+		return "", err
+	}
+	return repo.Branch()
+}
+
+// useBranchScope scopes the invocation to the current branch if sc says
+// so. Off a branch (outside a repository, or on a detached HEAD) cm runs
+// unscoped, with a warning.
+func (a *app) useBranchScope(sc branchScope) {
+	if !sc.scoped {
+		return
+	}
+	branch, err := currentBranch()
+	if err != nil {
+		a.logger().Warn("not on a git branch; branch scoping is off", "err", err)
+		return
+	}
+	a.prov.Branch = branch
+	a.allBranches = sc.all
+	a.store.SetBranch(branch, sc.all)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// cmdAsk sends a question to one agent and blocks until it answers,
+// printing the answer on stdout. The question's first line is "[ask]";
+// its permalink is the correlation ID, which inbox listings show after
+// the tag and the other side passes to cm answer. The reply starts
+// "[answer] 1f2e3d4c5b6a7980". Since permalinks survive cm gc, the
+// question can still be looked up with cm show. Other messages that
+// arrive meanwhile stay pending, as with cm wait-for.
+//
+// Usage:
+//
+//	cm ask bob "what port did you pick?" --timeout 2m
+//
+// Exit codes:
+//
+//	0 = answered
+//	1 = error or timeout
+func (a *app) cmdAsk(args []string) int {
+	const usage = "usage: cm ask <to> <question> [--timeout 2m] [--agent ID] [--json]"
+	flags := flag.NewFlagSet("ask", flag.ContinueOnError)
+	agent := flags.String("agent", "", "asking agent ID")
+	timeout := flags.Duration("timeout", 2*time.Minute, "give up waiting for the answer after this long")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	to, question, ok := parseTextArgs(flags, args)
+	if !ok {
+		return 1
+	}
+	if to == "" || question == "" || strings.EqualFold(to, "all") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	if to == agentID {
+		fmt.Fprintln(os.Stderr, "cm: ask: cannot ask yourself")
+		return 1
+	}
+	_, dead, err := a.liveRecipients([]string{to})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: ask: %v\n", err)
+		return 1
+	}
+	if len(dead) > 0 {
+		fmt.Fprintf(os.Stderr, "cm: ask: %s is %s\n", to, dead[0].reason)
+		return 1
+	}
+
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	ts := a.tick(agentID, ep, rn)
+	id, err := a.insertEvent(&model.Event{AgentID: agentID, LamportTS: ts, Epoch: ep, Round: rn, Kind: model.EventMsg,
+		Target: to, Body: "[ask]\n" + question, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: ask: %v\n", err)
+		return 1
+	}
+	cid := model.Permalink(agentID, id, ts)
+	if !*jsonOut {
+		fmt.Fprintf(os.Stderr, "asked %s at ts=%d (%s); waiting up to %s for cm answer %s\n", to, ts, cid, *timeout, cid)
+	}
+
+	isAnswer := func(e model.Event) bool {
+		first, _, _ := strings.Cut(e.Body, "\n")
+		return messageType(first) == "answer" && strings.TrimSpace(strings.TrimPrefix(first, "[answer]")) == cid
+	}
+	got, timedOut, err := a.waitForMessage(agentID, to, isAnswer, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: ask: %v\n", err)
+		return 1
+	}
+	if timedOut {
+		if *jsonOut {
+			printJSON(map[string]interface{}{"correlation_id": cid, "event_id": id, "timed_out": true})
+		}
+		fmt.Fprintf(os.Stderr, "cm: ask: no answer from %s after %s\n", to, *timeout)
+		return 1
+	}
+	_, answer, _ := strings.Cut(got.Body, "\n")
+	if *jsonOut {
+		printJSON(map[string]interface{}{"correlation_id": cid, "event_id": id, "answer": answer, "message": got})
+	} else {
+		fmt.Println(answer)
+	}
+	return 0
+}
+
+// cmdAnswer replies to a question asked with cm ask, sending the answer
+// to whoever asked it. The correlation ID is the question's permalink.
+//
+// Usage:
+//
+//	cm answer <correlation_id> <answer>
+func (a *app) cmdAnswer(args []string) int {
+	const usage = "usage: cm answer <correlation_id> <answer> [--agent ID] [--json]"
+	flags := flag.NewFlagSet("answer", flag.ContinueOnError)
+	agent := flags.String("agent", "", "answering agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	cid, answer, ok := parseTextArgs(flags, args)
+	if !ok {
+		return 1
+	}
+	if cid == "" || answer == "" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	ask, err := a.store.ResolvePermalink(cid)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "cm: answer: %v\n", err)
+		return 1
+	}
+	if ask == nil || !isQuestion(*ask) || ask.Target != agentID {
+		fmt.Fprintf(os.Stderr, "cm: answer: no question %s was asked of %s\n", cid, agentID)
+		return 1
+	}
+	cid = ask.Permalink
+	to := ask.AgentID
+
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	ts := a.tick(agentID, ep, rn)
+	id, err := a.insertEvent(&model.Event{AgentID: agentID, LamportTS: ts, Epoch: ep, Round: rn, Kind: model.EventMsg,
+		Target: to, Body: "[answer] " + cid + "\n" + answer, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: answer: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"correlation_id": cid, "to": to, "event_id": id, "lamport_ts": ts})
+	} else {
+		fmt.Printf("answered %s (%s) at ts=%d\n", to, cid, ts)
+	}
+	return 0
+}
+
+// parseTextArgs parses "<first> <text...>" with flags before, between or
+// after them, as cm send does: after the text only flags named by flags
+// count. The text words are joined with spaces.
+func parseTextArgs(flags *flag.FlagSet, args []string) (first, text string, ok bool) {
+	if err := flags.Parse(args); err != nil {
+		return "", "", false
+	}
+	if flags.NArg() == 0 {
+		return "", "", true
+	}
+	first = flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return "", "", false
+	}
+	words := flags.Args()
+	if len(words) > 1 && isFlagOf(flags, words[1]) {
+		if err := flags.Parse(words[1:]); err != nil {
+			return "", "", false
+		}
+		words = append(words[:1:1], flags.Args()...)
+	}
+	return first, strings.Join(words, " "), true
+}
+
+// isQuestion reports whether e is a question sent by cm ask.
+func isQuestion(e model.Event) bool {
+	first, _, _ := strings.Cut(e.Body, "\n")
+	return e.Kind == model.EventMsg && first == "[ask]"
+}
+
+// displayBody returns e's body as inbox listings show it: a question from
+// cm ask gets its correlation ID after the [ask] tag, for the recipient to
+// pass to cm answer.
+func displayBody(e model.Event) string {
+	if !isQuestion(e) || e.Permalink == "" {
+		return e.Body
+	}
+	return "[ask] " + e.Permalink + strings.TrimPrefix(e.Body, "[ask]")
+}
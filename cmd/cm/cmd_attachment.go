@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// maxBodySize returns the inline body limit: CLOCKMAIL_MAX_BODY bytes, or
+// send.max_body from the config file (8 KiB unless set). 0 keeps every
+// body inline.
+func (a *app) maxBodySize() int {
+	def := a.cfg.Int("send.max_body")
+	v := os.Getenv("CLOCKMAIL_MAX_BODY")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		fmt.Fprintf(os.Stderr, "cm: ignoring CLOCKMAIL_MAX_BODY=%q: want a number of bytes\n", v)
+		return def
+	}
+	return n
+}
+
+// offloadBody returns body as it is if it fits in max bytes (or max is
+// 0). Otherwise it stores body as an attachment and returns its first
+// line with a reference to the attachment, which is what recipients see.
+func (a *app) offloadBody(agentID, body string, max int) (string, *model.Attachment, error) {
+	if max == 0 || len(body) <= max {
+		return body, nil, nil
+	}
+	att, err := a.store.PutAttachment(body, agentID)
+	if err != nil {
+		return "", nil, err
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(body), "\n")
+	if r := []rune(first); len(r) > 120 {
+		first = string(r[:120]) + "..."
+	}
+	return fmt.Sprintf("%s\n[attachment %s: %d bytes; cm attachment get %s]",
+		first, att.ShortID(), att.Size, att.ShortID()), att, nil
+}
+
+// cmdAttachment retrieves message bodies that were too large to send
+// inline (see offloadBody).
+//
+// Usage:
+//
+//	cm attachment get <id> [--output FILE] [--json]
+func (a *app) cmdAttachment(args []string) int {
+	if len(args) < 1 || args[0] != "get" {
+		fmt.Fprintln(os.Stderr, "usage: cm attachment get <id> [--output FILE] [--json]")
+		return 1
+	}
+	flags := flag.NewFlagSet("attachment get", flag.ContinueOnError)
+	output := flags.String("output", "", "write the content to this file instead of stdout")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+	rest := flags.Args()
+	if len(rest) > 0 {
+		if err := flags.Parse(rest[1:]); err != nil {
+			return 1
+		}
+	}
+	if len(rest) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: cm attachment get <id> [--output FILE] [--json]")
+		return 1
+	}
+
+	att, err := a.store.GetAttachment(rest[0])
+	if err == sql.ErrNoRows {
+		return fail(fmt.Sprintf("attachment: no attachment %s", rest[0]), *jsonOut, 1, nil)
+	}
+	if errors.Is(err, store.ErrAmbiguousAttachment) {
+		return fail(fmt.Sprintf("attachment: %s matches several attachments; give more of the ID", rest[0]), *jsonOut, 1, nil)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: attachment: %v\n", err)
+		return 1
+	}
+
+	if *output != "" {
+		if err := os.WriteFile(*output, []byte(att.Body), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: attachment: %v\n", err)
+			return 1
+		}
+	}
+	switch {
+	case *jsonOut:
+		if *output != "" {
+			att.Body = ""
+		}
+		printJSON(map[string]interface{}{"attachment": att, "output": *output})
+	case *output != "":
+		fmt.Printf("wrote %d bytes to %s\n", att.Size, *output)
+	default:
+		fmt.Print(att.Body)
+	}
+	return 0
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/worktree"
+)
+
+// commitPayload is the body of a commit event.
+type commitPayload struct {
+	Commit  string   `json:"commit"`
+	Subject string   `json:"subject"`
+	Author  string   `json:"author"`
+	Files   []string `json:"files,omitempty"`
+}
+
+// authorSummary is one agent's share of the backfilled history.
+type authorSummary struct {
+	AgentID string `json:"agent_id"`
+	Commits int    `json:"commits"`
+	Files   int    `json:"files"`
+}
+
+// cmdBackfill seeds the event log with history from before clockmail was
+// set up, so a new database starts with ownership context instead of an
+// empty log. With --git, every commit since --since becomes a commit
+// event from the agent its author maps to, carrying the files it touched:
+// cm log -q 'kind=commit and body~"pkg/store"' then shows who has been
+// working where.
+//
+// Authors map to agents with --map EMAIL=AGENT or NAME=AGENT; unmapped
+// authors become the local part of their email address. Commits already
+// in the log are skipped, so backfill can be rerun as history grows.
+// Recording the history is an import: once any agent holds the admin
+// role, only an admin may backfill.
+//
+// Usage:
+//
+//	cm backfill --git --since '1 week'
+//	cm backfill --git --since 2024-05-01 --map alice@example.com=planner --dry-run
+//	cm backfill --git --agent ops
+func (a *app) cmdBackfill(args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	useGit := flags.Bool("git", false, "synthesize events from git commits")
+	since := flags.String("since", "1 week", "how far back to read (anything git log --since accepts; empty for all history)")
+	maxCommits := flags.Int("max", 1000, "read at most this many commits, the most recent")
+	var maps stringList
+	flags.Var(&maps, "map", "map a commit author to an agent: EMAIL=AGENT or NAME=AGENT (repeatable)")
+	dir := flags.String("dir", ".", "directory inside the git working tree")
+	agent := flags.String("agent", "", "agent recording the history: an admin, once there is one")
+	dryRun := flags.Bool("dry-run", false, "report what would be recorded without writing it")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if !*useGit {
+		fmt.Fprintln(os.Stderr, "usage: cm backfill --git [--since '1 week'] [--map EMAIL=AGENT]... [--dry-run] [--json]")
+		return 1
+	}
+
+	authors := make(map[string]string)
+	for _, m := range maps {
+		k, v, ok := strings.Cut(m, "=")
+		if !ok || strings.TrimSpace(k) == "" || strings.TrimSpace(v) == "" {
+			fmt.Fprintf(os.Stderr, "cm: backfill: --map %q: want EMAIL=AGENT or NAME=AGENT\n", m)
+			return 1
+		}
+		authors[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+	}
+
+	absDir, err := filepath.Abs(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: backfill: %v\n", err)
+		return 1
+	}
+	repo, err := worktree.Open(absDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: backfill: %v\n", err)
+		return 1
+	}
+	commits, err := repo.Log(*since, *maxCommits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: backfill: %v\n", err)
+		return 1
+	}
+
+	recorded, err := a.store.ListEventsByKind([]model.EventKind{model.EventCommit}, 0, math.MaxInt32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: backfill: %v\n", err)
+		return 1
+	}
+	seen := make(map[string]bool)
+	var ts int64
+	for _, e := range recorded {
+		seen[e.Target] = true
+		ts = max(ts, e.LamportTS)
+	}
+
+	// Commits happened before the agents' recorded work, so they are
+	// numbered from 1 (after any earlier backfill) rather than from the
+	// current clock; ImportEvents only ever raises clocks.
+	var events []model.Event
+	skipped := 0
+	summary := make(map[string]*authorSummary)
+	files := make(map[string]map[string]bool) // agent -> files touched
+	owners := make(map[string]string)         // file -> agent with most commits touching it
+	touches := make(map[string]map[string]int)
+	for _, c := range commits {
+		if seen[c.SHA] {
+			skipped++
+			continue
+		}
+		agentID := authorAgent(c.Author, c.Email, authors)
+		body, _ := json.Marshal(commitPayload{
+			Commit: c.SHA, Subject: c.Subject, Author: fmt.Sprintf("%s <%s>", c.Author, c.Email), Files: c.Files,
+		})
+		ts++
+		events = append(events, model.Event{
+			AgentID:    agentID,
+			LamportTS:  ts,
+			Kind:       model.EventCommit,
+			Target:     c.SHA,
+			Body:       string(body),
+			CreatedAt:  c.Time,
+			Provenance: a.prov,
+		})
+
+		if summary[agentID] == nil {
+			summary[agentID] = &authorSummary{AgentID: agentID}
+			files[agentID] = make(map[string]bool)
+		}
+		summary[agentID].Commits++
+		for _, f := range c.Files {
+			files[agentID][f] = true
+			if touches[f] == nil {
+				touches[f] = make(map[string]int)
+			}
+			touches[f][agentID]++
+			// Commits are oldest first, so ties go to the latest author.
+			if touches[f][agentID] >= touches[f][owners[f]] {
+				owners[f] = agentID
+			}
+		}
+	}
+	byAgent := make([]authorSummary, 0, len(summary))
+	for id, s := range summary {
+		s.Files = len(files[id])
+		byAgent = append(byAgent, *s)
+	}
+	sort.Slice(byAgent, func(i, j int) bool {
+		if byAgent[i].Commits != byAgent[j].Commits {
+			return byAgent[i].Commits > byAgent[j].Commits
+		}
+		return byAgent[i].AgentID < byAgent[j].AgentID
+	})
+
+	var created []string
+	if !*dryRun && len(events) > 0 {
+		a.actAs(*agent)
+		res, err := a.store.ImportEvents(events, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: backfill: %v\n", err)
+			return 1
+		}
+		created = res.AgentsCreated
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{
+			"commits": len(events), "skipped": skipped, "agents": byAgent, "owners": owners,
+			"agents_created": created, "dry_run": *dryRun,
+		})
+		return 0
+	}
+	verb := "backfilled"
+	if *dryRun {
+		verb = "would backfill"
+	}
+	fmt.Printf("%s %d commit(s) from %d author(s)", verb, len(events), len(byAgent))
+	if skipped > 0 {
+		fmt.Printf(" (skipped %d already recorded)", skipped)
+	}
+	fmt.Println()
+	for _, s := range byAgent {
+		fmt.Printf("  %-20s %d commit(s), %d file(s)\n", s.AgentID, s.Commits, s.Files)
+	}
+	if len(created) > 0 {
+		fmt.Printf("  created agents: %s\n", strings.Join(created, ", "))
+	}
+	return 0
+}
+
+// authorAgent maps a commit author to an agent ID: an explicit mapping by
+// email or name (keys lowercased), else the local part of the email
+// address (the user name of GitHub noreply addresses), else the name.
+func authorAgent(name, email string, authors map[string]string) string {
+	if id, ok := authors[strings.ToLower(email)]; ok {
+		return id
+	}
+	if id, ok := authors[strings.ToLower(name)]; ok {
+		return id
+	}
+	local, domain, _ := strings.Cut(email, "@")
+	if strings.EqualFold(domain, "users.noreply.github.com") {
+		if _, user, ok := strings.Cut(local, "+"); ok {
+			local = user
+		}
+	}
+	if id := agentSlug(local); id != "" {
+		return id
+	}
+	if id := agentSlug(name); id != "" {
+		return id
+	}
+	return "unknown"
+}
+
+// agentSlug lowercases s and replaces anything but letters, digits, '.',
+// '_' and '-' with '-'.
+func agentSlug(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, strings.TrimSpace(s))
+	return strings.Trim(s, "-")
+}
+
+// commitSummary renders a commit event as its short SHA and subject.
+func commitSummary(e model.Event) string {
+	var c commitPayload
+	if err := json.Unmarshal([]byte(e.Body), &c); err != nil {
+		return e.Target
+	}
+	sha := c.Commit
+	if len(sha) > 12 {
+		sha = sha[:12]
+	}
+	return fmt.Sprintf("%s %s (%d file(s))", sha, c.Subject, len(c.Files))
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/clock"
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// cmdBye deregisters the agent at the end of its session: it releases all
+// of the agent's locks, drops it from frontier computation so gates stop
+// waiting on it, and logs a departed event summarizing what it left
+// behind. Running cm register again brings the agent back.
+//
+// Usage: cm bye [--agent ID] [--json]   (alias: deregister)
+func (a *app) cmdBye(args []string) int {
+	flags := flag.NewFlagSet("bye", flag.ContinueOnError)
+	agent := flags.String("agent", "", "departing agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	a.actAs(agentID)
+
+	d, ts, err := a.depart(agentID, "departed")
+	if errors.Is(err, store.ErrNotRegistered) {
+		return fail(fmt.Sprintf("bye: %v", err), *jsonOut, 1, a.unregisteredActions(agentID))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: bye: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"departure": d, "lamport_ts": ts})
+	} else {
+		fmt.Printf("%s %s (ts=%d)\n", agentID, departureSummary("departed", d), ts)
+	}
+	return 0
+}
+
+// cmdReap departs agents that have not been seen for --older-than, as if
+// each had run cm bye, and logs a reaped event for each; the agent running
+// it (--agent, or CLOCKMAIL_AGENT) is spared. Use it to clear
+// out crashed sessions whose locks and stale positions would otherwise
+// block everyone else. With --fallback, a reaped agent's unread messages
+// are bounced to that agent rather than left to pile up. The [reap]
+// settings make this a policy: reap.after and reap.fallback are the
+// defaults, and reap.auto = 1 applies them lazily at the start of every
+// command, keeping a long-lived shared database clean without anyone
+// running cm reap.
+//
+// Departing other agents is privileged: once any agent holds the admin
+// role, only an admin may reap (see store.SetActor).
+//
+// Usage: cm reap [--older-than 1h] [--fallback AGENT] [--agent ADMIN] [--dry-run] [--json]
+func (a *app) cmdReap(args []string) int {
+	p := a.reapPolicy()
+	if p.after <= 0 {
+		p.after = time.Hour
+	}
+	flags := flag.NewFlagSet("reap", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent doing the reaping: an admin, once there is one")
+	olderThan := flags.Duration("older-than", p.after, "reap agents not seen for this long (default: reap.after)")
+	fallback := flags.String("fallback", p.fallback, "bounce reaped agents' unread messages to this agent (default: reap.fallback)")
+	dryRun := flags.Bool("dry-run", false, "list the agents that would be reaped")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *olderThan <= 0 {
+		fmt.Fprintln(os.Stderr, "cm: reap: --older-than must be positive")
+		return 1
+	}
+	p = reapPolicy{after: *olderThan, fallback: *fallback}
+	a.actAs(*agent)
+	// The agent reaping is evidently not gone.
+	reaper := *agent
+	if reaper == "" {
+		reaper = a.agentID
+	}
+
+	idle, err := a.reapable(p, reaper)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: reap: %v\n", err)
+		return 1
+	}
+	reaped := []*reapResult{}
+	failed := false
+	for _, ag := range idle {
+		if *dryRun {
+			reaped = append(reaped, &reapResult{Departure: &store.Departure{AgentID: ag.ID}})
+			continue
+		}
+		r, err := a.reap(ag, p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: reap: %s: %v\n", ag.ID, err)
+			failed = true
+			continue
+		}
+		reaped = append(reaped, r)
+		if !*jsonOut {
+			fmt.Printf("%s %s\n", ag.ID, r.summary)
+		}
+	}
+
+	switch {
+	case *jsonOut:
+		printJSON(map[string]interface{}{"reaped": reaped, "count": len(reaped), "dry_run": *dryRun})
+	case *dryRun:
+		for _, r := range reaped {
+			fmt.Printf("would reap %s\n", r.AgentID)
+		}
+		fmt.Printf("%d agent(s) not seen for %s\n", len(reaped), *olderThan)
+	case len(reaped) == 0 && !failed:
+		fmt.Printf("no agents idle for %s\n", *olderThan)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// reapPolicy says which agents cm reap departs and where their mail goes.
+type reapPolicy struct {
+	after    time.Duration // reap agents not seen for this long; 0 never
+	fallback string        // bounce their unread messages here, if set
+}
+
+// reapPolicy returns the policy of the [reap] settings.
+func (a *app) reapPolicy() reapPolicy {
+	return reapPolicy{after: a.cfg.Duration("reap.after"), fallback: a.cfg.String("reap.fallback")}
+}
+
+// reapResult is what reaping one agent did.
+type reapResult struct {
+	*store.Departure
+	// Bounced counts the unread messages forwarded to Fallback.
+	Bounced  int    `json:"bounced,omitempty"`
+	Fallback string `json:"fallback,omitempty"`
+
+	summary string
+}
+
+// reapable returns the agents p would reap now, other than spare: those
+// not departed and not seen for p.after, or past their spawn TTL.
+func (a *app) reapable(p reapPolicy, spare string) ([]model.Agent, error) {
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-p.after)
+	var idle []model.Agent
+	for _, ag := range agents {
+		if ag.DepartedAt != nil || ag.ID == spare {
+			continue
+		}
+		// Sub-agents spawned with --ttl are stale sooner.
+		ttlExpired := ag.TTL > 0 && time.Since(ag.LastSeen) > time.Duration(ag.TTL)*time.Second
+		if (p.after <= 0 || !ag.LastSeen.Before(cutoff)) && !ttlExpired {
+			continue
+		}
+		idle = append(idle, ag)
+	}
+	return idle, nil
+}
+
+// reap departs ag on behalf of p and, given a live fallback, bounces
+// its unread messages there in the same transaction, so a reaped agent's
+// mail is never left behind. The store ends its session, since whoever
+// held it is gone, so the reaper can write for it: the bounced messages
+// and the reaped event summarizing the departure.
+func (a *app) reap(ag model.Agent, p reapPolicy) (*reapResult, error) {
+	var unread []model.Event
+	if p.fallback != "" && p.fallback != ag.ID {
+		live, _, err := a.liveRecipients([]string{p.fallback})
+		if err != nil {
+			return nil, err
+		}
+		if len(live) == 0 {
+			a.logger().Warn("not bouncing messages: fallback agent is not live", "agent", ag.ID, "fallback", p.fallback)
+		} else if unread, err = a.store.ListUnread(ag.ID, "", 1000); err != nil {
+			return nil, fmt.Errorf("bounce unread messages: %w", err)
+		}
+	}
+
+	r := &reapResult{}
+	err := a.store.WithTx(func(tx store.TxStore) error {
+		d, err := tx.DepartAgent(ag.ID)
+		if err != nil {
+			return err
+		}
+		r.Departure = d
+		if err := a.bounceUnread(tx, ag, p.fallback, unread); err != nil {
+			return fmt.Errorf("bounce unread messages: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(unread) > 0 {
+		r.Bounced, r.Fallback = len(unread), p.fallback
+	}
+
+	reason := fmt.Sprintf("reaped after %s without activity", time.Since(ag.LastSeen).Round(time.Minute))
+	r.summary = departureSummary(reason, r.Departure)
+	if r.Bounced > 0 {
+		r.summary += fmt.Sprintf("; bounced %d to %s", r.Bounced, r.Fallback)
+	}
+	if _, err := a.recordEvent(ag.ID, model.EventReaped, r.Fallback, r.summary); err != nil {
+		a.logger().Warn("record reaped event", "agent", ag.ID, "err", err)
+	}
+	a.recordFrontier()
+	return r, nil
+}
+
+// bounceUnread forwards msgs, ag's unread messages, to fallback in its
+// name, each body saying whom it was from, and marks them received.
+func (a *app) bounceUnread(tx store.TxStore, ag model.Agent, fallback string, msgs []model.Event) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	receipt := newInboxReceipt(ag.ID, ag.Clock, msgs)
+	if err := receipt.write(tx); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	var c clock.Clock
+	for _, m := range msgs {
+		ts, err := tickIn(tx, ag.ID, &c, ag.Epoch, ag.Round)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.InsertEvent(&model.Event{
+			AgentID:    ag.ID,
+			LamportTS:  ts,
+			Epoch:      ag.Epoch,
+			Round:      ag.Round,
+			Kind:       model.EventMsg,
+			Target:     fallback,
+			Body:       fmt.Sprintf("(bounced from %s; %s from %s) %s", ag.ID, m.Kind, m.AgentID, m.Body),
+			CreatedAt:  now,
+			Priority:   m.Priority,
+			Provenance: a.prov,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// autoReap applies the reap policy before a command when reap.auto is
+// set, sparing the invoking agent. It only reports failures: the command
+// runs regardless.
+func (a *app) autoReap(command string) {
+	if a.cfg.Int("reap.auto") == 0 {
+		return
+	}
+	switch command {
+	case "init", "reap", "migrate", "snapshot", "config":
+		return
+	}
+	p := a.reapPolicy()
+	idle, err := a.reapable(p, a.agentID)
+	if err != nil {
+		a.logger().Warn("reap policy", "err", err)
+		return
+	}
+	for _, ag := range idle {
+		r, err := a.reap(ag, p)
+		if errors.Is(err, store.ErrNotAdmin) {
+			// Left to an admin's commands.
+			a.logger().Debug("reap policy", "err", err)
+			return
+		}
+		if err != nil {
+			a.logger().Warn("reap policy", "agent", ag.ID, "err", err)
+			continue
+		}
+		a.logger().Info("reaped idle agent", "agent", ag.ID, "summary", r.summary)
+	}
+}
+
+// depart marks agentID departed and logs a departed event describing it.
+func (a *app) depart(agentID, reason string) (*store.Departure, int64, error) {
+	d, err := a.store.DepartAgent(agentID)
+	if err != nil {
+		return nil, 0, err
+	}
+	ts, err := a.recordEvent(agentID, model.EventDeparted, "", departureSummary(reason, d))
+	if err != nil {
+		a.logger().Warn("record departed event", "agent", agentID, "err", err)
+	}
+	a.recordFrontier()
+	return d, ts, nil
+}
+
+// departureSummary describes a departure for the log, e.g.
+// "departed: released 2 lock(s) (a.go, b.go); 3 unread (bob: 2, carol: 1)".
+func departureSummary(reason string, d *store.Departure) string {
+	var b strings.Builder
+	b.WriteString(reason)
+	fmt.Fprintf(&b, ": released %d lock(s)", len(d.Locks))
+	if len(d.Locks) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(d.Locks, ", "))
+	}
+	senders := make([]string, 0, len(d.Unread))
+	total := 0
+	for from, n := range d.Unread {
+		senders = append(senders, fmt.Sprintf("%s: %d", from, n))
+		total += n
+	}
+	sort.Strings(senders)
+	fmt.Fprintf(&b, "; %d unread", total)
+	if total > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(senders, ", "))
+	}
+	return b.String()
+}
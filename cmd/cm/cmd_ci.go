@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/frontier"
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// cmdCI brings agent coordination into CI jobs, GitHub Actions in
+// particular. Both subcommands are non-interactive and need no agent ID:
+// CI watches the frontier rather than taking part in it.
+//
+// ci gate waits for an epoch like cm gate, with exit codes a job can
+// branch on, and writes a summary of the outcome to the job's step
+// summary ($GITHUB_STEP_SUMMARY) and safe=true|false to its step outputs
+// ($GITHUB_OUTPUT). ci annotate posts the frontier and the reviews of the
+// commit as a commit status, and optionally a pull request comment, using
+// $GITHUB_TOKEN.
+//
+// Usage:
+//
+//	cm ci gate --epoch N [--round R] [--timeout 20m] [--json]
+//	cm ci annotate --epoch N [--sha SHA] [--comment [--pr N]] [--dry-run] [--json]
+//
+// Exit codes (ci gate):
+//
+//	0 = epoch is safe
+//	1 = error or interrupted
+//	2 = still not safe when --timeout ran out
+func (a *app) cmdCI(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm ci <gate|annotate> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "gate":
+		return a.ciGate(args[1:])
+	case "annotate":
+		return a.ciAnnotate(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: ci: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+// ciReport is the coordination state cm ci reports for an epoch and,
+// for annotate, a commit.
+type ciReport struct {
+	Epoch     int64              `json:"epoch"`
+	Round     int64              `json:"round"`
+	Safe      bool               `json:"safe"`
+	BlockedBy []model.Pointstamp `json:"blocked_by"`
+	Commit    string             `json:"commit,omitempty"`
+	Reviews   []model.Review     `json:"reviews,omitempty"`
+	Waited    string             `json:"waited,omitempty"`
+	Reason    string             `json:"reason,omitempty"` // "timeout" when ci gate gave up
+}
+
+// ciReportFor computes the report for ts as seen by agentID ("" for an
+// observer), with the reviews of commit if it is set.
+func (a *app) ciReportFor(agentID string, ts model.Timestamp, commit string) (*ciReport, error) {
+	active, err := a.store.GetActivePointstamps(0)
+	if err != nil {
+		return nil, err
+	}
+	st := frontier.ComputeFrontierStatus(agentID, ts, active)
+	r := &ciReport{Epoch: ts.Epoch, Round: ts.Round, Safe: st.SafeToFinalize,
+		BlockedBy: st.BlockedBy, Commit: commit}
+	if r.BlockedBy == nil {
+		r.BlockedBy = []model.Pointstamp{}
+	}
+	if commit != "" {
+		if r.Reviews, err = a.store.ListReviews(commit); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// blockers lists the blocking agents as "alice@3.1".
+func (r *ciReport) blockers() string {
+	parts := make([]string, len(r.BlockedBy))
+	for i, p := range r.BlockedBy {
+		parts[i] = fmt.Sprintf("%s@%d.%d", p.Who(), p.Timestamp.Epoch, p.Timestamp.Round)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// state is the commit status for the report: failure if a review of the
+// commit failed or asked for changes, pending while the epoch is not
+// safe or a review is outstanding, success otherwise.
+func (r *ciReport) state() string {
+	pending := !r.Safe
+	for _, rv := range r.Reviews {
+		switch rv.State {
+		case model.ReviewFailed, model.ReviewChangesRequested:
+			return "failure"
+		case model.ReviewPending:
+			pending = true
+		}
+	}
+	if pending {
+		return "pending"
+	}
+	return "success"
+}
+
+// description is the one-line commit status description. GitHub cuts
+// them off at 140 characters.
+func (r *ciReport) description() string {
+	var d string
+	if r.Safe {
+		d = fmt.Sprintf("epoch %d.%d safe", r.Epoch, r.Round)
+	} else {
+		d = fmt.Sprintf("epoch %d.%d blocked by %s", r.Epoch, r.Round, r.blockers())
+	}
+	counts := map[model.ReviewState]int{}
+	for _, rv := range r.Reviews {
+		counts[rv.State]++
+	}
+	var rs []string
+	for _, s := range []model.ReviewState{model.ReviewPassed, model.ReviewPending, model.ReviewFailed, model.ReviewChangesRequested} {
+		if counts[s] > 0 {
+			rs = append(rs, fmt.Sprintf("%d %s", counts[s], strings.ReplaceAll(string(s), "_", " ")))
+		}
+	}
+	if len(rs) > 0 {
+		d += "; reviews: " + strings.Join(rs, ", ")
+	}
+	if len(d) > 140 {
+		d = d[:137] + "..."
+	}
+	return d
+}
+
+// markdown renders the report for a step summary or a PR comment.
+func (r *ciReport) markdown() string {
+	var b strings.Builder
+	verdict := "safe"
+	if !r.Safe {
+		verdict = "not safe"
+		if r.Reason == "timeout" {
+			verdict += " (gave up after " + r.Waited + ")"
+		}
+	}
+	fmt.Fprintf(&b, "### clockmail: epoch %d round %d is %s\n\n", r.Epoch, r.Round, verdict)
+	if len(r.BlockedBy) > 0 {
+		b.WriteString("Waiting on:\n\n| agent | epoch | round |\n|---|---|---|\n")
+		for _, p := range r.BlockedBy {
+			fmt.Fprintf(&b, "| %s | %d | %d |\n", p.Who(), p.Timestamp.Epoch, p.Timestamp.Round)
+		}
+		b.WriteString("\n")
+	} else if r.Safe {
+		b.WriteString("Every agent has moved past it.\n\n")
+	}
+	if r.Commit != "" {
+		if len(r.Reviews) == 0 {
+			fmt.Fprintf(&b, "No reviews of `%s` recorded.\n", shortSHA(r.Commit))
+		} else {
+			fmt.Fprintf(&b, "Reviews of `%s`:\n\n| reviewer | state | comment |\n|---|---|---|\n", shortSHA(r.Commit))
+			for _, rv := range r.Reviews {
+				comment := strings.ReplaceAll(strings.ReplaceAll(rv.Comment, "\n", " "), "|", `\|`)
+				fmt.Fprintf(&b, "| %s | %s | %s |\n", rv.Reviewer, rv.State, comment)
+			}
+		}
+	}
+	return b.String()
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+func (a *app) ciGate(args []string) int {
+	flags := flag.NewFlagSet("ci gate", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent the job runs as, whose own position is ignored (default: none)")
+	epoch := flags.Int64("epoch", 0, "epoch to wait for")
+	round := flags.Int64("round", 0, "round to wait for")
+	timeout := flags.Duration("timeout", 20*time.Minute, "how long to wait before failing with exit 2")
+	interval := flags.Duration("interval", a.cfg.Duration("poll.gate_interval"), "poll interval")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	agentID := *agent
+	if agentID == "" {
+		agentID = a.agentID
+	}
+	ts := model.Timestamp{Epoch: *epoch, Round: *round}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	start := time.Now()
+	deadline := start.Add(*timeout)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var r *ciReport
+	lastBlockers := ""
+	for {
+		var err error
+		if r, err = a.ciReportFor(agentID, ts, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: ci gate: %v\n", err)
+			return 1
+		}
+		if r.Safe {
+			break
+		}
+		// CI logs are read afterwards: say who is being waited on
+		// whenever that changes, not on every poll.
+		if bl := r.blockers(); bl != lastBlockers && !*jsonOut {
+			fmt.Fprintf(os.Stderr, "waiting for epoch=%d round=%d: blocked by %s\n", ts.Epoch, ts.Round, bl)
+			lastBlockers = bl
+		}
+		if !time.Now().Before(deadline) {
+			r.Reason = "timeout"
+			break
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(os.Stderr, "cm: ci gate: interrupted")
+			return 1
+		case <-ticker.C:
+		}
+	}
+	r.Waited = time.Since(start).Round(time.Second).String()
+
+	if err := ciStepSummary(r.markdown()); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: ci gate: step summary: %v\n", err)
+	}
+	if err := ciStepOutputs(map[string]string{"safe": strconv.FormatBool(r.Safe), "blocked_by": r.blockers()}); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: ci gate: step outputs: %v\n", err)
+	}
+
+	switch {
+	case *jsonOut:
+		printJSON(r)
+	case r.Safe:
+		fmt.Printf("SAFE: epoch=%d round=%d (waited %s)\n", ts.Epoch, ts.Round, r.Waited)
+	default:
+		msg := fmt.Sprintf("epoch=%d round=%d not safe after %s: blocked by %s", ts.Epoch, ts.Round, r.Waited, r.blockers())
+		if os.Getenv("GITHUB_ACTIONS") == "true" {
+			fmt.Printf("::error title=clockmail gate::%s\n", msg)
+		}
+		fmt.Printf("NOT SAFE: %s\n", msg)
+	}
+	if !r.Safe {
+		return 2
+	}
+	return 0
+}
+
+// ciStepSummary appends markdown to the job's step summary, if it has
+// one.
+func ciStepSummary(markdown string) error {
+	return appendGitHubFile("GITHUB_STEP_SUMMARY", markdown+"\n")
+}
+
+// ciStepOutputs sets the step's outputs, if it has an outputs file.
+func ciStepOutputs(outputs map[string]string) error {
+	var b strings.Builder
+	for _, k := range []string{"safe", "blocked_by"} {
+		if v, ok := outputs[k]; ok {
+			fmt.Fprintf(&b, "%s=%s\n", k, v)
+		}
+	}
+	return appendGitHubFile("GITHUB_OUTPUT", b.String())
+}
+
+func appendGitHubFile(env, text string) error {
+	path := os.Getenv(env)
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ciPullRef matches the ref of a pull_request workflow run.
+var ciPullRef = regexp.MustCompile(`^refs/pull/(\d+)/`)
+
+func (a *app) ciAnnotate(args []string) int {
+	flags := flag.NewFlagSet("ci annotate", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent the job runs as, whose own position is ignored (default: none)")
+	epoch := flags.Int64("epoch", 0, "epoch to report on")
+	round := flags.Int64("round", 0, "round to report on")
+	sha := flags.String("sha", os.Getenv("GITHUB_SHA"), "commit to annotate (default $GITHUB_SHA)")
+	repo := flags.String("repo", os.Getenv("GITHUB_REPOSITORY"), "owner/name (default $GITHUB_REPOSITORY)")
+	statusCtx := flags.String("context", "clockmail/frontier", "commit status context")
+	noStatus := flags.Bool("no-status", false, "do not post a commit status")
+	comment := flags.Bool("comment", false, "also comment on the pull request")
+	pr := flags.Int("pr", 0, "pull request to comment on (default: from $GITHUB_REF)")
+	dryRun := flags.Bool("dry-run", false, "print what would be posted instead of posting it")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *sha == "" || *repo == "" {
+		fmt.Fprintln(os.Stderr, "cm: ci annotate: need --sha and --repo (or $GITHUB_SHA and $GITHUB_REPOSITORY)")
+		return 1
+	}
+	if *comment && *pr == 0 {
+		if m := ciPullRef.FindStringSubmatch(os.Getenv("GITHUB_REF")); m != nil {
+			*pr, _ = strconv.Atoi(m[1])
+		}
+		if *pr == 0 {
+			fmt.Fprintln(os.Stderr, "cm: ci annotate: --comment needs --pr (not a pull_request run)")
+			return 1
+		}
+	}
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" && !*dryRun {
+		fmt.Fprintln(os.Stderr, "cm: ci annotate: GITHUB_TOKEN is not set")
+		return 1
+	}
+	agentID := *agent
+	if agentID == "" {
+		agentID = a.agentID
+	}
+
+	r, err := a.ciReportFor(agentID, model.Timestamp{Epoch: *epoch, Round: *round}, *sha)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: ci annotate: %v\n", err)
+		return 1
+	}
+
+	gh := githubAPI{base: envOr("GITHUB_API_URL", "https://api.github.com"), token: token}
+	var posted []githubPost
+	if !*noStatus {
+		posted = append(posted, githubPost{
+			Path: fmt.Sprintf("/repos/%s/statuses/%s", *repo, *sha),
+			Body: map[string]string{"state": r.state(), "description": r.description(), "context": *statusCtx},
+		})
+	}
+	if *comment {
+		posted = append(posted, githubPost{
+			Path: fmt.Sprintf("/repos/%s/issues/%d/comments", *repo, *pr),
+			Body: map[string]string{"body": r.markdown()},
+		})
+	}
+	if !*dryRun {
+		for _, p := range posted {
+			if err := gh.post(p.Path, p.Body); err != nil {
+				fmt.Fprintf(os.Stderr, "cm: ci annotate: %v\n", err)
+				return 1
+			}
+		}
+	}
+
+	if *jsonOut {
+		if posted == nil {
+			posted = []githubPost{}
+		}
+		printJSON(map[string]interface{}{"report": r, "state": r.state(), "posted": posted, "dry_run": *dryRun})
+		return 0
+	}
+	verb := "posted"
+	if *dryRun {
+		verb = "would post"
+	}
+	if !*noStatus {
+		fmt.Printf("%s commit status %s on %s@%s (%s): %s\n", verb, r.state(), *repo, shortSHA(*sha), *statusCtx, r.description())
+	}
+	if *comment {
+		fmt.Printf("%s comment on %s#%d\n", verb, *repo, *pr)
+		if *dryRun {
+			fmt.Print(r.markdown())
+		}
+	}
+	return 0
+}
+
+// githubPost is one request cm ci annotate makes.
+type githubPost struct {
+	Path string            `json:"path"`
+	Body map[string]string `json:"body"`
+}
+
+// githubAPI is the little of the GitHub REST API cm ci annotate uses.
+type githubAPI struct {
+	base  string
+	token string
+}
+
+var githubClient = &http.Client{Timeout: 30 * time.Second}
+
+func (g githubAPI) post(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(g.base, "/") + path
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("POST %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
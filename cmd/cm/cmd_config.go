@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/config"
+)
+
+// configPath is the project configuration file: CLOCKMAIL_CONFIG, or
+// .clockmail/config.toml.
+func configPath() string {
+	return envOr("CLOCKMAIL_CONFIG", workspacePath("config.toml"))
+}
+
+// cmdConfig reads and changes the project configuration file, which sets
+// defaults for flags teams would otherwise pass on every invocation (see
+// package config for the settings). Flags still override it.
+//
+// Usage:
+//
+//	cm config [list] [--json]
+//	cm config get <key> [--json]
+//	cm config set <key> <value>
+//	cm config unset <key>
+func (a *app) cmdConfig(args []string) int {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		return a.configList(args)
+	}
+	switch args[0] {
+	case "list", "ls":
+		return a.configList(args[1:])
+	case "get":
+		return a.configGet(args[1:])
+	case "set":
+		return a.configSet(args[1:])
+	case "unset":
+		return a.configUnset(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: config: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+// configSetting is one setting as cm config list reports it.
+type configSetting struct {
+	config.Key
+	Value string `json:"value"`
+	Set   bool   `json:"set"` // in the file, rather than the default
+}
+
+func (a *app) configList(args []string) int {
+	flags := flag.NewFlagSet("config list", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	var settings []configSetting
+	for _, k := range config.Keys {
+		v, set := a.cfg.Get(k.Name)
+		settings = append(settings, configSetting{Key: k, Value: v, Set: set})
+	}
+	for _, name := range a.cfg.Names() {
+		if strings.HasPrefix(name, config.TemplatePrefix) {
+			k, _ := config.Lookup(name)
+			settings = append(settings, configSetting{Key: k, Value: a.cfg.String(name), Set: true})
+		}
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"path": configPath(), "settings": settings})
+		return 0
+	}
+	fmt.Printf("# %s\n", configPath())
+	for _, s := range settings {
+		source := "default"
+		if s.Set {
+			source = "set"
+		}
+		fmt.Printf("%-22s %-8s %-8s %s\n", s.Name, strings.ReplaceAll(s.Value, "\n", `\n`), source, s.Doc)
+	}
+	return 0
+}
+
+func (a *app) configGet(args []string) int {
+	flags := flag.NewFlagSet("config get", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm config get <key> [--json]")
+		return 1
+	}
+	k, ok := config.Lookup(flags.Arg(0))
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cm: config: %v %q (cm config list shows them all)\n", config.ErrUnknownKey, flags.Arg(0))
+		return 1
+	}
+	v, set := a.cfg.Get(k.Name)
+	if *jsonOut {
+		printJSON(configSetting{Key: k, Value: v, Set: set})
+		return 0
+	}
+	fmt.Println(v)
+	return 0
+}
+
+func (a *app) configSet(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: cm config set <key> <value>")
+		return 1
+	}
+	cfg, err := config.Load(configPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: config: %v\n", err)
+		return 1
+	}
+	if err := cfg.Set(args[0], args[1]); err != nil {
+		if errors.Is(err, config.ErrUnknownKey) {
+			fmt.Fprintf(os.Stderr, "cm: config: %v (cm config list shows them all)\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "cm: config: %v\n", err)
+		}
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: config: %v\n", err)
+		return 1
+	}
+	if err := cfg.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: config: %v\n", err)
+		return 1
+	}
+	a.cfg = cfg
+	fmt.Printf("%s = %s (%s)\n", args[0], args[1], cfg.Path)
+	return 0
+}
+
+func (a *app) configUnset(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm config unset <key>")
+		return 1
+	}
+	if _, ok := config.Lookup(args[0]); !ok {
+		fmt.Fprintf(os.Stderr, "cm: config: %v %q (cm config list shows them all)\n", config.ErrUnknownKey, args[0])
+		return 1
+	}
+	cfg, err := config.Load(configPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: config: %v\n", err)
+		return 1
+	}
+	if !cfg.Unset(args[0]) {
+		fmt.Printf("%s was not set\n", args[0])
+		return 0
+	}
+	if err := cfg.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: config: %v\n", err)
+		return 1
+	}
+	a.cfg = cfg
+	fmt.Printf("%s reset to the default, %s\n", args[0], cfg.String(args[0]))
+	return 0
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/worktree"
+)
+
+// fileConflict is a changed file covered by another agent's lock.
+type fileConflict struct {
+	Path      string    `json:"path"`
+	Holder    string    `json:"holder"`
+	Lock      string    `json:"lock"` // locked path as recorded; may be a directory
+	LamportTS int64     `json:"lamport_ts"`
+	At        time.Time `json:"at"` // lock expiry, or when the lock was requested
+}
+
+// cmdConflicts compares the files changed in the git working tree with
+// the locks table, catching edits made without coordination before they
+// are committed or pushed. A changed file is a conflict if another agent
+// holds a lock covering it (exit 2), a warning if another agent requested
+// a lock on it within --since, and unlocked if nobody locked it.
+//
+// With --staged only the files staged for the next commit are checked;
+// the pre-commit hook installed by cm hook install runs it that way.
+//
+// Lock paths are read relative to --dir, which should be where agents run
+// cm (normally the repository root).
+//
+// Usage: cm conflicts [--base REV | --staged] [--since 1h] [--dir .] [--json]
+func (a *app) cmdConflicts(args []string) int {
+	flags := flag.NewFlagSet("conflicts", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent whose working tree is checked")
+	base := flags.String("base", "", "also count files changed since this git revision (e.g. main)")
+	staged := flags.Bool("staged", false, "only check files staged for commit")
+	since := flags.Duration("since", time.Hour, "warn about lock requests made within this window")
+	dir := flags.String("dir", ".", "directory inside the git working tree")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	if *staged && *base != "" {
+		fmt.Fprintln(os.Stderr, "cm: conflicts: --staged and --base are mutually exclusive")
+		return 1
+	}
+
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	absDir, err := filepath.Abs(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: conflicts: %v\n", err)
+		return 1
+	}
+	repo, err := worktree.Open(absDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: conflicts: %v\n", err)
+		return 1
+	}
+	var changed []string
+	if *staged {
+		changed, err = repo.Staged()
+	} else {
+		changed, err = repo.Changed(*base)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: conflicts: %v\n", err)
+		return 1
+	}
+	locks, err := a.store.ListLocks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: conflicts: %v\n", err)
+		return 1
+	}
+	requests, err := a.store.ListLockRequests(time.Now().Add(-*since))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: conflicts: %v\n", err)
+		return 1
+	}
+
+	// Relative lock paths are relative to the repository root (see
+	// lockpath.go), whichever worktree they were taken in.
+	conflicts, warnings := []fileConflict{}, []fileConflict{}
+	unlocked := []string{}
+	for _, f := range changed {
+		c, mine, locked := lockCovering(repo, repo.Root, agentID, f, locks)
+		if locked {
+			conflicts = append(conflicts, c)
+			continue
+		}
+		if mine {
+			continue
+		}
+		if w, ok := requestCovering(repo, repo.Root, agentID, f, requests); ok {
+			warnings = append(warnings, w)
+			continue
+		}
+		unlocked = append(unlocked, f)
+	}
+
+	var actions []nextAction
+	for _, c := range conflicts {
+		actions = append(actions, nextAction{
+			Command: fmt.Sprintf("cm send %s %q", c.Holder, "I have changes to "+c.Path+", which you hold locked"),
+			Reason:  "coordinate before either of you commits " + c.Path,
+		})
+	}
+	for _, f := range unlocked {
+		actions = append(actions, nextAction{Command: "cm lock " + f, Reason: "claim a file you are editing"})
+	}
+
+	code := 0
+	if len(conflicts) > 0 {
+		code = 2
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{
+			"agent_id": agentID, "root": repo.Root, "changed": len(changed),
+			"conflicts": conflicts, "warnings": warnings, "unlocked": unlocked,
+			"next_actions": actions,
+		})
+		return code
+	}
+
+	for _, c := range conflicts {
+		fmt.Printf("CONFLICT %s: locked by %s (lock %s, ts=%d)\n", c.Path, c.Holder, c.Lock, c.LamportTS)
+	}
+	for _, w := range warnings {
+		fmt.Printf("warning  %s: %s requested a lock %s ago (ts=%d)\n",
+			w.Path, w.Holder, time.Since(w.At).Round(time.Second), w.LamportTS)
+	}
+	for _, f := range unlocked {
+		fmt.Printf("unlocked %s\n", f)
+	}
+	if len(conflicts)+len(warnings)+len(unlocked) == 0 {
+		fmt.Printf("no conflicts (%d changed file(s), all locked by %s)\n", len(changed), agentID)
+	}
+	printHints(actions)
+	return code
+}
+
+// lockCovering finds another agent's lock covering file. mine reports
+// whether agentID itself holds a covering lock.
+func lockCovering(repo *worktree.Repo, dir, agentID, file string, locks []model.Lock) (c fileConflict, mine, ok bool) {
+	for _, l := range locks {
+		p, in := repo.Rel(dir, l.Path)
+		if !in || !worktree.Covers(p, file) {
+			continue
+		}
+		if l.AgentID == agentID {
+			mine = true
+			continue
+		}
+		if !ok {
+			c = fileConflict{Path: file, Holder: l.AgentID, Lock: l.Path, LamportTS: l.LamportTS, At: l.ExpiresAt}
+			ok = true
+		}
+	}
+	return c, mine, ok
+}
+
+// requestCovering finds the latest lock request by another agent covering
+// file.
+func requestCovering(repo *worktree.Repo, dir, agentID, file string, requests []model.Event) (fileConflict, bool) {
+	for i := len(requests) - 1; i >= 0; i-- {
+		e := requests[i]
+		if e.AgentID == agentID {
+			continue
+		}
+		if p, in := repo.Rel(dir, e.Target); in && worktree.Covers(p, file) {
+			return fileConflict{Path: file, Holder: e.AgentID, Lock: e.Target, LamportTS: e.LamportTS, At: e.CreatedAt}, true
+		}
+	}
+	return fileConflict{}, false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// cmdCRDT updates and reads grow-only counters and sets, for metrics
+// many agents aggregate at once. Unlike cm kv, where concurrent writes
+// overwrite each other, updates only add: each agent increments its own
+// slot of a counter, whose value is the sum, and set additions merge by
+// union, so no update is lost whatever order they land in. Each update is
+// also a crdt event in the log.
+//
+// Usage:
+//
+//	cm crdt incr tests_passed [N]
+//	cm crdt add flaky_tests TestFoo [TestBar...]
+//	cm crdt get tests_passed        # prints the value, or a set's elements
+//	cm crdt list
+func (a *app) cmdCRDT(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm crdt <incr|add|get|list> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "incr":
+		return a.crdtIncr(args[1:])
+	case "add":
+		return a.crdtAdd(args[1:])
+	case "get":
+		return a.crdtGet(args[1:])
+	case "list", "ls":
+		return a.crdtList(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: crdt: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) crdtIncr(args []string) int {
+	const usage = "usage: cm crdt incr <counter> [N] [--json]"
+	flags := flag.NewFlagSet("crdt incr", flag.ContinueOnError)
+	agent := flags.String("agent", "", "incrementing agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) < 1 || len(words) > 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	name, delta := words[0], int64(1)
+	if len(words) == 2 {
+		n, err := strconv.ParseInt(words[1], 10, 64)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "cm: crdt incr: %q is not a positive number (counters only grow)\n", words[1])
+			return 1
+		}
+		delta = n
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	c, err := a.store.IncrCounter(name, agentID, delta)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: crdt incr: %v\n", err)
+		return 1
+	}
+	ts, err := a.recordEvent(agentID, model.EventCRDT, name, "incr "+strconv.FormatInt(delta, 10))
+	if err != nil {
+		a.logger().Warn("record crdt event", "verb", "incr", "err", err)
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"counter": c, "lamport_ts": ts})
+	} else {
+		fmt.Printf("%s = %d (+%d by %s, ts=%d)\n", name, c.Value, delta, agentID, ts)
+	}
+	return 0
+}
+
+func (a *app) crdtAdd(args []string) int {
+	flags := flag.NewFlagSet("crdt add", flag.ContinueOnError)
+	agent := flags.String("agent", "", "adding agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: cm crdt add <set> <element>... [--json]")
+		return 1
+	}
+	name, elems := words[0], words[1:]
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	// Check before logging so a rejected add leaves no trace in the log;
+	// AddToSet re-checks atomically.
+	if _, err := a.store.GetCounter(name); err == nil {
+		fmt.Fprintf(os.Stderr, "cm: crdt add: %q is a counter\n", name)
+		return 1
+	}
+	ts, err := a.recordEvent(agentID, model.EventCRDT, name, "add "+strings.Join(elems, " "))
+	if err != nil {
+		a.logger().Warn("record crdt event", "verb", "add", "err", err)
+	}
+	set, added, err := a.store.AddToSet(name, agentID, ts, elems)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: crdt add: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"set": set, "added": added, "lamport_ts": ts})
+	} else {
+		fmt.Printf("%s: added %d of %d (%d elements, ts=%d)\n", name, added, len(elems), len(set.Elements), ts)
+	}
+	return 0
+}
+
+func (a *app) crdtGet(args []string) int {
+	flags := flag.NewFlagSet("crdt get", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm crdt get <name> [--json]")
+		return 1
+	}
+	name := words[0]
+	c, err := a.store.GetCounter(name)
+	if err == nil {
+		if *jsonOut {
+			printJSON(c)
+		} else {
+			fmt.Println(c.Value)
+		}
+		return 0
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "cm: crdt get: %v\n", err)
+		return 1
+	}
+	set, err := a.store.GetSet(name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fmt.Errorf("no counter or set named %s", name)
+		}
+		fmt.Fprintf(os.Stderr, "cm: crdt get: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(set)
+	} else {
+		for _, el := range set.Elements {
+			fmt.Println(el)
+		}
+	}
+	return 0
+}
+
+func (a *app) crdtList(args []string) int {
+	flags := flag.NewFlagSet("crdt list", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	counters, sets, err := a.store.ListCRDTs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: crdt list: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		if counters == nil {
+			counters = []model.GCounter{}
+		}
+		if sets == nil {
+			sets = []model.GSet{}
+		}
+		printJSON(map[string]interface{}{"counters": counters, "sets": sets})
+		return 0
+	}
+	if len(counters) == 0 && len(sets) == 0 {
+		fmt.Println("no counters or sets")
+		return 0
+	}
+	for _, c := range counters {
+		agents := make([]string, 0, len(c.Slots))
+		for agent := range c.Slots {
+			agents = append(agents, agent)
+		}
+		sort.Strings(agents)
+		slots := make([]string, len(agents))
+		for i, agent := range agents {
+			slots[i] = fmt.Sprintf("%s:%d", agent, c.Slots[agent])
+		}
+		fmt.Printf("counter %-20s %d  (%s)\n", c.Name, c.Value, strings.Join(slots, " "))
+	}
+	for _, s := range sets {
+		fmt.Printf("set     %-20s %d  {%s}\n", s.Name, len(s.Elements), strings.Join(s.Elements, ", "))
+	}
+	return 0
+}
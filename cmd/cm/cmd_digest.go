@@ -0,0 +1,272 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+	"github.com/daviddao/clockmail/pkg/seal"
+)
+
+// agentDigest summarizes one agent's part in a stretch of the log.
+type agentDigest struct {
+	Agent    string         `json:"agent"`
+	Events   int            `json:"events"`
+	Kinds    map[string]int `json:"kinds"`
+	Sent     int            `json:"messages_sent"`
+	SentTo   map[string]int `json:"sent_to,omitempty"`
+	Received int            `json:"messages_received"`
+	// EpochFrom and EpochTo are the lowest and highest epochs of the
+	// agent's events in the window; Epoch and Round are where its clock
+	// stands now.
+	EpochFrom   int64          `json:"epoch_from"`
+	EpochTo     int64          `json:"epoch_to"`
+	Epoch       int64          `json:"epoch"`
+	Round       int64          `json:"round"`
+	Departed    bool           `json:"departed,omitempty"`
+	LastLock    *digestLock    `json:"last_lock,omitempty"`
+	LastMessage *digestMessage `json:"last_message,omitempty"`
+}
+
+type digestLock struct {
+	LamportTS int64  `json:"lamport_ts"`
+	Action    string `json:"action"` // locked, released or renewed
+	Path      string `json:"path"`
+}
+
+type digestMessage struct {
+	LamportTS int64  `json:"lamport_ts"`
+	To        string `json:"to"`
+	Body      string `json:"body"`
+}
+
+// digestExcerpt is how much of a message body a digest quotes.
+const digestExcerpt = 80
+
+// cmdDigest summarizes recent history per agent: how many messages each
+// sent and received, what else it did by event kind, its last lock
+// activity and last message, and how far its epoch moved. It is meant to
+// prime an agent with what happened while it was away, in a few lines
+// per teammate rather than hundreds of raw events.
+//
+// --since takes a Lamport timestamp (events with lamport_ts >= N) or a
+// duration (events written within it).
+//
+// Usage: cm digest [--since 1h|N] [--json]
+func (a *app) cmdDigest(args []string) int {
+	flags := flag.NewFlagSet("digest", flag.ContinueOnError)
+	since := flags.String("since", "1h", "Lamport timestamp or duration to summarize from")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	src, sinceTS, err := digestWindow(*since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: digest: %v\n", err)
+		return 1
+	}
+	lf := logFilter{src: src}
+	if lf.query, err = query.Parse(src); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: digest: %v\n", err)
+		return 1
+	}
+	events, err := a.readLog(lf, sinceTS)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: digest: %v\n", err)
+		return 1
+	}
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: digest: %v\n", err)
+		return 1
+	}
+	digests := buildDigest(events, agents)
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{
+			"since":  *since,
+			"events": len(events),
+			"agents": digests,
+		})
+		return 0
+	}
+	if len(digests) == 0 {
+		fmt.Printf("no events since %s\n", *since)
+		return 0
+	}
+	fmt.Printf("digest since %s (%d event(s), %d agent(s))\n", *since, len(events), len(digests))
+	for _, d := range digests {
+		printDigest(d)
+	}
+	return 0
+}
+
+// digestWindow turns --since into a query and a Lamport lower bound: a
+// bare integer is a timestamp, anything else must be a duration.
+func digestWindow(since string) (src string, sinceTS int64, err error) {
+	if ts, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return "", ts, nil
+	}
+	d, err := time.ParseDuration(since)
+	if err != nil || d <= 0 {
+		return "", 0, fmt.Errorf("--since: want a Lamport timestamp or a duration like 30m, got %q", since)
+	}
+	return "age<" + d.String(), 0, nil
+}
+
+// readLog returns every event matching lf with lamport_ts >= sinceTS, in
+// total order, reading the log a page at a time.
+func (a *app) readLog(lf logFilter, sinceTS int64) ([]model.Event, error) {
+	const page = 500
+	q := lf.query
+	var out []model.Event
+	for {
+		events, err := a.store.QueryEvents(q, sinceTS, page)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, events...)
+		if len(events) < page {
+			return out, nil
+		}
+		last := events[len(events)-1]
+		if q, err = lf.after(fmt.Sprintf("ts>%d or (ts=%d and id>%d)", last.LamportTS, last.LamportTS, last.ID)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// buildDigest folds events, in total order, into one digest per agent
+// that sent or was sent something, sorted by agent ID. agents supplies
+// current clocks and departures.
+func buildDigest(events []model.Event, agents []model.Agent) []agentDigest {
+	byID := make(map[string]*agentDigest)
+	get := func(id string) *agentDigest {
+		d, ok := byID[id]
+		if !ok {
+			d = &agentDigest{Agent: id, Kinds: map[string]int{}, EpochFrom: -1, EpochTo: -1}
+			byID[id] = d
+		}
+		return d
+	}
+	registered := make(map[string]model.Agent, len(agents))
+	for _, ag := range agents {
+		registered[ag.ID] = ag
+	}
+
+	for _, e := range events {
+		d := get(e.AgentID)
+		d.Events++
+		d.Kinds[string(e.Kind)]++
+		if d.EpochFrom < 0 || e.Epoch < d.EpochFrom {
+			d.EpochFrom = e.Epoch
+		}
+		d.EpochTo = max(d.EpochTo, e.Epoch)
+
+		switch e.Kind {
+		case model.EventMsg:
+			d.Sent++
+			if d.SentTo == nil {
+				d.SentTo = map[string]int{}
+			}
+			d.SentTo[e.Target]++
+			d.LastMessage = &digestMessage{LamportTS: e.LamportTS, To: e.Target, Body: excerpt(e.Body)}
+			if _, ok := registered[e.Target]; ok {
+				get(e.Target).Received++
+			}
+		case model.EventLockReq:
+			d.LastLock = &digestLock{e.LamportTS, "locked", e.Target}
+		case model.EventLockRel:
+			d.LastLock = &digestLock{e.LamportTS, "released", e.Target}
+		case model.EventLockRenew:
+			d.LastLock = &digestLock{e.LamportTS, "renewed", e.Target}
+		}
+	}
+
+	out := make([]agentDigest, 0, len(byID))
+	for id, d := range byID {
+		if ag, ok := registered[id]; ok {
+			d.Epoch, d.Round = ag.Epoch, ag.Round
+			d.Departed = ag.DepartedAt != nil
+		}
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Agent < out[j].Agent })
+	return out
+}
+
+// excerpt shortens a message body to one line of at most digestExcerpt
+// runes. Sealed bodies are not quoted.
+func excerpt(body string) string {
+	if seal.IsSealed(body) {
+		return "[sealed]"
+	}
+	body = strings.Join(strings.Fields(body), " ")
+	if r := []rune(body); len(r) > digestExcerpt {
+		body = string(r[:digestExcerpt-3]) + "..."
+	}
+	return body
+}
+
+func printDigest(d agentDigest) {
+	status := ""
+	if d.Departed {
+		status = " (departed)"
+	}
+	epochs := fmt.Sprintf("epoch %d", d.EpochTo)
+	switch {
+	case d.Events == 0:
+		epochs = fmt.Sprintf("epoch %d", d.Epoch)
+	case d.EpochFrom != d.EpochTo:
+		epochs = fmt.Sprintf("epoch %d->%d", d.EpochFrom, d.EpochTo)
+	}
+	fmt.Printf("\n%s%s: %s, now at %d.%d\n", d.Agent, status, epochs, d.Epoch, d.Round)
+
+	msgs := fmt.Sprintf("  messages: %d sent", d.Sent)
+	if len(d.SentTo) > 0 {
+		msgs += " (" + countList(d.SentTo) + ")"
+	}
+	fmt.Printf("%s, %d received\n", msgs, d.Received)
+
+	other := make(map[string]int, len(d.Kinds))
+	for k, n := range d.Kinds {
+		if k != string(model.EventMsg) {
+			other[k] = n
+		}
+	}
+	if len(other) > 0 {
+		fmt.Printf("  activity: %s\n", countList(other))
+	}
+	if l := d.LastLock; l != nil {
+		fmt.Printf("  last lock: %s %s [ts=%d]\n", l.Action, l.Path, l.LamportTS)
+	}
+	if m := d.LastMessage; m != nil {
+		fmt.Printf("  last said: [ts=%d] -> %s: %s\n", m.LamportTS, m.To, m.Body)
+	}
+}
+
+// countList renders counts as "a 3, b 1", largest first.
+func countList(counts map[string]int) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s %d", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// deadRecipient is a recipient nobody would read a message for.
+type deadRecipient struct {
+	agent  string
+	reason string // "not registered" or "departed"
+}
+
+// liveRecipients splits recipients into the registered agents that have
+// not departed, in order, and the rest.
+func (a *app) liveRecipients(recipients []string) ([]string, []deadRecipient, error) {
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		return nil, nil, fmt.Errorf("list agents: %w", err)
+	}
+	known := make(map[string]model.Agent, len(agents))
+	for _, ag := range agents {
+		known[ag.ID] = ag
+	}
+	var live []string
+	var dead []deadRecipient
+	for _, r := range recipients {
+		switch ag, ok := known[r]; {
+		case !ok:
+			dead = append(dead, deadRecipient{r, "not registered"})
+		case ag.DepartedAt != nil:
+			dead = append(dead, deadRecipient{r, "departed"})
+		default:
+			live = append(live, r)
+		}
+	}
+	return live, dead, nil
+}
+
+// cmdDlq lists and redelivers dead letters: messages cm send kept back
+// because their recipient was not registered or had departed.
+//
+// Usage:
+//
+//	cm dlq list [--all] [--json]
+//	cm dlq redeliver <id> <new-target> [--agent ID] [--json]
+func (a *app) cmdDlq(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm dlq <list|redeliver> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "list", "ls":
+		return a.dlqList(args[1:])
+	case "redeliver":
+		return a.dlqRedeliver(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: dlq: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) dlqList(args []string) int {
+	flags := flag.NewFlagSet("dlq list", flag.ContinueOnError)
+	all := flags.Bool("all", false, "include dead letters already redelivered")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	letters, err := a.store.ListDeadLetters(*all)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: dlq: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		if letters == nil {
+			letters = []store.DeadLetter{}
+		}
+		printJSON(letters)
+		return 0
+	}
+	if len(letters) == 0 {
+		fmt.Println("(no dead letters)")
+		return 0
+	}
+	for _, d := range letters {
+		body := d.Body
+		if r := []rune(body); len(r) > 80 {
+			body = string(r[:80]) + "..."
+		}
+		fmt.Printf("%4d  %s -> %s (%s) at ts=%d, %s: %s\n", d.ID, d.From, d.To, d.Reason, d.LamportTS,
+			d.CreatedAt.Local().Format("2006-01-02 15:04"), body)
+		if d.RedeliveredAt != nil {
+			fmt.Printf("      redelivered to %s as event %d\n", d.RedeliveredTo, d.RedeliveredEvent)
+		}
+	}
+	return 0
+}
+
+// dlqRedeliver sends a dead letter to a live agent, as the invoking
+// agent. If that is not the original sender, the body says who it was.
+func (a *app) dlqRedeliver(args []string) int {
+	const usage = "usage: cm dlq redeliver <id> <new-target> [--agent ID] [--json]"
+	flags := flag.NewFlagSet("dlq redeliver", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID redelivering the message")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	var pos []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return 1
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		pos = append(pos, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(pos) != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	id, err := strconv.ParseInt(pos[0], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: dlq: bad dead letter ID %q\n", pos[0])
+		return 1
+	}
+	target := pos[1]
+
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	d, err := a.store.GetDeadLetter(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: dlq: %v\n", err)
+		return 1
+	}
+	if d.RedeliveredAt != nil {
+		fmt.Fprintf(os.Stderr, "cm: dlq: dead letter %d was already redelivered to %s\n", id, d.RedeliveredTo)
+		return 1
+	}
+	_, dead, err := a.liveRecipients([]string{target})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: dlq: %v\n", err)
+		return 1
+	}
+	if len(dead) > 0 {
+		fmt.Fprintf(os.Stderr, "cm: dlq: %s is %s\n", target, dead[0].reason)
+		return 1
+	}
+
+	body := d.Body
+	if agentID != d.From {
+		body = fmt.Sprintf("(forwarded from %s) %s", d.From, body)
+	}
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	ts := a.tick(agentID, ep, rn)
+	e := &model.Event{
+		AgentID:    agentID,
+		LamportTS:  ts,
+		Epoch:      ep,
+		Round:      rn,
+		Kind:       model.EventMsg,
+		Target:     target,
+		Body:       body,
+		CreatedAt:  time.Now().UTC(),
+		Priority:   d.Priority,
+		Provenance: a.prov,
+	}
+	eventID, err := a.store.RedeliverDeadLetter(id, e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: dlq: redeliver: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{
+			"dead_letter": id,
+			"event_id":    eventID,
+			"target":      target,
+			"lamport_ts":  ts,
+			"permalink":   model.Permalink(agentID, eventID, ts),
+		})
+		return 0
+	}
+	fmt.Printf("redelivered dead letter %d to %s at ts=%d (event %d)\n", id, target, ts, eventID)
+	return 0
+}
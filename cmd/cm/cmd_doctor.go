@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// doctorCheck is the outcome of one cm doctor check.
+type doctorCheck struct {
+	Name   string  `json:"name"`
+	OK     bool    `json:"ok"`
+	Detail string  `json:"detail"`
+	Ms     float64 `json:"ms,omitempty"`
+}
+
+// cmdDoctor checks that the database is usable: that it can be reached
+// (with the round-trip time, which matters for a remote libsql:// or
+// postgres:// database), that its schema is up to date, and that the
+// store can take the write lock. cm doctor opens the database without
+// migrating it, so it reports a pending schema rather than applying it.
+// Exits 2 if a check fails.
+//
+// Usage: cm doctor [--json]
+func (a *app) cmdDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	var checks []doctorCheck
+	t0 := time.Now()
+	err := a.store.Ping()
+	ping := doctorCheck{Name: "connect", OK: err == nil, Ms: durationMs(time.Since(t0))}
+	if err != nil {
+		ping.Detail = err.Error()
+	} else {
+		ping.Detail = fmt.Sprintf("%s reachable, round trip %s", a.store.Backend(), time.Since(t0).Round(time.Millisecond))
+	}
+	checks = append(checks, ping)
+
+	if ping.OK {
+		schema := doctorCheck{Name: "schema"}
+		version, err := a.store.SchemaVersion()
+		switch latest := store.LatestSchemaVersion(); {
+		case err != nil:
+			schema.Detail = err.Error()
+		case version < latest:
+			schema.Detail = fmt.Sprintf("version %d, latest %d; run cm migrate", version, latest)
+		case version > latest:
+			schema.Detail = fmt.Sprintf("version %d is newer than this cm (latest %d); upgrade cm", version, latest)
+		default:
+			schema.OK = true
+			schema.Detail = fmt.Sprintf("version %d", version)
+		}
+		checks = append(checks, schema)
+
+		// A database with no schema has nothing to write to yet.
+		if version > 0 {
+			write := doctorCheck{Name: "write"}
+			t0 = time.Now()
+			if err := a.store.CheckWrite(); err != nil {
+				write.Detail = err.Error()
+			} else {
+				write.OK = true
+				write.Detail = fmt.Sprintf("write lock taken in %s", time.Since(t0).Round(time.Millisecond))
+			}
+			write.Ms = durationMs(time.Since(t0))
+			checks = append(checks, write)
+		}
+	}
+	return printDoctor(checks, *jsonOut)
+}
+
+// doctorUnreachable reports a database that could not even be opened,
+// for cm doctor.
+func doctorUnreachable(args []string, err error) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	return printDoctor([]doctorCheck{{Name: "connect", Detail: err.Error()}}, *jsonOut)
+}
+
+func printDoctor(checks []doctorCheck, jsonOut bool) int {
+	ok := true
+	for _, c := range checks {
+		ok = ok && c.OK
+	}
+	code := 0
+	if !ok {
+		code = 2
+	}
+	if jsonOut {
+		printJSON(map[string]interface{}{"database": dbLocation(), "ok": ok, "checks": checks})
+		return code
+	}
+	fmt.Printf("database: %s\n", dbLocation())
+	for _, c := range checks {
+		state := "ok"
+		if !c.OK {
+			state = "FAIL"
+		}
+		fmt.Printf("  %-8s %-4s  %s\n", c.Name, state, c.Detail)
+	}
+	if !ok {
+		fmt.Fprintln(os.Stderr, "cm: doctor: some checks failed")
+	}
+	return code
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/frontier"
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// cmdEpoch manages declared epochs, so that the numbers agents pass to
+// heartbeat --epoch name a piece of work that is opened, worked on and
+// closed. Closing checks the frontier: it is refused (exit 2) while any
+// agent is still at or below the epoch.
+//
+// Usage:
+//
+//	cm epoch open 4 --desc "feature X"
+//	cm epoch close 4
+//	cm epoch list [--open]
+func (a *app) cmdEpoch(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm epoch <open|close|list> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "open":
+		return a.epochOpen(args[1:])
+	case "close":
+		return a.epochClose(args[1:])
+	case "list", "ls":
+		return a.epochList(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: epoch: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+// parseEpochArg parses flags given before or after the epoch number,
+// which is returned.
+func parseEpochArg(flags *flag.FlagSet, args []string, usage string) (int64, bool) {
+	if err := flags.Parse(args); err != nil {
+		return 0, false
+	}
+	rest := flags.Args()
+	if len(rest) > 0 {
+		if err := flags.Parse(rest[1:]); err != nil {
+			return 0, false
+		}
+	}
+	if len(rest) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 0, false
+	}
+	n, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil || n < 0 {
+		fmt.Fprintf(os.Stderr, "cm: epoch: %q is not an epoch number\n", rest[0])
+		return 0, false
+	}
+	return n, true
+}
+
+func (a *app) epochOpen(args []string) int {
+	flags := flag.NewFlagSet("epoch open", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID")
+	desc := flags.String("desc", "", "what the epoch is for")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	n, ok := parseEpochArg(flags, args, `usage: cm epoch open <N> [--desc "what it is for"] [--json]`)
+	if !ok {
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	e, err := a.store.OpenEpoch(n, *desc, agentID)
+	if errors.Is(err, store.ErrEpochClosed) {
+		return fail(fmt.Sprintf("epoch open: epoch %d is closed", n), *jsonOut, 1, []nextAction{
+			{Command: fmt.Sprintf("cm epoch open %d", n+1), Reason: "closed epochs stay closed; open a new one"},
+		})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: epoch open: %v\n", err)
+		return 1
+	}
+	body := "open"
+	if e.Description != "" {
+		body += ": " + e.Description
+	}
+	ts, err := a.recordEvent(agentID, model.EventEpoch, strconv.FormatInt(n, 10), body)
+	if err != nil {
+		a.logger().Warn("record epoch_open event", "err", err)
+	}
+
+	actions := []nextAction{{
+		Command: fmt.Sprintf("cm heartbeat --epoch %d", n),
+		Reason:  "move to the epoch when you start on it",
+	}}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"epoch": e, "lamport_ts": ts, "next_actions": actions})
+		return 0
+	}
+	fmt.Printf("epoch %d open", n)
+	if e.Description != "" {
+		fmt.Printf(": %s", e.Description)
+	}
+	fmt.Printf(" (ts=%d)\n", ts)
+	printHints(actions)
+	return 0
+}
+
+func (a *app) epochClose(args []string) int {
+	flags := flag.NewFlagSet("epoch close", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	n, ok := parseEpochArg(flags, args, "usage: cm epoch close <N> [--json]")
+	if !ok {
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	if _, err := a.store.GetEpoch(n); err == sql.ErrNoRows {
+		return fail(fmt.Sprintf("epoch close: epoch %d was never opened", n), *jsonOut, 1, []nextAction{
+			{Command: fmt.Sprintf("cm epoch open %d", n), Reason: "declare it first"},
+		})
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: epoch close: %v\n", err)
+		return 1
+	}
+
+	// Every agent, the closer included, must be past every round of n.
+	active, err := a.store.GetActivePointstamps(0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: epoch close: %v\n", err)
+		return 1
+	}
+	status := frontier.ComputeFrontierStatus("", model.Timestamp{Epoch: n, Round: math.MaxInt64}, active)
+	if !status.SafeToFinalize {
+		var who []string
+		for _, b := range status.BlockedBy {
+			who = append(who, fmt.Sprintf("%s (epoch=%d round=%d)", b.Who(), b.Timestamp.Epoch, b.Timestamp.Round))
+		}
+		actions := frontierActions(model.Timestamp{Epoch: n}, status.BlockedBy)
+		msg := fmt.Sprintf("epoch close: epoch %d is not finished: %s", n, strings.Join(who, ", "))
+		if *jsonOut {
+			fmt.Fprintf(os.Stderr, "cm: %s\n", msg)
+			printJSON(map[string]interface{}{
+				"error": msg, "epoch": n, "blocked_by": status.BlockedBy, "next_actions": actions,
+			})
+			return 2
+		}
+		return fail(msg, false, 2, actions)
+	}
+
+	e, err := a.store.CloseEpoch(n, agentID)
+	if errors.Is(err, store.ErrEpochClosed) {
+		fmt.Fprintf(os.Stderr, "cm: epoch close: epoch %d is already closed\n", n)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: epoch close: %v\n", err)
+		return 1
+	}
+	ts, err := a.recordEvent(agentID, model.EventEpoch, strconv.FormatInt(n, 10), "close")
+	if err != nil {
+		a.logger().Warn("record epoch_close event", "err", err)
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"epoch": e, "lamport_ts": ts})
+		return 0
+	}
+	fmt.Printf("epoch %d closed (ts=%d)\n", n, ts)
+	return 0
+}
+
+func (a *app) epochList(args []string) int {
+	flags := flag.NewFlagSet("epoch list", flag.ContinueOnError)
+	openOnly := flags.Bool("open", false, "only open epochs")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	epochs, err := a.store.ListEpochs(*openOnly)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: epoch list: %v\n", err)
+		return 1
+	}
+	active, err := a.store.GetActivePointstamps(0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: epoch list: %v\n", err)
+		return 1
+	}
+	agentsAt := make(map[int64][]string)
+	for _, p := range active {
+		agentsAt[p.Timestamp.Epoch] = append(agentsAt[p.Timestamp.Epoch], p.AgentID)
+	}
+
+	if *jsonOut {
+		type row struct {
+			model.Epoch
+			Agents []string `json:"agents"`
+		}
+		rows := []row{}
+		for _, e := range epochs {
+			rows = append(rows, row{Epoch: e, Agents: agentsAt[e.Epoch]})
+		}
+		printJSON(map[string]interface{}{"epochs": rows})
+		return 0
+	}
+	if len(epochs) == 0 {
+		fmt.Println("no epochs declared (cm epoch open N --desc ...)")
+		return 0
+	}
+	for _, e := range epochs {
+		fmt.Printf("%4d  %-6s  %s\n", e.Epoch, e.Status, e.Description)
+		detail := fmt.Sprintf("opened by %s %s", e.OpenedBy, e.OpenedAt.Local().Format("2006-01-02 15:04"))
+		if e.ClosedAt != nil {
+			detail += fmt.Sprintf(", closed by %s %s", e.ClosedBy, e.ClosedAt.Local().Format("2006-01-02 15:04"))
+		}
+		if at := agentsAt[e.Epoch]; len(at) > 0 {
+			detail += "; at it: " + strings.Join(at, ", ")
+		}
+		fmt.Printf("      %s\n", detail)
+	}
+	return 0
+}
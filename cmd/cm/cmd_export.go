@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// cmdExport writes the event log as JSON lines, one model.Event per line,
+// in insertion order. The output can be archived, moved to another repo,
+// or replayed into a fresh database with cm import.
+//
+// Usage:
+//
+//	cm export > history.jsonl
+//	cm export --since 120 --output recent.jsonl
+func (a *app) cmdExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "output format (jsonl)")
+	sinceTS := flags.Int64("since", 0, "export events with lamport_ts >= this")
+	output := flags.String("output", "", "write to file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *format != "jsonl" {
+		fmt.Fprintf(os.Stderr, "cm: export: unsupported format %q (supported: jsonl)\n", *format)
+		return 1
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: export: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	// Page by row ID rather than Lamport timestamp: IDs are unique, so no
+	// events sharing a timestamp are lost at page boundaries.
+	enc := json.NewEncoder(out)
+	var lastID int64
+	count := 0
+	for {
+		events, err := a.store.ListEventsSinceID(lastID, 500)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: export: %v\n", err)
+			return 1
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, e := range events {
+			lastID = e.ID
+			if e.LamportTS < *sinceTS {
+				continue
+			}
+			if err := enc.Encode(e); err != nil {
+				fmt.Fprintf(os.Stderr, "cm: export: %v\n", err)
+				return 1
+			}
+			count++
+		}
+	}
+
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "exported %d event(s) to %s\n", count, *output)
+	}
+	return 0
+}
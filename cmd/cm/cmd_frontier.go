@@ -4,55 +4,158 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/daviddao/clockmail/pkg/frontier"
 	"github.com/daviddao/clockmail/pkg/model"
 )
 
+// cmdFrontier checks whether a timestamp is safe to finalize. With
+// --history it instead shows how the frontier advanced: every change
+// recorded by heartbeats, with how long each frontier held, so a stalled
+// epoch can be traced to the agents that sat on it.
 func (a *app) cmdFrontier(args []string) int {
 	flags := flag.NewFlagSet("frontier", flag.ContinueOnError)
 	agent := flags.String("agent", "", "requesting agent ID")
 	epoch := flags.Int64("epoch", 0, "epoch to check safety for")
 	round := flags.Int64("round", 0, "round to check safety for")
+	at := flags.String("at", "", "timestamp to check as dotted coordinates, e.g. 3.2.7 (instead of --epoch and --round)")
+	rollup := flags.Bool("rollup", false, "report sub-agents under their top-level parent")
+	history := flags.Bool("history", false, "show how the frontier advanced over time")
+	since := flags.Duration("since", 24*time.Hour, "with --history, how far back to look")
+	limit := flags.Int("limit", 100, "with --history, show at most this many changes, the most recent")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
+	if *history {
+		return a.frontierHistory(*since, *limit, *jsonOut)
+	}
 
 	agentID, err := a.resolveAgent(*agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
-		return 1
+		return failNoAgent(err, *jsonOut)
 	}
 
 	ts := model.Timestamp{Epoch: *epoch, Round: *round}
-	active, err := a.store.GetActivePointstamps()
+	if t, ok, err := parseAt(flags, *at); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: frontier: %v\n", err)
+		return 1
+	} else if ok {
+		ts = t
+	}
+	active, err := a.store.GetActivePointstamps(0)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: frontier: %v\n", err)
 		return 1
 	}
 
 	status := frontier.ComputeFrontierStatus(agentID, ts, active)
+	if *rollup {
+		// Safety is decided on every agent; rollup only changes who is
+		// reported, so a blocked worker shows up as its orchestrator.
+		agents, err := a.store.ListAgents()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: frontier: %v\n", err)
+			return 1
+		}
+		parents := parentsOf(agents)
+		status.Frontier = frontier.Rollup(status.Frontier, parents)
+		status.BlockedBy = frontier.Rollup(status.BlockedBy, parents)
+	}
 
 	if *jsonOut {
-		printJSON(status)
+		printJSON(struct {
+			frontier.FrontierStatus
+			NextActions []nextAction `json:"next_actions,omitempty"`
+		}{status, frontierStatusActions(ts, status)})
 	} else {
 		if status.SafeToFinalize {
-			fmt.Printf("SAFE to finalize epoch=%d round=%d\n", *epoch, *round)
+			fmt.Printf("SAFE to finalize %s\n", ts.Fields())
 		} else {
-			fmt.Printf("NOT SAFE to finalize epoch=%d round=%d\n", *epoch, *round)
+			fmt.Printf("NOT SAFE to finalize %s\n", ts.Fields())
 			for _, b := range status.BlockedBy {
-				fmt.Printf("  blocked by %s at epoch=%d round=%d\n",
-					b.AgentID, b.Timestamp.Epoch, b.Timestamp.Round)
+				fmt.Printf("  blocked by %s at %s\n",
+					b.Who(), b.Timestamp.Fields())
 			}
+			printHints(frontierStatusActions(ts, status))
 		}
 		if len(status.Frontier) > 0 {
 			fmt.Println("frontier:")
 			for _, p := range status.Frontier {
-				fmt.Printf("  %s @ epoch=%d round=%d\n",
-					p.AgentID, p.Timestamp.Epoch, p.Timestamp.Round)
+				fmt.Printf("  %s @ %s\n",
+					p.Who(), p.Timestamp.Fields())
 			}
 		}
 	}
 	return 0
 }
+
+// frontierSpan is a frontier snapshot and how long it held.
+type frontierSpan struct {
+	model.FrontierSnapshot
+	Held    time.Duration `json:"held_ns"`
+	Current bool          `json:"current,omitempty"`
+}
+
+func (a *app) frontierHistory(since time.Duration, limit int, jsonOut bool) int {
+	snaps, err := a.store.ListFrontierHistory(time.Now().Add(-since), limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: frontier: %v\n", err)
+		return 1
+	}
+	now := time.Now()
+	spans := make([]frontierSpan, len(snaps))
+	longest := -1
+	for i, s := range snaps {
+		spans[i] = frontierSpan{FrontierSnapshot: s}
+		if i+1 < len(snaps) {
+			spans[i].Held = snaps[i+1].RecordedAt.Sub(s.RecordedAt)
+		} else {
+			spans[i].Held, spans[i].Current = now.Sub(s.RecordedAt), true
+		}
+		if len(s.Frontier) > 0 && (longest < 0 || spans[i].Held > spans[longest].Held) {
+			longest = i
+		}
+	}
+
+	if jsonOut {
+		out := map[string]interface{}{"history": spans}
+		if longest >= 0 {
+			out["longest"] = spans[longest]
+		}
+		printJSON(out)
+		return 0
+	}
+	if len(spans) == 0 {
+		fmt.Println("no frontier history yet (recorded by cm heartbeat and cm sync)")
+		return 0
+	}
+	for _, s := range spans {
+		held := s.Held.Round(time.Second).String()
+		if s.Current {
+			held += " so far"
+		}
+		fmt.Printf("%s  epoch=%-4d %-10s %s\n",
+			s.RecordedAt.Local().Format("2006-01-02 15:04:05"), s.Epoch, held, frontierHolders(s.Frontier))
+	}
+	if longest >= 0 {
+		s := spans[longest]
+		fmt.Printf("longest: epoch %d held %s by %s\n", s.Epoch, s.Held.Round(time.Second), frontierHolders(s.Frontier))
+	}
+	return 0
+}
+
+// frontierHolders lists a frontier's agents with their positions, e.g.
+// "bob (1/0), carol (1/2)".
+func frontierHolders(f []model.Pointstamp) string {
+	if len(f) == 0 {
+		return "(no active agents)"
+	}
+	parts := make([]string, len(f))
+	for i, p := range f {
+		parts[i] = fmt.Sprintf("%s (%d/%d)", p.Who(), p.Timestamp.Epoch, p.Timestamp.Round)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/frontier"
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/trace"
 )
 
 // cmdGate blocks until the Naiad frontier passes the specified epoch,
@@ -21,6 +27,13 @@ import (
 //	cm gate --epoch N             # block until epoch N is safe
 //	cm gate --epoch N --timeout 5m  # block with timeout
 //	cm gate --epoch N --check     # check once, exit 0 if safe, 1 if not
+//	cm gate --at 3.2.7            # block until step 7 of epoch 3 round 2 is safe
+//	cm gate --epoch N --scope pkg/store  # wait only for agents working in pkg/store
+//	cm gate --epoch N --exec "go test ./..."  # then run a command
+//
+// With --exec the command runs through sh once the epoch is safe, its
+// outcome is recorded as a gate_result event, and cm exits with the
+// command's status instead of 0.
 //
 // Exit codes:
 //
@@ -32,9 +45,12 @@ func (a *app) cmdGate(args []string) int {
 	agent := flags.String("agent", "", "agent ID")
 	epoch := flags.Int64("epoch", 0, "epoch to wait for")
 	round := flags.Int64("round", 0, "round to wait for")
+	at := flags.String("at", "", "timestamp to wait for as dotted coordinates, e.g. 3.2.7 (instead of --epoch and --round)")
 	timeout := flags.Duration("timeout", 10*time.Minute, "max time to wait")
-	interval := flags.Duration("interval", 2*time.Second, "poll interval")
+	interval := flags.Duration("interval", a.cfg.Duration("poll.gate_interval"), "poll interval")
+	scope := flags.String("scope", "", "wait only for agents whose scope (cm heartbeat --scope) or locks overlap this path prefix or module")
 	check := flags.Bool("check", false, "check once and exit (no blocking)")
+	command := flags.String("exec", "", "shell command to run once the epoch is safe")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
@@ -42,23 +58,36 @@ func (a *app) cmdGate(args []string) int {
 
 	agentID, err := a.resolveAgent(*agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
-		return 1
+		return failNoAgent(err, *jsonOut)
 	}
 
 	ts := model.Timestamp{Epoch: *epoch, Round: *round}
+	if t, ok, err := parseAt(flags, *at); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: gate: %v\n", err)
+		return 1
+	} else if ok {
+		ts = t
+	}
 
 	// Single check mode: just test once and exit.
 	if *check {
-		return a.gateCheck(agentID, ts, *jsonOut)
+		if *command != "" && a.checkFrontierSafe(agentID, ts, *scope) {
+			return a.gateExec(agentID, ts, *command, *jsonOut, 0)
+		}
+		return a.gateCheck(agentID, ts, *scope, *jsonOut)
 	}
 
 	// Blocking mode: poll until safe or timeout.
-	return a.gateWait(agentID, ts, *timeout, *interval, *jsonOut)
+	if *command != "" {
+		return a.gateWaitThen(agentID, ts, *scope, *timeout, *interval, *jsonOut, func(waited time.Duration) int {
+			return a.gateExec(agentID, ts, *command, *jsonOut, waited)
+		})
+	}
+	return a.gateWait(agentID, ts, *scope, *timeout, *interval, *jsonOut)
 }
 
-func (a *app) gateCheck(agentID string, ts model.Timestamp, jsonOut bool) int {
-	active, err := a.store.GetActivePointstamps()
+func (a *app) gateCheck(agentID string, ts model.Timestamp, scope string, jsonOut bool) int {
+	active, err := a.scopedPointstamps(scope)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: gate: %v\n", err)
 		return 1
@@ -67,7 +96,7 @@ func (a *app) gateCheck(agentID string, ts model.Timestamp, jsonOut bool) int {
 	status := frontier.ComputeFrontierStatus(agentID, ts, active)
 
 	if jsonOut {
-		printJSON(map[string]interface{}{
+		out := map[string]interface{}{
 			"epoch":         ts.Epoch,
 			"round":         ts.Round,
 			"safe":          status.SafeToFinalize,
@@ -75,17 +104,23 @@ func (a *app) gateCheck(agentID string, ts model.Timestamp, jsonOut bool) int {
 			"blocker_count": len(status.BlockedBy),
 			"active_agents": len(active),
 			"mode":          "check",
-		})
+			"next_actions":  frontierStatusActions(ts, status),
+		}
+		if scope != "" {
+			out["scope"] = scope
+		}
+		printJSON(out)
 	} else {
 		if status.SafeToFinalize {
-			fmt.Printf("SAFE: epoch=%d round=%d — all agents have advanced past this point\n",
-				ts.Epoch, ts.Round)
+			fmt.Printf("SAFE: %s — all agents%s have advanced past this point\n",
+				ts.Fields(), inScope(scope))
 		} else {
-			fmt.Printf("NOT SAFE: epoch=%d round=%d\n", ts.Epoch, ts.Round)
+			fmt.Printf("NOT SAFE: %s\n", ts.Fields())
 			for _, b := range status.BlockedBy {
-				fmt.Printf("  blocked by %s at epoch=%d round=%d\n",
-					b.AgentID, b.Timestamp.Epoch, b.Timestamp.Round)
+				fmt.Printf("  blocked by %s at %s\n",
+					b.Who(), b.Timestamp.Fields())
 			}
+			printHints(frontierStatusActions(ts, status))
 		}
 	}
 
@@ -95,54 +130,75 @@ func (a *app) gateCheck(agentID string, ts model.Timestamp, jsonOut bool) int {
 	return 2
 }
 
-func (a *app) gateWait(agentID string, ts model.Timestamp, timeout, interval time.Duration, jsonOut bool) int {
+func (a *app) gateWait(agentID string, ts model.Timestamp, scope string, timeout, interval time.Duration, jsonOut bool) int {
+	return a.gateWaitThen(agentID, ts, scope, timeout, interval, jsonOut, func(elapsed time.Duration) int {
+		return a.gateSuccess(agentID, ts, scope, jsonOut, elapsed)
+	})
+}
+
+// gateWaitThen polls until ts is safe for work in scope ("" for the whole
+// repository) and returns onSafe's exit code, or 1 on timeout or
+// interrupt.
+func (a *app) gateWaitThen(agentID string, ts model.Timestamp, scope string, timeout, interval time.Duration, jsonOut bool,
+	onSafe func(elapsed time.Duration) int) int {
 	deadline := time.Now().Add(timeout)
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
 	if !jsonOut {
-		fmt.Fprintf(os.Stderr, "waiting for epoch=%d round=%d to become safe (timeout=%s, poll=%s)\n",
-			ts.Epoch, ts.Round, timeout, interval)
+		fmt.Fprintf(os.Stderr, "waiting for %s to become safe%s (timeout=%s, poll=%s)\n",
+			ts.Fields(), inScope(scope), timeout, interval)
 	}
 
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	span := a.tracer.Start("gate.wait", trace.String("clockmail.agent", agentID),
+		trace.Int("clockmail.epoch", ts.Epoch), trace.Int("clockmail.round", ts.Round))
+	endWait := func(outcome string, waited time.Duration) {
+		span.Set(trace.String("clockmail.gate.outcome", outcome), trace.Float("clockmail.gate.waited_seconds", waited.Seconds()))
+		span.End(nil)
+	}
+
 	// Check immediately before first tick.
-	if safe := a.checkFrontierSafe(agentID, ts); safe {
-		return a.gateSuccess(agentID, ts, jsonOut, time.Duration(0))
+	if a.checkFrontierSafe(agentID, ts, scope) {
+		endWait("safe", 0)
+		return onSafe(0)
 	}
 
 	for {
 		select {
 		case <-sig:
+			endWait("interrupted", timeout-time.Until(deadline))
 			fmt.Fprintf(os.Stderr, "\ninterrupted\n")
 			return 1
 		case <-ticker.C:
 			if time.Now().After(deadline) {
+				endWait("timeout", timeout)
 				if jsonOut {
 					printJSON(map[string]interface{}{
 						"epoch": ts.Epoch, "round": ts.Round,
 						"safe": false, "reason": "timeout",
 					})
 				} else {
-					fmt.Fprintf(os.Stderr, "TIMEOUT: epoch=%d round=%d not safe after %s\n",
-						ts.Epoch, ts.Round, timeout)
+					fmt.Fprintf(os.Stderr, "TIMEOUT: %s not safe after %s\n",
+						ts.Fields(), timeout)
 				}
 				return 1
 			}
 
-			if safe := a.checkFrontierSafe(agentID, ts); safe {
-				elapsed := timeout - time.Until(deadline)
-				return a.gateSuccess(agentID, ts, jsonOut, elapsed)
+			if a.checkFrontierSafe(agentID, ts, scope) {
+				waited := timeout - time.Until(deadline)
+				endWait("safe", waited)
+				return onSafe(waited)
 			}
 		}
 	}
 }
 
-func (a *app) checkFrontierSafe(agentID string, ts model.Timestamp) bool {
-	active, err := a.store.GetActivePointstamps()
+func (a *app) checkFrontierSafe(agentID string, ts model.Timestamp, scope string) bool {
+	active, err := a.scopedPointstamps(scope)
 	if err != nil {
 		return false
 	}
@@ -150,18 +206,59 @@ func (a *app) checkFrontierSafe(agentID string, ts model.Timestamp) bool {
 	return status.SafeToFinalize
 }
 
-func (a *app) gateSuccess(agentID string, ts model.Timestamp, jsonOut bool, elapsed time.Duration) int {
+// scopedPointstamps returns the active pointstamps of agents whose work
+// can touch scope: its declared scope or a lock it holds overlaps it, or
+// it declared neither. An empty scope returns them all.
+func (a *app) scopedPointstamps(scope string) ([]model.Pointstamp, error) {
+	active, err := a.store.GetActivePointstamps(0)
+	if err != nil || scope == "" {
+		return active, err
+	}
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		return nil, err
+	}
+	locks, err := a.store.ListLocks()
+	if err != nil {
+		return nil, err
+	}
+	scopes := make(map[string][]string)
+	for _, ag := range agents {
+		if ag.Scope != "" {
+			scopes[ag.ID] = append(scopes[ag.ID], ag.Scope)
+		}
+	}
+	for _, l := range locks {
+		scopes[l.AgentID] = append(scopes[l.AgentID], l.Path)
+	}
+	return frontier.Scoped(active, scope, scopes), nil
+}
+
+// inScope describes a gate's scope for messages: " in pkg/store", or ""
+// for the whole repository.
+func inScope(scope string) string {
+	if scope == "" {
+		return ""
+	}
+	return " in " + scope
+}
+
+func (a *app) gateSuccess(agentID string, ts model.Timestamp, scope string, jsonOut bool, elapsed time.Duration) int {
 	if jsonOut {
-		printJSON(map[string]interface{}{
+		out := map[string]interface{}{
 			"epoch":   ts.Epoch,
 			"round":   ts.Round,
 			"safe":    true,
 			"elapsed": elapsed.String(),
 			"mode":    "wait",
-		})
+		}
+		if scope != "" {
+			out["scope"] = scope
+		}
+		printJSON(out)
 	} else {
-		fmt.Printf("SAFE: epoch=%d round=%d — all agents have advanced past this point",
-			ts.Epoch, ts.Round)
+		fmt.Printf("SAFE: %s — all agents%s have advanced past this point",
+			ts.Fields(), inScope(scope))
 		if elapsed > 0 {
 			fmt.Printf(" (waited %s)", elapsed.Round(time.Millisecond))
 		}
@@ -169,3 +266,128 @@ func (a *app) gateSuccess(agentID string, ts model.Timestamp, jsonOut bool, elap
 	}
 	return 0
 }
+
+// gateResultPayload is the body of a gate_result event.
+type gateResultPayload struct {
+	Epoch    int64  `json:"epoch"`
+	Round    int64  `json:"round"`
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"` // -1 if the command could not be started
+	Duration string `json:"duration"`
+	Waited   string `json:"waited,omitempty"` // how long the gate was shut before the command ran
+	Output   string `json:"output,omitempty"` // the last gateOutputTail bytes of stdout and stderr
+}
+
+// gateOutputTail is how much command output a gate_result event keeps.
+const gateOutputTail = 2048
+
+// gateExec runs command through sh once the gate at ts is safe, passing
+// its output through (stdout goes to stderr with --json), and records the
+// outcome as a gate_result event. It returns the command's exit status.
+func (a *app) gateExec(agentID string, ts model.Timestamp, command string, jsonOut bool, waited time.Duration) int {
+	if !jsonOut {
+		fmt.Fprintf(os.Stderr, "SAFE: %s — running %s\n", ts.Fields(), command)
+	}
+	var tail tailBuffer
+	stdout := io.Writer(os.Stdout)
+	if jsonOut {
+		stdout = os.Stderr
+	}
+	span := a.tracer.Start("gate.exec", trace.String("clockmail.gate.command", command),
+		trace.Int("clockmail.epoch", ts.Epoch), trace.Int("clockmail.round", ts.Round))
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(stdout, &tail)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &tail)
+	if tp := span.Traceparent(); tp != "" {
+		// The command's own spans (a test run, a build) nest under the gate.
+		cmd.Env = append(os.Environ(), "TRACEPARENT="+tp)
+	}
+	start := time.Now()
+	runErr := cmd.Run()
+	took := time.Since(start).Round(time.Millisecond)
+
+	code := 0
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(runErr, &exitErr):
+		code = exitErr.ExitCode()
+		if code < 0 { // killed by a signal
+			code = 1
+		}
+	case runErr != nil:
+		fmt.Fprintf(os.Stderr, "cm: gate: %v\n", runErr)
+		code = -1
+	}
+
+	span.Set(trace.Int("clockmail.gate.exit_code", int64(code)))
+	if code != 0 {
+		span.Fail(fmt.Sprintf("exit status %d", code))
+	}
+	span.End(nil)
+
+	body, _ := json.Marshal(gateResultPayload{
+		Epoch: ts.Epoch, Round: ts.Round, Command: command, ExitCode: code,
+		Duration: took.String(), Waited: waited.Round(time.Millisecond).String(), Output: tail.String(),
+	})
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	lts := a.tick(agentID, ep, rn)
+	id, err := a.insertEvent(&model.Event{
+		AgentID:   agentID,
+		LamportTS: lts,
+		Epoch:     ep,
+		Round:     rn,
+		Kind:      model.EventGateResult,
+		Body:      string(body),
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		a.logger().Warn("record gate_result event", "err", err)
+	}
+
+	if jsonOut {
+		printJSON(map[string]interface{}{
+			"epoch": ts.Epoch, "round": ts.Round, "safe": true, "waited": waited.String(),
+			"command": command, "exit_code": code, "duration": took.String(),
+			"lamport_ts": lts, "event_id": id, "mode": "exec",
+		})
+	} else {
+		fmt.Printf("gate_result: %q exited %d after %s (ts=%d)\n", command, code, took, lts)
+	}
+	if code < 0 {
+		return 1
+	}
+	return code
+}
+
+// gateResultSummary renders a gate_result event for cm log and cm watch.
+func gateResultSummary(e model.Event) string {
+	var p gateResultPayload
+	if err := json.Unmarshal([]byte(e.Body), &p); err != nil {
+		return e.Body
+	}
+	return fmt.Sprintf("epoch=%d round=%d %q exit=%d (%s)", p.Epoch, p.Round, p.Command, p.ExitCode, p.Duration)
+}
+
+// tailBuffer is an io.Writer keeping the last gateOutputTail bytes
+// written to it. It is safe for concurrent use.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - gateOutputTail; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
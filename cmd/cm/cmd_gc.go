@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// cmdGC compacts the event log. Old events are deleted (optionally after
+// being archived as JSON lines), but anything agents still depend on —
+// undelivered messages, each agent's latest position — is always kept.
+// Once any agent holds the admin role, only an admin may compact.
+//
+// Usage:
+//
+//	cm gc --keep-days 14 --keep-events 5000
+//	cm gc --keep-days 7 --archive events-old.jsonl
+//	cm gc --dry-run
+func (a *app) cmdGC(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent compacting the log: an admin, once there is one")
+	keepDays := flags.Int("keep-days", a.cfg.Int("retention.keep_days"), "keep events newer than N days (0 = no age limit)")
+	keepEvents := flags.Int("keep-events", a.cfg.Int("retention.keep_events"), "always keep the newest N events")
+	archive := flags.String("archive", "", "append removed events to this JSONL file")
+	dryRun := flags.Bool("dry-run", false, "report what would be removed without deleting")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *keepDays < 0 || *keepEvents < 0 {
+		fmt.Fprintln(os.Stderr, "cm: gc: --keep-days and --keep-events must be >= 0")
+		return 1
+	}
+
+	a.actAs(*agent)
+
+	opts := store.CompactOptions{KeepEvents: *keepEvents, DryRun: *dryRun}
+	if *keepDays > 0 {
+		opts.Before = time.Now().UTC().Add(-time.Duration(*keepDays) * 24 * time.Hour)
+	}
+
+	if *archive != "" && !*dryRun {
+		f, err := os.OpenFile(*archive, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: gc: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		opts.Archive = f
+	}
+
+	res, err := a.store.CompactEvents(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: gc: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{
+			"deleted":   res.Deleted,
+			"remaining": res.Remaining,
+			"dry_run":   res.DryRun,
+			"archive":   *archive,
+		})
+		return 0
+	}
+	verb := "removed"
+	if res.DryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("gc: %s %d event(s), %d remaining", verb, res.Deleted, res.Remaining)
+	if *archive != "" && !res.DryRun && res.Deleted > 0 {
+		fmt.Printf(" (archived to %s)", *archive)
+	}
+	fmt.Println()
+	return 0
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// cmdHandoff transfers work to another agent in one step: the sender's
+// locks on the files are released (or, with --reserve, passed to the
+// recipient so nobody else can take them in between) and a handoff
+// message is sent, atomically. The recipient takes the work over with
+// cm handoff accept, which locks the files for them and tells the sender.
+//
+// The message has the shape of the handoff template (see cm template):
+//
+//	[handoff] a.go, b.go
+//	next: <summary>
+//	epoch: 3
+//	accept: cm handoff accept 7 (locks reserved for you)
+//
+// Usage:
+//
+//	cm handoff <to> --files a.go,b.go --summary "..." [--epoch N] [--reserve] [--ttl N]
+//	cm handoff accept <id> [--ttl N]
+//	cm handoff list [--all]
+func (a *app) cmdHandoff(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "accept":
+			return a.handoffAccept(args[1:])
+		case "list", "ls":
+			return a.handoffList(args[1:])
+		}
+	}
+	return a.handoffStart(args)
+}
+
+func (a *app) handoffStart(args []string) int {
+	const usage = `usage: cm handoff <to> --files a.go,b.go --summary "..." [--epoch N] [--reserve] [--ttl N] [--json]`
+	flags := flag.NewFlagSet("handoff", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent handing off")
+	files := flags.String("files", "", "comma-separated files handed over; your locks on them are released")
+	summary := flags.String("summary", "", "what the recipient should do next")
+	epoch := flags.Int64("epoch", -1, "epoch of the work handed over (-1 = keep current)")
+	reserve := flags.Bool("reserve", false, "pass your locks to the recipient instead of releasing them")
+	ttlSec := flags.Int("ttl", a.lockTTLSeconds(), "with --reserve, how long the recipient holds the locks before accepting")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	rest := flags.Args()
+	if len(rest) > 0 {
+		if err := flags.Parse(rest[1:]); err != nil {
+			return 1
+		}
+	}
+	if len(rest) < 1 || flags.NArg() > 0 || (*files == "" && *summary == "") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	to := rest[0]
+
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	if to == agentID {
+		fmt.Fprintln(os.Stderr, "cm: handoff: cannot hand off to yourself")
+		return 1
+	}
+	_, dead, err := a.liveRecipients([]string{to})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: handoff: %v\n", err)
+		return 1
+	}
+	if len(dead) > 0 {
+		fmt.Fprintf(os.Stderr, "cm: handoff: %s is %s\n", to, dead[0].reason)
+		return 1
+	}
+
+	var paths []string
+	for _, f := range strings.Split(*files, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			paths = append(paths, f)
+		}
+	}
+	ep, rn := a.resolveEpochRound(agentID, *epoch, -1)
+	ts := a.tick(agentID, ep, rn)
+
+	now := time.Now().UTC()
+	h := &store.Handoff{From: agentID, To: to, Files: paths, Summary: *summary, Epoch: ep, CreatedAt: now}
+	msg := &model.Event{AgentID: agentID, LamportTS: ts, Epoch: ep, Round: rn, Kind: model.EventMsg,
+		Target: to, CreatedAt: now, Provenance: a.prov}
+	compose := func(id int64) string { return handoffMessage(h, id, *reserve) }
+	if err := a.store.StartHandoff(h, msg, compose, *reserve, time.Duration(*ttlSec)*time.Second); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: handoff: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"handoff": h, "lamport_ts": ts,
+			"permalink": model.Permalink(agentID, h.EventID, ts)})
+		return 0
+	}
+	fmt.Printf("handed off to %s as handoff %d (ts=%d)\n", to, h.ID, ts)
+	switch {
+	case *reserve && len(h.Reserved) > 0:
+		fmt.Printf("  locks reserved for %s: %s\n", to, strings.Join(h.Reserved, ", "))
+	case len(h.Released) > 0:
+		fmt.Printf("  locks released: %s\n", strings.Join(h.Released, ", "))
+	}
+	return 0
+}
+
+// handoffMessage is the body of handoff id's message.
+func handoffMessage(h *store.Handoff, id int64, reserve bool) string {
+	var b strings.Builder
+	files := strings.Join(h.Files, ", ")
+	if files == "" {
+		files = "(no files)"
+	}
+	fmt.Fprintf(&b, "[handoff] %s\n", files)
+	if h.Summary != "" {
+		fmt.Fprintf(&b, "next: %s\n", strings.Join(strings.Fields(h.Summary), " "))
+	}
+	fmt.Fprintf(&b, "epoch: %d\n", h.Epoch)
+	fmt.Fprintf(&b, "accept: cm handoff accept %d", id)
+	if reserve && len(h.Files) > 0 {
+		b.WriteString(" (locks reserved for you)")
+	}
+	return b.String()
+}
+
+// handoffAccept takes over a handoff: every file is locked for the
+// accepting agent (locks reserved for them are renewed; the rest are
+// acquired as cm lock would) and the sender is told. It exits 2 if some
+// file is locked by someone else.
+func (a *app) handoffAccept(args []string) int {
+	const usage = "usage: cm handoff accept <id> [--ttl N] [--agent ID] [--json]"
+	flags := flag.NewFlagSet("handoff accept", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent accepting the handoff")
+	ttlSec := flags.Int("ttl", a.lockTTLSeconds(), "lock TTL in seconds")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	rest := flags.Args()
+	if len(rest) > 0 {
+		if err := flags.Parse(rest[1:]); err != nil {
+			return 1
+		}
+	}
+	if len(rest) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	id, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: handoff: bad handoff ID %q\n", rest[0])
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	h, err := a.store.AcceptHandoff(id, agentID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: handoff: %v\n", err)
+		return 1
+	}
+
+	ttl := time.Duration(*ttlSec) * time.Second
+	var locked []string
+	denied := map[string]string{}
+	for _, path := range h.Files {
+		if _, _, err := a.renewLock(agentID, path, ttl); err == nil {
+			locked = append(locked, path)
+			continue
+		}
+		holder, err := a.takeLock(agentID, path, ttl)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "cm: handoff: lock %s: %v\n", path, err)
+			return 1
+		case holder != "":
+			denied[path] = holder
+		default:
+			locked = append(locked, path)
+		}
+	}
+
+	body := fmt.Sprintf("[handoff-accepted] %s\nhandoff: %d", strings.Join(h.Files, ", "), h.ID)
+	ts, err := a.recordEvent(agentID, model.EventMsg, h.From, body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: handoff: tell %s: %v\n", h.From, err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"handoff": h, "locked": locked, "denied": denied, "lamport_ts": ts})
+	} else {
+		fmt.Printf("accepted handoff %d from %s (ts=%d)\n", h.ID, h.From, ts)
+		if h.Summary != "" {
+			fmt.Printf("  next: %s\n", h.Summary)
+		}
+		if len(locked) > 0 {
+			fmt.Printf("  locked: %s\n", strings.Join(locked, ", "))
+		}
+		for _, path := range h.Files {
+			if holder, ok := denied[path]; ok {
+				fmt.Printf("  DENIED: %s holds %s\n", holder, path)
+			}
+		}
+	}
+	if len(denied) > 0 {
+		return 2
+	}
+	return 0
+}
+
+// takeLock acquires path for agentID as cm lock does, recording the
+// lock_req event. It returns the holder's ID if another agent has it.
+func (a *app) takeLock(agentID, path string, ttl time.Duration) (string, error) {
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	ts := a.tick(agentID, ep, rn)
+	_, conflict, err := a.store.AcquireLock(path, agentID, ts, ep, true, ttl)
+	if err != nil {
+		return "", err
+	}
+	body := ""
+	if conflict != nil {
+		body = fmt.Sprintf("%s: held by %s", store.LockDeniedPrefix, conflict.AgentID)
+	}
+	if _, err := a.insertEvent(&model.Event{AgentID: agentID, LamportTS: ts, Epoch: ep, Kind: model.EventLockReq,
+		Target: path, Body: body, CreatedAt: time.Now().UTC()}); err != nil {
+		a.logger().Warn("record lock_req event", "path", path, "err", err)
+	}
+	if conflict != nil {
+		return conflict.AgentID, nil
+	}
+	return "", nil
+}
+
+func (a *app) handoffList(args []string) int {
+	flags := flag.NewFlagSet("handoff list", flag.ContinueOnError)
+	agent := flags.String("agent", "", "list handoffs to or from this agent")
+	all := flags.Bool("all", false, "include accepted handoffs")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	agentID := *agent
+	if agentID == "" {
+		agentID = a.agentID
+	}
+	handoffs, err := a.store.ListHandoffs(agentID, !*all)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: handoff: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		if handoffs == nil {
+			handoffs = []store.Handoff{}
+		}
+		printJSON(handoffs)
+		return 0
+	}
+	if len(handoffs) == 0 {
+		fmt.Println("(no pending handoffs)")
+		return 0
+	}
+	for _, h := range handoffs {
+		state := "pending"
+		if h.AcceptedAt != nil {
+			state = "accepted"
+		}
+		fmt.Printf("%4d  %s -> %s  %-8s epoch %d  %s\n", h.ID, h.From, h.To, state, h.Epoch, strings.Join(h.Files, ", "))
+		if h.Summary != "" {
+			fmt.Printf("      next: %s\n", h.Summary)
+		}
+	}
+	return 0
+}
@@ -1,55 +1,353 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
 )
 
+// cmdHeartbeat advances the agent's clock and reports its working
+// position. With --interval it keeps beating until stopped, at the agent's
+// current position unless --epoch or --round is given, so that an agent
+// busy with a long task stays online and in the frontier. --daemon does
+// the same in the background, with a pidfile and log under .clockmail.
+// --at sets the position with steps below the round, e.g. 3.2.7, and
+// --scope the part of the repository the agent works on, so that scoped
+// gates (cm gate --scope) elsewhere do not wait for it.
+//
+// Usage:
+//
+//	cm heartbeat [--epoch N] [--round R] [--renew-locks]  # one beat
+//	cm heartbeat --at 3.2.7                                # one beat at step 7 of epoch 3 round 2
+//	cm heartbeat --scope pkg/store                         # declare where you work ("" for anywhere)
+//	cm heartbeat --interval 1m                             # beat until ctrl-c
+//	cm heartbeat --daemon [--interval 1m]                  # beat in the background
+//	cm heartbeat --stop                                    # stop the background beats
 func (a *app) cmdHeartbeat(args []string) int {
 	flags := flag.NewFlagSet("heartbeat", flag.ContinueOnError)
 	agent := flags.String("agent", "", "agent ID (overrides CLOCKMAIL_AGENT)")
 	epoch := flags.Int64("epoch", 0, "current working epoch")
 	round := flags.Int64("round", 0, "current working round")
+	at := flags.String("at", "", "current working position as dotted coordinates, e.g. 3.2.7 (instead of --epoch and --round)")
+	scope := flags.String("scope", "", "path prefix or module you are working on, recorded on the progress event (\"\" for anywhere)")
+	renewLocks := flags.Bool("renew-locks", false, "also extend every lock you hold by --lock-ttl (default on with --interval and --daemon)")
+	lockTTL := flags.Int("lock-ttl", a.lockTTLSeconds(), "lock TTL in seconds for --renew-locks")
+	interval := flags.Duration("interval", 0, "keep beating at this interval until stopped")
+	daemon := flags.Bool("daemon", false, "keep beating in the background (interval: --interval, default half of presence.online)")
+	stopDaemon := flags.Bool("stop", false, "stop the background heartbeat")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
 
 	agentID, err := a.resolveAgent(*agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
-		return 1
+		return failNoAgent(err, *jsonOut)
+	}
+	if *stopDaemon {
+		return a.stopHeartbeat(agentID, *jsonOut)
 	}
 
-	c := a.getClock(agentID)
-	ts := c.Tick()
-
-	if err := a.store.UpdateAgentClock(agentID, ts, *epoch, *round); err != nil {
+	opts := beatOptions{epoch: -1, round: -1, renewLocks: *renewLocks, lockTTL: time.Duration(*lockTTL) * time.Second}
+	if set["scope"] {
+		opts.scope = scope
+	}
+	loop := *daemon || *interval > 0
+	if !loop || set["epoch"] || set["round"] {
+		opts.epoch, opts.round = *epoch, *round
+	}
+	if ts, ok, err := parseAt(flags, *at); err != nil {
 		fmt.Fprintf(os.Stderr, "cm: heartbeat: %v\n", err)
 		return 1
+	} else if ok {
+		opts.epoch, opts.round, opts.steps, opts.at = ts.Epoch, ts.Round, ts.Steps, true
+	}
+	if loop && !set["renew-locks"] {
+		opts.renewLocks = true
+	}
+	if opts.epoch >= 0 && !a.checkWorkflow("heartbeat", agentID, opts.epoch, *jsonOut) {
+		return 2
+	}
+	if !loop {
+		a.printBeat(a.beat(agentID, opts), *jsonOut)
+		return 0
+	}
+
+	if *interval <= 0 {
+		*interval = max(a.presence("online")/2, time.Second)
+	}
+	if pid, ok := runningHeartbeat(agentID); ok && pid != os.Getpid() {
+		fmt.Fprintf(os.Stderr, "cm: heartbeat: already running for %s (pid %d; cm heartbeat --stop)\n", agentID, pid)
+		return 1
+	}
+	if *daemon {
+		return a.startHeartbeat(agentID, *interval, flags, *jsonOut)
 	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	return a.heartbeatLoop(agentID, opts, *interval, *jsonOut, sig)
+}
+
+// beatOptions says what each beat does. An epoch or round of -1 keeps the
+// agent's current one. With at set the agent moves to steps below the
+// round; otherwise its steps are kept while its epoch and round are. A
+// nil scope keeps the agent's current one.
+type beatOptions struct {
+	epoch, round int64
+	steps        []int64
+	at           bool
+	scope        *string
+	renewLocks   bool
+	lockTTL      time.Duration
+}
+
+// beatResult is what one beat did.
+type beatResult struct {
+	agentID      string
+	ts           int64
+	epoch, round int64
+	steps        []int64
+	scope        string
+	renewLocks   bool
+	renewed      []model.Lock
+	retired      []string
+}
 
-	if _, err := a.store.InsertEvent(&model.Event{
+// beat ticks the agent's clock and records a progress event at its
+// position, then retires finished sub-agents and renews locks as asked.
+func (a *app) beat(agentID string, opts beatOptions) beatResult {
+	ep, rn := a.resolveEpochRound(agentID, opts.epoch, opts.round)
+	ts := a.tick(agentID, ep, rn)
+	if opts.at {
+		if err := a.store.SetAgentAt(agentID, model.Timestamp{Epoch: ep, Round: rn, Steps: opts.steps}); err != nil {
+			a.logger().Warn("update position", "agent", agentID, "err", err)
+		}
+	}
+	if opts.scope != nil {
+		if err := a.store.SetAgentScope(agentID, *opts.scope); err != nil && !errors.Is(err, store.ErrNotRegistered) {
+			a.logger().Warn("update scope", "agent", agentID, "err", err)
+		}
+	}
+	steps, scope := opts.steps, ""
+	if opts.scope != nil {
+		scope = *opts.scope
+	}
+	if ag, err := a.store.GetAgent(agentID); err == nil {
+		steps, scope = ag.Steps, ag.Scope
+	}
+
+	// The progress event's target is the scope the agent reported.
+	if _, err := a.insertEvent(&model.Event{
 		AgentID:   agentID,
 		LamportTS: ts,
-		Epoch:     *epoch,
-		Round:     *round,
+		Epoch:     ep,
+		Round:     rn,
 		Kind:      model.EventProgress,
+		Target:    scope,
 		CreatedAt: time.Now().UTC(),
 	}); err != nil {
-		fmt.Fprintf(os.Stderr, "cm: heartbeat: event: %v\n", err)
+		a.logger().Warn("record progress event", "err", err)
+	}
+	a.recordFrontier()
+
+	r := beatResult{agentID: agentID, ts: ts, epoch: ep, round: rn, steps: steps, scope: scope, renewLocks: opts.renewLocks}
+	r.retired = a.retireSubAgents(agentID, ep)
+	if opts.renewLocks {
+		r.renewed = a.renewLocks(agentID, opts.lockTTL)
 	}
+	return r
+}
 
-	if *jsonOut {
-		printJSON(map[string]interface{}{
-			"agent_id": agentID, "lamport_ts": ts, "epoch": *epoch, "round": *round,
-		})
+func (a *app) printBeat(r beatResult, jsonOut bool) {
+	actions := a.unregisteredActions(r.agentID)
+	if jsonOut {
+		out := map[string]interface{}{
+			"agent_id": r.agentID, "lamport_ts": r.ts, "epoch": r.epoch, "round": r.round,
+		}
+		if len(r.steps) > 0 {
+			out["steps"] = r.steps
+		}
+		if r.scope != "" {
+			out["scope"] = r.scope
+		}
+		if r.renewLocks {
+			out["renewed_locks"] = r.renewed
+		}
+		if len(r.retired) > 0 {
+			out["retired"] = r.retired
+		}
+		if len(actions) > 0 {
+			out["next_actions"] = actions
+		}
+		printJSON(out)
+		return
+	}
+	pos := model.Timestamp{Epoch: r.epoch, Round: r.round, Steps: r.steps}
+	fmt.Printf("heartbeat %s ts=%d %s%s\n", r.agentID, r.ts, pos.Fields(), inScope(r.scope))
+	for _, l := range r.renewed {
+		fmt.Printf("  renewed %s (expires %s)\n", l.Path, l.ExpiresAt.Format(time.RFC3339))
+	}
+	if len(r.retired) > 0 {
+		fmt.Printf("  retired sub-agents: %s\n", strings.Join(r.retired, ", "))
+	}
+	printHints(actions)
+}
+
+// heartbeatLoop beats every interval until stop receives, holding the
+// agent's pidfile meanwhile.
+func (a *app) heartbeatLoop(agentID string, opts beatOptions, interval time.Duration, jsonOut bool, stop <-chan os.Signal) int {
+	pidfile := heartbeatPidfile(agentID)
+	if err := os.MkdirAll(workspacePath(""), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: heartbeat: %v\n", err)
+		return 1
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(pidfile, []byte(pid+"\n"), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: heartbeat: %v\n", err)
+		return 1
+	}
+	defer func() {
+		// Leave the file alone if another heartbeat has taken it over.
+		if data, err := os.ReadFile(pidfile); err == nil && strings.TrimSpace(string(data)) == pid {
+			os.Remove(pidfile)
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "heartbeat for %s every %s (ctrl-c to stop)\n", agentID, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.printBeat(a.beat(agentID, opts), jsonOut)
+		select {
+		case <-stop:
+			fmt.Fprintln(os.Stderr, "stopped")
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+// startHeartbeat runs cm heartbeat --interval again in a detached process
+// that logs to the workspace, and records its pid.
+func (a *app) startHeartbeat(agentID string, interval time.Duration, flags *flag.FlagSet, jsonOut bool) int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: heartbeat: %v\n", err)
+		return 1
+	}
+	args := []string{"heartbeat", "--agent", agentID, "--interval", interval.String()}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "agent", "interval", "daemon":
+		default:
+			args = append(args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	if err := os.MkdirAll(workspacePath(""), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: heartbeat: %v\n", err)
+		return 1
+	}
+	logPath := workspacePath("heartbeat-" + safeFileName(agentID) + ".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: heartbeat: %v\n", err)
+		return 1
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if workspaceRoot != "" {
+		cmd.Dir = workspaceRoot
+	}
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: heartbeat: %v\n", err)
+		return 1
+	}
+	pid := cmd.Process.Pid
+	// The child writes the pidfile too; writing it here as well means
+	// --stop works straight away.
+	if err := os.WriteFile(heartbeatPidfile(agentID), []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		a.logger().Warn("write heartbeat pidfile", "err", err)
+	}
+	cmd.Process.Release()
+
+	if jsonOut {
+		printJSON(map[string]interface{}{"agent_id": agentID, "pid": pid, "interval": interval.String(), "log": logPath})
+	} else {
+		fmt.Printf("heartbeat for %s running in the background (pid %d, every %s, log %s)\n", agentID, pid, interval, logPath)
+	}
+	return 0
+}
+
+// stopHeartbeat stops the agent's background heartbeat, if it has one.
+func (a *app) stopHeartbeat(agentID string, jsonOut bool) int {
+	pid, ok := runningHeartbeat(agentID)
+	if !ok {
+		if jsonOut {
+			printJSON(map[string]interface{}{"agent_id": agentID, "stopped": false})
+		} else {
+			fmt.Printf("no heartbeat running for %s\n", agentID)
+		}
+		return 2
+	}
+	if err := stopProcess(pid); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: heartbeat: stop pid %d: %v\n", pid, err)
+		return 1
+	}
+	os.Remove(heartbeatPidfile(agentID))
+	if jsonOut {
+		printJSON(map[string]interface{}{"agent_id": agentID, "stopped": true, "pid": pid})
 	} else {
-		fmt.Printf("heartbeat %s ts=%d epoch=%d round=%d\n", agentID, ts, *epoch, *round)
+		fmt.Printf("stopped heartbeat for %s (pid %d)\n", agentID, pid)
 	}
 	return 0
 }
+
+// runningHeartbeat returns the pid in the agent's heartbeat pidfile if
+// that process is alive. A stale pidfile is removed.
+func runningHeartbeat(agentID string) (int, bool) {
+	pidfile := heartbeatPidfile(agentID)
+	data, err := os.ReadFile(pidfile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "cm: heartbeat: %v\n", err)
+		}
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || !processAlive(pid) {
+		os.Remove(pidfile)
+		return 0, false
+	}
+	return pid, true
+}
+
+// heartbeatPidfile is where the agent's heartbeat loop records its pid.
+func heartbeatPidfile(agentID string) string {
+	return workspacePath("heartbeat-" + safeFileName(agentID) + ".pid")
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// safeFileName turns an agent ID, which may contain slashes and the like,
+// into something usable in a file name.
+func safeFileName(s string) string {
+	return unsafeFileChars.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/daviddao/clockmail/pkg/worktree"
+)
+
+// hookMarker identifies hook scripts written by cm hook install, so that
+// reinstalling and uninstalling never touch hooks written by anyone else.
+const hookMarker = "# clockmail hook"
+
+// hookScripts are the git hooks installed by cm hook install. They parse
+// cm's JSON output with jq when it is installed and fall back to the
+// plain-text output otherwise. Both hooks do nothing outside an agent
+// session (no CLOCKMAIL_AGENT and no --agent at install time) or when cm
+// is not on the PATH, so humans sharing the clone are not affected.
+var hookScripts = map[string]*template.Template{
+	"pre-commit": hookTemplate(`#!/bin/sh
+{{.Marker}}: refuse to commit files locked by other agents.
+# Installed by cm hook install; bypass once with git commit --no-verify.
+{{template "guard" .}}
+out=$({{.CM}} conflicts --staged --json{{.AgentFlag}} 2>&1)
+case $? in
+0) exit 0 ;;
+2) ;;
+*)
+	echo "clockmail: lock check failed, committing anyway: $out" >&2
+	exit 0
+	;;
+esac
+echo "clockmail: staged files are locked by other agents:" >&2
+if command -v jq >/dev/null 2>&1; then
+	printf '%s\n' "$out" | jq -r '.conflicts[] | "  \(.path): locked by \(.holder) (lock \(.lock))"' >&2
+else
+	{{.CM}} conflicts --staged{{.AgentFlag}} 2>/dev/null | grep '^CONFLICT' >&2
+fi
+echo "Ask the holder to release the lock (cm send <holder> ...), or commit with --no-verify." >&2
+exit 1
+`),
+	"post-commit": hookTemplate(`#!/bin/sh
+{{.Marker}}: request review of each new commit.
+# Installed by cm hook install.
+{{template "guard" .}}
+# Commits replayed by a rebase were reviewed when first made.
+[ -d "$(git rev-parse --git-path rebase-merge)" ] && exit 0
+[ -d "$(git rev-parse --git-path rebase-apply)" ] && exit 0
+sha=$(git rev-parse HEAD) || exit 0
+IFS='
+'
+files=$(git diff-tree --root --no-commit-id --name-only -r HEAD)
+if ! out=$({{.CM}} review-request --json --to {{.Reviewer}}{{.AgentFlag}} "$sha" $files 2>&1); then
+	echo "clockmail: review-request failed: $out" >&2
+	exit 0
+fi
+if command -v jq >/dev/null 2>&1; then
+	printf '%s\n' "$out" | jq -r '"clockmail: review requested from \(.recipients | join(",")) at ts=\(.lamport_ts)"'
+else
+	echo "clockmail: review requested for $sha"
+fi
+`),
+}
+
+const hookGuard = `{{define "guard"}}command -v {{.CM}} >/dev/null 2>&1 || exit 0
+{{- if not .Agent}}
+[ -n "$CLOCKMAIL_AGENT" ] || exit 0
+{{- end}}{{end}}`
+
+func hookTemplate(src string) *template.Template {
+	return template.Must(template.Must(template.New("hook").Parse(hookGuard)).Parse(src))
+}
+
+// hookParams fills in hookScripts. CM, AgentFlag and Reviewer are
+// shell-quoted; Agent is only tested for being set.
+type hookParams struct {
+	Marker    string
+	CM        string
+	Agent     string
+	AgentFlag string
+	Reviewer  string
+}
+
+// cmdHook installs and removes the git hooks that tie commits to
+// clockmail: pre-commit runs cm conflicts --staged and refuses the commit
+// if another agent holds a lock on a staged file; post-commit sends a
+// review request carrying the commit SHA and its changed files.
+//
+// session-start and session-end are run by agent runners' own lifecycle
+// hooks rather than by git, so that every session registers and leaves
+// properly without the agent having to remember to.
+//
+// Usage:
+//
+//	cm hook install [--reviewer tester] [--agent ID] [--cm PATH] [--force]
+//	cm hook uninstall
+//	cm hook session-start [--agent ID] [--budget N]
+//	cm hook session-end [--agent ID] [--message TEXT]
+func (a *app) cmdHook(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm hook <install|uninstall|session-start|session-end> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "install":
+		return a.hookInstall(args[1:])
+	case "uninstall":
+		return a.hookUninstall(args[1:])
+	case "session-start":
+		return a.hookSessionStart(args[1:])
+	case "session-end":
+		return a.hookSessionEnd(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: hook: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) hookInstall(args []string) int {
+	flags := flag.NewFlagSet("hook install", flag.ContinueOnError)
+	reviewer := flags.String("reviewer", a.cfg.String("review.reviewer"), "agent (or all, or @capability) asked to review each commit")
+	agent := flags.String("agent", "", "agent ID written into the hooks (default: $CLOCKMAIL_AGENT at commit time)")
+	cm := flags.String("cm", "cm", "cm command the hooks run")
+	force := flags.Bool("force", false, "replace existing hooks not written by cm (saved as <hook>.bak)")
+	dir := flags.String("dir", ".", "directory inside the git working tree")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	hooksDir, err := hooksDirOf(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+		return 1
+	}
+	p := hookParams{
+		Marker:   hookMarker,
+		CM:       shellQuote(*cm),
+		Agent:    *agent,
+		Reviewer: shellQuote(*reviewer),
+	}
+	if *agent != "" {
+		p.AgentFlag = " --agent " + shellQuote(*agent)
+	}
+
+	// Check every hook before writing any, so a refusal leaves the
+	// repository as it was.
+	names := []string{"pre-commit", "post-commit"}
+	backups := []string{}
+	for _, name := range names {
+		ours, exists, err := readHook(filepath.Join(hooksDir, name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+			return 1
+		}
+		if exists && !ours {
+			if !*force {
+				fmt.Fprintf(os.Stderr, "cm: hook: %s already exists and was not installed by cm (use --force to replace it)\n",
+					filepath.Join(hooksDir, name))
+				return 1
+			}
+			backups = append(backups, name)
+		}
+	}
+
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+		return 1
+	}
+	for _, name := range backups {
+		path := filepath.Join(hooksDir, name)
+		if err := os.Rename(path, path+".bak"); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+			return 1
+		}
+	}
+	for _, name := range names {
+		var buf bytes.Buffer
+		if err := hookScripts[name].Execute(&buf, p); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: hook: %s: %v\n", name, err)
+			return 1
+		}
+		if err := os.WriteFile(filepath.Join(hooksDir, name), buf.Bytes(), 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+			return 1
+		}
+		// WriteFile keeps the mode of an existing file.
+		if err := os.Chmod(filepath.Join(hooksDir, name), 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+			return 1
+		}
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{
+			"hooks_dir": hooksDir, "installed": names, "backed_up": backups, "reviewer": *reviewer,
+		})
+		return 0
+	}
+	for _, name := range backups {
+		fmt.Printf("saved existing %s as %s.bak\n", name, name)
+	}
+	fmt.Printf("installed pre-commit and post-commit hooks in %s\n", hooksDir)
+	fmt.Println("  pre-commit:  refuses commits of files locked by other agents")
+	fmt.Printf("  post-commit: requests review from %s\n", *reviewer)
+	if *agent == "" {
+		fmt.Println("  hooks act only when CLOCKMAIL_AGENT is set")
+	}
+	return 0
+}
+
+func (a *app) hookUninstall(args []string) int {
+	flags := flag.NewFlagSet("hook uninstall", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "directory inside the git working tree")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	hooksDir, err := hooksDirOf(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+		return 1
+	}
+	removed := []string{}
+	for _, name := range []string{"pre-commit", "post-commit"} {
+		path := filepath.Join(hooksDir, name)
+		ours, _, err := readHook(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+			return 1
+		}
+		if !ours {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+			return 1
+		}
+		// Put back whatever install --force replaced.
+		if _, err := os.Stat(path + ".bak"); err == nil {
+			if err := os.Rename(path+".bak", path); err != nil {
+				fmt.Fprintf(os.Stderr, "cm: hook: %v\n", err)
+				return 1
+			}
+		}
+		removed = append(removed, name)
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"hooks_dir": hooksDir, "removed": removed})
+		return 0
+	}
+	if len(removed) == 0 {
+		fmt.Printf("no clockmail hooks in %s\n", hooksDir)
+		return 0
+	}
+	fmt.Printf("removed %s from %s\n", strings.Join(removed, ", "), hooksDir)
+	return 0
+}
+
+func hooksDirOf(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	repo, err := worktree.Open(absDir)
+	if err != nil {
+		return "", err
+	}
+	return repo.HooksDir()
+}
+
+// readHook reports whether the hook at path exists and was written by cm.
+func readHook(path string) (ours, exists bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return strings.Contains(string(data), hookMarker), true, nil
+}
+
+// shellQuote quotes s for a POSIX shell, leaving plain words alone.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./@:,+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// hookSessionStart is for an agent runner's session start hook: it
+// registers the agent (which also mints its session token and signing
+// key) and prints cm prime, which the runner adds to the agent's
+// context. --role and --capabilities are passed on to cm register;
+// without them the agent keeps the ones it had.
+//
+// Usage: cm hook session-start [--agent ID] [--role R] [--capabilities C] [--budget N]
+func (a *app) hookSessionStart(args []string) int {
+	flags := flag.NewFlagSet("hook session-start", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID")
+	role := flags.String("role", "", "roles to register with (comma-separated)")
+	caps := flags.String("capabilities", "", "capabilities to register with (comma-separated)")
+	budget := flags.Int("budget", 0, "approximate token budget for the prime output (0 = no limit)")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: hook session-start: %v\n", err)
+		return 1
+	}
+
+	register := []string{agentID}
+	if *role != "" {
+		register = append(register, "--role", *role)
+	}
+	if *caps != "" {
+		register = append(register, "--capabilities", *caps)
+	}
+	if code := a.cmdRegister(register); code != 0 {
+		return code
+	}
+	fmt.Println()
+	return a.cmdPrime([]string{"--agent", agentID, "--budget", strconv.Itoa(*budget)})
+}
+
+// hookSessionEnd is for an agent runner's session end hook. It runs a
+// final sync at the agent's current position, so messages that arrived
+// during the session are received and its position recorded; broadcasts
+// a [status] leaving message naming the locks it is giving up; and then
+// runs cm bye, which releases them and drops the agent out of the
+// frontier. A failed sync or broadcast does not stop the departure:
+// leaving locks behind is worse than a missed message.
+//
+// Usage: cm hook session-end [--agent ID] [--message TEXT]
+func (a *app) hookSessionEnd(args []string) int {
+	flags := flag.NewFlagSet("hook session-end", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID")
+	message := flags.String("message", "", "what to tell the other agents (default: the locks being released)")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: hook session-end: %v\n", err)
+		return 1
+	}
+
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	if code := a.cmdSync([]string{"--agent", agentID,
+		"--epoch", strconv.FormatInt(ep, 10), "--round", strconv.FormatInt(rn, 10)}); code != 0 {
+		fmt.Fprintf(os.Stderr, "cm: hook session-end: final sync exited %d; leaving anyway\n", code)
+	}
+
+	detail := *message
+	if detail == "" {
+		locks, _ := a.store.ListLocksForAgent(agentID)
+		paths := make([]string, len(locks))
+		for i, l := range locks {
+			paths[i] = l.Path
+		}
+		detail = "session ended"
+		if len(paths) > 0 {
+			detail += "; releasing " + strings.Join(paths, ", ")
+		}
+	}
+	// Nobody to tell if the agent is the last one here.
+	if others, _ := a.resolveRecipients("all", agentID); len(others) > 0 {
+		body := strings.NewReplacer("{state}", "leaving", "{detail}", detail).Replace(builtinTemplates["status"])
+		if code := a.cmdSend([]string{"--agent", agentID, "all", body}); code != 0 {
+			fmt.Fprintf(os.Stderr, "cm: hook session-end: departure broadcast exited %d; leaving anyway\n", code)
+		}
+	}
+	return a.cmdBye([]string{"--agent", agentID})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// cmdIdentity shows which agents have registered signing keys and turns
+// strict signatures on or off. In strict mode the database refuses any
+// event, imported ones included, that is not signed by its agent's
+// registered key.
+//
+// Usage:
+//
+//	cm identity [status] [--json]
+//	cm identity strict <on|off>
+func (a *app) cmdIdentity(args []string) int {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		return a.identityStatus(args)
+	}
+	switch args[0] {
+	case "status":
+		return a.identityStatus(args[1:])
+	case "strict":
+		return a.identityStrict(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: identity: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+// identityRow is one agent's signing key as cm identity status reports it.
+type identityRow struct {
+	AgentID string `json:"agent_id"`
+	Key     string `json:"key,omitempty"`
+	// Local is "match" when this machine holds the agent's registered
+	// key, "mismatch" when it holds a different one, or "" when it holds
+	// none.
+	Local string `json:"local,omitempty"`
+}
+
+func (a *app) identityStatus(args []string) int {
+	flags := flag.NewFlagSet("identity status", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	strict, err := a.store.StrictSignatures()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: identity: %v\n", err)
+		return 1
+	}
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: identity: %v\n", err)
+		return 1
+	}
+	rows := []identityRow{}
+	for _, ag := range agents {
+		r := identityRow{AgentID: ag.ID}
+		r.Key, err = a.store.SigningKey(ag.ID)
+		if err != nil && err != sql.ErrNoRows {
+			fmt.Fprintf(os.Stderr, "cm: identity: %v\n", err)
+			return 1
+		}
+		if _, statErr := os.Stat(signingKeyPath(ag.ID)); statErr == nil {
+			if pub, _, err := ensureSigningKey(ag.ID); err == nil && pub == r.Key {
+				r.Local = "match"
+			} else {
+				r.Local = "mismatch"
+			}
+		}
+		rows = append(rows, r)
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"strict": strict, "agents": rows})
+		return 0
+	}
+	mode := "off (unsigned events are accepted)"
+	if strict {
+		mode = "on (events must be signed by their agent's registered key)"
+	}
+	fmt.Printf("strict signatures: %s\n", mode)
+	for _, r := range rows {
+		key := "no signing key (cm register " + r.AgentID + ")"
+		if r.Key != "" {
+			key = "key " + r.Key
+		}
+		local := ""
+		switch r.Local {
+		case "match":
+			local = "; private key here"
+		case "mismatch":
+			local = "; private key here does NOT match"
+		}
+		fmt.Printf("  %-16s %s%s\n", r.AgentID, key, local)
+	}
+	return 0
+}
+
+func (a *app) identityStrict(args []string) int {
+	flags := flag.NewFlagSet("identity strict", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 || (flags.Arg(0) != "on" && flags.Arg(0) != "off") {
+		fmt.Fprintln(os.Stderr, "usage: cm identity strict <on|off> [--json]")
+		return 1
+	}
+	on := flags.Arg(0) == "on"
+	if err := a.store.SetStrictSignatures(on); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: identity: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"strict": on})
+		return 0
+	}
+	if on {
+		fmt.Println("strict signatures on: events not signed by their agent's registered key are refused")
+		if agents, err := a.store.ListAgents(); err == nil {
+			for _, ag := range agents {
+				if _, err := a.store.SigningKey(ag.ID); err == sql.ErrNoRows {
+					fmt.Fprintf(os.Stderr, "cm: identity: %s has no signing key and can no longer write events (cm register %s)\n", ag.ID, ag.ID)
+				}
+			}
+		}
+	} else {
+		fmt.Println("strict signatures off")
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// cmdImport replays a JSONL event log (from cm export or cm gc --archive)
+// into the current database. Missing agents are created and every
+// sender's Lamport clock is raised to its highest imported timestamp, so
+// new events always sort after the imported history.
+//
+// Imported messages are treated as already delivered unless --unread is
+// given; replaying history should not flood inboxes. Once any agent holds
+// the admin role, only an admin may import.
+//
+// Usage:
+//
+//	cm import history.jsonl
+//	cm import --unread pending.jsonl
+//	cm export | cm import -
+func (a *app) cmdImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent importing: an admin, once there is one")
+	unread := flags.Bool("unread", false, "leave imported messages pending in recipients' inboxes")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm import <file|-> [--unread] [--json]")
+		return 1
+	}
+
+	var in io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: import: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	events, err := readEventsJSONL(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: import: %v\n", err)
+		return 1
+	}
+
+	a.actAs(*agent)
+	res, err := a.store.ImportEvents(events, !*unread)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: import: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(res)
+	} else {
+		fmt.Printf("imported %d event(s), skipped %d duplicate(s)\n", res.Imported, res.Duplicates)
+		if len(res.AgentsCreated) > 0 {
+			fmt.Printf("  created agents: %s\n", strings.Join(res.AgentsCreated, ", "))
+		}
+	}
+	return 0
+}
+
+// readEventsJSONL decodes one model.Event per line, skipping blank lines.
+func readEventsJSONL(r io.Reader) ([]model.Event, error) {
+	var events []model.Event
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		var e model.Event
+		if err := json.Unmarshal([]byte(text), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		events = append(events, e)
+	}
+	return events, sc.Err()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// cmdInbox lists the messages an agent kept with cm recv --keep or
+// flagged, oldest first, so that several conversations can stay open at
+// once instead of living only in the agent's context. --flag and --unflag
+// mark messages for attention; cm archive files them away.
+//
+// Usage:
+//
+//	cm inbox [--flagged | --archived | --all] [--json]
+//	cm inbox --flag ID [--flag ID...]
+//	cm inbox --unflag ID
+func (a *app) cmdInbox(args []string) int {
+	flags := flag.NewFlagSet("inbox", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID")
+	flagged := flags.Bool("flagged", false, "list only flagged messages")
+	archived := flags.Bool("archived", false, "list archived messages")
+	all := flags.Bool("all", false, "list messages in every state")
+	var flagList, unflagList stringList
+	flags.Var(&flagList, "flag", "flag the message with this event ID (repeatable, or comma-separated)")
+	flags.Var(&unflagList, "unflag", "move a flagged message back to the inbox (repeatable, or comma-separated)")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	if len(flagList) > 0 || len(unflagList) > 0 {
+		code := a.fileMessages("inbox", agentID, flagList, store.StateFlagged, "flagged", *jsonOut)
+		if code == 0 {
+			code = a.fileMessages("inbox", agentID, unflagList, store.StateInbox, "unflagged", *jsonOut)
+		}
+		return code
+	}
+
+	states := []store.MessageState{store.StateInbox, store.StateFlagged}
+	switch {
+	case *all:
+		states = nil
+	case *archived:
+		states = []store.MessageState{store.StateArchived}
+	case *flagged:
+		states = []store.MessageState{store.StateFlagged}
+	}
+	msgs, err := a.store.ListMessages(agentID, states...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: inbox: %v\n", err)
+		return 1
+	}
+	for i := range msgs {
+		e := []model.Event{msgs[i].Event}
+		openSealed(agentID, e)
+		msgs[i].Event = e[0]
+	}
+
+	if *jsonOut {
+		if msgs == nil {
+			msgs = []store.FiledMessage{}
+		}
+		printJSON(map[string]interface{}{"messages": msgs, "count": len(msgs)})
+		return 0
+	}
+	if len(msgs) == 0 {
+		fmt.Println("inbox is empty")
+		return 0
+	}
+	for _, m := range msgs {
+		note := ""
+		if m.State != store.StateInbox {
+			note = " (" + string(m.State) + ")"
+		}
+		e := m.Event
+		fmt.Printf("[id=%d ts=%d] %s%s: %s%s\n", e.ID, e.LamportTS, priorityTag(e), e.AgentID, e.Body, note)
+	}
+	return 0
+}
+
+// cmdArchive files messages away: they leave cm inbox, and cm gc may
+// delete them like any other received message. --undo returns them to the
+// inbox.
+//
+// Usage:
+//
+//	cm archive [--undo] <event_id>...
+func (a *app) cmdArchive(args []string) int {
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID")
+	undo := flags.Bool("undo", false, "move the messages back to the inbox")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: cm archive [--undo] <event_id>...")
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	if *undo {
+		return a.fileMessages("archive", agentID, flags.Args(), store.StateInbox, "moved to the inbox", *jsonOut)
+	}
+	return a.fileMessages("archive", agentID, flags.Args(), store.StateArchived, "archived", *jsonOut)
+}
+
+// fileMessages sets the state of the messages whose IDs are in vals and
+// reports it as done.
+func (a *app) fileMessages(cmd, agentID string, vals []string, state store.MessageState, done string, jsonOut bool) int {
+	ids, err := parseEventIDs(vals)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: %s: %v\n", cmd, err)
+		return 1
+	}
+	if len(ids) == 0 {
+		return 0
+	}
+	if err := a.store.SetMessageState(agentID, ids, state); err != nil {
+		if errors.Is(err, store.ErrNotInInbox) {
+			fmt.Fprintf(os.Stderr, "cm: %s: %v (%s)\n", cmd, err, agentID)
+		} else {
+			fmt.Fprintf(os.Stderr, "cm: %s: %v\n", cmd, err)
+		}
+		return 1
+	}
+	if jsonOut {
+		printJSON(map[string]interface{}{"ids": ids, "state": state})
+	} else {
+		fmt.Printf("%s %s\n", done, joinIDs(ids))
+	}
+	return 0
+}
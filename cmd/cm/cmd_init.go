@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -34,16 +35,34 @@ Run ` + "`cm prime`" + ` for current coordination state, or ` + "`cm onboard`" +
 <!-- END CLOCKMAIL INTEGRATION -->
 `
 
+// cmdInit sets up clockmail for a project. The workspace (.clockmail and
+// its marker, see workspace.go) is created in the working directory, or
+// reused if the directory is already inside one, and cm then finds it
+// from any subdirectory.
+//
+// --template sets up a known team in the same step (see
+// init_templates.go): cm init --template swarm-6 registers a planner, a
+// reviewer and four workers with their roles, opens the plan, build and
+// review epochs and writes settings tuned for that many agents.
 func (a *app) cmdInit(args []string) int {
 	flags := flag.NewFlagSet("init", flag.ContinueOnError)
 	agent := flags.String("agent", "", "agent ID to register (optional)")
-	agentsFile := flags.String("agents-md", "AGENTS.md", "path to AGENTS.md")
+	agentsFile := flags.String("agents-md", filepath.Join(workspaceRoot, "AGENTS.md"), "path to AGENTS.md")
 	skipAgents := flags.Bool("skip-agents-md", false, "don't touch AGENTS.md")
+	templateName := flags.String("template", "", "team preset: "+initTemplateNames)
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
+	var tmpl *initTemplate
+	if *templateName != "" {
+		var err error
+		if tmpl, err = lookupInitTemplate(*templateName); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: init: %v\n", err)
+			return 1
+		}
+	}
 
-	dbPath := envOr("CLOCKMAIL_DB", defaultDB)
+	dbPath := dbLocation()
 
 	agents, err := a.store.ListAgents()
 	if err != nil {
@@ -51,7 +70,11 @@ func (a *app) cmdInit(args []string) int {
 		return 1
 	}
 
-	fmt.Printf("initialized clockmail (db: %s)\n", dbPath)
+	root := workspaceRoot
+	if root == "" {
+		root, _ = os.Getwd()
+	}
+	fmt.Printf("initialized clockmail in %s (db: %s)\n", root, dbPath)
 	if len(agents) > 0 {
 		fmt.Printf("  %d existing agent(s)\n", len(agents))
 	}
@@ -69,6 +92,28 @@ func (a *app) cmdInit(args []string) int {
 		fmt.Printf("  registered agent %q (clock=%d)\n", ag.ID, ag.Clock)
 	}
 
+	if tmpl != nil {
+		res, err := a.applyInitTemplate(tmpl)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: init: template %s: %v\n", tmpl.Name, err)
+			return 1
+		}
+		fmt.Printf("  template %s: %s\n", tmpl.Name, tmpl.Desc)
+		for _, ag := range res.Registered {
+			fmt.Printf("    registered %-12s roles %s\n", ag.ID, strings.Join(ag.Roles, ","))
+		}
+		for _, n := range res.Epochs {
+			fmt.Printf("    opened epoch %d\n", n)
+		}
+		for _, st := range res.Written {
+			fmt.Printf("    config %s = %s\n", st.Key, st.Value)
+		}
+		for _, st := range res.Kept {
+			fmt.Printf("    config %s = %s (already set, kept)\n", st.Key, st.Value)
+		}
+		fmt.Printf("    channels: %s\n", strings.Join(tmpl.roleChannels(), ", "))
+	}
+
 	if !*skipAgents {
 		if err := injectAgentsSection(*agentsFile); err != nil {
 			fmt.Fprintf(os.Stderr, "cm: AGENTS.md: %v\n", err)
@@ -77,10 +122,19 @@ func (a *app) cmdInit(args []string) int {
 
 	fmt.Println()
 	fmt.Println("next steps:")
-	if agentID == "" {
+	switch {
+	case tmpl != nil && agentID == "":
+		ids := make([]string, len(tmpl.Agents))
+		for i, ag := range tmpl.Agents {
+			ids[i] = ag.ID
+		}
+		fmt.Printf("  in each session, as one of %s:\n", strings.Join(ids, ", "))
+		fmt.Println("  export CLOCKMAIL_AGENT=<id>")
+		fmt.Println("  cm register <id>   # keeps the template's roles")
+	case agentID == "":
 		fmt.Println("  export CLOCKMAIL_AGENT=<your-id>")
 		fmt.Println("  cm register <your-id>")
-	} else {
+	default:
 		fmt.Printf("  export CLOCKMAIL_AGENT=%s\n", agentID)
 	}
 	fmt.Println("  cm prime       # see coordination context")
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/seal"
+	"github.com/daviddao/clockmail/pkg/sign"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// keysDir is where agents' private keys live: CLOCKMAIL_KEYS, or
+// .clockmail/keys. It should not be on the filesystem the database is
+// shared over.
+func keysDir() string {
+	return envOr("CLOCKMAIL_KEYS", workspacePath("keys"))
+}
+
+func privateKeyPath(agentID string) string {
+	return filepath.Join(keysDir(), agentID+".key")
+}
+
+// loadPrivateKey reads agentID's private key from keysDir.
+func loadPrivateKey(agentID string) (string, error) {
+	b, err := os.ReadFile(privateKeyPath(agentID))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// ensureKeyPair returns the public half of agentID's private key,
+// generating and saving a private key first if there is none.
+func ensureKeyPair(agentID string) (pub string, created bool, err error) {
+	return ensureKeyFile(privateKeyPath(agentID), seal.GenerateKey, seal.PublicKey)
+}
+
+// signingKeyPath is where agentID's event signing key lives, next to its
+// sealing key.
+func signingKeyPath(agentID string) string {
+	return filepath.Join(keysDir(), agentID+".sign")
+}
+
+// ensureSigningKey returns the public half of agentID's signing key,
+// generating and saving one first if there is none.
+func ensureSigningKey(agentID string) (pub string, created bool, err error) {
+	return ensureKeyFile(signingKeyPath(agentID), sign.GenerateKey, sign.PublicKey)
+}
+
+// ensureKeyFile returns the public half of the private key in path,
+// generating one and saving it with owner-only permissions if the file
+// does not exist.
+func ensureKeyFile(path string, generate func() (string, string, error), public func(string) (string, error)) (pub string, created bool, err error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		pub, err = public(strings.TrimSpace(string(b)))
+		return pub, false, err
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", false, err
+	}
+	priv, pub, err := generate()
+	if err != nil {
+		return "", false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", false, err
+	}
+	if err := os.WriteFile(path, []byte(priv+"\n"), 0600); err != nil {
+		return "", false, err
+	}
+	return pub, true, nil
+}
+
+// localSigner signs events with the signing keys in keysDir. Events by
+// agents with no key here are left unsigned.
+func localSigner() store.Signer {
+	keys := make(map[string]string)
+	return func(e *model.Event) (string, error) {
+		priv, ok := keys[e.AgentID]
+		if !ok {
+			b, err := os.ReadFile(signingKeyPath(e.AgentID))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+			priv = strings.TrimSpace(string(b))
+			keys[e.AgentID] = priv
+		}
+		if priv == "" {
+			return "", nil
+		}
+		return sign.Sign(priv, e.SigningPayload())
+	}
+}
+
+// sealFor encrypts body for each recipient with their registered public
+// key. It fails, sealing nothing, if any recipient has no key.
+func (a *app) sealFor(recipients []string, body string) (map[string]string, error) {
+	sealed := make(map[string]string, len(recipients))
+	var missing []string
+	for _, r := range recipients {
+		pub, err := a.store.PublicKey(r)
+		if err != nil {
+			missing = append(missing, r)
+			continue
+		}
+		if sealed[r], err = seal.Seal(pub, []byte(body)); err != nil {
+			return nil, fmt.Errorf("seal for %s: %w", r, err)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no public key registered for %s (cm register <id> --keygen)", strings.Join(missing, ", "))
+	}
+	return sealed, nil
+}
+
+// openSealed decrypts, in place, the sealed bodies of messages addressed
+// to agentID, using its private key. Bodies that cannot be opened are
+// replaced by a note saying why.
+func openSealed(agentID string, events []model.Event) {
+	var priv string
+	var keyErr error
+	loaded := false
+	for i := range events {
+		e := &events[i]
+		if e.Target != agentID || !seal.IsSealed(e.Body) {
+			continue
+		}
+		if !loaded {
+			priv, keyErr = loadPrivateKey(agentID)
+			loaded = true
+		}
+		if keyErr != nil {
+			e.Body = fmt.Sprintf("[sealed message; no private key for %s: %v]", agentID, keyErr)
+			continue
+		}
+		plain, err := seal.Open(priv, e.Body)
+		if err != nil {
+			e.Body = fmt.Sprintf("[sealed message; cannot open: %v]", err)
+			continue
+		}
+		e.Body = string(plain)
+	}
+}
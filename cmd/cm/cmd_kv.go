@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// cmdKV reads and writes the shared scratchpad: small facts (a port, a
+// build status, a branch name) that every agent can look up without a
+// message. Each write is stamped with the writer's Lamport clock and
+// recorded as a kv event; of concurrent writes to a key the last in
+// Lamport order wins, ties broken by agent ID.
+//
+// Usage:
+//
+//	cm kv set api_port 8080
+//	cm kv get api_port              # prints 8080
+//	cm kv list
+//	cm kv watch build_status        # prints each new value until ctrl-c
+func (a *app) cmdKV(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm kv <set|get|list|watch> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "set":
+		return a.kvSet(args[1:])
+	case "get":
+		return a.kvGet(args[1:])
+	case "list", "ls":
+		return a.kvList(args[1:])
+	case "watch":
+		return a.kvWatch(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: kv: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) kvSet(args []string) int {
+	flags := flag.NewFlagSet("kv set", flag.ContinueOnError)
+	agent := flags.String("agent", "", "writing agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: cm kv set <key> <value> [--json]")
+		return 1
+	}
+	key, value := words[0], strings.Join(words[1:], " ")
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	ts, err := a.recordEvent(agentID, model.EventKV, key, value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: kv set: %v\n", err)
+		return 1
+	}
+	cur, applied, err := a.store.SetKV(model.KVEntry{Key: key, Value: value, AgentID: agentID, LamportTS: ts})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: kv set: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"entry": cur, "applied": applied, "lamport_ts": ts})
+		return 0
+	}
+	if !applied {
+		fmt.Printf("%s = %s (kept: %s's write at ts=%d is later than yours at ts=%d)\n",
+			key, cur.Value, cur.AgentID, cur.LamportTS, ts)
+		return 0
+	}
+	fmt.Printf("%s = %s (ts=%d)\n", key, value, ts)
+	return 0
+}
+
+func (a *app) kvGet(args []string) int {
+	flags := flag.NewFlagSet("kv get", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm kv get <key> [--json]")
+		return 1
+	}
+	e, err := a.store.GetKV(words[0])
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fmt.Errorf("%s is not set", words[0])
+		}
+		fmt.Fprintf(os.Stderr, "cm: kv get: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(e)
+	} else {
+		fmt.Println(e.Value)
+	}
+	return 0
+}
+
+func (a *app) kvList(args []string) int {
+	flags := flag.NewFlagSet("kv list", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	entries, err := a.store.ListKV()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: kv list: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		if entries == nil {
+			entries = []model.KVEntry{}
+		}
+		printJSON(entries)
+		return 0
+	}
+	if len(entries) == 0 {
+		fmt.Println("no keys set")
+		return 0
+	}
+	for _, e := range entries {
+		fmt.Printf("%-20s %-20s %s ts=%d\n", e.Key, e.Value, e.AgentID, e.LamportTS)
+	}
+	return 0
+}
+
+// kvWatch prints a key's value, then each value it takes, until
+// interrupted, --once after the first change, or --timeout.
+//
+// Exit codes:
+//
+//	0 = interrupted, or changed (with --once)
+//	1 = error or timeout
+func (a *app) kvWatch(args []string) int {
+	flags := flag.NewFlagSet("kv watch", flag.ContinueOnError)
+	once := flags.Bool("once", false, "exit after the first change")
+	timeout := flags.Duration("timeout", 0, "give up after this long (0 = never)")
+	jsonOut := flags.Bool("json", false, "JSON output (one object per line)")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm kv watch <key> [--once] [--timeout 10m] [--json]")
+		return 1
+	}
+	key := words[0]
+	show := func(e *model.KVEntry) {
+		if *jsonOut {
+			b, _ := json.Marshal(e)
+			fmt.Println(string(b))
+		} else {
+			fmt.Printf("%s = %s (%s, ts=%d)\n", e.Key, e.Value, e.AgentID, e.LamportTS)
+		}
+	}
+	// read returns the key's entry, or nil if it is not set.
+	read := func() (*model.KVEntry, error) {
+		e, err := a.store.GetKV(key)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return e, err
+	}
+
+	last, err := read()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: kv watch: %v\n", err)
+		return 1
+	}
+	if last != nil {
+		show(last)
+	} else if !*jsonOut {
+		fmt.Fprintf(os.Stderr, "%s is not set yet\n", key)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	wake, _, stop := a.wakeups(max(a.cfg.Duration("poll.watch_interval"), time.Second))
+	defer stop()
+	var deadline <-chan time.Time
+	if *timeout > 0 {
+		t := time.NewTimer(*timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	for {
+		select {
+		case <-sig:
+			fmt.Fprintln(os.Stderr, "\nstopped")
+			return 0
+		case <-deadline:
+			fmt.Fprintf(os.Stderr, "cm: kv watch: %s did not change in %s\n", key, *timeout)
+			return 1
+		case <-wake:
+			e, err := read()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cm: kv watch: %v\n", err)
+				continue
+			}
+			if e == nil || (last != nil && e.LamportTS == last.LamportTS && e.AgentID == last.AgentID) {
+				continue
+			}
+			show(e)
+			last = e
+			if *once {
+				return 0
+			}
+		}
+	}
+}
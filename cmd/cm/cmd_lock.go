@@ -1,88 +1,444 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/daviddao/clockmail/pkg/clock"
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+	"github.com/daviddao/clockmail/pkg/trace"
 )
 
 func (a *app) cmdLock(args []string) int {
 	flags := flag.NewFlagSet("lock", flag.ContinueOnError)
 	agent := flags.String("agent", "", "requesting agent ID")
-	ttlSec := flags.Int("ttl", 3600, "lock TTL in seconds")
+	ttlSec := flags.Int("ttl", a.lockTTLSeconds(), "lock TTL in seconds (default: lock.ttl in config.toml)")
 	epoch := flags.Int64("epoch", -1, "epoch context (-1 = keep current)")
+	renew := flags.Bool("renew", false, "extend a lock you already hold by --ttl")
+	dryRun := flags.Bool("dry-run", false, "report whether the lock would be granted, changing nothing")
+	atomic := flags.Bool("atomic", false, "lock every path given, or none of them")
+	queue := flags.Bool("queue", false, "if denied, join the queue of agents waiting for the lock (shown in cm status)")
 	jsonOut := flags.Bool("json", false, "JSON output")
-	if err := flags.Parse(args); err != nil {
+	// Parse flags between paths too: cm lock --atomic a.go b.go --ttl 60.
+	var paths []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return 1
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		paths = append(paths, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(paths) < 1 || (len(paths) > 1 && !*atomic) {
+		fmt.Fprintln(os.Stderr, "usage: cm lock <path> [--agent ID] [--ttl N] [--renew] [--dry-run] [--queue] [--json]")
+		fmt.Fprintln(os.Stderr, "       cm lock --atomic <path>... [--agent ID] [--ttl N] [--json]")
 		return 1
 	}
-	if flags.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "usage: cm lock <path> [--agent ID] [--ttl N] [--json]")
+	if *atomic && (*renew || *dryRun) {
+		fmt.Fprintln(os.Stderr, "cm: lock: --atomic cannot be combined with --renew or --dry-run")
+		return 1
+	}
+	if *queue && (*atomic || *renew || *dryRun) {
+		fmt.Fprintln(os.Stderr, "cm: lock: --queue cannot be combined with --atomic, --renew or --dry-run")
 		return 1
 	}
 
 	agentID, err := a.resolveAgent(*agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
-		return 1
+		return failNoAgent(err, *jsonOut)
+	}
+	for i, p := range paths {
+		paths[i] = a.lockPath(p)
 	}
 
-	path := flags.Arg(0)
+	if *atomic {
+		return a.lockAtomic(paths, agentID, *epoch, time.Duration(*ttlSec)*time.Second, *jsonOut)
+	}
+	path := paths[0]
+	if *dryRun {
+		return a.lockDryRun(path, agentID, *jsonOut)
+	}
+	if *renew {
+		return a.lockRenew(path, agentID, time.Duration(*ttlSec)*time.Second, *jsonOut)
+	}
 	ep, rn := a.resolveEpochRound(agentID, *epoch, -1)
 
 	c := a.getClock(agentID)
 
 	// Auto-recv: show pending messages (lock holders may have sent releases).
-	inbox := a.drainInbox(agentID, c)
+	receipt := a.readInbox(agentID, c)
+	inbox := receipt.msgs
 	if !*jsonOut {
 		printInbox(inbox)
 	}
 
-	ts := c.Tick()
-	_ = a.store.UpdateAgentClock(agentID, ts, ep, rn)
-
 	ttl := time.Duration(*ttlSec) * time.Second
-	lock, conflict, err := a.store.AcquireLock(path, agentID, ts, ep, true, ttl)
+
+	// Receipt, clock, decision and the lock_req event that records it
+	// commit together. The event is logged after the decision (avoiding
+	// phantom requests); a denied request says so, for cm metrics.
+	var lock, conflict *model.Lock
+	var ts int64
+	err = a.store.WithTx(func(tx store.TxStore) error {
+		if err := receipt.write(tx); err != nil {
+			return err
+		}
+		var err error
+		if ts, err = tickIn(tx, agentID, c, ep, rn); err != nil {
+			return err
+		}
+		if lock, conflict, err = tx.AcquireLock(path, agentID, ts, ep, true, ttl); err != nil {
+			return err
+		}
+		body := ""
+		if conflict != nil {
+			body = fmt.Sprintf("%s: held by %s", store.LockDeniedPrefix, conflict.AgentID)
+		}
+		_, err = tx.InsertEvent(&model.Event{
+			AgentID:    agentID,
+			LamportTS:  ts,
+			Epoch:      ep,
+			Kind:       model.EventLockReq,
+			Target:     path,
+			Body:       body,
+			CreatedAt:  time.Now().UTC(),
+			Provenance: a.prov,
+		})
+		return err
+	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: lock: %v\n", err)
 		return 1
 	}
 
-	// Log the lock request event after the decision (avoids logging phantom requests).
-	if _, err := a.store.InsertEvent(&model.Event{
-		AgentID:   agentID,
-		LamportTS: ts,
-		Epoch:     ep,
-		Kind:      model.EventLockReq,
-		Target:    path,
-		CreatedAt: time.Now().UTC(),
-	}); err != nil {
-		fmt.Fprintf(os.Stderr, "cm: lock: event: %v\n", err)
-	}
-
+	a.span.Set(trace.String("clockmail.agent", agentID), trace.String("clockmail.lock.path", path))
 	if conflict != nil {
+		a.span.Set(trace.String("clockmail.lock.outcome", "denied"), trace.String("clockmail.lock.holder", conflict.AgentID))
+		// With --queue the wait is recorded for everyone to see. It lasts
+		// as long as a lock would; lock --queue again to stay in line.
+		var waiting []model.LockIntent
+		position := 0
+		if *queue {
+			if _, err := a.store.QueueLockIntent(path, agentID, ts, ttl); err != nil {
+				fmt.Fprintf(os.Stderr, "cm: lock: queue: %v\n", err)
+				return 1
+			}
+			intents, _ := a.store.ListLockIntents()
+			for _, in := range intents {
+				if in.Path != path {
+					continue
+				}
+				waiting = append(waiting, in)
+				if in.AgentID == agentID {
+					position = len(waiting)
+				}
+			}
+		}
 		if *jsonOut {
-			printJSON(map[string]interface{}{
+			res := map[string]interface{}{
 				"granted":  false,
 				"conflict": conflict,
 				"resolution": fmt.Sprintf("%s holds lock with lower total order (%d,%q) vs (%d,%q)",
 					conflict.AgentID, conflict.LamportTS, conflict.AgentID, ts, agentID),
-				"inbox": inbox, "inbox_count": len(inbox),
-			})
+				"expires_in_seconds": int(time.Until(conflict.ExpiresAt).Seconds()),
+				"inbox":              inbox, "inbox_count": len(inbox),
+				"next_actions": lockDeniedActions(path, conflict),
+			}
+			if *queue {
+				res["queue"], res["queue_position"] = waiting, position
+			}
+			printJSON(res)
 		} else {
 			fmt.Printf("DENIED: %s holds %s (ts=%d < %d)\n",
 				conflict.AgentID, path, conflict.LamportTS, ts)
+			if conflict.AbsPath != "" {
+				fmt.Printf("  %s's copy: %s\n", conflict.AgentID, conflict.AbsPath)
+			}
+			if *queue {
+				fmt.Printf("queued for %s: position %d of %d; %s's lock expires in %s\n",
+					path, position, len(waiting), conflict.AgentID, untilString(conflict.ExpiresAt))
+			}
+			printHints(lockDeniedActions(path, conflict))
 		}
 		return 2
 	}
 
+	a.span.Set(trace.String("clockmail.lock.outcome", "granted"))
+	// Ownership is advisory: the lock stands, but the owner should know.
+	claims, _ := a.store.ListOwnership()
+	owner := ownerOf(claims, path, agentID)
 	if *jsonOut {
 		printJSON(map[string]interface{}{"granted": true, "lock": lock, "lamport_ts": ts,
-			"inbox": inbox, "inbox_count": len(inbox)})
+			"owned_by": owner, "inbox": inbox, "inbox_count": len(inbox)})
 	} else {
 		fmt.Printf("locked %s (ts=%d, ttl=%ds)\n", path, ts, *ttlSec)
+		if owner != nil {
+			fmt.Fprintf(os.Stderr, "cm: lock: %s is in %s, owned by %s; consider telling them (cm send %s ...)\n",
+				path, owner.Path, owner.AgentID, owner.AgentID)
+		}
+	}
+	return 0
+}
+
+// untilString renders the time left until t, to the second.
+func untilString(t time.Time) string {
+	d := time.Until(t).Round(time.Second)
+	if d < 0 {
+		d = 0
+	}
+	return d.String()
+}
+
+// printLockQueue lists, for each path with agents waiting, who is waiting
+// in the order they would get the lock and how long the holder's lock
+// has left, as cm status and prime show it.
+func printLockQueue(locks []model.Lock, intents []model.LockIntent) {
+	holders := make(map[string]model.Lock, len(locks))
+	for _, l := range locks {
+		holders[l.Path] = l
+	}
+	for i := 0; i < len(intents); {
+		path := intents[i].Path
+		var names []string
+		for ; i < len(intents) && intents[i].Path == path; i++ {
+			names = append(names, intents[i].AgentID)
+		}
+		waiting := fmt.Sprintf("%d agents waiting", len(names))
+		if len(names) == 1 {
+			waiting = "1 agent waiting"
+		}
+		held := "free now"
+		if l, ok := holders[path]; ok {
+			held = fmt.Sprintf("held by %s, %s left", l.AgentID, untilString(l.ExpiresAt))
+		}
+		fmt.Printf("  %s for %s (%s); %s\n", waiting, path, strings.Join(names, ", "), held)
+	}
+}
+
+// lockAtomic implements cm lock --atomic: every path is locked in one
+// transaction at one timestamp, or, if any is held by an agent with
+// priority, none is. Exits 2 naming the first conflict in sorted order.
+func (a *app) lockAtomic(paths []string, agentID string, epoch int64, ttl time.Duration, jsonOut bool) int {
+	ep, rn := a.resolveEpochRound(agentID, epoch, -1)
+	c := a.getClock(agentID)
+	receipt := a.readInbox(agentID, c)
+	inbox := receipt.msgs
+	if !jsonOut {
+		printInbox(inbox)
+	}
+
+	// One lock_req per lock granted, or one for the path that was denied,
+	// in the same transaction as the locks.
+	var locks []model.Lock
+	var conflict *model.Lock
+	var ts int64
+	err := a.store.WithTx(func(tx store.TxStore) error {
+		if err := receipt.write(tx); err != nil {
+			return err
+		}
+		var err error
+		if ts, err = tickIn(tx, agentID, c, ep, rn); err != nil {
+			return err
+		}
+		if locks, conflict, err = tx.AcquireLocks(paths, agentID, ts, ep, true, ttl); err != nil {
+			return err
+		}
+		record := func(path, body string) error {
+			_, err := tx.InsertEvent(&model.Event{AgentID: agentID, LamportTS: ts, Epoch: ep, Kind: model.EventLockReq,
+				Target: path, Body: body, CreatedAt: time.Now().UTC(), Provenance: a.prov})
+			return err
+		}
+		if conflict != nil {
+			return record(conflict.Path, fmt.Sprintf("%s: held by %s", store.LockDeniedPrefix, conflict.AgentID))
+		}
+		for _, l := range locks {
+			if err := record(l.Path, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: lock: %v\n", err)
+		return 1
+	}
+
+	a.span.Set(trace.String("clockmail.agent", agentID), trace.Int("clockmail.lock.paths", int64(len(paths))))
+	if conflict != nil {
+		a.span.Set(trace.String("clockmail.lock.outcome", "denied"), trace.String("clockmail.lock.holder", conflict.AgentID))
+		actions := lockDeniedActions(conflict.Path, conflict)
+		if jsonOut {
+			printJSON(map[string]interface{}{"granted": false, "conflict": conflict, "lamport_ts": ts,
+				"inbox": inbox, "inbox_count": len(inbox), "next_actions": actions})
+		} else {
+			fmt.Printf("DENIED: %s holds %s (ts=%d < %d); none of %s locked\n",
+				conflict.AgentID, conflict.Path, conflict.LamportTS, ts, strings.Join(paths, ", "))
+			printHints(actions)
+		}
+		return 2
+	}
+
+	a.span.Set(trace.String("clockmail.lock.outcome", "granted"))
+	claims, _ := a.store.ListOwnership()
+	owned := map[string]*model.Ownership{}
+	locked := make([]string, len(locks))
+	for i, l := range locks {
+		locked[i] = l.Path
+		if o := ownerOf(claims, l.Path, agentID); o != nil {
+			owned[l.Path] = o
+		}
+	}
+	if jsonOut {
+		printJSON(map[string]interface{}{"granted": true, "locks": locks, "lamport_ts": ts,
+			"owned_by": owned, "inbox": inbox, "inbox_count": len(inbox)})
+		return 0
+	}
+	fmt.Printf("locked %s (ts=%d, ttl=%ds)\n", strings.Join(locked, ", "), ts, int(ttl.Seconds()))
+	for _, p := range locked {
+		if o := owned[p]; o != nil {
+			fmt.Fprintf(os.Stderr, "cm: lock: %s is in %s, owned by %s; consider telling them (cm send %s ...)\n",
+				p, o.Path, o.AgentID, o.AgentID)
+		}
+	}
+	return 0
+}
+
+// lockDryRun implements cm lock --dry-run: it works out what cm lock
+// would do now, without draining the inbox, ticking the clock or writing
+// an event. The timestamp it would request at is the agent's clock after
+// receiving its pending messages, plus one. Exits 2 if it would be denied.
+func (a *app) lockDryRun(path, agentID string, jsonOut bool) int {
+	c := a.getClock(agentID)
+	pending, _ := a.store.ListUnread(agentID, "", 100)
+	for _, e := range pending {
+		c.Receive(e.LamportTS)
+	}
+	ts := c.Value() + 1
+
+	locks, err := a.store.LocksOnPath(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: lock: %v\n", err)
+		return 1
+	}
+	var holder, mine *model.Lock
+	for i, l := range locks {
+		switch {
+		case l.AgentID == agentID:
+			mine = &locks[i]
+		case l.Exclusive && holder == nil:
+			holder = &locks[i]
+		}
+	}
+	granted := holder == nil || clock.TotalOrderLess(ts, agentID, holder.LamportTS, holder.AgentID)
+	// The highest timestamp that still beats the holder: ties go to the
+	// lower agent ID.
+	var neededTS int64
+	if holder != nil {
+		neededTS = holder.LamportTS - 1
+		if agentID < holder.AgentID {
+			neededTS = holder.LamportTS
+		}
+	}
+	claims, _ := a.store.ListOwnership()
+	owner := ownerOf(claims, path, agentID)
+
+	if jsonOut {
+		result := map[string]interface{}{"dry_run": true, "granted": granted, "path": path,
+			"lamport_ts": ts, "holder": holder, "held_by_you": mine != nil, "owned_by": owner}
+		if holder != nil {
+			result["needed_ts"] = neededTS
+		}
+		printJSON(result)
+	} else {
+		switch {
+		case holder == nil && mine != nil:
+			fmt.Printf("would be granted: you already hold %s (expires %s); it would be re-acquired at ts=%d\n",
+				path, mine.ExpiresAt.Format("15:04:05"), ts)
+		case holder == nil:
+			fmt.Printf("would be granted: nobody holds %s (you would request at ts=%d)\n", path, ts)
+		case granted:
+			fmt.Printf("would be granted: %s holds %s at ts=%d, which your ts=%d beats; it would be evicted\n",
+				holder.AgentID, path, holder.LamportTS, ts)
+		default:
+			fmt.Printf("would be DENIED: %s holds %s (ts=%d, expires %s)\n",
+				holder.AgentID, path, holder.LamportTS, holder.ExpiresAt.Format("15:04:05"))
+			fmt.Printf("  you would request at ts=%d; winning needs ts<=%d, which your clock has passed:\n", ts, neededTS)
+			fmt.Printf("  wait for %s to unlock, or for the lock to expire\n", holder.AgentID)
+		}
+		if owner != nil {
+			fmt.Printf("  note: %s is in %s, owned by %s\n", path, owner.Path, owner.AgentID)
+		}
+	}
+	if !granted {
+		return 2
 	}
 	return 0
 }
+
+// lockRenew implements cm lock --renew.
+func (a *app) lockRenew(path, agentID string, ttl time.Duration, jsonOut bool) int {
+	lock, ts, err := a.renewLock(agentID, path, ttl)
+	if errors.Is(err, store.ErrLockNotHeld) {
+		return fail(fmt.Sprintf("lock: %s is not held by %s (expired or never acquired)", path, agentID),
+			jsonOut, 1, []nextAction{{Command: "cm lock " + path, Reason: "re-acquire it; another agent may hold it now"}})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: lock: renew: %v\n", err)
+		return 1
+	}
+	if jsonOut {
+		printJSON(map[string]interface{}{"renewed": true, "lock": lock, "lamport_ts": ts})
+	} else {
+		fmt.Printf("renewed %s (ts=%d, expires %s)\n", path, ts, lock.ExpiresAt.Format(time.RFC3339))
+	}
+	return 0
+}
+
+// renewLock extends a lock held by agentID and records the renewal in the
+// event log. Nothing is recorded if the lock was not held.
+func (a *app) renewLock(agentID, path string, ttl time.Duration) (*model.Lock, int64, error) {
+	lock, err := a.store.RenewLock(path, agentID, ttl)
+	if err != nil {
+		return nil, 0, err
+	}
+	ts, err := a.recordEvent(agentID, model.EventLockRenew, path,
+		"expires "+lock.ExpiresAt.Format(time.RFC3339))
+	if err != nil {
+		a.logger().Warn("record lock renewal event", "path", path, "err", err)
+	}
+	return lock, ts, nil
+}
+
+// renewLocks extends every lock agentID holds, for heartbeat and sync
+// --renew-locks. Locks that expire before they can be renewed are
+// logged and left out of the result.
+func (a *app) renewLocks(agentID string, ttl time.Duration) []model.Lock {
+	held, err := a.store.ListLocksForAgent(agentID)
+	if err != nil {
+		a.logger().Warn("renew locks", "agent", agentID, "err", err)
+		return nil
+	}
+	renewed := []model.Lock{}
+	for _, l := range held {
+		lock, _, err := a.renewLock(agentID, l.Path, ttl)
+		if err != nil {
+			a.logger().Warn("renew lock", "agent", agentID, "path", l.Path, "err", err)
+			continue
+		}
+		renewed = append(renewed, *lock)
+	}
+	return renewed
+}
+
+// lockTTLSeconds is the default lock TTL: lock.ttl from the config file,
+// an hour unless set.
+func (a *app) lockTTLSeconds() int {
+	return int(a.cfg.Duration("lock.ttl").Seconds())
+}
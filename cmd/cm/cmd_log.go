@@ -1,62 +1,435 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+	"github.com/daviddao/clockmail/pkg/sign"
+	"github.com/daviddao/clockmail/pkg/store"
 )
 
+// cmdLog prints the event log in Lamport order.
+//
+// -q filters events with a query expression (see package query), e.g.
+// 'kind=msg and agent=alice and body~"refactor" and epoch>=3'. The
+// shorthand flags are folded into it and run as SQL with it: --agent,
+// --target and --kind may be repeated (or comma-separated) and match any
+// of their values, and --epoch takes N, N..M, N.. or ..M. --grep is a
+// regular expression over the body; the database has no portable regex
+// operator, so it is applied as rows are read, paging until --limit
+// events match.
+//
+// --follow keeps printing matching events as they are written, like
+// tail -f, tracking the log by row ID so events that share a Lamport
+// timestamp are not skipped.
+//
+// --template formats each event with a Go text/template over model.Event,
+// e.g. '{{.LamportTS}} {{.AgentID}} {{.Kind}}'; a newline is appended
+// unless the template ends with one.
+//
+// --verify checks each event's signature against its agent's registered
+// signing key and marks the ones that are unsigned, by an agent with no
+// key, or forged or altered since they were written; it exits 2 if any
+// is forged.
+//
+// Usage: cm log [-q QUERY] [--agent A] [--target T] [--kind K] [--epoch N..M] [--grep RE]
+//
+//	[--since N] [--limit N] [--follow] [--template T] [--verify] [--json]
 func (a *app) cmdLog(args []string) int {
 	flags := flag.NewFlagSet("log", flag.ContinueOnError)
 	sinceTS := flags.Int64("since", 0, "fetch events with lamport_ts >= this")
 	limit := flags.Int("limit", 50, "max events to return")
-	kind := flags.String("kind", "", "filter by event kind")
+	var kinds, agents, targets stringList
+	flags.Var(&kinds, "kind", "filter by event kind (repeatable)")
+	flags.Var(&agents, "agent", "filter by sending agent (repeatable)")
+	flags.Var(&targets, "target", "filter by target (repeatable)")
+	epoch := flags.String("epoch", "", "filter by epoch: N, N..M, N.. or ..M")
+	grep := flags.String("grep", "", "filter by a regular expression over the body")
+	follow := flags.Bool("follow", false, "keep printing new matching events (ctrl-c to stop)")
+	var q string
+	flags.StringVar(&q, "q", "", "filter expression, e.g. 'kind=msg and agent=alice'")
+	flags.StringVar(&q, "query", "", "same as -q")
+	tmplText := flags.String("template", "", "format each event with a Go text/template over model.Event")
+	verify := flags.Bool("verify", false, "check event signatures and flag forged or altered events")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
 
-	events, err := a.store.ListEvents(*sinceTS, *limit)
+	var tmpl *template.Template
+	if *tmplText != "" {
+		if *jsonOut {
+			fmt.Fprintln(os.Stderr, "cm: log: --template and --json are mutually exclusive")
+			return 1
+		}
+		var err error
+		if tmpl, err = parseEventTemplate(*tmplText); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: log: template: %v\n", err)
+			return 1
+		}
+	}
+
+	src, err := logFilterSource(q, kinds, agents, targets, *epoch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: log: %v\n", err)
+		return 1
+	}
+	lf := logFilter{src: src}
+	if lf.query, err = query.Parse(src); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: log: %v\n", err)
+		return 1
+	}
+	if *grep != "" {
+		if lf.grep, err = regexp.Compile(*grep); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: log: grep: %v\n", err)
+			return 1
+		}
+	}
+
+	// Seed the follow cursor before the first read, so nothing written
+	// in between is missed.
+	followFrom := a.store.MaxEventID()
+	events, err := a.queryLog(lf, *sinceTS, *limit)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: log: %v\n", err)
 		return 1
 	}
 
-	if *kind != "" {
-		filtered := events[:0]
+	var checks map[int64]string
+	if *verify {
+		checks = make(map[int64]string, len(events))
+	}
+	forged := 0
+	check := func(events []model.Event) error {
+		if !*verify {
+			return nil
+		}
 		for _, e := range events {
-			if string(e.Kind) == *kind {
-				filtered = append(filtered, e)
+			status, err := a.verifyStatus(e)
+			if err != nil {
+				return err
+			}
+			checks[e.ID] = status
+			if status == sigForged {
+				forged++
 			}
 		}
-		events = filtered
+		return nil
+	}
+	if err := check(events); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: log: verify: %v\n", err)
+		return 1
 	}
 
-	if *jsonOut {
-		printJSON(map[string]interface{}{"events": events, "count": len(events)})
+	if *follow {
+		return a.followLog(lf, events, followFrom, check, func(e model.Event) error {
+			switch {
+			case tmpl != nil:
+				return tmpl.Execute(os.Stdout, &e)
+			case *jsonOut:
+				b, _ := json.Marshal(e)
+				fmt.Println(string(b))
+			default:
+				if *verify {
+					printVerifyMarker(checks[e.ID])
+				}
+				printEvent(e)
+			}
+			return nil
+		}, func() int { return forged })
+	}
+
+	exit := 0
+	if forged > 0 {
+		exit = 2
+	}
+
+	if tmpl != nil {
+		for i := range events {
+			if err := tmpl.Execute(os.Stdout, &events[i]); err != nil {
+				fmt.Fprintf(os.Stderr, "cm: log: template: %v\n", err)
+				return 1
+			}
+		}
+	} else if *jsonOut {
+		out := map[string]interface{}{"events": events, "count": len(events)}
+		if *verify {
+			out["verify"] = checks
+			out["forged"] = forged
+		}
+		printJSON(out)
+		return exit
 	} else {
 		if len(events) == 0 {
 			fmt.Println("no events")
 		} else {
 			for _, e := range events {
-				switch e.Kind {
-				case model.EventMsg:
-					fmt.Printf("[ts=%d] %s -> %s: %s\n", e.LamportTS, e.AgentID, e.Target, e.Body)
-				case model.EventLockReq:
-					fmt.Printf("[ts=%d] %s lock-req %s\n", e.LamportTS, e.AgentID, e.Target)
-				case model.EventLockRel:
-					fmt.Printf("[ts=%d] %s unlock %s\n", e.LamportTS, e.AgentID, e.Target)
-				case model.EventProgress:
-					fmt.Printf("[ts=%d] %s heartbeat epoch=%d round=%d\n",
-						e.LamportTS, e.AgentID, e.Epoch, e.Round)
-				default:
-					fmt.Printf("[ts=%d] %s %s %s %s\n",
-						e.LamportTS, e.AgentID, e.Kind, e.Target, e.Body)
+				if *verify {
+					printVerifyMarker(checks[e.ID])
+				}
+				printEvent(e)
+			}
+		}
+	}
+	if forged > 0 {
+		fmt.Fprintf(os.Stderr, "cm: log: %d event(s) do not match their agent's signing key\n", forged)
+	}
+	return exit
+}
+
+// printVerifyMarker writes the cm log --verify column for an event.
+func printVerifyMarker(status string) {
+	if status != sigOK {
+		fmt.Printf("%-10s ", "["+status+"]")
+	} else {
+		fmt.Printf("%-10s ", "")
+	}
+}
+
+// Signature check results reported by cm log --verify.
+const (
+	sigOK       = "ok"
+	sigUnsigned = "unsigned"
+	sigNoKey    = "no key"
+	sigForged   = "FORGED"
+)
+
+// verifyStatus checks e's signature, returning an error only when the
+// check itself could not be made.
+func (a *app) verifyStatus(e model.Event) (string, error) {
+	err := a.store.VerifyEvent(e)
+	switch {
+	case err == nil:
+		return sigOK, nil
+	case errors.Is(err, store.ErrUnsigned):
+		return sigUnsigned, nil
+	case errors.Is(err, store.ErrNoSigningKey):
+		return sigNoKey, nil
+	case errors.Is(err, sign.ErrBadSignature):
+		return sigForged, nil
+	}
+	return "", err
+}
+
+// parseEventTemplate compiles a --template (or watch --format) over
+// model.Event. A newline is appended unless text ends with one.
+func parseEventTemplate(text string) (*template.Template, error) {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return template.New("event").Option("missingkey=error").Parse(text)
+}
+
+// logFilter is what cm log selects events by: a query the store runs as
+// SQL, and an optional body regex checked as rows are read.
+type logFilter struct {
+	src   string // source of query, for paging
+	query *query.Query
+	grep  *regexp.Regexp
+}
+
+// logFilterSource folds the cm log shorthand flags into the -q
+// expression. Values within a flag are alternatives; flags are combined
+// with each other and with -q by "and".
+func logFilterSource(src string, kinds, agents, targets []string, epoch string) (string, error) {
+	var terms []string
+	for _, f := range []struct {
+		field  string
+		values []string
+	}{{"kind", kinds}, {"agent", agents}, {"target", targets}} {
+		var alts []string
+		for _, v := range f.values {
+			for _, v := range strings.Split(v, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					alts = append(alts, f.field+"="+strconv.Quote(v))
+				}
+			}
+		}
+		if len(alts) > 0 {
+			terms = append(terms, "("+strings.Join(alts, " or ")+")")
+		}
+	}
+	if epoch != "" {
+		lo, hi, err := parseEpochRange(epoch)
+		if err != nil {
+			return "", err
+		}
+		if lo >= 0 {
+			terms = append(terms, fmt.Sprintf("epoch>=%d", lo))
+		}
+		if hi >= 0 {
+			terms = append(terms, fmt.Sprintf("epoch<=%d", hi))
+		}
+	}
+	switch {
+	case strings.TrimSpace(src) == "":
+	case len(terms) == 0:
+		// Alone, -q is kept as written so parse errors point into it.
+		return src, nil
+	default:
+		terms = append(terms, "("+src+")")
+	}
+	return strings.Join(terms, " and "), nil
+}
+
+// parseEpochRange parses N, N..M, N.. or ..M. An open end is -1.
+func parseEpochRange(s string) (lo, hi int64, err error) {
+	bound := func(v string) (int64, error) {
+		if v == "" {
+			return -1, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("--epoch: want N, N..M, N.. or ..M, got %q", s)
+		}
+		return n, nil
+	}
+	from, to, isRange := strings.Cut(s, "..")
+	if !isRange {
+		to = from
+	}
+	if from == "" && to == "" {
+		return 0, 0, fmt.Errorf("--epoch: want N, N..M, N.. or ..M, got %q", s)
+	}
+	if lo, err = bound(from); err != nil {
+		return 0, 0, err
+	}
+	if hi, err = bound(to); err != nil {
+		return 0, 0, err
+	}
+	if lo >= 0 && hi >= 0 && lo > hi {
+		return 0, 0, fmt.Errorf("--epoch: range %q is empty", s)
+	}
+	return lo, hi, nil
+}
+
+// after narrows lf to events past cond, a query over ts and id.
+func (lf logFilter) after(cond string) (*query.Query, error) {
+	if strings.TrimSpace(lf.src) == "" {
+		return query.Parse(cond)
+	}
+	return query.Parse("(" + lf.src + ") and (" + cond + ")")
+}
+
+// queryLog returns up to limit events matching lf with lamport_ts >=
+// sinceTS, in total order. Without --grep this is a single query; with
+// it, pages are read past the last row seen until limit events match.
+func (a *app) queryLog(lf logFilter, sinceTS int64, limit int) ([]model.Event, error) {
+	if lf.grep == nil {
+		return a.store.QueryEvents(lf.query, sinceTS, limit)
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	page := max(limit, 200)
+	q := lf.query
+	var out []model.Event
+	for {
+		events, err := a.store.QueryEvents(q, sinceTS, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			if lf.grep.MatchString(e.Body) {
+				out = append(out, e)
+				if len(out) == limit {
+					return out, nil
 				}
 			}
 		}
+		if len(events) < page {
+			return out, nil
+		}
+		last := events[len(events)-1]
+		if q, err = lf.after(fmt.Sprintf("ts>%d or (ts=%d and id>%d)", last.LamportTS, last.LamportTS, last.ID)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// followLog prints the events cm log already read, then each matching
+// event written after row ID from, until interrupted. It returns 2 if
+// any event shown failed --verify.
+func (a *app) followLog(lf logFilter, events []model.Event, from int64,
+	check func([]model.Event) error, show func(model.Event) error, forged func() int) int {
+	seen := make(map[int64]bool)
+	for _, e := range events {
+		if err := show(e); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: log: %v\n", err)
+			return 1
+		}
+		if e.ID > from {
+			seen[e.ID] = true
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	wake, mode, stop := a.wakeups(max(a.cfg.Duration("poll.watch_interval"), time.Second))
+	defer stop()
+	fmt.Fprintf(os.Stderr, "following the log (%s, ctrl-c to stop)\n", mode)
+
+	for {
+		select {
+		case <-sig:
+			fmt.Fprintln(os.Stderr, "\nstopped")
+			if n := forged(); n > 0 {
+				fmt.Fprintf(os.Stderr, "cm: log: %d event(s) do not match their agent's signing key\n", n)
+				return 2
+			}
+			return 0
+		case <-wake:
+			next, last, err := a.tailLog(lf, from, seen)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cm: log: %v\n", err)
+				continue
+			}
+			from = last
+			if err := check(next); err != nil {
+				fmt.Fprintf(os.Stderr, "cm: log: verify: %v\n", err)
+				continue
+			}
+			for _, e := range next {
+				if err := show(e); err != nil {
+					fmt.Fprintf(os.Stderr, "cm: log: %v\n", err)
+					return 1
+				}
+			}
+		}
+	}
+}
+
+// tailLog returns the events matching lf with row ID > from, skipping
+// those in seen (already shown from the first read), and the last row
+// ID it read.
+func (a *app) tailLog(lf logFilter, from int64, seen map[int64]bool) ([]model.Event, int64, error) {
+	var out []model.Event
+	for {
+		events, err := a.store.QueryEventsSinceID(lf.query, from, 500)
+		if err != nil {
+			return nil, from, err
+		}
+		for _, e := range events {
+			from = e.ID
+			if !seen[e.ID] && (lf.grep == nil || lf.grep.MatchString(e.Body)) {
+				out = append(out, e)
+			}
+		}
+		if len(events) < 500 {
+			return out, from, nil
+		}
 	}
-	return 0
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/metrics"
+)
+
+// cmdMetrics exports Prometheus metrics: events by kind, pending messages
+// per agent, active locks and lock conflicts, gate waits and outcomes,
+// and each agent's position and lag behind the most advanced agent. With
+// --listen it serves them at /metrics for scraping; without, it prints
+// them once, e.g. for the node exporter's textfile collector. cm web
+// serves the same metrics at /metrics.
+//
+// Usage:
+//
+//	cm metrics                   # print once
+//	cm metrics --listen :9090    # serve http://host:9090/metrics
+func (a *app) cmdMetrics(args []string) int {
+	flags := flag.NewFlagSet("metrics", flag.ContinueOnError)
+	listen := flags.String("listen", "", "serve /metrics on this address instead of printing once")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	if *listen == "" {
+		fams, err := metrics.Collect(a.store, a.agentPresence, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: metrics: %v\n", err)
+			return 1
+		}
+		if err := metrics.Write(os.Stdout, fams); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: metrics: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: metrics: %v\n", err)
+		return 1
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler(a.store, a.agentPresence))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "metrics for %s on http://%s/metrics (ctrl-c to stop)\n", dbLocation(), ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "cm: metrics: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "\nstopped")
+	return 0
+}
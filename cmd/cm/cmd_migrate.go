@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// cmdMigrate shows and applies schema migrations. Every other command
+// opens the database fully migrated; cm migrate opens it as it is, so an
+// upgrade can be inspected first or applied a step at a time.
+//
+// Usage:
+//
+//	cm migrate --status
+//	cm migrate --to 3
+//	cm migrate
+func (a *app) cmdMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	status := flags.Bool("status", false, "list migrations and whether each is applied")
+	to := flags.Int("to", store.LatestSchemaVersion(), "migrate up to this schema version")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	from, err := a.store.SchemaVersion()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: migrate: %v\n", err)
+		return 1
+	}
+	if *status {
+		ms, err := a.store.Migrations()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: migrate: %v\n", err)
+			return 1
+		}
+		if *jsonOut {
+			printJSON(map[string]interface{}{
+				"version": from, "latest": store.LatestSchemaVersion(), "migrations": ms,
+			})
+			return 0
+		}
+		fmt.Printf("schema version %d (latest %d)\n", from, store.LatestSchemaVersion())
+		for _, m := range ms {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied " + m.AppliedAt.Local().Format("2006-01-02 15:04")
+			}
+			fmt.Printf("  %3d  %-58s  %s\n", m.Version, m.Description, state)
+		}
+		return 0
+	}
+
+	applied, err := a.store.MigrateTo(*to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: migrate: %v\n", err)
+		return 1
+	}
+	version, err := a.store.SchemaVersion()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: migrate: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		if applied == nil {
+			applied = []store.MigrationStatus{}
+		}
+		printJSON(map[string]interface{}{"from": from, "version": version, "applied": applied})
+		return 0
+	}
+	if len(applied) == 0 {
+		fmt.Printf("schema is at version %d; nothing to apply\n", version)
+		return 0
+	}
+	for _, m := range applied {
+		fmt.Printf("applied %d: %s\n", m.Version, m.Description)
+	}
+	fmt.Printf("schema version %d -> %d\n", from, version)
+	return 0
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/notify"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// defaultNotifyFile is the notify file in the workspace.
+func defaultNotifyFile() string { return workspacePath("notify.yaml") }
+
+// cmdNotify manages the notify file, which routes events to notification
+// transports (desktop, webhook, slack, email, exec). Routes are acted on by
+// cm watch --notify and cm notify daemon; the daemon also POSTs to the
+// [webhooks] URLs in config.toml.
+//
+// Usage:
+//
+//	cm notify validate [--file PATH]                 # parse and check the file
+//	cm notify test [--file PATH] <transport> [text]  # send a test notification
+//	cm notify daemon [--file PATH] [--since ID]      # deliver events as they happen
+func (a *app) cmdNotify(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm notify <validate|test|daemon> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "validate":
+		return a.notifyValidate(args[1:])
+	case "test":
+		return a.notifyTest(args[1:])
+	case "daemon":
+		return a.notifyDaemon(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: notify: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) notifyValidate(args []string) int {
+	flags := flag.NewFlagSet("notify validate", flag.ContinueOnError)
+	file := flags.String("file", defaultNotifyFile(), "notify config file")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	cfg, err := notify.Load(*file)
+	if err == nil {
+		_, err = cfg.Build()
+	}
+	if err != nil {
+		if *jsonOut {
+			printJSON(map[string]interface{}{"valid": false, "file": *file, "errors": strings.Split(err.Error(), "\n")})
+		} else {
+			fmt.Fprintf(os.Stderr, "cm: notify: %s: %v\n", *file, err)
+		}
+		return 1
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"valid": true, "file": *file,
+			"transports": len(cfg.Transports), "routes": len(cfg.Routes)})
+	} else {
+		fmt.Printf("%s: valid (%d transports, %d routes)\n", *file, len(cfg.Transports), len(cfg.Routes))
+	}
+	return 0
+}
+
+func (a *app) notifyTest(args []string) int {
+	flags := flag.NewFlagSet("notify test", flag.ContinueOnError)
+	file := flags.String("file", defaultNotifyFile(), "notify config file")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm notify test [--file PATH] <transport> [text]")
+		return 1
+	}
+	d, err := loadDispatcher(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: notify: %s: %v\n", *file, err)
+		return 1
+	}
+	body := "test notification from cm"
+	if flags.NArg() > 1 {
+		body = strings.Join(flags.Args()[1:], " ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	transport := flags.Arg(0)
+	if err := d.Send(ctx, transport, notify.Notification{Subject: "clockmail", Body: body}); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: notify: %v\n", err)
+		return 1
+	}
+	fmt.Printf("sent test notification via %s\n", transport)
+	return 0
+}
+
+// loadDispatcher loads a notify file and builds its transports.
+func loadDispatcher(path string) (*notify.Dispatcher, error) {
+	cfg, err := notify.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Build()
+}
+
+func (a *app) notifyDaemon(args []string) int {
+	flags := flag.NewFlagSet("notify daemon", flag.ContinueOnError)
+	file := flags.String("file", defaultNotifyFile(), "notify config file (its routes are used if it exists)")
+	since := flags.Int64("since", -1, "deliver events after this event ID (default: only new events)")
+	interval := flags.Duration("interval", a.cfg.Duration("poll.watch_interval"), "poll interval")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	d, err := a.newEventDelivery(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: notify: %v\n", err)
+		return 1
+	}
+	lastID := *since
+	if lastID < 0 {
+		lastID = a.store.MaxEventID()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	wake, mode, stop := a.wakeups(*interval)
+	defer stop()
+	fmt.Fprintf(os.Stderr, "delivering events after #%d to %s (%s, ctrl-c to stop)\n", lastID, d, mode)
+	for {
+		select {
+		case <-sig:
+			fmt.Fprintln(os.Stderr, "\nstopped")
+			return 0
+		case <-wake:
+			lastID = a.deliverSince(d, lastID)
+		}
+	}
+}
+
+// eventDelivery sends events to the [webhooks] URLs of config.toml and
+// through the routes of a notify file.
+type eventDelivery struct {
+	hooks  *notify.Dispatcher // one transport per webhook event, named after it
+	events []string           // webhook events with a URL
+	routes *notify.Dispatcher // nil without a notify file
+}
+
+// newEventDelivery builds the delivery for the current configuration and,
+// if it exists, the notify file at path. Having neither is an error.
+func (a *app) newEventDelivery(path string) (*eventDelivery, error) {
+	d := &eventDelivery{}
+	hooks := &notify.Config{Version: notify.Version, Transports: map[string]notify.Transport{}}
+	for ev, u := range a.cfg.Webhooks() {
+		hooks.Transports[ev] = webhookTransport(u)
+		d.events = append(d.events, ev)
+	}
+	sort.Strings(d.events)
+	var err error
+	if d.hooks, err = hooks.Build(); err != nil {
+		return nil, fmt.Errorf("webhooks: %w", err)
+	}
+	if _, statErr := os.Stat(path); statErr == nil {
+		if d.routes, err = loadDispatcher(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if len(d.events) == 0 && d.routes == nil {
+		return nil, fmt.Errorf("nothing to deliver: set URLs in the [webhooks] table of %s, or write %s", configPath(), path)
+	}
+	return d, nil
+}
+
+// String describes where events go, for the daemon's banner.
+func (d *eventDelivery) String() string {
+	var parts []string
+	if len(d.events) > 0 {
+		parts = append(parts, "webhooks for "+strings.Join(d.events, ", "))
+	}
+	if d.routes != nil {
+		parts = append(parts, "notify routes")
+	}
+	return strings.Join(parts, " and ")
+}
+
+// deliver sends e wherever it is due. Failures are joined; one does not
+// stop the others.
+func (d *eventDelivery) deliver(ctx context.Context, e model.Event) error {
+	var errs []error
+	if ev := webhookEvent(e); ev != "" && slices.Contains(d.events, ev) {
+		if err := d.hooks.Send(ctx, ev, notify.ForEvent(e)); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %w", err))
+		}
+	}
+	if d.routes != nil {
+		if err := d.routes.Dispatch(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliverSince delivers the events after lastID and returns the ID of the
+// last one read. Delivery failures are reported on stderr and not retried,
+// so that one unreachable endpoint cannot hold up the rest.
+func (a *app) deliverSince(d *eventDelivery, lastID int64) int64 {
+	for {
+		events, err := a.store.ListEventsSinceID(lastID, 200)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: notify: %v\n", err)
+			return lastID
+		}
+		for _, e := range events {
+			lastID = e.ID
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := d.deliver(ctx, e); err != nil {
+				fmt.Fprintf(os.Stderr, "cm: notify: event #%d: %v\n", e.ID, err)
+			}
+			cancel()
+		}
+		if len(events) < 200 {
+			return lastID
+		}
+	}
+}
+
+// webhookEvent is the [webhooks] event e counts as: its kind, except that
+// lock requests count only when denied, as lock_conflict.
+func webhookEvent(e model.Event) string {
+	if e.Kind == model.EventLockReq {
+		if strings.HasPrefix(e.Body, store.LockDeniedPrefix) {
+			return "lock_conflict"
+		}
+		return ""
+	}
+	return string(e.Kind)
+}
+
+// discordWebhook matches Discord webhook URLs.
+var discordWebhook = regexp.MustCompile(`^https://(discord|discordapp)\.com/api/webhooks/[^/]+/[^/]+/?$`)
+
+// webhookTransport is the transport for a webhook URL. Slack incoming
+// webhooks, and Discord ones through their Slack-compatible endpoint, get
+// a message they can display; other URLs get the notification as JSON.
+func webhookTransport(u string) notify.Transport {
+	switch {
+	case strings.HasPrefix(u, "https://hooks.slack.com/"):
+		return notify.Transport{Type: "slack", URL: u}
+	case discordWebhook.MatchString(u):
+		return notify.Transport{Type: "slack", URL: strings.TrimSuffix(u, "/") + "/slack"}
+	}
+	return notify.Transport{Type: "webhook", URL: u}
+}
@@ -7,7 +7,7 @@ import (
 
 func (a *app) cmdOnboard(_ []string) int {
 	agentID := a.agentID
-	dbPath := envOr("CLOCKMAIL_DB", defaultDB)
+	dbPath := dbLocation()
 
 	fmt.Println("cm (clockmail) — multi-agent coordination via Lamport clocks + Naiad frontiers")
 	fmt.Println()
@@ -25,7 +25,7 @@ func (a *app) cmdOnboard(_ []string) int {
 		fmt.Printf("  Active agents:  %d\n", len(agents))
 		for _, ag := range agents {
 			stale := ""
-			if time.Since(ag.LastSeen) > 10*time.Minute {
+			if time.Since(ag.LastSeen) > a.presence("idle") {
 				stale = " (stale)"
 			}
 			marker := ""
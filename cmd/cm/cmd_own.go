@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// cmdOwn records long-lived ownership of files and directories. Claims
+// never expire and block nothing: they tell other agents whom to ask
+// before working in an area, and cm lock warns when a lock falls inside
+// someone else's. A directory claim covers everything under it.
+//
+// Usage:
+//
+//	cm own [list] [--json]
+//	cm own <path>... [--note "..."] [--force]
+//	cm own release <path>...
+func (a *app) cmdOwn(args []string) int {
+	if len(args) == 0 || args[0] == "--json" || args[0] == "-json" {
+		return a.ownList(args)
+	}
+	switch args[0] {
+	case "list", "ls":
+		return a.ownList(args[1:])
+	case "release":
+		return a.ownRelease(args[1:])
+	}
+	return a.ownClaim(args)
+}
+
+// ownPath normalizes a claimed or locked path for comparison: slashes,
+// no trailing slash, no "./" or "..". It rejects paths that would cover
+// the whole project.
+func ownPath(p string) (string, error) {
+	p = path.Clean(filepath.ToSlash(p))
+	if p == "." || p == "/" {
+		return "", fmt.Errorf("claim a file or directory, not the whole project")
+	}
+	return p, nil
+}
+
+// ownerOf returns the most specific claim covering p that belongs to
+// an agent other than agentID.
+func ownerOf(claims []model.Ownership, p, agentID string) *model.Ownership {
+	p = path.Clean(filepath.ToSlash(p))
+	var best *model.Ownership
+	for i, o := range claims {
+		if o.AgentID == agentID || !pathWithin(p, o.Path) {
+			continue
+		}
+		if best == nil || len(o.Path) > len(best.Path) {
+			best = &claims[i]
+		}
+	}
+	return best
+}
+
+func (a *app) ownClaim(args []string) int {
+	flags := flag.NewFlagSet("own", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent claiming ownership")
+	note := flags.String("note", "", "what the claim is for, shown to others")
+	force := flags.Bool("force", false, "take over a path another agent owns")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	var paths []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return 1
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		paths = append(paths, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, `usage: cm own <path>... [--note "..."] [--force] [--agent ID] [--json]`)
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	claims, err := a.store.ListOwnership()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: own: %v\n", err)
+		return 1
+	}
+
+	var claimed []model.Ownership
+	var refused []model.Ownership
+	for _, p := range paths {
+		p, err := ownPath(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: own: %v\n", err)
+			return 1
+		}
+		o, held, err := a.store.ClaimOwnership(p, agentID, *note, *force)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: own: %v\n", err)
+			return 1
+		}
+		if held != nil {
+			refused = append(refused, *held)
+			continue
+		}
+		claimed = append(claimed, *o)
+		if !*jsonOut {
+			fmt.Printf("%s owns %s\n", agentID, o.Path)
+		}
+		// Nested claims are allowed, but worth knowing about.
+		if outer := ownerOf(claims, p, agentID); outer != nil && outer.Path != p && !*jsonOut {
+			fmt.Fprintf(os.Stderr, "cm: own: %s is inside %s, owned by %s\n", p, outer.Path, outer.AgentID)
+		}
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"claimed": claimed, "refused": refused})
+	} else {
+		for _, o := range refused {
+			fmt.Fprintf(os.Stderr, "cm: own: %s is owned by %s (--force takes it over)\n", o.Path, o.AgentID)
+		}
+	}
+	if len(refused) > 0 {
+		return 2
+	}
+	return 0
+}
+
+func (a *app) ownRelease(args []string) int {
+	flags := flag.NewFlagSet("own release", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent releasing ownership")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: cm own release <path>... [--agent ID]")
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, false)
+	}
+	for _, p := range flags.Args() {
+		p, err := ownPath(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: own: %v\n", err)
+			return 1
+		}
+		ok, err := a.store.ReleaseOwnership(p, agentID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: own: %v\n", err)
+			return 1
+		}
+		if ok {
+			fmt.Printf("%s no longer owns %s\n", agentID, p)
+		} else {
+			fmt.Printf("%s did not own %s\n", agentID, p)
+		}
+	}
+	return 0
+}
+
+func (a *app) ownList(args []string) int {
+	flags := flag.NewFlagSet("own list", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	claims, err := a.store.ListOwnership()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: own: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		if claims == nil {
+			claims = []model.Ownership{}
+		}
+		printJSON(claims)
+		return 0
+	}
+	if len(claims) == 0 {
+		fmt.Println("(no ownership claims)")
+		return 0
+	}
+	for _, o := range claims {
+		fmt.Println(ownershipLine(o, a.agentID))
+	}
+	return 0
+}
+
+// ownershipLine renders one claim as cm own, status and prime list it.
+func ownershipLine(o model.Ownership, you string) string {
+	line := fmt.Sprintf("  %-30s owned by %s", o.Path, o.AgentID)
+	if o.AgentID == you {
+		line += " (you)"
+	}
+	if o.Note != "" {
+		line += ": " + o.Note
+	}
+	return line + fmt.Sprintf(" (since %s)", o.ClaimedAt.Local().Format(time.DateOnly))
+}
@@ -3,25 +3,52 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/frontier"
 	"github.com/daviddao/clockmail/pkg/model"
 )
 
+// cmdPrime prints the coordination context an agent needs at the start of
+// a session.
+//
+// --budget N caps the text output at roughly N tokens (estimated at four
+// characters each) so it can be embedded in context windows of any size.
+// Sections are then filled in priority order (your pending messages, your
+// locks, the frontier and what blocks it, then work in progress, other
+// agents' locks, the agent list and the reference sections), and a
+// section that does not fit is cut short with a count of what was left
+// out and the command that shows it all.
+//
+// --json --schema-version N emits the versioned model.Prime document
+// instead of the ad hoc --json map, for orchestrators that parse it;
+// cm schema prime prints its JSON Schema.
+//
+// Usage: cm prime [--agent ID] [--budget N] [--json [--schema-version 1]]
 func (a *app) cmdPrime(args []string) int {
 	flags := flag.NewFlagSet("prime", flag.ContinueOnError)
 	agent := flags.String("agent", "", "agent ID")
+	budget := flags.Int("budget", 0, "approximate token budget for the text output (0 = no limit)")
 	jsonOut := flags.Bool("json", false, "JSON output")
+	schemaVersion := flags.Int("schema-version", 0, "emit the versioned JSON document (implies --json; see cm schema prime)")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
+	if *schemaVersion != 0 && *schemaVersion != model.PrimeSchemaVersion {
+		fmt.Fprintf(os.Stderr, "cm: prime: unsupported --schema-version %d (supported: %d)\n", *schemaVersion, model.PrimeSchemaVersion)
+		return 1
+	}
 
 	agentID, _ := a.resolveAgent(*agent)
 
 	agents, _ := a.store.ListAgents()
 	locks, _ := a.store.ListLocks()
-	active, _ := a.store.GetActivePointstamps()
+	wip, _ := a.store.ListWIP()
+	owners, _ := a.store.ListOwnership()
+	active, _ := a.store.GetActivePointstamps(0)
 	f := frontier.ComputeFrontier(active)
 
 	// Find current agent.
@@ -36,8 +63,8 @@ func (a *app) cmdPrime(args []string) int {
 	// Pending messages.
 	var pendingMsgs []model.Event
 	if agentID != "" {
-		cursor := a.store.GetCursor(agentID)
-		pendingMsgs, _ = a.store.ListEventsForAgent(agentID, cursor, 1000)
+		pendingMsgs, _ = a.store.ListUnread(agentID, "", 1000)
+		openSealed(agentID, pendingMsgs)
 	}
 
 	// My locks.
@@ -59,6 +86,10 @@ func (a *app) cmdPrime(args []string) int {
 		fStatus = &s
 	}
 
+	if *schemaVersion != 0 {
+		printJSON(a.buildPrime(agentID, myAgent, agents, myLocks, otherLocks, wip, pendingMsgs, fStatus))
+		return 0
+	}
 	if *jsonOut {
 		result := map[string]interface{}{
 			"agent_id":         agentID,
@@ -67,6 +98,8 @@ func (a *app) cmdPrime(args []string) int {
 			"locks":            locks,
 			"my_locks":         myLocks,
 			"other_locks":      otherLocks,
+			"wip":              wip,
+			"ownership":        owners,
 			"frontier":         f,
 			"frontier_status":  fStatus,
 			"pending_messages": pendingMsgs,
@@ -78,114 +111,322 @@ func (a *app) cmdPrime(args []string) int {
 
 	// --- Text Output ---
 
-	fmt.Println("# Clockmail Coordination Context")
-	fmt.Println()
+	// Sections are listed in display order; rank orders them for --budget.
+	var sections []primeSection
 
+	header := primeSection{rank: 0, heading: "# Clockmail Coordination Context", lines: []string{""}}
 	if myAgent != nil {
-		fmt.Printf("Agent: %s | Clock: %d | Epoch: %d | Round: %d\n",
-			myAgent.ID, myAgent.Clock, myAgent.Epoch, myAgent.Round)
+		header.lines = append(header.lines, fmt.Sprintf("Agent: %s | Clock: %d | Epoch: %d | Round: %d",
+			myAgent.ID, myAgent.Clock, myAgent.Epoch, myAgent.Round))
 	} else if agentID != "" {
-		fmt.Printf("Agent: %s (not registered — run: cm register %s)\n", agentID, agentID)
+		header.lines = append(header.lines, fmt.Sprintf("Agent: %s (not registered — run: cm register %s)", agentID, agentID))
 	} else {
-		fmt.Println("Agent: (not set — export CLOCKMAIL_AGENT=<id> && cm register <id>)")
+		header.lines = append(header.lines, "Agent: (not set — export CLOCKMAIL_AGENT=<id> && cm register <id>)")
 	}
-	fmt.Println()
+	sections = append(sections, header)
 
 	if len(agents) > 0 {
-		fmt.Println("## Active Agents")
+		sec := primeSection{rank: 6, heading: "## Active Agents", more: "cm status"}
 		for _, ag := range agents {
 			stale := ""
-			if time.Since(ag.LastSeen) > 10*time.Minute {
+			if time.Since(ag.LastSeen) > a.presence("idle") {
 				stale = " (stale)"
 			}
 			marker := ""
+			if len(ag.Roles) > 0 {
+				marker = " role:" + strings.Join(ag.Roles, ",")
+			}
 			if ag.ID == agentID {
-				marker = " (you)"
+				marker += " (you)"
 			}
-			fmt.Printf("  %-15s clock=%-4d epoch=%-3d round=%-3d%s%s\n",
-				ag.ID, ag.Clock, ag.Epoch, ag.Round, stale, marker)
+			sec.lines = append(sec.lines, fmt.Sprintf("  %-15s clock=%-4d epoch=%-3d round=%-3d%s%s",
+				ag.ID, ag.Clock, ag.Epoch, ag.Round, stale, marker))
 		}
-		fmt.Println()
+		sections = append(sections, sec)
+	}
+
+	if len(wip) > 0 {
+		sec := primeSection{rank: 4, heading: "## Work in Progress", more: "cm wip"}
+		for _, w := range wip {
+			sec.lines = append(sec.lines, wipLine(w, agentID))
+		}
+		sections = append(sections, sec)
+	}
+
+	if len(owners) > 0 {
+		sec := primeSection{rank: 4, heading: "## Ownership", more: "cm own"}
+		for _, o := range owners {
+			sec.lines = append(sec.lines, ownershipLine(o, agentID))
+		}
+		sections = append(sections, sec)
 	}
 
 	if len(myLocks) > 0 {
-		fmt.Println("## Your Locks")
+		sec := primeSection{rank: 2, heading: "## Your Locks", more: "cm status"}
 		for _, l := range myLocks {
 			remaining := time.Until(l.ExpiresAt).Truncate(time.Minute)
-			fmt.Printf("  %s (expires in %s)\n", l.Path, remaining)
+			sec.lines = append(sec.lines, fmt.Sprintf("  %s (expires in %s)", l.Path, remaining))
 		}
-		fmt.Println()
+		sections = append(sections, sec)
 	}
 
 	if len(otherLocks) > 0 {
-		fmt.Println("## Other Agents' Locks")
+		sec := primeSection{rank: 5, heading: "## Other Agents' Locks", more: "cm status"}
 		for _, l := range otherLocks {
-			fmt.Printf("  %s held by %s\n", l.Path, l.AgentID)
+			sec.lines = append(sec.lines, fmt.Sprintf("  %s held by %s", l.Path, l.AgentID))
 		}
-		fmt.Println()
+		sections = append(sections, sec)
 	}
 
-	if len(pendingMsgs) > 0 {
-		fmt.Printf("## Pending Messages: %d\n", len(pendingMsgs))
-		for _, e := range pendingMsgs {
-			body := e.Body
-			if len(body) > 100 {
-				body = body[:100] + "..."
-			}
-			fmt.Printf("  [ts=%d] %s: %s\n", e.LamportTS, e.AgentID, body)
+	pending := primeSection{rank: 1, heading: fmt.Sprintf("## Pending Messages: %d", len(pendingMsgs)), more: "cm recv"}
+	for _, e := range pendingMsgs {
+		body := displayBody(e)
+		if len(body) > 100 {
+			body = body[:100] + "..."
 		}
-		fmt.Println("  Run: cm recv   (to acknowledge and advance cursor)")
-	} else {
-		fmt.Println("## Pending Messages: 0")
+		pending.lines = append(pending.lines, fmt.Sprintf("  [ts=%d] %s: %s", e.LamportTS, e.AgentID, body))
+	}
+	if len(pendingMsgs) > 0 {
+		pending.footer = []string{"  Run: cm recv   (to acknowledge and advance cursor)"}
 	}
-	fmt.Println()
+	sections = append(sections, pending)
 
 	if myAgent != nil && fStatus != nil {
-		fmt.Println("## Frontier")
+		sec := primeSection{rank: 3, heading: "## Frontier", more: "cm frontier"}
 		if fStatus.SafeToFinalize {
-			fmt.Printf("  SAFE to finalize epoch=%d round=%d\n", myAgent.Epoch, myAgent.Round)
+			sec.lines = append(sec.lines, fmt.Sprintf("  SAFE to finalize epoch=%d round=%d", myAgent.Epoch, myAgent.Round))
 		} else {
-			fmt.Printf("  NOT SAFE to finalize epoch=%d round=%d\n", myAgent.Epoch, myAgent.Round)
+			sec.lines = append(sec.lines, fmt.Sprintf("  NOT SAFE to finalize epoch=%d round=%d", myAgent.Epoch, myAgent.Round))
 			for _, b := range fStatus.BlockedBy {
-				fmt.Printf("    blocked by %s at epoch=%d round=%d\n",
-					b.AgentID, b.Timestamp.Epoch, b.Timestamp.Round)
+				sec.lines = append(sec.lines, fmt.Sprintf("    blocked by %s at epoch=%d round=%d",
+					b.Who(), b.Timestamp.Epoch, b.Timestamp.Round))
 			}
 		}
 		if len(f) > 0 {
-			fmt.Println("  Frontier points:")
+			sec.lines = append(sec.lines, "  Frontier points:")
 			for _, p := range f {
-				fmt.Printf("    %s @ epoch=%d round=%d\n",
-					p.AgentID, p.Timestamp.Epoch, p.Timestamp.Round)
+				sec.lines = append(sec.lines, fmt.Sprintf("    %s @ epoch=%d round=%d",
+					p.Who(), p.Timestamp.Epoch, p.Timestamp.Round))
 			}
 		}
-		fmt.Println()
+		sections = append(sections, sec)
 	}
 
-	fmt.Println("## Session Close Protocol")
-	fmt.Println()
-	fmt.Println("Before ending your session:")
+	closing := primeSection{rank: 7, heading: "## Session Close Protocol", lines: []string{"", "Before ending your session:"}}
 	if len(myLocks) > 0 {
-		fmt.Println("  1. Release all locks:")
+		closing.lines = append(closing.lines, "  1. Release all locks:")
 		for _, l := range myLocks {
-			fmt.Printf("     cm unlock %s\n", l.Path)
+			closing.lines = append(closing.lines, fmt.Sprintf("     cm unlock %s", l.Path))
 		}
-		fmt.Println("  2. Sync your state:")
-		fmt.Println("     cm sync --epoch <N>")
+		closing.lines = append(closing.lines, "  2. Sync your state:", "     cm sync --epoch <N>")
 	} else {
-		fmt.Println("  cm sync --epoch <N>")
+		closing.lines = append(closing.lines, "  cm sync --epoch <N>")
 	}
-	fmt.Println()
+	sections = append(sections, closing)
 
-	fmt.Println("## Quick Reference")
-	fmt.Println()
-	fmt.Println("  cm sync --epoch N     # Main loop: heartbeat + recv + frontier")
-	fmt.Println("  cm send <to> <msg>    # Message another agent (drains inbox first)")
-	fmt.Println("  cm send all <msg>     # Broadcast to all agents")
-	fmt.Println("  cm broadcast <msg>    # Same as send all")
-	fmt.Println("  cm lock <path>        # Lock file before editing")
-	fmt.Println("  cm unlock <path>      # Release lock")
-	fmt.Println("  cm status             # Full overview")
-	fmt.Println("  cm log                # Event history")
+	sections = append(sections, primeSection{rank: 8, heading: "## Quick Reference", noBlank: true, lines: []string{
+		"",
+		"  cm sync --epoch N     # Main loop: heartbeat + recv + frontier",
+		"  cm send <to> <msg>    # Message another agent (drains inbox first)",
+		"  cm send all <msg>     # Broadcast to all agents",
+		"  cm broadcast <msg>    # Same as send all",
+		"  cm wip set <what>     # Declare what you are about to work on (--files ...)",
+		"  cm lock <path>        # Lock file before editing",
+		"  cm unlock <path>      # Release lock",
+		"  cm own <dir>          # Claim an area long-term (advisory; cm lock warns others)",
+		"  cm status             # Full overview",
+		"  cm log                # Event history",
+	}})
 
+	if *budget > 0 {
+		sections = fitPrime(sections, *budget*charsPerToken)
+	}
+	for _, sec := range sections {
+		fmt.Print(sec.render())
+	}
 	return 0
 }
+
+// charsPerToken is the rough size of a token that --budget assumes.
+const charsPerToken = 4
+
+// Under --budget, sections ranked up to primeEssentialRank are always
+// shown, and get primeFloor lines each before any section gets more.
+const (
+	primeEssentialRank = 3
+	primeFloor         = 3
+)
+
+// primeSection is one "## ..." block of cm prime's text output.
+type primeSection struct {
+	rank    int // lower is kept first under --budget
+	heading string
+	lines   []string
+	footer  []string // kept with the section whenever any of it is
+	more    string   // command that shows everything the section holds
+	noBlank bool     // no blank line after the section
+	omitted int      // lines left out by fitPrime
+}
+
+func (s primeSection) render() string {
+	var b strings.Builder
+	b.WriteString(s.heading + "\n")
+	for _, l := range s.lines {
+		b.WriteString(l + "\n")
+	}
+	if s.omitted > 0 {
+		fmt.Fprintf(&b, "  ... %d more (run: %s)\n", s.omitted, s.more)
+	}
+	for _, l := range s.footer {
+		b.WriteString(l + "\n")
+	}
+	if !s.noBlank {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// fitPrime fits sections into limit characters. Your pending messages,
+// your locks and the frontier (ranks up to primeEssentialRank) always
+// appear, each with at least its first primeFloor lines if they fit, so
+// a long inbox cannot crowd out a lock you forgot. Then, going down the
+// ranks, each section is filled in while it fits and cut short with a
+// "... N more" note where it stops; a section with no command to show
+// the rest is kept whole or not at all. The top-ranked section is always
+// kept whole. The result is in rank order, so the most important
+// context comes first.
+func fitPrime(sections []primeSection, limit int) []primeSection {
+	sorted := append([]primeSection(nil), sections...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].rank < sorted[j].rank })
+
+	used := 0
+	kept := make([]bool, len(sorted))
+	keep := func(i int) {
+		kept[i] = true
+		used += len(sorted[i].render())
+	}
+	// grow adds lines to section i, up to n in all, while they fit.
+	grow := func(i, n int) {
+		sec := &sorted[i]
+		all := sec.lines[:len(sec.lines)+sec.omitted]
+		for len(sec.lines) < n && sec.omitted > 0 {
+			before := len(sec.render())
+			trial := *sec
+			trial.lines = all[:len(sec.lines)+1]
+			trial.omitted--
+			if used+len(trial.render())-before > limit {
+				return
+			}
+			*sec = trial
+			used += len(sec.render()) - before
+		}
+	}
+
+	for i := range sorted {
+		sec := &sorted[i]
+		if i > 0 && sec.more != "" {
+			sec.lines, sec.omitted = sec.lines[:0:len(sec.lines)], len(sec.lines)
+		}
+		if i == 0 || sec.rank <= primeEssentialRank {
+			keep(i)
+		}
+	}
+	for i := range sorted {
+		if kept[i] {
+			grow(i, primeFloor)
+		}
+	}
+	dropped := 0
+	for i := range sorted {
+		if !kept[i] {
+			if used+len(sorted[i].render()) > limit {
+				dropped++
+				continue
+			}
+			keep(i)
+		}
+		grow(i, len(sorted[i].lines)+sorted[i].omitted)
+	}
+
+	var out []primeSection
+	for i, sec := range sorted {
+		if kept[i] {
+			out = append(out, sec)
+		}
+	}
+	if dropped > 0 {
+		out = append(out, primeSection{
+			heading: fmt.Sprintf("(%d more section(s) left out to fit --budget; run cm prime without it for everything)", dropped),
+			noBlank: true,
+		})
+	}
+	return out
+}
+
+// buildPrime assembles the versioned prime document from what cmdPrime
+// gathered. Lists are never null, so consumers can range over them.
+func (a *app) buildPrime(agentID string, me *model.Agent, agents []model.Agent, myLocks, otherLocks []model.Lock,
+	wip []model.WIP, pending []model.Event, fs *frontier.FrontierStatus) model.Prime {
+	p := model.Prime{
+		SchemaVersion:   model.PrimeSchemaVersion,
+		GeneratedAt:     time.Now().UTC(),
+		AgentID:         agentID,
+		Registered:      me != nil,
+		Agents:          make([]model.PrimeAgent, 0, len(agents)),
+		MyLocks:         primeLocks(myLocks),
+		OtherLocks:      primeLocks(otherLocks),
+		WIP:             make([]model.PrimeWIP, 0, len(wip)),
+		PendingCount:    len(pending),
+		PendingMessages: make([]model.PrimeMessage, 0, len(pending)),
+	}
+	for _, ag := range agents {
+		pa := model.PrimeAgent{
+			ID: ag.ID, Clock: ag.Clock, Epoch: ag.Epoch, Round: ag.Round,
+			Presence: a.agentPresence(ag), LastSeen: ag.LastSeen,
+			Roles: append([]string{}, ag.Roles...), You: ag.ID == agentID,
+		}
+		p.Agents = append(p.Agents, pa)
+		if pa.You {
+			p.Self = &pa
+		}
+	}
+	for _, w := range wip {
+		p.WIP = append(p.WIP, model.PrimeWIP{
+			AgentID: w.AgentID, Description: w.Description, Files: append([]string{}, w.Files...),
+			Epoch: w.Epoch, UpdatedAt: w.UpdatedAt,
+		})
+	}
+	for _, e := range pending {
+		prio := e.Priority
+		if prio == "" {
+			prio = model.PriorityNormal
+		}
+		p.PendingMessages = append(p.PendingMessages, model.PrimeMessage{
+			ID: e.ID, LamportTS: e.LamportTS, From: e.AgentID, Body: e.Body,
+			Priority: string(prio), SentAt: e.CreatedAt,
+		})
+	}
+	if me != nil && fs != nil {
+		p.Frontier = &model.PrimeFrontier{
+			Epoch: me.Epoch, Round: me.Round, Safe: fs.SafeToFinalize,
+			BlockedBy: primePointstamps(fs.BlockedBy), Points: primePointstamps(fs.Frontier),
+		}
+	}
+	return p
+}
+
+func primeLocks(locks []model.Lock) []model.PrimeLock {
+	out := make([]model.PrimeLock, 0, len(locks))
+	for _, l := range locks {
+		out = append(out, model.PrimeLock{Path: l.Path, AgentID: l.AgentID, Exclusive: l.Exclusive, ExpiresAt: l.ExpiresAt})
+	}
+	return out
+}
+
+func primePointstamps(ps []model.Pointstamp) []model.PrimePointstamp {
+	out := make([]model.PrimePointstamp, 0, len(ps))
+	for _, p := range ps {
+		out = append(out, model.PrimePointstamp{AgentID: p.AgentID, Epoch: p.Timestamp.Epoch, Round: p.Timestamp.Round, EventID: p.EventID})
+	}
+	return out
+}
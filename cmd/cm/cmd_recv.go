@@ -4,98 +4,337 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+	"github.com/daviddao/clockmail/pkg/trace"
 )
 
+// cmdRecv receives pending messages (IR2). With --wait it first blocks
+// until at least one message is pending or --timeout passes, so an agent
+// can pend on its inbox instead of looping over sync; a timeout is not an
+// error and reports no new messages.
+//
+// --from receives only one sender's messages: the others stay pending,
+// because each agent keeps a cursor per sender as well as one for all.
+// --min-priority likewise receives only messages at or above the floor;
+// the cursor stops at the first one it leaves pending.
+//
+// --defer ID leaves a message unhandled: the cursor still moves past it,
+// but it stays pending and is shown again by the next recv (or, with
+// --for, once the snooze ends). --peek lists the inbox, deferred messages
+// included, without receiving anything.
+//
+// --keep files the received messages in the agent's inbox, where cm inbox
+// lists them until cm archive; without it they are let go once shown.
 func (a *app) cmdRecv(args []string) int {
 	flags := flag.NewFlagSet("recv", flag.ContinueOnError)
 	agent := flags.String("agent", "", "recipient agent ID")
 	sinceTS := flags.Int64("since", -1, "fetch events with lamport_ts >= this (-1 = use cursor)")
 	limit := flags.Int("limit", 100, "max messages to return")
-	from := flags.String("from", "", "filter messages by sender agent ID")
+	from := flags.String("from", "", "receive only messages from this agent, leaving the rest pending")
+	minPriority := flags.String("min-priority", "low", "only receive messages at or above this priority (urgent, normal, low), leaving the rest pending")
 	summary := flags.Bool("summary", false, "show one-line summaries only (first 80 chars)")
+	wait := flags.Bool("wait", false, "block until at least one message arrives")
+	timeout := flags.Duration("timeout", 60*time.Second, "with --wait, give up after this long")
+	peek := flags.Bool("peek", false, "list pending messages with their IDs without receiving them")
+	var deferList stringList
+	flags.Var(&deferList, "defer", "keep the message with this event ID pending (repeatable, or comma-separated)")
+	snooze := flags.Duration("for", 0, "with --defer, hide the messages for this long (default: until the next recv)")
+	keep := flags.Bool("keep", false, "keep the received messages in the inbox (cm inbox) until archived")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
 
-	agentID, err := a.resolveAgent(*agent)
+	minPrio, err := model.ParsePriority(*minPriority)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
+		fmt.Fprintf(os.Stderr, "cm: recv: %v\n", err)
 		return 1
 	}
 
-	since := *sinceTS
-	if since < 0 {
-		since = a.store.GetCursor(agentID)
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	// pending lists what recv would receive now, and sets held to the
+	// timestamp of the first message --min-priority leaves pending.
+	var held int64
+	pending := func() ([]model.Event, error) {
+		var events []model.Event
+		var err error
+		if *sinceTS < 0 {
+			events, err = a.store.ListUnread(agentID, *from, *limit)
+		} else {
+			events, err = a.store.ListEventsForAgent(agentID, *sinceTS, *limit)
+			if *from != "" {
+				events = filterByFrom(events, *from)
+			}
+		}
+		held = 0
+		for _, e := range events {
+			if e.Priority.Rank() < minPrio.Rank() {
+				held = e.LamportTS
+				break
+			}
+		}
+		return filterByPriority(events, minPrio), err
 	}
 
-	events, err := a.store.ListEventsForAgent(agentID, since, *limit)
+	deferIDs, err := parseEventIDs(deferList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: recv: --defer: %v\n", err)
+		return 1
+	}
+	deferrals, err := a.store.ListDeferred(agentID)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: recv: %v\n", err)
 		return 1
 	}
-
-	// Advance clock per IR2 for ALL received messages, even if we filter
-	// the display. This is correct per Lamport 1978: the agent's clock
-	// must advance past all messages it has seen, regardless of display
-	// filtering. Filtering is a presentation concern, not a clock concern.
-	c := a.getClock(agentID)
-	var maxTS int64
-	for _, e := range events {
-		c.Receive(e.LamportTS)
-		if e.LamportTS > maxTS {
-			maxTS = e.LamportTS
+	now := time.Now()
+	var due []model.Event
+	var snoozed []store.Deferral
+	for _, d := range deferrals {
+		if *from != "" && d.Event.AgentID != *from {
+			continue
+		}
+		if d.Due(now) {
+			if d.Event.Priority.Rank() >= minPrio.Rank() {
+				due = append(due, d.Event)
+			}
+		} else {
+			snoozed = append(snoozed, d)
 		}
 	}
-	newTS := c.Value()
+	if *peek {
+		return recvPeek(agentID, pending, due, snoozed, *jsonOut)
+	}
 
-	if ag, _ := a.store.GetAgent(agentID); ag != nil {
-		_ = a.store.UpdateAgentClock(agentID, newTS, ag.Epoch, ag.Round)
+	events, err := pending()
+	timedOut := false
+	if err == nil && *wait && len(events) == 0 && len(due) == 0 {
+		events, timedOut, err = a.waitForInbox(pending, *timeout)
 	}
-	if maxTS > 0 {
-		_ = a.store.SetCursor(agentID, maxTS+1)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: recv: %v\n", err)
+		return 1
+	}
+	// Defer first: an ID that is not in the inbox receives nothing.
+	if len(deferIDs) > 0 {
+		var until time.Time
+		if *snooze > 0 {
+			until = now.Add(*snooze)
+		}
+		if err := a.store.DeferMessages(agentID, deferIDs, until); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: recv: --defer: %v\n", err)
+			return 1
+		}
 	}
 
-	// Apply --from filter for display (after clock advancement).
-	displayed := events
-	if *from != "" {
-		displayed = filterByFrom(events, *from)
+	// Advance clock per IR2 for every received message. --from and
+	// --min-priority decide what is received, so they are applied above:
+	// messages they leave pending are not seen, and move neither the
+	// clock nor the cursor.
+	//
+	// Deliveries, clock and cursor commit together, so a crash cannot
+	// leave the cursor past messages the clock does not reflect.
+	receipt := newInboxReceipt(agentID, a.getClock(agentID).Value(), events)
+	receipt.from = *from
+	receipt.held = held
+	if err := a.store.WithTx(receipt.write); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: recv: %v\n", err)
+		return 1
+	}
+	newTS := receipt.clock
+	a.span.Set(trace.String("clockmail.agent", agentID), trace.Int("clockmail.messages", int64(len(events))),
+		trace.Int("clockmail.lamport_ts", newTS))
+
+	// The inbox is what is due again from earlier deferrals plus what just
+	// arrived, less what is being deferred now. Due deferrals shown here
+	// are handled.
+	deferring := make(map[int64]bool)
+	for _, id := range deferIDs {
+		deferring[id] = true
+	}
+	var inbox []model.Event
+	var handled []int64
+	for _, e := range due {
+		if !deferring[e.ID] {
+			inbox = append(inbox, e)
+			handled = append(handled, e.ID)
+		}
+		deferring[e.ID] = true // not again from events
+	}
+	for _, e := range events {
+		if !deferring[e.ID] {
+			inbox = append(inbox, e)
+		}
+	}
+	_ = a.store.ClearDeferred(agentID, handled)
+	events = inbox
+	var kept []int64
+	if *keep {
+		for _, e := range events {
+			kept = append(kept, e.ID)
+		}
+		if err := a.store.KeepMessages(agentID, kept); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: recv: --keep: %v\n", err)
+			return 1
+		}
 	}
+	openSealed(agentID, events)
+
+	// Surface urgent messages first.
+	sortByPriority(events)
 
 	if *jsonOut {
 		printJSON(map[string]interface{}{
-			"messages":       displayed,
-			"count":          len(displayed),
+			"messages":       events,
+			"count":          len(events),
 			"total_received": len(events),
 			"new_lamport_ts": newTS,
+			"timed_out":      timedOut,
+			"deferred":       deferIDs,
+			"kept":           kept,
 		})
 	} else {
-		if len(events) == 0 {
+		if timedOut {
+			fmt.Printf("no new messages (waited %s)\n", *timeout)
+		} else if len(events) == 0 {
 			fmt.Println("no new messages")
-		} else if len(displayed) == 0 {
-			fmt.Fprintf(os.Stderr, "(%d messages received, none from %q, clock now %d)\n",
-				len(events), *from, newTS)
 		} else {
-			for _, e := range displayed {
-				body := e.Body
+			for _, e := range events {
+				body := displayBody(e)
 				if *summary && len(body) > 80 {
 					body = body[:80] + "..."
 				}
-				fmt.Printf("[ts=%d] %s: %s\n", e.LamportTS, e.AgentID, body)
-			}
-			if *from != "" && len(displayed) < len(events) {
-				fmt.Fprintf(os.Stderr, "(%d shown from %q, %d total received, clock now %d)\n",
-					len(displayed), *from, len(events), newTS)
-			} else {
-				fmt.Fprintf(os.Stderr, "(%d messages, clock now %d)\n", len(events), newTS)
+				fmt.Printf("[ts=%d] %s%s: %s\n", e.LamportTS, priorityTag(e), e.AgentID, body)
 			}
+			fmt.Fprintf(os.Stderr, "(%d messages, clock now %d)\n", len(events), newTS)
+		}
+		if held > 0 {
+			fmt.Fprintf(os.Stderr, "(messages below %s left pending)\n", minPrio)
 		}
+		if len(deferIDs) > 0 {
+			fmt.Fprintf(os.Stderr, "(deferred %s; cm recv --peek lists them)\n", joinIDs(deferIDs))
+		}
+		if len(kept) > 0 {
+			fmt.Fprintf(os.Stderr, "(kept %s in the inbox; cm archive ID when done)\n", joinIDs(kept))
+		}
+	}
+	return 0
+}
+
+// recvPeek implements cm recv --peek: new and deferred messages, with
+// their event IDs, and no side effects.
+func recvPeek(agentID string, pending func() ([]model.Event, error), due []model.Event, snoozed []store.Deferral, jsonOut bool) int {
+	events, err := pending()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: recv: %v\n", err)
+		return 1
+	}
+	openSealed(agentID, events)
+	openSealed(agentID, due)
+	for i := range snoozed {
+		e := []model.Event{snoozed[i].Event}
+		openSealed(agentID, e)
+		snoozed[i].Event = e[0]
+	}
+	if jsonOut {
+		if events == nil {
+			events = []model.Event{}
+		}
+		printJSON(map[string]interface{}{"messages": events, "due": due, "snoozed": snoozed})
+		return 0
+	}
+	if len(events)+len(due)+len(snoozed) == 0 {
+		fmt.Println("no pending messages")
+		return 0
+	}
+	line := func(e model.Event, note string) {
+		fmt.Printf("[id=%d ts=%d] %s%s: %s%s\n", e.ID, e.LamportTS, priorityTag(e), e.AgentID, e.Body, note)
+	}
+	for _, e := range due {
+		line(e, " (deferred)")
+	}
+	for _, e := range events {
+		line(e, "")
+	}
+	for _, d := range snoozed {
+		line(d.Event, fmt.Sprintf(" (snoozed until %s)", d.Until.Local().Format("15:04")))
 	}
 	return 0
 }
 
+// parseEventIDs parses event IDs given as repeated and/or comma-separated
+// values.
+func parseEventIDs(vals []string) ([]int64, error) {
+	var ids []int64
+	for _, v := range vals {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(f, 10, 64)
+			if err != nil || id <= 0 {
+				return nil, fmt.Errorf("%q is not an event ID", f)
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// joinIDs renders event IDs as "12, 13".
+func joinIDs(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(s, ", ")
+}
+
+// waitForInbox blocks until pending returns messages, or timeout passes
+// (timedOut). It wakes on every event write (see wakeups) and checks the
+// inbox then; nothing is received until it returns.
+func (a *app) waitForInbox(pending func() ([]model.Event, error), timeout time.Duration) (events []model.Event, timedOut bool, err error) {
+	span := a.tracer.Start("recv.wait", trace.Float("clockmail.timeout_seconds", timeout.Seconds()))
+	defer func() {
+		span.Set(trace.Bool("clockmail.timed_out", timedOut))
+		span.End(err)
+	}()
+	wake, _, stop := a.wakeups(time.Second)
+	defer stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			return nil, true, nil
+		case <-wake:
+			events, err := pending()
+			if err != nil || len(events) > 0 {
+				return events, false, err
+			}
+		}
+	}
+}
+
+// filterByPriority returns only events at or above min priority.
+func filterByPriority(events []model.Event, min model.Priority) []model.Event {
+	var filtered []model.Event
+	for _, e := range events {
+		if e.Priority.Rank() >= min.Rank() {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
 // filterByFrom returns only events sent by the given agent ID.
 func filterByFrom(events []model.Event, from string) []model.Event {
 	var filtered []model.Event
@@ -1,34 +1,265 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/seal"
+	"github.com/daviddao/clockmail/pkg/store"
 )
 
+// cmdRegister creates or refreshes an agent. --capabilities replaces the
+// skills the agent advertises for "@capability" addressing, and --role the
+// roles it is reached by as "role:<name>"; without them a re-registration
+// keeps the existing ones.
+//
+// --keygen creates the agent's private key under .clockmail/keys (keeping
+// one that is already there) and registers its public half, so others can
+// cm send --encrypt to it; --pubkey registers a key made elsewhere.
+//
+// Every agent also gets an event signing key, <agent_id>.sign in the same
+// directory, whose public half is registered the first time the agent
+// registers. Events written from here are signed with it, so cm log
+// --verify can tell them from forged or altered ones.
+//
+// --admin grants the admin role, which privileged operations (cm unlock
+// --force, cm reap, cm gc, cm import, cm backfill) require once any agent
+// holds it.
+// The first admin may be registered by anyone; after that only an admin
+// may grant the role.
+//
+// Registering also starts a new session for the agent, saved in
+// .clockmail/session. From then on the store only accepts the agent's
+// writes from processes that read that token, so a second process
+// started elsewhere with the same CLOCKMAIL_AGENT is refused instead of
+// corrupting the agent's clock. Registering again takes the session over.
+//
+// Usage: cm register <agent_id> [--role planner] [--admin] [--capabilities go,tests,db] [--keygen | --pubkey KEY] [--json]
 func (a *app) cmdRegister(args []string) int {
 	flags := flag.NewFlagSet("register", flag.ContinueOnError)
+	capsFlag := flags.String("capabilities", "", "comma-separated capabilities to advertise (e.g. go,tests,db)")
+	var roleFlags stringList
+	flags.Var(&roleFlags, "role", "role the agent holds, e.g. planner or tester (repeatable, comma-separated)")
+	admin := flags.Bool("admin", false, "grant the admin role, keeping the agent's other roles (needs an admin once there is one)")
+	pubkey := flags.String("pubkey", "", "register this public key for sealed messages")
+	keygen := flags.Bool("keygen", false, "create a key pair in .clockmail/keys and register its public key")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
 	if flags.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "usage: cm register <agent_id> [--json]")
+		fmt.Fprintln(os.Stderr, "usage: cm register <agent_id> [--role planner] [--capabilities go,tests,db] [--json]")
+		return 1
+	}
+	id := flags.Arg(0)
+	// Also accept flags after the agent ID, as in the usage line.
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return 1
+	}
+	capsSet, rolesSet := false, false
+	flags.Visit(func(f *flag.Flag) {
+		capsSet = capsSet || f.Name == "capabilities"
+		rolesSet = rolesSet || f.Name == "role"
+	})
+
+	if *keygen && *pubkey != "" {
+		fmt.Fprintln(os.Stderr, "cm: register: --keygen and --pubkey are mutually exclusive")
 		return 1
 	}
+	if *pubkey != "" {
+		if err := seal.ValidatePublicKey(*pubkey); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: register: --pubkey: %v\n", err)
+			return 1
+		}
+	}
+
+	var caps []string
+	if capsSet {
+		var err error
+		if caps, err = model.ParseCapabilities(*capsFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: register: %v\n", err)
+			return 1
+		}
+	}
 
-	agent, err := a.store.RegisterAgent(flags.Arg(0))
+	var roles []string
+	if rolesSet {
+		var err error
+		if roles, err = model.ParseRoles(strings.Join(roleFlags, ",")); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: register: %v\n", err)
+			return 1
+		}
+	}
+
+	agent, err := a.store.RegisterAgent(id)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: register: %v\n", err)
 		return 1
 	}
+	if *admin {
+		if !rolesSet {
+			roles = agent.Roles
+		}
+		if !slices.Contains(roles, model.RoleAdmin) {
+			roles = append(roles, model.RoleAdmin)
+			slices.Sort(roles)
+		}
+		rolesSet = true
+	}
+	// Without a default agent, the agent registering grants itself any
+	// role it is given.
+	if a.agentID == "" {
+		a.store.SetActor(id)
+	}
+	if capsSet {
+		if err := a.store.SetCapabilities(id, caps); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: register: capabilities: %v\n", err)
+			return 1
+		}
+		agent.Capabilities = caps
+	}
+	if rolesSet {
+		if err := a.store.SetRoles(id, roles); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: register: roles: %v\n", err)
+			return 1
+		}
+		agent.Roles = roles
+	}
+	key := *pubkey
+	created := false
+	if *keygen {
+		if key, created, err = ensureKeyPair(id); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: register: key: %v\n", err)
+			return 1
+		}
+	}
+	if key != "" {
+		if err := a.store.SetPublicKey(id, key); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: register: key: %v\n", err)
+			return 1
+		}
+	}
+	signPub, signCreated, err := ensureSigningKey(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: register: signing key: %v\n", err)
+		return 1
+	}
+	registered, err := a.store.RegisterSigningKey(id, signPub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: register: signing key: %v\n", err)
+		return 1
+	}
+	if registered != signPub {
+		fmt.Fprintf(os.Stderr, "cm: register: %s already has a different signing key registered; events signed with %s will not verify\n",
+			id, signingKeyPath(id))
+	}
+	token, err := a.store.StartSession(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: register: session: %v\n", err)
+		return 1
+	}
+	if err := saveSession(id, token); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: register: session: %v\n", err)
+		return 1
+	}
 
 	if *jsonOut {
 		printJSON(agent)
 	} else {
 		fmt.Printf("registered agent %q (clock=%d, epoch=%d, round=%d)\n",
 			agent.ID, agent.Clock, agent.Epoch, agent.Round)
+		if len(agent.Roles) > 0 {
+			fmt.Printf("roles: %s (reachable as role:%s)\n",
+				strings.Join(agent.Roles, ","), strings.Join(agent.Roles, ", role:"))
+		}
+		if len(agent.Capabilities) > 0 {
+			fmt.Printf("capabilities: %s (reachable as @%s)\n",
+				strings.Join(agent.Capabilities, ","), strings.Join(agent.Capabilities, ", @"))
+		}
+		if created {
+			fmt.Printf("created private key %s\n", privateKeyPath(id))
+		}
+		if signCreated {
+			fmt.Printf("created signing key %s\n", signingKeyPath(id))
+		}
+		if key != "" {
+			fmt.Printf("public key registered; others can cm send --encrypt %s\n", id)
+		}
 		fmt.Fprintf(os.Stderr, "hint: export CLOCKMAIL_AGENT=%s\n", agent.ID)
 	}
 	return 0
 }
+
+// sessionPath is the file holding the session tokens cm register minted
+// here: CLOCKMAIL_SESSION, or .clockmail/session. Each line is
+// "<agent_id> <token>".
+func sessionPath() string {
+	return envOr("CLOCKMAIL_SESSION", workspacePath("session"))
+}
+
+// loadSessions reads the session file; a missing file holds no tokens.
+func loadSessions() (map[string]string, error) {
+	tokens := make(map[string]string)
+	f, err := os.Open(sessionPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if id, token, ok := strings.Cut(strings.TrimSpace(sc.Text()), " "); ok {
+			tokens[id] = strings.TrimSpace(token)
+		}
+	}
+	return tokens, sc.Err()
+}
+
+// saveSession records token as agentID's session token, keeping the
+// tokens of other agents registered from here.
+func saveSession(agentID, token string) error {
+	tokens, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	tokens[agentID] = token
+	ids := make([]string, 0, len(tokens))
+	for id := range tokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var b strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&b, "%s %s\n", id, tokens[id])
+	}
+	path := sessionPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
+
+// localSessions presents the tokens in the session file, read once per
+// process.
+func localSessions() store.Sessions {
+	var tokens map[string]string
+	return func(agentID string) (string, error) {
+		if tokens == nil {
+			var err error
+			if tokens, err = loadSessions(); err != nil {
+				return "", err
+			}
+		}
+		return tokens[agentID], nil
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/clock"
+	"github.com/daviddao/clockmail/pkg/frontier"
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+)
+
+// replaySleep pauses between replayed events; tests replace it.
+var replaySleep = time.Sleep
+
+// cmdReplay re-emits the event log in Lamport total order, pausing
+// between events for the wall-clock time that separated them divided by
+// --speed, so a past session can be watched as it unfolded.
+//
+// --frontier reconstructs the frontier after each event from the
+// positions the events carry, the way the live store derives it from
+// agents' last heartbeats (departed agents and agents silent for longer
+// than presence.active drop out), and prints it whenever it changes. --gate N adds
+// whether a gate on epoch N would have opened, and who held it shut,
+// which is usually the question: why did cm gate never return?
+//
+// Usage: cm replay [--speed 10x] [--until TS] [--max-wait 5s] [--frontier] [--gate N [--as AGENT]] [--json]
+func (a *app) cmdReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speedFlag := flags.String("speed", "10x", "playback speed relative to the original timing (0 = no pauses)")
+	until := flags.Int64("until", -1, "stop after events with lamport_ts <= this (-1 = whole log)")
+	maxWait := flags.Duration("max-wait", 5*time.Second, "longest pause between two events (0 = no limit)")
+	showFrontier := flags.Bool("frontier", false, "print the reconstructed frontier whenever it changes")
+	gate := flags.Int64("gate", -1, "report whether a gate on this epoch would have opened (-1 = off)")
+	gateRound := flags.Int64("gate-round", 0, "round of the --gate position")
+	as := flags.String("as", "", "agent whose gate --gate evaluates (its own position does not block it)")
+	jsonOut := flags.Bool("json", false, "JSON output (one object per event)")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	speed, err := parseSpeed(*speedFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: replay: %v\n", err)
+		return 1
+	}
+
+	lf := logFilter{}
+	if *until >= 0 {
+		lf.src = fmt.Sprintf("ts<=%d", *until)
+		if lf.query, err = query.Parse(lf.src); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: replay: %v\n", err)
+			return 1
+		}
+	}
+	events, err := a.readLog(lf, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: replay: %v\n", err)
+		return 1
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return clock.TotalOrderLess(events[i].LamportTS, events[i].AgentID, events[j].LamportTS, events[j].AgentID)
+	})
+
+	var gateTS *model.Timestamp
+	if *gate >= 0 {
+		gateTS = &model.Timestamp{Epoch: *gate, Round: *gateRound}
+	}
+	r := newReplayer(a.presence("active"))
+	var prev time.Time
+	for i, e := range events {
+		if i > 0 && speed > 0 {
+			if d := time.Duration(float64(e.CreatedAt.Sub(prev)) / speed); d > 0 {
+				if *maxWait > 0 && d > *maxWait {
+					d = *maxWait
+				}
+				replaySleep(d)
+			}
+		}
+		prev = e.CreatedAt
+		step := r.apply(e, *as, gateTS)
+
+		if *jsonOut {
+			out := map[string]interface{}{"event": e}
+			if *showFrontier {
+				out["frontier"] = step.frontier
+			}
+			if gateTS != nil {
+				out["gate"] = map[string]interface{}{"epoch": gateTS.Epoch, "round": gateTS.Round,
+					"safe": step.gate.SafeToFinalize, "blocked_by": step.gate.BlockedBy}
+			}
+			b, _ := json.Marshal(out)
+			fmt.Println(string(b))
+			continue
+		}
+		printEvent(e)
+		if *showFrontier && step.frontierChanged {
+			fmt.Printf("    frontier: %s\n", pointstampList(step.frontier))
+		}
+		if gateTS != nil && step.gateChanged {
+			if step.gate.SafeToFinalize {
+				fmt.Printf("    gate epoch=%d round=%d: OPEN\n", gateTS.Epoch, gateTS.Round)
+			} else {
+				fmt.Printf("    gate epoch=%d round=%d: shut, blocked by %s\n", gateTS.Epoch, gateTS.Round, pointstampList(step.gate.BlockedBy))
+			}
+		}
+	}
+	if !*jsonOut {
+		if len(events) == 0 {
+			fmt.Println("no events")
+		} else if gateTS != nil && !r.gateOpen {
+			fmt.Printf("gate epoch=%d round=%d still shut at ts=%d\n", gateTS.Epoch, gateTS.Round, events[len(events)-1].LamportTS)
+		}
+	}
+	return 0
+}
+
+// parseSpeed accepts a multiplier such as 10x, 2.5 or 0.5x. Zero means
+// no pauses at all.
+func parseSpeed(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "x"), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("--speed: want a multiplier like 10x, got %q", s)
+	}
+	return v, nil
+}
+
+// replayer tracks each agent's last known position as events go by.
+type replayer struct {
+	pos      map[string]model.Timestamp
+	lastSeen map[string]time.Time
+	frontier []model.Pointstamp
+	gateOpen bool
+	gateSeen bool
+	blockers string
+	window   time.Duration // how long a last position counts, as in store.GetActivePointstamps
+}
+
+// replayStep is what changed after one event.
+type replayStep struct {
+	frontier        []model.Pointstamp
+	frontierChanged bool
+	gate            frontier.FrontierStatus
+	gateChanged     bool
+}
+
+func newReplayer(window time.Duration) *replayer {
+	return &replayer{pos: map[string]model.Timestamp{}, lastSeen: map[string]time.Time{}, window: window}
+}
+
+// apply advances the reconstruction past e. The frontier and gate are
+// evaluated as of e's wall-clock time.
+func (r *replayer) apply(e model.Event, as string, gate *model.Timestamp) replayStep {
+	if e.Kind == model.EventDeparted || e.Kind == model.EventReaped {
+		delete(r.pos, e.AgentID)
+		delete(r.lastSeen, e.AgentID)
+	} else {
+		r.pos[e.AgentID] = model.Timestamp{Epoch: e.Epoch, Round: e.Round}
+		r.lastSeen[e.AgentID] = e.CreatedAt
+	}
+	active := r.active(e.CreatedAt)
+
+	var step replayStep
+	step.frontier = frontier.ComputeFrontier(active)
+	step.frontierChanged = pointstampList(step.frontier) != pointstampList(r.frontier)
+	r.frontier = step.frontier
+	if gate != nil {
+		step.gate = frontier.ComputeFrontierStatus(as, *gate, active)
+		blockers := pointstampList(step.gate.BlockedBy)
+		step.gateChanged = !r.gateSeen || step.gate.SafeToFinalize != r.gateOpen || blockers != r.blockers
+		r.gateSeen, r.gateOpen, r.blockers = true, step.gate.SafeToFinalize, blockers
+	}
+	return step
+}
+
+// active returns the positions of agents heard from within
+// r.window of now, sorted by agent ID.
+func (r *replayer) active(now time.Time) []model.Pointstamp {
+	var ps []model.Pointstamp
+	for id, ts := range r.pos {
+		if now.Sub(r.lastSeen[id]) < r.window {
+			ps = append(ps, model.Pointstamp{AgentID: id, Timestamp: ts})
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].AgentID < ps[j].AgentID })
+	return ps
+}
+
+// pointstampList renders pointstamps as "alice@2.0, bob@1.3".
+func pointstampList(ps []model.Pointstamp) string {
+	if len(ps) == 0 {
+		return "(none)"
+	}
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		parts[i] = fmt.Sprintf("%s@%d.%d", p.Who(), p.Timestamp.Epoch, p.Timestamp.Round)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/web"
+)
+
+// cmdReport writes a standalone HTML timeline of the event log for people
+// who will never run the CLI: one swimlane per agent, message arrows from
+// send to receipt, lock bars, and review markers. The page needs no server
+// and no JavaScript, so it can be attached to a post-run write-up as is.
+//
+// Usage:
+//
+//	cm report --html run.html
+//	cm report --epoch 3 --html epoch3.html --title "nightly refactor"
+func (a *app) cmdReport(args []string) int {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	epoch := flags.Int64("epoch", -1, "only show events recorded in this epoch (-1 = all)")
+	output := flags.String("html", "", "write the HTML report to this file (- for stdout)")
+	title := flags.String("title", "clockmail", "report title")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *output == "" {
+		fmt.Fprintln(os.Stderr, "cm: report: --html FILE is required")
+		return 1
+	}
+
+	var log []model.Event
+	var lastID int64
+	for {
+		events, err := a.store.ListEventsSinceID(lastID, 500)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: report: %v\n", err)
+			return 1
+		}
+		if len(events) == 0 {
+			break
+		}
+		log = append(log, events...)
+		lastID = events[len(events)-1].ID
+	}
+	deliveries, err := a.store.ListDeliveries(time.Time{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: report: %v\n", err)
+		return 1
+	}
+
+	var ep *int64
+	if *epoch >= 0 {
+		ep = epoch
+	}
+	r := web.BuildReport(*title, ep, log, deliveries)
+
+	out := os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: report: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := r.WriteHTML(out); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: report: %v\n", err)
+		return 1
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "wrote %s (%d event(s), %d agent(s))\n", *output, r.Stats.Events, r.Stats.Agents)
+	}
+	return 0
+}
@@ -4,11 +4,18 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/worktree"
 )
 
 // reviewPayload is the structured metadata embedded in review event bodies.
@@ -18,8 +25,54 @@ type reviewPayload struct {
 	Type    string   `json:"type"`              // "review-request" or "review-done"
 	Commit  string   `json:"commit"`            // git commit SHA (short or full)
 	Files   []string `json:"files,omitempty"`   // affected files (request only)
-	Verdict string   `json:"verdict,omitempty"` // "pass" or "fail" (done only)
+	Verdict string   `json:"verdict,omitempty"` // "pass", "fail" or "changes" (done only)
 	Comment string   `json:"comment,omitempty"` // optional reviewer comment
+
+	// Comments are the reviewer's notes on particular lines (done only).
+	Comments []reviewComment `json:"comments,omitempty"`
+
+	// Follows is the commit this one addresses review comments on, which
+	// links the two into one review thread (request only).
+	Follows string `json:"follows,omitempty"`
+
+	// RoutedFrom names the configured reviewer when the request was
+	// rerouted because that reviewer was offline (request only).
+	RoutedFrom string `json:"routed_from,omitempty"`
+}
+
+// reviewComment is a reviewer's note on a line, or range of lines, of a
+// file as of the reviewed commit.
+type reviewComment struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	EndLine int    `json:"end_line,omitempty"`
+	Body    string `json:"body"`
+}
+
+func (c reviewComment) String() string {
+	if c.EndLine > c.Line {
+		return fmt.Sprintf("%s:%d-%d: %s", c.File, c.Line, c.EndLine, c.Body)
+	}
+	return fmt.Sprintf("%s:%d: %s", c.File, c.Line, c.Body)
+}
+
+var reviewCommentRE = regexp.MustCompile(`^(.+?):(\d+)(?:-(\d+))?:\s*(\S.*)$`)
+
+// parseReviewComment parses FILE:LINE: TEXT or FILE:START-END: TEXT.
+func parseReviewComment(s string) (reviewComment, error) {
+	m := reviewCommentRE.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return reviewComment{}, fmt.Errorf("comment %q: want FILE:LINE: TEXT or FILE:START-END: TEXT", s)
+	}
+	c := reviewComment{File: m[1], Body: m[4]}
+	c.Line, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		c.EndLine, _ = strconv.Atoi(m[3])
+	}
+	if c.Line < 1 || (m[3] != "" && c.EndLine < c.Line) {
+		return reviewComment{}, fmt.Errorf("comment %q: bad line range", s)
+	}
+	return c, nil
 }
 
 // cmdReviewRequest signals that a commit is ready for review. It sends a
@@ -30,21 +83,29 @@ type reviewPayload struct {
 // "happened-before" anchor: any subsequent review-done event will have a
 // strictly higher Lamport timestamp (by IR2), proving review-after-write.
 //
+// If a named reviewer is registered but offline, the request is rerouted to
+// the next capable agent that is online (see rerouteReviewer) and the
+// original reviewer is recorded in the payload. Use --no-reroute to
+// deliver to the named reviewer regardless.
+//
 // Usage:
 //
 //	cm review-request <commit> [files...]            # send to tester
 //	cm review-request <commit> --to all [files...]   # broadcast
 //	cm review-request <commit> --to planner f1 f2    # specific reviewer
+//	cm review-request <fix> --follows <commit>       # re-request after changes
 func (a *app) cmdReviewRequest(args []string) int {
 	flags := flag.NewFlagSet("review-request", flag.ContinueOnError)
 	agent := flags.String("agent", "", "sender agent ID")
-	to := flags.String("to", "tester", "reviewer agent ID (default: tester)")
+	to := flags.String("to", a.cfg.String("review.reviewer"), "reviewer agent ID (default: review.reviewer in config.toml)")
+	noReroute := flags.Bool("no-reroute", false, "deliver to offline reviewers instead of rerouting")
+	follows := flags.String("follows", "", "commit whose requested changes this one addresses")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
 	if flags.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "usage: cm review-request <commit> [files...] [--to reviewer] [--json]")
+		fmt.Fprintln(os.Stderr, "usage: cm review-request [--to reviewer] [--follows commit] [--no-reroute] [--json] <commit> [files...]")
 		fmt.Fprintln(os.Stderr, "  Signals a commit is ready for review. Sends structured message to reviewer.")
 		fmt.Fprintln(os.Stderr, "  The Lamport timestamp proves causal ordering: review happens-after commit.")
 		return 1
@@ -52,8 +113,7 @@ func (a *app) cmdReviewRequest(args []string) int {
 
 	agentID, err := a.resolveAgent(*agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
-		return 1
+		return failNoAgent(err, *jsonOut)
 	}
 
 	commitSHA := flags.Arg(0)
@@ -69,27 +129,51 @@ func (a *app) cmdReviewRequest(args []string) int {
 	inbox := a.drainInbox(agentID, c)
 	printInbox(inbox)
 
-	// Build structured payload.
-	payload := reviewPayload{
-		Type:   "review-request",
-		Commit: commitSHA,
-		Files:  files,
+	target, err := a.assignRoleReviewers(*to, agentID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: review-request: %v\n", err)
+		return 1
 	}
-	bodyBytes, _ := json.Marshal(payload)
-
-	// Tick and send (Lamport IR1).
-	ts := c.Tick()
-	_ = a.store.UpdateAgentClock(agentID, ts, ep, rn)
-
-	recipients, err := a.resolveRecipients(*to, agentID)
+	recipients, err := a.resolveRecipients(target, agentID)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: review-request: %v\n", err)
 		return 1
 	}
+	broadcast := strings.EqualFold(strings.TrimSpace(*to), "all")
+	rerouted := make(map[string]string) // original reviewer -> replacement
+	routedFrom := make(map[string]string)
+	if !broadcast && !*noReroute {
+		for i, r := range recipients {
+			alt, ok := a.rerouteReviewer(r, agentID, recipients)
+			if !ok {
+				continue
+			}
+			if alt == "" {
+				fmt.Fprintf(os.Stderr, "cm: review-request: %s is offline and no capable reviewer is online; sending anyway\n", r)
+				continue
+			}
+			rerouted[r] = alt
+			routedFrom[alt] = r
+			recipients[i] = alt
+		}
+	}
+
+	// Tick and send (Lamport IR1).
+	ts := a.tick(agentID, ep, rn)
 
-	var eventIDs []int64
-	for _, r := range recipients {
-		id, err := a.store.InsertEvent(&model.Event{
+	events := make([]*model.Event, len(recipients))
+	for i, r := range recipients {
+		// Build structured payload.
+		payload := reviewPayload{
+			Type:       "review-request",
+			Commit:     commitSHA,
+			Files:      files,
+			RoutedFrom: routedFrom[r],
+			Follows:    *follows,
+		}
+		bodyBytes, _ := json.Marshal(payload)
+
+		events[i] = &model.Event{
 			AgentID:   agentID,
 			LamportTS: ts,
 			Epoch:     ep,
@@ -98,12 +182,12 @@ func (a *app) cmdReviewRequest(args []string) int {
 			Target:    r,
 			Body:      string(bodyBytes),
 			CreatedAt: time.Now().UTC(),
-		})
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "cm: review-request: %v\n", err)
-			return 1
 		}
-		eventIDs = append(eventIDs, id)
+	}
+	eventIDs, err := a.insertEvents(events)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: review-request: %v\n", err)
+		return 1
 	}
 
 	if *jsonOut {
@@ -113,21 +197,148 @@ func (a *app) cmdReviewRequest(args []string) int {
 			"commit":     commitSHA,
 			"files":      files,
 			"recipients": recipients,
+			"rerouted":   rerouted,
+			"follows":    *follows,
 			"type":       "review-request",
 		})
 	} else {
+		for from, alt := range rerouted {
+			fmt.Printf("rerouted: %s is offline, sending to %s\n", from, alt)
+		}
 		fileStr := ""
 		if len(files) > 0 {
 			fileStr = fmt.Sprintf(" files=[%s]", strings.Join(files, ", "))
 		}
+		if *follows != "" {
+			fileStr += " follows=" + *follows
+		}
 		fmt.Printf("review-request sent to %s at ts=%d commit=%s%s\n",
 			strings.Join(recipients, ","), ts, commitSHA, fileStr)
 	}
 	return 0
 }
 
+// assignRoleReviewers replaces each "role:<name>" entry of a review
+// request's --to list with one agent holding the role, so that a request
+// to role:tester goes to a single tester rather than all of them. Agents
+// online are preferred over idle and offline ones, then the one with the
+// fewest pending reviews, then the lowest ID. The sender is never chosen.
+func (a *app) assignRoleReviewers(to, senderID string) (string, error) {
+	entries := strings.Split(to, ",")
+	var chosen []string
+	for i, e := range entries {
+		role, ok := strings.CutPrefix(strings.TrimSpace(e), "role:")
+		if !ok {
+			continue
+		}
+		role = strings.ToLower(role)
+		ids, err := a.store.AgentsWithRole(role)
+		if err != nil {
+			return "", fmt.Errorf("resolve role:%s: %w", role, err)
+		}
+		best, bestRank, bestLoad := "", 0, 0
+		for _, id := range ids {
+			if id == senderID || slices.Contains(chosen, id) {
+				continue
+			}
+			ag, err := a.store.GetAgent(id)
+			if err != nil {
+				return "", err
+			}
+			rank := 2
+			switch a.agentPresence(*ag) {
+			case "online":
+				rank = 0
+			case "idle":
+				rank = 1
+			}
+			pending, err := a.store.PendingReviews(id)
+			if err != nil {
+				return "", err
+			}
+			if best == "" || rank < bestRank || (rank == bestRank && len(pending) < bestLoad) {
+				best, bestRank, bestLoad = id, rank, len(pending)
+			}
+		}
+		if best == "" {
+			return "", fmt.Errorf("no other agents hold role %q", role)
+		}
+		chosen = append(chosen, best)
+		entries[i] = best
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// rerouteReviewer decides whether a review request addressed to reviewer
+// should go elsewhere. ok is false if reviewer is not a registered agent
+// or is neither offline nor departed, in which case the request is
+// delivered as addressed.
+// Otherwise alt is the replacement, or "" if no capable agent is online.
+//
+// A replacement is capable if it shares one of reviewer's roles, whether
+// from the active workflow or registered with cm register --role; if
+// reviewer has no role any agent is capable. The sender and agents already receiving the request
+// are never chosen. Online agents are preferred over idle ones, and ties
+// go to the lowest agent ID so the choice is deterministic.
+func (a *app) rerouteReviewer(reviewer, senderID string, taken []string) (alt string, ok bool) {
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		return "", false
+	}
+	var target *model.Agent
+	for i := range agents {
+		if agents[i].ID == reviewer {
+			target = &agents[i]
+		}
+	}
+	if target == nil || (a.agentPresence(*target) != "offline" && a.agentPresence(*target) != "departed") {
+		return "", false
+	}
+
+	w, _ := a.activeWorkflow()
+	roles := slices.Clone(target.Roles)
+	if w != nil {
+		roles = append(roles, w.RolesOf(reviewer)...)
+	}
+	registered := make(map[string][]string)
+	for _, ag := range agents {
+		registered[ag.ID] = ag.Roles
+	}
+	capable := func(id string) bool {
+		if len(roles) == 0 {
+			return true
+		}
+		for _, role := range roles {
+			if slices.Contains(registered[id], role) || (w != nil && w.HasRole(id, role)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	best, bestPresence := "", ""
+	for _, ag := range agents {
+		presence := a.agentPresence(ag)
+		if ag.ID == senderID || presence == "offline" || presence == "departed" ||
+			slices.Contains(taken, ag.ID) || !capable(ag.ID) {
+			continue
+		}
+		better := best == "" ||
+			(presence == "online" && bestPresence != "online") ||
+			(presence == bestPresence && ag.ID < best)
+		if better {
+			best, bestPresence = ag.ID, presence
+		}
+	}
+	return best, true
+}
+
 // cmdReviewDone signals that a review is complete. The reviewer sends
 // a structured verdict (pass/fail) back to the original author or to all.
+// With --request-changes the verdict is "changes" instead: the reviewer's
+// -c FILE:LINE: TEXT notes are carried as structured comments, and the
+// author answers with a new review-request (--follows the commit) once
+// they are addressed. Notes may accompany a pass or fail too.
 //
 // Because the reviewer received the review-request first (advancing their
 // clock via IR2), the review-done event's Lamport timestamp is guaranteed
@@ -139,16 +350,22 @@ func (a *app) cmdReviewRequest(args []string) int {
 //	cm review-done <commit> pass                # approve
 //	cm review-done <commit> fail "needs fix"    # reject with comment
 //	cm review-done <commit> pass --to sergie    # specific author
+//	cm review-done <commit> --request-changes -c 'a.go:12: check err' "see notes"
 func (a *app) cmdReviewDone(args []string) int {
 	flags := flag.NewFlagSet("review-done", flag.ContinueOnError)
 	agent := flags.String("agent", "", "reviewer agent ID")
 	to := flags.String("to", "all", "author agent ID to notify (default: all)")
+	requestChanges := flags.Bool("request-changes", false, "ask for changes instead of giving a pass/fail verdict")
+	var notes stringList
+	flags.Var(&notes, "c", "line comment FILE:LINE: TEXT or FILE:START-END: TEXT (repeatable)")
+	flags.Var(&notes, "comment", "same as -c")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
-	if flags.NArg() < 2 {
-		fmt.Fprintln(os.Stderr, "usage: cm review-done <commit> <pass|fail> [comment] [--to author] [--json]")
+	if flags.NArg() < 2 && !(*requestChanges && flags.NArg() == 1) {
+		fmt.Fprintln(os.Stderr, "usage: cm review-done <commit> <pass|fail> [comment] [-c FILE:LINE: TEXT]... [--to author] [--json]")
+		fmt.Fprintln(os.Stderr, "       cm review-done <commit> --request-changes [-c FILE:LINE: TEXT]... [summary]")
 		fmt.Fprintln(os.Stderr, "  Signals a review is complete with a verdict.")
 		fmt.Fprintln(os.Stderr, "  Lamport timestamp is guaranteed > review-request (proves review-after-write).")
 		return 1
@@ -156,19 +373,36 @@ func (a *app) cmdReviewDone(args []string) int {
 
 	agentID, err := a.resolveAgent(*agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
-		return 1
+		return failNoAgent(err, *jsonOut)
 	}
 
 	commitSHA := flags.Arg(0)
-	verdict := strings.ToLower(flags.Arg(1))
-	if verdict != "pass" && verdict != "fail" {
-		fmt.Fprintf(os.Stderr, "cm: review-done: verdict must be 'pass' or 'fail', got %q\n", verdict)
+	rest := flags.Args()[1:]
+	verdict := "changes"
+	if !*requestChanges {
+		verdict = strings.ToLower(rest[0])
+		if verdict != "pass" && verdict != "fail" {
+			fmt.Fprintf(os.Stderr, "cm: review-done: verdict must be 'pass' or 'fail', got %q\n", verdict)
+			return 1
+		}
+		rest = rest[1:]
+	} else if len(rest) > 0 && (strings.EqualFold(rest[0], "pass") || strings.EqualFold(rest[0], "fail")) {
+		fmt.Fprintln(os.Stderr, "cm: review-done: --request-changes replaces the pass/fail verdict")
 		return 1
 	}
-	var comment string
-	if flags.NArg() > 2 {
-		comment = strings.Join(flags.Args()[2:], " ")
+	comment := strings.Join(rest, " ")
+	var comments []reviewComment
+	for _, n := range notes {
+		c, err := parseReviewComment(n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: review-done: %v\n", err)
+			return 1
+		}
+		comments = append(comments, c)
+	}
+	if verdict == "changes" && comment == "" && len(comments) == 0 {
+		fmt.Fprintln(os.Stderr, "cm: review-done: --request-changes needs a summary or -c FILE:LINE: TEXT comments")
+		return 1
 	}
 
 	ep, rn := a.resolveEpochRound(agentID, -1, -1)
@@ -180,16 +414,16 @@ func (a *app) cmdReviewDone(args []string) int {
 
 	// Build structured payload.
 	payload := reviewPayload{
-		Type:    "review-done",
-		Commit:  commitSHA,
-		Verdict: verdict,
-		Comment: comment,
+		Type:     "review-done",
+		Commit:   commitSHA,
+		Verdict:  verdict,
+		Comment:  comment,
+		Comments: comments,
 	}
 	bodyBytes, _ := json.Marshal(payload)
 
 	// Tick and send (Lamport IR1).
-	ts := c.Tick()
-	_ = a.store.UpdateAgentClock(agentID, ts, ep, rn)
+	ts := a.tick(agentID, ep, rn)
 
 	recipients, err := a.resolveRecipients(*to, agentID)
 	if err != nil {
@@ -197,9 +431,9 @@ func (a *app) cmdReviewDone(args []string) int {
 		return 1
 	}
 
-	var eventIDs []int64
-	for _, r := range recipients {
-		id, err := a.store.InsertEvent(&model.Event{
+	events := make([]*model.Event, len(recipients))
+	for i, r := range recipients {
+		events[i] = &model.Event{
 			AgentID:   agentID,
 			LamportTS: ts,
 			Epoch:     ep,
@@ -208,12 +442,12 @@ func (a *app) cmdReviewDone(args []string) int {
 			Target:    r,
 			Body:      string(bodyBytes),
 			CreatedAt: time.Now().UTC(),
-		})
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "cm: review-done: %v\n", err)
-			return 1
 		}
-		eventIDs = append(eventIDs, id)
+	}
+	eventIDs, err := a.insertEvents(events)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: review-done: %v\n", err)
+		return 1
 	}
 
 	if *jsonOut {
@@ -223,6 +457,7 @@ func (a *app) cmdReviewDone(args []string) int {
 			"commit":     commitSHA,
 			"verdict":    verdict,
 			"comment":    comment,
+			"comments":   comments,
 			"recipients": recipients,
 			"type":       "review-done",
 		})
@@ -233,6 +468,363 @@ func (a *app) cmdReviewDone(args []string) int {
 		}
 		fmt.Printf("review-done sent to %s at ts=%d commit=%s verdict=%s%s\n",
 			strings.Join(recipients, ","), ts, commitSHA, verdict, commentStr)
+		for _, c := range comments {
+			fmt.Printf("  %s\n", c)
+		}
 	}
 	return 0
 }
+
+// commitReviews is the reviews of one commit.
+type commitReviews struct {
+	Commit  string            `json:"commit"`
+	State   model.ReviewState `json:"state"`
+	Reviews []model.Review    `json:"reviews"`
+}
+
+// cmdReview reports on the reviews table, which review-request and
+// review-done keep up to date: one row per commit and reviewer. Show reads
+// the review events themselves to replay a whole thread.
+//
+// Usage:
+//
+//	cm review status [commit]          # all reviews, or those of one commit (SHA prefix)
+//	cm review pending [--reviewer ID]  # reviews waiting on you
+//	cm review show <commit>            # the thread: requests, comments, re-requests, verdicts
+func (a *app) cmdReview(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm review <status|pending|show> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "status":
+		return a.reviewStatus(args[1:])
+	case "pending":
+		return a.reviewPending(args[1:])
+	case "show":
+		return a.reviewShow(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: review: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) reviewStatus(args []string) int {
+	flags := flag.NewFlagSet("review status", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	commit := flags.Arg(0)
+
+	reviews, err := a.store.ListReviews(commit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: review: %v\n", err)
+		return 1
+	}
+	if commit != "" && len(reviews) == 0 {
+		return fail(fmt.Sprintf("review: no reviews of %s", commit), *jsonOut, 1, []nextAction{
+			{Command: "cm review-request " + commit, Reason: "ask for a review"},
+		})
+	}
+
+	var commits []commitReviews
+	index := make(map[string]int)
+	for _, r := range reviews {
+		i, ok := index[r.Commit]
+		if !ok {
+			i = len(commits)
+			index[r.Commit] = i
+			commits = append(commits, commitReviews{Commit: r.Commit})
+		}
+		commits[i].Reviews = append(commits[i].Reviews, r)
+	}
+	for i := range commits {
+		commits[i].State = overallReviewState(commits[i].Reviews)
+	}
+
+	if *jsonOut {
+		if commits == nil {
+			commits = []commitReviews{}
+		}
+		printJSON(map[string]interface{}{"commits": commits})
+		return 0
+	}
+	if len(commits) == 0 {
+		fmt.Println("no reviews")
+		return 0
+	}
+	for _, c := range commits {
+		fmt.Printf("%s %s\n", c.Commit, c.State)
+		for _, r := range c.Reviews {
+			from := ""
+			if r.RequestedBy != "" {
+				from = fmt.Sprintf(" (requested by %s at ts=%d)", r.RequestedBy, r.RequestTS)
+			}
+			switch r.State {
+			case model.ReviewPending:
+				fmt.Printf("  %-16s pending for %s%s\n", r.Reviewer, time.Since(r.RequestedAt).Round(time.Second), from)
+			default:
+				comment := ""
+				if r.Comment != "" {
+					comment = fmt.Sprintf(" %q", r.Comment)
+				}
+				fmt.Printf("  %-16s %s at ts=%d%s%s\n", r.Reviewer, r.State, r.VerdictTS, comment, from)
+			}
+		}
+	}
+	return 0
+}
+
+func (a *app) reviewPending(args []string) int {
+	flags := flag.NewFlagSet("review pending", flag.ContinueOnError)
+	reviewer := flags.String("reviewer", "", "reviewer agent ID (default: you)")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	reviewerID, err := a.resolveAgent(*reviewer)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	pending, err := a.store.PendingReviews(reviewerID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: review: %v\n", err)
+		return 1
+	}
+
+	var actions []nextAction
+	for _, r := range pending {
+		actions = append(actions, nextAction{
+			Command: fmt.Sprintf("cm review-done %s pass --to %s", r.Commit, r.RequestedBy),
+			Reason:  "report your verdict (or --request-changes -c FILE:LINE: TEXT)",
+		})
+	}
+
+	if *jsonOut {
+		if pending == nil {
+			pending = []model.Review{}
+		}
+		printJSON(map[string]interface{}{"reviewer": reviewerID, "pending": pending, "next_actions": actions})
+		return 0
+	}
+	if len(pending) == 0 {
+		fmt.Printf("no reviews pending for %s\n", reviewerID)
+		return 0
+	}
+	fmt.Printf("%d review(s) pending for %s:\n", len(pending), reviewerID)
+	for _, r := range pending {
+		files := ""
+		if len(r.Files) > 0 {
+			files = fmt.Sprintf(" files=[%s]", strings.Join(r.Files, ", "))
+		}
+		fmt.Printf("  %s from %s at ts=%d (%s ago)%s\n",
+			r.Commit, r.RequestedBy, r.RequestTS, time.Since(r.RequestedAt).Round(time.Second), files)
+	}
+	printHints(actions)
+	return 0
+}
+
+// overallReviewState summarizes a commit's reviews: failed if any
+// reviewer failed it, then changes requested if any reviewer asked for
+// changes, pending while any review is outstanding, and passed otherwise.
+func overallReviewState(reviews []model.Review) model.ReviewState {
+	state := model.ReviewPassed
+	for _, r := range reviews {
+		switch r.State {
+		case model.ReviewFailed:
+			return model.ReviewFailed
+		case model.ReviewChangesRequested:
+			state = model.ReviewChangesRequested
+		case model.ReviewPending:
+			if state != model.ReviewChangesRequested {
+				state = model.ReviewPending
+			}
+		}
+	}
+	return state
+}
+
+// threadEntry is one step of a review thread: a request or a verdict,
+// merged across the events written for each recipient.
+type threadEntry struct {
+	LamportTS int64           `json:"lamport_ts"`
+	AgentID   string          `json:"agent_id"`
+	Kind      model.EventKind `json:"kind"`
+	To        []string        `json:"to"`
+	CreatedAt time.Time       `json:"created_at"`
+	reviewPayload
+}
+
+// reviewThread collects the review events of commit (a SHA prefix) and of
+// every commit linked to it by review-request --follows, in either
+// direction, ordered by Lamport timestamp. It also returns the thread's
+// commits in the order they were first requested.
+func reviewThread(events []model.Event, commit string) ([]threadEntry, []string) {
+	sameCommit := func(x, y string) bool {
+		return x != "" && y != "" && (strings.HasPrefix(x, y) || strings.HasPrefix(y, x))
+	}
+	payloads := make([]reviewPayload, len(events))
+	for i, e := range events {
+		json.Unmarshal([]byte(e.Body), &payloads[i]) //nolint:errcheck // malformed bodies have no commit
+	}
+
+	thread := []string{commit}
+	inThread := func(c string) bool {
+		return slices.ContainsFunc(thread, func(t string) bool { return sameCommit(t, c) })
+	}
+	// Follow links until no commit joins; threads are short, so the
+	// repeated scans are cheap.
+	for grew := true; grew; {
+		grew = false
+		for i, e := range events {
+			p := payloads[i]
+			if e.Kind != model.EventReviewReq || p.Follows == "" {
+				continue
+			}
+			if inThread(p.Commit) && !inThread(p.Follows) {
+				thread, grew = append(thread, p.Follows), true
+			} else if inThread(p.Follows) && !inThread(p.Commit) {
+				thread, grew = append(thread, p.Commit), true
+			}
+		}
+	}
+
+	var entries []threadEntry
+	index := make(map[string]int)
+	for i, e := range events {
+		if !inThread(payloads[i].Commit) {
+			continue
+		}
+		key := fmt.Sprintf("%s\x00%d\x00%s\x00%s", e.AgentID, e.LamportTS, e.Kind, e.Body)
+		if j, ok := index[key]; ok {
+			entries[j].To = append(entries[j].To, e.Target)
+			continue
+		}
+		index[key] = len(entries)
+		entries = append(entries, threadEntry{
+			LamportTS: e.LamportTS, AgentID: e.AgentID, Kind: e.Kind,
+			To: []string{e.Target}, CreatedAt: e.CreatedAt, reviewPayload: payloads[i],
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].LamportTS != entries[j].LamportTS {
+			return entries[i].LamportTS < entries[j].LamportTS
+		}
+		return entries[i].AgentID < entries[j].AgentID
+	})
+
+	var commits []string
+	for _, en := range entries {
+		if en.Kind == model.EventReviewReq && !slices.Contains(commits, en.Commit) {
+			commits = append(commits, en.Commit)
+		}
+	}
+	return entries, commits
+}
+
+func (a *app) reviewShow(args []string) int {
+	flags := flag.NewFlagSet("review show", flag.ContinueOnError)
+	context := flags.Int("context", 2, "lines of source shown around each comment (-1 for none)")
+	dir := flags.String("dir", ".", "directory inside the git working tree, for comment context")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm review show [--context N] [--json] <commit>")
+		return 1
+	}
+	commit := flags.Arg(0)
+
+	events, err := a.store.ListEventsByKind(
+		[]model.EventKind{model.EventReviewReq, model.EventReviewDone}, 0, math.MaxInt32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: review: %v\n", err)
+		return 1
+	}
+	entries, commits := reviewThread(events, commit)
+	if len(entries) == 0 {
+		return fail(fmt.Sprintf("review: no reviews of %s", commit), *jsonOut, 1, []nextAction{
+			{Command: "cm review-request " + commit, Reason: "ask for a review"},
+		})
+	}
+
+	// The thread stands where the review of its latest commit stands.
+	var state model.ReviewState
+	if len(commits) > 0 {
+		reviews, err := a.store.ListReviews(commits[len(commits)-1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: review: %v\n", err)
+			return 1
+		}
+		state = overallReviewState(reviews)
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"commit": commit, "commits": commits, "state": state, "thread": entries})
+		return 0
+	}
+	fmt.Printf("review thread for %s", commit)
+	if len(commits) > 1 {
+		fmt.Printf(" (%s)", strings.Join(commits, " -> "))
+	}
+	if state != "" {
+		fmt.Printf(": %s", state)
+	}
+	fmt.Println()
+
+	var repo *worktree.Repo
+	if *context >= 0 {
+		if absDir, err := filepath.Abs(*dir); err == nil {
+			repo, _ = worktree.Open(absDir)
+		}
+	}
+	for _, en := range entries {
+		to := strings.Join(en.To, ",")
+		switch {
+		case en.Kind == model.EventReviewReq && en.Follows != "":
+			fmt.Printf("[ts=%d] %s re-requested review of %s from %s (follows %s)\n", en.LamportTS, en.AgentID, en.Commit, to, en.Follows)
+		case en.Kind == model.EventReviewReq:
+			fmt.Printf("[ts=%d] %s requested review of %s from %s\n", en.LamportTS, en.AgentID, en.Commit, to)
+		case en.Verdict == "changes":
+			fmt.Printf("[ts=%d] %s requested changes to %s\n", en.LamportTS, en.AgentID, en.Commit)
+		default:
+			fmt.Printf("[ts=%d] %s: %s %s\n", en.LamportTS, en.AgentID, en.Verdict, en.Commit)
+		}
+		if len(en.Files) > 0 {
+			fmt.Printf("    files: %s\n", strings.Join(en.Files, ", "))
+		}
+		if en.Comment != "" {
+			fmt.Printf("    %q\n", en.Comment)
+		}
+		for _, c := range en.Comments {
+			fmt.Printf("    %s\n", c)
+			if repo != nil {
+				printCommentContext(repo, en.Commit, c, *context)
+			}
+		}
+	}
+	return 0
+}
+
+// printCommentContext prints the lines c refers to as of commit, with
+// context lines around them, marking the commented lines with '>'. It
+// prints nothing if the file cannot be read at that commit.
+func printCommentContext(repo *worktree.Repo, commit string, c reviewComment, context int) {
+	data, err := repo.Show(commit, c.File)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	end := max(c.EndLine, c.Line)
+	from, to := max(c.Line-context, 1), min(end+context, len(lines))
+	for n := from; n <= to; n++ {
+		mark := " "
+		if n >= c.Line && n <= end {
+			mark = ">"
+		}
+		fmt.Printf("      %s %4d | %s\n", mark, n, lines[n-1])
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// cmdSaga records multi-step coordinated operations. Each step carries
+// the instruction that undoes it; aborting a saga (by its owner or by any
+// other agent, e.g. after the owner crashed) releases the locks its steps
+// took and emits the remaining compensations, last step first.
+//
+// Usage:
+//
+//	cm saga begin "auth refactor"                      # prints saga ID
+//	cm saga step <id> --lock auth.go "lock auth.go"
+//	cm saga step <id> --undo "git revert abc123" "commit abc123"
+//	cm saga commit <id>
+//	cm saga abort <id> [reason]
+//	cm saga status [id]
+func (a *app) cmdSaga(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm saga <begin|step|commit|abort|status> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "begin":
+		return a.sagaBegin(args[1:])
+	case "step":
+		return a.sagaStep(args[1:])
+	case "commit":
+		return a.sagaFinish(args[1:], model.SagaCommitted)
+	case "abort":
+		return a.sagaFinish(args[1:], model.SagaAborted)
+	case "status":
+		return a.sagaStatus(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: saga: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) sagaBegin(args []string) int {
+	flags := flag.NewFlagSet("saga begin", flag.ContinueOnError)
+	agent := flags.String("agent", "", "owning agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	name := strings.Join(flags.Args(), " ")
+
+	// The owner's clock strictly increases, so agent-ts is a unique ID.
+	c := a.getClock(agentID)
+	id := fmt.Sprintf("%s-%d", agentID, c.Value()+1)
+	saga, err := a.store.BeginSaga(id, agentID, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: saga begin: %v\n", err)
+		return 1
+	}
+	ts, err := a.recordEvent(agentID, model.EventSaga, id, "begin "+name)
+	if err != nil {
+		a.logger().Warn("record saga event", "verb", "begin", "err", err)
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"saga": saga, "lamport_ts": ts})
+	} else {
+		fmt.Printf("saga %s begun (ts=%d)\n", id, ts)
+		fmt.Fprintf(os.Stderr, "hint: cm saga step %s --undo \"<command>\" \"<what you did>\"\n", id)
+	}
+	return 0
+}
+
+func (a *app) sagaStep(args []string) int {
+	flags := flag.NewFlagSet("saga step", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent performing the step")
+	undo := flags.String("undo", "", "instruction that compensates this step")
+	var locks stringList
+	flags.Var(&locks, "lock", "path locked by this step, released on abort (repeatable)")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, "usage: cm saga step [--undo CMD] [--lock PATH]... <saga-id> <action>")
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	sagaID := flags.Arg(0)
+	action := strings.Join(flags.Args()[1:], " ")
+
+	// Check before logging so rejected steps leave no trace in the log;
+	// AddSagaStep re-checks atomically.
+	if saga, err := a.store.GetSaga(sagaID); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: saga step: saga %q not found\n", sagaID)
+		return 1
+	} else if saga.Status != model.SagaOpen {
+		fmt.Fprintf(os.Stderr, "cm: saga step: saga %q is %s\n", sagaID, saga.Status)
+		return 1
+	}
+
+	ts, err := a.recordEvent(agentID, model.EventSaga, sagaID, "step: "+action)
+	if err != nil {
+		a.logger().Warn("record saga event", "verb", "step", "err", err)
+	}
+	step, err := a.store.AddSagaStep(sagaID, model.SagaStep{
+		AgentID:      agentID,
+		Action:       action,
+		Compensation: *undo,
+		Locks:        locks,
+		LamportTS:    ts,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: saga step: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"saga_id": sagaID, "step": step})
+	} else {
+		fmt.Printf("saga %s step %d: %s (ts=%d)\n", sagaID, step.Seq, action, ts)
+	}
+	return 0
+}
+
+func (a *app) sagaFinish(args []string, status model.SagaStatus) int {
+	verb := "commit"
+	if status == model.SagaAborted {
+		verb = "abort"
+	}
+	flags := flag.NewFlagSet("saga "+verb, flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent finishing the saga")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "usage: cm saga %s <saga-id> [reason]\n", verb)
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	sagaID := flags.Arg(0)
+	reason := strings.Join(flags.Args()[1:], " ")
+
+	saga, err := a.store.FinishSaga(sagaID, status)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: saga %s: %v\n", verb, err)
+		return 1
+	}
+	body := verb
+	if reason != "" {
+		body += ": " + reason
+	}
+	ts, err := a.recordEvent(agentID, model.EventSaga, sagaID, body)
+	if err != nil {
+		a.logger().Warn("record saga event", "verb", verb, "err", err)
+	}
+
+	if status == model.SagaCommitted {
+		if *jsonOut {
+			printJSON(map[string]interface{}{"saga": saga, "lamport_ts": ts})
+		} else {
+			fmt.Printf("saga %s committed (%d steps, ts=%d)\n", sagaID, len(saga.Steps), ts)
+		}
+		return 0
+	}
+	return a.sagaCompensate(agentID, saga, reason, ts, *jsonOut)
+}
+
+// sagaCompensate unwinds an aborted saga: locks recorded on its steps are
+// released on behalf of the agents that took them, and the remaining
+// compensation instructions are printed and sent to every participant.
+func (a *app) sagaCompensate(agentID string, saga *model.Saga, reason string, ts int64, jsonOut bool) int {
+	var released []string
+	var instructions []string
+	for _, st := range saga.Compensations() {
+		for _, path := range st.Locks {
+			if err := a.store.ReleaseLock(path, st.AgentID); err != nil {
+				a.logger().Warn("release saga lock", "saga", saga.ID, "path", path, "err", err)
+				continue
+			}
+			if _, err := a.recordEvent(agentID, model.EventLockRel, path, "saga "+saga.ID); err != nil {
+				a.logger().Warn("record unlock event", "path", path, "err", err)
+			}
+			released = append(released, path)
+		}
+		if st.Compensation != "" {
+			instructions = append(instructions, fmt.Sprintf("step %d (%s): %s", st.Seq, st.AgentID, st.Compensation))
+		}
+	}
+
+	// Tell every other participant what still needs undoing.
+	participants := map[string]bool{saga.AgentID: true}
+	for _, st := range saga.Steps {
+		participants[st.AgentID] = true
+	}
+	delete(participants, agentID)
+	if len(participants) > 0 {
+		msg := fmt.Sprintf("saga %s aborted by %s", saga.ID, agentID)
+		if reason != "" {
+			msg += ": " + reason
+		}
+		if len(instructions) > 0 {
+			msg += "; compensate in order: " + strings.Join(instructions, "; ")
+		}
+		for p := range participants {
+			if _, err := a.recordEvent(agentID, model.EventMsg, p, msg); err != nil {
+				fmt.Fprintf(os.Stderr, "cm: saga abort: notify %s: %v\n", p, err)
+			}
+		}
+	}
+
+	if jsonOut {
+		printJSON(map[string]interface{}{
+			"saga":           saga,
+			"lamport_ts":     ts,
+			"released_locks": released,
+			"compensations":  instructions,
+		})
+		return 0
+	}
+	fmt.Printf("saga %s aborted (ts=%d)\n", saga.ID, ts)
+	for _, p := range released {
+		fmt.Printf("  released lock %s\n", p)
+	}
+	if len(instructions) == 0 {
+		fmt.Println("  no compensation instructions recorded")
+	} else {
+		fmt.Println("  compensate in order:")
+		for i, ins := range instructions {
+			fmt.Printf("    %d. %s\n", i+1, ins)
+		}
+	}
+	return 0
+}
+
+func (a *app) sagaStatus(args []string) int {
+	flags := flag.NewFlagSet("saga status", flag.ContinueOnError)
+	all := flags.Bool("all", false, "include committed and aborted sagas")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	if flags.NArg() > 0 {
+		saga, err := a.store.GetSaga(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: saga status: %s: %v\n", flags.Arg(0), err)
+			return 1
+		}
+		if *jsonOut {
+			printJSON(saga)
+			return 0
+		}
+		fmt.Printf("saga %s %q owner=%s status=%s\n", saga.ID, saga.Name, saga.AgentID, saga.Status)
+		for _, st := range saga.Steps {
+			fmt.Printf("  %d. [ts=%d] %s: %s\n", st.Seq, st.LamportTS, st.AgentID, st.Action)
+			if len(st.Locks) > 0 {
+				fmt.Printf("       locks: %s\n", strings.Join(st.Locks, ", "))
+			}
+			if st.Compensation != "" {
+				fmt.Printf("       undo:  %s\n", st.Compensation)
+			}
+		}
+		return 0
+	}
+
+	sagas, err := a.store.ListSagas(!*all)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: saga status: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"sagas": sagas, "count": len(sagas)})
+		return 0
+	}
+	if len(sagas) == 0 {
+		fmt.Println("no open sagas")
+		return 0
+	}
+	for _, g := range sagas {
+		fmt.Printf("  %-24s %-10s owner=%-12s %s\n", g.ID, g.Status, g.AgentID, g.Name)
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// schemas are the versioned documents cm can describe, by name.
+var schemas = map[string]struct {
+	version int
+	doc     interface{}
+	title   string
+}{
+	"prime": {model.PrimeSchemaVersion, model.Prime{}, "cm prime --json --schema-version"},
+}
+
+// cmdSchema prints the JSON Schema of a versioned output document, built
+// from its Go type in pkg/model, so orchestrators can validate what they
+// parse or generate bindings from it.
+//
+// Usage:
+//
+//	cm schema          # list documents
+//	cm schema prime    # JSON Schema for cm prime --json --schema-version 1
+func (a *app) cmdSchema(args []string) int {
+	if len(args) == 0 {
+		for _, name := range []string{"prime"} {
+			s := schemas[name]
+			fmt.Printf("%-8s version %d  (%s %d)\n", name, s.version, s.title, s.version)
+		}
+		return 0
+	}
+	s, ok := schemas[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cm: schema: unknown document %q (try: cm schema)\n", args[0])
+		return 1
+	}
+	root := jsonSchema(reflect.TypeOf(s.doc))
+	out := map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"$id":         fmt.Sprintf("https://github.com/daviddao/clockmail/schema/%s/v%d.json", args[0], s.version),
+		"title":       fmt.Sprintf("%s %d", s.title, s.version),
+		"type":        root["type"],
+		"properties":  root["properties"],
+		"required":    root["required"],
+		"description": fmt.Sprintf("Version %d. Fields may be added within a version; none is renamed, removed or retyped.", s.version),
+	}
+	printJSON(out)
+	return 0
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema describes t as encoding/json marshals it. Struct fields are
+// described by their doc tags and are all required (an omitempty field
+// would be optional, but versioned documents do not use them).
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		s := jsonSchema(t.Elem())
+		s["type"] = []interface{}{s["type"], "null"}
+		return s
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			p := jsonSchema(f.Type)
+			if doc := f.Tag.Get("doc"); doc != "" {
+				p["description"] = doc
+			}
+			props[name] = p
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "required": required}
+	}
+	panic("jsonSchema: unsupported type " + t.String())
+}
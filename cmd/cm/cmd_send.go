@@ -1,55 +1,172 @@
 package main
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+	"github.com/daviddao/clockmail/pkg/trace"
 )
 
 // cmdSend is the unified send command. It drains the inbox before sending
-// (bidirectional by default). Use --quiet to suppress inbox output.
+// (bidirectional by default). Use --quiet to suppress inbox output (the
+// global --quiet, which also silences warnings).
 //
 // The old "exchange" command is now an alias for "send" (see main.go).
 // The special recipient "all" broadcasts to every registered agent.
 //
-// Usage: cm send <to> <message> [--quiet] [--agent ID] [--json]
+// --priority urgent surfaces the message ahead of normal traffic in the
+// recipient's recv and sync output.
+//
+// Bodies over --max-body bytes (CLOCKMAIL_MAX_BODY, default 8 KiB) are
+// stored as attachments; the message carries their first line and the
+// attachment ID for cm attachment get.
+//
+// --encrypt seals the body for each recipient with their registered
+// public key (see cm register --keygen); recv opens it with the private
+// key in .clockmail/keys. Sealed bodies are never offloaded.
+//
+// Recipients that are not registered, or have departed, get nothing in
+// the log: the message is kept as a dead letter (see cm dlq) and send
+// exits 2. --force sends to them anyway.
+//
+// --template NAME sends a canned message (see cm template) in place of
+// <message>, filled in from --var name=value.
+//
+// --idempotency-key K makes a retried send harmless: if the sender has
+// already sent with K, nothing is written and the first send's event IDs
+// are reported instead. "auto" derives the key from the sender,
+// recipient, priority, body and the current minute.
+//
+// --deliver-after D and --deliver-at-epoch N hold the message back: it is
+// written now, at the sender's timestamp, but the recipient's recv and
+// sync do not show it until D has passed and every other agent has moved
+// past epoch N. --when-safe holds it until the message's own --epoch and
+// --round are safe as cm gate sees them, so an agent can stage an
+// announcement tied to global progress instead of polling the gate.
+//
+// Usage: cm send [--priority urgent|normal|low] [--idempotency-key K|auto] [--deliver-after D] [--deliver-at-epoch N | --when-safe] [--quiet] [--agent ID] [--json] <to> <message>
 func (a *app) cmdSend(args []string) int {
 	flags := flag.NewFlagSet("send", flag.ContinueOnError)
 	agent := flags.String("agent", "", "sender agent ID")
 	epoch := flags.Int64("epoch", -1, "epoch context (-1 = keep current)")
 	round := flags.Int64("round", -1, "round context (-1 = keep current)")
 	quiet := flags.Bool("quiet", false, "suppress inbox output (fire-and-forget mode)")
+	priority := flags.String("priority", "normal", "message priority: urgent, normal, or low")
+	encrypt := flags.Bool("encrypt", false, "seal the body so only the recipients can read it")
+	force := flags.Bool("force", false, "send to recipients that are not registered or have departed")
+	maxBody := flags.Int("max-body", a.maxBodySize(), "store bodies larger than this many bytes as attachments (0 = never)")
+	tmplName := flags.String("template", "", "send the named message template (see cm template list)")
+	var vars stringList
+	flags.Var(&vars, "var", "template value as name=value (repeatable)")
+	idemKey := flags.String("idempotency-key", "", "send at most once per key; \"auto\" derives one from the message and the minute")
+	deliverAfter := flags.Duration("deliver-after", 0, "hold the message back from the recipient for this long")
+	deliverEpoch := flags.Int64("deliver-at-epoch", -1, "hold the message back until the frontier has passed this epoch")
+	whenSafe := flags.Bool("when-safe", false, "hold the message back until its --epoch and --round are safe (as cm gate)")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
-	if flags.NArg() < 2 {
-		fmt.Fprintln(os.Stderr, "usage: cm send <to> <message> [--quiet] [--agent ID] [--json]")
+	// Flags may also follow the recipient: cm send bob --template handoff,
+	// or a quoted message: cm send all "tests green" --when-safe --epoch 2.
+	// After the message only send's own flags count, so that an unquoted
+	// message can still contain words starting with "-".
+	var to string
+	var msgArgs []string
+	if flags.NArg() > 0 {
+		to = flags.Arg(0)
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return 1
+		}
+		msgArgs = flags.Args()
+		if len(msgArgs) > 1 && isFlagOf(flags, msgArgs[1]) {
+			if err := flags.Parse(msgArgs[1:]); err != nil {
+				return 1
+			}
+			msgArgs = append(msgArgs[:1:1], flags.Args()...)
+		}
+	}
+	if to == "" || (len(msgArgs) == 0) == (*tmplName == "") {
+		fmt.Fprintln(os.Stderr, "usage: cm send [--priority urgent|normal|low] [--idempotency-key K|auto] [--quiet] [--agent ID] [--json] <to> <message>")
+		fmt.Fprintln(os.Stderr, "       cm send <to> --template NAME [--var name=value ...]")
 		fmt.Fprintln(os.Stderr, "  Sends a message after draining your inbox (bidirectional by default).")
 		fmt.Fprintln(os.Stderr, "  Use 'all' as recipient to broadcast to every registered agent.")
 		return 1
 	}
+	body := strings.Join(msgArgs, " ")
+	if *tmplName != "" {
+		t, err := a.template(*tmplName)
+		if err == nil {
+			body, err = t.render(vars)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: send: %v\n", err)
+			return 1
+		}
+	}
 
-	agentID, err := a.resolveAgent(*agent)
+	prio, err := model.ParsePriority(*priority)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
+		fmt.Fprintf(os.Stderr, "cm: send: %v\n", err)
 		return 1
 	}
+	if *deliverAfter < 0 {
+		fmt.Fprintln(os.Stderr, "cm: send: --deliver-after must not be negative")
+		return 1
+	}
+	if *whenSafe && *deliverEpoch >= 0 {
+		fmt.Fprintln(os.Stderr, "cm: send: --when-safe and --deliver-at-epoch are exclusive")
+		return 1
+	}
+
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	key := *idemKey
+	if key == "auto" {
+		key = autoSendKey(agentID, to, prio, body, time.Now())
+	}
 
 	ep, rn := a.resolveEpochRound(agentID, *epoch, *round)
-	to := flags.Arg(0)
-	body := strings.Join(flags.Args()[1:], " ")
+	var sched *store.Schedule
+	if *deliverAfter > 0 || *deliverEpoch >= 0 || *whenSafe {
+		sched = &store.Schedule{}
+		if *deliverAfter > 0 {
+			sched.After = time.Now().Add(*deliverAfter)
+		}
+		switch {
+		case *deliverEpoch >= 0:
+			sched.Epoch, sched.Round, sched.HasEpoch = *deliverEpoch, math.MaxInt64, true
+		case *whenSafe:
+			sched.Epoch, sched.Round, sched.HasEpoch = ep, rn, true
+		}
+	}
+	var att *model.Attachment
+	if !*encrypt {
+		if body, att, err = a.offloadBody(agentID, body, *maxBody); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: send: attachment: %v\n", err)
+			return 1
+		}
+	}
 
 	c := a.getClock(agentID)
 
 	// Step 1: Drain inbox (Lamport IR2). Always drain; output depends on flags.
-	inbox := a.drainInbox(agentID, c)
+	receipt := a.readInbox(agentID, c)
+	inbox := receipt.msgs
 	if !*jsonOut {
-		if *quiet {
+		if *quiet || a.quiet {
 			// Quiet mode: inbox to stderr (old send behavior).
 			printInbox(inbox)
 		} else {
@@ -57,11 +174,11 @@ func (a *app) cmdSend(args []string) int {
 			if len(inbox) > 0 {
 				fmt.Printf("=== %d received message(s) ===\n", len(inbox))
 				for _, e := range inbox {
-					msgBody := e.Body
+					msgBody := displayBody(e)
 					if len(msgBody) > 120 {
 						msgBody = msgBody[:120] + "..."
 					}
-					fmt.Printf("  [ts=%d] %s: %s\n", e.LamportTS, e.AgentID, msgBody)
+					fmt.Printf("  [ts=%d] %s%s: %s\n", e.LamportTS, priorityTag(e), e.AgentID, msgBody)
 				}
 				fmt.Println("============================")
 				fmt.Println()
@@ -72,50 +189,194 @@ func (a *app) cmdSend(args []string) int {
 		}
 	}
 
-	// Step 2: Send (Lamport IR1).
-	ts := c.Tick()
-	_ = a.store.UpdateAgentClock(agentID, ts, ep, rn)
-
+	// Step 2: Send (Lamport IR1, applied with the writes below).
 	recipients, err := a.resolveRecipients(to, agentID)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: send: %v\n", err)
 		return 1
 	}
-	var eventIDs []int64
-	for _, r := range recipients {
-		id, err := a.store.InsertEvent(&model.Event{
-			AgentID:   agentID,
-			LamportTS: ts,
-			Epoch:     ep,
-			Round:     rn,
-			Kind:      model.EventMsg,
-			Target:    r,
-			Body:      body,
-			CreatedAt: time.Now().UTC(),
-		})
-		if err != nil {
+	// Nobody would read a message to an unknown or departed agent: park
+	// it as a dead letter instead, unless --force.
+	var deadLetters []store.DeadLetter
+	if !*force {
+		var dead []deadRecipient
+		if recipients, dead, err = a.liveRecipients(recipients); err != nil {
 			fmt.Fprintf(os.Stderr, "cm: send: %v\n", err)
 			return 1
 		}
-		eventIDs = append(eventIDs, id)
+		if *encrypt && len(dead) > 0 {
+			// A dead letter would keep the body in the clear.
+			fmt.Fprintf(os.Stderr, "cm: send: --encrypt: %s is %s; nothing sent (--force sends anyway)\n",
+				dead[0].agent, dead[0].reason)
+			return 1
+		}
+		for _, u := range dead {
+			deadLetters = append(deadLetters, store.DeadLetter{From: agentID, To: u.agent, Body: body, Priority: prio,
+				Epoch: ep, Round: rn, Reason: u.reason, CreatedAt: time.Now().UTC()})
+		}
+	}
+	var sealed map[string]string
+	if *encrypt {
+		if sealed, err = a.sealFor(recipients, body); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: send: --encrypt: %v\n", err)
+			return 1
+		}
+	}
+	// The inbox receipt, the tick, the dead letters and the messages
+	// commit together, or nothing is sent.
+	var eventIDs []int64
+	var ts int64
+	var dup *store.SendKey
+	err = a.store.WithTx(func(tx store.TxStore) error {
+		eventIDs, dup = nil, nil
+		if err := receipt.write(tx); err != nil {
+			return err
+		}
+		var err error
+		if key != "" {
+			if dup, err = tx.SendKey(agentID, key); err == nil {
+				return nil
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		if ts, err = tickIn(tx, agentID, c, ep, rn); err != nil {
+			return err
+		}
+		for i := range deadLetters {
+			deadLetters[i].LamportTS = ts
+			if _, err := tx.AddDeadLetter(&deadLetters[i]); err != nil {
+				return fmt.Errorf("dead letter: %w", err)
+			}
+		}
+		msgs := make([]*model.Event, len(recipients))
+		for i, r := range recipients {
+			msgBody := body
+			if sealed != nil {
+				msgBody = sealed[r]
+			}
+			msgs[i] = &model.Event{
+				AgentID:    agentID,
+				LamportTS:  ts,
+				Epoch:      ep,
+				Round:      rn,
+				Kind:       model.EventMsg,
+				Target:     r,
+				Body:       msgBody,
+				CreatedAt:  time.Now().UTC(),
+				Priority:   prio,
+				Provenance: a.prov,
+			}
+		}
+		if eventIDs, err = tx.InsertEvents(msgs); err != nil {
+			return err
+		}
+		if sched != nil {
+			if err := tx.ScheduleDeliveries(eventIDs, *sched); err != nil {
+				return fmt.Errorf("schedule: %w", err)
+			}
+		}
+		if key != "" {
+			return tx.RecordSendKey(&store.SendKey{AgentID: agentID, Key: key, LamportTS: ts, EventIDs: eventIDs})
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: send: %v\n", err)
+		return 1
+	}
+	if dup != nil {
+		// Already sent: report the first send. Only the receipt for the
+		// inbox shown above was written, so those messages are received
+		// as on any send; the clock does not tick for a message.
+		ts, eventIDs, deadLetters = dup.LamportTS, dup.EventIDs, nil
 	}
+	for _, d := range deadLetters {
+		fmt.Fprintf(os.Stderr, "cm: send: %s is %s; kept as dead letter %d (cm dlq redeliver %d <agent>, or send --force)\n",
+			d.To, d.Reason, d.ID, d.ID)
+	}
+	var permalinks []string
+	for _, id := range eventIDs {
+		permalinks = append(permalinks, model.Permalink(agentID, id, ts))
+	}
+	a.span.Set(trace.String("clockmail.agent", agentID), trace.Int("clockmail.lamport_ts", ts),
+		trace.Int("clockmail.recipients", int64(len(eventIDs))), trace.String("clockmail.priority", string(prio)))
 
 	if *jsonOut {
 		printJSON(map[string]interface{}{
-			"lamport_ts":  ts,
-			"event_ids":   eventIDs,
-			"recipients":  len(eventIDs),
-			"broadcast":   strings.EqualFold(strings.TrimSpace(to), "all"),
-			"inbox":       inbox,
-			"inbox_count": len(inbox),
+			"lamport_ts":      ts,
+			"event_ids":       eventIDs,
+			"permalinks":      permalinks,
+			"recipients":      len(eventIDs),
+			"broadcast":       strings.EqualFold(strings.TrimSpace(to), "all"),
+			"priority":        prio,
+			"attachment":      att,
+			"encrypted":       *encrypt,
+			"inbox":           inbox,
+			"inbox_count":     len(inbox),
+			"dead_letters":    deadLetters,
+			"idempotency_key": key,
+			"duplicate":       dup != nil,
+			"schedule":        sched,
 		})
-	} else {
+	} else if dup != nil {
+		fmt.Printf("already sent at ts=%d (idempotency key %s); not sent again\n", ts, key)
+	} else if len(recipients) > 0 {
 		recipientNames := strings.Join(recipients, ",")
 		if strings.EqualFold(strings.TrimSpace(to), "all") {
 			fmt.Printf("broadcast to %s at ts=%d (%d recipients)\n", recipientNames, ts, len(eventIDs))
 		} else {
 			fmt.Printf("sent to %s at ts=%d (%d recipients)\n", recipientNames, ts, len(eventIDs))
 		}
+		if att != nil {
+			fmt.Fprintf(os.Stderr, "(body is %d bytes; stored as attachment %s)\n", att.Size, att.ShortID())
+		}
+		if sched != nil {
+			fmt.Fprintf(os.Stderr, "(held back %s)\n", describeSchedule(*sched))
+		}
+	}
+	if len(deadLetters) > 0 {
+		return 2
 	}
 	return 0
 }
+
+// isFlagOf reports whether arg is one of fs's flags, as -name, --name or
+// --name=value.
+func isFlagOf(fs *flag.FlagSet, arg string) bool {
+	name, ok := strings.CutPrefix(arg, "-")
+	if !ok {
+		return false
+	}
+	name = strings.TrimPrefix(name, "-")
+	name, _, _ = strings.Cut(name, "=")
+	return name != "" && fs.Lookup(name) != nil
+}
+
+// describeSchedule says when a held message is delivered, as
+// "until 14:05 and the frontier passes epoch 3".
+func describeSchedule(sc store.Schedule) string {
+	var conds []string
+	if !sc.After.IsZero() {
+		conds = append(conds, "until "+sc.After.Local().Format("15:04:05"))
+	}
+	switch {
+	case sc.HasEpoch && sc.Round == math.MaxInt64:
+		conds = append(conds, fmt.Sprintf("until the frontier passes epoch %d", sc.Epoch))
+	case sc.HasEpoch:
+		conds = append(conds, fmt.Sprintf("until epoch=%d round=%d is safe", sc.Epoch, sc.Round))
+	}
+	return strings.Join(conds, " and ")
+}
+
+// autoSendKey derives an idempotency key for cm send --idempotency-key
+// auto: the same message from the same sender within the same minute
+// gets the same key.
+func autoSendKey(agentID, to string, prio model.Priority, body string, now time.Time) string {
+	h := sha256.New()
+	for _, f := range []string{agentID, to, string(prio), body, now.UTC().Truncate(time.Minute).Format(time.RFC3339)} {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	return "auto-" + hex.EncodeToString(h.Sum(nil))[:32]
+}
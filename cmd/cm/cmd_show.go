@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// cmdShow resolves an event permalink (see model.Permalink) and prints the
+// event. Permalinks survive cm gc, so an agent can follow a reference in an
+// old message even after the event it points to has been compacted.
+//
+// Usage: cm show [--json] <permalink>
+func (a *app) cmdShow(args []string) int {
+	flags := flag.NewFlagSet("show", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm show [--json] <permalink>")
+		return 1
+	}
+
+	e, err := a.store.ResolvePermalink(flags.Arg(0))
+	if errors.Is(err, sql.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "cm: show: unknown permalink %q\n", flags.Arg(0))
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: show: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(e)
+		return 0
+	}
+	fmt.Printf("event %d (%s) epoch=%d round=%d at %s\n",
+		e.ID, e.Permalink, e.Epoch, e.Round, e.CreatedAt.Format("2006-01-02 15:04:05"))
+	printEvent(*e)
+	return 0
+}
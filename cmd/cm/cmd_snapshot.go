@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotsDir is where cm snapshot keeps database copies:
+// CLOCKMAIL_SNAPSHOTS, or .clockmail/snapshots.
+func snapshotsDir() string {
+	return envOr("CLOCKMAIL_SNAPSHOTS", workspacePath("snapshots"))
+}
+
+// snapshotName is what a snapshot may be called: a file name, without
+// directories.
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// cmdSnapshot checkpoints and rolls back the whole coordination state.
+// create copies the database with SQLite's online backup API, safe while
+// agents keep writing; restore copies a snapshot back over the live
+// database, so every agent's clock, locks, messages and cursors return to
+// the checkpoint together. Agents that keep running across a restore
+// should re-sync (cm sync) before acting on what they remember.
+//
+// Usage:
+//
+//	cm snapshot create [name]       # default name: the current time
+//	cm snapshot restore <name>
+//	cm snapshot list
+func (a *app) cmdSnapshot(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm snapshot <create|restore|list> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "create":
+		return a.snapshotCreate(args[1:])
+	case "restore":
+		return a.snapshotRestore(args[1:])
+	case "list", "ls":
+		return a.snapshotList(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: snapshot: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) snapshotCreate(args []string) int {
+	flags := flag.NewFlagSet("snapshot create", flag.ContinueOnError)
+	force := flags.Bool("force", false, "replace an existing snapshot of the same name")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm snapshot create [name] [--force] [--json]")
+		return 1
+	}
+	name := time.Now().UTC().Format("20060102-150405")
+	if len(words) == 1 {
+		name = words[0]
+	}
+	path, err := snapshotPath(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: snapshot create: %v\n", err)
+		return 1
+	}
+	if _, err := os.Stat(path); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "cm: snapshot create: snapshot %q exists (--force replaces it)\n", name)
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: snapshot create: %v\n", err)
+		return 1
+	}
+	if err := a.store.Snapshot(path); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: snapshot create: %v\n", err)
+		return 1
+	}
+
+	info, _ := os.Stat(path)
+	var size int64
+	if info != nil {
+		size = info.Size()
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"name": name, "path": path, "size": size})
+	} else {
+		fmt.Printf("snapshot %s created (%d bytes)\n", name, size)
+		fmt.Fprintf(os.Stderr, "hint: cm snapshot restore %s rolls every agent back to this point\n", name)
+	}
+	return 0
+}
+
+func (a *app) snapshotRestore(args []string) int {
+	flags := flag.NewFlagSet("snapshot restore", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm snapshot restore <name> [--json]")
+		return 1
+	}
+	name := words[0]
+	path, err := snapshotPath(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: snapshot restore: %v\n", err)
+		return 1
+	}
+	if err := a.store.Restore(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("no snapshot %q in %s", name, snapshotsDir())
+		}
+		fmt.Fprintf(os.Stderr, "cm: snapshot restore: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"name": name, "path": path, "restored": true})
+	} else {
+		fmt.Printf("restored snapshot %s\n", name)
+	}
+	return 0
+}
+
+func (a *app) snapshotList(args []string) int {
+	flags := flag.NewFlagSet("snapshot list", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	entries, err := os.ReadDir(snapshotsDir())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "cm: snapshot list: %v\n", err)
+		return 1
+	}
+	type snapshotInfo struct {
+		Name      string    `json:"name"`
+		Size      int64     `json:"size"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	snaps := []snapshotInfo{}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".db")
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		snaps = append(snaps, snapshotInfo{Name: name, Size: info.Size(), CreatedAt: info.ModTime().UTC()})
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].CreatedAt.Before(snaps[j].CreatedAt) })
+
+	if *jsonOut {
+		printJSON(snaps)
+		return 0
+	}
+	if len(snaps) == 0 {
+		fmt.Println("no snapshots")
+		return 0
+	}
+	for _, s := range snaps {
+		fmt.Printf("%-24s %s  %d bytes\n", s.Name, s.CreatedAt.Local().Format("2006-01-02 15:04:05"), s.Size)
+	}
+	return 0
+}
+
+// snapshotPath returns the file for the snapshot called name.
+func snapshotPath(name string) (string, error) {
+	if !snapshotName.MatchString(name) {
+		return "", fmt.Errorf("invalid snapshot name %q (letters, digits, '.', '_' and '-')", name)
+	}
+	return filepath.Join(snapshotsDir(), name+".db"), nil
+}
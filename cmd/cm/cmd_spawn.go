@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// cmdSpawn registers a sub-agent under a parent session, for orchestrators
+// that fan work out to short-lived workers. The spawn is a local event of
+// the parent; the child starts with the parent's clock and position, so
+// its work is causally after the spawn. cm frontier --rollup and
+// cm status --rollup fold children into their parent.
+//
+// Children spawned with --ephemeral or --ttl retire themselves: the
+// parent's next heartbeat or sync runs cm bye for ephemeral children once
+// the parent has left the spawn epoch, and for children idle past their
+// TTL (cm reap honors the TTL too).
+//
+// Usage: cm spawn <child-id> [--parent ID] [--ephemeral] [--ttl N] [--capabilities go,tests] [--json]
+func (a *app) cmdSpawn(args []string) int {
+	flags := flag.NewFlagSet("spawn", flag.ContinueOnError)
+	parent := flags.String("parent", "", "parent agent ID (default: CLOCKMAIL_AGENT)")
+	capsFlag := flags.String("capabilities", "", "comma-separated capabilities for the child")
+	ephemeral := flags.Bool("ephemeral", false, "retire the child when the parent leaves the current epoch")
+	ttlSec := flags.Int("ttl", 0, "retire the child after N seconds without activity (0 = never)")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm spawn <child-id> [--parent ID] [--ephemeral] [--ttl N] [--capabilities go,tests] [--json]")
+		return 1
+	}
+	childID := flags.Arg(0)
+	// Also accept flags after the child ID, as in the usage line.
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return 1
+	}
+
+	if *ttlSec < 0 {
+		fmt.Fprintln(os.Stderr, "cm: spawn: --ttl must not be negative")
+		return 1
+	}
+	var caps []string
+	if *capsFlag != "" {
+		var err error
+		if caps, err = model.ParseCapabilities(*capsFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: spawn: %v\n", err)
+			return 1
+		}
+	}
+
+	parentID, err := a.resolveAgent(*parent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	ep, rn := a.resolveEpochRound(parentID, -1, -1)
+	ts := a.tick(parentID, ep, rn)
+	life := store.Lifecycle{Ephemeral: *ephemeral, TTL: time.Duration(*ttlSec) * time.Second}
+	child, err := a.store.SpawnAgent(childID, parentID, ts, life)
+	switch {
+	case errors.Is(err, store.ErrNotRegistered):
+		return fail(fmt.Sprintf("spawn: %v", err), *jsonOut, 1, a.unregisteredActions(parentID))
+	case errors.Is(err, store.ErrAgentActive):
+		return fail(fmt.Sprintf("spawn: %v", err), *jsonOut, 1, []nextAction{
+			{Command: "cm spawn <another-id> --parent " + parentID, Reason: childID + " is in use by a live session"},
+			{Command: "cm bye --agent " + childID, Reason: "retire it first if that session is gone"},
+		})
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "cm: spawn: %v\n", err)
+		return 1
+	}
+	if len(caps) > 0 {
+		if err := a.store.SetCapabilities(childID, caps); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: spawn: capabilities: %v\n", err)
+			return 1
+		}
+		child.Capabilities = caps
+	}
+
+	if _, err := a.insertEvent(&model.Event{
+		AgentID:   parentID,
+		LamportTS: ts,
+		Epoch:     ep,
+		Round:     rn,
+		Kind:      model.EventSpawn,
+		Target:    childID,
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		a.logger().Warn("record spawn event", "parent", parentID, "child", childID, "err", err)
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"agent": child, "parent_id": parentID, "lamport_ts": ts})
+	} else {
+		fmt.Printf("spawned %q under %q (clock=%d, epoch=%d, round=%d)\n",
+			child.ID, parentID, child.Clock, child.Epoch, child.Round)
+		if len(child.Capabilities) > 0 {
+			fmt.Printf("capabilities: %s\n", strings.Join(child.Capabilities, ","))
+		}
+		fmt.Fprintf(os.Stderr, "hint: run the child with CLOCKMAIL_AGENT=%s\n", child.ID)
+	}
+	return 0
+}
+
+// parentsOf maps each sub-agent in agents to its parent, for
+// frontier.Rollup.
+func parentsOf(agents []model.Agent) map[string]string {
+	parents := make(map[string]string)
+	for _, ag := range agents {
+		if ag.ParentID != "" {
+			parents[ag.ID] = ag.ParentID
+		}
+	}
+	return parents
+}
+
+// retireSubAgents runs cm bye for the children of parentID whose lifecycle
+// has ended now that the parent is at epoch, along with their own live
+// descendants. It returns the retired agent IDs.
+func (a *app) retireSubAgents(parentID string, epoch int64) []string {
+	// The parent departs its own sub-agents, which needs no admin.
+	a.actAs(parentID)
+	ids, err := a.store.RetirableSubAgents(parentID, epoch)
+	if err != nil || len(ids) == 0 {
+		if err != nil {
+			a.logger().Warn("retire sub-agents", "parent", parentID, "err", err)
+		}
+		return nil
+	}
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		a.logger().Warn("retire sub-agents", "parent", parentID, "err", err)
+		return nil
+	}
+	parents := parentsOf(agents)
+
+	var retired []string
+	for _, id := range ids {
+		batch := []string{id}
+		for _, ag := range agents {
+			if ag.DepartedAt == nil && ag.ID != id && isDescendant(ag.ID, id, parents) {
+				batch = append(batch, ag.ID)
+			}
+		}
+		for _, child := range batch {
+			reason := fmt.Sprintf("retired by %s at epoch %d", parentID, epoch)
+			if _, _, err := a.depart(child, reason); err != nil {
+				a.logger().Warn("retire sub-agent", "parent", parentID, "child", child, "err", err)
+				continue
+			}
+			retired = append(retired, child)
+		}
+	}
+	return retired
+}
+
+// isDescendant reports whether agentID is below ancestorID in parents.
+func isDescendant(agentID, ancestorID string, parents map[string]string) bool {
+	seen := map[string]bool{agentID: true}
+	for p := parents[agentID]; p != "" && !seen[p]; p = parents[p] {
+		if p == ancestorID {
+			return true
+		}
+		seen[p] = true
+	}
+	return false
+}
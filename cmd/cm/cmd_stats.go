@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+)
+
+// clockStats summarizes how synchronized the swarm is.
+type clockStats struct {
+	Agents   []agentDrift   `json:"agents"`
+	MinClock int64          `json:"min_clock"`
+	MaxClock int64          `json:"max_clock"`
+	Spread   int64          `json:"spread"`
+	Latency  latencyStats   `json:"latency"`
+	ByAgent  []latencyStats `json:"by_recipient,omitempty"`
+}
+
+// agentDrift is one active agent's distance from the fastest clock.
+type agentDrift struct {
+	AgentID  string `json:"agent_id"`
+	Clock    int64  `json:"clock"`
+	Behind   int64  `json:"behind"`
+	Presence string `json:"presence"`
+	Stuck    bool   `json:"stuck,omitempty"`
+}
+
+// latencyStats aggregates deliveries: wall time from send to drain, and
+// the recipient's clock skew relative to the send timestamp.
+type latencyStats struct {
+	AgentID string        `json:"agent_id,omitempty"`
+	Count   int           `json:"count"`
+	P50     time.Duration `json:"p50_ns"`
+	P90     time.Duration `json:"p90_ns"`
+	Max     time.Duration `json:"max_ns"`
+	SkewMin int64         `json:"skew_min"`
+	SkewP50 int64         `json:"skew_p50"`
+	SkewMax int64         `json:"skew_max"`
+}
+
+// cmdStats reports clock drift between agents and message latency.
+//
+// Clock spread is measured across active agents (seen in the last 10
+// minutes). An agent whose clock trails the fastest one by more than
+// --drift-warn ticks is flagged: it is still heartbeating but no longer
+// receiving, which usually means it is stuck in a loop that never syncs.
+//
+// -q limits latency to deliveries of events matching a query expression,
+// e.g. 'agent=alice' for messages alice sent or 'priority=urgent'.
+//
+// Usage:
+//
+//	cm stats                    # last hour of deliveries
+//	cm stats --since 24h --json
+//	cm stats -q 'kind=review_req
+func (a *app) cmdStats(args []string) int {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	since := flags.Duration("since", time.Hour, "measure deliveries made within this window")
+	q := flags.String("q", "", "only measure deliveries of events matching this filter expression")
+	driftWarn := flags.Int64("drift-warn", 50, "flag agents whose clock trails the maximum by more than N")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	filter, err := query.Parse(*q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: stats: %v\n", err)
+		return 1
+	}
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: stats: %v\n", err)
+		return 1
+	}
+	deliveries, err := a.store.QueryDeliveries(filter, time.Now().Add(-*since))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: stats: %v\n", err)
+		return 1
+	}
+	st := a.computeClockStats(agents, deliveries, *driftWarn)
+
+	if *jsonOut {
+		printJSON(st)
+		return 0
+	}
+
+	if len(st.Agents) == 0 {
+		fmt.Println("clocks: no active agents")
+	} else {
+		fmt.Printf("clocks (%d active): min=%d max=%d spread=%d\n",
+			len(st.Agents), st.MinClock, st.MaxClock, st.Spread)
+		for _, d := range st.Agents {
+			warn := ""
+			if d.Stuck {
+				warn = "  (!) far behind; is it calling cm sync?"
+			}
+			fmt.Printf("  %s %-20s clock=%-6d behind=%d%s\n",
+				presenceIndicator(d.Presence), d.AgentID, d.Clock, d.Behind, warn)
+		}
+	}
+
+	matching := ""
+	if filter != nil {
+		matching = " matching " + filter.String()
+	}
+	if st.Latency.Count == 0 {
+		fmt.Printf("latency: no messages%s delivered in the last %s\n", matching, *since)
+		return 0
+	}
+	fmt.Printf("latency (%d messages%s in the last %s):\n", st.Latency.Count, matching, *since)
+	printLatency("all", st.Latency)
+	for _, l := range st.ByAgent {
+		printLatency(l.AgentID, l)
+	}
+	return 0
+}
+
+func printLatency(label string, l latencyStats) {
+	fmt.Printf("  %-20s n=%-4d p50=%-8s p90=%-8s max=%-8s skew=[%d, %d, %d]\n",
+		label, l.Count, l.P50.Round(time.Millisecond), l.P90.Round(time.Millisecond),
+		l.Max.Round(time.Millisecond), l.SkewMin, l.SkewP50, l.SkewMax)
+}
+
+// computeClockStats derives drift and latency statistics. Offline agents
+// are left out of the clock spread: their clocks are frozen by design.
+func (a *app) computeClockStats(agents []model.Agent, deliveries []model.Delivery, driftWarn int64) clockStats {
+	var st clockStats
+	for _, ag := range agents {
+		presence := a.agentPresence(ag)
+		if presence == "offline" {
+			continue
+		}
+		if len(st.Agents) == 0 || ag.Clock < st.MinClock {
+			st.MinClock = ag.Clock
+		}
+		if ag.Clock > st.MaxClock {
+			st.MaxClock = ag.Clock
+		}
+		st.Agents = append(st.Agents, agentDrift{AgentID: ag.ID, Clock: ag.Clock, Presence: presence})
+	}
+	st.Spread = st.MaxClock - st.MinClock
+	for i := range st.Agents {
+		d := &st.Agents[i]
+		d.Behind = st.MaxClock - d.Clock
+		d.Stuck = d.Behind > driftWarn
+	}
+
+	st.Latency = summarizeDeliveries(deliveries)
+	byAgent := make(map[string][]model.Delivery)
+	for _, d := range deliveries {
+		byAgent[d.AgentID] = append(byAgent[d.AgentID], d)
+	}
+	ids := make([]string, 0, len(byAgent))
+	for id := range byAgent {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		l := summarizeDeliveries(byAgent[id])
+		l.AgentID = id
+		st.ByAgent = append(st.ByAgent, l)
+	}
+	return st
+}
+
+func summarizeDeliveries(ds []model.Delivery) latencyStats {
+	l := latencyStats{Count: len(ds)}
+	if len(ds) == 0 {
+		return l
+	}
+	lat := make([]time.Duration, len(ds))
+	skew := make([]int64, len(ds))
+	for i, d := range ds {
+		lat[i] = d.Latency()
+		skew[i] = d.Skew()
+	}
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	sort.Slice(skew, func(i, j int) bool { return skew[i] < skew[j] })
+	l.P50 = lat[len(lat)/2]
+	l.P90 = lat[len(lat)*9/10]
+	l.Max = lat[len(lat)-1]
+	l.SkewMin = skew[0]
+	l.SkewP50 = skew[len(skew)/2]
+	l.SkewMax = skew[len(skew)-1]
+	return l
+}
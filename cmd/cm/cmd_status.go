@@ -4,8 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/daviddao/clockmail/pkg/config"
 	"github.com/daviddao/clockmail/pkg/frontier"
 	"github.com/daviddao/clockmail/pkg/model"
 )
@@ -13,89 +17,294 @@ import (
 func (a *app) cmdStatus(args []string) int {
 	flags := flag.NewFlagSet("status", flag.ContinueOnError)
 	agent := flags.String("agent", "", "agent ID (optional, shows focused view)")
+	rollup := flags.Bool("rollup", false, "list sub-agents under their top-level parent")
+	window := flags.Duration("presence-window", 0, "count agents seen within this as present: idle rather than offline, and in the frontier (default: presence.active)")
+	watch := flags.Bool("watch", false, "redraw every --interval, highlighting changed clocks and new locks, until interrupted")
+	interval := flags.Duration("interval", 2*time.Second, "how often --watch redraws")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
+	if *watch && *jsonOut {
+		fmt.Fprintln(os.Stderr, "cm: status: --watch redraws a table; use --json without it")
+		return 1
+	}
+	if *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "cm: status: --interval must be positive")
+		return 1
+	}
 
 	// Best-effort agent resolution (status works without one).
 	agentID, _ := a.resolveAgent(*agent)
 
-	agents, err := a.store.ListAgents()
+	if *watch {
+		return a.statusWatch(agentID, *window, *rollup, *interval)
+	}
+	st, err := a.readStatus(agentID, *window, *rollup)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: status: %v\n", err)
 		return 1
 	}
-
-	locks, _ := a.store.ListLocks()
-	active, _ := a.store.GetActivePointstamps()
-	f := frontier.ComputeFrontier(active)
-
-	// Compute presence for each agent.
-	type agentInfo struct {
-		model.Agent
-		Presence string `json:"presence"`
-	}
-	agentInfos := make([]agentInfo, len(agents))
-	for i, ag := range agents {
-		agentInfos[i] = agentInfo{Agent: ag, Presence: agentPresence(ag)}
-	}
-
 	if *jsonOut {
 		result := map[string]interface{}{
-			"agents":   agentInfos,
-			"locks":    locks,
-			"frontier": f,
+			"agents":     st.infos,
+			"locks":      st.locks,
+			"wip":        st.wip,
+			"ownership":  st.owners,
+			"lock_queue": st.intents,
+			"frontier":   st.frontier,
+			"warnings":   st.warnings,
+		}
+		if a.prov.Branch != "" {
+			result["branch"] = a.prov.Branch
+			result["all_branches"] = a.allBranches
 		}
 		if agentID != "" {
-			ts := agentTimestamp(agents, agentID)
-			result["my_status"] = frontier.ComputeFrontierStatus(agentID, ts, active)
+			ts := agentTimestamp(st.agents, agentID)
+			result["my_status"] = frontier.ComputeFrontierStatus(agentID, ts, st.active)
 		}
 		printJSON(result)
-	} else {
-		fmt.Println("agents:")
-		for _, ai := range agentInfos {
-			marker := ""
-			if ai.ID == agentID {
-				marker = " <-- you"
+		return 0
+	}
+	a.printStatus(st, nil, false)
+	return 0
+}
+
+// statusAgent is an agent as cm status lists it.
+type statusAgent struct {
+	model.Agent
+	Presence  string   `json:"presence"`
+	SubAgents []string `json:"sub_agents,omitempty"`
+}
+
+// statusView is what cm status shows, read at one moment.
+type statusView struct {
+	agentID  string // the agent viewing, or ""
+	rollup   bool
+	agents   []model.Agent
+	infos    []statusAgent
+	locks    []model.Lock
+	wip      []model.WIP
+	owners   []model.Ownership
+	intents  []model.LockIntent
+	active   []model.Pointstamp
+	frontier []model.Pointstamp
+	warnings []statusWarning
+}
+
+// readStatus reads the agents, locks and frontier cm status shows.
+func (a *app) readStatus(agentID string, window time.Duration, rollup bool) (*statusView, error) {
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		return nil, err
+	}
+	st := &statusView{agentID: agentID, rollup: rollup, agents: agents}
+	st.locks, _ = a.store.ListLocks()
+	st.wip, _ = a.store.ListWIP()
+	st.owners, _ = a.store.ListOwnership()
+	st.intents, _ = a.store.ListLockIntents()
+	st.active, _ = a.store.GetActivePointstamps(window)
+	st.frontier = frontier.ComputeFrontier(st.active)
+	lastEvent, _ := a.store.LastEventAt()
+	unread, _ := a.store.CountUnread()
+	st.warnings = a.healthWarnings(st, lastEvent, unread, time.Now())
+	parents := parentsOf(agents)
+
+	// Compute presence for each agent.
+	st.infos = make([]statusAgent, 0, len(agents))
+	if rollup {
+		// Top-level agents only, each listing its live descendants.
+		st.frontier = frontier.Rollup(st.frontier, parents)
+		subs := make(map[string][]string)
+		for _, ag := range agents {
+			if root := frontier.Root(ag.ID, parents); root != ag.ID && ag.DepartedAt == nil {
+				subs[root] = append(subs[root], ag.ID)
 			}
-			presence := presenceIndicator(ai.Presence)
-			fmt.Printf("  %s %-20s clock=%-4d epoch=%-3d round=%-3d last_seen=%s%s\n",
-				presence, ai.ID, ai.Clock, ai.Epoch, ai.Round,
-				ai.LastSeen.Format("15:04:05"), marker)
 		}
-
-		if len(locks) > 0 {
-			fmt.Println("locks:")
-			for _, l := range locks {
-				fmt.Printf("  %-30s held by %-15s ts=%-4d expires=%s\n",
-					l.Path, l.AgentID, l.LamportTS, l.ExpiresAt.Format("15:04:05"))
+		for _, ag := range agents {
+			if frontier.Root(ag.ID, parents) == ag.ID {
+				st.infos = append(st.infos, statusAgent{
+					Agent: ag, Presence: a.agentPresenceWithin(ag, window), SubAgents: subs[ag.ID],
+				})
 			}
+		}
+	} else {
+		for _, ag := range agents {
+			st.infos = append(st.infos, statusAgent{Agent: ag, Presence: a.agentPresenceWithin(ag, window)})
+		}
+	}
+	return st, nil
+}
+
+// printStatus prints st as cm status does. With prev, the view before it,
+// agents whose clock moved and locks taken since are marked "*" (and, if
+// bold, shown in bold).
+func (a *app) printStatus(st, prev *statusView, bold bool) {
+	agentID := st.agentID
+	// mark returns the indent of a line, "* " if it changed, and wraps
+	// the line in bold then.
+	mark := func(changed bool, line string) string {
+		if !changed {
+			return "  " + line
+		}
+		if bold {
+			return "\x1b[1m* " + line + "\x1b[0m"
+		}
+		return "* " + line
+	}
+	var clocks map[string]int64
+	var held map[[2]string]bool
+	if prev != nil {
+		clocks = make(map[string]int64, len(prev.infos))
+		for _, ai := range prev.infos {
+			clocks[ai.ID] = ai.Clock
+		}
+		held = make(map[[2]string]bool, len(prev.locks))
+		for _, l := range prev.locks {
+			held[[2]string{l.Path, l.AgentID}] = true
+		}
+	}
+
+	if a.prov.Branch != "" {
+		if a.allBranches {
+			fmt.Printf("branch: %s (showing all branches)\n", a.prov.Branch)
 		} else {
-			fmt.Println("locks: none")
+			fmt.Printf("branch: %s\n", a.prov.Branch)
+		}
+	}
+	fmt.Println("agents:")
+	hidden := 0
+	for _, ai := range st.infos {
+		// Retired sub-agents pile up quickly; only count them.
+		if ai.ParentID != "" && ai.DepartedAt != nil {
+			hidden++
+			continue
+		}
+		marker := ""
+		if ai.ID == agentID {
+			marker = " <-- you"
+		}
+		if len(ai.Capabilities) > 0 {
+			marker = " [" + strings.Join(ai.Capabilities, ",") + "]" + marker
+		}
+		if len(ai.Roles) > 0 {
+			marker = " role:" + strings.Join(ai.Roles, ",") + marker
+		}
+		if ai.ParentID != "" && !st.rollup {
+			marker = " (sub-agent of " + ai.ParentID + ")" + marker
+		}
+		if len(ai.SubAgents) > 0 {
+			marker = fmt.Sprintf(" +%d sub-agents (%s)", len(ai.SubAgents), strings.Join(ai.SubAgents, ",")) + marker
 		}
+		clock, seen := clocks[ai.ID]
+		changed := prev != nil && (!seen || clock != ai.Clock)
+		fmt.Println(mark(changed, fmt.Sprintf("%s %-20s clock=%-4d epoch=%-3d round=%-3d last_seen=%s%s",
+			presenceIndicator(ai.Presence), ai.ID, ai.Clock, ai.Epoch, ai.Round,
+			ai.LastSeen.Format("15:04:05"), marker)))
+	}
+	if hidden > 0 {
+		fmt.Printf("  (%d retired sub-agents not shown)\n", hidden)
+	}
 
-		if len(f) > 0 {
-			fmt.Println("frontier:")
-			for _, p := range f {
-				fmt.Printf("  %s @ epoch=%d round=%d\n",
-					p.AgentID, p.Timestamp.Epoch, p.Timestamp.Round)
+	if len(st.wip) > 0 {
+		fmt.Println("work in progress:")
+		printWIP(st.wip, agentID)
+	}
+
+	if len(st.owners) > 0 {
+		fmt.Println("ownership:")
+		for _, o := range st.owners {
+			fmt.Println(ownershipLine(o, agentID))
+		}
+	}
+
+	if len(st.locks) > 0 {
+		fmt.Println("locks:")
+		for _, l := range st.locks {
+			where := ""
+			if l.Branch != "" && l.Branch != a.prov.Branch {
+				where = " on " + l.Branch
 			}
+			changed := prev != nil && !held[[2]string{l.Path, l.AgentID}]
+			fmt.Println(mark(changed, fmt.Sprintf("%-30s held by %-15s ts=%-4d expires=%s%s",
+				l.Path, l.AgentID, l.LamportTS, l.ExpiresAt.Format("15:04:05"), where)))
 		}
+	} else {
+		fmt.Println("locks: none")
+	}
 
-		if agentID != "" {
-			ts := agentTimestamp(agents, agentID)
-			fStatus := frontier.ComputeFrontierStatus(agentID, ts, active)
-			if fStatus.SafeToFinalize {
-				fmt.Printf("you (%s): SAFE to finalize epoch=%d round=%d\n",
-					agentID, ts.Epoch, ts.Round)
-			} else {
-				fmt.Printf("you (%s): NOT SAFE to finalize epoch=%d round=%d\n",
-					agentID, ts.Epoch, ts.Round)
+	if len(st.intents) > 0 {
+		fmt.Println("lock queue:")
+		printLockQueue(st.locks, st.intents)
+	}
+
+	if len(st.frontier) > 0 {
+		fmt.Println("frontier:")
+		for _, p := range st.frontier {
+			fmt.Printf("  %s @ epoch=%d round=%d\n",
+				p.Who(), p.Timestamp.Epoch, p.Timestamp.Round)
+		}
+	}
+
+	if len(st.warnings) > 0 {
+		fmt.Println("warnings:")
+		for _, w := range st.warnings {
+			fmt.Printf("  ! %s\n", w.Message)
+		}
+	}
+
+	if agentID != "" {
+		ts := agentTimestamp(st.agents, agentID)
+		fStatus := frontier.ComputeFrontierStatus(agentID, ts, st.active)
+		if fStatus.SafeToFinalize {
+			fmt.Printf("you (%s): SAFE to finalize epoch=%d round=%d\n",
+				agentID, ts.Epoch, ts.Round)
+		} else {
+			fmt.Printf("you (%s): NOT SAFE to finalize epoch=%d round=%d\n",
+				agentID, ts.Epoch, ts.Round)
+		}
+	}
+}
+
+// statusWatch implements cm status --watch: it redraws the status every
+// interval until interrupted, marking what changed since the previous
+// draw. On a terminal each draw replaces the last; piped, draws follow
+// one another.
+func (a *app) statusWatch(agentID string, window time.Duration, rollup bool, interval time.Duration) int {
+	tty := isTerminal(os.Stdout)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev *statusView
+	for {
+		st, err := a.readStatus(agentID, window, rollup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: status: %v\n", err)
+		} else {
+			if tty {
+				fmt.Print("\x1b[H\x1b[2J") // cursor home, clear screen
+			} else if prev != nil {
+				fmt.Println()
 			}
+			fmt.Printf("every %s: %s  (ctrl-c to stop)\n", interval, time.Now().Format("15:04:05"))
+			a.printStatus(st, prev, tty)
+			prev = st
+		}
+		select {
+		case <-sig:
+			return 0
+		case <-ticker.C:
 		}
 	}
-	return 0
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
 
 func agentTimestamp(agents []model.Agent, id string) model.Timestamp {
@@ -107,20 +316,37 @@ func agentTimestamp(agents []model.Agent, id string) model.Timestamp {
 	return model.Timestamp{}
 }
 
-// agentPresence returns a presence string based on last_seen time.
-//   - "online"  — seen within 2 minutes
-//   - "idle"    — seen within 10 minutes
-//   - "offline" — not seen for 10+ minutes
-func agentPresence(ag model.Agent) string {
-	since := time.Since(ag.LastSeen)
-	switch {
-	case since < 2*time.Minute:
-		return "online"
-	case since < 10*time.Minute:
-		return "idle"
-	default:
-		return "offline"
+// agentPresence returns a presence string based on last_seen time, with
+// the presence.online and presence.idle thresholds (see
+// model.Agent.Presence).
+func (a *app) agentPresence(ag model.Agent) string {
+	return a.agentPresenceWithin(ag, 0)
+}
+
+// agentPresenceWithin is agentPresence with agents seen within window
+// idle rather than offline, however low presence.idle is.
+func (a *app) agentPresenceWithin(ag model.Agent, window time.Duration) string {
+	return ag.PresenceWithin(time.Now(), a.presence("online"), max(a.presence("idle"), window))
+}
+
+// presence returns the presence.<name> threshold (online, idle or active).
+func (a *app) presence(name string) time.Duration { return presenceSetting(a.cfg, name) }
+
+// presenceSetting returns the presence.<name> threshold:
+// CLOCKMAIL_PRESENCE_<NAME> if set, otherwise the config file's.
+func presenceSetting(cfg *config.Config, name string) time.Duration {
+	def := cfg.Duration("presence." + name)
+	env := "CLOCKMAIL_PRESENCE_" + strings.ToUpper(name)
+	v := os.Getenv(env)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		fmt.Fprintf(os.Stderr, "cm: ignoring %s=%q: want a duration such as 30m\n", env, v)
+		return def
 	}
+	return d
 }
 
 // presenceIndicator returns a short text indicator for display.
@@ -130,6 +356,8 @@ func presenceIndicator(presence string) string {
 		return "[+]"
 	case "idle":
 		return "[~]"
+	case "departed":
+		return "[x]"
 	default:
 		return "[-]"
 	}
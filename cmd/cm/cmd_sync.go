@@ -4,17 +4,27 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/frontier"
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
 )
 
+// cmdSync is heartbeat + recv + frontier in one step. With --auto-advance
+// the agent needs no epoch bookkeeping: it syncs at its stored position
+// (unless --epoch/--round say otherwise) and, once the frontier shows
+// that position is safe, moves on to the next open epoch (see cm epoch;
+// epoch+1 if none are declared) with a second progress event.
 func (a *app) cmdSync(args []string) int {
 	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
 	agent := flags.String("agent", "", "agent ID")
 	epoch := flags.Int64("epoch", 0, "current working epoch")
 	round := flags.Int64("round", 0, "current working round")
+	renewLocks := flags.Bool("renew-locks", false, "also extend every lock you hold by --lock-ttl")
+	lockTTL := flags.Int("lock-ttl", a.lockTTLSeconds(), "lock TTL in seconds for --renew-locks")
+	autoAdvance := flags.Bool("auto-advance", false, "move to the next open epoch once the current one is safe")
 	jsonOut := flags.Bool("json", false, "JSON output")
 	if err := flags.Parse(args); err != nil {
 		return 1
@@ -22,53 +32,71 @@ func (a *app) cmdSync(args []string) int {
 
 	agentID, err := a.resolveAgent(*agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
-		return 1
+		return failNoAgent(err, *jsonOut)
+	}
+	if *autoAdvance {
+		set := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		flagEpoch, flagRound := int64(-1), int64(-1)
+		if set["epoch"] {
+			flagEpoch = *epoch
+		}
+		if set["round"] {
+			flagRound = *round
+		}
+		*epoch, *round = a.resolveEpochRound(agentID, flagEpoch, flagRound)
 	}
 
-	// 1. Heartbeat: tick clock, update position.
-	c := a.getClock(agentID)
-	ts := c.Tick()
-	_ = a.store.UpdateAgentClock(agentID, ts, *epoch, *round)
-	if _, err := a.store.InsertEvent(&model.Event{
-		AgentID:   agentID,
-		LamportTS: ts,
-		Epoch:     *epoch,
-		Round:     *round,
-		Kind:      model.EventProgress,
-		CreatedAt: time.Now().UTC(),
-	}); err != nil {
-		fmt.Fprintf(os.Stderr, "cm: sync: event: %v\n", err)
+	if !a.checkWorkflow("sync", agentID, *epoch, *jsonOut) {
+		return 2
 	}
 
-	// 2. Recv: fetch new messages, apply IR2.
-	since := a.store.GetCursor(agentID)
-	messages, err := a.store.ListEventsForAgent(agentID, since, 100)
+	// 1-2. Heartbeat and recv (IR1, then IR2 for each message), committed
+	// atomically with the cursor so a crash cannot lose messages.
+	res, err := a.store.SyncAtomic(agentID, *epoch, *round, 100, a.prov)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: sync: recv: %v\n", err)
+		fmt.Fprintf(os.Stderr, "cm: sync: %v\n", err)
 		return 1
 	}
-	var maxMsgTS int64
-	for _, e := range messages {
-		c.Receive(e.LamportTS)
-		if e.LamportTS > maxMsgTS {
-			maxMsgTS = e.LamportTS
-		}
-	}
-	newTS := c.Value()
-	_ = a.store.UpdateAgentClock(agentID, newTS, *epoch, *round)
-	if maxMsgTS > 0 {
-		_ = a.store.SetCursor(agentID, maxMsgTS+1)
-	}
+	messages, newTS := res.Messages, res.Clock
+	openSealed(agentID, messages)
+	sortByPriority(messages)
 
 	// 3. Frontier: check safety.
 	nts := model.Timestamp{Epoch: *epoch, Round: *round}
-	active, _ := a.store.GetActivePointstamps()
+	active, _ := a.store.GetActivePointstamps(0)
 	fStatus := frontier.ComputeFrontierStatus(agentID, nts, active)
 
-	// 4. Locks: show what this agent holds.
+	// With --auto-advance, leave a safe epoch for the next open one.
+	var advancedFrom *int64
+	if *autoAdvance && fStatus.SafeToFinalize && res.Registered {
+		next, ok, err := a.nextOpenEpoch(*epoch)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: sync: %v\n", err)
+		} else if !ok {
+			fmt.Fprintf(os.Stderr, "cm: sync: epoch %d is safe but no later epoch is open (cm epoch open %d)\n", *epoch, *epoch+1)
+		} else if a.checkWorkflow("sync", agentID, next, false) {
+			ts, err := a.advanceEpoch(agentID, next)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cm: sync: advance to epoch %d: %v\n", next, err)
+			} else {
+				from := *epoch
+				advancedFrom = &from
+				*epoch, *round, newTS = next, 0, ts
+			}
+		}
+	}
+	a.recordFrontier()
+	retired := a.retireSubAgents(agentID, *epoch)
+
+	// 4. Locks: renew them if asked, then show what this agent holds.
+	if *renewLocks {
+		a.renewLocks(agentID, time.Duration(*lockTTL)*time.Second)
+	}
 	locks, _ := a.store.ListLocksForAgent(agentID)
 
+	actions := a.unregisteredActions(agentID)
+
 	if *jsonOut {
 		printJSON(map[string]interface{}{
 			"agent_id":         agentID,
@@ -80,17 +108,20 @@ func (a *app) cmdSync(args []string) int {
 			"frontier":         fStatus,
 			"safe_to_finalize": fStatus.SafeToFinalize,
 			"locks":            locks,
+			"retired":          retired,
+			"advanced_from":    advancedFrom,
+			"next_actions":     actions,
 		})
 	} else {
 		// Messages FIRST — the most important output for agent coordination.
 		if len(messages) > 0 {
 			fmt.Printf("\n=== %d new message(s) ===\n", len(messages))
 			for _, e := range messages {
-				body := e.Body
+				body := displayBody(e)
 				if len(body) > 120 {
 					body = body[:120] + "..."
 				}
-				fmt.Printf("  [ts=%d] %s: %s\n", e.LamportTS, e.AgentID, body)
+				fmt.Printf("  [ts=%d] %s%s: %s\n", e.LamportTS, priorityTag(e), e.AgentID, body)
 			}
 			fmt.Println("========================")
 			fmt.Println()
@@ -98,16 +129,21 @@ func (a *app) cmdSync(args []string) int {
 
 		fmt.Printf("sync %s ts=%d epoch=%d round=%d\n", agentID, newTS, *epoch, *round)
 
-		if fStatus.SafeToFinalize {
+		if advancedFrom != nil {
+			fmt.Printf("  frontier: epoch=%d is safe; advanced to epoch=%d\n", *advancedFrom, *epoch)
+		} else if fStatus.SafeToFinalize {
 			fmt.Printf("  frontier: SAFE to finalize epoch=%d round=%d\n", *epoch, *round)
 		} else {
 			fmt.Printf("  frontier: NOT SAFE to finalize epoch=%d round=%d\n", *epoch, *round)
 			for _, b := range fStatus.BlockedBy {
 				fmt.Printf("    blocked by %s at epoch=%d round=%d\n",
-					b.AgentID, b.Timestamp.Epoch, b.Timestamp.Round)
+					b.Who(), b.Timestamp.Epoch, b.Timestamp.Round)
 			}
 		}
 
+		if len(retired) > 0 {
+			fmt.Printf("  retired sub-agents: %s\n", strings.Join(retired, ", "))
+		}
 		if len(locks) > 0 {
 			fmt.Printf("  %d active locks:\n", len(locks))
 			for _, l := range locks {
@@ -115,6 +151,49 @@ func (a *app) cmdSync(args []string) int {
 					l.Path, l.LamportTS, l.ExpiresAt.Format(time.RFC3339))
 			}
 		}
+		printHints(actions)
 	}
 	return 0
 }
+
+// nextOpenEpoch returns the lowest open declared epoch after epoch, or
+// epoch+1 if no epochs have been declared at all. ok is false if epochs
+// are declared but none after epoch is open.
+func (a *app) nextOpenEpoch(epoch int64) (next int64, ok bool, err error) {
+	all, err := a.store.ListEpochs(false)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(all) == 0 {
+		return epoch + 1, true, nil
+	}
+	for _, e := range all { // ordered by epoch
+		if e.Epoch > epoch && e.Status == model.EpochOpen {
+			return e.Epoch, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// advanceEpoch moves agentID to round 0 of epoch with a progress event
+// (IR1), returning its timestamp.
+func (a *app) advanceEpoch(agentID string, epoch int64) (int64, error) {
+	c := a.getClock(agentID)
+	var ts int64
+	err := a.store.WithTx(func(tx store.TxStore) error {
+		var err error
+		if ts, err = tickIn(tx, agentID, c, epoch, 0); err != nil {
+			return err
+		}
+		_, err = tx.InsertEvent(&model.Event{
+			AgentID:    agentID,
+			LamportTS:  ts,
+			Epoch:      epoch,
+			Kind:       model.EventProgress,
+			CreatedAt:  time.Now().UTC(),
+			Provenance: a.prov,
+		})
+		return err
+	})
+	return ts, err
+}
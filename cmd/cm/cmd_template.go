@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// builtinTemplates are the canned protocol messages. Each starts with its
+// kind in brackets and puts every further field on a "name: value" line,
+// so a receiving agent can tell them apart and pick them apart without
+// guessing. The [templates] table of the config file may add more or
+// replace these.
+var builtinTemplates = map[string]string{
+	"handoff": "[handoff] {file}\nnext: {next}",
+	"status":  "[status] {state}\ndetail: {detail}",
+	"blocker": "[blocker] {on}\nneed: {need}",
+}
+
+// templatePlaceholder matches a {name} placeholder.
+var templatePlaceholder = regexp.MustCompile(`\{([a-z][a-z0-9_]*)\}`)
+
+// messageTemplate is a template as cm template list and show report it.
+type messageTemplate struct {
+	Name   string   `json:"name"`
+	Text   string   `json:"text"`
+	Vars   []string `json:"vars"`
+	Source string   `json:"source"` // "builtin" or "config"
+}
+
+// templates returns every template, built-in or from the config file,
+// sorted by name.
+func (a *app) templates() []messageTemplate {
+	byName := map[string]messageTemplate{}
+	for name, text := range builtinTemplates {
+		byName[name] = messageTemplate{Name: name, Text: text, Source: "builtin"}
+	}
+	for name, text := range a.cfg.Templates() {
+		byName[name] = messageTemplate{Name: name, Text: text, Source: "config"}
+	}
+	out := make([]messageTemplate, 0, len(byName))
+	for _, t := range byName {
+		t.Vars = templateVars(t.Text)
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// template returns the template called name.
+func (a *app) template(name string) (messageTemplate, error) {
+	var names []string
+	for _, t := range a.templates() {
+		if t.Name == name {
+			return t, nil
+		}
+		names = append(names, t.Name)
+	}
+	return messageTemplate{}, fmt.Errorf("no template %q (have %s)", name, strings.Join(names, ", "))
+}
+
+// templateVars returns the placeholders in text, in order of first use.
+func templateVars(text string) []string {
+	vars := []string{}
+	seen := map[string]bool{}
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(text, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			vars = append(vars, m[1])
+		}
+	}
+	return vars
+}
+
+// render fills in t's placeholders from assignments of the form
+// name=value. Every placeholder must be given and nothing else may be,
+// so that messages from one template always have the same fields.
+func (t messageTemplate) render(assignments []string) (string, error) {
+	values := map[string]string{}
+	for _, as := range assignments {
+		name, value, ok := strings.Cut(as, "=")
+		if !ok || name == "" {
+			return "", fmt.Errorf("--var %q: want name=value", as)
+		}
+		values[name] = value
+	}
+	var missing []string
+	for _, v := range t.Vars {
+		if _, ok := values[v]; !ok {
+			missing = append(missing, "--var "+v+"=...")
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("template %s needs %s", t.Name, strings.Join(missing, " "))
+	}
+	for name := range values {
+		if !slices.Contains(t.Vars, name) {
+			return "", fmt.Errorf("template %s has no {%s} (it takes %s)", t.Name, name, strings.Join(t.Vars, ", "))
+		}
+	}
+	return templatePlaceholder.ReplaceAllStringFunc(t.Text, func(m string) string {
+		return values[m[1:len(m)-1]]
+	}), nil
+}
+
+// cmdTemplate shows the message templates cm send --template fills in:
+// the built-in handoff, status and blocker messages, and any defined in
+// the [templates] table of the config file.
+//
+// Usage:
+//
+//	cm template list [--json]
+//	cm template show <name> [--json]
+func (a *app) cmdTemplate(args []string) int {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		return a.templateList(args)
+	}
+	switch args[0] {
+	case "list", "ls":
+		return a.templateList(args[1:])
+	case "show":
+		return a.templateShow(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: template: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) templateList(args []string) int {
+	flags := flag.NewFlagSet("template list", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	templates := a.templates()
+	if *jsonOut {
+		printJSON(templates)
+		return 0
+	}
+	for _, t := range templates {
+		first, _, _ := strings.Cut(t.Text, "\n")
+		fmt.Printf("%-12s %-8s %-24s %s\n", t.Name, t.Source, strings.Join(t.Vars, ","), first)
+	}
+	return 0
+}
+
+func (a *app) templateShow(args []string) int {
+	flags := flag.NewFlagSet("template show", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	rest := flags.Args()
+	if len(rest) > 0 {
+		if err := flags.Parse(rest[1:]); err != nil {
+			return 1
+		}
+	}
+	if len(rest) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: cm template show <name> [--json]")
+		return 1
+	}
+	t, err := a.template(rest[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: template: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(t)
+		return 0
+	}
+	fmt.Printf("# %s (%s); vars: %s\n", t.Name, t.Source, strings.Join(t.Vars, ", "))
+	fmt.Println(t.Text)
+	return 0
+}
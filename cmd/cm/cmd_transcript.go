@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/clock"
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+)
+
+// cmdTranscript reconstructs the messages exchanged between two agents,
+// in both directions, in Lamport total order, for post-mortems of runs
+// that went wrong. With "all" as the second agent it covers everything
+// the first one sent or received. Sealed messages are opened for any
+// recipient whose private key is on this machine.
+//
+// Usage: cm transcript <agentA> <agentB|all> [--epoch N] [--json]
+func (a *app) cmdTranscript(args []string) int {
+	flags := flag.NewFlagSet("transcript", flag.ContinueOnError)
+	epoch := flags.Int64("epoch", -1, "only messages sent in this epoch (-1 = all)")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	// Flags may follow the agents.
+	var names []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return 1
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		names = append(names, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(names) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: cm transcript <agentA> <agentB|all> [--epoch N] [--json]")
+		return 1
+	}
+	agentA, agentB := names[0], names[1]
+	all := strings.EqualFold(agentB, "all")
+
+	qa, qb := strconv.Quote(agentA), strconv.Quote(agentB)
+	src := fmt.Sprintf("kind=msg and ((agent=%s and target=%s) or (agent=%s and target=%s))", qa, qb, qb, qa)
+	if all {
+		src = fmt.Sprintf("kind=msg and (agent=%s or target=%s)", qa, qa)
+	}
+	if *epoch >= 0 {
+		src += fmt.Sprintf(" and epoch=%d", *epoch)
+	}
+	lf := logFilter{src: src}
+	var err error
+	if lf.query, err = query.Parse(src); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: transcript: %v\n", err)
+		return 1
+	}
+	msgs, err := a.readLog(lf, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: transcript: %v\n", err)
+		return 1
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return clock.TotalOrderLess(msgs[i].LamportTS, msgs[i].AgentID, msgs[j].LamportTS, msgs[j].AgentID)
+	})
+	openSealed(agentA, msgs)
+	if !all {
+		openSealed(agentB, msgs)
+	}
+
+	if *jsonOut {
+		out := map[string]interface{}{
+			"agents":   []string{agentA, agentB},
+			"messages": msgs,
+			"count":    len(msgs),
+		}
+		if *epoch >= 0 {
+			out["epoch"] = *epoch
+		}
+		printJSON(out)
+		return 0
+	}
+
+	between := agentA + " and " + agentB
+	if all {
+		between = agentA + " and everyone"
+	}
+	if len(msgs) == 0 {
+		fmt.Printf("no messages between %s\n", between)
+		return 0
+	}
+	fmt.Printf("# Transcript: %s\n\n", between)
+	summary := fmt.Sprintf("%d message(s), Lamport ts %d to %d", len(msgs), msgs[0].LamportTS, msgs[len(msgs)-1].LamportTS)
+	if *epoch >= 0 {
+		summary += fmt.Sprintf(", epoch %d", *epoch)
+	}
+	fmt.Println(summary + ".")
+	for _, m := range msgs {
+		meta := []string{fmt.Sprintf("epoch %d", m.Epoch), m.CreatedAt.UTC().Format(time.RFC3339)}
+		if m.Priority != "" && m.Priority != model.PriorityNormal {
+			meta = append(meta, string(m.Priority))
+		}
+		fmt.Printf("\n### [ts=%d] %s → %s\n\n_%s_\n\n", m.LamportTS, m.AgentID, m.Target, strings.Join(meta, " · "))
+		for _, line := range strings.Split(strings.TrimRight(m.Body, "\n"), "\n") {
+			fmt.Println(strings.TrimRight("> "+line, " "))
+		}
+	}
+	return 0
+}
@@ -7,49 +7,212 @@ import (
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
 )
 
+// cmdUnlock releases locks: one path, or with --all every lock the agent
+// holds. --force --as-admin is the operator's override for a holder that
+// crashed mid-edit: it evicts whoever holds the path, records a
+// forced_release event naming both parties, and sends each evicted holder
+// an urgent message saying so. Once any agent holds the admin role, only
+// an admin may force.
+//
+// Usage:
+//
+//	cm unlock <path> [--agent ID] [--json]
+//	cm unlock --all [--agent ID] [--json]
+//	cm unlock <path> --force --as-admin [--agent ID] [--json]
 func (a *app) cmdUnlock(args []string) int {
+	const usage = "usage: cm unlock <path>|--all [--agent ID] [--force --as-admin] [--json]"
 	flags := flag.NewFlagSet("unlock", flag.ContinueOnError)
 	agent := flags.String("agent", "", "agent releasing the lock")
+	all := flags.Bool("all", false, "release every lock the agent holds")
+	force := flags.Bool("force", false, "release the lock whoever holds it (needs --as-admin)")
+	asAdmin := flags.Bool("as-admin", false, "act as an operator, for --force")
 	jsonOut := flags.Bool("json", false, "JSON output")
-	if err := flags.Parse(args); err != nil {
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
 		return 1
 	}
-	if flags.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "usage: cm unlock <path> [--agent ID] [--json]")
+	if *all == (len(words) == 1) || len(words) > 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	if *force && !*asAdmin {
+		fmt.Fprintln(os.Stderr, "cm: unlock: --force evicts another agent's lock; confirm with --as-admin")
+		return 1
+	}
+	if *force && *all {
+		fmt.Fprintln(os.Stderr, "cm: unlock: --force takes one path, not --all")
 		return 1
 	}
 
 	agentID, err := a.resolveAgent(*agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "cm: %v\n", err)
+		return failNoAgent(err, *jsonOut)
+	}
+
+	if *all {
+		return a.unlockAll(agentID, *jsonOut)
+	}
+	path := a.lockPath(words[0])
+	if *force {
+		a.actAs(agentID)
+		return a.unlockForce(path, agentID, *jsonOut)
+	}
+	ts, err := a.unlock(path, agentID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: unlock: %v\n", err)
 		return 1
 	}
 
-	path := flags.Arg(0)
-	c := a.getClock(agentID)
-	ts := c.Tick()
+	if *jsonOut {
+		printJSON(map[string]interface{}{"released": true, "path": path, "lamport_ts": ts})
+	} else {
+		fmt.Printf("unlocked %s (ts=%d)\n", path, ts)
+	}
+	return 0
+}
+
+// unlock releases agentID's lock on path, logging a lock_rel event, and
+// takes the agent out of the path's lock queue.
+func (a *app) unlock(path, agentID string) (int64, error) {
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	ts := a.tick(agentID, ep, rn)
 
-	if _, err := a.store.InsertEvent(&model.Event{
+	if _, err := a.insertEvent(&model.Event{
 		AgentID:   agentID,
 		LamportTS: ts,
+		Epoch:     ep,
 		Kind:      model.EventLockRel,
 		Target:    path,
 		CreatedAt: time.Now().UTC(),
 	}); err != nil {
-		fmt.Fprintf(os.Stderr, "cm: unlock: event: %v\n", err)
+		a.logger().Warn("record unlock event", "path", path, "err", err)
 	}
 
 	if err := a.store.ReleaseLock(path, agentID); err != nil {
+		return 0, err
+	}
+	// Unlocking a path you are only queued for leaves the queue.
+	if _, err := a.store.DropLockIntent(path, agentID); err != nil {
+		return 0, err
+	}
+	return ts, nil
+}
+
+// unlockAll implements cm unlock --all.
+func (a *app) unlockAll(agentID string, jsonOut bool) int {
+	held, err := a.store.ListLocksForAgent(agentID)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "cm: unlock: %v\n", err)
 		return 1
 	}
+	released := []string{}
+	var ts int64
+	for _, l := range held {
+		if ts, err = a.unlock(l.Path, agentID); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: unlock: %s: %v\n", l.Path, err)
+			return 1
+		}
+		released = append(released, l.Path)
+		if !jsonOut {
+			fmt.Printf("unlocked %s (ts=%d)\n", l.Path, ts)
+		}
+	}
 
-	if *jsonOut {
-		printJSON(map[string]interface{}{"released": true, "path": path, "lamport_ts": ts})
-	} else {
-		fmt.Printf("unlocked %s (ts=%d)\n", path, ts)
+	if jsonOut {
+		printJSON(map[string]interface{}{"released": released, "count": len(released), "lamport_ts": ts})
+	} else if len(released) == 0 {
+		fmt.Printf("%s holds no locks\n", agentID)
+	}
+	return 0
+}
+
+// unlockForce implements cm unlock --force: agentID, the operator,
+// evicts every holder of path. The release, the forced_release events
+// recording it and the messages telling each holder commit together, so
+// a holder is never evicted without a trace.
+func (a *app) unlockForce(path, agentID string, jsonOut bool) int {
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	c := a.getClock(agentID)
+
+	var released []model.Lock
+	var stamps []int64
+	err := a.store.WithTx(func(tx store.TxStore) error {
+		var err error
+		if released, err = tx.ForceReleaseLock(path); err != nil {
+			return err
+		}
+		if len(released) == 0 {
+			return fmt.Errorf("nobody holds %s", path)
+		}
+		stamps = stamps[:0]
+		// An unregistered operator ticks a copy of its local clock, so a
+		// retried transaction hands out the same timestamps again.
+		cc := *c
+		now := time.Now().UTC()
+		for _, l := range released {
+			ts, err := tickIn(tx, agentID, &cc, ep, rn)
+			if err != nil {
+				return err
+			}
+			cc.Set(ts)
+			if _, err := tx.InsertEvent(&model.Event{
+				AgentID:    agentID,
+				LamportTS:  ts,
+				Epoch:      ep,
+				Round:      rn,
+				Kind:       model.EventForcedRelease,
+				Target:     path,
+				Body:       fmt.Sprintf("evicted %s (held since ts=%d)", l.AgentID, l.LamportTS),
+				CreatedAt:  now,
+				Provenance: a.prov,
+			}); err != nil {
+				return fmt.Errorf("record forced release: %w", err)
+			}
+			stamps = append(stamps, ts)
+			if l.AgentID == agentID {
+				continue
+			}
+			msgTS, err := tickIn(tx, agentID, &cc, ep, rn)
+			if err != nil {
+				return err
+			}
+			cc.Set(msgTS)
+			if _, err := tx.InsertEvent(&model.Event{
+				AgentID:    agentID,
+				LamportTS:  msgTS,
+				Epoch:      ep,
+				Round:      rn,
+				Kind:       model.EventMsg,
+				Target:     l.AgentID,
+				Body:       fmt.Sprintf("%s force-released your lock on %s; re-lock it before editing again", agentID, path),
+				CreatedAt:  now,
+				Priority:   model.PriorityUrgent,
+				Provenance: a.prov,
+			}); err != nil {
+				return fmt.Errorf("notify %s: %w", l.AgentID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: unlock: %v\n", err)
+		return 1
+	}
+
+	evicted := make([]string, 0, len(released))
+	var ts int64
+	for i, l := range released {
+		evicted = append(evicted, l.AgentID)
+		ts = stamps[i]
+		if !jsonOut {
+			fmt.Printf("force-released %s from %s (ts=%d)\n", path, l.AgentID, ts)
+		}
+	}
+	if jsonOut {
+		printJSON(map[string]interface{}{"released": true, "forced": true, "path": path, "evicted": evicted, "lamport_ts": ts})
 	}
 	return 0
 }
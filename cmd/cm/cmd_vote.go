@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// cmdVote runs group decisions. Each agent casts one ballot, stamped with
+// its Lamport clock; ballots are totally ordered by timestamp, ties broken
+// by agent ID, and the first --quorum of them decide the vote. The option
+// with the most of those ballots wins; of options with equal counts, the
+// one that reached its count first. Every ballot is also an event in the
+// log, so the decision can be audited (cm log --kind vote).
+//
+// Usage:
+//
+//	cm vote open "merge now?" --options yes,no --quorum 3   # prints vote ID
+//	cm vote cast <id> yes
+//	cm vote result <id>
+//
+// Exit codes for result:
+//
+//	0 = decided
+//	1 = error
+//	2 = quorum not reached yet
+func (a *app) cmdVote(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm vote <open|cast|result> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "open":
+		return a.voteOpen(args[1:])
+	case "cast":
+		return a.voteCast(args[1:])
+	case "result":
+		return a.voteResult(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: vote: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) voteOpen(args []string) int {
+	const usage = `usage: cm vote open "<question>" [--options yes,no] [--quorum N] [--json]`
+	flags := flag.NewFlagSet("vote open", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent opening the vote")
+	options := flags.String("options", "yes,no", "comma-separated options")
+	quorum := flags.Int("quorum", 0, "ballots that decide the vote (default: active agents)")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	question := strings.Join(words, " ")
+	if question == "" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	var opts []string
+	for _, o := range strings.Split(*options, ",") {
+		if o = strings.TrimSpace(o); o != "" && !slices.Contains(opts, o) {
+			opts = append(opts, o)
+		}
+	}
+	if len(opts) < 2 {
+		fmt.Fprintln(os.Stderr, "cm: vote open: need at least two options")
+		return 1
+	}
+	if *quorum < 0 {
+		fmt.Fprintln(os.Stderr, "cm: vote open: --quorum cannot be negative")
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	if *quorum == 0 {
+		agents, err := a.store.ListAgents()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: vote open: %v\n", err)
+			return 1
+		}
+		for _, ag := range agents {
+			if ag.DepartedAt == nil {
+				*quorum++
+			}
+		}
+	}
+
+	// The opener's clock strictly increases, so agent-ts is a unique ID.
+	id := fmt.Sprintf("%s-%d", agentID, a.getClock(agentID).Value()+1)
+	ts, err := a.recordEvent(agentID, model.EventVote, id, "open "+question)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: vote open: %v\n", err)
+		return 1
+	}
+	v := &model.Vote{
+		ID:        id,
+		AgentID:   agentID,
+		Question:  question,
+		Options:   opts,
+		Quorum:    *quorum,
+		LamportTS: ts,
+	}
+	if err := a.store.OpenVote(v); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: vote open: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"vote": v, "lamport_ts": ts})
+	} else {
+		fmt.Printf("vote %s opened: %s [%s] quorum %d (ts=%d)\n", v.ID, question, strings.Join(opts, "/"), v.Quorum, ts)
+		fmt.Fprintf(os.Stderr, "hint: cm vote cast %s <%s>\n", v.ID, strings.Join(opts, "|"))
+	}
+	return 0
+}
+
+func (a *app) voteCast(args []string) int {
+	flags := flag.NewFlagSet("vote cast", flag.ContinueOnError)
+	agent := flags.String("agent", "", "voting agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: cm vote cast <vote-id> <option> [--json]")
+		return 1
+	}
+	voteID, choice := words[0], words[1]
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	// Check before logging so rejected ballots leave no trace in the log;
+	// CastBallot re-checks atomically.
+	v, err := a.store.GetVote(voteID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fmt.Errorf("vote %q not found", voteID)
+		}
+		fmt.Fprintf(os.Stderr, "cm: vote cast: %v\n", err)
+		return 1
+	}
+	if !v.HasOption(choice) {
+		fmt.Fprintf(os.Stderr, "cm: vote cast: %q is not an option (options: %s)\n", choice, strings.Join(v.Options, ", "))
+		return 1
+	}
+	for _, b := range v.Ballots {
+		if b.AgentID == agentID {
+			fmt.Fprintf(os.Stderr, "cm: vote cast: %s already voted %s in %s\n", agentID, b.Choice, voteID)
+			return 1
+		}
+	}
+
+	ts, err := a.recordEvent(agentID, model.EventVote, voteID, "cast "+choice)
+	if err != nil {
+		a.logger().Warn("record vote event", "verb", "cast", "err", err)
+	}
+	v, err = a.store.CastBallot(voteID, model.Ballot{AgentID: agentID, Choice: choice, LamportTS: ts})
+	if err != nil {
+		if errors.Is(err, store.ErrAlreadyVoted) {
+			err = fmt.Errorf("%s already voted in %s", agentID, voteID)
+		}
+		fmt.Fprintf(os.Stderr, "cm: vote cast: %v\n", err)
+		return 1
+	}
+
+	r := v.Result()
+	if *jsonOut {
+		printJSON(map[string]interface{}{"vote_id": voteID, "choice": choice, "lamport_ts": ts, "result": r})
+	} else {
+		fmt.Printf("voted %s in %s (ts=%d)\n", choice, voteID, ts)
+		fmt.Println("  " + describeResult(v, r))
+	}
+	return 0
+}
+
+func (a *app) voteResult(args []string) int {
+	flags := flag.NewFlagSet("vote result", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	words, ok := parseArgsAnywhere(flags, args)
+	if !ok {
+		return 1
+	}
+	if len(words) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm vote result <vote-id> [--json]")
+		return 1
+	}
+	v, err := a.store.GetVote(words[0])
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fmt.Errorf("vote %q not found", words[0])
+		}
+		fmt.Fprintf(os.Stderr, "cm: vote result: %v\n", err)
+		return 1
+	}
+
+	r := v.Result()
+	if *jsonOut {
+		printJSON(map[string]interface{}{"vote": v, "result": r})
+	} else {
+		fmt.Printf("vote %s by %s (ts=%d): %s\n", v.ID, v.AgentID, v.LamportTS, v.Question)
+		fmt.Println("  " + describeResult(v, r))
+		for _, o := range v.Options {
+			fmt.Printf("    %-10s %d\n", o, r.Counts[o])
+		}
+		if len(v.Ballots) > 0 {
+			fmt.Println("  ballots in order:")
+		}
+		for i, b := range v.Ballots {
+			note := ""
+			if i >= r.Counted {
+				note = "  (after quorum, not counted)"
+			}
+			fmt.Printf("    ts=%-6d %-12s %s%s\n", b.LamportTS, b.AgentID, b.Choice, note)
+		}
+	}
+	if !r.Decided {
+		return 2
+	}
+	return 0
+}
+
+// describeResult summarizes a tally as "decided: yes (3 of 3 ballots)" or
+// "open: 1 of 3 ballots, leading: yes".
+func describeResult(v *model.Vote, r model.VoteResult) string {
+	if r.Decided {
+		return fmt.Sprintf("decided: %s (%d of %d ballots)", r.Winner, r.Counted, v.Quorum)
+	}
+	s := fmt.Sprintf("open: %d of %d ballots", r.Counted, v.Quorum)
+	if r.Winner != "" {
+		s += ", leading: " + r.Winner
+	}
+	return s
+}
+
+// parseArgsAnywhere parses flags given before, between or after the
+// positional arguments, which are returned in order.
+func parseArgsAnywhere(flags *flag.FlagSet, args []string) ([]string, bool) {
+	var words []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, false
+		}
+		if flags.NArg() == 0 {
+			return words, true
+		}
+		words = append(words, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
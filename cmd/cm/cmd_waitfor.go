@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// cmdWaitFor blocks until a message matching a predicate is pending, then
+// receives it and prints it as JSON: a blocking primitive for
+// request/response protocols between agents. --from matches the sender,
+// --type the kind in brackets that protocol messages start with (see cm
+// template), so --type handoff matches "[handoff] ...".
+//
+// Only the match is taken out of the inbox. Older pending messages that
+// do not match are deferred (cm recv --defer) and shown by the next cm
+// recv, and newer ones stay pending.
+//
+// Usage:
+//
+//	cm wait-for --from planner --type task-assignment --timeout 10m
+//
+// Exit codes:
+//
+//	0 = a matching message was received
+//	1 = error or timeout
+func (a *app) cmdWaitFor(args []string) int {
+	flags := flag.NewFlagSet("wait-for", flag.ContinueOnError)
+	agent := flags.String("agent", "", "recipient agent ID")
+	from := flags.String("from", "", "match only messages from this agent")
+	msgType := flags.String("type", "", "match only messages starting with [TYPE]")
+	timeout := flags.Duration("timeout", 10*time.Minute, "give up after this long")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: cm wait-for [--from AGENT] [--type TYPE] [--timeout 10m]")
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, true)
+	}
+	match := func(e model.Event) bool {
+		return *msgType == "" || messageType(e.Body) == *msgType
+	}
+	got, timedOut, err := a.waitForMessage(agentID, *from, match, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: wait-for: %v\n", err)
+		return 1
+	}
+	if timedOut {
+		fmt.Fprintf(os.Stderr, "cm: wait-for: no matching message after %s\n", *timeout)
+		return 1
+	}
+	printJSON(got)
+	return 0
+}
+
+// waitForMessage blocks until a message to agentID from sender (any if
+// empty) that satisfies match is pending, or timeout passes (timedOut),
+// and receives it alone: see cmdWaitFor.
+func (a *app) waitForMessage(agentID, from string, match func(model.Event) bool, timeout time.Duration) (got *model.Event, timedOut bool, err error) {
+	matches := func(e model.Event) bool { return (from == "" || e.AgentID == from) && match(e) }
+
+	// A match may already have been received and deferred.
+	deferrals, err := a.store.ListDeferred(agentID)
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	for _, d := range deferrals {
+		e := []model.Event{d.Event}
+		openSealed(agentID, e)
+		if d.Due(now) && matches(e[0]) {
+			return &e[0], false, a.store.ClearDeferred(agentID, []int64{e[0].ID})
+		}
+	}
+
+	// through returns the pending messages up to and including the first
+	// match, or none if nothing matches yet.
+	through := func() ([]model.Event, error) {
+		events, err := a.store.ListUnread(agentID, from, 1000)
+		if err != nil {
+			return nil, err
+		}
+		openSealed(agentID, events)
+		for i, e := range events {
+			if !matches(e) {
+				continue
+			}
+			// The cursor moves past the match's timestamp, so messages
+			// sharing it are taken (and deferred) too.
+			n := i + 1
+			for n < len(events) && events[n].LamportTS == e.LamportTS {
+				n++
+			}
+			return events[:n], nil
+		}
+		return nil, nil
+	}
+	events, err := through()
+	if err == nil && len(events) == 0 {
+		events, timedOut, err = a.waitForInbox(through, timeout)
+	}
+	if err != nil || timedOut {
+		return nil, timedOut, err
+	}
+
+	var others []int64
+	for i, e := range events {
+		if got == nil && matches(e) {
+			got = &events[i]
+		} else {
+			others = append(others, e.ID)
+		}
+	}
+	if err := a.store.DeferMessages(agentID, others, time.Time{}); err != nil {
+		return nil, false, err
+	}
+	receipt := newInboxReceipt(agentID, a.getClock(agentID).Value(), events)
+	receipt.from = from
+	if err := a.store.WithTx(receipt.write); err != nil {
+		return nil, false, err
+	}
+	return got, false, nil
+}
+
+// messageType returns the kind a protocol message starts with in
+// brackets, "handoff" for "[handoff] a.go", or "" if it has none.
+func messageType(body string) string {
+	if !strings.HasPrefix(body, "[") {
+		return ""
+	}
+	end := strings.IndexAny(body, "]\n")
+	if end < 0 || body[end] != ']' {
+		return ""
+	}
+	return body[1:end]
+}
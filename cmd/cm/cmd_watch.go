@@ -1,28 +1,99 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/notify"
+	"github.com/daviddao/clockmail/pkg/query"
 )
 
+// cmdWatch streams events as they are written: an agent's messages
+// (receiving them), or with --all every event, read-only.
+//
+// --kind, --from and --target may be repeated (or comma-separated) and
+// match any of their values; --epoch takes N, N..M, N.. or ..M. They are
+// combined with each other and with -q by "and", as in cm log. --format
+// shapes each event with a Go text/template over model.Event, e.g.
+// '{{.AgentID}}\t{{.Kind}}\t{{.Body}}'.
+//
+// With --json, --keepalive 30s writes {"kind":"keepalive",...} whenever
+// that long passes without an event, so a supervisor reading the stream
+// can tell a quiet swarm from a dead watch, and a clean shutdown (ctrl-c
+// or SIGTERM) ends the stream with a {"kind":"summary",...} object.
+//
+// Usage: cm watch [--all] [--kind K] [--from A] [--target T] [--epoch N..M] [-q QUERY]
+//
+//	[--format T | --json [--keepalive 30s]] [--interval N] [--notify]
 func (a *app) cmdWatch(args []string) int {
 	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
 	agent := flags.String("agent", "", "agent ID (omit for global stream)")
 	all := flags.Bool("all", false, "watch all events from all agents (global mode)")
-	kind := flags.String("kind", "", "filter by event kind (msg, lock_req, lock_rel, progress)")
-	interval := flags.Int("interval", 1, "poll interval in seconds")
+	var kinds, froms, targets stringList
+	flags.Var(&kinds, "kind", "filter by event kind (repeatable)")
+	flags.Var(&froms, "from", "filter by sending agent (repeatable)")
+	flags.Var(&targets, "target", "filter by target (repeatable)")
+	epoch := flags.String("epoch", "", "filter by epoch: N, N..M, N.. or ..M")
+	format := flags.String("format", "", "format each event with a Go text/template over model.Event")
+	var q string
+	flags.StringVar(&q, "q", "", "filter expression, e.g. 'kind=msg and agent=alice'")
+	flags.StringVar(&q, "query", "", "same as -q")
+	interval := flags.Int("interval", max(int(a.cfg.Duration("poll.watch_interval").Seconds()), 1), "poll interval in seconds (a fallback when the store can push writes)")
 	jsonOut := flags.Bool("json", false, "JSON output (one JSON object per line)")
+	keepalive := flags.Duration("keepalive", 0, "with --json, write a keepalive line after this long without events (0 = never)")
+	notifyOn := flags.Bool("notify", false, "also route shown events through the notify file")
+	notifyFile := flags.String("notify-file", defaultNotifyFile(), "notify config file (with --notify)")
 	if err := flags.Parse(args); err != nil {
 		return 1
 	}
 
+	src, err := logFilterSource(q, kinds, froms, targets, *epoch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: watch: %v\n", err)
+		return 1
+	}
+	filter, err := query.Parse(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: watch: %v\n", err)
+		return 1
+	}
+
+	var out watchOutput = printWatched(*jsonOut)
+	if *format != "" {
+		if *jsonOut {
+			fmt.Fprintln(os.Stderr, "cm: watch: --format and --json are mutually exclusive")
+			return 1
+		}
+		tmpl, err := parseEventTemplate(*format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: watch: format: %v\n", err)
+			return 1
+		}
+		out = formatWatched(tmpl)
+	}
+	if *notifyOn {
+		d, err := loadDispatcher(*notifyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cm: watch: %s: %v\n", *notifyFile, err)
+			return 1
+		}
+		out = notifyWatched(out, d)
+	}
+
+	if *keepalive < 0 || (*keepalive > 0 && !*jsonOut) {
+		fmt.Fprintln(os.Stderr, "cm: watch: --keepalive needs --json and a positive duration")
+		return 1
+	}
+	w := newWatchStream(out, *jsonOut, *keepalive)
+
 	agentID, agentErr := a.resolveAgent(*agent)
 	globalMode := *all || agentErr != nil
 
@@ -33,55 +104,196 @@ func (a *app) cmdWatch(args []string) int {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
 	if globalMode {
-		return a.watchGlobal(sig, pollInterval, *kind, *jsonOut)
+		return a.watchGlobal(sig, pollInterval, filter, w)
+	}
+	return a.watchAgent(sig, agentID, pollInterval, filter, w)
+}
+
+// watchStream is the output side of one cm watch: it shows events, and
+// with --json writes keepalives while idle and a summary at the end.
+type watchStream struct {
+	out       watchOutput
+	jsonOut   bool
+	keepalive time.Duration
+	timer     *time.Timer // fires after keepalive without output; nil if off
+
+	started    time.Time
+	shown      int
+	keepalives int
+	lastID     int64 // row ID of the last event read
+}
+
+func newWatchStream(out watchOutput, jsonOut bool, keepalive time.Duration) *watchStream {
+	w := &watchStream{out: out, jsonOut: jsonOut, keepalive: keepalive, started: time.Now()}
+	if keepalive > 0 {
+		w.timer = time.NewTimer(keepalive)
+	}
+	return w
+}
+
+// idle receives when a keepalive is due; never if keepalives are off.
+func (w *watchStream) idle() <-chan time.Time {
+	if w.timer == nil {
+		return nil
+	}
+	return w.timer.C
+}
+
+// show writes e and restarts the keepalive countdown.
+func (w *watchStream) show(e model.Event) {
+	w.out(e)
+	w.shown++
+	if w.timer != nil {
+		w.timer.Reset(w.keepalive)
+	}
+}
+
+// ping writes a keepalive line.
+func (w *watchStream) ping() {
+	w.keepalives++
+	b, _ := json.Marshal(map[string]interface{}{
+		"kind": "keepalive", "time": time.Now().UTC().Format(time.RFC3339), "events": w.shown,
+	})
+	fmt.Println(string(b))
+	w.timer.Reset(w.keepalive)
+}
+
+// stop ends the stream after a signal: a summary object with --json, a
+// note on stderr otherwise.
+func (w *watchStream) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if !w.jsonOut {
+		fmt.Fprintln(os.Stderr, "\nstopped")
+		return
 	}
-	return a.watchAgent(sig, agentID, pollInterval, *kind, *jsonOut)
+	b, _ := json.Marshal(map[string]interface{}{
+		"kind":          "summary",
+		"events":        w.shown,
+		"keepalives":    w.keepalives,
+		"started":       w.started.UTC().Format(time.RFC3339),
+		"duration":      time.Since(w.started).Round(time.Millisecond).String(),
+		"last_event_id": w.lastID,
+	})
+	fmt.Println(string(b))
+}
+
+// watchOutput handles each event cm watch shows.
+type watchOutput func(e model.Event)
+
+// printWatched writes events to stdout as text or JSON lines.
+func printWatched(jsonOut bool) watchOutput {
+	return func(e model.Event) {
+		if jsonOut {
+			b, _ := json.Marshal(e)
+			fmt.Println(string(b))
+		} else {
+			printEvent(e)
+		}
+	}
+}
+
+// formatWatched writes events to stdout through tmpl. An event the
+// template fails on is reported on stderr and the stream goes on.
+func formatWatched(tmpl *template.Template) watchOutput {
+	return func(e model.Event) {
+		if err := tmpl.Execute(os.Stdout, &e); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: watch: format: %v\n", err)
+		}
+	}
+}
+
+// notifyWatched wraps out to also dispatch each event to d. Delivery
+// failures are reported on stderr and do not stop the watch.
+func notifyWatched(out watchOutput, d *notify.Dispatcher) watchOutput {
+	return func(e model.Event) {
+		out(e)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := d.Dispatch(ctx, e); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: watch: notify: %v\n", err)
+		}
+	}
+}
+
+// wakeups returns a channel that receives whenever new events may be
+// waiting: as soon as one is written, if the store can tell (see
+// store.Watch), and otherwise, or as a fallback, every interval. mode
+// describes which for the banner; stop ends the wakeups.
+func (a *app) wakeups(interval time.Duration) (wake <-chan struct{}, mode string, stop func()) {
+	ch := make(chan struct{}, 1)
+	done := make(chan struct{})
+	w, err := a.store.Watch()
+	if err != nil {
+		ticker := time.NewTicker(interval)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					select {
+					case ch <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+		return ch, fmt.Sprintf("poll every %s", interval), func() { ticker.Stop(); close(done) }
+	}
+	go func() {
+		for {
+			w.Wait(interval)
+			select {
+			case <-done:
+				return
+			case ch <- struct{}{}:
+			default: // a wakeup is already pending
+			}
+		}
+	}()
+	return ch, fmt.Sprintf("push, polling every %s as a fallback", interval), func() { close(done); w.Close() }
 }
 
 // watchGlobal streams all events from all agents. Read-only: no clock
 // side-effects, no cursor updates. Safe for passive observers.
-func (a *app) watchGlobal(sig chan os.Signal, interval time.Duration, kindFilter string, jsonOut bool) int {
+func (a *app) watchGlobal(sig chan os.Signal, interval time.Duration, filter *query.Query, w *watchStream) int {
 	// Seed cursor to the current max event row ID so we only show new events.
 	// We track by row ID (autoincrement) rather than Lamport timestamp
 	// because multiple events can share a Lamport timestamp.
-	lastSeenID := a.store.MaxEventID()
+	w.lastID = a.store.MaxEventID()
 
 	kindStr := "all events"
-	if kindFilter != "" {
-		kindStr = kindFilter + " events"
+	if filter != nil {
+		kindStr = "events matching " + filter.String()
 	}
-	fmt.Fprintf(os.Stderr, "watching %s from all agents (poll every %s, ctrl-c to stop)\n",
-		kindStr, interval)
-
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	wake, mode, stop := a.wakeups(interval)
+	defer stop()
+	fmt.Fprintf(os.Stderr, "watching %s from all agents (%s, ctrl-c to stop)\n", kindStr, mode)
 
 	for {
 		select {
 		case <-sig:
-			fmt.Fprintln(os.Stderr, "\nstopped")
+			w.stop()
 			return 0
-		case <-ticker.C:
-			events, err := a.store.ListEventsSinceID(lastSeenID, 200)
+		case <-w.idle():
+			w.ping()
+		case <-wake:
+			events, err := a.store.ListEventsSinceID(w.lastID, 200)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "cm: watch: %v\n", err)
 				continue
 			}
 
 			for _, e := range events {
-				lastSeenID = e.ID
+				w.lastID = e.ID
 
-				// Apply kind filter.
-				if kindFilter != "" && string(e.Kind) != kindFilter {
+				if !filter.Match(e) {
 					continue
 				}
 
-				if jsonOut {
-					b, _ := json.Marshal(e)
-					fmt.Println(string(b))
-				} else {
-					printEvent(e)
-				}
+				w.show(e)
 			}
 		}
 	}
@@ -89,60 +301,43 @@ func (a *app) watchGlobal(sig chan os.Signal, interval time.Duration, kindFilter
 
 // watchAgent streams messages targeted to a specific agent. Advances the
 // agent's Lamport clock (IR2) and updates their cursor.
-func (a *app) watchAgent(sig chan os.Signal, agentID string, interval time.Duration, kindFilter string, jsonOut bool) int {
-	cursor := a.store.GetCursor(agentID)
-
+func (a *app) watchAgent(sig chan os.Signal, agentID string, interval time.Duration, filter *query.Query, w *watchStream) int {
 	kindStr := "messages"
-	if kindFilter != "" {
-		kindStr = kindFilter + " events"
+	if filter != nil {
+		kindStr = "messages matching " + filter.String()
 	}
-	fmt.Fprintf(os.Stderr, "watching %s for %s (poll every %s, ctrl-c to stop)\n",
-		kindStr, agentID, interval)
-
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	wake, mode, stop := a.wakeups(interval)
+	defer stop()
+	fmt.Fprintf(os.Stderr, "watching %s for %s (%s, ctrl-c to stop)\n", kindStr, agentID, mode)
 
 	for {
 		select {
 		case <-sig:
-			fmt.Fprintln(os.Stderr, "\nstopped")
+			w.stop()
 			return 0
-		case <-ticker.C:
-			events, err := a.store.ListEventsForAgent(agentID, cursor, 100)
+		case <-w.idle():
+			w.ping()
+		case <-wake:
+			events, err := a.store.ListUnread(agentID, "", 100)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "cm: watch: %v\n", err)
 				continue
 			}
 
+			openSealed(agentID, events)
+			// Filtered-out messages are still received: the cursor and
+			// clock move past them.
 			for _, e := range events {
-				// Apply kind filter if set (agent mode only gets msg by default).
-				if kindFilter != "" && string(e.Kind) != kindFilter {
-					if e.LamportTS >= cursor {
-						cursor = e.LamportTS + 1
-					}
-					continue
-				}
-
-				if jsonOut {
-					b, _ := json.Marshal(e)
-					fmt.Println(string(b))
-				} else {
-					printEvent(e)
-				}
-				if e.LamportTS >= cursor {
-					cursor = e.LamportTS + 1
+				if filter.Match(e) {
+					w.show(e)
 				}
+				w.lastID = max(w.lastID, e.ID)
 			}
 
 			if len(events) > 0 {
-				_ = a.store.SetCursor(agentID, cursor)
-				c := a.getClock(agentID)
-				for _, e := range events {
-					c.Receive(e.LamportTS)
-				}
-				newTS := c.Value()
-				if ag, _ := a.store.GetAgent(agentID); ag != nil {
-					_ = a.store.UpdateAgentClock(agentID, newTS, ag.Epoch, ag.Round)
+				receipt := newInboxReceipt(agentID, a.getClock(agentID).Value(), events)
+				if err := a.store.WithTx(receipt.write); err != nil {
+					a.logger().Warn("record inbox receipt", "agent", agentID, "err", err)
 				}
 			}
 		}
@@ -155,9 +350,19 @@ func printEvent(e model.Event) {
 	case model.EventMsg:
 		fmt.Printf("[ts=%d] %s -> %s: %s\n", e.LamportTS, e.AgentID, e.Target, e.Body)
 	case model.EventLockReq:
-		fmt.Printf("[ts=%d] %s lock-req %s\n", e.LamportTS, e.AgentID, e.Target)
+		if e.Body != "" {
+			fmt.Printf("[ts=%d] %s lock-req %s (%s)\n", e.LamportTS, e.AgentID, e.Target, e.Body)
+		} else {
+			fmt.Printf("[ts=%d] %s lock-req %s\n", e.LamportTS, e.AgentID, e.Target)
+		}
 	case model.EventLockRel:
 		fmt.Printf("[ts=%d] %s unlock %s\n", e.LamportTS, e.AgentID, e.Target)
+	case model.EventLockRenew:
+		fmt.Printf("[ts=%d] %s renew %s (%s)\n", e.LamportTS, e.AgentID, e.Target, e.Body)
+	case model.EventCommit:
+		fmt.Printf("[ts=%d] %s commit %s\n", e.LamportTS, e.AgentID, commitSummary(e))
+	case model.EventGateResult:
+		fmt.Printf("[ts=%d] %s gate_result %s\n", e.LamportTS, e.AgentID, gateResultSummary(e))
 	case model.EventProgress:
 		fmt.Printf("[ts=%d] %s heartbeat epoch=%d round=%d\n",
 			e.LamportTS, e.AgentID, e.Epoch, e.Round)
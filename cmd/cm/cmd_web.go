@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/web"
+)
+
+// cmdWeb serves a live dashboard of the swarm for human supervisors: an
+// agent graph, a Lamport timeline, locks, and the frontier. Read-only,
+// like `cm watch --all`. It listens on loopback only unless --addr asks
+// for a wider bind, since the dashboard shows every message.
+//
+// Usage:
+//
+//	cm web                       # http://127.0.0.1:7777
+//	cm web --addr :8080          # every interface
+func (a *app) cmdWeb(args []string) int {
+	flags := flag.NewFlagSet("web", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:7777", "listen address (e.g. :7777 to listen on every interface)")
+	interval := flags.Duration("interval", time.Second, "how often to push updates to the page")
+	title := flags.String("title", "clockmail", "dashboard title")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: web: %v\n", err)
+		return 1
+	}
+	srv := &http.Server{
+		Handler:           web.New(a.store, *interval, *title).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "dashboard for %s on http://%s (ctrl-c to stop)\n", dbLocation(), ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "cm: web: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "\nstopped")
+	return 0
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// cmdWIP manages work-in-progress declarations: a line saying what the
+// agent is about to do and the files it expects to touch, shown to
+// everyone in cm status and cm prime. Declaring before locking lets
+// agents notice overlapping plans while they are still plans; cm wip set
+// warns when the files overlap another agent's declaration or locks.
+//
+// Usage:
+//
+//	cm wip set "refactoring store.go" --files pkg/store/store.go
+//	cm wip clear
+//	cm wip [list] [--json]
+func (a *app) cmdWIP(args []string) int {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		return a.wipList(args)
+	}
+	switch args[0] {
+	case "set":
+		return a.wipSet(args[1:])
+	case "clear":
+		return a.wipClear(args[1:])
+	case "list", "ls":
+		return a.wipList(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: wip: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+// wipOverlap is another agent's declaration or lock covering files the
+// caller declared.
+type wipOverlap struct {
+	AgentID string   `json:"agent_id"`
+	Kind    string   `json:"kind"` // "wip" or "lock"
+	Files   []string `json:"files"`
+	What    string   `json:"what,omitempty"`
+}
+
+func (a *app) wipSet(args []string) int {
+	flags := flag.NewFlagSet("wip set", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID")
+	var files stringList
+	flags.Var(&files, "files", "comma-separated files or directories you expect to touch (repeatable)")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	// Flags may follow the description.
+	var words []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return 1
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		words = append(words, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	desc := strings.TrimSpace(strings.Join(words, " "))
+	if desc == "" {
+		fmt.Fprintln(os.Stderr, `usage: cm wip set "what you are doing" [--files a.go,pkg/dir] [--json]`)
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	var paths []string
+	for _, f := range files {
+		for _, p := range strings.Split(f, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+
+	epoch, _ := a.resolveEpochRound(agentID, -1, -1)
+	w, err := a.store.SetWIP(agentID, desc, paths, epoch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: wip: %v\n", err)
+		return 1
+	}
+	overlaps, err := a.wipOverlaps(agentID, paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: wip: %v\n", err)
+	}
+	var actions []nextAction
+	for _, o := range overlaps {
+		actions = append(actions, nextAction{
+			Command: fmt.Sprintf("cm send %s \"planning to work on %s too\"", o.AgentID, strings.Join(o.Files, ", ")),
+			Reason:  fmt.Sprintf("%s's %s covers the same files; agree who goes first", o.AgentID, o.Kind),
+		})
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"wip": w, "overlaps": overlaps, "next_actions": actions})
+		return 0
+	}
+	fmt.Printf("%s is working on: %s\n", agentID, wipSummary(*w))
+	for _, o := range overlaps {
+		if o.Kind == "lock" {
+			fmt.Fprintf(os.Stderr, "cm: wip: %s holds the lock on %s\n", o.AgentID, strings.Join(o.Files, ", "))
+		} else {
+			fmt.Fprintf(os.Stderr, "cm: wip: %s is also working on %s (%s)\n", o.AgentID, strings.Join(o.Files, ", "), o.What)
+		}
+	}
+	printHints(actions)
+	return 0
+}
+
+// wipOverlaps returns the other agents' declarations and locks covering
+// any of paths, declarations first.
+func (a *app) wipOverlaps(agentID string, paths []string) ([]wipOverlap, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	var out []wipOverlap
+	all, err := a.store.ListWIP()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range all {
+		if w.AgentID == agentID {
+			continue
+		}
+		if shared := overlappingPaths(paths, w.Files); len(shared) > 0 {
+			out = append(out, wipOverlap{AgentID: w.AgentID, Kind: "wip", Files: shared, What: w.Description})
+		}
+	}
+	locks, err := a.store.ListLocks()
+	if err != nil {
+		return out, err
+	}
+	held := make(map[string][]string)
+	var holders []string
+	for _, l := range locks {
+		if l.AgentID == agentID {
+			continue
+		}
+		if shared := overlappingPaths(paths, []string{l.Path}); len(shared) > 0 {
+			if held[l.AgentID] == nil {
+				holders = append(holders, l.AgentID)
+			}
+			held[l.AgentID] = append(held[l.AgentID], l.Path)
+		}
+	}
+	for _, id := range holders {
+		out = append(out, wipOverlap{AgentID: id, Kind: "lock", Files: held[id]})
+	}
+	return out, nil
+}
+
+// overlappingPaths returns the entries of theirs that are, contain, or
+// lie inside one of ours.
+func overlappingPaths(ours, theirs []string) []string {
+	var shared []string
+	for _, t := range theirs {
+		for _, o := range ours {
+			if pathWithin(t, o) || pathWithin(o, t) {
+				shared = append(shared, t)
+				break
+			}
+		}
+	}
+	return shared
+}
+
+// pathWithin reports whether p is dir or a path under it.
+func pathWithin(p, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	p = strings.TrimSuffix(p, "/")
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+func (a *app) wipClear(args []string) int {
+	flags := flag.NewFlagSet("wip clear", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent ID")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+	cleared, err := a.store.ClearWIP(agentID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: wip: %v\n", err)
+		return 1
+	}
+	if *jsonOut {
+		printJSON(map[string]interface{}{"agent_id": agentID, "cleared": cleared})
+	} else if cleared {
+		fmt.Printf("cleared work in progress for %s\n", agentID)
+	} else {
+		fmt.Printf("%s had no work in progress declared\n", agentID)
+	}
+	return 0
+}
+
+func (a *app) wipList(args []string) int {
+	flags := flag.NewFlagSet("wip list", flag.ContinueOnError)
+	agent := flags.String("agent", "", "only this agent's declaration")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	var ws []model.WIP
+	if *agent != "" {
+		w, err := a.store.GetWIP(*agent)
+		if err != nil && err != sql.ErrNoRows {
+			fmt.Fprintf(os.Stderr, "cm: wip: %v\n", err)
+			return 1
+		}
+		if w != nil {
+			ws = append(ws, *w)
+		}
+	} else {
+		var err error
+		if ws, err = a.store.ListWIP(); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: wip: %v\n", err)
+			return 1
+		}
+	}
+
+	if *jsonOut {
+		if ws == nil {
+			ws = []model.WIP{}
+		}
+		printJSON(map[string]interface{}{"wip": ws})
+		return 0
+	}
+	if len(ws) == 0 {
+		fmt.Println(`no work in progress declared (cm wip set "what you are doing" --files ...)`)
+		return 0
+	}
+	printWIP(ws, "")
+	return 0
+}
+
+// printWIP prints one "alice is working on: ..." line per declaration,
+// marking the one belonging to you.
+func printWIP(ws []model.WIP, you string) {
+	for _, w := range ws {
+		fmt.Println(wipLine(w, you))
+	}
+}
+
+// wipLine renders one declaration as printWIP lists it.
+func wipLine(w model.WIP, you string) string {
+	marker := ""
+	if w.AgentID == you {
+		marker = " (you)"
+	}
+	return fmt.Sprintf("  %s is working on: %s%s", w.AgentID, wipSummary(w), marker)
+}
+
+// wipSummary renders a declaration as its description, files and age,
+// e.g. "refactoring store.go (pkg/store/store.go; epoch 2, 5m0s ago)".
+func wipSummary(w model.WIP) string {
+	detail := fmt.Sprintf("epoch %d, %s ago", w.Epoch, time.Since(w.UpdatedAt).Round(time.Second))
+	if len(w.Files) > 0 {
+		detail = strings.Join(w.Files, ", ") + "; " + detail
+	}
+	return fmt.Sprintf("%s (%s)", w.Description, detail)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/workflow"
+)
+
+// defaultWorkflowFile is the workflow definition in the workspace.
+func defaultWorkflowFile() string { return workspacePath("workflow.yaml") }
+
+// cmdWorkflow manages the declarative workflow. The file on disk is only
+// a draft; `apply` copies it into the shared database, after which
+// heartbeat and sync enforce its rules for every agent.
+//
+// Usage:
+//
+//	cm workflow validate [--file PATH]   # parse and check the file
+//	cm workflow apply [--file PATH]      # validate and activate for all agents
+//	cm workflow status                   # evaluate the active workflow
+func (a *app) cmdWorkflow(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cm workflow <validate|apply|status> [flags]")
+		return 1
+	}
+	switch args[0] {
+	case "validate":
+		return a.workflowValidate(args[1:])
+	case "apply":
+		return a.workflowApply(args[1:])
+	case "status":
+		return a.workflowStatus(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "cm: workflow: unknown subcommand %q\n", args[0])
+		return 1
+	}
+}
+
+func (a *app) workflowValidate(args []string) int {
+	flags := flag.NewFlagSet("workflow validate", flag.ContinueOnError)
+	file := flags.String("file", defaultWorkflowFile(), "workflow definition file")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	w, err := workflow.Load(*file)
+	if err != nil {
+		if *jsonOut {
+			printJSON(map[string]interface{}{"valid": false, "file": *file, "errors": strings.Split(err.Error(), "\n")})
+		} else {
+			fmt.Fprintf(os.Stderr, "cm: workflow: %s: %v\n", *file, err)
+		}
+		return 1
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"valid": true, "file": *file, "workflow": w})
+	} else {
+		fmt.Printf("%s: valid (%d roles, %d epochs)\n", *file, len(w.Roles), len(w.Epochs))
+	}
+	return 0
+}
+
+func (a *app) workflowApply(args []string) int {
+	flags := flag.NewFlagSet("workflow apply", flag.ContinueOnError)
+	agent := flags.String("agent", "", "agent applying the workflow")
+	file := flags.String("file", defaultWorkflowFile(), "workflow definition file")
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	agentID, err := a.resolveAgent(*agent)
+	if err != nil {
+		return failNoAgent(err, *jsonOut)
+	}
+
+	w, err := workflow.Load(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: workflow: %s: %v\n", *file, err)
+		return 1
+	}
+	body, err := w.Marshal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: workflow: %v\n", err)
+		return 1
+	}
+	if err := a.store.SetWorkflow(body, agentID); err != nil {
+		fmt.Fprintf(os.Stderr, "cm: workflow: apply: %v\n", err)
+		return 1
+	}
+
+	ep, rn := a.resolveEpochRound(agentID, -1, -1)
+	ts := a.tick(agentID, ep, rn)
+	if _, err := a.insertEvent(&model.Event{
+		AgentID:   agentID,
+		LamportTS: ts,
+		Epoch:     ep,
+		Round:     rn,
+		Kind:      model.EventWorkflow,
+		Body:      fmt.Sprintf("applied %s (%d roles, %d epochs)", *file, len(w.Roles), len(w.Epochs)),
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		a.logger().Warn("record workflow event", "err", err)
+	}
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"applied": true, "file": *file, "lamport_ts": ts, "workflow": w})
+	} else {
+		fmt.Printf("applied workflow from %s (ts=%d, %d roles, %d epochs)\n",
+			*file, ts, len(w.Roles), len(w.Epochs))
+	}
+	return 0
+}
+
+func (a *app) workflowStatus(args []string) int {
+	flags := flag.NewFlagSet("workflow status", flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	w, err := a.activeWorkflow()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: workflow: %v\n", err)
+		return 1
+	}
+	if w == nil {
+		if *jsonOut {
+			printJSON(map[string]interface{}{"active": false})
+		} else {
+			fmt.Printf("no workflow applied (write %s, then: cm workflow apply)\n", defaultWorkflowFile())
+		}
+		return 0
+	}
+
+	agents, err := a.store.ListAgents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: workflow: %v\n", err)
+		return 1
+	}
+	st, err := a.workflowState("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: workflow: %v\n", err)
+		return 1
+	}
+	epochs := w.Status(agents, st)
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{"active": true, "workflow": w, "epochs": epochs})
+		return 0
+	}
+
+	fmt.Println("roles:")
+	for _, ag := range agents {
+		roles := w.RolesOf(ag.ID)
+		if len(roles) == 0 {
+			fmt.Printf("  %-20s (no role)\n", ag.ID)
+		} else {
+			fmt.Printf("  %-20s %s\n", ag.ID, strings.Join(roles, ","))
+		}
+	}
+	fmt.Println("epochs:")
+	for _, es := range epochs {
+		name := ""
+		if es.Name != "" {
+			name = " (" + es.Name + ")"
+		}
+		gate := "open"
+		if !es.GateOpen {
+			var names []string
+			for _, b := range es.Blockers {
+				names = append(names, b.AgentID)
+			}
+			gate = "waiting on " + strings.Join(names, ",")
+		}
+		fmt.Printf("  epoch %d%s: agents=[%s] gate=%s\n",
+			es.Epoch, name, strings.Join(es.Agents, ","), gate)
+		for _, r := range es.Reviews {
+			switch {
+			case r.Passed:
+				fmt.Printf("    review %s: passed (commit %s)\n", r.AgentID, r.Commit)
+			case r.Commit != "":
+				fmt.Printf("    review %s: not passed (commit %s)\n", r.AgentID, r.Commit)
+			default:
+				fmt.Printf("    review %s: not requested\n", r.AgentID)
+			}
+		}
+	}
+	if w.MaxEpochsAhead > 0 {
+		fmt.Printf("max epochs ahead of frontier: %d\n", w.MaxEpochsAhead)
+	}
+	return 0
+}
+
+// activeWorkflow returns the workflow applied to the shared database, or
+// nil if none has been applied.
+func (a *app) activeWorkflow() (*workflow.Workflow, error) {
+	body, err := a.store.GetWorkflow()
+	if err != nil || body == "" {
+		return nil, err
+	}
+	return workflow.Unmarshal(body)
+}
+
+// workflowState gathers the coordination state workflow rules evaluate.
+// Review requests are limited to those sent by requester, or taken from
+// every agent if requester is empty.
+func (a *app) workflowState(requester string) (workflow.State, error) {
+	active, err := a.store.GetActivePointstamps(0)
+	if err != nil {
+		return workflow.State{}, err
+	}
+	reviews, err := a.store.ReviewEvents(requester)
+	if err != nil {
+		return workflow.State{}, err
+	}
+	return workflow.State{Active: active, Reviews: reviews}, nil
+}
+
+// checkWorkflow enforces the active workflow before agentID moves to
+// epoch. It prints any violations to stderr, with next actions (as JSON on
+// stdout if jsonOut), and returns false if the move is not allowed.
+// Without an applied workflow every move is allowed.
+func (a *app) checkWorkflow(cmd, agentID string, epoch int64, jsonOut bool) bool {
+	w, err := a.activeWorkflow()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: %s: workflow: %v\n", cmd, err)
+		return false
+	}
+	if w == nil {
+		return true
+	}
+	ag, err := a.store.GetAgent(agentID)
+	if err != nil {
+		// Unregistered agents have no position to move from.
+		return true
+	}
+	st, err := a.workflowState(agentID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cm: %s: workflow: %v\n", cmd, err)
+		return false
+	}
+	vs := w.CheckTransition(agentID, ag.Epoch, epoch, st)
+	if len(vs) == 0 {
+		return true
+	}
+	for _, v := range vs {
+		fmt.Fprintf(os.Stderr, "cm: %s: workflow: %s\n", cmd, v)
+	}
+	actions := workflowActions(vs)
+	if jsonOut {
+		printJSON(map[string]interface{}{
+			"error":        "workflow violation",
+			"violations":   vs,
+			"next_actions": actions,
+		})
+	} else {
+		printHints(actions)
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detach starts cmd in a new process group, away from the console's
+// ctrl-c.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// processAlive reports whether a process with this pid exists.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// stopProcess ends the process. Windows has no SIGTERM to ask with.
+func stopProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
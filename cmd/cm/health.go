@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// Kinds of status warning, for orchestrators that remediate them.
+const (
+	warnStaleHolder  = "stale_lock_holder" // holds locks, clock has not ticked for health.stale
+	warnEpochLag     = "epoch_lag"         // health.epoch_lag or more epochs behind the median
+	warnLockExpiring = "lock_expiring"     // lock expires within health.expiry
+	warnInboxBacklog = "inbox_backlog"     // more than health.backlog unread messages
+)
+
+// statusWarning is an anomaly cm status flags.
+type statusWarning struct {
+	Kind    string `json:"kind"`
+	Agent   string `json:"agent"`
+	Path    string `json:"path,omitempty"` // lock_expiring only
+	Message string `json:"message"`
+}
+
+// healthWarnings returns the anomalies in st at now, with the health.*
+// thresholds; a threshold of 0 turns its check off. lastEvent is when each
+// agent last wrote an event and unread its inbox backlog.
+func (a *app) healthWarnings(st *statusView, lastEvent map[string]time.Time, unread map[string]int64, now time.Time) []statusWarning {
+	warnings := []statusWarning{}
+	stale := a.cfg.Duration("health.stale")
+	lag := int64(a.cfg.Int("health.epoch_lag"))
+	expiry := a.cfg.Duration("health.expiry")
+	backlog := int64(a.cfg.Int("health.backlog"))
+
+	live := make([]model.Agent, 0, len(st.agents))
+	for _, ag := range st.agents {
+		if ag.DepartedAt == nil {
+			live = append(live, ag)
+		}
+	}
+	held := make(map[string]int)
+	for _, l := range st.locks {
+		held[l.AgentID]++
+	}
+
+	if stale > 0 {
+		for _, ag := range live {
+			if held[ag.ID] == 0 {
+				continue
+			}
+			last, ok := lastEvent[ag.ID]
+			if !ok {
+				last = ag.Registered
+			}
+			if idle := now.Sub(last); idle >= stale {
+				warnings = append(warnings, statusWarning{Kind: warnStaleHolder, Agent: ag.ID,
+					Message: fmt.Sprintf("%s holds %d lock(s) but its clock has not advanced in %s",
+						ag.ID, held[ag.ID], idle.Truncate(time.Second))})
+			}
+		}
+	}
+
+	if lag > 0 && len(live) > 1 {
+		median := medianEpoch(live)
+		for _, ag := range live {
+			if median-ag.Epoch >= lag {
+				warnings = append(warnings, statusWarning{Kind: warnEpochLag, Agent: ag.ID,
+					Message: fmt.Sprintf("%s is at epoch %d, %d behind the median %d",
+						ag.ID, ag.Epoch, median-ag.Epoch, median)})
+			}
+		}
+	}
+
+	if expiry > 0 {
+		for _, l := range st.locks {
+			if left := l.ExpiresAt.Sub(now); left < expiry {
+				warnings = append(warnings, statusWarning{Kind: warnLockExpiring, Agent: l.AgentID, Path: l.Path,
+					Message: fmt.Sprintf("%s's lock on %s expires in %s", l.AgentID, l.Path, max(left, 0).Truncate(time.Second))})
+			}
+		}
+	}
+
+	if backlog > 0 {
+		for _, ag := range live {
+			if n := unread[ag.ID]; n > backlog {
+				warnings = append(warnings, statusWarning{Kind: warnInboxBacklog, Agent: ag.ID,
+					Message: fmt.Sprintf("%s has %d unread messages", ag.ID, n)})
+			}
+		}
+	}
+	return warnings
+}
+
+// medianEpoch returns the median of the agents' epochs, the lower middle
+// one for an even count.
+func medianEpoch(agents []model.Agent) int64 {
+	epochs := make([]int64, len(agents))
+	for i, ag := range agents {
+		epochs[i] = ag.Epoch
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	return epochs[(len(epochs)-1)/2]
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/daviddao/clockmail/pkg/frontier"
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/workflow"
+)
+
+// nextAction is a command that would get an agent past a failure caused by
+// coordination state (rather than a bug or bad input). Commands attach them
+// to such failures — as "next_actions" in JSON output and as "hint:" lines
+// on stderr otherwise — so an agent can recover without a human reading
+// the error for it.
+type nextAction struct {
+	Command string `json:"command"`
+	Reason  string `json:"reason"`
+}
+
+// printHints writes actions to stderr, one per line.
+func printHints(actions []nextAction) {
+	for _, na := range actions {
+		fmt.Fprintf(os.Stderr, "  hint: %-40s # %s\n", na.Command, na.Reason)
+	}
+}
+
+// fail reports a state error and its next actions, then returns code.
+// The message goes to stderr prefixed with "cm: "; with jsonOut the error
+// and actions are also printed to stdout as a JSON object.
+func fail(msg string, jsonOut bool, code int, actions []nextAction) int {
+	fmt.Fprintf(os.Stderr, "cm: %s\n", msg)
+	if jsonOut {
+		printJSON(map[string]interface{}{"error": msg, "next_actions": actions})
+	} else {
+		printHints(actions)
+	}
+	return code
+}
+
+// failNoAgent reports a missing agent identity (see resolveAgent).
+func failNoAgent(err error, jsonOut bool) int {
+	return fail(err.Error(), jsonOut, 1, []nextAction{
+		{Command: "export CLOCKMAIL_AGENT=<your-id>", Reason: "set a default identity for every command"},
+		{Command: "cm register <your-id>", Reason: "join the swarm if you have not registered yet"},
+	})
+}
+
+// unregisteredActions returns next actions if agentID has not registered
+// or has departed.
+// Unregistered agents can send and receive, but their clock and position
+// are not persisted, so the frontier and other agents cannot see them.
+func (a *app) unregisteredActions(agentID string) []nextAction {
+	if ag, err := a.store.GetAgent(agentID); err == nil {
+		if ag.DepartedAt == nil {
+			return nil
+		}
+		return []nextAction{{
+			Command: "cm register " + agentID,
+			Reason:  agentID + " has departed; the frontier and broadcasts ignore it until it rejoins",
+		}}
+	}
+	return []nextAction{{
+		Command: "cm register " + agentID,
+		Reason:  agentID + " is not registered; its clock and position are not being recorded",
+	}}
+}
+
+// lockDeniedActions suggests how to get a lock held by conflict.AgentID.
+func lockDeniedActions(path string, conflict *model.Lock) []nextAction {
+	return []nextAction{
+		{Command: fmt.Sprintf("cm send %s %q", conflict.AgentID, "please release "+path),
+			Reason: "ask the holder to release it"},
+		{Command: "cm watch", Reason: "wait for the holder's release message"},
+		{Command: "cm lock " + path, Reason: fmt.Sprintf("retry after release (expires %s)",
+			conflict.ExpiresAt.Format("15:04:05"))},
+	}
+}
+
+// frontierActions suggests how to wait for, or unblock, an unsafe epoch.
+func frontierActions(ts model.Timestamp, blockedBy []model.Pointstamp) []nextAction {
+	actions := []nextAction{{
+		Command: fmt.Sprintf("cm gate --epoch %d --round %d", ts.Epoch, ts.Round),
+		Reason:  "block until every agent has advanced past this point",
+	}}
+	for _, b := range blockedBy {
+		if b.EventID != 0 {
+			actions = append(actions, nextAction{
+				Command: fmt.Sprintf("cm send %s %q", b.AgentID,
+					fmt.Sprintf("waiting on you to read message #%d", b.EventID)),
+				Reason: fmt.Sprintf("%s has not read message #%d, sent at epoch=%d round=%d",
+					b.AgentID, b.EventID, b.Timestamp.Epoch, b.Timestamp.Round),
+			})
+			continue
+		}
+		actions = append(actions, nextAction{
+			Command: fmt.Sprintf("cm send %s %q", b.AgentID,
+				fmt.Sprintf("waiting on you to pass epoch %d", ts.Epoch)),
+			Reason: fmt.Sprintf("%s is still at epoch=%d round=%d", b.AgentID, b.Timestamp.Epoch, b.Timestamp.Round),
+		})
+	}
+	return actions
+}
+
+// frontierStatusActions returns frontierActions for an unsafe status and
+// nil for a safe one.
+func frontierStatusActions(ts model.Timestamp, st frontier.FrontierStatus) []nextAction {
+	if st.SafeToFinalize {
+		return nil
+	}
+	return frontierActions(ts, st.BlockedBy)
+}
+
+// workflowActions suggests how to satisfy each workflow violation.
+func workflowActions(vs []workflow.Violation) []nextAction {
+	var actions []nextAction
+	for _, v := range vs {
+		switch v.Rule {
+		case "review":
+			actions = append(actions, nextAction{
+				Command: "cm review-request <commit>",
+				Reason:  fmt.Sprintf("epoch %d needs a passing review before you leave it", v.Epoch),
+			})
+		case "gate":
+			actions = append(actions, nextAction{
+				Command: "cm workflow status",
+				Reason:  fmt.Sprintf("see which agents the gate on epoch %d is waiting for", v.Epoch),
+			})
+		case "role":
+			actions = append(actions, nextAction{
+				Command: "cm workflow status",
+				Reason:  fmt.Sprintf("see which epochs your role may enter (epoch %d is restricted)", v.Epoch),
+			})
+		case "ahead":
+			actions = append(actions, nextAction{
+				Command: "cm frontier",
+				Reason:  "see which agents are behind; wait for them or coordinate before moving on",
+			})
+		}
+	}
+	return actions
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/config"
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// initTemplate is a team preset for cm init --template: the agents to
+// register, the epochs to open and the settings to write. Roles are the
+// team's channels: agents reach a group with send role:<name>.
+type initTemplate struct {
+	Name   string
+	Desc   string
+	Agents []initAgent
+	Epochs []model.Epoch
+	Config []initSetting
+}
+
+type initAgent struct {
+	ID    string
+	Roles []string
+}
+
+type initSetting struct {
+	Key   string
+	Value string
+}
+
+// maxSwarm bounds swarm-N, which registers N agents.
+const maxSwarm = 64
+
+// initTemplateNames lists the presets for messages.
+const initTemplateNames = "pair, swarm-N (3 to 64 agents, e.g. swarm-6)"
+
+// lookupInitTemplate returns the preset called name.
+func lookupInitTemplate(name string) (*initTemplate, error) {
+	if name == "pair" {
+		return &initTemplate{
+			Name: "pair",
+			Desc: "one developer and one reviewer",
+			Agents: []initAgent{
+				{ID: "dev", Roles: []string{"implementer"}},
+				{ID: "reviewer", Roles: []string{"reviewer", "tester"}},
+			},
+			Epochs: []model.Epoch{{Epoch: 1, Description: "first change"}},
+			Config: []initSetting{
+				{"review.reviewer", "reviewer"},
+				{"lock.ttl", "30m"},
+			},
+		}, nil
+	}
+	if n, ok := strings.CutPrefix(name, "swarm-"); ok {
+		size, err := strconv.Atoi(n)
+		if err != nil || size < 3 || size > maxSwarm {
+			return nil, fmt.Errorf("template %q: a swarm has 3 to %d agents", name, maxSwarm)
+		}
+		t := &initTemplate{
+			Name: name,
+			Desc: fmt.Sprintf("a planner, a reviewer and %d workers", size-2),
+			Agents: []initAgent{
+				{ID: "planner", Roles: []string{"planner"}},
+				{ID: "reviewer", Roles: []string{"reviewer", "tester"}},
+			},
+			Epochs: []model.Epoch{
+				{Epoch: 1, Description: "plan"},
+				{Epoch: 2, Description: "build"},
+				{Epoch: 3, Description: "review"},
+			},
+			// Many agents share the database and lock the same files:
+			// queue writes, expire abandoned locks sooner and notice
+			// crashed sessions quickly.
+			Config: []initSetting{
+				{"review.reviewer", "reviewer"},
+				{"lock.ttl", "20m"},
+				{"presence.online", "1m"},
+				{"presence.idle", "5m"},
+				{"poll.watch_interval", "500ms"},
+				{"db.dedicated_writer", "1"},
+			},
+		}
+		for i := 1; i <= size-2; i++ {
+			t.Agents = append(t.Agents, initAgent{ID: fmt.Sprintf("worker-%d", i), Roles: []string{"worker"}})
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("no init template %q (have %s)", name, initTemplateNames)
+}
+
+// initTemplateResult is what applying a preset did.
+type initTemplateResult struct {
+	Template   string
+	Registered []initAgent
+	Epochs     []int64
+	Written    []initSetting
+	Kept       []initSetting // already set in the file, so left alone
+}
+
+// applyInitTemplate registers t's agents with their roles, opens its
+// epochs (as its first agent, the coordinator) and writes its settings to
+// the config file. Settings the file already has are kept, so applying a
+// preset to an existing workspace does not undo a team's own tuning.
+// Agents still run cm register themselves to get their session token and
+// signing key.
+func (a *app) applyInitTemplate(t *initTemplate) (*initTemplateResult, error) {
+	res := &initTemplateResult{Template: t.Name}
+	for _, ag := range t.Agents {
+		if _, err := a.store.RegisterAgent(ag.ID); err != nil {
+			return nil, fmt.Errorf("register %s: %w", ag.ID, err)
+		}
+		if err := a.store.SetRoles(ag.ID, ag.Roles); err != nil {
+			return nil, fmt.Errorf("roles for %s: %w", ag.ID, err)
+		}
+		res.Registered = append(res.Registered, ag)
+	}
+
+	coordinator := t.Agents[0].ID
+	for _, ep := range t.Epochs {
+		if existing, err := a.store.GetEpoch(ep.Epoch); err == nil && existing != nil {
+			continue
+		}
+		if _, err := a.store.OpenEpoch(ep.Epoch, ep.Description, coordinator); err != nil {
+			return nil, fmt.Errorf("open epoch %d: %w", ep.Epoch, err)
+		}
+		if _, err := a.recordEvent(coordinator, model.EventEpoch, strconv.FormatInt(ep.Epoch, 10), "open: "+ep.Description); err != nil {
+			a.logger().Warn("record epoch_open event", "err", err)
+		}
+		res.Epochs = append(res.Epochs, ep.Epoch)
+	}
+
+	cfg, err := config.Load(configPath())
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	for _, st := range t.Config {
+		if v, set := cfg.Get(st.Key); set {
+			res.Kept = append(res.Kept, initSetting{st.Key, v})
+			continue
+		}
+		if err := cfg.Set(st.Key, st.Value); err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+		res.Written = append(res.Written, st)
+	}
+	if len(res.Written) > 0 {
+		if err := cfg.Save(); err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+		a.cfg = cfg
+	}
+	return res, nil
+}
+
+// roleChannels returns the role:<name> addresses t's agents are reachable
+// by, in order of first use.
+func (t *initTemplate) roleChannels() []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, ag := range t.Agents {
+		for _, r := range ag.Roles {
+			if !seen[r] {
+				seen[r] = true
+				out = append(out, "role:"+r)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/daviddao/clockmail/pkg/worktree"
+)
+
+// lockPath is the name cm lock and unlock use for a path: inside a git
+// working tree, slash-separated and relative to the tree's root, so that
+// agents in separate worktrees of one repository (or in different
+// directories of one) lock the same file under the same name. Paths
+// outside the tree, or given when cm runs outside one, are kept as given.
+func (a *app) lockPath(p string) string {
+	repo := a.worktree()
+	if repo == nil {
+		return p
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return p
+	}
+	if rel, ok := repo.Rel(dir, p); ok {
+		return rel
+	}
+	// git reports the root with symlinks resolved.
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		if rel, ok := repo.Rel(real, p); ok {
+			return rel
+		}
+	}
+	return p
+}
+
+// worktree returns the git working tree containing the working
+// directory, or nil outside one, and tells the store its root, so locks
+// record where the holder's copy of a file is. It asks git once per
+// invocation.
+func (a *app) worktree() *worktree.Repo {
+	if a.repoKnown {
+		return a.repo
+	}
+	a.repoKnown = true
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	if a.repo, err = worktree.Open(dir); err != nil {
+		a.logger().Debug("lock paths stay as given: not in a git working tree", "err", err)
+		a.repo = nil
+		return nil
+	}
+	a.store.SetWorktree(a.repo.Root)
+	return a.repo
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logSettings are the diagnostics settings of one invocation, from
+// CLOCKMAIL_LOG and the global --verbose and --quiet flags.
+type logSettings struct {
+	level slog.Level
+	json  bool
+	quiet bool // --quiet was passed (cm send also keeps its inbox to itself)
+}
+
+// defaultLogger is used by apps built without newApp, and reports
+// warnings as they always were reported: on stderr.
+var defaultLogger = newLogger(os.Stderr, logSettings{level: slog.LevelWarn})
+
+// parseLogEnv reads CLOCKMAIL_LOG: a comma-separated list of a level
+// (debug, info, warn, error) and a format (text, json), e.g. "debug,json".
+// Unset means warnings and errors, as key=value text.
+func parseLogEnv(v string) (logSettings, error) {
+	ls := logSettings{level: slog.LevelWarn}
+	for _, f := range strings.Split(v, ",") {
+		switch f = strings.ToLower(strings.TrimSpace(f)); f {
+		case "":
+		case "json":
+			ls.json = true
+		case "text":
+			ls.json = false
+		default:
+			if err := ls.level.UnmarshalText([]byte(f)); err != nil {
+				return ls, fmt.Errorf("CLOCKMAIL_LOG: unknown setting %q (want debug, info, warn, error, text or json)", f)
+			}
+		}
+	}
+	return ls, nil
+}
+
+// splitLogFlags removes the global --verbose and --quiet flags from a
+// command's arguments, wherever they appear before a "--" terminator.
+// --verbose logs at debug level and --quiet only errors; either overrides
+// the level in ls.
+func splitLogFlags(args []string, ls logSettings) (logSettings, []string) {
+	rest := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		switch strings.TrimLeft(arg, "-") {
+		case "verbose":
+			if strings.HasPrefix(arg, "-") {
+				ls.level = slog.LevelDebug
+				continue
+			}
+		case "quiet":
+			if strings.HasPrefix(arg, "-") {
+				ls.level, ls.quiet = slog.LevelError, true
+				continue
+			}
+		}
+		rest = append(rest, arg)
+	}
+	return ls, rest
+}
+
+// newLogger returns a logger writing one line per record to w, prefixed
+// "cm: " in text form. Timestamps are only written at debug level or as
+// JSON, where interleaving between concurrent agents is what is being
+// debugged.
+func newLogger(w io.Writer, ls logSettings) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: ls.level}
+	if ls.json {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	if ls.level > slog.LevelDebug {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	return slog.New(slog.NewTextHandler(prefixWriter{w, "cm: "}, opts))
+}
+
+// prefixWriter prepends prefix to every write. slog handlers write each
+// record with a single call, so that is once per line.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+}
+
+func (p prefixWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(p.w, p.prefix); err != nil {
+		return 0, err
+	}
+	return p.w.Write(b)
+}
+
+// logger returns the invocation's logger.
+func (a *app) logger() *slog.Logger {
+	if a.log == nil {
+		return defaultLogger
+	}
+	return a.log
+}
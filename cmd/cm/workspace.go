@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The workspace is the directory holding .clockmail. Like git with .git,
+// cm looks for it in the working directory and then in each parent, so
+// commands work from anywhere inside a project. A directory is a
+// workspace if its .clockmail has the marker cm init writes, or a
+// database (workspaces from before the marker).
+
+// workspaceMarker is the file cm init creates in .clockmail to mark the
+// workspace root.
+const workspaceMarker = "workspace"
+
+// workspaceRoot is the workspace found by findWorkspace, or "" for the
+// working directory. Everything cm keeps in .clockmail (the database,
+// keys, session tokens, config) is resolved against it.
+var workspaceRoot string
+
+// findWorkspace returns the nearest directory at or above dir that is a
+// workspace.
+func findWorkspace(dir string) (string, bool) {
+	for {
+		for _, name := range []string{workspaceMarker, "clockmail.db"} {
+			if _, err := os.Stat(filepath.Join(dir, defaultDir, name)); err == nil {
+				return dir, true
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// useWorkspace finds the workspace for the working directory and sets
+// workspaceRoot. It reports whether one was found.
+func useWorkspace() (bool, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return false, err
+	}
+	root, ok := findWorkspace(wd)
+	if ok && root != wd {
+		workspaceRoot = root
+	}
+	return ok, nil
+}
+
+// workspacePath returns the path of name in the workspace's .clockmail.
+func workspacePath(name string) string {
+	return filepath.Join(workspaceRoot, defaultDir, name)
+}
+
+// markWorkspace creates .clockmail and its marker in the working
+// directory, making it a workspace root.
+func markWorkspace() error {
+	if err := os.MkdirAll(workspacePath(""), 0755); err != nil {
+		return err
+	}
+	marker := workspacePath(workspaceMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+	return os.WriteFile(marker, []byte("# clockmail workspace root (created by cm init)\n"), 0644)
+}
+
+// errNoWorkspace is returned outside any workspace.
+func errNoWorkspace() error {
+	wd, _ := os.Getwd()
+	return fmt.Errorf("no clockmail workspace in %s or any parent directory (run cm init in the project root, or use --db PATH)", wd)
+}
+
+// splitDB removes the global --db flag from a command's arguments,
+// wherever it appears before a "--" terminator, and returns its value
+// ("" if absent) with the remaining arguments.
+func splitDB(args []string) (string, []string, error) {
+	var db string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "db" {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return "", nil, fmt.Errorf("flag needs an argument: %s", arg)
+			}
+			i++
+			value = args[i]
+		}
+		db = value
+	}
+	return db, rest, nil
+}
@@ -0,0 +1,444 @@
+// Package config reads and writes the project configuration file,
+// .clockmail/config.toml, which sets team-wide defaults for flags that
+// would otherwise have to be passed on every invocation:
+//
+//	[lock]
+//	ttl = "2h"                # cm lock --ttl, heartbeat/sync --lock-ttl
+//
+//	[presence]
+//	online = "2m"             # seen this recently: online
+//	idle = "30m"              # then idle until this, then offline
+//	active = "1h"             # seen this recently: counts toward the frontier
+//
+//	[review]
+//	reviewer = "tester"       # cm review-request --to, cm hook install --reviewer
+//
+//	[poll]
+//	watch_interval = "1s"     # cm watch --interval
+//	gate_interval = "5s"      # cm gate --interval
+//
+//	[retention]
+//	keep_days = 14            # cm gc --keep-days
+//	keep_events = 5000        # cm gc --keep-events
+//
+//	[templates]
+//	handoff = "[handoff] {file}\nnext: {next}"   # cm send --template handoff
+//
+//	[webhooks]
+//	review_req = "https://hooks.slack.com/services/..."   # cm notify daemon
+//	lock_conflict = "https://example.com/hook"
+//
+// Flags override the file, and the file overrides built-in defaults.
+// Only the subset of TOML the file needs is understood: [table] headers,
+// key = value pairs with string, integer or boolean values, and comments.
+// Unknown keys are rejected so that a typo does not silently leave a
+// default in place; the [templates] table is the exception, since its
+// keys are the names of the templates it defines, and [webhooks] takes
+// only the events in WebhookEvents.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the type of a setting's value.
+type Kind string
+
+const (
+	String   Kind = "string"
+	Int      Kind = "int"
+	Duration Kind = "duration"
+	URL      Kind = "url"
+)
+
+// Key describes a setting the file may contain.
+type Key struct {
+	Name    string `json:"name"` // "table.key"
+	Kind    Kind   `json:"kind"`
+	Default string `json:"default"`
+	Doc     string `json:"doc"`
+}
+
+// Keys lists every known setting, in the order cm config list shows them.
+var Keys = []Key{
+	{"lock.ttl", Duration, "1h", "lock time-to-live (cm lock --ttl, heartbeat/sync --lock-ttl)"},
+	{"presence.online", Duration, "2m", "agents seen within this are online"},
+	{"presence.idle", Duration, "10m", "agents seen within this are idle, after it offline"},
+	{"presence.active", Duration, "10m", "agents seen within this count toward the frontier (cm frontier, gate, status)"},
+	{"health.stale", Duration, "10m", "cm status warns of lock holders whose clock has not ticked for this long (0 = never)"},
+	{"health.epoch_lag", Int, "2", "cm status warns of agents this many epochs behind the median (0 = never)"},
+	{"health.expiry", Duration, "5m", "cm status warns of locks expiring within this (0 = never)"},
+	{"health.backlog", Int, "50", "cm status warns of agents with more unread messages than this (0 = never)"},
+	{"reap.after", Duration, "1h", "cm reap departs agents not seen for this long (cm reap --older-than)"},
+	{"reap.fallback", String, "", "agent cm reap bounces a reaped agent's unread messages to (cm reap --fallback)"},
+	{"reap.auto", Int, "0", "1 runs the reap policy at the start of every command"},
+	{"review.reviewer", String, "tester", "reviewer asked by cm review-request and the post-commit hook"},
+	{"poll.watch_interval", Duration, "1s", "how often cm watch polls"},
+	{"poll.gate_interval", Duration, "2s", "how often cm gate polls the frontier"},
+	{"retention.keep_days", Int, "30", "cm gc keeps events newer than this many days (0 = no age limit)"},
+	{"retention.keep_events", Int, "1000", "cm gc always keeps the newest this many events"},
+	{"send.max_body", Int, "8192", "bodies larger than this many bytes become attachments (0 = never)"},
+	{"branch.scoped", Int, "0", "1 scopes locks and messages to the checked-out git branch, as --branch-scoped does"},
+	{"db.max_conns", Int, "4", "database connections each cm process may open"},
+	{"db.dedicated_writer", Int, "0", "1 sends all writes through one connection (SQLite; less SQLITE_BUSY churn with many agents)"},
+}
+
+// ErrUnknownKey is returned for settings not in Keys.
+var ErrUnknownKey = errors.New("unknown setting")
+
+// TemplatePrefix begins the names of message templates: the setting
+// "templates.handoff" defines the template cm send --template handoff uses.
+const TemplatePrefix = "templates."
+
+// WebhookPrefix begins the names of webhook settings: "webhooks.review_req"
+// is the URL cm notify daemon POSTs review requests to.
+const WebhookPrefix = "webhooks."
+
+// WebhookEvents are the events a webhook can be set for: event kinds, and
+// lock_conflict for lock requests that were denied.
+var WebhookEvents = []string{"msg", "review_req", "review_done", "lock_conflict", "gate_result", "epoch", "departed", "reaped", "spawn"}
+
+// Lookup returns the known setting called name.
+func Lookup(name string) (Key, bool) {
+	for _, k := range Keys {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	if t, ok := strings.CutPrefix(name, TemplatePrefix); ok && validTemplateName(t) {
+		return Key{name, String, "", "message template (cm send --template " + t + ")"}, true
+	}
+	if ev, ok := strings.CutPrefix(name, WebhookPrefix); ok && slices.Contains(WebhookEvents, ev) {
+		return Key{name, URL, "", "URL cm notify daemon POSTs " + ev + " events to"}, true
+	}
+	return Key{}, false
+}
+
+// validTemplateName reports whether s is lowercase letters, digits, "-"
+// and "_", starting with a letter.
+func validTemplateName(s string) bool {
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '-' || r == '_'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Check reports whether value is valid for the setting.
+func (k Key) Check(value string) error {
+	switch k.Kind {
+	case Int:
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("%s: %q is not a non-negative integer", k.Name, value)
+		}
+	case Duration:
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("%s: %q is not a duration like 90s or 2h", k.Name, value)
+		}
+	case URL:
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: %q is not an http(s) URL", k.Name, value)
+		}
+	}
+	return nil
+}
+
+// Config is a loaded configuration file. The zero value, and a nil
+// *Config, hold no settings: every getter returns the built-in default.
+type Config struct {
+	Path   string
+	values map[string]string
+	lines  []string // the file as read, kept so Save preserves comments
+}
+
+// Load reads the file at path. A missing file is an empty configuration.
+func Load(path string) (*Config, error) {
+	c := &Config{Path: path, values: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.parse(string(data)); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse reads configuration from src, as Load does from a file.
+func Parse(src string) (*Config, error) {
+	c := &Config{values: map[string]string{}}
+	if err := c.parse(src); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) parse(src string) error {
+	c.lines = strings.Split(strings.TrimSuffix(src, "\n"), "\n")
+	if src == "" {
+		c.lines = nil
+	}
+	table := ""
+	for i, line := range c.lines {
+		text := strings.TrimSpace(stripComment(line))
+		switch {
+		case text == "":
+			continue
+		case strings.HasPrefix(text, "["):
+			if !strings.HasSuffix(text, "]") || strings.HasPrefix(text, "[[") {
+				return fmt.Errorf("line %d: malformed table header %q", i+1, text)
+			}
+			table = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+		name, raw, ok := strings.Cut(text, "=")
+		if !ok {
+			return fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		name = strings.TrimSpace(name)
+		if table != "" {
+			name = table + "." + name
+		}
+		k, ok := Lookup(name)
+		if !ok {
+			return fmt.Errorf("line %d: %w %q", i+1, ErrUnknownKey, name)
+		}
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %w", i+1, name, err)
+		}
+		if err := k.Check(value); err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if _, dup := c.values[name]; dup {
+			return fmt.Errorf("line %d: %s is set twice", i+1, name)
+		}
+		c.values[name] = value
+	}
+	return nil
+}
+
+// stripComment removes a trailing # comment that is not inside a string.
+func stripComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseValue decodes a basic or literal string, an integer or a boolean,
+// returning its text.
+func parseValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		s, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("malformed string %s", raw)
+		}
+		return s, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", fmt.Errorf("malformed string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	if _, err := strconv.ParseInt(strings.ReplaceAll(raw, "_", ""), 10, 64); err != nil {
+		return "", fmt.Errorf("unsupported value %s (use a quoted string or an integer)", raw)
+	}
+	return strings.ReplaceAll(raw, "_", ""), nil
+}
+
+// Get returns the value of a setting and whether the file sets it. Unset
+// settings return their default.
+func (c *Config) Get(name string) (string, bool) {
+	if c != nil {
+		if v, ok := c.values[name]; ok {
+			return v, true
+		}
+	}
+	k, _ := Lookup(name)
+	return k.Default, false
+}
+
+// String returns a string setting.
+func (c *Config) String(name string) string {
+	v, _ := c.Get(name)
+	return v
+}
+
+// Int returns an integer setting.
+func (c *Config) Int(name string) int {
+	n, _ := strconv.Atoi(c.String(name))
+	return n
+}
+
+// Duration returns a duration setting.
+func (c *Config) Duration(name string) time.Duration {
+	d, _ := time.ParseDuration(c.String(name))
+	return d
+}
+
+// Set changes a setting in memory; Save writes it out.
+func (c *Config) Set(name, value string) error {
+	k, ok := Lookup(name)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, name)
+	}
+	if err := k.Check(value); err != nil {
+		return err
+	}
+	if c.values == nil {
+		c.values = map[string]string{}
+	}
+	c.values[name] = value
+	c.lines = setLine(c.lines, k, value)
+	return nil
+}
+
+// Unset removes a setting, returning whether the file had it.
+func (c *Config) Unset(name string) bool {
+	if _, ok := c.values[name]; !ok {
+		return false
+	}
+	delete(c.values, name)
+	if i, _ := findLine(c.lines, name); i >= 0 {
+		c.lines = append(c.lines[:i], c.lines[i+1:]...)
+	}
+	return true
+}
+
+// Names returns the settings the file sets, sorted.
+func (c *Config) Names() []string {
+	var names []string
+	if c != nil {
+		for n := range c.values {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Templates returns the message templates the file defines, by name.
+func (c *Config) Templates() map[string]string {
+	out := map[string]string{}
+	for _, n := range c.Names() {
+		if t, ok := strings.CutPrefix(n, TemplatePrefix); ok {
+			out[t] = c.values[n]
+		}
+	}
+	return out
+}
+
+// Webhooks returns the webhook URLs the file sets, by event.
+func (c *Config) Webhooks() map[string]string {
+	out := map[string]string{}
+	for _, n := range c.Names() {
+		if ev, ok := strings.CutPrefix(n, WebhookPrefix); ok {
+			out[ev] = c.values[n]
+		}
+	}
+	return out
+}
+
+// Save writes the configuration back to its file, keeping the comments
+// and layout of the original.
+func (c *Config) Save() error {
+	data := strings.Join(c.lines, "\n")
+	if data != "" {
+		data += "\n"
+	}
+	return os.WriteFile(c.Path, []byte(data), 0644)
+}
+
+// findLine returns the index of the line setting name, or -1, and the
+// index of the last line of name's table, or -1 if the file has no such
+// table.
+func findLine(lines []string, name string) (at, tableEnd int) {
+	table, key := "", name
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		table, key = name[:i], name[i+1:]
+	}
+	at, tableEnd = -1, -1
+	current := ""
+	for i, line := range lines {
+		text := strings.TrimSpace(stripComment(line))
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			current = strings.TrimSpace(text[1 : len(text)-1])
+			if current == table {
+				tableEnd = i
+			}
+			continue
+		}
+		if current != table {
+			continue
+		}
+		if text != "" {
+			tableEnd = i
+		}
+		if k, _, ok := strings.Cut(text, "="); ok && strings.TrimSpace(k) == key {
+			at = i
+		}
+	}
+	return at, tableEnd
+}
+
+// setLine replaces the line setting k, or adds one to k's table, adding
+// the table at the end if the file has none.
+func setLine(lines []string, k Key, value string) []string {
+	table, key := k.Name[:strings.LastIndex(k.Name, ".")], k.Name[strings.LastIndex(k.Name, ".")+1:]
+	text := value
+	if k.Kind != Int {
+		text = strconv.Quote(value)
+	}
+	line := key + " = " + text
+	at, tableEnd := findLine(lines, k.Name)
+	switch {
+	case at >= 0:
+		// Keep a trailing comment.
+		if c := lines[at][len(stripComment(lines[at])):]; c != "" {
+			line += " " + c
+		}
+		lines[at] = line
+	case tableEnd >= 0:
+		lines = append(lines[:tableEnd+1], append([]string{line}, lines[tableEnd+1:]...)...)
+	default:
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+table+"]", line)
+	}
+	return lines
+}
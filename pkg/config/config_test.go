@@ -0,0 +1,174 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sample = `# team defaults
+[lock]
+ttl = "2h"   # long refactors
+
+[retention]
+keep_days = 14
+keep_events = 5_000
+
+[review]
+reviewer = 'qa'
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse(sample)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if d := c.Duration("lock.ttl"); d != 2*time.Hour {
+		t.Errorf("lock.ttl = %v", d)
+	}
+	if n := c.Int("retention.keep_events"); n != 5000 {
+		t.Errorf("retention.keep_events = %d", n)
+	}
+	if s := c.String("review.reviewer"); s != "qa" {
+		t.Errorf("review.reviewer = %q", s)
+	}
+	// Unset keys fall back to their defaults.
+	if v, set := c.Get("presence.idle"); set || v != "10m" {
+		t.Errorf("presence.idle = %q, set %v", v, set)
+	}
+	if got := strings.Join(c.Names(), ","); got != "lock.ttl,retention.keep_days,retention.keep_events,review.reviewer" {
+		t.Errorf("Names = %s", got)
+	}
+
+	var none *Config
+	if d := none.Duration("poll.gate_interval"); d != 2*time.Second {
+		t.Errorf("nil config: poll.gate_interval = %v", d)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, src := range []string{
+		"[lock]\ntl = \"1h\"",          // unknown key
+		"[lock]\nttl = \"soon\"",       // bad duration
+		"[retention]\nkeep_days = -1",  // negative
+		"[retention]\nkeep_days = 1.5", // float
+		"[lock\nttl = \"1h\"",          // header
+		"[lock]\nttl",                  // no value
+		"[lock]\nttl = \"1h\"\nttl = \"2h\"",
+	} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("Parse(%q) should fail", src)
+		}
+	}
+	if _, err := Parse("[lock]\ntll = \"1h\""); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unknown key: err = %v", err)
+	}
+}
+
+func TestSetAndSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(sample), 0644)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := c.Set("lock.ttl", "3h"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.Set("retention.keep_days", "7"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.Set("poll.watch_interval", "5s"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.Set("lock.ttl", "never"); err == nil {
+		t.Fatal("Set accepted an invalid duration")
+	}
+	if err := c.Set("lock.tll", "1h"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Set unknown key: err = %v", err)
+	}
+	if !c.Unset("review.reviewer") || c.Unset("review.reviewer") {
+		t.Fatal("Unset should report whether the key was set")
+	}
+	if err := c.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	want := `# team defaults
+[lock]
+ttl = "3h" # long refactors
+
+[retention]
+keep_days = 7
+keep_events = 5_000
+
+[review]
+
+[poll]
+watch_interval = "5s"
+`
+	if string(data) != want {
+		t.Fatalf("saved file:\n%s\nwant:\n%s", data, want)
+	}
+	c, err = Load(path)
+	if err != nil || c.Duration("poll.watch_interval") != 5*time.Second || c.String("review.reviewer") != "tester" {
+		t.Fatalf("reloaded: %v, %+v", err, c)
+	}
+}
+
+func TestLoad_Missing(t *testing.T) {
+	c, err := Load(filepath.Join(t.TempDir(), "config.toml"))
+	if err != nil || len(c.Names()) != 0 {
+		t.Fatalf("Load missing file = %+v, %v", c, err)
+	}
+	c.Set("lock.ttl", "30m")
+	if err := c.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	data, _ := os.ReadFile(c.Path)
+	if string(data) != "[lock]\nttl = \"30m\"\n" {
+		t.Fatalf("new file = %q", data)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	c, err := Parse("[templates]\nhandoff = \"[handoff] {file}\\nnext: {next}\"\nready-for-review = 'ready: {branch}'\n")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	got := c.Templates()
+	if len(got) != 2 || got["handoff"] != "[handoff] {file}\nnext: {next}" || got["ready-for-review"] != "ready: {branch}" {
+		t.Fatalf("Templates = %q", got)
+	}
+	for _, src := range []string{"[templates]\nHandoff = 'x'", "[templates]\n9lives = 'x'"} {
+		if _, err := Parse(src); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("Parse(%q): err = %v, want ErrUnknownKey", src, err)
+		}
+	}
+	if err := c.Set("templates.blocker", "[blocker] {on}"); err != nil || c.Templates()["blocker"] != "[blocker] {on}" {
+		t.Fatalf("Set template: %v", err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	c, err := Parse("[webhooks]\nreview_req = \"https://hooks.slack.com/services/T/B/X\"\nlock_conflict = 'http://localhost:9000/cm'\n")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	got := c.Webhooks()
+	if len(got) != 2 || got["review_req"] != "https://hooks.slack.com/services/T/B/X" || got["lock_conflict"] != "http://localhost:9000/cm" {
+		t.Fatalf("Webhooks = %q", got)
+	}
+	if _, err := Parse("[webhooks]\nreview_request = 'https://example.com'"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unknown event: err = %v, want ErrUnknownKey", err)
+	}
+	for _, v := range []string{"example.com/hook", "ftp://example.com", "https://"} {
+		if err := c.Set("webhooks.msg", v); err == nil {
+			t.Errorf("Set webhooks.msg %q: want an error", v)
+		}
+	}
+}
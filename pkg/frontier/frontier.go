@@ -10,17 +10,23 @@
 // tells each agent exactly when it is safe to commit.
 package frontier
 
-import "github.com/daviddao/clockmail/pkg/model"
+import (
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
 
 // ComputeFrontier returns the antichain of minimal active pointstamps.
 // A pointstamp p is in the frontier iff no other active pointstamp q
-// satisfies q.Timestamp < p.Timestamp (strictly less).
+// satisfies q.Timestamp < p.Timestamp (strictly less). An agent's unread
+// messages are pointstamps of their own, so an old message can keep its
+// recipient's position out of the frontier.
 func ComputeFrontier(active []model.Pointstamp) []model.Pointstamp {
 	var frontier []model.Pointstamp
-	for _, p := range active {
+	for i, p := range active {
 		dominated := false
-		for _, q := range active {
-			if q.AgentID != p.AgentID && q.Timestamp.Less(p.Timestamp) {
+		for j, q := range active {
+			if i != j && q.Timestamp.Less(p.Timestamp) {
 				dominated = true
 				break
 			}
@@ -44,7 +50,9 @@ type FrontierStatus struct {
 // at timestamp ts, given the set of active pointstamps from all agents.
 //
 // An agent is safe to finalize at ts when no other agent has outstanding
-// work at any timestamp <= ts. The returned status includes the computed
+// work at any timestamp <= ts: neither a working position nor an unread
+// message in its inbox sent at such a timestamp. The agent's own unread
+// messages do not block it. The returned status includes the computed
 // frontier and the list of blocking pointstamps (if any).
 func ComputeFrontierStatus(agentID string, ts model.Timestamp, active []model.Pointstamp) FrontierStatus {
 	f := ComputeFrontier(active)
@@ -63,3 +71,77 @@ func ComputeFrontierStatus(agentID string, ts model.Timestamp, active []model.Po
 	}
 	return status
 }
+
+// Scoped keeps the pointstamps that matter to work in scope: those of
+// agents with a scope (agent ID -> the scopes it declared and the paths
+// it locks) overlapping it, and of agents that declared none and may be
+// working anywhere. An empty scope keeps everything. Unread messages
+// count under their recipient.
+func Scoped(active []model.Pointstamp, scope string, scopes map[string][]string) []model.Pointstamp {
+	if scope == "" {
+		return active
+	}
+	var out []model.Pointstamp
+	for _, p := range active {
+		theirs := scopes[p.AgentID]
+		keep := len(theirs) == 0
+		for _, s := range theirs {
+			if Overlaps(scope, s) {
+				keep = true
+				break
+			}
+		}
+		if keep {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Overlaps reports whether two scopes, path prefixes or module names,
+// can cover the same files: one equals the other or lies under it, so
+// pkg/store overlaps pkg/store/store.go but not pkg/storage. An empty
+// scope overlaps everything.
+func Overlaps(a, b string) bool {
+	a, b = strings.Trim(a, "/"), strings.Trim(b, "/")
+	if a == "" || b == "" || a == b {
+		return true
+	}
+	return strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// Rollup folds the pointstamps of sub-agents into their top-level
+// ancestor, found by following parents (agent ID -> parent ID). Each
+// ancestor is reported once, at the greatest lower bound of its own
+// timestamp and those of its descendants: an orchestrator is only as far
+// along as its slowest worker. Order follows the first appearance of each
+// ancestor in ps.
+func Rollup(ps []model.Pointstamp, parents map[string]string) []model.Pointstamp {
+	var out []model.Pointstamp
+	index := make(map[string]int)
+	for _, p := range ps {
+		root := Root(p.AgentID, parents)
+		i, ok := index[root]
+		if !ok {
+			index[root] = len(out)
+			out = append(out, model.Pointstamp{AgentID: root, Timestamp: p.Timestamp})
+			continue
+		}
+		out[i].Timestamp = out[i].Timestamp.Meet(p.Timestamp)
+	}
+	return out
+}
+
+// Root returns the top-level ancestor of agentID. Cycles, which the store
+// prevents, end the walk rather than looping forever.
+func Root(agentID string, parents map[string]string) string {
+	seen := map[string]bool{agentID: true}
+	for {
+		parent := parents[agentID]
+		if parent == "" || seen[parent] {
+			return agentID
+		}
+		seen[parent] = true
+		agentID = parent
+	}
+}
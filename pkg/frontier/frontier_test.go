@@ -84,6 +84,28 @@ func TestComputeFrontier_ThreeAgents_MixedDomination(t *testing.T) {
 	}
 }
 
+func TestComputeFrontier_UnreadMessage(t *testing.T) {
+	msg := ps("bob", 1, 0)
+	msg.EventID = 7
+	active := []model.Pointstamp{
+		ps("alice", 2, 0),
+		ps("bob", 2, 0), // dominated by the message bob has not read
+		msg,
+	}
+	f := ComputeFrontier(active)
+	if len(f) != 1 || f[0].EventID != 7 {
+		t.Fatalf("frontier = %+v, want only bob's unread message", f)
+	}
+	status := ComputeFrontierStatus("alice", ts(1, 0), active)
+	if status.SafeToFinalize || len(status.BlockedBy) != 1 || status.BlockedBy[0].EventID != 7 {
+		t.Fatalf("alice at (1,0) should wait for bob to read #7: %+v", status)
+	}
+	// bob's own inbox does not hold bob back.
+	if status := ComputeFrontierStatus("bob", ts(1, 0), active); !status.SafeToFinalize {
+		t.Fatalf("bob should be safe: %+v", status)
+	}
+}
+
 func TestComputeFrontierStatus_Safe(t *testing.T) {
 	active := []model.Pointstamp{
 		ps("alice", 1, 0),
@@ -153,3 +175,75 @@ func TestComputeFrontierStatus_IncludesFrontier(t *testing.T) {
 		t.Fatal("status should include computed frontier")
 	}
 }
+
+func TestScoped(t *testing.T) {
+	active := []model.Pointstamp{ps("alice", 1, 0), ps("bob", 1, 0), ps("carol", 1, 0), ps("dave", 1, 0)}
+	scopes := map[string][]string{
+		"alice": {"pkg/store"},
+		"bob":   {"pkg/web", "pkg/store/store.go"}, // a lock inside pkg/store
+		"carol": {"pkg/storage"},
+		// dave declared nothing
+	}
+	var got []string
+	for _, p := range Scoped(active, "pkg/store/", scopes) {
+		got = append(got, p.AgentID)
+	}
+	if len(got) != 3 || got[0] != "alice" || got[1] != "bob" || got[2] != "dave" {
+		t.Fatalf("Scoped(pkg/store) kept %v, want alice, bob, dave", got)
+	}
+	if len(Scoped(active, "", scopes)) != 4 {
+		t.Fatal("an empty scope should keep everything")
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"pkg/store", "pkg/store", true},
+		{"pkg/store", "pkg/store/store.go", true},
+		{"pkg/store/", "pkg", true},
+		{"pkg/store", "pkg/storage", false},
+		{"store", "web", false},
+		{"", "web", true},
+	}
+	for _, c := range cases {
+		if got := Overlaps(c.a, c.b); got != c.want {
+			t.Errorf("Overlaps(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestRollup(t *testing.T) {
+	parents := map[string]string{"w1": "orch", "w2": "orch", "w2a": "w2"}
+	active := []model.Pointstamp{
+		ps("orch", 3, 0),
+		ps("w1", 2, 4),
+		ps("bob", 1, 0),
+		ps("w2a", 5, 1),
+	}
+	got := Rollup(active, parents)
+	if len(got) != 2 {
+		t.Fatalf("rollup: got %d pointstamps, want 2 (orch, bob): %+v", len(got), got)
+	}
+	if got[0].AgentID != "orch" || !got[0].Timestamp.Equal(ts(2, 0)) {
+		t.Fatalf("orch should roll up to the meet (2,0), got %+v", got[0])
+	}
+	if got[1].AgentID != "bob" || !got[1].Timestamp.Equal(ts(1, 0)) {
+		t.Fatalf("bob has no children and should be unchanged, got %+v", got[1])
+	}
+}
+
+func TestRollup_ChildWithoutActiveParent(t *testing.T) {
+	got := Rollup([]model.Pointstamp{ps("w1", 2, 0)}, map[string]string{"w1": "orch"})
+	if len(got) != 1 || got[0].AgentID != "orch" {
+		t.Fatalf("an idle parent should still stand in for its child, got %+v", got)
+	}
+}
+
+func TestRoot_Cycle(t *testing.T) {
+	if got := Root("a", map[string]string{"a": "b", "b": "a"}); got != "b" {
+		t.Fatalf("Root on a cycle = %q, want b", got)
+	}
+}
@@ -0,0 +1,572 @@
+// Package libsql is a database/sql driver for remote libSQL databases
+// (Turso, or a self-hosted sqld), speaking the server's HTTP pipeline
+// protocol (Hrana over HTTP, /v2/pipeline). It lets agents on different
+// machines share one hosted SQLite database with the same schema as a
+// local file.
+//
+// It is deliberately small: the statements clockmail runs, with
+// transactions kept on one server-side stream through its baton, and no
+// dependency beyond net/http. Importing the package registers the driver
+// as "libsql".
+//
+// DSNs look like libsql://<db>-<org>.turso.io?authToken=TOKEN, which
+// connects over HTTPS; add tls=0 for a local sqld over plain HTTP
+// (libsql://127.0.0.1:8080?tls=0). busyTimeout=MS sets how long each
+// statement waits for another writer's lock on the server (default
+// 60000, as for a local database).
+package libsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() { sql.Register("libsql", &Driver{}) }
+
+// Timeout bounds each round trip to the server. Remote writes wait for
+// the server's write lock as well as the network, so it is generous.
+const Timeout = 60 * time.Second
+
+// DefaultBusyTimeout is how long a statement waits for the server's
+// write lock unless the DSN says otherwise.
+const DefaultBusyTimeout = 60 * time.Second
+
+// Driver is the libsql database/sql driver.
+type Driver struct{}
+
+// Open connects to the database at dsn.
+func (Driver) Open(dsn string) (driver.Conn, error) {
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{cfg: cfg, url: cfg.URL, client: &http.Client{Timeout: Timeout}}, nil
+}
+
+// Config is a parsed DSN.
+type Config struct {
+	// URL is the server's base URL.
+	URL string
+	// Token is the auth token, if any.
+	Token string
+	// BusyTimeout is set on each stream with PRAGMA busy_timeout.
+	BusyTimeout time.Duration
+}
+
+// ParseDSN parses a libsql:// DSN.
+func ParseDSN(dsn string) (Config, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return Config{}, fmt.Errorf("libsql: %w", err)
+	}
+	if u.Scheme != "libsql" || u.Host == "" {
+		return Config{}, fmt.Errorf("libsql: %q is not a libsql://host DSN", Redact(dsn))
+	}
+	q := u.Query()
+	scheme := "https"
+	if q.Get("tls") == "0" {
+		scheme = "http"
+	}
+	cfg := Config{
+		URL:         scheme + "://" + u.Host + strings.TrimSuffix(u.Path, "/"),
+		Token:       q.Get("authToken"),
+		BusyTimeout: DefaultBusyTimeout,
+	}
+	if v := q.Get("busyTimeout"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return Config{}, fmt.Errorf("libsql: bad busyTimeout %q", v)
+		}
+		cfg.BusyTimeout = time.Duration(ms) * time.Millisecond
+	}
+	return cfg, nil
+}
+
+// Redact returns dsn with its auth token hidden, for messages.
+func Redact(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	q := u.Query()
+	if q.Get("authToken") == "" {
+		return dsn
+	}
+	q.Set("authToken", "xxx")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Error is an error reported by the server for a statement. Its text
+// carries the SQLite error code, so callers can tell SQLITE_BUSY from
+// other failures.
+type Error struct {
+	Message string
+	Code    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return "libsql: " + e.Message
+	}
+	return fmt.Sprintf("libsql: %s (%s)", e.Message, e.Code)
+}
+
+// ---------------------------------------------------------------------------
+// Protocol
+// ---------------------------------------------------------------------------
+
+type pipelineRequest struct {
+	Baton    *string         `json:"baton"`
+	Requests []streamRequest `json:"requests"`
+}
+
+type streamRequest struct {
+	Type string `json:"type"` // execute, sequence or close
+	Stmt *stmt  `json:"stmt,omitempty"`
+	SQL  string `json:"sql,omitempty"`
+}
+
+type stmt struct {
+	SQL      string  `json:"sql"`
+	Args     []value `json:"args,omitempty"`
+	WantRows bool    `json:"want_rows"`
+}
+
+type pipelineResponse struct {
+	Baton   *string        `json:"baton"`
+	BaseURL *string        `json:"base_url"`
+	Results []streamResult `json:"results"`
+}
+
+type streamResult struct {
+	Type     string `json:"type"` // ok or error
+	Response *struct {
+		Type   string      `json:"type"`
+		Result *stmtResult `json:"result"`
+	} `json:"response"`
+	Error *struct {
+		Message string `json:"message"`
+		Code    string `json:"code"`
+	} `json:"error"`
+}
+
+type stmtResult struct {
+	Cols []struct {
+		Name string `json:"name"`
+	} `json:"cols"`
+	Rows             [][]value `json:"rows"`
+	AffectedRowCount int64     `json:"affected_row_count"`
+	LastInsertRowid  *string   `json:"last_insert_rowid"`
+}
+
+// value is a protocol value: {"type": "integer", "value": "42"} and so on.
+type value struct {
+	Type   string      `json:"type"` // null, integer, float, text or blob
+	Value  interface{} `json:"value"`
+	Base64 string      `json:"base64"`
+}
+
+func (v value) MarshalJSON() ([]byte, error) {
+	switch v.Type {
+	case "null":
+		return []byte(`{"type":"null"}`), nil
+	case "blob":
+		return json.Marshal(map[string]string{"type": "blob", "base64": v.Base64})
+	}
+	return json.Marshal(map[string]interface{}{"type": v.Type, "value": v.Value})
+}
+
+func toValue(v driver.Value) (value, error) {
+	switch v := v.(type) {
+	case nil:
+		return value{Type: "null"}, nil
+	case int64:
+		return value{Type: "integer", Value: strconv.FormatInt(v, 10)}, nil
+	case float64:
+		return value{Type: "float", Value: v}, nil
+	case bool:
+		if v {
+			return value{Type: "integer", Value: "1"}, nil
+		}
+		return value{Type: "integer", Value: "0"}, nil
+	case string:
+		return value{Type: "text", Value: v}, nil
+	case []byte:
+		return value{Type: "blob", Base64: base64.StdEncoding.EncodeToString(v)}, nil
+	case time.Time:
+		return value{Type: "text", Value: v.Format(time.RFC3339Nano)}, nil
+	}
+	return value{}, fmt.Errorf("libsql: unsupported argument type %T", v)
+}
+
+func (v value) driverValue() (driver.Value, error) {
+	switch v.Type {
+	case "null":
+		return nil, nil
+	case "integer":
+		s, _ := v.Value.(string)
+		return strconv.ParseInt(s, 10, 64)
+	case "float":
+		f, _ := v.Value.(float64)
+		return f, nil
+	case "text":
+		s, _ := v.Value.(string)
+		return s, nil
+	case "blob":
+		return base64.StdEncoding.DecodeString(v.Base64)
+	}
+	return nil, fmt.Errorf("libsql: unknown value type %q", v.Type)
+}
+
+// ---------------------------------------------------------------------------
+// Connections
+// ---------------------------------------------------------------------------
+
+// conn is one server-side stream. Outside a transaction every request
+// closes its stream, since the server expires idle ones; a transaction
+// keeps its stream open by passing the baton along.
+type conn struct {
+	cfg    Config
+	url    string // cfg.URL, or where the server redirected the stream
+	client *http.Client
+	baton  string
+	inTx   bool
+	broken bool
+	// beginPending defers BEGIN until the transaction's first statement,
+	// saving a round trip.
+	beginPending bool
+}
+
+var (
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.Pinger             = (*conn)(nil)
+	_ driver.NamedValueChecker  = (*conn)(nil)
+	_ driver.ConnPrepareContext = (*conn)(nil)
+	_ driver.Validator          = (*conn)(nil)
+)
+
+// pipeline sends reqs on the connection's stream and returns their
+// results, failing on the first that failed.
+func (c *conn) pipeline(ctx context.Context, reqs []streamRequest) ([]*stmtResult, error) {
+	if c.broken {
+		return nil, driver.ErrBadConn
+	}
+	// Requests opening a stream first set its busy timeout, and a
+	// transaction's first request begins it; their results are dropped.
+	var prefix []streamRequest
+	if c.baton == "" && c.cfg.BusyTimeout > 0 {
+		prefix = append(prefix, streamRequest{Type: "execute", Stmt: &stmt{
+			SQL: fmt.Sprintf("PRAGMA busy_timeout = %d", c.cfg.BusyTimeout.Milliseconds())}})
+	}
+	if c.beginPending {
+		prefix = append(prefix, streamRequest{Type: "execute", Stmt: &stmt{SQL: "BEGIN"}})
+	}
+	reqs = append(prefix, reqs...)
+	if !c.inTx {
+		reqs = append(reqs, streamRequest{Type: "close"})
+	}
+	body := pipelineRequest{Requests: reqs}
+	if c.baton != "" {
+		body.Baton = &c.baton
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.post(ctx, b)
+	c.baton, c.beginPending = "", false
+	if err != nil {
+		// A transaction's stream is lost with its baton; nothing more
+		// may run on this connection as if it were still open.
+		c.broken = c.inTx
+		return nil, err
+	}
+	if resp.Baton != nil && c.inTx {
+		c.baton = *resp.Baton
+	}
+	if resp.BaseURL != nil && *resp.BaseURL != "" {
+		c.url = strings.TrimSuffix(*resp.BaseURL, "/")
+	}
+	if len(resp.Results) != len(reqs) {
+		return nil, fmt.Errorf("libsql: %d results for %d requests", len(resp.Results), len(reqs))
+	}
+	out := make([]*stmtResult, 0, len(reqs))
+	for i, r := range resp.Results {
+		if r.Type == "error" {
+			if r.Error == nil {
+				return nil, &Error{Message: "unknown error"}
+			}
+			return nil, &Error{Message: r.Error.Message, Code: r.Error.Code}
+		}
+		if i < len(prefix) {
+			continue
+		}
+		var res *stmtResult
+		if r.Response != nil {
+			res = r.Response.Result
+		}
+		out = append(out, res)
+	}
+	return out, nil
+}
+
+// IsValid reports whether the connection may be reused.
+func (c *conn) IsValid() bool { return !c.broken }
+
+// post sends one pipeline request. Requests the server turned away
+// before running them (429, 503) are retried after a pause.
+func (c *conn) post(ctx context.Context, body []byte) (*pipelineResponse, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/v2/pipeline", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.cfg.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("libsql: %w", err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("libsql: %w", err)
+		}
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+			if attempt < 3 {
+				time.Sleep(time.Duration(100<<attempt) * time.Millisecond)
+				continue
+			}
+			fallthrough
+		case resp.StatusCode != http.StatusOK:
+			msg := strings.TrimSpace(string(data))
+			if len(msg) > 200 {
+				msg = msg[:200]
+			}
+			return nil, fmt.Errorf("libsql: %s: %s", resp.Status, msg)
+		}
+		var out pipelineResponse
+		if err := json.Unmarshal(data, &out); err != nil {
+			return nil, fmt.Errorf("libsql: decode response: %w", err)
+		}
+		return &out, nil
+	}
+}
+
+func (c *conn) execute(ctx context.Context, query string, args []driver.NamedValue, wantRows bool) (*stmtResult, error) {
+	req := streamRequest{Type: "execute", Stmt: &stmt{SQL: query, WantRows: wantRows}}
+	if len(args) == 0 && multiStatement(query) {
+		req = streamRequest{Type: "sequence", SQL: query}
+	}
+	for _, a := range args {
+		if a.Name != "" {
+			return nil, errors.New("libsql: named arguments are not supported")
+		}
+		v, err := toValue(a.Value)
+		if err != nil {
+			return nil, err
+		}
+		req.Stmt.Args = append(req.Stmt.Args, v)
+	}
+	res, err := c.pipeline(ctx, []streamRequest{req})
+	if err != nil {
+		return nil, err
+	}
+	if res[0] == nil {
+		return &stmtResult{}, nil
+	}
+	return res[0], nil
+}
+
+// multiStatement reports whether query holds more than one statement,
+// as schema scripts do; those are sent as a sequence.
+func multiStatement(query string) bool {
+	return strings.Contains(strings.TrimRight(strings.TrimSpace(query), ";"), ";")
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.execute(ctx, query, args, false)
+	if err != nil {
+		return nil, err
+	}
+	r := result{affected: res.AffectedRowCount}
+	if res.LastInsertRowid != nil {
+		r.lastID, _ = strconv.ParseInt(*res.LastInsertRowid, 10, 64)
+	}
+	return r, nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.execute(ctx, query, args, true)
+	if err != nil {
+		return nil, err
+	}
+	r := &rows{values: res.Rows}
+	for _, col := range res.Cols {
+		r.cols = append(r.cols, col.Name)
+	}
+	return r, nil
+}
+
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch v := nv.Value.(type) {
+	case int:
+		nv.Value = int64(v)
+	case int32:
+		nv.Value = int64(v)
+	case uint32:
+		nv.Value = int64(v)
+	case nil, int64, float64, bool, string, []byte, time.Time:
+	default:
+		return driver.ErrSkip
+	}
+	return nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	_, err := c.execute(ctx, "SELECT 1", nil, true)
+	return err
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext returns a statement that is sent in full each time it
+// runs; the server keeps no prepared statements between requests.
+func (c *conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	return &preparedStmt{c: c, query: query}, nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.inTx {
+		return nil, errors.New("libsql: transaction already open")
+	}
+	if opts.ReadOnly {
+		return nil, errors.New("libsql: read-only transactions are not supported")
+	}
+	c.inTx, c.beginPending = true, true
+	return &tx{c: c}, nil
+}
+
+// Close ends the stream if a transaction left it open.
+func (c *conn) Close() error {
+	if c.baton == "" {
+		return nil
+	}
+	c.inTx, c.beginPending = false, false
+	_, err := c.pipeline(context.Background(), nil)
+	return err
+}
+
+type tx struct{ c *conn }
+
+func (t *tx) Commit() error { return t.end("COMMIT") }
+
+func (t *tx) Rollback() error { return t.end("ROLLBACK") }
+
+// end finishes the transaction with sql and closes its stream. A
+// transaction that never ran a statement has nothing to finish.
+func (t *tx) end(sql string) error {
+	c := t.c
+	if !c.inTx {
+		return driver.ErrBadConn
+	}
+	if c.beginPending {
+		c.inTx, c.beginPending = false, false
+		return nil
+	}
+	c.inTx = false
+	_, err := c.pipeline(context.Background(), []streamRequest{{Type: "execute", Stmt: &stmt{SQL: sql}}})
+	return err
+}
+
+type preparedStmt struct {
+	c     *conn
+	query string
+}
+
+func (s *preparedStmt) Close() error  { return nil }
+func (s *preparedStmt) NumInput() int { return -1 }
+
+func (s *preparedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), named(args))
+}
+
+func (s *preparedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), named(args))
+}
+
+func (s *preparedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.c.ExecContext(ctx, s.query, args)
+}
+
+func (s *preparedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.c.QueryContext(ctx, s.query, args)
+}
+
+func (s *preparedStmt) CheckNamedValue(nv *driver.NamedValue) error { return s.c.CheckNamedValue(nv) }
+
+func named(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return out
+}
+
+type result struct{ lastID, affected int64 }
+
+func (r result) LastInsertId() (int64, error) { return r.lastID, nil }
+func (r result) RowsAffected() (int64, error) { return r.affected, nil }
+
+type rows struct {
+	cols   []string
+	values [][]value
+	i      int
+}
+
+func (r *rows) Columns() []string { return r.cols }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.i >= len(r.values) {
+		return io.EOF
+	}
+	row := r.values[r.i]
+	r.i++
+	for i := range dest {
+		if i >= len(row) {
+			dest[i] = nil
+			continue
+		}
+		v, err := row[i].driverValue()
+		if err != nil {
+			return err
+		}
+		dest[i] = v
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package libsql_test
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/libsql"
+	"github.com/daviddao/clockmail/pkg/libsql/libsqltest"
+)
+
+func newServer(t *testing.T) *libsqltest.Server {
+	t.Helper()
+	srv, err := libsqltest.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestParseDSN(t *testing.T) {
+	cfg, err := libsql.ParseDSN("libsql://db-org.turso.io?authToken=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.URL != "https://db-org.turso.io" || cfg.Token != "abc" || cfg.BusyTimeout != libsql.DefaultBusyTimeout {
+		t.Fatalf("ParseDSN = %+v", cfg)
+	}
+	cfg, err = libsql.ParseDSN("libsql://127.0.0.1:8080?tls=0&busyTimeout=250")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.URL != "http://127.0.0.1:8080" || cfg.Token != "" || cfg.BusyTimeout != 250*time.Millisecond {
+		t.Fatalf("ParseDSN = %+v", cfg)
+	}
+	for _, bad := range []string{"https://x", "libsql://", "libsql://h?busyTimeout=soon"} {
+		if _, err := libsql.ParseDSN(bad); err == nil {
+			t.Errorf("ParseDSN(%q) succeeded", bad)
+		}
+	}
+	if got := libsql.Redact("libsql://h?authToken=secret"); strings.Contains(got, "secret") {
+		t.Errorf("Redact kept the token: %s", got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	srv := newServer(t)
+	srv.Token = "tok"
+	db, err := sql.Open("libsql", srv.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`CREATE TABLE t (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, n INTEGER, f REAL, b BLOB);
+		CREATE INDEX t_name ON t(name)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	res, err := db.Exec(`INSERT INTO t (name, n, f, b) VALUES (?, ?, ?, ?)`, "a", int64(1)<<40, 1.5, []byte{0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := res.LastInsertId(); id != 1 {
+		t.Errorf("LastInsertId = %d, want 1", id)
+	}
+	var (
+		name string
+		n    int64
+		f    float64
+		b    []byte
+		null sql.NullString
+	)
+	if err := db.QueryRow(`SELECT name, n, f, b, NULL FROM t WHERE id = ?`, 1).Scan(&name, &n, &f, &b, &null); err != nil {
+		t.Fatal(err)
+	}
+	if name != "a" || n != 1<<40 || f != 1.5 || len(b) != 2 || b[1] != 1 || null.Valid {
+		t.Errorf("row = %q %d %v %v %v", name, n, f, b, null)
+	}
+
+	// A rolled-back transaction leaves nothing behind; a committed one
+	// is visible to the next stream.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`INSERT INTO t (name) VALUES ('rolled back')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = db.Begin()
+	tx.Exec(`INSERT INTO t (name) VALUES ('b')`)
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&count); err != nil || count != 2 {
+		t.Fatalf("count inside tx = %d, %v; want 2", count, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&count); err != nil || count != 2 {
+		t.Fatalf("count = %d, %v; want 2", count, err)
+	}
+
+	// Statement errors come back as *libsql.Error with the SQLite code.
+	_, err = db.Exec(`INSERT INTO nope VALUES (1)`)
+	var lerr *libsql.Error
+	if !errors.As(err, &lerr) || lerr.Code == "" {
+		t.Fatalf("error = %#v, want *libsql.Error with a code", err)
+	}
+}
+
+func TestRoundTrip_Unauthorized(t *testing.T) {
+	srv := newServer(t)
+	srv.Token = "tok"
+	db, _ := sql.Open("libsql", strings.Replace(srv.DSN(), "authToken=tok", "authToken=wrong", 1))
+	defer db.Close()
+	if err := db.Ping(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Ping with a wrong token = %v, want 401", err)
+	}
+}
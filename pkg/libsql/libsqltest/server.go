@@ -0,0 +1,265 @@
+// Package libsqltest runs a libSQL pipeline server for tests. It speaks
+// enough of the protocol for package libsql, and runs the statements on
+// a SQLite file of its own, so tests see real SQLite behaviour without a
+// hosted database.
+package libsqltest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "modernc.org/sqlite" // the database behind the server
+)
+
+// Server is a running test server.
+type Server struct {
+	*httptest.Server
+	// Token, if set, must be presented as a bearer token.
+	Token string
+
+	db      *sql.DB
+	mu      sync.Mutex
+	streams map[string]*sql.Conn
+	// Requests counts the pipeline requests served.
+	Requests int
+}
+
+// New starts a server whose database lives in dir.
+func New(dir string) (*Server, error) {
+	db, err := sql.Open("sqlite", filepath.Join(dir, "libsql.db")+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{db: db, streams: make(map[string]*sql.Conn)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s, nil
+}
+
+// DSN returns a libsql:// DSN for the server.
+func (s *Server) DSN() string {
+	dsn := "libsql://" + strings.TrimPrefix(s.URL, "http://") + "?tls=0"
+	if s.Token != "" {
+		dsn += "&authToken=" + s.Token
+	}
+	return dsn
+}
+
+// Close stops the server and closes its database.
+func (s *Server) Close() {
+	s.Server.Close()
+	s.mu.Lock()
+	for _, c := range s.streams {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.db.Close()
+}
+
+type request struct {
+	Baton    *string `json:"baton"`
+	Requests []struct {
+		Type string `json:"type"`
+		SQL  string `json:"sql"`
+		Stmt *struct {
+			SQL      string  `json:"sql"`
+			Args     []value `json:"args"`
+			WantRows bool    `json:"want_rows"`
+		} `json:"stmt"`
+	} `json:"requests"`
+}
+
+type value struct {
+	Type   string      `json:"type"`
+	Value  interface{} `json:"value,omitempty"`
+	Base64 string      `json:"base64,omitempty"`
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v2/pipeline" || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.Requests++
+	var c *sql.Conn
+	if req.Baton != nil {
+		c = s.streams[*req.Baton]
+		delete(s.streams, *req.Baton)
+	}
+	s.mu.Unlock()
+	if req.Baton != nil && c == nil {
+		http.Error(w, "unknown baton", http.StatusBadRequest)
+		return
+	}
+	ctx := context.Background()
+	if c == nil {
+		var err error
+		if c, err = s.db.Conn(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var results []interface{}
+	closed := false
+	for _, q := range req.Requests {
+		switch q.Type {
+		case "close":
+			closed = true
+			results = append(results, ok(map[string]interface{}{"type": "close"}))
+		case "sequence":
+			if _, err := c.ExecContext(ctx, q.SQL); err != nil {
+				results = append(results, failed(err))
+				continue
+			}
+			results = append(results, ok(map[string]interface{}{"type": "sequence"}))
+		case "execute":
+			res, err := execute(ctx, c, q.Stmt.SQL, q.Stmt.Args)
+			if err != nil {
+				results = append(results, failed(err))
+				continue
+			}
+			results = append(results, ok(map[string]interface{}{"type": "execute", "result": res}))
+		default:
+			results = append(results, failed(fmt.Errorf("unsupported request %q", q.Type)))
+		}
+	}
+
+	out := map[string]interface{}{"baton": nil, "base_url": nil, "results": results}
+	if closed {
+		c.Close()
+	} else {
+		b := make([]byte, 8)
+		rand.Read(b)
+		baton := hex.EncodeToString(b)
+		s.mu.Lock()
+		s.streams[baton] = c
+		s.mu.Unlock()
+		out["baton"] = baton
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func ok(resp interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "ok", "response": resp}
+}
+
+func failed(err error) map[string]interface{} {
+	code := "SQLITE_ERROR"
+	if strings.Contains(err.Error(), "(5)") || strings.Contains(err.Error(), "SQLITE_BUSY") {
+		code = "SQLITE_BUSY"
+	}
+	return map[string]interface{}{"type": "error", "error": map[string]string{"message": err.Error(), "code": code}}
+}
+
+func execute(ctx context.Context, c *sql.Conn, query string, args []value) (map[string]interface{}, error) {
+	var params []interface{}
+	for _, a := range args {
+		switch a.Type {
+		case "null":
+			params = append(params, nil)
+		case "integer":
+			s, _ := a.Value.(string)
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, n)
+		case "blob":
+			b, err := base64.StdEncoding.DecodeString(a.Base64)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, b)
+		default:
+			params = append(params, a.Value)
+		}
+	}
+	if !returnsRows(query) {
+		res, err := c.ExecContext(ctx, query, params...)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := res.RowsAffected()
+		id, _ := res.LastInsertId()
+		return map[string]interface{}{"cols": []interface{}{}, "rows": []interface{}{},
+			"affected_row_count": n, "last_insert_rowid": strconv.FormatInt(id, 10)}, nil
+	}
+	rows, err := c.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]map[string]string, len(names))
+	for i, n := range names {
+		cols[i] = map[string]string{"name": n}
+	}
+	out := [][]value{}
+	for rows.Next() {
+		vals := make([]interface{}, len(names))
+		ptrs := make([]interface{}, len(names))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make([]value, len(vals))
+		for i, v := range vals {
+			row[i] = toValue(v)
+		}
+		out = append(out, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"cols": cols, "rows": out, "affected_row_count": 0, "last_insert_rowid": nil}, nil
+}
+
+// returnsRows reports whether query produces rows.
+func returnsRows(query string) bool {
+	q := strings.ToUpper(strings.TrimSpace(query))
+	return strings.HasPrefix(q, "SELECT") || strings.HasPrefix(q, "PRAGMA") ||
+		strings.HasPrefix(q, "WITH") || strings.Contains(q, "RETURNING")
+}
+
+func toValue(v interface{}) value {
+	switch v := v.(type) {
+	case nil:
+		return value{Type: "null"}
+	case int64:
+		return value{Type: "integer", Value: strconv.FormatInt(v, 10)}
+	case float64:
+		return value{Type: "float", Value: v}
+	case []byte:
+		return value{Type: "blob", Base64: base64.StdEncoding.EncodeToString(v)}
+	case string:
+		return value{Type: "text", Value: v}
+	}
+	return value{Type: "text", Value: fmt.Sprint(v)}
+}
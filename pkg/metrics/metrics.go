@@ -0,0 +1,255 @@
+// Package metrics exports the state of a clockmail store in the Prometheus
+// text exposition format, for fleet operators who want to alert when an
+// agent stalls an epoch, an inbox backs up, or locks keep colliding.
+//
+// Everything is computed from the store at scrape time; nothing is kept
+// in memory between scrapes, so any number of cm processes can serve the
+// same database and agree.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/frontier"
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+// ContentType is the media type of the exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Presence decides an agent's presence (online, idle, offline, departed)
+// for the clockmail_agents gauge. Nil uses model.Agent.Presence.
+type Presence func(model.Agent) string
+
+// Family is one metric with its samples.
+type Family struct {
+	Name    string
+	Help    string
+	Type    string // gauge, counter or summary
+	Samples []Sample
+}
+
+// Sample is one labelled value of a family. Suffix is appended to the
+// family name (_sum and _count for summaries).
+type Sample struct {
+	Suffix string
+	Labels [][2]string
+	Value  float64
+}
+
+// Collect reads st and returns every metric family, in a stable order.
+func Collect(st store.StoreInterface, presence Presence, now time.Time) ([]Family, error) {
+	if presence == nil {
+		presence = func(ag model.Agent) string { return ag.Presence(now) }
+	}
+	agents, err := st.ListAgents()
+	if err != nil {
+		return nil, fmt.Errorf("list agents: %w", err)
+	}
+	kinds, err := st.CountEventsByKind()
+	if err != nil {
+		return nil, fmt.Errorf("count events: %w", err)
+	}
+	unread, err := st.CountUnread()
+	if err != nil {
+		return nil, fmt.Errorf("count unread: %w", err)
+	}
+	locks, err := st.ListLocks()
+	if err != nil {
+		return nil, fmt.Errorf("list locks: %w", err)
+	}
+	denied, err := st.CountDeniedLocks()
+	if err != nil {
+		return nil, fmt.Errorf("count denied locks: %w", err)
+	}
+	gates, err := gateResults(st)
+	if err != nil {
+		return nil, fmt.Errorf("gate results: %w", err)
+	}
+	active, err := st.GetActivePointstamps(0)
+	if err != nil {
+		return nil, fmt.Errorf("active pointstamps: %w", err)
+	}
+
+	var fams []Family
+	add := func(name, typ, help string, samples ...Sample) {
+		fams = append(fams, Family{Name: name, Help: help, Type: typ, Samples: samples})
+	}
+
+	var s []Sample
+	for _, k := range sortedKeys(kinds) {
+		s = append(s, Sample{Labels: [][2]string{{"kind", string(k)}}, Value: float64(kinds[k])})
+	}
+	add("clockmail_log_events", "gauge", "Events in the log by kind (cm gc lowers these).", s...)
+
+	byPresence := map[string]int{"online": 0, "idle": 0, "offline": 0, "departed": 0}
+	for _, ag := range agents {
+		byPresence[presence(ag)]++
+	}
+	s = nil
+	for _, p := range sortedKeys(byPresence) {
+		s = append(s, Sample{Labels: [][2]string{{"presence", p}}, Value: float64(byPresence[p])})
+	}
+	add("clockmail_agents", "gauge", "Registered agents by presence.", s...)
+
+	var pending, held, clock, epoch, round, lag, seen, blocking, deniedS []Sample
+	heldBy := map[string]int{}
+	for _, l := range locks {
+		heldBy[l.AgentID]++
+	}
+	maxEpoch := int64(-1)
+	for _, p := range active {
+		maxEpoch = max(maxEpoch, p.Timestamp.Epoch)
+	}
+	front := frontier.ComputeFrontier(active)
+	onFrontier := map[string]bool{}
+	for _, p := range front {
+		onFrontier[p.AgentID] = true
+	}
+	for _, ag := range agents {
+		if ag.DepartedAt != nil {
+			continue
+		}
+		l := [][2]string{{"agent", ag.ID}}
+		pending = append(pending, Sample{Labels: l, Value: float64(unread[ag.ID])})
+		held = append(held, Sample{Labels: l, Value: float64(heldBy[ag.ID])})
+		deniedS = append(deniedS, Sample{Labels: l, Value: float64(denied[ag.ID])})
+		clock = append(clock, Sample{Labels: l, Value: float64(ag.Clock)})
+		epoch = append(epoch, Sample{Labels: l, Value: float64(ag.Epoch)})
+		round = append(round, Sample{Labels: l, Value: float64(ag.Round)})
+		seen = append(seen, Sample{Labels: l, Value: now.Sub(ag.LastSeen).Seconds()})
+		if maxEpoch >= 0 {
+			lag = append(lag, Sample{Labels: l, Value: float64(max(maxEpoch-ag.Epoch, 0))})
+		}
+		// An agent holds the frontier back when it is on it while
+		// another active agent has moved to a later epoch.
+		b := 0.0
+		if onFrontier[ag.ID] && ag.Epoch < maxEpoch {
+			b = 1
+		}
+		blocking = append(blocking, Sample{Labels: l, Value: b})
+	}
+	add("clockmail_messages_pending", "gauge", "Inbox events an agent has not received yet.", pending...)
+	add("clockmail_locks_active", "gauge", "Locks currently held.", Sample{Value: float64(len(locks))})
+	add("clockmail_locks_held", "gauge", "Locks currently held by each agent.", held...)
+	add("clockmail_lock_conflicts_total", "counter", "Lock requests denied because another agent held the lock, by requester.", deniedS...)
+	add("clockmail_agent_clock", "gauge", "Agent's Lamport clock.", clock...)
+	add("clockmail_agent_epoch", "gauge", "Epoch of the agent's working position.", epoch...)
+	add("clockmail_agent_round", "gauge", "Round of the agent's working position.", round...)
+	add("clockmail_agent_last_seen_seconds", "gauge", "Seconds since the agent last did anything.", seen...)
+	add("clockmail_agent_epoch_lag", "gauge", "Epochs the agent trails the most advanced active agent by.", lag...)
+	add("clockmail_agent_blocking_frontier", "gauge", "1 if the agent is on the frontier while others have moved to later epochs.", blocking...)
+
+	minEpoch := 0.0
+	if len(front) > 0 {
+		minEpoch = float64(front[0].Timestamp.Epoch)
+		for _, p := range front[1:] {
+			minEpoch = min(minEpoch, float64(p.Timestamp.Epoch))
+		}
+	}
+	add("clockmail_frontier_min_epoch", "gauge", "Lowest epoch on the frontier: nothing at or after it is safe to finalize.", Sample{Value: minEpoch})
+
+	add("clockmail_gate_wait_seconds", "summary", "How long cm gate --exec waited for its epoch before running.",
+		Sample{Suffix: "_sum", Value: gates.waited.Seconds()}, Sample{Suffix: "_count", Value: float64(gates.waits)})
+	add("clockmail_gate_runs_total", "counter", "Commands run by cm gate --exec, by outcome.",
+		Sample{Labels: [][2]string{{"result", "pass"}}, Value: float64(gates.passed)},
+		Sample{Labels: [][2]string{{"result", "fail"}}, Value: float64(gates.failed)})
+	return fams, nil
+}
+
+type gateStats struct {
+	waits          int
+	waited         time.Duration
+	passed, failed int
+}
+
+// gateResults totals the gate_result events in the log.
+func gateResults(st store.StoreInterface) (gateStats, error) {
+	var g gateStats
+	q, err := query.Parse("kind=" + string(model.EventGateResult))
+	if err != nil {
+		return g, err
+	}
+	var last int64
+	for {
+		events, err := st.QueryEventsSinceID(q, last, 500)
+		if err != nil {
+			return g, err
+		}
+		for _, e := range events {
+			last = e.ID
+			var p struct {
+				ExitCode int    `json:"exit_code"`
+				Waited   string `json:"waited"`
+			}
+			if json.Unmarshal([]byte(e.Body), &p) != nil {
+				continue
+			}
+			if p.ExitCode == 0 {
+				g.passed++
+			} else {
+				g.failed++
+			}
+			if d, err := time.ParseDuration(p.Waited); err == nil {
+				g.waits++
+				g.waited += d
+			}
+		}
+		if len(events) < 500 {
+			return g, nil
+		}
+	}
+}
+
+// Write renders fams in the text exposition format.
+func Write(w io.Writer, fams []Family) error {
+	var b strings.Builder
+	for _, f := range fams {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.Name, f.Help, f.Name, f.Type)
+		for _, s := range f.Samples {
+			b.WriteString(f.Name + s.Suffix)
+			if len(s.Labels) > 0 {
+				parts := make([]string, len(s.Labels))
+				for i, l := range s.Labels {
+					parts[i] = l[0] + `="` + labelEscaper.Replace(l[1]) + `"`
+				}
+				b.WriteString("{" + strings.Join(parts, ",") + "}")
+			}
+			fmt.Fprintf(&b, " %g\n", s.Value)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Handler serves the metrics of st on every GET.
+func Handler(st store.StoreInterface, presence Presence) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fams, err := Collect(st, presence, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		_ = Write(w, fams)
+	})
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+func newStore(t *testing.T) *store.Store {
+	t.Helper()
+	s, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("store.New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestCollect(t *testing.T) {
+	s := newStore(t)
+	now := time.Now().UTC()
+	for _, id := range []string{"alice", "bob", "carol"} {
+		s.RegisterAgent(id)
+	}
+	s.UpdateAgentClock("alice", 5, 3, 0)
+	s.UpdateAgentClock("bob", 4, 1, 2)
+	s.UpdateAgentClock("carol", 2, 3, 0)
+	s.DepartAgent("carol")
+	s.AcquireLock("a.go", "alice", 5, 3, true, time.Hour)
+	gate, _ := json.Marshal(map[string]interface{}{"exit_code": 0, "waited": "1.5s"})
+	failed, _ := json.Marshal(map[string]interface{}{"exit_code": 1, "waited": "500ms"})
+	for _, e := range []model.Event{
+		{AgentID: "bob", LamportTS: 1, Epoch: 1, Round: 2, Kind: model.EventMsg, Target: "alice", Body: "one"},
+		{AgentID: "bob", LamportTS: 2, Epoch: 1, Round: 2, Kind: model.EventMsg, Target: "alice", Body: "two"},
+		{AgentID: "bob", LamportTS: 3, Kind: model.EventLockReq, Target: "a.go", Body: store.LockDeniedPrefix + ": held by alice"},
+		{AgentID: "alice", LamportTS: 4, Kind: model.EventLockReq, Target: "a.go"},
+		{AgentID: "alice", LamportTS: 5, Kind: model.EventGateResult, Body: string(gate)},
+		{AgentID: "alice", LamportTS: 6, Kind: model.EventGateResult, Body: string(failed)},
+	} {
+		e := e
+		e.CreatedAt = now
+		if _, err := s.InsertEvent(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fams, err := Collect(s, nil, now)
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	var b strings.Builder
+	if err := Write(&b, fams); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE clockmail_log_events gauge\n",
+		`clockmail_log_events{kind="msg"} 2` + "\n",
+		`clockmail_log_events{kind="lock_req"} 2` + "\n",
+		`clockmail_agents{presence="departed"} 1` + "\n",
+		`clockmail_messages_pending{agent="alice"} 2` + "\n",
+		`clockmail_messages_pending{agent="bob"} 0` + "\n",
+		"clockmail_locks_active 1\n",
+		`clockmail_locks_held{agent="alice"} 1` + "\n",
+		`clockmail_lock_conflicts_total{agent="bob"} 1` + "\n",
+		`clockmail_lock_conflicts_total{agent="alice"} 0` + "\n",
+		`clockmail_agent_epoch_lag{agent="bob"} 2` + "\n",
+		`clockmail_agent_epoch_lag{agent="alice"} 0` + "\n",
+		`clockmail_agent_blocking_frontier{agent="bob"} 1` + "\n",
+		`clockmail_agent_blocking_frontier{agent="alice"} 0` + "\n",
+		"clockmail_frontier_min_epoch 1\n",
+		"clockmail_gate_wait_seconds_sum 2\n",
+		"clockmail_gate_wait_seconds_count 2\n",
+		`clockmail_gate_runs_total{result="pass"} 1` + "\n",
+		`clockmail_gate_runs_total{result="fail"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	// Departed agents have no per-agent samples.
+	if strings.Contains(out, `agent="carol"`) {
+		t.Errorf("metrics should leave out departed agents:\n%s", out)
+	}
+}
+
+func TestWrite_EscapesLabels(t *testing.T) {
+	var b strings.Builder
+	Write(&b, []Family{{Name: "m", Help: "h", Type: "gauge", Samples: []Sample{
+		{Labels: [][2]string{{"agent", "a\"b\\c\nd"}}, Value: 1.5},
+	}}})
+	if got := b.String(); got != "# HELP m h\n# TYPE m gauge\nm{agent=\"a\\\"b\\\\c\\nd\"} 1.5\n" {
+		t.Fatalf("Write = %q", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := newStore(t)
+	s.RegisterAgent("alice")
+	rec := httptest.NewRecorder()
+	Handler(s, func(model.Agent) string { return "idle" }).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `clockmail_agents{presence="idle"} 1`) {
+		t.Fatalf("handler should use the presence function:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,91 @@
+package model
+
+import "time"
+
+// PrimeSchemaVersion is the current version of the Prime document that
+// cm prime --json --schema-version emits.
+//
+// Within a version, fields are only ever added: none is renamed, removed
+// or given a different type or meaning, so a consumer written against
+// version 1 keeps working as long as it ignores fields it does not know.
+// Anything else bumps the version, and cm prime keeps emitting the older
+// versions on request.
+const PrimeSchemaVersion = 1
+
+// Prime is the versioned, machine-readable form of cm prime: what an
+// agent needs to know at the start of a session. cm schema prime prints
+// its JSON Schema, built from the doc tags below.
+type Prime struct {
+	SchemaVersion int       `json:"schema_version" doc:"Version of this document's structure; 1"`
+	GeneratedAt   time.Time `json:"generated_at" doc:"When the document was produced"`
+	AgentID       string    `json:"agent_id" doc:"The agent the document was produced for; empty if none is set"`
+	Registered    bool      `json:"registered" doc:"Whether agent_id is a registered agent"`
+	// Self is the agent's own entry from Agents, or nil if it is not
+	// registered.
+	Self            *PrimeAgent    `json:"self" doc:"The agent's own entry from agents, or null if it is not registered"`
+	Agents          []PrimeAgent   `json:"agents" doc:"Every registered agent, sorted by ID"`
+	MyLocks         []PrimeLock    `json:"my_locks" doc:"Locks held by the agent"`
+	OtherLocks      []PrimeLock    `json:"other_locks" doc:"Locks held by other agents"`
+	WIP             []PrimeWIP     `json:"wip" doc:"Declared work in progress (cm wip), everyone's"`
+	PendingCount    int            `json:"pending_count" doc:"Number of messages waiting in the agent's inbox"`
+	PendingMessages []PrimeMessage `json:"pending_messages" doc:"Messages waiting in the agent's inbox, oldest first"`
+	Frontier        *PrimeFrontier `json:"frontier" doc:"Whether the agent may finalize its current work, or null if it is not registered"`
+}
+
+// PrimeAgent is one agent as Prime reports it.
+type PrimeAgent struct {
+	ID       string    `json:"id" doc:"Agent ID"`
+	Clock    int64     `json:"clock" doc:"Lamport clock"`
+	Epoch    int64     `json:"epoch" doc:"Epoch of the agent's working position"`
+	Round    int64     `json:"round" doc:"Round of the agent's working position"`
+	Presence string    `json:"presence" doc:"online, idle, offline or departed"`
+	LastSeen time.Time `json:"last_seen_at" doc:"Last time the agent did anything"`
+	Roles    []string  `json:"roles" doc:"Roles the agent registered with (role:<name> recipients)"`
+	You      bool      `json:"you" doc:"Whether this is the agent the document was produced for"`
+}
+
+// PrimeLock is a held file lock.
+type PrimeLock struct {
+	Path      string    `json:"path" doc:"Locked path"`
+	AgentID   string    `json:"agent_id" doc:"Holder"`
+	Exclusive bool      `json:"exclusive" doc:"Whether the lock is exclusive (false for shared)"`
+	ExpiresAt time.Time `json:"expires_at" doc:"When the lock lapses unless renewed"`
+}
+
+// PrimeWIP is an agent's declaration of what it is working on.
+type PrimeWIP struct {
+	AgentID     string    `json:"agent_id" doc:"Declaring agent"`
+	Description string    `json:"description" doc:"What the agent said it is doing"`
+	Files       []string  `json:"files" doc:"Files the work touches"`
+	Epoch       int64     `json:"epoch" doc:"Epoch the declaration was made in"`
+	UpdatedAt   time.Time `json:"updated_at" doc:"When the declaration was last set"`
+}
+
+// PrimeMessage is an unread message. Sealed bodies are opened when the
+// agent's private key is available.
+type PrimeMessage struct {
+	ID        int64     `json:"id" doc:"Event ID"`
+	LamportTS int64     `json:"lamport_ts" doc:"Lamport timestamp of the send"`
+	From      string    `json:"from" doc:"Sender"`
+	Body      string    `json:"body" doc:"Message text"`
+	Priority  string    `json:"priority" doc:"urgent, normal or low"`
+	SentAt    time.Time `json:"sent_at" doc:"Wall-clock time of the send"`
+}
+
+// PrimeFrontier says whether the agent may finalize work at its current
+// position, and what stands in the way.
+type PrimeFrontier struct {
+	Epoch     int64             `json:"epoch" doc:"Epoch of the agent's position"`
+	Round     int64             `json:"round" doc:"Round of the agent's position"`
+	Safe      bool              `json:"safe" doc:"Whether no other agent has outstanding work at or before the position"`
+	BlockedBy []PrimePointstamp `json:"blocked_by" doc:"Agents whose outstanding work blocks finalizing"`
+	Points    []PrimePointstamp `json:"points" doc:"The frontier: earliest outstanding positions across all agents"`
+}
+
+// PrimePointstamp is an agent's working position.
+type PrimePointstamp struct {
+	AgentID string `json:"agent_id" doc:"Agent"`
+	Epoch   int64  `json:"epoch" doc:"Epoch"`
+	Round   int64  `json:"round" doc:"Round"`
+	EventID int64  `json:"event_id,omitempty" doc:"Set for a message still unread in the agent's inbox: its event ID"`
+}
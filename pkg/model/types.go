@@ -13,54 +13,355 @@
 //     at t. The "frontier" is the antichain of earliest-incomplete pointstamps.
 package model
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
-// Timestamp is a Naiad-style structured timestamp: (Epoch, Round).
+// Timestamp is a Naiad-style structured timestamp: (Epoch, Round), with
+// optional further coordinates for nested loops.
 // Epoch identifies a batch of work (a task, a PR, a feature).
 // Round identifies a refinement iteration within that epoch.
+// Steps, outermost first, identify iterations nested within the round:
+// 3.2.7 is epoch 3, round 2, step 7. Missing coordinates are 0, so (3, 2)
+// is the same timestamp as 3.2.0. Most of the log records only the
+// (Epoch, Round) projection.
 type Timestamp struct {
-	Epoch int64 `json:"epoch"`
-	Round int64 `json:"round"`
+	Epoch int64   `json:"epoch"`
+	Round int64   `json:"round"`
+	Steps []int64 `json:"steps,omitempty"`
+}
+
+// coord returns coordinate i of t: Epoch, Round, then Steps, 0 past the end.
+func (t Timestamp) coord(i int) int64 {
+	switch {
+	case i == 0:
+		return t.Epoch
+	case i == 1:
+		return t.Round
+	case i-2 < len(t.Steps):
+		return t.Steps[i-2]
+	}
+	return 0
 }
 
-// LessEq returns true if t <= other in the Naiad partial order.
-// (e1,r1) <= (e2,r2) iff e1<=e2 AND r1<=r2.
+// depth is the number of coordinates t spells out.
+func (t Timestamp) depth() int { return 2 + len(t.Steps) }
+
+// LessEq returns true if t <= other in the Naiad partial order, the
+// product order on coordinates: (e1,r1) <= (e2,r2) iff e1<=e2 AND
+// r1<=r2, and likewise for every step.
 func (t Timestamp) LessEq(other Timestamp) bool {
-	return t.Epoch <= other.Epoch && t.Round <= other.Round
+	for i := range max(t.depth(), other.depth()) {
+		if t.coord(i) > other.coord(i) {
+			return false
+		}
+	}
+	return true
 }
 
 // Less returns true if t < other (strictly less in the partial order).
 func (t Timestamp) Less(other Timestamp) bool {
-	return t.LessEq(other) && t != other
+	return t.LessEq(other) && !t.Equal(other)
+}
+
+// Equal reports whether t and other are the same timestamp.
+func (t Timestamp) Equal(other Timestamp) bool {
+	return t.LessEq(other) && other.LessEq(t)
+}
+
+// Meet returns the greatest lower bound of t and other: the minimum of
+// each coordinate.
+func (t Timestamp) Meet(other Timestamp) Timestamp {
+	m := Timestamp{Epoch: min(t.Epoch, other.Epoch), Round: min(t.Round, other.Round)}
+	for i := 2; i < max(t.depth(), other.depth()); i++ {
+		m.Steps = append(m.Steps, min(t.coord(i), other.coord(i)))
+	}
+	m.Steps = trimSteps(m.Steps)
+	return m
+}
+
+// String renders t as dotted coordinates: "3.2", or "3.2.7" with a step.
+func (t Timestamp) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d.%d", t.Epoch, t.Round)
+	for _, s := range t.Steps {
+		fmt.Fprintf(&b, ".%d", s)
+	}
+	return b.String()
+}
+
+// Fields renders t as "epoch=3 round=2", with " steps=7" (dotted when
+// there are several) if t has steps.
+func (t Timestamp) Fields() string {
+	s := fmt.Sprintf("epoch=%d round=%d", t.Epoch, t.Round)
+	if len(t.Steps) > 0 {
+		s += " steps=" + FormatSteps(t.Steps)
+	}
+	return s
+}
+
+// ParseTimestamp parses dotted coordinates as written by String: "3"
+// (round 0), "3.2" or "3.2.7". Trailing zero steps are dropped.
+func ParseTimestamp(s string) (Timestamp, error) {
+	parts := strings.Split(s, ".")
+	coords := make([]int64, len(parts))
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 {
+			return Timestamp{}, fmt.Errorf("invalid timestamp %q: want dotted non-negative integers such as 3.2.7", s)
+		}
+		coords[i] = n
+	}
+	t := Timestamp{Epoch: coords[0]}
+	if len(coords) > 1 {
+		t.Round = coords[1]
+		t.Steps = trimSteps(coords[2:])
+	}
+	return t, nil
+}
+
+// FormatSteps renders steps as dotted coordinates ("7.1"), "" for none.
+func FormatSteps(steps []int64) string {
+	parts := make([]string, len(steps))
+	for i, s := range steps {
+		parts[i] = strconv.FormatInt(s, 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// ParseSteps parses what FormatSteps writes.
+func ParseSteps(s string) ([]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var steps []int64
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid steps %q", s)
+		}
+		steps = append(steps, n)
+	}
+	return steps, nil
+}
+
+// trimSteps drops trailing zero steps, which do not change a timestamp,
+// returning nil for none.
+func trimSteps(steps []int64) []int64 {
+	for len(steps) > 0 && steps[len(steps)-1] == 0 {
+		steps = steps[:len(steps)-1]
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+	return slices.Clone(steps)
 }
 
 // Pointstamp is a (Timestamp, AgentID) pair from Naiad. In our model the
-// "location" dimension is the agent identity.
+// "location" dimension is the agent identity. Outstanding work is either
+// an agent's working position or, when EventID is set, a message at the
+// sender's position that is still unread in AgentID's inbox.
 type Pointstamp struct {
 	Timestamp Timestamp `json:"timestamp"`
 	AgentID   string    `json:"agent_id"`
+	EventID   int64     `json:"event_id,omitempty"`
+}
+
+// Who describes what holds the pointstamp: the agent, or the unread
+// message and its recipient.
+func (p Pointstamp) Who() string {
+	if p.EventID != 0 {
+		return fmt.Sprintf("unread message #%d to %s", p.EventID, p.AgentID)
+	}
+	return p.AgentID
 }
 
 // EventKind enumerates the types of events in the append-only log.
 type EventKind string
 
 const (
-	EventMsg        EventKind = "msg"
-	EventLockReq    EventKind = "lock_req"
-	EventLockRel    EventKind = "lock_rel"
-	EventProgress   EventKind = "progress"
-	EventReviewReq  EventKind = "review_req"
-	EventReviewDone EventKind = "review_done"
+	EventMsg           EventKind = "msg"
+	EventLockReq       EventKind = "lock_req"
+	EventLockRel       EventKind = "lock_rel"
+	EventLockRenew     EventKind = "lock_renew"
+	EventProgress      EventKind = "progress"
+	EventReviewReq     EventKind = "review_req"
+	EventReviewDone    EventKind = "review_done"
+	EventWorkflow      EventKind = "workflow"
+	EventSaga          EventKind = "saga"
+	EventDeparted      EventKind = "departed"
+	EventReaped        EventKind = "reaped" // departed by cm reap; target is the agent its unread messages were bounced to
+	EventSpawn         EventKind = "spawn"
+	EventForcedRelease EventKind = "forced_release" // cm unlock --force; target is the path, body names the evicted holder
+	EventAdmin         EventKind = "admin"          // a privileged operation; target names it, the agent is who did it
+	EventCommit        EventKind = "commit"         // historical git commit, from cm backfill
+	EventGateResult    EventKind = "gate_result"    // outcome of cm gate --exec
+	EventEpoch         EventKind = "epoch"          // cm epoch open/close; target is the epoch number
+	EventVote          EventKind = "vote"           // cm vote open/cast; target is the vote ID
+	EventKV            EventKind = "kv"             // cm kv set; target is the key, body the value
+	EventCRDT          EventKind = "crdt"           // cm crdt incr/add; target is the counter or set
+)
+
+// Priority ranks inbox messages. The empty value means normal priority.
+type Priority string
+
+const (
+	PriorityUrgent Priority = "urgent"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
 )
 
+// ParsePriority validates a priority name. The empty string is normal.
+func ParsePriority(s string) (Priority, error) {
+	switch p := Priority(s); p {
+	case PriorityUrgent, PriorityNormal, PriorityLow:
+		return p, nil
+	case "":
+		return PriorityNormal, nil
+	default:
+		return "", fmt.Errorf("invalid priority %q (want urgent, normal, or low)", s)
+	}
+}
+
+// Rank orders priorities: urgent > normal > low.
+func (p Priority) Rank() int {
+	switch p {
+	case PriorityUrgent:
+		return 2
+	case PriorityLow:
+		return 0
+	default:
+		return 1
+	}
+}
+
 // Agent represents a registered agent session.
 type Agent struct {
-	ID         string    `json:"id"`
-	Clock      int64     `json:"clock"`
-	Epoch      int64     `json:"epoch"`
-	Round      int64     `json:"round"`
+	ID    string `json:"id"`
+	Clock int64  `json:"clock"`
+	Epoch int64  `json:"epoch"`
+	Round int64  `json:"round"`
+	// Steps are the coordinates of the agent's position below Round (see
+	// Timestamp), set by cm heartbeat --at.
+	Steps      []int64   `json:"steps,omitempty"`
 	Registered time.Time `json:"registered_at"`
 	LastSeen   time.Time `json:"last_seen_at"`
+	// Capabilities are the skills the agent advertises, sorted. Messages
+	// sent to "@<capability>" reach every agent advertising it.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Roles name the agent's part in the team (planner, tester, ...),
+	// sorted. Messages sent to "role:<name>" reach every agent with it.
+	Roles []string `json:"roles,omitempty"`
+	// DepartedAt is set once the agent leaves with cm bye or is reaped.
+	// Departed agents hold no locks and are ignored by the frontier.
+	DepartedAt *time.Time `json:"departed_at,omitempty"`
+	// ParentID is the agent that spawned this one with cm spawn, if any.
+	ParentID string `json:"parent_id,omitempty"`
+	// RetireEpoch is set for ephemeral sub-agents (cm spawn --ephemeral),
+	// which are retired once their parent moves past this epoch.
+	RetireEpoch *int64 `json:"retire_epoch,omitempty"`
+	// TTL, in seconds, retires a sub-agent not seen for that long
+	// (cm spawn --ttl). Zero means no limit.
+	TTL int64 `json:"ttl,omitempty"`
+	// Scope is the part of the repository the agent says it works on, a
+	// path prefix or module name set by cm heartbeat --scope. Empty means
+	// anywhere. Scoped gates (cm gate --scope) wait only for agents whose
+	// scope or locks overlap theirs.
+	Scope string `json:"scope,omitempty"`
+}
+
+// ParseCapabilities parses a comma-separated capability list such as
+// "go,tests,db". Names are lowercased, deduplicated, and sorted; each must
+// be non-empty and use only letters, digits, '-', '_', or '.'.
+func ParseCapabilities(s string) ([]string, error) {
+	return parseNames(s, "capability")
+}
+
+// RoleAdmin is the role of agents allowed privileged operations: evicting
+// another agent's lock, reaping, compacting the log, importing events and
+// granting the role itself.
+const RoleAdmin = "admin"
+
+// ParseRoles parses a comma-separated role list such as "planner,tester",
+// with the same rules as ParseCapabilities.
+func ParseRoles(s string) ([]string, error) {
+	return parseNames(s, "role")
+}
+
+func parseNames(s, what string) ([]string, error) {
+	var names []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		for _, r := range c {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+				return nil, fmt.Errorf("invalid %s %q (use letters, digits, '-', '_', '.')", what, c)
+			}
+		}
+		if !slices.Contains(names, c) {
+			names = append(names, c)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// Default presence thresholds; the presence.online and presence.idle
+// settings override them.
+const (
+	DefaultOnline = 2 * time.Minute
+	DefaultIdle   = 10 * time.Minute
+)
+
+// Position returns the agent's working position.
+func (a Agent) Position() Timestamp {
+	return Timestamp{Epoch: a.Epoch, Round: a.Round, Steps: a.Steps}
+}
+
+// Presence classifies an agent by how recently it was seen:
+//   - "online"  — seen within DefaultOnline (2 minutes)
+//   - "idle"    — seen within DefaultIdle (10 minutes)
+//   - "offline" — not seen for 10+ minutes
+//   - "departed" — deregistered (see DepartedAt), however recently seen
+func (a Agent) Presence(now time.Time) string {
+	return a.PresenceWithin(now, DefaultOnline, DefaultIdle)
+}
+
+// PresenceWithin classifies an agent like Presence, with the online and
+// idle thresholds given.
+func (a Agent) PresenceWithin(now time.Time, online, idle time.Duration) string {
+	since := now.Sub(a.LastSeen)
+	switch {
+	case a.DepartedAt != nil:
+		return "departed"
+	case since < online:
+		return "online"
+	case since < idle:
+		return "idle"
+	default:
+		return "offline"
+	}
+}
+
+// Retired reports whether a live sub-agent's lifecycle has ended, given
+// that its parent is now at parentEpoch.
+func (a Agent) Retired(parentEpoch int64, now time.Time) bool {
+	if a.DepartedAt != nil {
+		return false
+	}
+	if a.RetireEpoch != nil && parentEpoch > *a.RetireEpoch {
+		return true
+	}
+	return a.TTL > 0 && now.Sub(a.LastSeen) > time.Duration(a.TTL)*time.Second
 }
 
 // Event is a single entry in the append-only event log.
@@ -74,6 +375,67 @@ type Event struct {
 	Target    string    `json:"target,omitempty"`
 	Body      string    `json:"body,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
+	Priority  Priority  `json:"priority,omitempty"` // inbox events only; empty is normal
+	Permalink string    `json:"permalink,omitempty"`
+	Provenance
+	// Signature is the writing agent's signature over SigningPayload, or
+	// empty for unsigned events (see package sign).
+	Signature string `json:"signature,omitempty"`
+	// PrevHash is the ChainHash of the event written before this one in
+	// the database, chaining the log so that altering or removing an
+	// event shows (see cm verify-log). Empty for the first event.
+	PrevHash string `json:"prev_hash,omitempty"`
+}
+
+// SigningPayload returns the bytes an agent signs for the event: every
+// field the agent chose, but not the row ID or permalink, which the
+// database assigns.
+func (e Event) SigningPayload() []byte {
+	prio := e.Priority
+	if prio == PriorityNormal {
+		prio = "" // stored as empty
+	}
+	fields := []interface{}{
+		"clockmail-event-v1", e.AgentID, e.LamportTS, e.Epoch, e.Round, string(e.Kind), e.Target, e.Body,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano), string(prio), e.Tool, e.RunID,
+	}
+	if e.Branch != "" {
+		// Appended only when set, so events from before branches verify.
+		fields = append(fields, e.Branch)
+	}
+	b, _ := json.Marshal(fields)
+	return b
+}
+
+// ChainHash returns the hex SHA-256 of the event's PrevHash, signing
+// payload and signature: the PrevHash of the event written after it.
+func (e Event) ChainHash() string {
+	h := sha256.New()
+	h.Write([]byte(e.PrevHash))
+	h.Write([]byte{0})
+	h.Write(e.SigningPayload())
+	h.Write([]byte{0})
+	h.Write([]byte(e.Signature))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Provenance identifies the tool invocation that caused an event, so the
+// log can be joined with an agent framework's own run records, and the git
+// branch it was made on when cm runs branch-scoped. All fields are
+// optional and free-form.
+type Provenance struct {
+	Tool   string `json:"tool,omitempty"`
+	RunID  string `json:"run_id,omitempty"`
+	Branch string `json:"branch,omitempty"`
+}
+
+// Permalink returns the stable reference for the event with the given
+// origin agent, row ID, and Lamport timestamp: the first 16 hex digits of
+// their SHA-256. Unlike a row ID alone, it stays meaningful after the event
+// is compacted away or replayed into another database.
+func Permalink(agentID string, id, lamportTS int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", agentID, id, lamportTS)))
+	return hex.EncodeToString(sum[:8])
 }
 
 // Lock represents an active file reservation.
@@ -84,4 +446,299 @@ type Lock struct {
 	Epoch     int64     `json:"epoch"`
 	Exclusive bool      `json:"exclusive"`
 	ExpiresAt time.Time `json:"expires_at"`
+	Branch    string    `json:"branch,omitempty"` // git branch namespace; "" is every branch
+	// AbsPath is where Path, relative to a repository root, is in the
+	// holder's worktree; "" if Path is not repository-relative.
+	AbsPath string `json:"abs_path,omitempty"`
+}
+
+// LockIntent is an agent waiting for a lock another agent holds (cm lock
+// --queue). It is dropped when the agent gets the lock, gives up, departs
+// or stops renewing it.
+type LockIntent struct {
+	Path      string    `json:"path"`
+	AgentID   string    `json:"agent_id"`
+	LamportTS int64     `json:"lamport_ts"` // of the denied request
+	QueuedAt  time.Time `json:"queued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Delivery records an inbox event being drained by its recipient. Compared
+// with the event itself it measures how far apart sender and recipient are,
+// both in wall time and in Lamport time.
+type Delivery struct {
+	EventID     int64     `json:"event_id"`
+	AgentID     string    `json:"agent_id"` // recipient
+	SenderID    string    `json:"sender_id"`
+	SendTS      int64     `json:"send_ts"`
+	Clock       int64     `json:"clock"` // recipient's clock before receiving
+	SentAt      time.Time `json:"sent_at"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+// Latency is the wall-clock time between send and drain.
+func (d Delivery) Latency() time.Duration { return d.DeliveredAt.Sub(d.SentAt) }
+
+// Skew is the recipient's clock minus the send timestamp at drain time.
+// Positive means the recipient was ahead of the sender; a large negative
+// value means the recipient had fallen far behind the swarm.
+func (d Delivery) Skew() int64 { return d.Clock - d.SendTS }
+
+// ReviewState is where one reviewer's review of a commit stands.
+type ReviewState string
+
+const (
+	ReviewPending ReviewState = "pending"
+	ReviewPassed  ReviewState = "passed"
+	ReviewFailed  ReviewState = "failed"
+
+	// ReviewChangesRequested means the reviewer left comments to address
+	// before the commit (or one that follows it) is reviewed again.
+	ReviewChangesRequested ReviewState = "changes_requested"
+)
+
+// Review is one reviewer's review of a commit, kept up to date from
+// review_req and review_done events so that outstanding reviews can be
+// found without scanning the event log.
+type Review struct {
+	Commit      string      `json:"commit"`
+	Reviewer    string      `json:"reviewer"`
+	RequestedBy string      `json:"requested_by,omitempty"` // empty if the verdict was not requested
+	State       ReviewState `json:"state"`
+	Files       []string    `json:"files,omitempty"`
+	Comment     string      `json:"comment,omitempty"`
+	RequestTS   int64       `json:"request_ts,omitempty"`
+	VerdictTS   int64       `json:"verdict_ts,omitempty"`
+	RequestedAt time.Time   `json:"requested_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// EpochStatus is whether a declared epoch is still being worked on.
+type EpochStatus string
+
+const (
+	EpochOpen   EpochStatus = "open"
+	EpochClosed EpochStatus = "closed"
+)
+
+// Epoch is an epoch declared with cm epoch open, giving the bare integer
+// agents report in their pointstamps a description and a lifecycle.
+type Epoch struct {
+	Epoch       int64       `json:"epoch"`
+	Description string      `json:"description,omitempty"`
+	Status      EpochStatus `json:"status"`
+	OpenedBy    string      `json:"opened_by"`
+	OpenedAt    time.Time   `json:"opened_at"`
+	ClosedBy    string      `json:"closed_by,omitempty"`
+	ClosedAt    *time.Time  `json:"closed_at,omitempty"`
+}
+
+// WIP is an agent's declared work in progress (cm wip set): what it is
+// doing and which files it expects to touch, announced before it takes
+// any locks.
+type WIP struct {
+	AgentID     string    `json:"agent_id"`
+	Description string    `json:"description"`
+	Files       []string  `json:"files,omitempty"`
+	Epoch       int64     `json:"epoch"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Ownership is an agent's standing claim on a file or directory (cm own).
+// Unlike a lock it never expires and enforces nothing: it tells others
+// whom to ask before touching the area.
+type Ownership struct {
+	Path      string    `json:"path"` // a file, or a directory covering everything under it
+	AgentID   string    `json:"agent_id"`
+	Note      string    `json:"note,omitempty"`
+	ClaimedAt time.Time `json:"claimed_at"`
+}
+
+// Attachment is a message body too large to keep in the event log. The
+// event carries a summary and the attachment's ID, the SHA-256 of the
+// body; cm attachment get retrieves the rest.
+type Attachment struct {
+	ID        string    `json:"id"`
+	Size      int       `json:"size"`
+	Body      string    `json:"body,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ShortID is the prefix of the attachment ID shown in message bodies.
+func (a Attachment) ShortID() string {
+	if len(a.ID) > 12 {
+		return a.ID[:12]
+	}
+	return a.ID
+}
+
+// FrontierSnapshot is the frontier as it stood from RecordedAt until the
+// next snapshot was recorded.
+type FrontierSnapshot struct {
+	ID int64 `json:"id"`
+	// Epoch is the lowest epoch on the frontier: the work holding
+	// everyone else back.
+	Epoch    int64        `json:"epoch"`
+	Frontier []Pointstamp `json:"frontier"`
+	// Active is the number of active agents at the time.
+	Active     int       `json:"active"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// SagaStatus is the lifecycle state of a saga.
+type SagaStatus string
+
+const (
+	SagaOpen      SagaStatus = "open"
+	SagaCommitted SagaStatus = "committed"
+	SagaAborted   SagaStatus = "aborted"
+)
+
+// Saga records a multi-step coordinated operation (e.g. lock set, edits,
+// review, unlock) so that it can be unwound by any agent if it fails
+// mid-flight.
+type Saga struct {
+	ID        string     `json:"id"`
+	AgentID   string     `json:"agent_id"`
+	Name      string     `json:"name,omitempty"`
+	Status    SagaStatus `json:"status"`
+	Steps     []SagaStep `json:"steps,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// SagaStep is one completed step of a saga together with the instruction
+// that undoes it.
+type SagaStep struct {
+	Seq          int       `json:"seq"`
+	AgentID      string    `json:"agent_id"`
+	Action       string    `json:"action"`
+	Compensation string    `json:"compensation,omitempty"`
+	Locks        []string  `json:"locks,omitempty"` // paths locked by this step, released on abort
+	LamportTS    int64     `json:"lamport_ts"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Compensations returns the steps in the order their undo instructions
+// must run: last step first.
+func (g *Saga) Compensations() []SagaStep {
+	out := make([]SagaStep, 0, len(g.Steps))
+	for i := len(g.Steps) - 1; i >= 0; i-- {
+		out = append(out, g.Steps[i])
+	}
+	return out
+}
+
+// Vote is a group decision between a fixed set of options. Each agent
+// casts at most one ballot; the first Quorum ballots in Lamport order
+// decide it.
+type Vote struct {
+	ID        string    `json:"id"`
+	AgentID   string    `json:"agent_id"`
+	Question  string    `json:"question"`
+	Options   []string  `json:"options"`
+	Quorum    int       `json:"quorum"`
+	LamportTS int64     `json:"lamport_ts"`
+	Ballots   []Ballot  `json:"ballots,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Ballot is one agent's choice in a vote.
+type Ballot struct {
+	AgentID   string    `json:"agent_id"`
+	Choice    string    `json:"choice"`
+	LamportTS int64     `json:"lamport_ts"`
+	CastAt    time.Time `json:"cast_at"`
+}
+
+// Before reports whether b precedes o in the total order of ballots:
+// by Lamport timestamp, ties broken by agent ID.
+func (b Ballot) Before(o Ballot) bool {
+	if b.LamportTS != o.LamportTS {
+		return b.LamportTS < o.LamportTS
+	}
+	return b.AgentID < o.AgentID
+}
+
+// HasOption reports whether choice is one of the vote's options.
+func (v *Vote) HasOption(choice string) bool {
+	return slices.Contains(v.Options, choice)
+}
+
+// VoteResult is the tally of a vote.
+type VoteResult struct {
+	// Counts holds the number of counted ballots for each option.
+	Counts map[string]int `json:"counts"`
+	// Counted is the number of ballots counted: at most Quorum. Ballots
+	// cast after the quorum was reached are recorded but not counted.
+	Counted int  `json:"counted"`
+	Decided bool `json:"decided"`
+	// Winner is the leading option, final once Decided. Of options with
+	// equal counts, the one that reached its count first leads.
+	Winner string `json:"winner,omitempty"`
+}
+
+// Result tallies the vote's ballots in their total order (see
+// Ballot.Before), so every agent computes the same result from the same
+// ballots regardless of the order it read them in.
+func (v *Vote) Result() VoteResult {
+	ballots := append([]Ballot(nil), v.Ballots...)
+	slices.SortFunc(ballots, func(x, y Ballot) int {
+		switch {
+		case x.Before(y):
+			return -1
+		case y.Before(x):
+			return 1
+		}
+		return 0
+	})
+	if v.Quorum > 0 && len(ballots) > v.Quorum {
+		ballots = ballots[:v.Quorum]
+	}
+
+	r := VoteResult{Counts: make(map[string]int, len(v.Options))}
+	for _, o := range v.Options {
+		r.Counts[o] = 0
+	}
+	best := 0
+	for _, b := range ballots {
+		r.Counts[b.Choice]++
+		r.Counted++
+		// Strictly greater: an option that only ties the leader reached
+		// the count later, so the leader keeps the lead.
+		if r.Counts[b.Choice] > best {
+			best = r.Counts[b.Choice]
+			r.Winner = b.Choice
+		}
+	}
+	r.Decided = v.Quorum > 0 && r.Counted >= v.Quorum
+	return r
+}
+
+// KVEntry is the current value of a key in the shared scratchpad. Of
+// concurrent writes the last in Lamport order wins: the highest
+// timestamp, ties broken by agent ID.
+type KVEntry struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	AgentID   string    `json:"agent_id"`
+	LamportTS int64     `json:"lamport_ts"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GCounter is a grow-only counter. Each agent only adds to its own slot
+// and the value is the sum of the slots, so concurrent increments merge
+// without conflict in any order.
+type GCounter struct {
+	Name  string           `json:"name"`
+	Value int64            `json:"value"`
+	Slots map[string]int64 `json:"slots"`
+}
+
+// GSet is a grow-only set: elements are added, never removed, so
+// concurrent additions merge by union. Elements are sorted.
+type GSet struct {
+	Name     string   `json:"name"`
+	Elements []string `json:"elements"`
 }
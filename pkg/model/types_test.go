@@ -1,6 +1,10 @@
 package model
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
 
 func TestTimestamp_LessEq_Reflexive(t *testing.T) {
 	ts := Timestamp{Epoch: 3, Round: 5}
@@ -22,14 +26,14 @@ func TestTimestamp_LessEq_PartialOrder(t *testing.T) {
 		a, b   Timestamp
 		expect bool
 	}{
-		{"both less", Timestamp{1, 1}, Timestamp{2, 2}, true},
-		{"equal", Timestamp{2, 2}, Timestamp{2, 2}, true},
-		{"epoch less, round equal", Timestamp{1, 2}, Timestamp{2, 2}, true},
-		{"epoch equal, round less", Timestamp{2, 1}, Timestamp{2, 2}, true},
-		{"epoch greater", Timestamp{3, 1}, Timestamp{2, 2}, false},
-		{"round greater", Timestamp{1, 3}, Timestamp{2, 2}, false},
-		{"incomparable: epoch less, round greater", Timestamp{1, 3}, Timestamp{2, 2}, false},
-		{"incomparable: epoch greater, round less", Timestamp{3, 1}, Timestamp{2, 2}, false},
+		{"both less", Timestamp{Epoch: 1, Round: 1}, Timestamp{Epoch: 2, Round: 2}, true},
+		{"equal", Timestamp{Epoch: 2, Round: 2}, Timestamp{Epoch: 2, Round: 2}, true},
+		{"epoch less, round equal", Timestamp{Epoch: 1, Round: 2}, Timestamp{Epoch: 2, Round: 2}, true},
+		{"epoch equal, round less", Timestamp{Epoch: 2, Round: 1}, Timestamp{Epoch: 2, Round: 2}, true},
+		{"epoch greater", Timestamp{Epoch: 3, Round: 1}, Timestamp{Epoch: 2, Round: 2}, false},
+		{"round greater", Timestamp{Epoch: 1, Round: 3}, Timestamp{Epoch: 2, Round: 2}, false},
+		{"incomparable: epoch less, round greater", Timestamp{Epoch: 1, Round: 3}, Timestamp{Epoch: 2, Round: 2}, false},
+		{"incomparable: epoch greater, round less", Timestamp{Epoch: 3, Round: 1}, Timestamp{Epoch: 2, Round: 2}, false},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -47,10 +51,10 @@ func TestTimestamp_Less_StrictlyLess(t *testing.T) {
 		a, b   Timestamp
 		expect bool
 	}{
-		{"strictly less both", Timestamp{1, 1}, Timestamp{2, 2}, true},
-		{"equal — not strict", Timestamp{2, 2}, Timestamp{2, 2}, false},
-		{"epoch less, round equal — strict", Timestamp{1, 2}, Timestamp{2, 2}, true},
-		{"incomparable", Timestamp{1, 3}, Timestamp{2, 2}, false},
+		{"strictly less both", Timestamp{Epoch: 1, Round: 1}, Timestamp{Epoch: 2, Round: 2}, true},
+		{"equal — not strict", Timestamp{Epoch: 2, Round: 2}, Timestamp{Epoch: 2, Round: 2}, false},
+		{"epoch less, round equal — strict", Timestamp{Epoch: 1, Round: 2}, Timestamp{Epoch: 2, Round: 2}, true},
+		{"incomparable", Timestamp{Epoch: 1, Round: 3}, Timestamp{Epoch: 2, Round: 2}, false},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -63,8 +67,8 @@ func TestTimestamp_Less_StrictlyLess(t *testing.T) {
 }
 
 func TestTimestamp_Antisymmetric(t *testing.T) {
-	a := Timestamp{1, 2}
-	b := Timestamp{2, 1}
+	a := Timestamp{Epoch: 1, Round: 2}
+	b := Timestamp{Epoch: 2, Round: 1}
 	// Incomparable: neither a <= b nor b <= a
 	if a.LessEq(b) {
 		t.Fatal("a should not be LessEq b")
@@ -75,9 +79,9 @@ func TestTimestamp_Antisymmetric(t *testing.T) {
 }
 
 func TestTimestamp_Transitive(t *testing.T) {
-	a := Timestamp{1, 1}
-	b := Timestamp{2, 2}
-	c := Timestamp{3, 3}
+	a := Timestamp{Epoch: 1, Round: 1}
+	b := Timestamp{Epoch: 2, Round: 2}
+	c := Timestamp{Epoch: 3, Round: 3}
 	if !a.Less(b) || !b.Less(c) {
 		t.Fatal("precondition failed")
 	}
@@ -88,8 +92,165 @@ func TestTimestamp_Transitive(t *testing.T) {
 
 func TestTimestamp_ZeroValue(t *testing.T) {
 	zero := Timestamp{}
-	any := Timestamp{1, 0}
+	any := Timestamp{Epoch: 1, Round: 0}
 	if !zero.LessEq(any) {
 		t.Fatal("zero should be <= any non-negative timestamp")
 	}
 }
+
+func TestTimestamp_Steps(t *testing.T) {
+	at := func(s string) Timestamp {
+		ts, err := ParseTimestamp(s)
+		if err != nil {
+			t.Fatalf("ParseTimestamp(%q): %v", s, err)
+		}
+		return ts
+	}
+	if ts := at("3.2.7"); ts.Epoch != 3 || ts.Round != 2 || len(ts.Steps) != 1 || ts.Steps[0] != 7 {
+		t.Fatalf("3.2.7 parsed as %+v", ts)
+	}
+	if !at("3.2.0.0").Equal(Timestamp{Epoch: 3, Round: 2}) || at("3.2.0").Steps != nil {
+		t.Fatal("trailing zero steps should not change a timestamp")
+	}
+	if !at("3").Equal(Timestamp{Epoch: 3}) {
+		t.Fatal(`"3" should be epoch 3 round 0`)
+	}
+	if !at("3.2.7").Less(at("3.2.8")) || !at("3.2").Less(at("3.2.1")) || at("3.2.7").LessEq(at("3.3")) {
+		t.Fatal("steps should be ordered coordinate-wise like epoch and round")
+	}
+	if got := at("3.1.9").Meet(at("2.4.1.5")); !got.Equal(at("2.1.1")) {
+		t.Fatalf("Meet = %s, want 2.1.1", got)
+	}
+	if got := at("3.2.7.1").String(); got != "3.2.7.1" {
+		t.Fatalf("String = %q", got)
+	}
+	if got := at("3.2.7.1").Fields(); got != "epoch=3 round=2 steps=7.1" {
+		t.Fatalf("Fields = %q", got)
+	}
+	for _, bad := range []string{"", "3.", "a.b", "3.-1"} {
+		if _, err := ParseTimestamp(bad); err == nil {
+			t.Errorf("ParseTimestamp(%q) should fail", bad)
+		}
+	}
+}
+
+func TestAgent_Presence(t *testing.T) {
+	now := time.Now()
+	cases := map[time.Duration]string{
+		30 * time.Second: "online",
+		5 * time.Minute:  "idle",
+		time.Hour:        "offline",
+	}
+	for ago, want := range cases {
+		a := Agent{LastSeen: now.Add(-ago)}
+		if got := a.Presence(now); got != want {
+			t.Errorf("seen %s ago: Presence = %q, want %q", ago, got, want)
+		}
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for in, want := range map[string]Priority{"": PriorityNormal, "urgent": PriorityUrgent, "low": PriorityLow} {
+		got, err := ParsePriority(in)
+		if err != nil || got != want {
+			t.Errorf("ParsePriority(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParsePriority("URGENT!"); err == nil {
+		t.Error("ParsePriority should reject unknown names")
+	}
+	if !(PriorityUrgent.Rank() > Priority("").Rank() && Priority("").Rank() == PriorityNormal.Rank() &&
+		PriorityNormal.Rank() > PriorityLow.Rank()) {
+		t.Error("Rank should order urgent > normal (or empty) > low")
+	}
+}
+
+func TestPermalink(t *testing.T) {
+	p := Permalink("alice", 7, 42)
+	if len(p) != 16 || p != Permalink("alice", 7, 42) {
+		t.Fatalf("Permalink = %q, want 16 stable hex digits", p)
+	}
+	for _, other := range []string{Permalink("bob", 7, 42), Permalink("alice", 8, 42), Permalink("alice", 7, 43)} {
+		if other == p {
+			t.Errorf("Permalink collision: %q", p)
+		}
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	caps, err := ParseCapabilities(" tests, Go,,db,go ")
+	if err != nil {
+		t.Fatalf("ParseCapabilities: %v", err)
+	}
+	if len(caps) != 3 || caps[0] != "db" || caps[1] != "go" || caps[2] != "tests" {
+		t.Fatalf("caps = %v, want [db go tests]", caps)
+	}
+	if _, err := ParseCapabilities("go,c++"); err == nil {
+		t.Error("expected error for invalid capability")
+	}
+}
+
+func TestAgent_PresenceDeparted(t *testing.T) {
+	now := time.Now()
+	a := Agent{LastSeen: now, DepartedAt: &now}
+	if got := a.Presence(now); got != "departed" {
+		t.Errorf("Presence = %q, want departed", got)
+	}
+}
+
+// TestPrime_V1Fields pins the field names of schema version 1. Adding a
+// field means adding it here; renaming or removing one needs a new
+// version.
+func TestPrime_V1Fields(t *testing.T) {
+	b, err := json.Marshal(Prime{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	json.Unmarshal(b, &got)
+	want := []string{"schema_version", "generated_at", "agent_id", "registered", "self", "agents",
+		"my_locks", "other_locks", "wip", "pending_count", "pending_messages", "frontier"}
+	for _, k := range want {
+		if _, ok := got[k]; !ok {
+			t.Errorf("Prime lost field %q", k)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("Prime has %d fields, want %d; add new ones to this test", len(got), len(want))
+	}
+}
+
+func TestVote_Result(t *testing.T) {
+	v := &Vote{Options: []string{"yes", "no"}, Quorum: 4, Ballots: []Ballot{
+		{AgentID: "dave", Choice: "yes", LamportTS: 9},
+		{AgentID: "bob", Choice: "no", LamportTS: 3},
+		{AgentID: "alice", Choice: "yes", LamportTS: 3},
+	}}
+	r := v.Result()
+	if r.Decided || r.Counted != 3 || r.Winner != "yes" {
+		t.Fatalf("before quorum: %+v", r)
+	}
+
+	// A 2-2 tie goes to the option that reached 2 first: "no" at ts=5
+	// beats "yes" at ts=9.
+	v.Ballots = append(v.Ballots, Ballot{AgentID: "carol", Choice: "no", LamportTS: 5})
+	r = v.Result()
+	if !r.Decided || r.Counts["yes"] != 2 || r.Counts["no"] != 2 || r.Winner != "no" {
+		t.Fatalf("tie: %+v", r)
+	}
+
+	// Ballots past the quorum are not counted.
+	v.Ballots = append(v.Ballots, Ballot{AgentID: "erin", Choice: "yes", LamportTS: 10})
+	if r2 := v.Result(); r2.Counted != 4 || r2.Winner != "no" {
+		t.Fatalf("late ballot changed the result: %+v", r2)
+	}
+
+	// Equal timestamps are ordered by agent ID: alice's ballot comes first.
+	v = &Vote{Options: []string{"a", "b"}, Quorum: 2, Ballots: []Ballot{
+		{AgentID: "bob", Choice: "b", LamportTS: 1},
+		{AgentID: "alice", Choice: "a", LamportTS: 1},
+	}}
+	if r := v.Result(); r.Winner != "a" {
+		t.Fatalf("winner = %q, want a", r.Winner)
+	}
+}
@@ -0,0 +1,305 @@
+// Package notify delivers "tell me when X happens" notifications.
+//
+// A notify file (.clockmail/notify.yaml) names transports and routes
+// events to them:
+//
+//	version: 1
+//	transports:
+//	  me:
+//	    type: desktop
+//	  team:
+//	    type: slack
+//	    url: https://hooks.slack.com/services/T000/B000/XXXX
+//	  pager:
+//	    type: exec
+//	    command: [./scripts/page.sh]
+//	routes:
+//	  - kinds: [review_req, review_done]
+//	    target: alice            # only events addressed to alice
+//	    notify: [me, team]
+//	  - kinds: [msg]
+//	    min_priority: urgent
+//	    notify: [pager]
+//
+// Transport types are looked up in a registry. The built-in types are
+// desktop, webhook, slack, email, and exec; embedders can add their own
+// with Register.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/daviddao/clockmail/pkg/model"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the notify schema version understood by this package.
+const Version = 1
+
+// Notification is a single message handed to a transport.
+type Notification struct {
+	Subject string       `json:"subject"`
+	Body    string       `json:"body"`
+	Event   *model.Event `json:"event,omitempty"` // nil for notifications not caused by an event
+}
+
+// ForEvent builds the notification sent for e.
+func ForEvent(e model.Event) Notification {
+	subject := fmt.Sprintf("[%s] %s", e.Kind, e.AgentID)
+	if e.Target != "" {
+		subject += " -> " + e.Target
+	}
+	if e.Priority == model.PriorityUrgent {
+		subject = "[urgent] " + subject
+	}
+	return Notification{Subject: subject, Body: e.Body, Event: &e}
+}
+
+// Notifier delivers notifications over one transport.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Transport configures a named notifier. Only the fields its type uses
+// need be set; Options carries settings for types registered by embedders.
+type Transport struct {
+	Type        string            `yaml:"type"`
+	URL         string            `yaml:"url,omitempty"`          // webhook, slack
+	Headers     map[string]string `yaml:"headers,omitempty"`      // webhook
+	Command     []string          `yaml:"command,omitempty"`      // exec
+	Addr        string            `yaml:"addr,omitempty"`         // email: SMTP host:port
+	From        string            `yaml:"from,omitempty"`         // email
+	To          []string          `yaml:"to,omitempty"`           // email
+	Username    string            `yaml:"username,omitempty"`     // email: SMTP auth
+	PasswordEnv string            `yaml:"password_env,omitempty"` // email: env var holding the SMTP password
+	Options     map[string]string `yaml:"options,omitempty"`
+}
+
+// Factory builds a notifier from its configuration.
+type Factory func(Transport) (Notifier, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a transport type available to notify files. It panics if
+// typ is registered twice, like database/sql.Register.
+func Register(typ string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[typ]; dup {
+		panic("notify: Register called twice for type " + typ)
+	}
+	registry[typ] = f
+}
+
+// Types returns the registered transport types, sorted.
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	types := make([]string, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func lookup(typ string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	f, ok := registry[typ]
+	return f, ok
+}
+
+// Route sends events matching all of its filters to the Notify
+// transports. Empty filters match everything.
+type Route struct {
+	Name        string   `yaml:"name,omitempty"`
+	Kinds       []string `yaml:"kinds,omitempty"`        // event kinds
+	From        []string `yaml:"from,omitempty"`         // sending agents
+	Target      string   `yaml:"target,omitempty"`       // recipient agent or lock path
+	MinPriority string   `yaml:"min_priority,omitempty"` // lowest message priority to forward
+	Notify      []string `yaml:"notify"`
+}
+
+// Matches reports whether e passes the route's filters.
+func (r *Route) Matches(e model.Event) bool {
+	if len(r.Kinds) > 0 && !slices.Contains(r.Kinds, string(e.Kind)) {
+		return false
+	}
+	if len(r.From) > 0 && !slices.Contains(r.From, e.AgentID) {
+		return false
+	}
+	if r.Target != "" && r.Target != e.Target {
+		return false
+	}
+	if r.MinPriority != "" {
+		floor, _ := model.ParsePriority(r.MinPriority)
+		if e.Priority.Rank() < floor.Rank() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Route) label(i int) string {
+	if r.Name != "" {
+		return fmt.Sprintf("route %q", r.Name)
+	}
+	return fmt.Sprintf("route %d", i+1)
+}
+
+// Config is a parsed notify file.
+type Config struct {
+	Version    int                  `yaml:"version"`
+	Transports map[string]Transport `yaml:"transports"`
+	Routes     []Route              `yaml:"routes"`
+}
+
+// Parse decodes and validates a notify file. Unknown keys are rejected so
+// that typos do not silently drop notifications.
+func Parse(data []byte) (*Config, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parse notify config: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Load reads and parses a notify file.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Validate checks the configuration for internal consistency. All problems
+// are reported at once, joined into a single error.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Version != Version {
+		errs = append(errs, fmt.Errorf("unsupported version %d (want %d)", c.Version, Version))
+	}
+	for _, name := range sortedKeys(c.Transports) {
+		t := c.Transports[name]
+		if _, ok := lookup(t.Type); !ok {
+			errs = append(errs, fmt.Errorf("transport %q: unknown type %q (known: %s)",
+				name, t.Type, strings.Join(Types(), ", ")))
+		}
+	}
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		if len(r.Notify) == 0 {
+			errs = append(errs, fmt.Errorf("%s: notify is empty", r.label(i)))
+		}
+		for _, t := range r.Notify {
+			if _, ok := c.Transports[t]; !ok {
+				errs = append(errs, fmt.Errorf("%s: undefined transport %q", r.label(i), t))
+			}
+		}
+		if r.MinPriority != "" {
+			if _, err := model.ParsePriority(r.MinPriority); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", r.label(i), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Dispatcher routes events to the notifiers built from a Config.
+type Dispatcher struct {
+	routes    []Route
+	notifiers map[string]Notifier
+}
+
+// Build constructs every configured transport.
+func (c *Config) Build() (*Dispatcher, error) {
+	d := &Dispatcher{routes: c.Routes, notifiers: make(map[string]Notifier)}
+	var errs []error
+	for _, name := range sortedKeys(c.Transports) {
+		t := c.Transports[name]
+		f, ok := lookup(t.Type)
+		if !ok {
+			errs = append(errs, fmt.Errorf("transport %q: unknown type %q", name, t.Type))
+			continue
+		}
+		n, err := f(t)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("transport %q: %w", name, err))
+			continue
+		}
+		d.notifiers[name] = n
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Dispatch notifies every transport with a route matching e. Each
+// transport is notified at most once per event, even if several routes
+// match. Delivery failures are joined into the returned error; they do not
+// stop delivery to the remaining transports.
+func (d *Dispatcher) Dispatch(ctx context.Context, e model.Event) error {
+	var targets []string
+	for i := range d.routes {
+		if !d.routes[i].Matches(e) {
+			continue
+		}
+		for _, t := range d.routes[i].Notify {
+			if !slices.Contains(targets, t) {
+				targets = append(targets, t)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	n := ForEvent(e)
+	var errs []error
+	for _, t := range targets {
+		if err := d.Send(ctx, t, n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Send delivers n over the named transport, bypassing routes.
+func (d *Dispatcher) Send(ctx context.Context, transport string, n Notification) error {
+	nt, ok := d.notifiers[transport]
+	if !ok {
+		return fmt.Errorf("unknown transport %q", transport)
+	}
+	if err := nt.Notify(ctx, n); err != nil {
+		return fmt.Errorf("%s: %w", transport, err)
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,203 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// recorder is a test transport that keeps what it is sent.
+type recorder struct{ got []Notification }
+
+func (r *recorder) Notify(_ context.Context, n Notification) error {
+	r.got = append(r.got, n)
+	return nil
+}
+
+var recorders = map[string]*recorder{}
+
+func init() {
+	Register("test-recorder", func(t Transport) (Notifier, error) {
+		r := &recorder{}
+		recorders[t.Options["id"]] = r
+		return r, nil
+	})
+}
+
+func TestParse_Valid(t *testing.T) {
+	c, err := Parse([]byte(`
+version: 1
+transports:
+  hook: {type: webhook, url: http://example.invalid/hook}
+routes:
+  - kinds: [msg]
+    min_priority: urgent
+    notify: [hook]
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(c.Transports) != 1 || len(c.Routes) != 1 {
+		t.Fatalf("parsed %+v", c)
+	}
+}
+
+func TestParse_ReportsAllProblems(t *testing.T) {
+	_, err := Parse([]byte(`
+version: 2
+transports:
+  x: {type: carrier-pigeon}
+routes:
+  - name: broken
+    min_priority: asap
+    notify: [nowhere]
+  - kinds: [msg]
+`))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"unsupported version", `unknown type "carrier-pigeon"`,
+		`route "broken": undefined transport "nowhere"`, `invalid priority "asap"`, "route 2: notify is empty"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error missing %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestParse_RejectsUnknownKeys(t *testing.T) {
+	if _, err := Parse([]byte("version: 1\nroutes:\n  - kinds: [msg]\n    notfiy: [x]\n")); err == nil {
+		t.Fatal("expected error for misspelled key")
+	}
+}
+
+func TestRoute_Matches(t *testing.T) {
+	e := model.Event{AgentID: "alice", Kind: model.EventMsg, Target: "bob", Priority: model.PriorityUrgent}
+	cases := []struct {
+		r    Route
+		want bool
+	}{
+		{Route{}, true},
+		{Route{Kinds: []string{"msg"}, From: []string{"alice"}, Target: "bob"}, true},
+		{Route{Kinds: []string{"lock_req"}}, false},
+		{Route{From: []string{"carol"}}, false},
+		{Route{Target: "carol"}, false},
+		{Route{MinPriority: "urgent"}, true},
+	}
+	for i, c := range cases {
+		if got := c.r.Matches(e); got != c.want {
+			t.Errorf("case %d: Matches = %v, want %v", i, got, c.want)
+		}
+	}
+	e.Priority = ""
+	if (&Route{MinPriority: "urgent"}).Matches(e) {
+		t.Error("normal message should not pass min_priority urgent")
+	}
+}
+
+func TestDispatch_NotifiesEachTransportOnce(t *testing.T) {
+	c, err := Parse([]byte(`
+version: 1
+transports:
+  a: {type: test-recorder, options: {id: dispatch-a}}
+  b: {type: test-recorder, options: {id: dispatch-b}}
+routes:
+  - kinds: [review_req]
+    notify: [a]
+  - target: bob
+    notify: [a, b]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := d.Dispatch(ctx, model.Event{AgentID: "alice", Kind: model.EventReviewReq, Target: "bob", Body: "abc123"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Dispatch(ctx, model.Event{AgentID: "alice", Kind: model.EventMsg, Target: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	a, b := recorders["dispatch-a"], recorders["dispatch-b"]
+	if len(a.got) != 1 || len(b.got) != 1 {
+		t.Fatalf("deliveries: a=%d b=%d, want 1 each", len(a.got), len(b.got))
+	}
+	if n := a.got[0]; n.Subject != "[review_req] alice -> bob" || n.Body != "abc123" || n.Event == nil {
+		t.Errorf("notification = %+v", n)
+	}
+}
+
+func TestWebhookAndSlack(t *testing.T) {
+	var bodies []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&v)
+		bodies = append(bodies, v)
+		if r.Header.Get("X-Token") == "bad" {
+			http.Error(w, "nope", http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	n := Notification{Subject: "hello", Body: "world"}
+	hook, _ := newWebhook(Transport{URL: srv.URL})
+	if err := hook.Notify(context.Background(), n); err != nil {
+		t.Fatalf("webhook: %v", err)
+	}
+	sl, _ := newSlack(Transport{URL: srv.URL})
+	if err := sl.Notify(context.Background(), n); err != nil {
+		t.Fatalf("slack: %v", err)
+	}
+	if bodies[0]["subject"] != "hello" || bodies[1]["text"] != "*hello*\nworld" {
+		t.Errorf("payloads = %v", bodies)
+	}
+
+	bad, _ := newWebhook(Transport{URL: srv.URL, Headers: map[string]string{"X-Token": "bad"}})
+	if err := bad.Notify(context.Background(), n); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected 403 error, got %v", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	x, err := newExec(Transport{Command: []string{"sh", "-c", `cat > "$0"; echo "$CM_NOTIFY_KIND" >> "$0"`, out}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Notify(context.Background(), ForEvent(model.Event{AgentID: "alice", Kind: model.EventMsg})); err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	data, _ := os.ReadFile(out)
+	if !strings.Contains(string(data), `"subject":"[msg] alice"`) || !strings.HasSuffix(string(data), "msg\n") {
+		t.Errorf("exec saw %q", data)
+	}
+
+	fail, _ := newExec(Transport{Command: []string{"sh", "-c", "echo boom >&2; exit 3"}})
+	if err := fail.Notify(context.Background(), Notification{}); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expected failing command error, got %v", err)
+	}
+}
+
+func TestBuild_RequiresTransportSettings(t *testing.T) {
+	c := &Config{Version: 1, Transports: map[string]Transport{
+		"w": {Type: "webhook"}, "m": {Type: "email"}, "x": {Type: "exec"},
+	}}
+	_, err := c.Build()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, name := range []string{`"w"`, `"m"`, `"x"`} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error missing transport %s: %v", name, err)
+		}
+	}
+}
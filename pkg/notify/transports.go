@@ -0,0 +1,182 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("desktop", newDesktop)
+	Register("webhook", newWebhook)
+	Register("slack", newSlack)
+	Register("email", newEmail)
+	Register("exec", newExec)
+}
+
+// httpClient is shared by the webhook and slack transports.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON POSTs v to url and fails on a non-2xx response.
+func postJSON(ctx context.Context, url string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("POST %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// webhook POSTs the notification as JSON.
+type webhook struct {
+	url     string
+	headers map[string]string
+}
+
+func newWebhook(t Transport) (Notifier, error) {
+	if t.URL == "" {
+		return nil, errors.New("webhook: url is required")
+	}
+	return &webhook{url: t.URL, headers: t.Headers}, nil
+}
+
+func (w *webhook) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, w.url, w.headers, n)
+}
+
+// slack posts to a Slack incoming webhook.
+type slack struct{ url string }
+
+func newSlack(t Transport) (Notifier, error) {
+	if t.URL == "" {
+		return nil, errors.New("slack: url is required")
+	}
+	return &slack{url: t.URL}, nil
+}
+
+func (s *slack) Notify(ctx context.Context, n Notification) error {
+	text := "*" + n.Subject + "*"
+	if n.Body != "" {
+		text += "\n" + n.Body
+	}
+	return postJSON(ctx, s.url, nil, map[string]string{"text": text})
+}
+
+// execNotifier runs a command with the notification as JSON on stdin and
+// its fields in CM_NOTIFY_* environment variables.
+type execNotifier struct{ argv []string }
+
+func newExec(t Transport) (Notifier, error) {
+	if len(t.Command) == 0 {
+		return nil, errors.New("exec: command is required")
+	}
+	return &execNotifier{argv: t.Command}, nil
+}
+
+func (x *execNotifier) Notify(ctx context.Context, n Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, x.argv[0], x.argv[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(), "CM_NOTIFY_SUBJECT="+n.Subject, "CM_NOTIFY_BODY="+n.Body)
+	if n.Event != nil {
+		cmd.Env = append(cmd.Env,
+			"CM_NOTIFY_KIND="+string(n.Event.Kind),
+			"CM_NOTIFY_FROM="+n.Event.AgentID,
+			"CM_NOTIFY_TARGET="+n.Event.Target,
+		)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", x.argv[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// desktop shows a local desktop notification via notify-send (Linux and
+// BSDs) or osascript (macOS).
+type desktop struct{}
+
+func newDesktop(Transport) (Notifier, error) { return desktop{}, nil }
+
+func (desktop) Notify(ctx context.Context, n Notification) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		script := fmt.Sprintf("display notification %q with title %q", n.Body, n.Subject)
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	} else {
+		cmd = exec.CommandContext(ctx, "notify-send", "--app-name=clockmail", n.Subject, n.Body)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd.Path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// email sends the notification over SMTP. The password is read from the
+// environment so it never appears in the notify file.
+type email struct {
+	addr, from string
+	to         []string
+	auth       smtp.Auth
+}
+
+func newEmail(t Transport) (Notifier, error) {
+	if t.Addr == "" || t.From == "" || len(t.To) == 0 {
+		return nil, errors.New("email: addr, from, and to are required")
+	}
+	e := &email{addr: t.Addr, from: t.From, to: t.To}
+	if t.Username != "" {
+		host, _, err := net.SplitHostPort(t.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("email: addr: %w", err)
+		}
+		e.auth = smtp.PlainAuth("", t.Username, os.Getenv(t.PasswordEnv), host)
+	}
+	return e, nil
+}
+
+func (e *email) Notify(ctx context.Context, n Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.Subject)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", n.Body)
+	// net/smtp has no context support; bound the call by ctx instead.
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(e.addr, e.auth, e.from, e.to, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
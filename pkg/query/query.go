@@ -0,0 +1,504 @@
+// Package query implements the filter expressions accepted by cm log,
+// watch and stats:
+//
+//	kind=msg and agent=alice and body~"refactor" and epoch>=3
+//	(kind=lock_req or kind=lock_rel) and not target~vendor/
+//	age<1h and priority=urgent
+//
+// A query is a boolean combination (and, or, not, parentheses) of
+// comparisons between an event field and a value. It compiles to a SQL
+// WHERE clause for the store, and can also be evaluated against a single
+// event for streams that are filtered as they are read.
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// Query is a parsed filter expression. A nil *Query matches every event.
+type Query struct {
+	src  string
+	root node
+}
+
+// Fields lists the event fields a query can compare, in documentation
+// order.
+var Fields = []string{"id", "agent", "ts", "epoch", "round", "kind", "target", "body",
+	"priority", "tool", "run_id", "branch", "age"}
+
+type fieldType int
+
+const (
+	textField fieldType = iota
+	intField
+	ageField // duration since the event was created
+)
+
+type field struct {
+	column string
+	typ    fieldType
+	get    func(e *model.Event) interface{}
+}
+
+var fields = map[string]field{
+	"id":       {"id", intField, func(e *model.Event) interface{} { return e.ID }},
+	"agent":    {"agent_id", textField, func(e *model.Event) interface{} { return e.AgentID }},
+	"ts":       {"lamport_ts", intField, func(e *model.Event) interface{} { return e.LamportTS }},
+	"epoch":    {"epoch", intField, func(e *model.Event) interface{} { return e.Epoch }},
+	"round":    {"round", intField, func(e *model.Event) interface{} { return e.Round }},
+	"kind":     {"kind", textField, func(e *model.Event) interface{} { return string(e.Kind) }},
+	"target":   {"COALESCE(%starget,'')", textField, func(e *model.Event) interface{} { return e.Target }},
+	"body":     {"COALESCE(%sbody,'')", textField, func(e *model.Event) interface{} { return e.Body }},
+	"priority": {"priority", textField, func(e *model.Event) interface{} { return storedPriority(e.Priority) }},
+	"tool":     {"tool", textField, func(e *model.Event) interface{} { return e.Tool }},
+	"run_id":   {"run_id", textField, func(e *model.Event) interface{} { return e.RunID }},
+	"branch":   {"branch", textField, func(e *model.Event) interface{} { return e.Branch }},
+	"age":      {"created_at", ageField, func(e *model.Event) interface{} { return e.CreatedAt }},
+}
+
+// aliases are accepted spellings of field names.
+var aliases = map[string]string{
+	"agent_id": "agent", "from": "agent", "lamport_ts": "ts", "to": "target", "type": "kind",
+}
+
+// Parse compiles src into a Query. An empty (or all-blank) src returns
+// nil, which matches everything.
+func Parse(src string) (*Query, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+	p := &parser{lex: lexer{src: src}}
+	p.next()
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Query{src: src, root: root}, nil
+}
+
+// String returns the source text of q.
+func (q *Query) String() string {
+	if q == nil {
+		return ""
+	}
+	return q.src
+}
+
+// Where returns q as a SQL boolean expression over the events table and
+// its arguments, with ? placeholders. prefix qualifies column names, for
+// example "e." when events are joined under the alias e. A nil query
+// compiles to a condition that is always true.
+func (q *Query) Where(prefix string) (string, []interface{}) {
+	if q == nil {
+		return "1=1", nil
+	}
+	var b strings.Builder
+	var args []interface{}
+	q.root.sql(&b, &args, prefix, time.Now())
+	return b.String(), args
+}
+
+// Match reports whether e satisfies q. It agrees with Where.
+func (q *Query) Match(e model.Event) bool {
+	if q == nil {
+		return true
+	}
+	return q.root.match(&e, time.Now())
+}
+
+// storedPriority mirrors how the store records priorities: normal is
+// stored as the empty string.
+func storedPriority(p model.Priority) string {
+	if p == model.PriorityNormal {
+		return ""
+	}
+	return string(p)
+}
+
+// --- AST ---
+
+type node interface {
+	sql(b *strings.Builder, args *[]interface{}, prefix string, now time.Time)
+	match(e *model.Event, now time.Time) bool
+}
+
+type andNode struct{ l, r node }
+type orNode struct{ l, r node }
+type notNode struct{ x node }
+
+type cmpNode struct {
+	field field
+	op    string
+	text  string        // textField
+	num   int64         // intField
+	age   time.Duration // ageField
+}
+
+func (n andNode) sql(b *strings.Builder, args *[]interface{}, prefix string, now time.Time) {
+	b.WriteString("(")
+	n.l.sql(b, args, prefix, now)
+	b.WriteString(" AND ")
+	n.r.sql(b, args, prefix, now)
+	b.WriteString(")")
+}
+
+func (n andNode) match(e *model.Event, now time.Time) bool {
+	return n.l.match(e, now) && n.r.match(e, now)
+}
+
+func (n orNode) sql(b *strings.Builder, args *[]interface{}, prefix string, now time.Time) {
+	b.WriteString("(")
+	n.l.sql(b, args, prefix, now)
+	b.WriteString(" OR ")
+	n.r.sql(b, args, prefix, now)
+	b.WriteString(")")
+}
+
+func (n orNode) match(e *model.Event, now time.Time) bool {
+	return n.l.match(e, now) || n.r.match(e, now)
+}
+
+func (n notNode) sql(b *strings.Builder, args *[]interface{}, prefix string, now time.Time) {
+	b.WriteString("NOT ")
+	n.x.sql(b, args, prefix, now)
+}
+
+func (n notNode) match(e *model.Event, now time.Time) bool {
+	return !n.x.match(e, now)
+}
+
+func (n cmpNode) sql(b *strings.Builder, args *[]interface{}, prefix string, now time.Time) {
+	col := prefix + n.field.column
+	if strings.Contains(n.field.column, "%s") {
+		col = fmt.Sprintf(n.field.column, prefix)
+	}
+	switch n.field.typ {
+	case textField:
+		switch n.op {
+		case "~", "!~":
+			neg := ""
+			if n.op == "!~" {
+				neg = "NOT "
+			}
+			fmt.Fprintf(b, "(LOWER(%s) %sLIKE ? ESCAPE '\\')", col, neg)
+			*args = append(*args, "%"+escapeLike(strings.ToLower(n.text))+"%")
+		default:
+			fmt.Fprintf(b, "(%s %s ?)", col, sqlOp(n.op))
+			*args = append(*args, n.text)
+		}
+	case intField:
+		fmt.Fprintf(b, "(%s %s ?)", col, sqlOp(n.op))
+		*args = append(*args, n.num)
+	case ageField:
+		// age < d means created after now-d: the comparison flips.
+		cutoff := now.Add(-n.age).UTC().Format(time.RFC3339Nano)
+		fmt.Fprintf(b, "(%s %s ?)", col, sqlOp(flip(n.op)))
+		*args = append(*args, cutoff)
+	}
+}
+
+func (n cmpNode) match(e *model.Event, now time.Time) bool {
+	switch v := n.field.get(e).(type) {
+	case string:
+		switch n.op {
+		case "~":
+			return strings.Contains(strings.ToLower(v), strings.ToLower(n.text))
+		case "!~":
+			return !strings.Contains(strings.ToLower(v), strings.ToLower(n.text))
+		}
+		return compare(strings.Compare(v, n.text), n.op)
+	case int64:
+		return compare(cmp64(v, n.num), n.op)
+	case time.Time:
+		return compare(cmp64(int64(now.Sub(v)), int64(n.age)), n.op)
+	}
+	return false
+}
+
+func cmp64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compare(c int, op string) bool {
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func sqlOp(op string) string {
+	if op == "!=" {
+		return "<>"
+	}
+	return op
+}
+
+func flip(op string) string {
+	switch op {
+	case "<":
+		return ">"
+	case "<=":
+		return ">="
+	case ">":
+		return "<"
+	case ">=":
+		return "<="
+	}
+	return op
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// --- parser ---
+
+type parser struct {
+	lex lexer
+	tok token
+}
+
+func (p *parser) next() { p.tok = p.lex.next() }
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	if p.tok.kind == tokError {
+		return fmt.Errorf("query: at offset %d: %s", p.tok.pos, p.tok.text)
+	}
+	return fmt.Errorf("query: at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) keyword(kw string) bool {
+	return p.tok.kind == tokWord && strings.EqualFold(p.tok.text, kw)
+}
+
+// parseOr parses: and ("or" and)*
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, r}
+	}
+	return l, nil
+}
+
+// parseAnd parses: unary ("and" unary)*
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, r}
+	}
+	return l, nil
+}
+
+// parseUnary parses: "not" unary | "(" or ")" | comparison
+func (p *parser) parseUnary() (node, error) {
+	switch {
+	case p.keyword("not"):
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{x}, nil
+	case p.tok.kind == tokLParen:
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ), got %s", p.tok)
+		}
+		p.next()
+		return x, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses: field op value
+func (p *parser) parseComparison() (node, error) {
+	if p.tok.kind != tokWord {
+		return nil, p.errorf("expected a field name, got %s", p.tok)
+	}
+	name := strings.ToLower(p.tok.text)
+	if a, ok := aliases[name]; ok {
+		name = a
+	}
+	f, ok := fields[name]
+	if !ok {
+		return nil, p.errorf("unknown field %q (fields: %s)", p.tok.text, strings.Join(Fields, ", "))
+	}
+	p.next()
+
+	if p.tok.kind != tokOp {
+		return nil, p.errorf("expected an operator after %s, got %s", name, p.tok)
+	}
+	op := p.tok.text
+	switch {
+	case f.typ == textField && (op == "<" || op == "<=" || op == ">" || op == ">="):
+		return nil, p.errorf("%s is text and does not support %s", name, op)
+	case f.typ != textField && (op == "~" || op == "!~"):
+		return nil, p.errorf("%s is a number and does not support %s", name, op)
+	case f.typ == ageField && (op == "=" || op == "!="):
+		return nil, p.errorf("%s is compared with <, <=, > or >=", name)
+	}
+	p.next()
+
+	if p.tok.kind != tokWord && p.tok.kind != tokString {
+		return nil, p.errorf("expected a value after %s%s, got %s", name, op, p.tok)
+	}
+	n := cmpNode{field: f, op: op, text: p.tok.text}
+	switch f.typ {
+	case intField:
+		v, err := strconv.ParseInt(p.tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("%s needs an integer, got %q", name, p.tok.text)
+		}
+		n.num = v
+	case ageField:
+		d, err := time.ParseDuration(p.tok.text)
+		if err != nil {
+			return nil, p.errorf("%s needs a duration like 30m or 2h, got %q", name, p.tok.text)
+		}
+		n.age = d
+	case textField:
+		if name == "priority" && strings.EqualFold(n.text, string(model.PriorityNormal)) {
+			n.text = ""
+		}
+	}
+	p.next()
+	return n, nil
+}
+
+// --- lexer ---
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokError
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokError:
+		return t.text
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+// wordChar reports whether c can appear in an unquoted word: field
+// names, numbers, durations, agent IDs and paths.
+func wordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("_-./@:*+", c) >= 0
+}
+
+func (l *lexer) next() token {
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t' || l.src[l.pos] == '\n') {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}
+	case c == '"':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != '"' {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return token{kind: tokError, text: "unterminated string", pos: start}
+		}
+		l.pos++
+		s, err := strconv.Unquote(l.src[start:l.pos])
+		if err != nil {
+			return token{kind: tokError, text: "invalid string " + l.src[start:l.pos], pos: start}
+		}
+		return token{kind: tokString, text: s, pos: start}
+	case strings.IndexByte("=!<>~", c) >= 0:
+		for _, op := range []string{"!=", "!~", "<=", ">=", "=", "<", ">", "~"} {
+			if strings.HasPrefix(l.src[l.pos:], op) {
+				l.pos += len(op)
+				return token{kind: tokOp, text: op, pos: start}
+			}
+		}
+	case wordChar(c):
+		for l.pos < len(l.src) && wordChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokWord, text: l.src[start:l.pos], pos: start}
+	}
+	return token{kind: tokError, text: fmt.Sprintf("unexpected character %q", c), pos: start}
+}
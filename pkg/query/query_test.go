@@ -0,0 +1,109 @@
+package query
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestParse_Empty(t *testing.T) {
+	q, err := Parse("  ")
+	if err != nil || q != nil {
+		t.Fatalf("Parse(blank) = %v, %v; want nil, nil", q, err)
+	}
+	if !q.Match(model.Event{}) {
+		t.Fatal("nil query should match everything")
+	}
+	if where, args := q.Where(""); where != "1=1" || args != nil {
+		t.Fatalf("nil Where = %q, %v", where, args)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	e := model.Event{ID: 7, AgentID: "alice", LamportTS: 12, Epoch: 3, Round: 1, Kind: model.EventMsg,
+		Target: "bob", Body: "Starting the REFACTOR of pkg/store", Priority: model.PriorityUrgent,
+		CreatedAt: time.Now().Add(-10 * time.Minute)}
+	cases := []struct {
+		src  string
+		want bool
+	}{
+		{`kind=msg and agent=alice and body~"refactor" and epoch>=3`, true},
+		{`kind=msg and epoch>3`, false},
+		{`kind=lock_req or to=bob`, true},
+		{`not agent=alice`, false},
+		{`agent!=alice or (ts<=12 and round=1)`, true},
+		{`body!~refactor`, false},
+		{`body~"pkg/store" and id=7`, true},
+		{`priority=urgent and age<1h`, true},
+		{`age<5m`, false},
+		{`age>=5m AND NOT kind=progress`, true},
+		{`priority=normal`, false},
+		{`tool=""`, true},
+	}
+	for _, c := range cases {
+		q, err := Parse(c.src)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", c.src, err)
+		}
+		if got := q.Match(e); got != c.want {
+			t.Errorf("%s: Match = %v, want %v", c.src, got, c.want)
+		}
+	}
+}
+
+func TestWhere(t *testing.T) {
+	q, err := Parse(`kind=msg and (agent=alice or not epoch>=3) and body~"50%_done"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, args := q.Where("e.")
+	want := `(((e.kind = ?) AND ((e.agent_id = ?) OR NOT (e.epoch >= ?))) AND (LOWER(COALESCE(e.body,'')) LIKE ? ESCAPE '\'))`
+	if where != want {
+		t.Fatalf("Where =\n  %s\nwant\n  %s", where, want)
+	}
+	if len(args) != 4 || args[0] != "msg" || args[1] != "alice" || args[2] != int64(3) || args[3] != `%50\%\_done%` {
+		t.Fatalf("args = %#v", args)
+	}
+
+	q, _ = Parse("age<1h")
+	where, args = q.Where("")
+	if where != "(created_at > ?)" || len(args) != 1 {
+		t.Fatalf("age Where = %q, %v", where, args)
+	}
+	cutoff, err := time.Parse(time.RFC3339Nano, args[0].(string))
+	if err != nil || time.Since(cutoff) < 59*time.Minute || time.Since(cutoff) > 61*time.Minute {
+		t.Fatalf("age cutoff = %v, %v", args[0], err)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	cases := []struct{ src, want string }{
+		{"colour=red", `unknown field "colour"`},
+		{"kind msg", "expected an operator after kind"},
+		{"epoch>=three", "epoch needs an integer"},
+		{"age<soon", "age needs a duration"},
+		{"agent<bob", "agent is text and does not support <"},
+		{"epoch~3", "epoch is a number and does not support ~"},
+		{"age=1h", "age is compared with <, <=, > or >="},
+		{"kind=msg and", "expected a field name, got end of query"},
+		{"(kind=msg", "expected ), got end of query"},
+		{"kind=msg agent=bob", `unexpected "agent"`},
+		{`body~"open`, "unterminated string"},
+		{"kind=msg & agent=bob", "unexpected character '&'"},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.src)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("Parse(%q) error = %v, want %q", c.src, err, c.want)
+		}
+	}
+}
+
+func TestParse_ErrorOffset(t *testing.T) {
+	_, err := Parse("kind=msg & agent=bob")
+	if err == nil || err.Error() != "query: at offset 9: unexpected character '&'" {
+		t.Fatalf("error = %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Package seal encrypts message bodies for a single recipient.
+//
+// Each agent has an X25519 key pair; the public half is registered in the
+// shared database and the private half stays on the agent's machine. A
+// sealed body is encrypted with AES-256-GCM under a key derived (HKDF-
+// SHA256) from a fresh ephemeral key pair and the recipient's public key,
+// so only the recipient can open it and the database never sees the
+// plaintext. Senders are not authenticated: anyone who can write to the
+// database can seal a message to any agent.
+//
+// Sealed bodies are text, so they travel through the event log like any
+// other body:
+//
+//	cm-sealed:v1:<base64(ephemeral public key | nonce | ciphertext)>
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Prefix marks a sealed body.
+const Prefix = "cm-sealed:v1:"
+
+// info binds derived keys to this format.
+const info = "clockmail seal v1"
+
+// ErrNotSealed is returned by Open for bodies that are not sealed.
+var ErrNotSealed = errors.New("body is not sealed")
+
+// GenerateKey returns a new key pair, each half base64-encoded.
+func GenerateKey() (priv, pub string, err error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return encode(k.Bytes()), encode(k.PublicKey().Bytes()), nil
+}
+
+// PublicKey returns the public half of a base64-encoded private key.
+func PublicKey(priv string) (string, error) {
+	k, err := parsePrivate(priv)
+	if err != nil {
+		return "", err
+	}
+	return encode(k.PublicKey().Bytes()), nil
+}
+
+// ValidatePublicKey reports whether pub is a base64-encoded X25519 public
+// key.
+func ValidatePublicKey(pub string) error {
+	_, err := parsePublic(pub)
+	return err
+}
+
+// IsSealed reports whether body was produced by Seal.
+func IsSealed(body string) bool { return strings.HasPrefix(body, Prefix) }
+
+// Seal encrypts plaintext for the holder of the private key matching pub.
+func Seal(pub string, plaintext []byte) (string, error) {
+	to, err := parsePublic(pub)
+	if err != nil {
+		return "", err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(eph, to, eph.PublicKey())
+	if err != nil {
+		return "", err
+	}
+	out := append([]byte{}, eph.PublicKey().Bytes()...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, plaintext, eph.PublicKey().Bytes())
+	return Prefix + encode(out), nil
+}
+
+// Open decrypts a sealed body with a base64-encoded private key.
+func Open(priv, body string) ([]byte, error) {
+	if !IsSealed(body) {
+		return nil, ErrNotSealed
+	}
+	k, err := parsePrivate(priv)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(body, Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("sealed body: %w", err)
+	}
+	const keyLen = 32
+	if len(raw) < keyLen {
+		return nil, errors.New("sealed body is truncated")
+	}
+	eph, err := ecdh.X25519().NewPublicKey(raw[:keyLen])
+	if err != nil {
+		return nil, fmt.Errorf("sealed body: %w", err)
+	}
+	aead, err := newAEAD(k, eph, eph)
+	if err != nil {
+		return nil, err
+	}
+	rest := raw[keyLen:]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("sealed body is truncated")
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], raw[:keyLen])
+	if err != nil {
+		return nil, errors.New("sealed body was not sealed for this key, or was altered")
+	}
+	return plaintext, nil
+}
+
+// newAEAD derives the AES-GCM cipher shared by priv and peer, salted with
+// the ephemeral public key.
+func newAEAD(priv *ecdh.PrivateKey, peer, eph *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, shared, eph.Bytes(), info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parsePrivate(s string) (*ecdh.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+	k, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+	return k, nil
+}
+
+func parsePublic(s string) (*ecdh.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+	k, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+	return k, nil
+}
+
+func encode(b []byte) string { return base64.StdEncoding.EncodeToString(b) }
@@ -0,0 +1,59 @@
+package seal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	priv, pub, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := PublicKey(priv); err != nil || p != pub {
+		t.Fatalf("PublicKey = %q, %v; want %q", p, err, pub)
+	}
+
+	sealed, err := Seal(pub, []byte("the token is 1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || strings.Contains(sealed, "1234") {
+		t.Fatalf("sealed = %q", sealed)
+	}
+	if again, _ := Seal(pub, []byte("the token is 1234")); again == sealed {
+		t.Fatal("sealing twice should give different ciphertexts")
+	}
+	got, err := Open(priv, sealed)
+	if err != nil || string(got) != "the token is 1234" {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+}
+
+func TestOpen_Rejects(t *testing.T) {
+	priv, pub, _ := GenerateKey()
+	other, _, _ := GenerateKey()
+	sealed, _ := Seal(pub, []byte("secret"))
+
+	if _, err := Open(other, sealed); err == nil {
+		t.Error("opened with the wrong key")
+	}
+	b := []byte(sealed)
+	if b[len(b)-10] == 'A' {
+		b[len(b)-10] = 'B'
+	} else {
+		b[len(b)-10] = 'A'
+	}
+	if _, err := Open(priv, string(b)); err == nil {
+		t.Error("opened a tampered body")
+	}
+	if _, err := Open(priv, "plain text"); err != ErrNotSealed {
+		t.Errorf("Open(plain) err = %v, want ErrNotSealed", err)
+	}
+	if _, err := Open(priv, Prefix+"AAAA"); err == nil {
+		t.Error("opened a truncated body")
+	}
+	if err := ValidatePublicKey("not a key"); err == nil {
+		t.Error("ValidatePublicKey accepted garbage")
+	}
+}
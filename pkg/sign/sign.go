@@ -0,0 +1,71 @@
+// Package sign proves which agent wrote an event.
+//
+// Each agent has an Ed25519 key pair. The private key stays on the
+// agent's machine and signs every event the agent writes; the public key
+// is registered in the shared database the first time the agent
+// registers, and from then on anyone can check that an event claiming to
+// come from the agent really does, and has not been altered since.
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrBadSignature is returned by Verify when a signature does not match.
+var ErrBadSignature = errors.New("signature does not match")
+
+// GenerateKey returns a new key pair, each half base64-encoded. The
+// private half is the 32-byte seed.
+func GenerateKey() (priv, pub string, err error) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return encode(sk.Seed()), encode(pk), nil
+}
+
+// PublicKey returns the public half of a base64-encoded private key.
+func PublicKey(priv string) (string, error) {
+	sk, err := parsePrivate(priv)
+	if err != nil {
+		return "", err
+	}
+	return encode(sk.Public().(ed25519.PublicKey)), nil
+}
+
+// Sign signs payload with a base64-encoded private key.
+func Sign(priv string, payload []byte) (string, error) {
+	sk, err := parsePrivate(priv)
+	if err != nil {
+		return "", err
+	}
+	return encode(ed25519.Sign(sk, payload)), nil
+}
+
+// Verify checks sig over payload against a base64-encoded public key.
+func Verify(pub string, payload []byte, sig string) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pub))
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key: not a base64 Ed25519 key")
+	}
+	s, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(b), payload, s) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func parsePrivate(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != ed25519.SeedSize {
+		return nil, fmt.Errorf("private key: not a base64 Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(b), nil
+}
+
+func encode(b []byte) string { return base64.StdEncoding.EncodeToString(b) }
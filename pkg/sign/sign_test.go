@@ -0,0 +1,36 @@
+package sign
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	priv, pub, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := PublicKey(priv); err != nil || p != pub {
+		t.Fatalf("PublicKey = %q, %v; want %q", p, err, pub)
+	}
+	sig, err := Sign(priv, []byte("event"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(pub, []byte("event"), sig); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := Verify(pub, []byte("tampered"), sig); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered payload: err = %v", err)
+	}
+	_, other, _ := GenerateKey()
+	if err := Verify(other, []byte("event"), sig); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("wrong key: err = %v", err)
+	}
+	if err := Verify(pub, []byte("event"), ""); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("empty signature: err = %v", err)
+	}
+	if _, err := Sign("garbage", nil); err == nil {
+		t.Error("Sign accepted a bad key")
+	}
+}
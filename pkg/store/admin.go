@@ -0,0 +1,135 @@
+// admin.go is the permission layer. Privileged operations (evicting
+// another agent's lock, departing another agent, compacting the log,
+// importing events, and changing who holds the admin role) are open to
+// every agent until some agent holds model.RoleAdmin. From then on the
+// store refuses them unless its actor is a live admin whose session this
+// process holds. Each privileged operation is logged, in the same
+// transaction, as an admin event by the actor.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// ErrNotAdmin is returned for a privileged operation by an agent that
+// does not hold the admin role, once some agent does.
+var ErrNotAdmin = errors.New("only an admin may do this")
+
+// ErrLastAdmin is returned by DepartAgent for the last live admin, whose
+// departure would open privileged operations to everyone again.
+var ErrLastAdmin = errors.New("the last admin cannot depart; grant the admin role to another agent first")
+
+// SetActor sets the agent this process acts as for privileged
+// operations: the one whose role authorizes them and who is logged as
+// doing them. "" is nobody in particular.
+func (s *Store) SetActor(agentID string) { s.actor = agentID }
+
+// Admins returns the live agents holding the admin role, ordered by ID.
+func (s *Store) Admins() ([]string, error) { return s.AgentsWithRole(model.RoleAdmin) }
+
+// checkNotLastAdmin returns ErrLastAdmin if agentID is the only live
+// admin, as seen in db.
+func checkNotLastAdmin(db dbtx, agentID string) error {
+	var admin, others int
+	if err := db.QueryRow(
+		`SELECT COUNT(CASE WHEN r.agent_id = ? THEN 1 END), COUNT(CASE WHEN r.agent_id <> ? THEN 1 END)
+		 FROM roles r JOIN agents a ON a.id = r.agent_id
+		 WHERE r.role = ? AND a.departed_at = ''`,
+		agentID, agentID, model.RoleAdmin,
+	).Scan(&admin, &others); err != nil {
+		return fmt.Errorf("check admins: %w", err)
+	}
+	if admin > 0 && others == 0 {
+		return fmt.Errorf("%s: %w", agentID, ErrLastAdmin)
+	}
+	return nil
+}
+
+// authorize returns nil if the actor may perform op, as seen in db.
+func (s *Store) authorize(db dbtx, op string) error {
+	const adminsSQL = `SELECT COUNT(*) FROM roles r JOIN agents a ON a.id = r.agent_id
+		WHERE r.role = ? AND a.departed_at = ''`
+	var admins int
+	if err := db.QueryRow(adminsSQL, model.RoleAdmin).Scan(&admins); err != nil {
+		return fmt.Errorf("check admins: %w", err)
+	}
+	if admins == 0 {
+		return nil
+	}
+	if s.actor == "" {
+		return fmt.Errorf("%s: %w (act as an admin agent with CLOCKMAIL_AGENT or --agent)", op, ErrNotAdmin)
+	}
+	var isAdmin int
+	if err := db.QueryRow(adminsSQL+` AND r.agent_id = ?`, model.RoleAdmin, s.actor).Scan(&isAdmin); err != nil {
+		return fmt.Errorf("check admins: %w", err)
+	}
+	if isAdmin == 0 {
+		return fmt.Errorf("%s: %w, and %s is not an admin", op, ErrNotAdmin, s.actor)
+	}
+	// The role is only worth the identity behind it.
+	return s.checkSession(db, s.actor)
+}
+
+// descendsFrom reports whether agentID is a sub-agent of ancestorID, at
+// any depth, as seen in db.
+func descendsFrom(db dbtx, agentID, ancestorID string) (bool, error) {
+	seen := map[string]bool{agentID: true}
+	for id := agentID; ; {
+		var parent string
+		err := db.QueryRow(`SELECT parent_id FROM agents WHERE id = ?`, id).Scan(&parent)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if parent == "" || seen[parent] {
+			return false, nil
+		}
+		if parent == ancestorID {
+			return true, nil
+		}
+		seen[parent] = true
+		id = parent
+	}
+}
+
+// logPrivileged appends an admin event by the actor to tx, saying it
+// performed op, with detail. An actor that is not a registered agent, or
+// whose session this process does not hold (possible only while there
+// are no admins), leaves no event.
+func (s *Store) logPrivileged(tx *txn, op, detail string) error {
+	if s.actor == "" {
+		return nil
+	}
+	if err := s.checkSession(tx, s.actor); err != nil {
+		return nil
+	}
+	ts, err := advanceAgentClock(s.db.dialect, tx, s.actor, 0)
+	if errors.Is(err, ErrNotRegistered) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var ep, rn int64
+	if err := tx.QueryRow(`SELECT epoch, round FROM agents WHERE id = ?`, s.actor).Scan(&ep, &rn); err != nil {
+		return err
+	}
+	_, err = s.insertSigned(tx, &model.Event{
+		AgentID:   s.actor,
+		LamportTS: ts,
+		Epoch:     ep,
+		Round:     rn,
+		Kind:      model.EventAdmin,
+		Target:    op,
+		Body:      detail,
+		CreatedAt: time.Now().UTC(),
+	})
+	return err
+}
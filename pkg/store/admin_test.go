@@ -0,0 +1,106 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestAdmin_OpenUntilAssigned(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	s.AcquireLock("file.go", "bob", 1, 0, true, time.Hour)
+
+	// No admins yet: anyone may force, and the eviction is logged.
+	s.SetActor("alice")
+	if _, err := s.ForceReleaseLock("file.go"); err != nil {
+		t.Fatalf("ForceReleaseLock without admins: %v", err)
+	}
+	events, _ := s.ListEventsByKind([]model.EventKind{model.EventAdmin}, 0, 10)
+	if len(events) != 1 || events[0].AgentID != "alice" || events[0].Target != "force_unlock" ||
+		events[0].Body != "released file.go from bob" {
+		t.Fatalf("admin events = %+v", events)
+	}
+
+	// The first admin may be granted by anyone.
+	if err := s.SetRoles("alice", []string{model.RoleAdmin}); err != nil {
+		t.Fatalf("grant first admin: %v", err)
+	}
+	if ids, err := s.Admins(); err != nil || strings.Join(ids, ",") != "alice" {
+		t.Fatalf("Admins = %v, %v", ids, err)
+	}
+}
+
+func TestAdmin_Enforced(t *testing.T) {
+	s := newTestStore(t)
+	for _, id := range []string{"ops", "bob", "idle"} {
+		s.RegisterAgent(id)
+	}
+	s.SetRoles("ops", []string{model.RoleAdmin})
+	s.AcquireLock("file.go", "idle", 1, 0, true, time.Hour)
+
+	s.SetActor("bob")
+	checks := map[string]func() error{
+		"force_unlock": func() error { _, err := s.ForceReleaseLock("file.go"); return err },
+		"reap":         func() error { _, err := s.DepartAgent("idle"); return err },
+		"import":       func() error { _, err := s.ImportEvents(importFixture(), true); return err },
+		"gc":           func() error { _, err := s.CompactEvents(CompactOptions{KeepEvents: 1}); return err },
+		"admin_role":   func() error { return s.SetRoles("bob", []string{model.RoleAdmin}) },
+	}
+	for op, check := range checks {
+		if err := check(); !errors.Is(err, ErrNotAdmin) {
+			t.Errorf("%s by bob: err = %v, want ErrNotAdmin", op, err)
+		}
+	}
+	if locks, _ := s.ListLocks(); len(locks) != 1 {
+		t.Fatalf("locks = %+v, want idle's still held", locks)
+	}
+	// A dry run changes nothing, so anyone may.
+	if _, err := s.CompactEvents(CompactOptions{KeepEvents: 1, DryRun: true}); err != nil {
+		t.Errorf("dry-run gc by bob: %v", err)
+	}
+	s.SetActor("")
+	if _, err := s.ForceReleaseLock("file.go"); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("ForceReleaseLock by nobody: err = %v, want ErrNotAdmin", err)
+	}
+
+	s.SetActor("ops")
+	if _, err := s.ForceReleaseLock("file.go"); err != nil {
+		t.Fatalf("ForceReleaseLock by ops: %v", err)
+	}
+	if _, err := s.DepartAgent("idle"); err != nil {
+		t.Fatalf("DepartAgent by ops: %v", err)
+	}
+	if err := s.SetRoles("bob", []string{model.RoleAdmin}); err != nil {
+		t.Fatalf("grant admin by ops: %v", err)
+	}
+	events, _ := s.ListEventsByKind([]model.EventKind{model.EventAdmin}, 0, 10)
+	var ops []string
+	for _, e := range events {
+		if e.AgentID != "ops" {
+			t.Errorf("admin event by %s: %+v", e.AgentID, e)
+		}
+		ops = append(ops, e.Target+": "+e.Body)
+	}
+	want := "force_unlock: released file.go from idle|reap: departed idle|admin_role: granted admin to bob"
+	if got := strings.Join(ops, "|"); got != want {
+		t.Errorf("admin events = %q, want %q", got, want)
+	}
+
+	// A departed admin no longer counts, but the last one cannot depart.
+	s.SetActor("ops")
+	if _, err := s.DepartAgent("ops"); err != nil {
+		t.Fatalf("DepartAgent(ops) with bob still an admin: %v", err)
+	}
+	s.SetActor("bob")
+	if _, err := s.DepartAgent("bob"); !errors.Is(err, ErrLastAdmin) {
+		t.Fatalf("departing the last admin: err = %v, want ErrLastAdmin", err)
+	}
+	if _, err := s.CompactEvents(CompactOptions{KeepEvents: 1}); err != nil {
+		t.Errorf("gc by bob, now an admin: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+// attachment.go stores message bodies too large for the event log,
+// addressed by the SHA-256 of their content.
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// ErrAmbiguousAttachment is returned when an attachment ID prefix matches
+// more than one attachment.
+var ErrAmbiguousAttachment = errors.New("attachment ID prefix is ambiguous")
+
+// PutAttachment stores body and returns its attachment, without the body.
+// Storing the same content twice returns the existing attachment.
+func (s *Store) PutAttachment(body, createdBy string) (*model.Attachment, error) {
+	sum := sha256.Sum256([]byte(body))
+	id := hex.EncodeToString(sum[:])
+	err := retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO attachments (id, body, size, created_by, created_at) VALUES (?, ?, ?, ?, ?)
+			 ON CONFLICT(id) DO NOTHING`,
+			id, body, len(body), createdBy, time.Now().UTC().Format(time.RFC3339Nano),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.GetAttachment(id)
+	if err != nil {
+		return nil, err
+	}
+	a.Body = ""
+	return a, nil
+}
+
+// GetAttachment returns the attachment whose ID is or starts with id, or
+// sql.ErrNoRows if there is none.
+func (s *Store) GetAttachment(id string) (*model.Attachment, error) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if id == "" || strings.Trim(id, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("%q is not an attachment ID", id)
+	}
+	rows, err := s.db.Query(
+		`SELECT id, body, size, created_by, created_at FROM attachments WHERE id LIKE ? LIMIT 2`, id+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []model.Attachment
+	for rows.Next() {
+		var a model.Attachment
+		var at string
+		if err := rows.Scan(&a.ID, &a.Body, &a.Size, &a.CreatedBy, &at); err != nil {
+			return nil, err
+		}
+		if a.CreatedAt, err = time.Parse(time.RFC3339Nano, at); err != nil {
+			return nil, fmt.Errorf("parse created_at for attachment %s: %w", a.ShortID(), err)
+		}
+		out = append(out, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	switch len(out) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return &out[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrAmbiguousAttachment, id)
+	}
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestAttachments(t *testing.T) {
+	s := newTestStore(t)
+	body := strings.Repeat("+ added line\n", 1000)
+
+	a, err := s.PutAttachment(body, "alice")
+	if err != nil {
+		t.Fatalf("PutAttachment: %v", err)
+	}
+	if len(a.ID) != 64 || a.Size != len(body) || a.Body != "" || a.CreatedBy != "alice" {
+		t.Fatalf("attachment = %+v", a)
+	}
+	// Same content, same attachment.
+	if again, err := s.PutAttachment(body, "bob"); err != nil || again.ID != a.ID || again.CreatedBy != "alice" {
+		t.Fatalf("second put = %+v, %v", again, err)
+	}
+
+	got, err := s.GetAttachment(a.ShortID())
+	if err != nil || got.Body != body {
+		t.Fatalf("GetAttachment(%s) = %+v, %v", a.ShortID(), got, err)
+	}
+	if _, err := s.GetAttachment(strings.ToUpper(a.ID)); err != nil {
+		t.Fatalf("GetAttachment is case-insensitive: %v", err)
+	}
+	if _, err := s.GetAttachment(strings.Repeat("0", 64)); err != sql.ErrNoRows {
+		t.Fatalf("unknown ID err = %v", err)
+	}
+	if _, err := s.GetAttachment("x%"); err == nil {
+		t.Fatal("GetAttachment should reject non-hex IDs")
+	}
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// These benchmarks time the store's hot paths, to guide the WAL and
+// retry tuning. cm bench measures the same operations under contention
+// from many connections.
+
+func benchMsg(from, to string, ts int64) *model.Event {
+	return &model.Event{AgentID: from, LamportTS: ts, Kind: model.EventMsg, Target: to, Body: "bench", CreatedAt: time.Now().UTC()}
+}
+
+func BenchmarkInsertEvent(b *testing.B) {
+	s := newTestStore(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := s.InsertEvent(benchMsg("alice", "bob", int64(i+1))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTickAgent(b *testing.B) {
+	s := newTestStore(b)
+	if _, err := s.RegisterAgent("alice"); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		if _, err := s.TickAgent("alice"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendTx is cm send's write: tick and insert in one transaction.
+func BenchmarkSendTx(b *testing.B) {
+	s := newTestStore(b)
+	if _, err := s.RegisterAgent("alice"); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		err := s.WithTx(func(tx TxStore) error {
+			ts, err := tx.TickAgent("alice")
+			if err != nil {
+				return err
+			}
+			_, err = tx.InsertEvent(benchMsg("alice", "bob", ts))
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListUnread(b *testing.B) {
+	s := newTestStore(b)
+	for i := 0; i < 1000; i++ {
+		if _, err := s.InsertEvent(benchMsg(fmt.Sprintf("agent-%d", i%10), "bob", int64(i+1))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ListUnread("bob", "", 100); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAcquireReleaseLock(b *testing.B) {
+	s := newTestStore(b)
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.AcquireLock("a.go", "alice", int64(i+1), 0, true, time.Minute); err != nil {
+			b.Fatal(err)
+		}
+		if err := s.ReleaseLock("a.go", "alice"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInsertEventContended inserts from several connections to one
+// database at once, as separate cm processes would.
+func BenchmarkInsertEventContended(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "bench.db")
+	s, err := New(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := New(path)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		var ts int64
+		for pb.Next() {
+			ts++
+			if _, err := conn.InsertEvent(benchMsg("alice", "bob", ts)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// SetCapabilities replaces the capabilities agentID advertises. Pass the
+// output of model.ParseCapabilities; an empty list clears them.
+func (s *Store) SetCapabilities(agentID string, caps []string) error {
+	return retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if _, err := tx.Exec(`DELETE FROM capabilities WHERE agent_id = ?`, agentID); err != nil {
+			return err
+		}
+		for _, c := range caps {
+			if _, err := tx.Exec(
+				`INSERT INTO capabilities (agent_id, capability) VALUES (?, ?)`, agentID, c,
+			); err != nil {
+				return fmt.Errorf("add capability %q: %w", c, err)
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// AgentsWithCapability returns the registered, non-departed agents
+// advertising capability, ordered by ID.
+func (s *Store) AgentsWithCapability(capability string) ([]string, error) {
+	rows, err := s.db.Query(
+		`SELECT c.agent_id FROM capabilities c JOIN agents a ON a.id = c.agent_id
+		 WHERE c.capability = ? AND a.departed_at = '' ORDER BY c.agent_id`, capability,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// capabilitiesByAgent returns every agent's capabilities, sorted. With a
+// non-empty agentID only that agent's are loaded.
+func (s *Store) capabilitiesByAgent(agentID string) (map[string][]string, error) {
+	q := `SELECT agent_id, capability FROM capabilities`
+	var args []interface{}
+	if agentID != "" {
+		q += ` WHERE agent_id = ?`
+		args = append(args, agentID)
+	}
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	caps := make(map[string][]string)
+	for rows.Next() {
+		var id, c string
+		if err := rows.Scan(&id, &c); err != nil {
+			return nil, err
+		}
+		caps[id] = append(caps[id], c)
+	}
+	for _, list := range caps {
+		sort.Strings(list)
+	}
+	return caps, rows.Err()
+}
+
+// attachCapabilities fills in Capabilities for each agent.
+func (s *Store) attachCapabilities(agents []model.Agent, agentID string) error {
+	caps, err := s.capabilitiesByAgent(agentID)
+	if err != nil {
+		return fmt.Errorf("load capabilities: %w", err)
+	}
+	for i := range agents {
+		agents[i].Capabilities = caps[agents[i].ID]
+	}
+	return nil
+}
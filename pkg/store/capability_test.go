@@ -0,0 +1,41 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	if err := s.SetCapabilities("alice", []string{"db", "go"}); err != nil {
+		t.Fatalf("SetCapabilities: %v", err)
+	}
+	s.SetCapabilities("bob", []string{"go"})
+	// Capabilities of agents that never registered are not addressable.
+	s.SetCapabilities("ghost", []string{"go"})
+
+	ids, err := s.AgentsWithCapability("go")
+	if err != nil {
+		t.Fatalf("AgentsWithCapability: %v", err)
+	}
+	if strings.Join(ids, ",") != "alice,bob" {
+		t.Fatalf("go agents = %v", ids)
+	}
+
+	ag, _ := s.GetAgent("alice")
+	if strings.Join(ag.Capabilities, ",") != "db,go" {
+		t.Fatalf("GetAgent capabilities = %v", ag.Capabilities)
+	}
+	agents, _ := s.ListAgents()
+	if len(agents) != 2 || len(agents[1].Capabilities) != 1 {
+		t.Fatalf("ListAgents = %+v", agents)
+	}
+
+	// Setting replaces the previous list.
+	s.SetCapabilities("alice", []string{"tests"})
+	if ids, _ := s.AgentsWithCapability("db"); len(ids) != 0 {
+		t.Fatalf("db agents after replace = %v", ids)
+	}
+}
@@ -0,0 +1,194 @@
+// chain.go links the event log into a hash chain. Each event stores the
+// ChainHash of the event written before it in prev_hash, and the settings
+// table holds the hash of the newest one, so altering, reordering or
+// removing any event breaks the chain where it happened. Events deleted
+// by CompactEvents stay in the chain through their permalink snapshots.
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// chainHead returns the hash of the newest event in the chain, or "" if
+// no event has been chained yet.
+func chainHead(db dbtx) (string, error) {
+	var h string
+	err := db.QueryRow(`SELECT value FROM settings WHERE key = 'chain_head'`).Scan(&h)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return h, err
+}
+
+func setChainHead(db dbtx, h string) error {
+	_, err := db.Exec(
+		`INSERT INTO settings (key, value) VALUES ('chain_head', ?)
+		 ON CONFLICT(key) DO UPDATE SET value = excluded.value`, h,
+	)
+	return err
+}
+
+// chainEntry is an event in the chain, live or restored from the snapshot
+// CompactEvents kept of it.
+type chainEntry struct {
+	model.Event
+	compacted bool
+}
+
+// chainEntries returns every event in the chain in row ID order.
+func chainEntries(db dbtx) ([]chainEntry, error) {
+	rows, err := db.Query(
+		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events ORDER BY id ASC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	live, err := scanEvents(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]chainEntry, 0, len(live))
+	for _, e := range live {
+		entries = append(entries, chainEntry{Event: e})
+	}
+
+	rows, err = db.Query(
+		`SELECT event_id, MIN(snapshot) FROM permalinks
+		 WHERE snapshot <> '' AND event_id NOT IN (SELECT id FROM events)
+		 GROUP BY event_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	n := len(entries)
+	for rows.Next() {
+		var id int64
+		var snapshot string
+		if err := rows.Scan(&id, &snapshot); err != nil {
+			return nil, err
+		}
+		var e model.Event
+		if err := json.Unmarshal([]byte(snapshot), &e); err != nil {
+			return nil, fmt.Errorf("decode snapshot of event %d: %w", id, err)
+		}
+		e.ID = id
+		entries = append(entries, chainEntry{Event: e, compacted: true})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) > n {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	}
+	return entries, nil
+}
+
+// linkEvent sets e.PrevHash to the current chain head. It takes the chain
+// lock, so the caller must insert e and call setChainHead in the same
+// transaction.
+func linkEvent(tx *txn, e *model.Event) error {
+	if err := tx.advisoryLock("clockmail:chain"); err != nil {
+		return err
+	}
+	prev, err := chainHead(tx)
+	if err != nil {
+		return fmt.Errorf("chain head: %w", err)
+	}
+	e.PrevHash = prev
+	return nil
+}
+
+// backfillChain chains the events of a database written before events
+// were chained, oldest first, rewriting the snapshots of compacted ones.
+func backfillChain(db dbtx) error {
+	entries, err := chainEntries(db)
+	if err != nil {
+		return err
+	}
+	prev := ""
+	for _, c := range entries {
+		c.PrevHash = prev
+		if c.compacted {
+			data, err := json.Marshal(c.Event)
+			if err != nil {
+				return err
+			}
+			if _, err := db.Exec(`UPDATE permalinks SET snapshot = ? WHERE event_id = ?`, string(data), c.ID); err != nil {
+				return fmt.Errorf("chain snapshot of event %d: %w", c.ID, err)
+			}
+		} else if _, err := db.Exec(`UPDATE events SET prev_hash = ? WHERE id = ?`, prev, c.ID); err != nil {
+			return fmt.Errorf("chain event %d: %w", c.ID, err)
+		}
+		prev = c.ChainHash()
+	}
+	if prev == "" {
+		return nil
+	}
+	return setChainHead(db, prev)
+}
+
+// ChainBreak is a place where the hash chain does not hold.
+type ChainBreak struct {
+	// EventID is the first event whose prev_hash does not match the
+	// event before it, or 0 when the newest event does not match the
+	// recorded head.
+	EventID   int64  `json:"event_id"`
+	Permalink string `json:"permalink,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// ChainReport is the result of VerifyChain.
+type ChainReport struct {
+	Checked   int          `json:"checked"`
+	Compacted int          `json:"compacted"` // checked from gc snapshots
+	Head      string       `json:"head"`
+	Breaks    []ChainBreak `json:"breaks"`
+}
+
+// OK reports whether the chain held throughout.
+func (r *ChainReport) OK() bool { return len(r.Breaks) == 0 }
+
+// VerifyChain walks the event log from the first event, checking that
+// each event's prev_hash is the hash of the one before it and that the
+// newest event's hash is the recorded head. An event altered in place
+// breaks the chain at the event after it; a removed event, at the one
+// that followed it.
+func (s *Store) VerifyChain() (*ChainReport, error) {
+	entries, err := chainEntries(s.db)
+	if err != nil {
+		return nil, err
+	}
+	head, err := chainHead(s.db)
+	if err != nil {
+		return nil, err
+	}
+	r := &ChainReport{Head: head, Breaks: []ChainBreak{}}
+	prev := ""
+	for _, c := range entries {
+		r.Checked++
+		if c.compacted {
+			r.Compacted++
+		}
+		if c.PrevHash != prev {
+			r.Breaks = append(r.Breaks, ChainBreak{
+				EventID:   c.ID,
+				Permalink: model.Permalink(c.AgentID, c.ID, c.LamportTS),
+				Reason:    "prev_hash does not match the event before it: that event was altered or removed",
+			})
+		}
+		prev = c.ChainHash()
+	}
+	if prev != head {
+		r.Breaks = append(r.Breaks, ChainBreak{Reason: "the newest event does not match the recorded chain head: it was altered or removed"})
+	}
+	return r, nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func chainFixture(t *testing.T) (*Store, []int64) {
+	t.Helper()
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	var ids []int64
+	for i, body := range []string{"one", "two", "three", "four"} {
+		id, err := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: int64(i + 1), Kind: model.EventMsg, Target: "bob", Body: body, CreatedAt: old})
+		if err != nil {
+			t.Fatalf("InsertEvent: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return s, ids
+}
+
+func TestChain_Intact(t *testing.T) {
+	s, _ := chainFixture(t)
+	s.SyncAtomic("bob", 1, 0, 9, model.Provenance{})
+	r, err := s.VerifyChain()
+	if err != nil {
+		t.Fatalf("VerifyChain: %v", err)
+	}
+	if !r.OK() || r.Checked != 5 || r.Head == "" {
+		t.Fatalf("report = %+v", r)
+	}
+	events, _ := s.ListEventsSinceID(0, 10)
+	if events[0].PrevHash != "" || events[1].PrevHash != events[0].ChainHash() {
+		t.Fatalf("events not chained: %+v", events[:2])
+	}
+}
+
+func TestChain_DetectsTampering(t *testing.T) {
+	s, ids := chainFixture(t)
+	s.db.Exec(`UPDATE events SET body = 'edited' WHERE id = ?`, ids[1])
+	r, _ := s.VerifyChain()
+	if len(r.Breaks) != 1 || r.Breaks[0].EventID != ids[2] {
+		t.Fatalf("altered event: breaks = %+v", r.Breaks)
+	}
+
+	s, ids = chainFixture(t)
+	s.db.Exec(`DELETE FROM events WHERE id = ?`, ids[1])
+	r, _ = s.VerifyChain()
+	if len(r.Breaks) != 1 || r.Breaks[0].EventID != ids[2] {
+		t.Fatalf("removed event: breaks = %+v", r.Breaks)
+	}
+
+	s, ids = chainFixture(t)
+	s.db.Exec(`DELETE FROM events WHERE id = ?`, ids[3])
+	r, _ = s.VerifyChain()
+	if len(r.Breaks) != 1 || r.Breaks[0].EventID != 0 {
+		t.Fatalf("removed newest event: breaks = %+v", r.Breaks)
+	}
+}
+
+func TestChain_SurvivesCompaction(t *testing.T) {
+	s, _ := chainFixture(t)
+	s.SetCursor("bob", 100)
+	res, err := s.CompactEvents(CompactOptions{KeepEvents: 1})
+	if err != nil || res.Deleted != 3 {
+		t.Fatalf("CompactEvents = %+v, %v", res, err)
+	}
+	r, _ := s.VerifyChain()
+	if !r.OK() || r.Checked != 4 || r.Compacted != 3 {
+		t.Fatalf("report = %+v", r)
+	}
+}
+
+func TestChain_Backfill(t *testing.T) {
+	s, _ := chainFixture(t)
+	s.SetCursor("bob", 100)
+	s.CompactEvents(CompactOptions{KeepEvents: 2})
+	// Simulate a database from before chaining; its snapshots keep the
+	// hashes they were taken with, so clear those too.
+	s.db.Exec(`UPDATE events SET prev_hash = ''`)
+	s.db.Exec(`UPDATE permalinks SET snapshot = REPLACE(snapshot, '"prev_hash"', '"old_hash"')`)
+	s.db.Exec(`DELETE FROM settings WHERE key = 'chain_head'`)
+	if r, _ := s.VerifyChain(); r.OK() {
+		t.Fatal("unchained events should not verify")
+	}
+
+	if err := backfillChain(s.db); err != nil {
+		t.Fatalf("backfillChain: %v", err)
+	}
+	r, _ := s.VerifyChain()
+	if !r.OK() || r.Checked != 4 || r.Compacted != 2 {
+		t.Fatalf("after backfill: %+v", r)
+	}
+	// New events continue the chain.
+	s.InsertEvent(&model.Event{AgentID: "bob", LamportTS: 20, Kind: model.EventMsg, Target: "alice", CreatedAt: time.Now().UTC()})
+	if r, _ := s.VerifyChain(); !r.OK() || r.Checked != 5 {
+		t.Fatalf("after insert: %+v", r)
+	}
+}
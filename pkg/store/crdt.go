@@ -0,0 +1,201 @@
+// crdt.go persists grow-only counters and sets. Updates only ever add
+// (to the writer's own counter slot, or an element to a set), so agents
+// can aggregate concurrently without read-modify-write races.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// IncrCounter adds delta (which must be positive) to agentID's slot of
+// the named counter, creating it if needed, and returns the counter.
+// Returns an error if name is a set.
+func (s *Store) IncrCounter(name, agentID string, delta int64) (*model.GCounter, error) {
+	if delta <= 0 {
+		return nil, fmt.Errorf("counter %q only grows: increment must be positive, got %d", name, delta)
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := tx.advisoryLock("clockmail:crdt:" + name); err != nil {
+			return err
+		}
+		if err := crdtTypeIs(tx, name, "crdt_sets", "set"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO crdt_counters (name, agent_id, count, updated_at) VALUES (?, ?, ?, ?)
+			 ON CONFLICT(name, agent_id) DO UPDATE SET count = crdt_counters.count + excluded.count,
+			   updated_at = excluded.updated_at`,
+			name, agentID, delta, now,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetCounter(name)
+}
+
+// AddToSet adds elems to the named set, creating it if needed, and
+// returns the set and how many of elems were new. An element keeps the
+// agent and Lamport timestamp that first added it. Returns an error if
+// name is a counter.
+func (s *Store) AddToSet(name, agentID string, lamportTS int64, elems []string) (*model.GSet, int, error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var added int
+	err := retryOnContention(func() error {
+		added = 0
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := tx.advisoryLock("clockmail:crdt:" + name); err != nil {
+			return err
+		}
+		if err := crdtTypeIs(tx, name, "crdt_counters", "counter"); err != nil {
+			return err
+		}
+		for _, el := range elems {
+			res, err := tx.Exec(
+				`INSERT INTO crdt_sets (name, element, agent_id, lamport_ts, added_at) VALUES (?, ?, ?, ?, ?)
+				 ON CONFLICT(name, element) DO NOTHING`,
+				name, el, agentID, lamportTS, now,
+			)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			added += int(n)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	set, err := s.GetSet(name)
+	return set, added, err
+}
+
+// crdtTypeIs fails if name already exists in table, the store of the
+// other kind of CRDT.
+func crdtTypeIs(tx *txn, name, table, kind string) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE name = ?`, name).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%q is a %s", name, kind)
+	}
+	return nil
+}
+
+// GetCounter returns the named counter, or sql.ErrNoRows if it was never
+// incremented.
+func (s *Store) GetCounter(name string) (*model.GCounter, error) {
+	rows, err := s.db.Query(`SELECT agent_id, count FROM crdt_counters WHERE name = ? ORDER BY agent_id ASC`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c := model.GCounter{Name: name, Slots: map[string]int64{}}
+	for rows.Next() {
+		var agent string
+		var n int64
+		if err := rows.Scan(&agent, &n); err != nil {
+			return nil, err
+		}
+		c.Slots[agent] = n
+		c.Value += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(c.Slots) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &c, nil
+}
+
+// GetSet returns the named set with its elements sorted, or
+// sql.ErrNoRows if nothing was ever added to it.
+func (s *Store) GetSet(name string) (*model.GSet, error) {
+	rows, err := s.db.Query(`SELECT element FROM crdt_sets WHERE name = ? ORDER BY element ASC`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := model.GSet{Name: name}
+	for rows.Next() {
+		var el string
+		if err := rows.Scan(&el); err != nil {
+			return nil, err
+		}
+		set.Elements = append(set.Elements, el)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(set.Elements) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &set, nil
+}
+
+// ListCRDTs returns every counter and every set, each ordered by name.
+func (s *Store) ListCRDTs() ([]model.GCounter, []model.GSet, error) {
+	var counters []model.GCounter
+	rows, err := s.db.Query(`SELECT name, agent_id, count FROM crdt_counters ORDER BY name ASC, agent_id ASC`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, agent string
+		var n int64
+		if err := rows.Scan(&name, &agent, &n); err != nil {
+			return nil, nil, err
+		}
+		if len(counters) == 0 || counters[len(counters)-1].Name != name {
+			counters = append(counters, model.GCounter{Name: name, Slots: map[string]int64{}})
+		}
+		c := &counters[len(counters)-1]
+		c.Slots[agent] = n
+		c.Value += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var sets []model.GSet
+	rows2, err := s.db.Query(`SELECT name, element FROM crdt_sets ORDER BY name ASC, element ASC`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var name, el string
+		if err := rows2.Scan(&name, &el); err != nil {
+			return nil, nil, err
+		}
+		if len(sets) == 0 || sets[len(sets)-1].Name != name {
+			sets = append(sets, model.GSet{Name: name})
+		}
+		sets[len(sets)-1].Elements = append(sets[len(sets)-1].Elements, el)
+	}
+	return counters, sets, rows2.Err()
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCRDT_Counter(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.GetCounter("tests_passed"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("unknown counter: err = %v, want sql.ErrNoRows", err)
+	}
+
+	// Concurrent increments from several agents are never lost.
+	var wg sync.WaitGroup
+	for _, agent := range []string{"alice", "bob", "carol"} {
+		wg.Add(1)
+		go func(agent string) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if _, err := s.IncrCounter("tests_passed", agent, 1); err != nil {
+					t.Errorf("IncrCounter(%s): %v", agent, err)
+				}
+			}
+		}(agent)
+	}
+	wg.Wait()
+	c, err := s.IncrCounter("tests_passed", "alice", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Value != 35 || c.Slots["alice"] != 15 || c.Slots["bob"] != 10 {
+		t.Fatalf("counter = %+v, want 35 with alice 15, bob 10", c)
+	}
+	if _, err := s.IncrCounter("tests_passed", "alice", -1); err == nil {
+		t.Fatal("a negative increment should fail: counters only grow")
+	}
+}
+
+func TestCRDT_Set(t *testing.T) {
+	s := newTestStore(t)
+	set, added, err := s.AddToSet("flaky_tests", "alice", 3, []string{"TestFoo", "TestBar"})
+	if err != nil || added != 2 {
+		t.Fatalf("AddToSet: added %d, %v", added, err)
+	}
+	set, added, err = s.AddToSet("flaky_tests", "bob", 4, []string{"TestFoo", "TestBaz"})
+	if err != nil || added != 1 {
+		t.Fatalf("AddToSet again: added %d, %v", added, err)
+	}
+	if got := strings.Join(set.Elements, ","); got != "TestBar,TestBaz,TestFoo" {
+		t.Fatalf("elements = %s", got)
+	}
+
+	// A name is either a counter or a set.
+	if _, err := s.IncrCounter("flaky_tests", "alice", 1); err == nil {
+		t.Fatal("incrementing a set should fail")
+	}
+	s.IncrCounter("runs", "alice", 1)
+	if _, _, err := s.AddToSet("runs", "alice", 5, []string{"x"}); err == nil {
+		t.Fatal("adding to a counter should fail")
+	}
+
+	counters, sets, err := s.ListCRDTs()
+	if err != nil || len(counters) != 1 || counters[0].Name != "runs" || len(sets) != 1 || len(sets[0].Elements) != 3 {
+		t.Fatalf("ListCRDTs = %+v, %+v, %v", counters, sets, err)
+	}
+}
@@ -0,0 +1,192 @@
+// cursor.go keeps recv cursors. Each agent has an all-senders cursor, the
+// Lamport timestamp below which its inbox has been received, and may have
+// per-sender cursors ahead of it, left by receiving only one sender's
+// messages (cm recv --from). A message is unread while its timestamp is at
+// or past both its recipient's all-senders cursor and the recipient's
+// cursor for its sender, and it has not been delivered.
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/trace"
+)
+
+// unreadCond is the SQL condition, on events aliased e, for an inbox event
+// its recipient has not received yet. A delivered message is received
+// even if the cursors are behind it, as they are when recv
+// --min-priority leaves older, less urgent messages pending. A scheduled
+// message (schedule.go), or one tagged with a git branch (see
+// Store.SetBranch), is unread until delivered, even once the cursors
+// have passed it.
+const unreadCond = `e.kind IN ('msg', 'review_req', 'review_done')
+	AND e.id NOT IN (SELECT event_id FROM deliveries)
+	AND ((e.lamport_ts >= COALESCE((SELECT c.since_ts FROM inbox_cursors c WHERE c.agent_id = e.target AND c.sender = ''), 0)
+	      AND e.lamport_ts >= COALESCE((SELECT c.since_ts FROM inbox_cursors c WHERE c.agent_id = e.target AND c.sender = e.agent_id), 0))
+	  OR e.branch <> '' OR e.id IN (SELECT event_id FROM schedules))`
+
+// GetCursor returns an agent's all-senders recv cursor (0 if unset).
+func (s *Store) GetCursor(agentID string) int64 {
+	var ts int64
+	if err := s.db.QueryRow(
+		`SELECT since_ts FROM inbox_cursors WHERE agent_id = ? AND sender = ''`, agentID,
+	).Scan(&ts); err != nil {
+		return 0
+	}
+	return ts
+}
+
+// SetCursor sets an agent's all-senders recv cursor. Per-sender cursors it
+// catches up with are dropped.
+func (s *Store) SetCursor(agentID string, sinceTS int64) error {
+	err := retryOnContention(func() error {
+		return setCursor(s.db, agentID, sinceTS)
+	})
+	if err == nil {
+		logger.Debug("cursor moved", "agent", agentID, "since_ts", sinceTS)
+	}
+	return err
+}
+
+// advanceCursor moves agentID's all-senders cursor to sinceTS unless it
+// is already past it. Receiving a released scheduled message, which may
+// sit behind the cursor, must not move the cursor back.
+func advanceCursor(db dbtx, agentID string, sinceTS int64) error {
+	if _, err := db.Exec(
+		`INSERT INTO inbox_cursors (agent_id, sender, since_ts) VALUES (?, '', ?)
+		 ON CONFLICT(agent_id, sender) DO UPDATE SET since_ts = excluded.since_ts
+		 WHERE inbox_cursors.since_ts < excluded.since_ts`,
+		agentID, sinceTS,
+	); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		`DELETE FROM inbox_cursors WHERE agent_id = ? AND sender <> '' AND since_ts <= ?`, agentID, sinceTS,
+	)
+	return err
+}
+
+func setCursor(db dbtx, agentID string, sinceTS int64) error {
+	if _, err := db.Exec(
+		`INSERT INTO inbox_cursors (agent_id, sender, since_ts) VALUES (?, '', ?)
+		 ON CONFLICT(agent_id, sender) DO UPDATE SET since_ts = excluded.since_ts`,
+		agentID, sinceTS,
+	); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		`DELETE FROM inbox_cursors WHERE agent_id = ? AND sender <> '' AND since_ts <= ?`, agentID, sinceTS,
+	)
+	return err
+}
+
+// SetSenderCursor advances agentID's cursor for messages from sender to
+// sinceTS. It never moves a cursor back.
+func (s *Store) SetSenderCursor(agentID, sender string, sinceTS int64) error {
+	err := retryOnContention(func() error {
+		return setSenderCursor(s.db, agentID, sender, sinceTS)
+	})
+	if err == nil {
+		logger.Debug("sender cursor moved", "agent", agentID, "sender", sender, "since_ts", sinceTS)
+	}
+	return err
+}
+
+func setSenderCursor(db dbtx, agentID, sender string, sinceTS int64) error {
+	if sender == "" {
+		return fmt.Errorf("sender is required")
+	}
+	_, err := db.Exec(
+		`INSERT INTO inbox_cursors (agent_id, sender, since_ts) VALUES (?, ?, ?)
+		 ON CONFLICT(agent_id, sender) DO UPDATE SET since_ts = excluded.since_ts
+		 WHERE inbox_cursors.since_ts < excluded.since_ts`,
+		agentID, sender, sinceTS,
+	)
+	return err
+}
+
+// SenderCursors returns agentID's per-sender cursors that are ahead of its
+// all-senders cursor, by sender.
+func (s *Store) SenderCursors(agentID string) (map[string]int64, error) {
+	rows, err := s.db.Query(
+		`SELECT sender, since_ts FROM inbox_cursors WHERE agent_id = ? AND sender <> ''
+		 AND since_ts > COALESCE((SELECT f.since_ts FROM inbox_cursors f WHERE f.agent_id = ? AND f.sender = ''), 0)`,
+		agentID, agentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]int64)
+	for rows.Next() {
+		var sender string
+		var ts int64
+		if err := rows.Scan(&sender, &ts); err != nil {
+			return nil, err
+		}
+		out[sender] = ts
+	}
+	return out, rows.Err()
+}
+
+// listUnreadSQL selects an agent's unread inbox, less held messages, from
+// one sender if bySender.
+func listUnreadSQL(bySender bool) string {
+	q := `SELECT e.id, e.agent_id, e.lamport_ts, e.epoch, e.round, e.kind,
+	             COALESCE(e.target,''), COALESCE(e.body,''), e.created_at, e.priority, e.tool, e.run_id, e.branch, e.signature, e.prev_hash
+	      FROM events e WHERE e.target = ? AND ` + unreadCond + ` AND ` + visibleCond
+	if bySender {
+		q += ` AND e.agent_id = ?`
+	}
+	return q + ` ORDER BY e.lamport_ts ASC, e.id ASC LIMIT ?`
+}
+
+// ListUnread returns up to limit of agentID's unread inbox events, from
+// sender only if sender is not empty, in Lamport order.
+func (s *Store) ListUnread(agentID, sender string, limit int) ([]model.Event, error) {
+	span := s.tracer.Start("store.list_unread", trace.String("clockmail.agent", agentID))
+	events, err := s.listUnread(s.db, agentID, sender, limit)
+	span.Set(trace.Int("clockmail.messages", int64(len(events))))
+	span.End(err)
+	return events, err
+}
+
+func (s *Store) listUnread(db dbtx, agentID, sender string, limit int) ([]model.Event, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	args := append([]interface{}{agentID}, s.visibleArgs(time.Now())...)
+	if sender != "" {
+		args = append(args, sender)
+	}
+	rows, err := db.Query(listUnreadSQL(sender != ""), append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEvents(rows)
+}
+
+// migrateCursors moves the cursors of databases created before per-sender
+// cursors, one row per agent in a cursors table, into inbox_cursors as
+// all-senders cursors, and drops the old table. (The WHERE clause keeps
+// SQLite from reading ON CONFLICT as a join constraint.)
+func (d dialect) migrateCursors(db dbtx) error {
+	ok, err := d.hasTable(db, "cursors")
+	if err != nil || !ok {
+		return err
+	}
+	if _, err := db.Exec(
+		`INSERT INTO inbox_cursors (agent_id, sender, since_ts)
+		 SELECT agent_id, '', since_ts FROM cursors WHERE true
+		 ON CONFLICT(agent_id, sender) DO NOTHING`,
+	); err != nil {
+		return fmt.Errorf("migrate cursors: %w", err)
+	}
+	if _, err := db.Exec(`DROP TABLE cursors`); err != nil {
+		return fmt.Errorf("drop old cursors: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// deadletter.go keeps messages that had nowhere to go. cm send refuses to
+// put a message in the log for a recipient that is not registered, or
+// has departed, since nobody would ever read it; the message is parked
+// here instead until someone redelivers it to a live agent.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+var (
+	// ErrDeadLetterNotFound is returned for an unknown dead letter ID.
+	ErrDeadLetterNotFound = errors.New("no such dead letter")
+	// ErrAlreadyRedelivered is returned by RedeliverDeadLetter for a dead
+	// letter that has been redelivered before.
+	ErrAlreadyRedelivered = errors.New("dead letter already redelivered")
+)
+
+// DeadLetter is a message that was not delivered, and where it went
+// after, if anywhere.
+type DeadLetter struct {
+	ID        int64          `json:"id"`
+	From      string         `json:"from"`
+	To        string         `json:"to"`
+	Body      string         `json:"body"`
+	Priority  model.Priority `json:"priority"`
+	LamportTS int64          `json:"lamport_ts"`
+	Epoch     int64          `json:"epoch"`
+	Round     int64          `json:"round"`
+	Reason    string         `json:"reason"` // e.g. "not registered", "departed"
+	CreatedAt time.Time      `json:"created_at"`
+
+	RedeliveredTo    string     `json:"redelivered_to,omitempty"`
+	RedeliveredEvent int64      `json:"redelivered_event,omitempty"`
+	RedeliveredAt    *time.Time `json:"redelivered_at,omitempty"`
+}
+
+// AddDeadLetter parks d and returns its ID.
+func (s *Store) AddDeadLetter(d *DeadLetter) (int64, error) {
+	var id int64
+	err := retryOnContention(func() error {
+		var err error
+		id, err = addDeadLetter(s.db.dialect, s.db, d)
+		return err
+	})
+	if err == nil {
+		d.ID = id
+	}
+	return id, err
+}
+
+func addDeadLetter(dl dialect, db dbtx, d *DeadLetter) (int64, error) {
+	return dl.insertReturningID(db,
+		`INSERT INTO dead_letters (from_agent, to_agent, body, priority, lamport_ts, epoch, round, reason, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.From, d.To, d.Body, string(d.Priority), d.LamportTS, d.Epoch, d.Round, d.Reason,
+		d.CreatedAt.UTC().Format(time.RFC3339Nano),
+	)
+}
+
+const deadLetterCols = `id, from_agent, to_agent, body, priority, lamport_ts, epoch, round, reason, created_at,
+	redelivered_to, redelivered_event, redelivered_at`
+
+// ListDeadLetters returns the dead letters awaiting redelivery, oldest
+// first, or with all every dead letter ever parked.
+func (s *Store) ListDeadLetters(all bool) ([]DeadLetter, error) {
+	q := `SELECT ` + deadLetterCols + ` FROM dead_letters`
+	if !all {
+		q += ` WHERE redelivered_at = ''`
+	}
+	rows, err := s.db.Query(q + ` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DeadLetter
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *d)
+	}
+	return out, rows.Err()
+}
+
+// GetDeadLetter returns dead letter id, or ErrDeadLetterNotFound.
+func (s *Store) GetDeadLetter(id int64) (*DeadLetter, error) {
+	d, err := scanDeadLetter(s.db.QueryRow(`SELECT `+deadLetterCols+` FROM dead_letters WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("dead letter %d: %w", id, ErrDeadLetterNotFound)
+	}
+	return d, err
+}
+
+// RedeliverDeadLetter appends e (the message, addressed to its new
+// target) to the log and marks dead letter id as redelivered by it, in
+// one transaction, so a dead letter is delivered at most once. Returns
+// the new event's ID.
+func (s *Store) RedeliverDeadLetter(id int64, e *model.Event) (int64, error) {
+	if err := s.signEvent(e); err != nil {
+		return 0, err
+	}
+	var eventID int64
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		var at string
+		if err := tx.QueryRow(`SELECT redelivered_at FROM dead_letters WHERE id = ?`, id).Scan(&at); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("dead letter %d: %w", id, ErrDeadLetterNotFound)
+			}
+			return err
+		}
+		if at != "" {
+			return fmt.Errorf("dead letter %d: %w", id, ErrAlreadyRedelivered)
+		}
+		if err := s.checkSession(tx, e.AgentID); err != nil {
+			return err
+		}
+		if err := checkStrict(tx, e); err != nil {
+			return err
+		}
+		if eventID, err = s.db.dialect.insertEvent(tx, e); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			`UPDATE dead_letters SET redelivered_to = ?, redelivered_event = ?, redelivered_at = ? WHERE id = ?`,
+			e.Target, eventID, time.Now().UTC().Format(time.RFC3339Nano), id,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == nil {
+		s.bump()
+	}
+	return eventID, err
+}
+
+// CountDeadLetters returns how many dead letters await redelivery.
+func (s *Store) CountDeadLetters() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM dead_letters WHERE redelivered_at = ''`).Scan(&n)
+	return n, err
+}
+
+func scanDeadLetter(row interface{ Scan(...interface{}) error }) (*DeadLetter, error) {
+	var d DeadLetter
+	var prio, created, redeliveredAt string
+	if err := row.Scan(&d.ID, &d.From, &d.To, &d.Body, &prio, &d.LamportTS, &d.Epoch, &d.Round, &d.Reason, &created,
+		&d.RedeliveredTo, &d.RedeliveredEvent, &redeliveredAt); err != nil {
+		return nil, err
+	}
+	d.Priority = model.Priority(prio)
+	var err error
+	if d.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+		return nil, fmt.Errorf("parse created_at for dead letter %d: %w", d.ID, err)
+	}
+	if redeliveredAt != "" {
+		t, err := time.Parse(time.RFC3339Nano, redeliveredAt)
+		if err != nil {
+			return nil, fmt.Errorf("parse redelivered_at for dead letter %d: %w", d.ID, err)
+		}
+		d.RedeliveredAt = &t
+	}
+	return &d, nil
+}
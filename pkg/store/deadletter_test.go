@@ -0,0 +1,50 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestDeadLetters(t *testing.T) {
+	s := newTestStore(t)
+	d := DeadLetter{From: "alice", To: "ghost", Body: "hi", Priority: model.PriorityUrgent,
+		LamportTS: 3, Reason: "not registered", CreatedAt: time.Now().UTC()}
+	id, err := s.AddDeadLetter(&d)
+	if err != nil || id == 0 || d.ID != id {
+		t.Fatalf("AddDeadLetter = %d, %v (d.ID=%d)", id, err, d.ID)
+	}
+	if n, _ := s.CountDeadLetters(); n != 1 {
+		t.Fatalf("CountDeadLetters = %d, want 1", n)
+	}
+
+	e := &model.Event{AgentID: "alice", LamportTS: 4, Kind: model.EventMsg, Target: "bob",
+		Body: "hi", CreatedAt: time.Now().UTC(), Priority: model.PriorityUrgent}
+	eventID, err := s.RedeliverDeadLetter(id, e)
+	if err != nil {
+		t.Fatalf("RedeliverDeadLetter: %v", err)
+	}
+	got, err := s.GetDeadLetter(id)
+	if err != nil || got.RedeliveredTo != "bob" || got.RedeliveredEvent != eventID || got.RedeliveredAt == nil ||
+		got.Priority != model.PriorityUrgent {
+		t.Fatalf("GetDeadLetter = %+v, %v", got, err)
+	}
+	if _, err := s.RedeliverDeadLetter(id, e); !errors.Is(err, ErrAlreadyRedelivered) {
+		t.Fatalf("second redelivery err = %v, want ErrAlreadyRedelivered", err)
+	}
+	if events, _ := s.ListEventsForAgent("bob", 0, 0); len(events) != 1 {
+		t.Fatalf("bob has %d messages, want exactly 1", len(events))
+	}
+
+	if pending, _ := s.ListDeadLetters(false); len(pending) != 0 {
+		t.Fatalf("pending = %+v, want none", pending)
+	}
+	if all, _ := s.ListDeadLetters(true); len(all) != 1 {
+		t.Fatalf("all = %+v, want 1", all)
+	}
+	if _, err := s.GetDeadLetter(99); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf("unknown id err = %v", err)
+	}
+}
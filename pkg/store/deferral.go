@@ -0,0 +1,162 @@
+// deferral.go tracks messages an agent has received but chosen to handle
+// later. The recv cursor still moves past them, so the rest of the inbox
+// flows normally; a deferral row keeps each one pending until the agent
+// takes it.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// ErrNotInInbox is returned by DeferMessages for an event that is not a
+// message to the deferring agent.
+var ErrNotInInbox = errors.New("not a message to this agent")
+
+// Deferral is a message its recipient put off.
+type Deferral struct {
+	Event model.Event `json:"event"`
+	// Until is when the message becomes due again; zero means at the next
+	// recv.
+	Until      time.Time `json:"until,omitempty"`
+	DeferredAt time.Time `json:"deferred_at"`
+}
+
+// Due reports whether the message should be shown again at now.
+func (d Deferral) Due(now time.Time) bool { return d.Until.IsZero() || !now.Before(d.Until) }
+
+// DeferMessages marks the inbox events ids of agentID as deferred until
+// until (zero for the next recv), replacing earlier deferrals of them.
+// Every ID must be a msg, review_req or review_done event targeting
+// agentID.
+func (s *Store) DeferMessages(agentID string, ids []int64, until time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var untilStr string
+	if !until.IsZero() {
+		untilStr = until.UTC().Format(time.RFC3339Nano)
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		for _, id := range ids {
+			if err := checkInInbox(tx, agentID, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO deferrals (event_id, agent_id, until, deferred_at) VALUES (?, ?, ?, ?)
+				 ON CONFLICT(event_id) DO UPDATE SET until = excluded.until, deferred_at = excluded.deferred_at`,
+				id, agentID, untilStr, now,
+			); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// ListDeferred returns the messages agentID has deferred, in Lamport
+// order, whether due or not.
+func (s *Store) ListDeferred(agentID string) ([]Deferral, error) {
+	rows, err := s.db.Query(`SELECT event_id, until, deferred_at FROM deferrals WHERE agent_id = ?`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]Deferral)
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		var until, deferred string
+		if err := rows.Scan(&id, &until, &deferred); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var d Deferral
+		if until != "" {
+			if d.Until, err = time.Parse(time.RFC3339Nano, until); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("parse until for deferral of %d: %w", id, err)
+			}
+		}
+		if d.DeferredAt, err = time.Parse(time.RFC3339Nano, deferred); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("parse deferred_at for deferral of %d: %w", id, err)
+		}
+		byID[id] = d
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	events, err := eventsByID(s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Deferral, 0, len(events))
+	for _, e := range events {
+		d := byID[e.ID]
+		d.Event = e
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// checkInInbox returns ErrNotInInbox unless event id is a msg, review_req
+// or review_done event targeting agentID.
+func checkInInbox(db dbtx, agentID string, id int64) error {
+	var n int
+	if err := db.QueryRow(
+		`SELECT COUNT(*) FROM events WHERE id = ? AND target = ? AND kind IN ('msg', 'review_req', 'review_done')`,
+		id, agentID,
+	).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("event %d: %w", id, ErrNotInInbox)
+	}
+	return nil
+}
+
+// eventsByID returns the events with the given IDs, in Lamport order.
+// IDs of deleted events are skipped.
+func eventsByID(db dbtx, ids []interface{}) ([]model.Event, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	rows, err := db.Query(
+		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events WHERE id IN (`+placeholders+`) ORDER BY lamport_ts ASC, id ASC`, ids...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEvents(rows)
+}
+
+// ClearDeferred drops agentID's deferrals of ids: the messages have been
+// handled.
+func (s *Store) ClearDeferred(agentID string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []interface{}{agentID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	return retryOnContention(func() error {
+		_, err := s.db.Exec(`DELETE FROM deferrals WHERE agent_id = ? AND event_id IN (`+placeholders+`)`, args...)
+		return err
+	})
+}
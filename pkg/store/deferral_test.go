@@ -0,0 +1,65 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestDeferrals(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	msg := func(ts int64, to string) int64 {
+		id, err := s.InsertEvent(&model.Event{AgentID: "bob", LamportTS: ts, Kind: model.EventMsg, Target: to, Body: "big request", CreatedAt: time.Now().UTC()})
+		if err != nil {
+			t.Fatalf("InsertEvent: %v", err)
+		}
+		return id
+	}
+	first, second, other := msg(1, "alice"), msg(2, "alice"), msg(3, "carol")
+	progress, _ := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 4, Kind: model.EventProgress, CreatedAt: time.Now().UTC()})
+
+	for _, id := range []int64{other, progress, 999} {
+		if err := s.DeferMessages("alice", []int64{id}, time.Time{}); !errors.Is(err, ErrNotInInbox) {
+			t.Fatalf("deferring event %d: err = %v", id, err)
+		}
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := s.DeferMessages("alice", []int64{second, first}, time.Time{}); err != nil {
+		t.Fatalf("DeferMessages: %v", err)
+	}
+	if err := s.DeferMessages("alice", []int64{second}, later); err != nil {
+		t.Fatalf("re-deferring: %v", err)
+	}
+	ds, err := s.ListDeferred("alice")
+	if err != nil || len(ds) != 2 || ds[0].Event.ID != first || ds[1].Event.ID != second {
+		t.Fatalf("ListDeferred = %+v, %v", ds, err)
+	}
+	now := time.Now()
+	if !ds[0].Due(now) || ds[1].Due(now) || !ds[1].Due(later) || ds[0].Event.Body != "big request" {
+		t.Fatalf("deferrals = %+v", ds)
+	}
+
+	// Deferred messages survive compaction even once past the cursor.
+	s.SetCursor("alice", 10)
+	if _, err := s.CompactEvents(CompactOptions{}); err != nil {
+		t.Fatalf("CompactEvents: %v", err)
+	}
+	if ds, _ := s.ListDeferred("alice"); len(ds) != 2 {
+		t.Fatalf("after gc: %+v", ds)
+	}
+
+	if err := s.ClearDeferred("alice", []int64{first}); err != nil {
+		t.Fatalf("ClearDeferred: %v", err)
+	}
+	if ds, _ := s.ListDeferred("alice"); len(ds) != 1 || ds[0].Event.ID != second {
+		t.Fatalf("after clear: %+v", ds)
+	}
+	if ds, _ := s.ListDeferred("bob"); len(ds) != 0 {
+		t.Fatalf("bob's deferrals = %+v", ds)
+	}
+}
@@ -0,0 +1,90 @@
+// delivery.go records when inbox events are drained, so that message
+// latency and clock skew between agents can be measured after the fact.
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+	"github.com/daviddao/clockmail/pkg/trace"
+)
+
+// RecordDeliveries notes that agentID drained events while its clock was
+// at clock. Events already recorded keep their first delivery, so
+// re-reading an inbox does not distort latency.
+func (s *Store) RecordDeliveries(agentID string, clock int64, events []model.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	span := s.tracer.Start("store.record_deliveries",
+		trace.String("clockmail.agent", agentID), trace.Int("clockmail.messages", int64(len(events))))
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := recordDeliveries(tx, agentID, clock, events); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	span.End(err)
+	return err
+}
+
+func recordDeliveries(db dbtx, agentID string, clock int64, events []model.Event) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, e := range events {
+		if _, err := db.Exec(
+			`INSERT INTO deliveries (event_id, agent_id, clock, delivered_at)
+			 VALUES (?, ?, ?, ?)
+			 ON CONFLICT(event_id) DO NOTHING`,
+			e.ID, agentID, clock, now,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListDeliveries returns deliveries made at or after since, oldest first.
+func (s *Store) ListDeliveries(since time.Time) ([]model.Delivery, error) {
+	return s.QueryDeliveries(nil, since)
+}
+
+// QueryDeliveries returns deliveries made at or after since of events
+// matching q, oldest first. A nil q matches every event.
+func (s *Store) QueryDeliveries(q *query.Query, since time.Time) ([]model.Delivery, error) {
+	where, args := q.Where("e.")
+	rows, err := s.db.Query(
+		`SELECT d.event_id, d.agent_id, e.agent_id, e.lamport_ts, d.clock, e.created_at, d.delivered_at
+		 FROM deliveries d JOIN events e ON e.id = d.event_id
+		 WHERE d.delivered_at >= ? AND `+where+`
+		 ORDER BY d.delivered_at ASC, d.event_id ASC`,
+		append([]interface{}{since.UTC().Format(time.RFC3339Nano)}, args...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var out []model.Delivery
+	for rows.Next() {
+		var d model.Delivery
+		var sent, delivered string
+		if err := rows.Scan(&d.EventID, &d.AgentID, &d.SenderID, &d.SendTS, &d.Clock, &sent, &delivered); err != nil {
+			return nil, err
+		}
+		if d.SentAt, err = time.Parse(time.RFC3339Nano, sent); err != nil {
+			return nil, fmt.Errorf("parse sent time for event %d: %w", d.EventID, err)
+		}
+		if d.DeliveredAt, err = time.Parse(time.RFC3339Nano, delivered); err != nil {
+			return nil, fmt.Errorf("parse delivery time for event %d: %w", d.EventID, err)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+)
+
+func TestDeliveries_RecordAndList(t *testing.T) {
+	s := newTestStore(t)
+	sent := time.Now().UTC().Add(-3 * time.Second)
+	id, _ := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 9, Kind: model.EventMsg, Target: "bob", CreatedAt: sent})
+	e := model.Event{ID: id}
+
+	if err := s.RecordDeliveries("bob", 4, []model.Event{e}); err != nil {
+		t.Fatalf("RecordDeliveries: %v", err)
+	}
+	// A second drain of the same event keeps the first delivery.
+	if err := s.RecordDeliveries("bob", 20, []model.Event{e}); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := s.ListDeliveries(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("ListDeliveries: %v", err)
+	}
+	if len(ds) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(ds))
+	}
+	d := ds[0]
+	if d.AgentID != "bob" || d.SenderID != "alice" || d.Skew() != -5 {
+		t.Fatalf("delivery = %+v (skew %d)", d, d.Skew())
+	}
+	if d.Latency() < 3*time.Second {
+		t.Fatalf("latency = %s, want >= 3s", d.Latency())
+	}
+
+	if ds, _ := s.ListDeliveries(time.Now().Add(time.Minute)); len(ds) != 0 {
+		t.Fatalf("future window should be empty, got %d", len(ds))
+	}
+}
+
+func TestQueryDeliveries(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now().UTC()
+	a, _ := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, Target: "bob", CreatedAt: now})
+	b, _ := s.InsertEvent(&model.Event{AgentID: "carol", LamportTS: 2, Kind: model.EventMsg, Target: "bob", CreatedAt: now})
+	if err := s.RecordDeliveries("bob", 3, []model.Event{{ID: a}, {ID: b}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q, _ := query.Parse("agent=carol")
+	ds, err := s.QueryDeliveries(q, time.Time{})
+	if err != nil {
+		t.Fatalf("QueryDeliveries: %v", err)
+	}
+	if len(ds) != 1 || ds[0].EventID != b || ds[0].SenderID != "carol" {
+		t.Fatalf("deliveries = %+v", ds)
+	}
+	if ds, _ := s.QueryDeliveries(nil, time.Time{}); len(ds) != 2 {
+		t.Fatalf("nil query: got %d deliveries, want 2", len(ds))
+	}
+}
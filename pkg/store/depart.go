@@ -0,0 +1,144 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Departure summarizes what DepartAgent cleaned up.
+type Departure struct {
+	AgentID string `json:"agent_id"`
+	// Locks are the paths whose locks were released.
+	Locks []string `json:"locks"`
+	// Unread counts messages still pending in the agent's inbox, by sender.
+	Unread map[string]int `json:"unread"`
+}
+
+// ErrNotRegistered is returned by DepartAgent for unknown agents.
+var ErrNotRegistered = errors.New("agent is not registered")
+
+// DepartAgent marks agentID as departed, releases all its locks and clears
+// its work in progress, in one transaction. Departed agents are left out
+// of GetActivePointstamps, so their unfinished epochs no longer hold back
+// gates; RegisterAgent brings them back. Unread messages stay in the log
+// and are only counted.
+//
+// Departing an agent other than the store's actor or one of its
+// sub-agents is privileged (see admin.go), as cm reap does; it also ends
+// the agent's session, since whoever held it is gone. The last live admin
+// cannot depart (ErrLastAdmin) until it hands the role over.
+func (s *Store) DepartAgent(agentID string) (*Departure, error) {
+	var d *Departure
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		res, err := s.departIn(tx, agentID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		d = res
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.bump()
+	return d, nil
+}
+
+// departIn is DepartAgent within tx.
+func (s *Store) departIn(tx *txn, agentID string) (*Departure, error) {
+	other := agentID != s.actor
+	if other && s.actor != "" {
+		// Retiring one's own sub-agents is routine, not a reap.
+		below, err := descendsFrom(tx, agentID, s.actor)
+		if err != nil {
+			return nil, err
+		}
+		other = !below
+	}
+	if other {
+		if err := s.authorize(tx, "reap"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkNotLastAdmin(tx, agentID); err != nil {
+		return nil, err
+	}
+
+	res := &Departure{AgentID: agentID, Unread: map[string]int{}}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	r, err := tx.Exec(`UPDATE agents SET departed_at = ? WHERE id = ?`, now, agentID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotRegistered, agentID)
+	}
+
+	rows, err := tx.Query(`SELECT path FROM locks WHERE agent_id = ? ORDER BY path`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		res.Locks = append(res.Locks, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM locks WHERE agent_id = ?`, agentID); err != nil {
+		return nil, fmt.Errorf("release locks: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM lock_intents WHERE agent_id = ?`, agentID); err != nil {
+		return nil, fmt.Errorf("drop lock intents: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM wip WHERE agent_id = ?`, agentID); err != nil {
+		return nil, fmt.Errorf("clear wip: %w", err)
+	}
+
+	rows, err = tx.Query(
+		`SELECT e.agent_id, COUNT(*) FROM events e
+		 WHERE e.target = ? AND `+unreadCond+`
+		 GROUP BY e.agent_id`, agentID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("count unread: %w", err)
+	}
+	for rows.Next() {
+		var from string
+		var n int
+		if err := rows.Scan(&from, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		res.Unread[from] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if other {
+		if _, err := tx.Exec(`DELETE FROM sessions WHERE agent_id = ?`, agentID); err != nil {
+			return nil, fmt.Errorf("end session: %w", err)
+		}
+		if err := s.logPrivileged(tx, "reap", "departed "+agentID); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestDepartAgent(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	s.UpdateAgentClock("alice", 5, 1, 0)
+	s.AcquireLock("b.go", "alice", 2, 1, true, time.Hour)
+	s.AcquireLock("a.go", "alice", 3, 1, true, time.Hour)
+	s.AcquireLock("c.go", "bob", 4, 0, true, time.Hour)
+	for _, ts := range []int64{6, 7} {
+		s.InsertEvent(&model.Event{AgentID: "bob", LamportTS: ts, Kind: model.EventMsg, Target: "alice", CreatedAt: time.Now().UTC()})
+	}
+	s.SetCursor("alice", 7) // the message at ts=6 was already read
+
+	d, err := s.DepartAgent("alice")
+	if err != nil {
+		t.Fatalf("DepartAgent: %v", err)
+	}
+	if len(d.Locks) != 2 || d.Locks[0] != "a.go" || d.Locks[1] != "b.go" {
+		t.Errorf("released locks = %v, want [a.go b.go]", d.Locks)
+	}
+	if d.Unread["bob"] != 1 || len(d.Unread) != 1 {
+		t.Errorf("unread = %v, want bob:1", d.Unread)
+	}
+	if locks, _ := s.ListLocks(); len(locks) != 1 || locks[0].AgentID != "bob" {
+		t.Errorf("remaining locks = %+v, want only bob's", locks)
+	}
+
+	ag, _ := s.GetAgent("alice")
+	if ag.DepartedAt == nil || ag.Presence(time.Now()) != "departed" {
+		t.Fatalf("alice = %+v, want departed", ag)
+	}
+	ps, _ := s.GetActivePointstamps(0)
+	if len(ps) != 1 || ps[0].AgentID != "bob" {
+		t.Errorf("active pointstamps = %+v, want only bob", ps)
+	}
+
+	// Registering again rejoins.
+	if ag, _ := s.RegisterAgent("alice"); ag.DepartedAt != nil {
+		t.Errorf("re-registered alice still departed: %+v", ag)
+	}
+	// bob's message is still unread in alice's inbox, and in flight again.
+	if ps, _ := s.GetActivePointstamps(0); len(ps) != 3 || ps[2].EventID == 0 || ps[2].AgentID != "alice" {
+		t.Errorf("active pointstamps after rejoin = %+v, want alice, bob and alice's unread message", ps)
+	}
+}
+
+func TestDepartAgent_Unregistered(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.DepartAgent("ghost"); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("err = %v, want ErrNotRegistered", err)
+	}
+}
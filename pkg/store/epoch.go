@@ -0,0 +1,143 @@
+// epoch.go persists declared epochs: the numbers agents report in their
+// pointstamps, given a description and an open/closed lifecycle by
+// cm epoch.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// ErrEpochClosed is returned when opening or closing an epoch that has
+// already been closed.
+var ErrEpochClosed = errors.New("epoch is closed")
+
+// ErrEpochNotOpened is returned when closing an epoch nobody opened.
+var ErrEpochNotOpened = errors.New("epoch was never opened")
+
+// OpenEpoch declares epoch, opened by agentID. Opening an epoch that is
+// already open keeps it open, replacing its description if desc is not
+// empty. Closed epochs cannot be reopened.
+func (s *Store) OpenEpoch(epoch int64, desc, agentID string) (*model.Epoch, error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	err := retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO epochs (epoch, description, status, opened_by, opened_at)
+			 VALUES (?, ?, ?, ?, ?)
+			 ON CONFLICT(epoch) DO UPDATE SET
+			   description = CASE WHEN excluded.description <> '' THEN excluded.description ELSE epochs.description END
+			 WHERE epochs.status = ?`,
+			epoch, desc, string(model.EpochOpen), agentID, now, string(model.EpochOpen),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	e, err := s.GetEpoch(epoch)
+	if err != nil {
+		return nil, err
+	}
+	if e.Status != model.EpochOpen {
+		return nil, fmt.Errorf("%w: %d", ErrEpochClosed, epoch)
+	}
+	return e, nil
+}
+
+// CloseEpoch marks an open epoch closed by agentID. It does not check the
+// frontier; callers decide whether the epoch is finished.
+func (s *Store) CloseEpoch(epoch int64, agentID string) (*model.Epoch, error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var affected int64
+	err := retryOnContention(func() error {
+		res, err := s.db.Exec(
+			`UPDATE epochs SET status = ?, closed_by = ?, closed_at = ? WHERE epoch = ? AND status = ?`,
+			string(model.EpochClosed), agentID, now, epoch, string(model.EpochOpen),
+		)
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	e, err := s.GetEpoch(epoch)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrEpochNotOpened, epoch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrEpochClosed, epoch)
+	}
+	return e, nil
+}
+
+const epochColumns = `epoch, description, status, opened_by, opened_at, closed_by, closed_at`
+
+// GetEpoch returns a declared epoch, or sql.ErrNoRows if it was never
+// opened.
+func (s *Store) GetEpoch(epoch int64) (*model.Epoch, error) {
+	rows, err := s.db.Query(`SELECT `+epochColumns+` FROM epochs WHERE epoch = ?`, epoch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	epochs, err := scanEpochs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(epochs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &epochs[0], nil
+}
+
+// ListEpochs returns declared epochs in order, optionally only the open
+// ones.
+func (s *Store) ListEpochs(openOnly bool) ([]model.Epoch, error) {
+	query := `SELECT ` + epochColumns + ` FROM epochs`
+	var args []interface{}
+	if openOnly {
+		query += ` WHERE status = ?`
+		args = append(args, string(model.EpochOpen))
+	}
+	rows, err := s.db.Query(query+` ORDER BY epoch ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEpochs(rows)
+}
+
+func scanEpochs(rows *sql.Rows) ([]model.Epoch, error) {
+	var out []model.Epoch
+	for rows.Next() {
+		var e model.Epoch
+		var status, opened, closed string
+		if err := rows.Scan(&e.Epoch, &e.Description, &status, &e.OpenedBy, &opened, &e.ClosedBy, &closed); err != nil {
+			return nil, err
+		}
+		e.Status = model.EpochStatus(status)
+		var err error
+		if e.OpenedAt, err = time.Parse(time.RFC3339Nano, opened); err != nil {
+			return nil, fmt.Errorf("parse opened_at for epoch %d: %w", e.Epoch, err)
+		}
+		if closed != "" {
+			t, err := time.Parse(time.RFC3339Nano, closed)
+			if err != nil {
+				return nil, fmt.Errorf("parse closed_at for epoch %d: %w", e.Epoch, err)
+			}
+			e.ClosedAt = &t
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
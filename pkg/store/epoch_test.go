@@ -0,0 +1,57 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestEpochs_Lifecycle(t *testing.T) {
+	s := newTestStore(t)
+
+	e, err := s.OpenEpoch(4, "feature X", "alice")
+	if err != nil {
+		t.Fatalf("OpenEpoch: %v", err)
+	}
+	if e.Epoch != 4 || e.Description != "feature X" || e.Status != model.EpochOpen || e.OpenedBy != "alice" || e.ClosedAt != nil {
+		t.Fatalf("opened = %+v", e)
+	}
+
+	// Reopening keeps the opener; an empty description keeps the old one.
+	if e, err = s.OpenEpoch(4, "", "bob"); err != nil || e.Description != "feature X" || e.OpenedBy != "alice" {
+		t.Fatalf("reopen = %+v, %v", e, err)
+	}
+	if e, _ = s.OpenEpoch(4, "feature X and Y", "bob"); e.Description != "feature X and Y" {
+		t.Fatalf("description not replaced: %+v", e)
+	}
+	s.OpenEpoch(2, "", "alice")
+
+	if open, err := s.ListEpochs(true); err != nil || len(open) != 2 || open[0].Epoch != 2 || open[1].Epoch != 4 {
+		t.Fatalf("ListEpochs(open) = %+v, %v", open, err)
+	}
+
+	if e, err = s.CloseEpoch(2, "bob"); err != nil || e.Status != model.EpochClosed || e.ClosedBy != "bob" || e.ClosedAt == nil {
+		t.Fatalf("CloseEpoch = %+v, %v", e, err)
+	}
+	if _, err := s.CloseEpoch(2, "bob"); !errors.Is(err, ErrEpochClosed) {
+		t.Fatalf("closing twice: err = %v", err)
+	}
+	if _, err := s.OpenEpoch(2, "again", "alice"); !errors.Is(err, ErrEpochClosed) {
+		t.Fatalf("reopening a closed epoch: err = %v", err)
+	}
+	if _, err := s.CloseEpoch(9, "bob"); !errors.Is(err, ErrEpochNotOpened) {
+		t.Fatalf("closing an unopened epoch: err = %v", err)
+	}
+	if _, err := s.GetEpoch(9); err != sql.ErrNoRows {
+		t.Fatalf("GetEpoch(9): err = %v", err)
+	}
+
+	if open, _ := s.ListEpochs(true); len(open) != 1 || open[0].Epoch != 4 {
+		t.Fatalf("open epochs = %+v", open)
+	}
+	if all, _ := s.ListEpochs(false); len(all) != 2 {
+		t.Fatalf("all epochs = %+v", all)
+	}
+}
@@ -0,0 +1,137 @@
+// frontier_history.go keeps a timeline of the frontier, so that once an
+// epoch has finished one can still see which agents held it back and for
+// how long.
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/frontier"
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// RecordFrontier computes the frontier over the active agents and, if it
+// differs from the last snapshot, records a new one. It returns the
+// snapshot in effect and whether it was just recorded. Heartbeats call it
+// after every move, so the history changes only when the frontier does.
+func (s *Store) RecordFrontier() (*model.FrontierSnapshot, bool, error) {
+	active, err := s.GetActivePointstamps(0)
+	if err != nil {
+		return nil, false, err
+	}
+	f := frontier.ComputeFrontier(active)
+	sort.Slice(f, func(i, j int) bool { return f[i].AgentID < f[j].AgentID })
+	if f == nil {
+		f = []model.Pointstamp{}
+	}
+	body, err := json.Marshal(f)
+	if err != nil {
+		return nil, false, err
+	}
+	snap := &model.FrontierSnapshot{Frontier: f, Active: len(active), RecordedAt: time.Now().UTC()}
+	for i, p := range f {
+		if i == 0 || p.Timestamp.Epoch < snap.Epoch {
+			snap.Epoch = p.Timestamp.Epoch
+		}
+	}
+
+	var last *model.FrontierSnapshot
+	err = retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := tx.advisoryLock("clockmail:frontier"); err != nil {
+			return err
+		}
+		rows, err := tx.Query(`SELECT ` + frontierColumns + ` FROM frontier_history ORDER BY id DESC LIMIT 1`)
+		if err != nil {
+			return err
+		}
+		prev, err := scanFrontierHistory(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(prev) > 0 {
+			if b, _ := json.Marshal(prev[0].Frontier); string(b) == string(body) {
+				last = &prev[0]
+				return nil
+			}
+		}
+		last = nil
+		snap.ID, err = s.db.dialect.insertReturningID(tx,
+			`INSERT INTO frontier_history (epoch, frontier, active, recorded_at) VALUES (?, ?, ?, ?)`,
+			snap.Epoch, string(body), snap.Active, snap.RecordedAt.Format(time.RFC3339Nano),
+		)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if last != nil {
+		return last, false, nil
+	}
+	return snap, true, nil
+}
+
+const frontierColumns = `id, epoch, frontier, active, recorded_at`
+
+// ListFrontierHistory returns the snapshots recorded at or after since,
+// oldest first, keeping the most recent limit. The snapshot in effect at
+// since, recorded before it, is included too, so the timeline has no gap
+// at its start.
+func (s *Store) ListFrontierHistory(since time.Time, limit int) ([]model.FrontierSnapshot, error) {
+	var first int64
+	err := s.db.QueryRow(
+		`SELECT COALESCE(MAX(id), 0) FROM frontier_history WHERE recorded_at < ?`,
+		since.UTC().Format(time.RFC3339Nano),
+	).Scan(&first)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		`SELECT `+frontierColumns+` FROM frontier_history WHERE id >= ? ORDER BY id DESC LIMIT ?`,
+		first, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snaps, err := scanFrontierHistory(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(snaps)-1; i < j; i, j = i+1, j-1 {
+		snaps[i], snaps[j] = snaps[j], snaps[i]
+	}
+	return snaps, nil
+}
+
+func scanFrontierHistory(rows *sql.Rows) ([]model.FrontierSnapshot, error) {
+	var out []model.FrontierSnapshot
+	for rows.Next() {
+		var f model.FrontierSnapshot
+		var body, at string
+		if err := rows.Scan(&f.ID, &f.Epoch, &body, &f.Active, &at); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(body), &f.Frontier); err != nil {
+			return nil, fmt.Errorf("parse frontier snapshot %d: %w", f.ID, err)
+		}
+		var err error
+		if f.RecordedAt, err = time.Parse(time.RFC3339Nano, at); err != nil {
+			return nil, fmt.Errorf("parse recorded_at for frontier snapshot %d: %w", f.ID, err)
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
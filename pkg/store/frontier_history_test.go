@@ -0,0 +1,51 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrontierHistory(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	s.UpdateAgentClock("alice", 1, 1, 0)
+	s.UpdateAgentClock("bob", 1, 1, 2)
+
+	snap, recorded, err := s.RecordFrontier()
+	if err != nil || !recorded {
+		t.Fatalf("RecordFrontier = %v, %v", recorded, err)
+	}
+	// (1,0) < (1,2): alice alone holds the frontier.
+	if snap.Epoch != 1 || snap.Active != 2 || len(snap.Frontier) != 1 || snap.Frontier[0].AgentID != "alice" {
+		t.Fatalf("snapshot = %+v", snap)
+	}
+
+	// bob moving on does not change the frontier: nothing is recorded.
+	s.UpdateAgentClock("bob", 2, 2, 0)
+	if again, recorded, err := s.RecordFrontier(); err != nil || recorded || again.ID != snap.ID {
+		t.Fatalf("unchanged frontier: %+v, recorded=%v, %v", again, recorded, err)
+	}
+
+	s.UpdateAgentClock("alice", 3, 3, 0)
+	if next, recorded, _ := s.RecordFrontier(); !recorded || next.Epoch != 2 || next.Frontier[0].AgentID != "bob" {
+		t.Fatalf("after alice moved: %+v, recorded=%v", next, recorded)
+	}
+	s.DepartAgent("bob")
+	s.RecordFrontier()
+
+	snaps, err := s.ListFrontierHistory(time.Time{}, 10)
+	if err != nil || len(snaps) != 3 {
+		t.Fatalf("ListFrontierHistory = %+v, %v", snaps, err)
+	}
+	if snaps[0].Epoch != 1 || snaps[1].Epoch != 2 || snaps[2].Epoch != 3 || snaps[2].Active != 1 {
+		t.Fatalf("history = %+v", snaps)
+	}
+	if last, _ := s.ListFrontierHistory(time.Time{}, 1); len(last) != 1 || last[0].ID != snaps[2].ID {
+		t.Fatalf("limit 1 = %+v", last)
+	}
+	// The snapshot in effect at since is included.
+	if recent, _ := s.ListFrontierHistory(time.Now().Add(time.Hour), 10); len(recent) != 1 || recent[0].ID != snaps[2].ID {
+		t.Fatalf("since the future = %+v", recent)
+	}
+}
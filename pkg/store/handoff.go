@@ -0,0 +1,233 @@
+// handoff.go records transfers of work between agents. Starting a handoff
+// releases the sender's locks on the files handed over (or passes them
+// straight to the recipient), logs the handoff message and records the
+// handoff, all in one transaction, so there is no moment at which the
+// files are unlocked and nobody has been told.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+var (
+	// ErrHandoffNotFound is returned for an unknown handoff ID.
+	ErrHandoffNotFound = errors.New("no such handoff")
+	// ErrHandoffAccepted is returned by AcceptHandoff for a handoff that
+	// has been accepted before.
+	ErrHandoffAccepted = errors.New("handoff already accepted")
+	// ErrNotHandoffRecipient is returned by AcceptHandoff when the
+	// accepting agent is not the one the work was handed to.
+	ErrNotHandoffRecipient = errors.New("handoff is addressed to another agent")
+)
+
+// Handoff is one transfer of work from one agent to another.
+type Handoff struct {
+	ID      int64    `json:"id"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Files   []string `json:"files"`
+	Summary string   `json:"summary"`
+	Epoch   int64    `json:"epoch"`
+	EventID int64    `json:"event_id"` // the handoff message
+	// Released are the files the sender held locks on when handing off.
+	Released []string `json:"released"`
+	// Reserved are the released files whose locks passed to the
+	// recipient instead of being freed.
+	Reserved   []string   `json:"reserved"`
+	CreatedAt  time.Time  `json:"created_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
+
+// StartHandoff hands h.Files from h.From to h.To. The sender's locks on
+// those files are released, with a lock_rel event for each, or with
+// reserve transferred to the recipient for ttl, keeping their Lamport
+// timestamps. msg, the handoff message, is logged with the body compose
+// returns for the new handoff's ID. h gets its ID, EventID, Released and
+// Reserved.
+func (s *Store) StartHandoff(h *Handoff, msg *model.Event, compose func(id int64) string, reserve bool, ttl time.Duration) error {
+	s.expireStaleLocks()
+	err := retryOnContention(func() error {
+		h.Released, h.Reserved = nil, nil
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+
+		if h.ID, err = s.db.dialect.insertReturningID(tx,
+			`INSERT INTO handoffs (from_agent, to_agent, files, summary, epoch, event_id, released, reserved, created_at)
+			 VALUES (?, ?, ?, ?, ?, 0, '', '', ?)`,
+			h.From, h.To, strings.Join(h.Files, "\n"), h.Summary, h.Epoch, h.CreatedAt.UTC().Format(time.RFC3339Nano),
+		); err != nil {
+			return err
+		}
+
+		for _, path := range h.Files {
+			if err := tx.advisoryLock("clockmail:lock:" + path); err != nil {
+				return fmt.Errorf("advisory lock: %w", err)
+			}
+			var held int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM locks WHERE path = ? AND agent_id = ?`, path, h.From).Scan(&held); err != nil {
+				return err
+			}
+			if held == 0 {
+				continue
+			}
+			h.Released = append(h.Released, path)
+			note := fmt.Sprintf("handed off to %s (handoff %d)", h.To, h.ID)
+			if reserve {
+				if _, err := tx.Exec(`DELETE FROM locks WHERE path = ? AND agent_id = ?`, path, h.To); err != nil {
+					return err
+				}
+				if _, err := tx.Exec(`UPDATE locks SET agent_id = ?, epoch = ?, expires_at = ? WHERE path = ? AND agent_id = ?`,
+					h.To, h.Epoch, time.Now().UTC().Add(ttl).Format(time.RFC3339Nano), path, h.From); err != nil {
+					return err
+				}
+				h.Reserved = append(h.Reserved, path)
+				note = fmt.Sprintf("reserved for %s (handoff %d)", h.To, h.ID)
+			} else if _, err := tx.Exec(`DELETE FROM locks WHERE path = ? AND agent_id = ?`, path, h.From); err != nil {
+				return err
+			}
+			if _, err := s.insertSigned(tx, &model.Event{AgentID: h.From, LamportTS: msg.LamportTS, Epoch: h.Epoch,
+				Kind: model.EventLockRel, Target: path, Body: note, CreatedAt: msg.CreatedAt, Provenance: msg.Provenance}); err != nil {
+				return err
+			}
+		}
+
+		msg.Body = compose(h.ID)
+		if h.EventID, err = s.insertSigned(tx, msg); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE handoffs SET event_id = ?, released = ?, reserved = ? WHERE id = ?`,
+			h.EventID, strings.Join(h.Released, "\n"), strings.Join(h.Reserved, "\n"), h.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == nil {
+		s.bump()
+	}
+	return err
+}
+
+// insertSigned signs e and appends it to the log within tx.
+func (s *Store) insertSigned(tx *txn, e *model.Event) (int64, error) {
+	if err := s.signEvent(e); err != nil {
+		return 0, err
+	}
+	if err := s.checkSession(tx, e.AgentID); err != nil {
+		return 0, err
+	}
+	if err := checkStrict(tx, e); err != nil {
+		return 0, err
+	}
+	return s.db.dialect.insertEvent(tx, e)
+}
+
+// AcceptHandoff marks handoff id accepted by agentID, who must be its
+// recipient. Taking over the files' locks is left to the caller.
+func (s *Store) AcceptHandoff(id int64, agentID string) (*Handoff, error) {
+	var h *Handoff
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if h, err = getHandoff(tx, id); err != nil {
+			return err
+		}
+		switch {
+		case h.To != agentID:
+			return fmt.Errorf("handoff %d (to %s): %w", id, h.To, ErrNotHandoffRecipient)
+		case h.AcceptedAt != nil:
+			return fmt.Errorf("handoff %d: %w", id, ErrHandoffAccepted)
+		}
+		now := time.Now().UTC()
+		if _, err := tx.Exec(`UPDATE handoffs SET accepted_at = ? WHERE id = ?`, now.Format(time.RFC3339Nano), id); err != nil {
+			return err
+		}
+		h.AcceptedAt = &now
+		return tx.Commit()
+	})
+	return h, err
+}
+
+// GetHandoff returns handoff id, or ErrHandoffNotFound.
+func (s *Store) GetHandoff(id int64) (*Handoff, error) {
+	return getHandoff(s.db, id)
+}
+
+// ListHandoffs returns handoffs to or from agentID ("" for everyone's),
+// oldest first; with pending only those not yet accepted.
+func (s *Store) ListHandoffs(agentID string, pending bool) ([]Handoff, error) {
+	q := `SELECT ` + handoffCols + ` FROM handoffs WHERE 1 = 1`
+	var args []interface{}
+	if agentID != "" {
+		q += ` AND (from_agent = ? OR to_agent = ?)`
+		args = append(args, agentID, agentID)
+	}
+	if pending {
+		q += ` AND accepted_at = ''`
+	}
+	rows, err := s.db.Query(q+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Handoff
+	for rows.Next() {
+		h, err := scanHandoff(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *h)
+	}
+	return out, rows.Err()
+}
+
+const handoffCols = `id, from_agent, to_agent, files, summary, epoch, event_id, released, reserved, created_at, accepted_at`
+
+func getHandoff(db dbtx, id int64) (*Handoff, error) {
+	h, err := scanHandoff(db.QueryRow(`SELECT `+handoffCols+` FROM handoffs WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("handoff %d: %w", id, ErrHandoffNotFound)
+	}
+	return h, err
+}
+
+func scanHandoff(row interface{ Scan(...interface{}) error }) (*Handoff, error) {
+	var h Handoff
+	var files, released, reserved, created, accepted string
+	if err := row.Scan(&h.ID, &h.From, &h.To, &files, &h.Summary, &h.Epoch, &h.EventID,
+		&released, &reserved, &created, &accepted); err != nil {
+		return nil, err
+	}
+	h.Files, h.Released, h.Reserved = splitLines(files), splitLines(released), splitLines(reserved)
+	var err error
+	if h.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+		return nil, fmt.Errorf("parse created_at for handoff %d: %w", h.ID, err)
+	}
+	if accepted != "" {
+		t, err := time.Parse(time.RFC3339Nano, accepted)
+		if err != nil {
+			return nil, fmt.Errorf("parse accepted_at for handoff %d: %w", h.ID, err)
+		}
+		h.AcceptedAt = &t
+	}
+	return &h, nil
+}
+
+// splitLines splits a newline-joined list column; "" is no items.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
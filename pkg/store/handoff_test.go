@@ -0,0 +1,71 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestHandoff(t *testing.T) {
+	s := newTestStore(t)
+	for _, p := range []string{"a.go", "b.go"} {
+		if _, conflict, err := s.AcquireLock(p, "alice", 5, 1, true, time.Hour); err != nil || conflict != nil {
+			t.Fatalf("AcquireLock(%s): %v, %v", p, conflict, err)
+		}
+	}
+	s.AcquireLock("c.go", "carol", 2, 1, true, time.Hour)
+
+	start := func(reserve bool, files ...string) *Handoff {
+		t.Helper()
+		h := &Handoff{From: "alice", To: "bob", Files: files, Summary: "add tests", Epoch: 3, CreatedAt: time.Now()}
+		msg := &model.Event{AgentID: "alice", LamportTS: 9, Kind: model.EventMsg, Target: "bob", CreatedAt: time.Now()}
+		if err := s.StartHandoff(h, msg, func(id int64) string { return fmt.Sprintf("handoff %d", id) }, reserve, time.Hour); err != nil {
+			t.Fatalf("StartHandoff: %v", err)
+		}
+		return h
+	}
+
+	// Released: alice's lock on a.go goes; carol keeps c.go.
+	h := start(false, "a.go", "c.go")
+	if len(h.Released) != 1 || h.Released[0] != "a.go" || len(h.Reserved) != 0 || h.EventID == 0 {
+		t.Fatalf("handoff = %+v", h)
+	}
+	locks, _ := s.ListLocks()
+	if len(locks) != 2 || locks[0].Path != "c.go" || locks[1].Path != "b.go" {
+		t.Fatalf("locks after release = %+v", locks)
+	}
+	inbox, _ := s.ListEventsForAgent("bob", 0, 0)
+	if len(inbox) != 1 || inbox[0].Body != fmt.Sprintf("handoff %d", h.ID) {
+		t.Fatalf("bob's inbox = %+v", inbox)
+	}
+
+	// Reserved: b.go passes to bob with alice's timestamp.
+	h2 := start(true, "b.go")
+	bobs, _ := s.ListLocksForAgent("bob")
+	if len(h2.Reserved) != 1 || len(bobs) != 1 || bobs[0].Path != "b.go" || bobs[0].LamportTS != 5 || bobs[0].Epoch != 3 {
+		t.Fatalf("reserved handoff = %+v, bob's locks = %+v", h2, bobs)
+	}
+
+	if _, err := s.AcceptHandoff(h2.ID, "carol"); !errors.Is(err, ErrNotHandoffRecipient) {
+		t.Fatalf("accept by carol: err = %v", err)
+	}
+	got, err := s.AcceptHandoff(h2.ID, "bob")
+	if err != nil || got.AcceptedAt == nil || got.Reserved[0] != "b.go" {
+		t.Fatalf("AcceptHandoff = %+v, %v", got, err)
+	}
+	if _, err := s.AcceptHandoff(h2.ID, "bob"); !errors.Is(err, ErrHandoffAccepted) {
+		t.Fatalf("second accept: err = %v", err)
+	}
+	if _, err := s.GetHandoff(99); !errors.Is(err, ErrHandoffNotFound) {
+		t.Fatalf("GetHandoff(99): err = %v", err)
+	}
+	if pending, _ := s.ListHandoffs("bob", true); len(pending) != 1 || pending[0].ID != h.ID {
+		t.Fatalf("pending for bob = %+v", pending)
+	}
+	if all, _ := s.ListHandoffs("", false); len(all) != 2 {
+		t.Fatalf("all handoffs = %+v", all)
+	}
+}
@@ -0,0 +1,19 @@
+// health.go checks that the database is reachable and writable, for
+// cm doctor.
+package store
+
+// Ping checks that the database can be reached.
+func (s *Store) Ping() error { return s.db.Ping() }
+
+// CheckWrite takes the database's write lock and lets it go again,
+// changing nothing, to check that the store can write. On SQLite a
+// write statement reserves the lock even when it matches no rows.
+func (s *Store) CheckWrite() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE schema_version SET version = version WHERE version < 0`)
+	return err
+}
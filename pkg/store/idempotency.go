@@ -0,0 +1,67 @@
+// idempotency.go remembers what a send with an idempotency key wrote.
+// Agent frameworks retry tool calls that look failed, and a retried cm
+// send would otherwise put the message in the log twice. A key is unique
+// per sender, so the retry finds the first send's events instead.
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SendKey records the events written by a send with an idempotency key.
+type SendKey struct {
+	AgentID   string    `json:"agent_id"`
+	Key       string    `json:"key"`
+	LamportTS int64     `json:"lamport_ts"`
+	EventIDs  []int64   `json:"event_ids"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SendKey returns the send agentID made with key, or sql.ErrNoRows if it
+// has made none.
+func (s *Store) SendKey(agentID, key string) (*SendKey, error) {
+	return sendKey(s.db, agentID, key)
+}
+
+func sendKey(db dbtx, agentID, key string) (*SendKey, error) {
+	k := &SendKey{AgentID: agentID, Key: key}
+	var ids, created string
+	err := db.QueryRow(
+		`SELECT lamport_ts, event_ids, created_at FROM send_keys WHERE agent_id = ? AND key = ?`,
+		agentID, key,
+	).Scan(&k.LamportTS, &ids, &created)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range strings.Fields(ids) {
+		id, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse event_ids for send key %s of %s: %w", key, agentID, err)
+		}
+		k.EventIDs = append(k.EventIDs, id)
+	}
+	if k.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+		return nil, fmt.Errorf("parse created_at for send key %s of %s: %w", key, agentID, err)
+	}
+	return k, nil
+}
+
+// recordSendKey stores k. The key is the table's primary key, so a
+// second send with it fails rather than being recorded twice.
+func recordSendKey(db dbtx, k *SendKey) error {
+	ids := make([]string, len(k.EventIDs))
+	for i, id := range k.EventIDs {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	if k.CreatedAt.IsZero() {
+		k.CreatedAt = time.Now().UTC()
+	}
+	_, err := db.Exec(
+		`INSERT INTO send_keys (agent_id, key, lamport_ts, event_ids, created_at) VALUES (?, ?, ?, ?, ?)`,
+		k.AgentID, k.Key, k.LamportTS, strings.Join(ids, "\n"), k.CreatedAt.Format(time.RFC3339Nano),
+	)
+	return err
+}
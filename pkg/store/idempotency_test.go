@@ -0,0 +1,33 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestSendKeys(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.SendKey("alice", "k1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("SendKey before send: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.WithTx(func(tx TxStore) error {
+		return tx.RecordSendKey(&SendKey{AgentID: "alice", Key: "k1", LamportTS: 4, EventIDs: []int64{7, 8}})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	k, err := s.SendKey("alice", "k1")
+	if err != nil || k.LamportTS != 4 || len(k.EventIDs) != 2 || k.EventIDs[1] != 8 {
+		t.Fatalf("SendKey = %+v, %v; want ts 4, events [7 8]", k, err)
+	}
+
+	// Keys are per sender, and a key cannot be recorded twice.
+	if _, err := s.SendKey("bob", "k1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("SendKey for bob: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.WithTx(func(tx TxStore) error {
+		return tx.RecordSendKey(&SendKey{AgentID: "alice", Key: "k1", LamportTS: 9})
+	}); err == nil {
+		t.Fatal("recording a used key succeeded")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
 )
 
 // StoreInterface defines the full set of store operations.
@@ -28,9 +29,33 @@ type StoreInterface interface {
 	// UpdateAgentClock persists the agent's Lamport clock and position.
 	UpdateAgentClock(id string, clk, epoch, round int64) error
 
+	// SetAgentPosition moves an agent to an epoch and round, clock untouched.
+	SetAgentPosition(id string, epoch, round int64) error
+
+	// SetAgentAt moves an agent to a timestamp with steps, clock untouched.
+	SetAgentAt(id string, ts model.Timestamp) error
+
+	// SetAgentScope records the part of the repository an agent works on.
+	SetAgentScope(id, scope string) error
+
+	// TickAgent atomically applies IR1 to an agent's stored clock.
+	TickAgent(id string) (int64, error)
+
+	// ReceiveAgent atomically applies IR2 to an agent's stored clock.
+	ReceiveAgent(id string, ts int64) (int64, error)
+
 	// ListAgents returns all registered agents ordered by ID.
 	ListAgents() ([]model.Agent, error)
 
+	// DepartAgent marks an agent departed and releases its locks.
+	DepartAgent(agentID string) (*Departure, error)
+
+	// SpawnAgent registers a sub-agent under a parent.
+	SpawnAgent(childID, parentID string, clk int64, life Lifecycle) (*model.Agent, error)
+
+	// RetirableSubAgents returns children whose lifecycle has ended.
+	RetirableSubAgents(parentID string, epoch int64) ([]string, error)
+
 	// --- Cursors ---
 
 	// GetCursor returns the stored recv cursor for an agent (0 if unset).
@@ -39,10 +64,69 @@ type StoreInterface interface {
 	// SetCursor updates the recv cursor for an agent.
 	SetCursor(agentID string, sinceTS int64) error
 
+	// SetSenderCursor advances an agent's recv cursor for one sender.
+	SetSenderCursor(agentID, sender string, sinceTS int64) error
+
+	// SenderCursors returns an agent's per-sender cursors that are ahead
+	// of its recv cursor.
+	SenderCursors(agentID string) (map[string]int64, error)
+
+	// ListUnread returns an agent's unread inbox events, optionally from
+	// one sender only.
+	ListUnread(agentID, sender string, limit int) ([]model.Event, error)
+
+	// --- Public keys ---
+
+	// SetPublicKey registers the key messages to an agent are sealed with.
+	SetPublicKey(agentID, pubkey string) error
+
+	// PublicKey returns an agent's registered public key.
+	PublicKey(agentID string) (string, error)
+
+	// --- Sessions ---
+
+	// StartSession mints a new session token for an agent, replacing any
+	// earlier one.
+	StartSession(agentID string) (string, error)
+
+	// EndSession drops an agent's session.
+	EndSession(agentID string) error
+
+	// --- Signing keys ---
+
+	// RegisterSigningKey registers an agent's signing key unless it has
+	// one, returning the key registered.
+	RegisterSigningKey(agentID, pub string) (string, error)
+
+	// SigningKey returns an agent's registered signing key.
+	SigningKey(agentID string) (string, error)
+
+	// SetStrictSignatures turns rejection of unverified events on or off.
+	SetStrictSignatures(on bool) error
+
+	// StrictSignatures reports whether strict mode is on.
+	StrictSignatures() (bool, error)
+
+	// VerifyEvent checks an event's signature against its agent's key.
+	VerifyEvent(e model.Event) error
+
+	// VerifyChain checks the event log's hash chain end to end.
+	VerifyChain() (*ChainReport, error)
+
+	// --- Attachments ---
+
+	// PutAttachment stores a large message body by content hash.
+	PutAttachment(body, createdBy string) (*model.Attachment, error)
+
+	// GetAttachment returns an attachment by ID or unique ID prefix.
+	GetAttachment(id string) (*model.Attachment, error)
+
 	// --- Events ---
 
 	// InsertEvent appends an event to the log. Returns the row ID.
 	InsertEvent(e *model.Event) (int64, error)
+	// InsertEvents appends events in one transaction.
+	InsertEvents(events []*model.Event) ([]int64, error)
 
 	// ListEvents returns events with lamport_ts >= sinceTS.
 	ListEvents(sinceTS int64, limit int) ([]model.Event, error)
@@ -59,24 +143,294 @@ type StoreInterface interface {
 	// ListEventsForAgent returns messages targeted to agentID.
 	ListEventsForAgent(agentID string, sinceTS int64, limit int) ([]model.Event, error)
 
+	// ListEventsByKind returns events of the given kinds since sinceTS.
+	ListEventsByKind(kinds []model.EventKind, sinceTS int64, limit int) ([]model.Event, error)
+
+	// QueryEvents returns events matching a query since sinceTS.
+	QueryEvents(q *query.Query, sinceTS int64, limit int) ([]model.Event, error)
+	// QueryEventsSinceID returns events matching a query with row ID > sinceID.
+	QueryEventsSinceID(q *query.Query, sinceID int64, limit int) ([]model.Event, error)
+
+	// --- Metrics ---
+
+	// CountEventsByKind returns how many events of each kind are in the log.
+	CountEventsByKind() (map[model.EventKind]int64, error)
+
+	// CountUnread returns each agent's number of unreceived inbox events.
+	CountUnread() (map[string]int64, error)
+
+	// CountDeniedLocks returns each agent's number of denied lock requests.
+	CountDeniedLocks() (map[string]int64, error)
+
+	// LastEventAt returns when each agent wrote its latest event.
+	LastEventAt() (map[string]time.Time, error)
+
+	// CompactEvents deletes old events that are no longer needed.
+	CompactEvents(opts CompactOptions) (*CompactResult, error)
+
+	// ImportEvents replays exported events, restoring agents and clocks.
+	ImportEvents(events []model.Event, markDelivered bool) (*ImportResult, error)
+
+	// --- Reviews ---
+
+	// ListReviews returns reviews of commits starting with commit.
+	ListReviews(commit string) ([]model.Review, error)
+
+	// PendingReviews returns the reviews waiting on reviewer.
+	PendingReviews(reviewer string) ([]model.Review, error)
+
+	// ReviewEvents returns the review requests sent by requester and the
+	// latest verdict of each review, newest first.
+	ReviewEvents(requester string) ([]model.Event, error)
+
+	// --- Epochs ---
+
+	// OpenEpoch declares an epoch, or updates an open one's description.
+	OpenEpoch(epoch int64, desc, agentID string) (*model.Epoch, error)
+
+	// CloseEpoch marks an open epoch closed.
+	CloseEpoch(epoch int64, agentID string) (*model.Epoch, error)
+
+	// GetEpoch returns a declared epoch.
+	GetEpoch(epoch int64) (*model.Epoch, error)
+
+	// ListEpochs returns declared epochs, optionally only open ones.
+	ListEpochs(openOnly bool) ([]model.Epoch, error)
+
+	// --- Deferred messages ---
+
+	// DeferMessages keeps received inbox events pending for later.
+	DeferMessages(agentID string, ids []int64, until time.Time) error
+
+	// ListDeferred returns an agent's deferred messages.
+	ListDeferred(agentID string) ([]Deferral, error)
+
+	// ClearDeferred drops deferrals of handled messages.
+	ClearDeferred(agentID string, ids []int64) error
+
+	// --- Message states ---
+
+	// SetMessageState files messages as inbox, flagged or archived.
+	SetMessageState(agentID string, ids []int64, state MessageState) error
+
+	// KeepMessages puts received messages in the inbox unless already filed.
+	KeepMessages(agentID string, ids []int64) error
+
+	// ListMessages returns an agent's filed messages in the given states.
+	ListMessages(agentID string, states ...MessageState) ([]FiledMessage, error)
+
+	// --- Work in progress ---
+
+	// SetWIP declares what an agent is working on.
+	SetWIP(agentID, desc string, files []string, epoch int64) (*model.WIP, error)
+
+	// ClearWIP removes an agent's declaration.
+	ClearWIP(agentID string) (bool, error)
+
+	// GetWIP returns an agent's declaration.
+	GetWIP(agentID string) (*model.WIP, error)
+
+	// ListWIP returns every declaration.
+	ListWIP() ([]model.WIP, error)
+
+	// --- Ownership ---
+
+	// ClaimOwnership records an agent as the owner of a path.
+	ClaimOwnership(path, agentID, note string, force bool) (*model.Ownership, *model.Ownership, error)
+
+	// ReleaseOwnership drops an agent's claim on a path.
+	ReleaseOwnership(path, agentID string) (bool, error)
+
+	// ListOwnership returns every claim.
+	ListOwnership() ([]model.Ownership, error)
+
+	// --- Frontier history ---
+
+	// RecordFrontier records the current frontier if it has changed.
+	RecordFrontier() (*model.FrontierSnapshot, bool, error)
+
+	// ListFrontierHistory returns frontier snapshots since a time.
+	ListFrontierHistory(since time.Time, limit int) ([]model.FrontierSnapshot, error)
+
+	// --- Transactions ---
+
+	// WithTx runs several writes in one transaction.
+	WithTx(fn func(tx TxStore) error) error
+
 	// --- Locks ---
 
 	// AcquireLock attempts to acquire a file lock.
 	AcquireLock(path, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) (*model.Lock, *model.Lock, error)
 
+	// AcquireLocks acquires several locks all-or-nothing.
+	AcquireLocks(paths []string, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) ([]model.Lock, *model.Lock, error)
+
 	// ReleaseLock releases a file lock held by an agent.
 	ReleaseLock(path, agentID string) error
 
+	// ForceReleaseLock releases every agent's lock on a path.
+	ForceReleaseLock(path string) ([]model.Lock, error)
+
+	// RenewLock extends the expiry of a lock held by an agent.
+	RenewLock(path, agentID string, ttl time.Duration) (*model.Lock, error)
+
 	// ListLocks returns all active (non-expired) locks.
 	ListLocks() ([]model.Lock, error)
 
 	// ListLocksForAgent returns active locks held by a specific agent.
 	ListLocksForAgent(agentID string) ([]model.Lock, error)
 
+	// LocksOnPath returns the unexpired locks on a path without side effects.
+	LocksOnPath(path string) ([]model.Lock, error)
+
+	// QueueLockIntent records an agent waiting for a lock.
+	QueueLockIntent(path, agentID string, lamportTS int64, ttl time.Duration) (*model.LockIntent, error)
+
+	// DropLockIntent removes an agent's intent on a path.
+	DropLockIntent(path, agentID string) (bool, error)
+
+	// ListLockIntents returns the unexpired intents in queue order.
+	ListLockIntents() ([]model.LockIntent, error)
+
+	// ListLockRequests returns lock_req events recorded since a time.
+	ListLockRequests(since time.Time) ([]model.Event, error)
+
 	// --- Frontier ---
 
-	// GetActivePointstamps returns pointstamps for active agents.
-	GetActivePointstamps() ([]model.Pointstamp, error)
+	// GetActivePointstamps returns pointstamps for agents seen within
+	// window, or within the store's active window if window <= 0.
+	GetActivePointstamps(window time.Duration) ([]model.Pointstamp, error)
+
+	// --- Workflow ---
+
+	// SetWorkflow records the active workflow definition.
+	SetWorkflow(body, appliedBy string) error
+
+	// GetWorkflow returns the active workflow definition ("" if none).
+	GetWorkflow() (string, error)
+
+	// --- Sagas ---
+
+	// BeginSaga opens a new saga owned by agentID.
+	BeginSaga(id, agentID, name string) (*model.Saga, error)
+
+	// AddSagaStep appends a step to an open saga.
+	AddSagaStep(sagaID string, step model.SagaStep) (*model.SagaStep, error)
+
+	// FinishSaga commits or aborts an open saga.
+	FinishSaga(sagaID string, status model.SagaStatus) (*model.Saga, error)
+
+	// GetSaga returns a saga with its steps.
+	GetSaga(id string) (*model.Saga, error)
+
+	// ListSagas returns sagas, optionally only open ones.
+	ListSagas(openOnly bool) ([]model.Saga, error)
+
+	// --- Votes ---
+
+	// OpenVote records a new vote.
+	OpenVote(v *model.Vote) error
+
+	// CastBallot records an agent's one ballot in a vote.
+	CastBallot(voteID string, b model.Ballot) (*model.Vote, error)
+
+	// GetVote returns a vote with its ballots in total order.
+	GetVote(id string) (*model.Vote, error)
+
+	// --- Key-value scratchpad ---
+
+	// SetKV writes a key unless a later write (in Lamport order) holds it.
+	SetKV(e model.KVEntry) (*model.KVEntry, bool, error)
+
+	// GetKV returns a key's current entry.
+	GetKV(key string) (*model.KVEntry, error)
+
+	// ListKV returns every key's current entry ordered by key.
+	ListKV() ([]model.KVEntry, error)
+
+	// --- CRDTs ---
+
+	// IncrCounter adds delta to agentID's slot of a grow-only counter.
+	IncrCounter(name, agentID string, delta int64) (*model.GCounter, error)
+
+	// AddToSet adds elements to a grow-only set.
+	AddToSet(name, agentID string, lamportTS int64, elems []string) (*model.GSet, int, error)
+
+	// GetCounter returns a grow-only counter with its slots.
+	GetCounter(name string) (*model.GCounter, error)
+
+	// GetSet returns a grow-only set.
+	GetSet(name string) (*model.GSet, error)
+
+	// ListCRDTs returns every counter and set ordered by name.
+	ListCRDTs() ([]model.GCounter, []model.GSet, error)
+
+	// --- Capabilities ---
+
+	// SetCapabilities replaces the capabilities an agent advertises.
+	SetCapabilities(agentID string, caps []string) error
+	// AgentsWithCapability returns the agents advertising a capability.
+	AgentsWithCapability(capability string) ([]string, error)
+
+	// --- Roles ---
+
+	// SetRoles replaces the roles an agent holds.
+	SetRoles(agentID string, roles []string) error
+	// AgentsWithRole returns the agents holding a role.
+	AgentsWithRole(role string) ([]string, error)
+
+	// --- Permalinks ---
+
+	// ResolvePermalink returns the event a permalink refers to, including
+	// events removed by CompactEvents.
+	ResolvePermalink(link string) (*model.Event, error)
+
+	// --- Sync ---
+
+	// SyncAtomic records a heartbeat and receives pending messages in
+	// one transaction.
+	SyncAtomic(agentID string, epoch, round int64, limit int, prov model.Provenance) (*SyncResult, error)
+
+	// --- Deliveries ---
+
+	// RecordDeliveries notes that agentID drained events at clock.
+	RecordDeliveries(agentID string, clock int64, events []model.Event) error
+
+	// ListDeliveries returns deliveries made at or after since.
+	ListDeliveries(since time.Time) ([]model.Delivery, error)
+
+	// QueryDeliveries returns deliveries of events matching a query.
+	QueryDeliveries(q *query.Query, since time.Time) ([]model.Delivery, error)
+
+	// --- Dead letters ---
+
+	// AddDeadLetter parks a message that had no live recipient.
+	AddDeadLetter(d *DeadLetter) (int64, error)
+	// ListDeadLetters returns pending dead letters, or all of them.
+	ListDeadLetters(all bool) ([]DeadLetter, error)
+	// GetDeadLetter returns one dead letter.
+	GetDeadLetter(id int64) (*DeadLetter, error)
+	// RedeliverDeadLetter logs e and marks the dead letter redelivered.
+	RedeliverDeadLetter(id int64, e *model.Event) (int64, error)
+	// CountDeadLetters returns how many dead letters are pending.
+	CountDeadLetters() (int, error)
+
+	// --- Idempotency keys ---
+
+	// SendKey returns the send an agent made with an idempotency key.
+	SendKey(agentID, key string) (*SendKey, error)
+
+	// --- Handoffs ---
+
+	// StartHandoff releases or reserves the sender's locks and logs the
+	// handoff message, atomically.
+	StartHandoff(h *Handoff, msg *model.Event, compose func(id int64) string, reserve bool, ttl time.Duration) error
+	// AcceptHandoff marks a handoff accepted by its recipient.
+	AcceptHandoff(id int64, agentID string) (*Handoff, error)
+	// GetHandoff returns one handoff.
+	GetHandoff(id int64) (*Handoff, error)
+	// ListHandoffs returns handoffs involving an agent, or everyone's.
+	ListHandoffs(agentID string, pending bool) ([]Handoff, error)
 }
 
 // Compile-time check that *Store implements StoreInterface.
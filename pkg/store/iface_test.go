@@ -63,6 +63,52 @@ func TestStoreImplementsInterface(t *testing.T) {
 	if cur != 42 {
 		t.Errorf("expected cursor 42, got %d", cur)
 	}
+	if err := iface.SetSenderCursor("test-agent", "other", 50); err != nil {
+		t.Fatalf("SetSenderCursor: %v", err)
+	}
+	if sc, err := iface.SenderCursors("test-agent"); err != nil || sc["other"] != 50 {
+		t.Errorf("SenderCursors = %v, %v", sc, err)
+	}
+	if _, err := iface.ListUnread("test-agent", "", 10); err != nil {
+		t.Fatalf("ListUnread: %v", err)
+	}
+
+	// Public keys
+	if err := iface.SetPublicKey("test-agent", "key"); err != nil {
+		t.Fatalf("SetPublicKey: %v", err)
+	}
+	if k, err := iface.PublicKey("test-agent"); err != nil || k != "key" {
+		t.Errorf("PublicKey = %q, %v", k, err)
+	}
+
+	// Signing keys
+	if k, err := iface.RegisterSigningKey("test-agent", "sigkey"); err != nil || k != "sigkey" {
+		t.Errorf("RegisterSigningKey = %q, %v", k, err)
+	}
+	if k, err := iface.SigningKey("test-agent"); err != nil || k != "sigkey" {
+		t.Errorf("SigningKey = %q, %v", k, err)
+	}
+	if err := iface.SetStrictSignatures(false); err != nil {
+		t.Fatalf("SetStrictSignatures: %v", err)
+	}
+	if on, err := iface.StrictSignatures(); err != nil || on {
+		t.Errorf("StrictSignatures = %v, %v", on, err)
+	}
+	if err := iface.VerifyEvent(model.Event{AgentID: "test-agent"}); err != ErrUnsigned {
+		t.Errorf("VerifyEvent(unsigned) = %v", err)
+	}
+	if r, err := iface.VerifyChain(); err != nil || !r.OK() {
+		t.Errorf("VerifyChain = %+v, %v", r, err)
+	}
+
+	// Attachments
+	att, err := iface.PutAttachment("big body", "test-agent")
+	if err != nil {
+		t.Fatalf("PutAttachment: %v", err)
+	}
+	if got, err := iface.GetAttachment(att.ID); err != nil || got.Body != "big body" {
+		t.Errorf("GetAttachment = %+v, %v", got, err)
+	}
 
 	// Events
 	e := &model.Event{
@@ -89,6 +135,25 @@ func TestStoreImplementsInterface(t *testing.T) {
 		t.Errorf("expected 1 event, got %d", len(events))
 	}
 
+	if events, err := iface.QueryEvents(nil, 0, 10); err != nil || len(events) != 1 {
+		t.Fatalf("QueryEvents: %v, %v", events, err)
+	}
+	if events, err := iface.QueryEventsSinceID(nil, 0, 10); err != nil || len(events) != 1 {
+		t.Fatalf("QueryEventsSinceID: %v, %v", events, err)
+	}
+	if counts, err := iface.CountEventsByKind(); err != nil || len(counts) != 1 {
+		t.Fatalf("CountEventsByKind: %v, %v", counts, err)
+	}
+	if _, err := iface.CountUnread(); err != nil {
+		t.Fatalf("CountUnread: %v", err)
+	}
+	if _, err := iface.CountDeniedLocks(); err != nil {
+		t.Fatalf("CountDeniedLocks: %v", err)
+	}
+	if last, err := iface.LastEventAt(); err != nil || len(last) != 1 {
+		t.Fatalf("LastEventAt: %v, %v", last, err)
+	}
+
 	events2, err := iface.ListEventsSinceID(0, 10)
 	if err != nil {
 		t.Fatalf("ListEventsSinceID: %v", err)
@@ -115,6 +180,182 @@ func TestStoreImplementsInterface(t *testing.T) {
 		t.Errorf("expected 1 agent event, got %d", len(agentEvents))
 	}
 
+	kindEvents, err := iface.ListEventsByKind([]model.EventKind{model.EventMsg}, 0, 10)
+	if err != nil {
+		t.Fatalf("ListEventsByKind: %v", err)
+	}
+	if len(kindEvents) != 1 {
+		t.Errorf("expected 1 msg event, got %d", len(kindEvents))
+	}
+
+	if res, err := iface.CompactEvents(CompactOptions{DryRun: true}); err != nil || res == nil {
+		t.Fatalf("CompactEvents: %v", err)
+	}
+
+	if _, err := iface.ImportEvents(nil, true); err != nil {
+		t.Fatalf("ImportEvents: %v", err)
+	}
+
+	// Sagas
+	if _, err := iface.BeginSaga("s-1", "test-agent", "x"); err != nil {
+		t.Fatalf("BeginSaga: %v", err)
+	}
+	if _, err := iface.AddSagaStep("s-1", model.SagaStep{AgentID: "test-agent", Action: "a"}); err != nil {
+		t.Fatalf("AddSagaStep: %v", err)
+	}
+	if _, err := iface.GetSaga("s-1"); err != nil {
+		t.Fatalf("GetSaga: %v", err)
+	}
+	if sagas, err := iface.ListSagas(true); err != nil || len(sagas) != 1 {
+		t.Fatalf("ListSagas: %v (%d)", err, len(sagas))
+	}
+	if _, err := iface.FinishSaga("s-1", model.SagaCommitted); err != nil {
+		t.Fatalf("FinishSaga: %v", err)
+	}
+
+	// Votes
+	if err := iface.OpenVote(&model.Vote{ID: "v-1", AgentID: "test-agent", Question: "q", Options: []string{"yes", "no"}, Quorum: 1}); err != nil {
+		t.Fatalf("OpenVote: %v", err)
+	}
+	if _, err := iface.CastBallot("v-1", model.Ballot{AgentID: "test-agent", Choice: "yes", LamportTS: 1}); err != nil {
+		t.Fatalf("CastBallot: %v", err)
+	}
+	if v, err := iface.GetVote("v-1"); err != nil || len(v.Ballots) != 1 {
+		t.Fatalf("GetVote: %v", err)
+	}
+
+	// Key-value scratchpad
+	if _, applied, err := iface.SetKV(model.KVEntry{Key: "k", Value: "v", AgentID: "test-agent", LamportTS: 1}); err != nil || !applied {
+		t.Fatalf("SetKV: %v (applied %v)", err, applied)
+	}
+	if e, err := iface.GetKV("k"); err != nil || e.Value != "v" {
+		t.Fatalf("GetKV: %v", err)
+	}
+	if entries, err := iface.ListKV(); err != nil || len(entries) != 1 {
+		t.Fatalf("ListKV: %v (%d)", err, len(entries))
+	}
+
+	// CRDTs
+	if c, err := iface.IncrCounter("c", "test-agent", 2); err != nil || c.Value != 2 {
+		t.Fatalf("IncrCounter: %v", err)
+	}
+	if _, added, err := iface.AddToSet("s", "test-agent", 1, []string{"x"}); err != nil || added != 1 {
+		t.Fatalf("AddToSet: %v (added %d)", err, added)
+	}
+	if _, err := iface.GetCounter("c"); err != nil {
+		t.Fatalf("GetCounter: %v", err)
+	}
+	if _, err := iface.GetSet("s"); err != nil {
+		t.Fatalf("GetSet: %v", err)
+	}
+	if counters, sets, err := iface.ListCRDTs(); err != nil || len(counters) != 1 || len(sets) != 1 {
+		t.Fatalf("ListCRDTs: %v (%d, %d)", err, len(counters), len(sets))
+	}
+
+	// Reviews
+	if _, err := iface.ListReviews(""); err != nil {
+		t.Fatalf("ListReviews: %v", err)
+	}
+	if _, err := iface.PendingReviews("test-agent"); err != nil {
+		t.Fatalf("PendingReviews: %v", err)
+	}
+	if _, err := iface.ReviewEvents("test-agent"); err != nil {
+		t.Fatalf("ReviewEvents: %v", err)
+	}
+
+	// Epochs
+	if _, err := iface.OpenEpoch(4, "feature X", "test-agent"); err != nil {
+		t.Fatalf("OpenEpoch: %v", err)
+	}
+	if _, err := iface.GetEpoch(4); err != nil {
+		t.Fatalf("GetEpoch: %v", err)
+	}
+	if _, err := iface.CloseEpoch(4, "test-agent"); err != nil {
+		t.Fatalf("CloseEpoch: %v", err)
+	}
+	if epochs, err := iface.ListEpochs(false); err != nil || len(epochs) != 1 {
+		t.Fatalf("ListEpochs: %v (%d)", err, len(epochs))
+	}
+
+	// Deferred messages
+	msgID, _ := iface.InsertEvent(&model.Event{AgentID: "other", LamportTS: 90, Kind: model.EventMsg, Target: "test-agent", CreatedAt: time.Now().UTC()})
+	if err := iface.DeferMessages("test-agent", []int64{msgID}, time.Time{}); err != nil {
+		t.Fatalf("DeferMessages: %v", err)
+	}
+	if ds, err := iface.ListDeferred("test-agent"); err != nil || len(ds) != 1 {
+		t.Fatalf("ListDeferred: %v (%d)", err, len(ds))
+	}
+	if err := iface.ClearDeferred("test-agent", []int64{msgID}); err != nil {
+		t.Fatalf("ClearDeferred: %v", err)
+	}
+
+	// Work in progress
+	if _, err := iface.SetWIP("test-agent", "refactoring", []string{"a.go"}, 1); err != nil {
+		t.Fatalf("SetWIP: %v", err)
+	}
+	if _, err := iface.GetWIP("test-agent"); err != nil {
+		t.Fatalf("GetWIP: %v", err)
+	}
+	if ws, err := iface.ListWIP(); err != nil || len(ws) != 1 {
+		t.Fatalf("ListWIP: %v (%d)", err, len(ws))
+	}
+	if ok, err := iface.ClearWIP("test-agent"); err != nil || !ok {
+		t.Fatalf("ClearWIP: %v, %v", ok, err)
+	}
+
+	// Frontier history
+	if _, _, err := iface.RecordFrontier(); err != nil {
+		t.Fatalf("RecordFrontier: %v", err)
+	}
+	if snaps, err := iface.ListFrontierHistory(time.Time{}, 10); err != nil || len(snaps) != 1 {
+		t.Fatalf("ListFrontierHistory: %v (%d)", err, len(snaps))
+	}
+
+	// Deliveries
+	if err := iface.RecordDeliveries("test-agent", 1, nil); err != nil {
+		t.Fatalf("RecordDeliveries: %v", err)
+	}
+	if _, err := iface.ListDeliveries(time.Time{}); err != nil {
+		t.Fatalf("ListDeliveries: %v", err)
+	}
+	if _, err := iface.QueryDeliveries(nil, time.Time{}); err != nil {
+		t.Fatalf("QueryDeliveries: %v", err)
+	}
+
+	// Capabilities
+	if err := iface.SetCapabilities("test-agent", []string{"go"}); err != nil {
+		t.Fatalf("SetCapabilities: %v", err)
+	}
+	if ids, err := iface.AgentsWithCapability("go"); err != nil || len(ids) != 1 {
+		t.Fatalf("AgentsWithCapability: %v (%v)", err, ids)
+	}
+
+	// Roles
+	if err := iface.SetRoles("test-agent", []string{"tester"}); err != nil {
+		t.Fatalf("SetRoles: %v", err)
+	}
+	if ids, err := iface.AgentsWithRole("tester"); err != nil || len(ids) != 1 {
+		t.Fatalf("AgentsWithRole: %v (%v)", err, ids)
+	}
+
+	// Permalinks
+	if _, err := iface.ResolvePermalink("0000000000000000"); err == nil {
+		t.Fatal("ResolvePermalink: expected error for unknown link")
+	}
+
+	// Sync
+	if _, err := iface.SyncAtomic("test-agent", 0, 0, 10, model.Provenance{}); err != nil {
+		t.Fatalf("SyncAtomic: %v", err)
+	}
+
+	// Sub-agents
+	if child, err := iface.SpawnAgent("test-child", "test-agent", 1, Lifecycle{}); err != nil || child.ParentID != "test-agent" {
+		t.Fatalf("SpawnAgent: %+v, %v", child, err)
+	}
+	if _, err := iface.DepartAgent("test-child"); err != nil {
+		t.Fatalf("DepartAgent(test-child): %v", err)
+	}
+
 	// Locks
 	lock, conflict, err := iface.AcquireLock("test.go", "test-agent", 1, 0, true, time.Hour)
 	if err != nil {
@@ -127,6 +368,10 @@ func TestStoreImplementsInterface(t *testing.T) {
 		t.Errorf("expected lock path 'test.go', got %q", lock.Path)
 	}
 
+	if _, err := iface.RenewLock("test.go", "test-agent", 2*time.Hour); err != nil {
+		t.Fatalf("RenewLock: %v", err)
+	}
+
 	locks, err := iface.ListLocks()
 	if err != nil {
 		t.Fatalf("ListLocks: %v", err)
@@ -143,16 +388,129 @@ func TestStoreImplementsInterface(t *testing.T) {
 		t.Errorf("expected 1 agent lock, got %d", len(agentLocks))
 	}
 
+	if got, conflict, err := iface.AcquireLocks([]string{"test.go", "other.go"}, "test-agent", 6, 0, true, time.Hour); err != nil || conflict != nil || len(got) != 2 {
+		t.Fatalf("AcquireLocks = %+v, %+v, %v", got, conflict, err)
+	}
+	if err := iface.ReleaseLock("other.go", "test-agent"); err != nil {
+		t.Fatalf("ReleaseLock: %v", err)
+	}
+
+	if on, err := iface.LocksOnPath("test.go"); err != nil || len(on) != 1 {
+		t.Fatalf("LocksOnPath = %d, %v", len(on), err)
+	}
+
+	if _, err := iface.ListLockRequests(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("ListLockRequests: %v", err)
+	}
+
 	if err := iface.ReleaseLock("test.go", "test-agent"); err != nil {
 		t.Fatalf("ReleaseLock: %v", err)
 	}
 
 	// Frontier
-	ps, err := iface.GetActivePointstamps()
+	ps, err := iface.GetActivePointstamps(0)
 	if err != nil {
 		t.Fatalf("GetActivePointstamps: %v", err)
 	}
 	if len(ps) != 1 {
 		t.Errorf("expected 1 pointstamp, got %d", len(ps))
 	}
+
+	// Workflow
+	if err := iface.SetWorkflow(`{"version":1}`, "test-agent"); err != nil {
+		t.Fatalf("SetWorkflow: %v", err)
+	}
+	if body, err := iface.GetWorkflow(); err != nil || body != `{"version":1}` {
+		t.Errorf("GetWorkflow: got %q, err=%v", body, err)
+	}
+
+	// Departure
+	if _, err := iface.DepartAgent("test-agent"); err != nil {
+		t.Fatalf("DepartAgent: %v", err)
+	}
+
+	dl := &DeadLetter{From: "iface-agent", To: "nobody", Body: "hi", Reason: "not registered", CreatedAt: time.Now()}
+	if _, err := iface.AddDeadLetter(dl); err != nil {
+		t.Fatalf("AddDeadLetter: %v", err)
+	}
+	if _, err := iface.GetDeadLetter(dl.ID); err != nil {
+		t.Fatalf("GetDeadLetter: %v", err)
+	}
+	if _, err := iface.RedeliverDeadLetter(dl.ID, &model.Event{AgentID: "iface-agent", Kind: model.EventMsg, Target: "iface-agent", Body: "hi", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("RedeliverDeadLetter: %v", err)
+	}
+	if n, err := iface.CountDeadLetters(); err != nil || n != 0 {
+		t.Fatalf("CountDeadLetters = %d, %v", n, err)
+	}
+	if all, err := iface.ListDeadLetters(true); err != nil || len(all) != 1 {
+		t.Fatalf("ListDeadLetters(all) = %d, %v", len(all), err)
+	}
+
+	ho := &Handoff{From: "iface-agent", To: "test-agent", Files: []string{"x.go"}, CreatedAt: time.Now()}
+	hmsg := &model.Event{AgentID: "iface-agent", Kind: model.EventMsg, Target: "test-agent", CreatedAt: time.Now()}
+	if err := iface.StartHandoff(ho, hmsg, func(int64) string { return "handoff" }, false, time.Hour); err != nil {
+		t.Fatalf("StartHandoff: %v", err)
+	}
+	if _, err := iface.AcceptHandoff(ho.ID, "test-agent"); err != nil {
+		t.Fatalf("AcceptHandoff: %v", err)
+	}
+	if _, err := iface.GetHandoff(ho.ID); err != nil {
+		t.Fatalf("GetHandoff: %v", err)
+	}
+	if hs, err := iface.ListHandoffs("", false); err != nil || len(hs) != 1 {
+		t.Fatalf("ListHandoffs = %d, %v", len(hs), err)
+	}
+
+	if o, held, err := iface.ClaimOwnership("pkg/x", "iface-agent", "", false); err != nil || o == nil || held != nil {
+		t.Fatalf("ClaimOwnership = %+v, %+v, %v", o, held, err)
+	}
+	if claims, err := iface.ListOwnership(); err != nil || len(claims) != 1 {
+		t.Fatalf("ListOwnership = %d, %v", len(claims), err)
+	}
+	if ok, err := iface.ReleaseOwnership("pkg/x", "iface-agent"); err != nil || !ok {
+		t.Fatalf("ReleaseOwnership = %v, %v", ok, err)
+	}
+
+	if _, err := iface.QueueLockIntent("queued.go", "iface-agent", 1, time.Hour); err != nil {
+		t.Fatalf("QueueLockIntent: %v", err)
+	}
+	if intents, err := iface.ListLockIntents(); err != nil || len(intents) != 1 {
+		t.Fatalf("ListLockIntents = %d, %v", len(intents), err)
+	}
+	if ok, err := iface.DropLockIntent("queued.go", "iface-agent"); err != nil || !ok {
+		t.Fatalf("DropLockIntent = %v, %v", ok, err)
+	}
+
+	if err := iface.WithTx(func(tx TxStore) error {
+		return tx.UpdateAgentClock("test-agent", 99, 0, 0)
+	}); err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if ts, err := iface.TickAgent("test-agent"); err != nil || ts != 100 {
+		t.Fatalf("TickAgent = %d, %v", ts, err)
+	}
+	if ts, err := iface.ReceiveAgent("test-agent", 200); err != nil || ts != 201 {
+		t.Fatalf("ReceiveAgent = %d, %v", ts, err)
+	}
+	if err := iface.SetAgentPosition("test-agent", 1, 2); err != nil {
+		t.Fatalf("SetAgentPosition: %v", err)
+	}
+	if err := iface.SetAgentAt("test-agent", model.Timestamp{Epoch: 1, Round: 2, Steps: []int64{3}}); err != nil {
+		t.Fatalf("SetAgentAt: %v", err)
+	}
+	if err := iface.SetAgentScope("test-agent", "pkg/store"); err != nil {
+		t.Fatalf("SetAgentScope: %v", err)
+	}
+	if _, err := iface.StartSession("test-agent"); err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+	if err := iface.EndSession("test-agent"); err != nil {
+		t.Fatalf("EndSession: %v", err)
+	}
+	if k, err := iface.SendKey("test-agent", "none"); err == nil {
+		t.Fatalf("SendKey = %+v for an unused key", k)
+	}
+	if ids, err := iface.InsertEvents(nil); err != nil || len(ids) != 0 {
+		t.Fatalf("InsertEvents(nil) = %v, %v", ids, err)
+	}
 }
@@ -0,0 +1,181 @@
+// import.go replays exported events into a store.
+//
+// Exported logs (cm export, cm gc --archive) are streams of model.Event.
+// Replaying them must leave the store in a state where Lamport's rules
+// still hold: every agent's clock is at least the highest timestamp it
+// ever emitted, so its next event sorts after its imported history.
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// ImportResult reports the outcome of ImportEvents.
+type ImportResult struct {
+	Imported      int      `json:"imported"`
+	Duplicates    int      `json:"duplicates"`
+	AgentsCreated []string `json:"agents_created,omitempty"`
+}
+
+// importedMsg is an imported inbox event and its new row ID.
+type importedMsg struct {
+	id    int64
+	event *model.Event
+}
+
+// inboxKinds are the event kinds delivered through ListEventsForAgent.
+var inboxKinds = map[model.EventKind]bool{
+	model.EventMsg:        true,
+	model.EventReviewReq:  true,
+	model.EventReviewDone: true,
+}
+
+// ImportEvents appends events to the log in a single transaction. Row IDs
+// are reassigned; everything else is preserved. Events already present
+// (same agent, timestamp, kind, target, and creation time) are skipped,
+// so importing the same file twice is harmless.
+//
+// Agents that do not exist yet are created, positioned at their latest
+// imported progress event and marked last seen at their latest imported
+// event. Every sender's clock is raised to its highest imported timestamp.
+// If markDelivered is set, the imported messages are recorded as delivered
+// so that history is not redelivered as new mail. Recipients' recv cursors
+// are left alone: mail already waiting for them stays unread.
+func (s *Store) ImportEvents(events []model.Event, markDelivered bool) (*ImportResult, error) {
+	type agentSummary struct {
+		maxTS    int64
+		lastSeen time.Time
+		progress *model.Event
+	}
+	senders := make(map[string]*agentSummary)
+	var order []string // deterministic agent creation order
+	var inbox []importedMsg
+	res := &ImportResult{}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+	if err := s.authorize(tx, "import"); err != nil {
+		return nil, err
+	}
+
+	for i := range events {
+		e := &events[i]
+		if e.AgentID == "" || e.Kind == "" {
+			return nil, fmt.Errorf("event %d: agent_id and kind are required", i+1)
+		}
+		created := e.CreatedAt.UTC().Format(time.RFC3339Nano)
+
+		var exists int
+		err := tx.QueryRow(
+			`SELECT COUNT(*) FROM events
+			 WHERE agent_id = ? AND lamport_ts = ? AND kind = ? AND COALESCE(target,'') = ? AND created_at = ?`,
+			e.AgentID, e.LamportTS, string(e.Kind), e.Target, created,
+		).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", i+1, err)
+		}
+		if exists > 0 {
+			res.Duplicates++
+			continue
+		}
+		if err := checkStrict(tx, e); err != nil {
+			return nil, fmt.Errorf("event %d: %w", i+1, err)
+		}
+		id, err := s.db.dialect.insertEvent(tx, e)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", i+1, err)
+		}
+		// Keep the permalink the event had in its source database so
+		// references to it in imported message bodies still resolve.
+		if e.Permalink != "" {
+			if err := insertPermalink(tx, e.Permalink, id); err != nil {
+				return nil, fmt.Errorf("event %d: permalink: %w", i+1, err)
+			}
+		}
+		res.Imported++
+
+		sum, ok := senders[e.AgentID]
+		if !ok {
+			sum = &agentSummary{}
+			senders[e.AgentID] = sum
+			order = append(order, e.AgentID)
+		}
+		if e.LamportTS > sum.maxTS {
+			sum.maxTS = e.LamportTS
+		}
+		if e.CreatedAt.After(sum.lastSeen) {
+			sum.lastSeen = e.CreatedAt
+		}
+		if e.Kind == model.EventProgress && (sum.progress == nil || e.LamportTS >= sum.progress.LamportTS) {
+			sum.progress = e
+		}
+		if inboxKinds[e.Kind] && e.Target != "" {
+			if _, ok := senders[e.Target]; !ok {
+				senders[e.Target] = &agentSummary{lastSeen: e.CreatedAt}
+				order = append(order, e.Target)
+			}
+			inbox = append(inbox, importedMsg{id: id, event: e})
+		}
+	}
+
+	for _, id := range order {
+		sum := senders[id]
+		var epoch, round int64
+		if sum.progress != nil {
+			epoch, round = sum.progress.Epoch, sum.progress.Round
+		}
+		seen := sum.lastSeen.UTC().Format(time.RFC3339Nano)
+		r, err := tx.Exec(
+			`INSERT INTO agents (id, clock, epoch, round, registered, last_seen)
+			 VALUES (?, ?, ?, ?, ?, ?)
+			 ON CONFLICT(id) DO NOTHING`,
+			id, sum.maxTS, epoch, round, seen, seen,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("agent %s: %w", id, err)
+		}
+		if n, _ := r.RowsAffected(); n > 0 {
+			res.AgentsCreated = append(res.AgentsCreated, id)
+			continue
+		}
+		if _, err := tx.Exec(
+			`UPDATE agents SET clock = CASE WHEN clock < ? THEN ? ELSE clock END WHERE id = ?`,
+			sum.maxTS, sum.maxTS, id,
+		); err != nil {
+			return nil, fmt.Errorf("agent %s: clock: %w", id, err)
+		}
+	}
+
+	if markDelivered {
+		// As far as anyone can tell now, history was delivered when sent.
+		for _, m := range inbox {
+			if _, err := tx.Exec(
+				`INSERT INTO deliveries (event_id, agent_id, clock, delivered_at) VALUES (?, ?, ?, ?)
+				 ON CONFLICT(event_id) DO NOTHING`,
+				m.id, m.event.Target, m.event.LamportTS, m.event.CreatedAt.UTC().Format(time.RFC3339Nano),
+			); err != nil {
+				return nil, fmt.Errorf("deliver to %s: %w", m.event.Target, err)
+			}
+		}
+	}
+
+	if res.Imported > 0 {
+		detail := fmt.Sprintf("imported %d events (%d duplicates)", res.Imported, res.Duplicates)
+		if err := s.logPrivileged(tx, "import", detail); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit import: %w", err)
+	}
+	if res.Imported > 0 {
+		s.bump()
+	}
+	return res, nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func importFixture() []model.Event {
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	return []model.Event{
+		{AgentID: "alice", LamportTS: 1, Epoch: 1, Kind: model.EventProgress, CreatedAt: t0},
+		{AgentID: "alice", LamportTS: 4, Epoch: 1, Kind: model.EventMsg, Target: "bob", Body: "hi", CreatedAt: t0.Add(time.Minute)},
+		{AgentID: "bob", LamportTS: 6, Epoch: 2, Round: 1, Kind: model.EventProgress, CreatedAt: t0.Add(2 * time.Minute)},
+		{AgentID: "alice", LamportTS: 9, Epoch: 1, Kind: model.EventLockReq, Target: "a.go", CreatedAt: t0.Add(3 * time.Minute)},
+	}
+}
+
+func TestImportEvents_CreatesAgentsAndClocks(t *testing.T) {
+	s := newTestStore(t)
+	res, err := s.ImportEvents(importFixture(), true)
+	if err != nil {
+		t.Fatalf("ImportEvents: %v", err)
+	}
+	if res.Imported != 4 || res.Duplicates != 0 || len(res.AgentsCreated) != 2 {
+		t.Fatalf("result = %+v, want 4 imported, 2 agents created", res)
+	}
+
+	alice, err := s.GetAgent("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Clock != 9 || alice.Epoch != 1 {
+		t.Errorf("alice clock/epoch = %d/%d, want 9/1", alice.Clock, alice.Epoch)
+	}
+	if !alice.LastSeen.Equal(importFixture()[3].CreatedAt) {
+		t.Errorf("alice last_seen = %v, want latest imported event time", alice.LastSeen)
+	}
+	bob, _ := s.GetAgent("bob")
+	if bob.Clock != 6 || bob.Epoch != 2 || bob.Round != 1 {
+		t.Errorf("bob clock/epoch/round = %d/%d/%d, want 6/2/1", bob.Clock, bob.Epoch, bob.Round)
+	}
+	if _, err := s.GetAgent("a.go"); err == nil {
+		t.Error("lock targets are paths and must not become agents")
+	}
+}
+
+func TestImportEvents_MarkDelivered(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.ImportEvents(importFixture(), true); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, _ := s.ListUnread("bob", "", 10); len(msgs) != 0 {
+		t.Fatalf("imported history should be delivered, got %d pending", len(msgs))
+	}
+
+	s2 := newTestStore(t)
+	if _, err := s2.ImportEvents(importFixture(), false); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, _ := s2.ListUnread("bob", "", 10); len(msgs) != 1 {
+		t.Fatalf("unread import should leave 1 pending message, got %d", len(msgs))
+	}
+}
+
+func TestImportEvents_KeepsWaitingMail(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("bob")
+	s.RegisterAgent("zed")
+	s.InsertEvent(&model.Event{AgentID: "zed", LamportTS: 1, Kind: model.EventMsg, Target: "bob",
+		Body: "fresh unread", CreatedAt: time.Now().UTC()})
+
+	if _, err := s.ImportEvents(importFixture(), true); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := s.ListUnread("bob", "", 10)
+	if len(msgs) != 1 || msgs[0].Body != "fresh unread" {
+		t.Fatalf("bob's inbox after import = %+v, want the waiting message alone", msgs)
+	}
+	if c := s.GetCursor("bob"); c != 0 {
+		t.Errorf("import moved bob's cursor to %d", c)
+	}
+}
+
+func TestImportEvents_Idempotent(t *testing.T) {
+	s := newTestStore(t)
+	s.ImportEvents(importFixture(), true)
+	res, err := s.ImportEvents(importFixture(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 0 || res.Duplicates != 4 {
+		t.Fatalf("second import = %+v, want all duplicates", res)
+	}
+	if c := s.CountEvents(); c != 4 {
+		t.Fatalf("CountEvents = %d, want 4", c)
+	}
+}
+
+func TestImportEvents_NeverLowersClock(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.UpdateAgentClock("alice", 50, 3, 0)
+	if _, err := s.ImportEvents(importFixture(), true); err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := s.GetAgent("alice")
+	if alice.Clock != 50 || alice.Epoch != 3 {
+		t.Fatalf("existing agent clock/epoch = %d/%d, want 50/3 unchanged", alice.Clock, alice.Epoch)
+	}
+}
+
+func TestImportEvents_RejectsIncompleteEvent(t *testing.T) {
+	s := newTestStore(t)
+	_, err := s.ImportEvents([]model.Event{{AgentID: "alice"}}, true)
+	if err == nil {
+		t.Fatal("event without kind should be rejected")
+	}
+	if c := s.CountEvents(); c != 0 {
+		t.Fatalf("failed import must not leave events behind, got %d", c)
+	}
+}
@@ -0,0 +1,25 @@
+package store
+
+import "time"
+
+// SetPublicKey registers pubkey as the key messages to agentID are sealed
+// with (see package seal), replacing any earlier one. The store does not
+// check the key; callers validate it.
+func (s *Store) SetPublicKey(agentID, pubkey string) error {
+	return retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO agent_keys (agent_id, pubkey, updated_at) VALUES (?, ?, ?)
+			 ON CONFLICT(agent_id) DO UPDATE SET pubkey = excluded.pubkey, updated_at = excluded.updated_at`,
+			agentID, pubkey, time.Now().UTC().Format(time.RFC3339Nano),
+		)
+		return err
+	})
+}
+
+// PublicKey returns agentID's registered public key, or sql.ErrNoRows if
+// it has none.
+func (s *Store) PublicKey(agentID string) (string, error) {
+	var k string
+	err := s.db.QueryRow(`SELECT pubkey FROM agent_keys WHERE agent_id = ?`, agentID).Scan(&k)
+	return k, err
+}
@@ -0,0 +1,18 @@
+package store
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestPublicKeys(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.PublicKey("alice"); err != sql.ErrNoRows {
+		t.Fatalf("PublicKey before registering: err = %v", err)
+	}
+	s.SetPublicKey("alice", "k1")
+	s.SetPublicKey("alice", "k2") // rotation replaces
+	if k, err := s.PublicKey("alice"); err != nil || k != "k2" {
+		t.Fatalf("PublicKey = %q, %v", k, err)
+	}
+}
@@ -0,0 +1,80 @@
+// kv.go persists the shared key-value scratchpad: small facts agents
+// publish for each other, resolved last-writer-wins in Lamport order.
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// SetKV writes e unless the key holds a write that is later in Lamport
+// order (higher timestamp, or the same timestamp and a higher agent ID),
+// and returns the key's entry afterwards. applied reports whether e won;
+// if not, the returned entry is the write that beat it.
+func (s *Store) SetKV(e model.KVEntry) (cur *model.KVEntry, applied bool, err error) {
+	if e.UpdatedAt.IsZero() {
+		e.UpdatedAt = time.Now().UTC()
+	}
+	err = retryOnContention(func() error {
+		res, err := s.db.Exec(
+			`INSERT INTO kv (key, value, agent_id, lamport_ts, updated_at) VALUES (?, ?, ?, ?, ?)
+			 ON CONFLICT(key) DO UPDATE SET value = excluded.value, agent_id = excluded.agent_id,
+			   lamport_ts = excluded.lamport_ts, updated_at = excluded.updated_at
+			 WHERE kv.lamport_ts < excluded.lamport_ts
+			    OR (kv.lamport_ts = excluded.lamport_ts AND kv.agent_id <= excluded.agent_id)`,
+			e.Key, e.Value, e.AgentID, e.LamportTS, e.UpdatedAt.Format(time.RFC3339Nano),
+		)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		applied = n > 0
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	cur, err = s.GetKV(e.Key)
+	return cur, applied, err
+}
+
+// GetKV returns the current entry for key, or sql.ErrNoRows if it was
+// never set.
+func (s *Store) GetKV(key string) (*model.KVEntry, error) {
+	return scanKV(s.db.QueryRow(
+		`SELECT key, value, agent_id, lamport_ts, updated_at FROM kv WHERE key = ?`, key,
+	))
+}
+
+// ListKV returns the current entry of every key, ordered by key.
+func (s *Store) ListKV() ([]model.KVEntry, error) {
+	rows, err := s.db.Query(`SELECT key, value, agent_id, lamport_ts, updated_at FROM kv ORDER BY key ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []model.KVEntry
+	for rows.Next() {
+		e, err := scanKV(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *e)
+	}
+	return out, rows.Err()
+}
+
+func scanKV(row interface{ Scan(...interface{}) error }) (*model.KVEntry, error) {
+	var e model.KVEntry
+	var updated string
+	if err := row.Scan(&e.Key, &e.Value, &e.AgentID, &e.LamportTS, &updated); err != nil {
+		return nil, err
+	}
+	var err error
+	if e.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+		return nil, fmt.Errorf("parse updated_at for key %s: %w", e.Key, err)
+	}
+	return &e, nil
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestKV_LastWriterWins(t *testing.T) {
+	s := newTestStore(t)
+	set := func(agent, value string, ts int64) (*model.KVEntry, bool) {
+		t.Helper()
+		cur, applied, err := s.SetKV(model.KVEntry{Key: "api_port", Value: value, AgentID: agent, LamportTS: ts})
+		if err != nil {
+			t.Fatalf("SetKV(%s, %s): %v", agent, value, err)
+		}
+		return cur, applied
+	}
+
+	if _, err := s.GetKV("api_port"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("unset key: err = %v, want sql.ErrNoRows", err)
+	}
+	if cur, applied := set("bob", "8080", 5); !applied || cur.Value != "8080" {
+		t.Fatalf("first write: applied %v, %+v", applied, cur)
+	}
+	// An older write arriving late loses.
+	if cur, applied := set("alice", "9090", 3); applied || cur.Value != "8080" || cur.AgentID != "bob" {
+		t.Fatalf("older write: applied %v, %+v", applied, cur)
+	}
+	// At the same timestamp the higher agent ID wins.
+	if _, applied := set("alice", "9090", 5); applied {
+		t.Fatal("alice@5 should lose to bob@5")
+	}
+	if cur, applied := set("carol", "7070", 5); !applied || cur.Value != "7070" {
+		t.Fatalf("carol@5 should beat bob@5: applied %v, %+v", applied, cur)
+	}
+	if cur, applied := set("alice", "6060", 6); !applied || cur.Value != "6060" {
+		t.Fatalf("later write: applied %v, %+v", applied, cur)
+	}
+
+	if _, _, err := s.SetKV(model.KVEntry{Key: "build_status", Value: "green", AgentID: "alice", LamportTS: 7}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.ListKV()
+	if err != nil || len(entries) != 2 || entries[0].Key != "api_port" || entries[1].Key != "build_status" {
+		t.Fatalf("ListKV = %+v, %v", entries, err)
+	}
+}
@@ -0,0 +1,50 @@
+// libsql.go opens a store on a remote libSQL server (Turso or sqld), so
+// agents on different machines can share one hosted SQLite database with
+// the same schema as a local file.
+//
+// The server runs SQLite, so the store uses the SQLite dialect unchanged.
+// What differs is latency: every statement is a network round trip, and
+// writers from every machine contend for one write lock. The driver sets
+// a generous busy timeout on each server stream and begins transactions
+// with their first statement, and the store's multi-event writes
+// (InsertEvents) already go in one transaction. There is no notify file,
+// so Watch is unavailable and the cmd layer polls.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/libsql"
+)
+
+// libsqlScheme prefixes DSNs for a remote libSQL server.
+const libsqlScheme = "libsql://"
+
+func newLibSQL(dsn string, migrate bool) (*Store, error) {
+	if _, err := libsql.ParseDSN(dsn); err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+	db, err := sql.Open("libsql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+	db.SetMaxOpenConns(defaultMaxOpenConns)
+	db.SetMaxIdleConns(2)
+	db.SetConnMaxLifetime(30 * time.Minute)
+
+	s := &Store{db: &conn{DB: db, dialect: dialectSQLite, dsn: dsn, remote: true}}
+	if !migrate {
+		return s, nil
+	}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	if err := s.db.prepareHot(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/libsql/libsqltest"
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestLibSQLStore(t *testing.T) {
+	srv, err := libsqltest.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Token = "tok"
+
+	s, err := Open(srv.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Backend() != "libsql" {
+		t.Fatalf("Backend() = %q, want libsql", s.Backend())
+	}
+	if err := s.SetPool(PoolOptions{DedicatedWriter: true}); err != nil || s.PoolStats().Writer != nil {
+		t.Fatalf("SetPool on libsql: writer %v, err %v; want none", s.PoolStats().Writer, err)
+	}
+	if _, err := s.Watch(); !errors.Is(err, ErrNoNotify) {
+		t.Fatalf("Watch on libsql = %v, want ErrNoNotify", err)
+	}
+
+	// A second machine opening the same database sees it migrated and
+	// shares its writes.
+	other, err := Open(srv.DSN())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer other.Close()
+
+	if _, err := s.RegisterAgent("alice"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, st := range []*Store{s, other} {
+		wg.Add(1)
+		go func(st *Store) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := st.TickAgent("alice"); err != nil {
+					t.Error(err)
+				}
+			}
+		}(st)
+	}
+	wg.Wait()
+	if a, err := other.GetAgent("alice"); err != nil || a.Clock != 10 {
+		t.Fatalf("alice = %+v, %v; want clock 10", a, err)
+	}
+
+	if _, err := s.InsertEvents([]*model.Event{
+		{AgentID: "alice", LamportTS: 11, Kind: model.EventMsg, Target: "bob", Body: "one", CreatedAt: time.Now().UTC()},
+		{AgentID: "alice", LamportTS: 11, Kind: model.EventMsg, Target: "carol", Body: "two", CreatedAt: time.Now().UTC()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := other.ListUnread("bob", "", 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Body != "one" {
+		t.Fatalf("bob's unread = %+v, %v", msgs, err)
+	}
+
+	lock, _, err := s.AcquireLock("a.go", "alice", 12, 0, true, time.Minute)
+	if err != nil || lock == nil {
+		t.Fatalf("AcquireLock = %v, %v", lock, err)
+	}
+	if lock, _, err := other.AcquireLock("a.go", "bob", 13, 0, true, time.Minute); err != nil || lock != nil {
+		t.Fatalf("bob took alice's lock: %v, %v", lock, err)
+	}
+}
@@ -0,0 +1,98 @@
+// lockqueue.go records agents waiting for locks held by others, so that
+// everyone can see where contention is and plan around it instead of
+// retrying blindly. Intents are advisory: the Lamport total order alone
+// still decides who gets a lock.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// QueueLockIntent records that agentID is waiting for path, as of its
+// denied request at lamportTS. The intent lapses after ttl unless queued
+// again; queueing again refreshes it but keeps the original queued_at.
+func (s *Store) QueueLockIntent(path, agentID string, lamportTS int64, ttl time.Duration) (*model.LockIntent, error) {
+	now := time.Now().UTC()
+	in := &model.LockIntent{Path: path, AgentID: agentID, LamportTS: lamportTS, QueuedAt: now, ExpiresAt: now.Add(ttl)}
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if _, err := tx.Exec(
+			`INSERT INTO lock_intents (path, agent_id, lamport_ts, queued_at, expires_at) VALUES (?, ?, ?, ?, ?)
+			 ON CONFLICT(path, agent_id) DO UPDATE SET
+			   lamport_ts = excluded.lamport_ts, expires_at = excluded.expires_at`,
+			path, agentID, lamportTS, in.QueuedAt.Format(time.RFC3339Nano), in.ExpiresAt.Format(time.RFC3339Nano),
+		); err != nil {
+			return err
+		}
+		var queued string
+		if err := tx.QueryRow(`SELECT queued_at FROM lock_intents WHERE path = ? AND agent_id = ?`, path, agentID).Scan(&queued); err != nil {
+			return err
+		}
+		if in.QueuedAt, err = time.Parse(time.RFC3339Nano, queued); err != nil {
+			return fmt.Errorf("parse queued_at for %s: %w", path, err)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// DropLockIntent removes agentID's intent on path, reporting whether it
+// had one. Acquiring the lock drops it too.
+func (s *Store) DropLockIntent(path, agentID string) (bool, error) {
+	var n int64
+	err := retryOnContention(func() error {
+		res, err := s.db.Exec(`DELETE FROM lock_intents WHERE path = ? AND agent_id = ?`, path, agentID)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return n > 0, err
+}
+
+// ListLockIntents returns the unexpired intents, by path and then in the
+// order the lock would go to the waiters: (lamport_ts, agent_id).
+func (s *Store) ListLockIntents() ([]model.LockIntent, error) {
+	rows, err := s.db.Query(
+		`SELECT path, agent_id, lamport_ts, queued_at, expires_at FROM lock_intents
+		 WHERE expires_at >= ? ORDER BY path, lamport_ts, agent_id`,
+		time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanLockIntents(rows)
+}
+
+func scanLockIntents(rows *sql.Rows) ([]model.LockIntent, error) {
+	var out []model.LockIntent
+	for rows.Next() {
+		var in model.LockIntent
+		var queued, expires string
+		if err := rows.Scan(&in.Path, &in.AgentID, &in.LamportTS, &queued, &expires); err != nil {
+			return nil, err
+		}
+		var err error
+		if in.QueuedAt, err = time.Parse(time.RFC3339Nano, queued); err != nil {
+			return nil, fmt.Errorf("parse queued_at for %s: %w", in.Path, err)
+		}
+		if in.ExpiresAt, err = time.Parse(time.RFC3339Nano, expires); err != nil {
+			return nil, fmt.Errorf("parse expires_at for %s: %w", in.Path, err)
+		}
+		out = append(out, in)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockIntents(t *testing.T) {
+	s := newTestStore(t)
+	if _, _, err := s.AcquireLock("a.go", "alice", 1, 0, true, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.QueueLockIntent("a.go", "carol", 7, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.QueueLockIntent("a.go", "bob", 5, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.QueueLockIntent("b.go", "dave", 3, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	intents, err := s.ListLockIntents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intents) != 2 || intents[0].AgentID != "bob" || intents[1].AgentID != "carol" {
+		t.Fatalf("intents = %+v; want bob then carol on a.go, dave's lapsed", intents)
+	}
+
+	// Queueing again refreshes the request but keeps the place in time.
+	again, err := s.QueueLockIntent("a.go", "carol", 9, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.QueuedAt.Equal(first.QueuedAt) || again.LamportTS != 9 {
+		t.Fatalf("requeued intent = %+v; want queued_at %v, ts 9", again, first.QueuedAt)
+	}
+
+	// Getting the lock ends the wait.
+	if err := s.ReleaseLock("a.go", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, conflict, err := s.AcquireLock("a.go", "bob", 10, 0, true, time.Hour); err != nil || conflict != nil {
+		t.Fatalf("AcquireLock = %+v, %v", conflict, err)
+	}
+	if intents, _ := s.ListLockIntents(); len(intents) != 1 || intents[0].AgentID != "carol" {
+		t.Fatalf("after bob locked, intents = %+v", intents)
+	}
+
+	if ok, err := s.DropLockIntent("a.go", "carol"); err != nil || !ok {
+		t.Fatalf("DropLockIntent = %v, %v", ok, err)
+	}
+	if ok, _ := s.DropLockIntent("a.go", "carol"); ok {
+		t.Fatal("DropLockIntent reported an intent that was already gone")
+	}
+}
@@ -0,0 +1,17 @@
+package store
+
+import "log/slog"
+
+// logger receives the store's diagnostics: contention retries, cursor
+// moves and clock updates, mostly at debug level. It discards everything
+// until SetLogger is called.
+var logger = slog.New(slog.DiscardHandler)
+
+// SetLogger sends the diagnostics of every Store in the process to l. Nil
+// discards them again.
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(slog.DiscardHandler)
+	}
+	logger = l
+}
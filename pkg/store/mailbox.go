@@ -0,0 +1,128 @@
+// mailbox.go files received messages per recipient, email style. The recv
+// cursor only says what an agent has received; a message_state row keeps
+// a message around after that: in the inbox (cm recv --keep), flagged for
+// attention, or archived once dealt with. Messages without a row were
+// received and let go, as they always have been.
+package store
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// MessageState is where a recipient has filed a message.
+type MessageState string
+
+const (
+	StateInbox    MessageState = "inbox"
+	StateFlagged  MessageState = "flagged"
+	StateArchived MessageState = "archived"
+)
+
+// ParseMessageState validates a state name.
+func ParseMessageState(s string) (MessageState, error) {
+	switch st := MessageState(s); st {
+	case StateInbox, StateFlagged, StateArchived:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown message state %q (want inbox, flagged or archived)", s)
+}
+
+// FiledMessage is a message with the state its recipient filed it under.
+type FiledMessage struct {
+	Event     model.Event  `json:"event"`
+	State     MessageState `json:"state"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// SetMessageState files agentID's messages ids under state, replacing
+// their earlier state. Every ID must be a msg, review_req or review_done
+// event targeting agentID.
+func (s *Store) SetMessageState(agentID string, ids []int64, state MessageState) error {
+	return s.fileMessages(agentID, ids, state, true)
+}
+
+// KeepMessages puts agentID's messages ids in the inbox, leaving those
+// already filed where they are.
+func (s *Store) KeepMessages(agentID string, ids []int64) error {
+	return s.fileMessages(agentID, ids, StateInbox, false)
+}
+
+func (s *Store) fileMessages(agentID string, ids []int64, state MessageState, replace bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	conflict := `DO NOTHING`
+	if replace {
+		conflict = `DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at`
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		for _, id := range ids {
+			if err := checkInInbox(tx, agentID, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO message_state (event_id, agent_id, state, updated_at) VALUES (?, ?, ?, ?)
+				 ON CONFLICT(event_id) `+conflict,
+				id, agentID, string(state), now,
+			); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// ListMessages returns agentID's filed messages in any of states (every
+// state if none are given), in Lamport order.
+func (s *Store) ListMessages(agentID string, states ...MessageState) ([]FiledMessage, error) {
+	rows, err := s.db.Query(`SELECT event_id, state, updated_at FROM message_state WHERE agent_id = ?`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]FiledMessage)
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		var state, updated string
+		if err := rows.Scan(&id, &state, &updated); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		f := FiledMessage{State: MessageState(state)}
+		if len(states) > 0 && !slices.Contains(states, f.State) {
+			continue
+		}
+		if f.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("parse updated_at for message %d: %w", id, err)
+		}
+		byID[id] = f
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	events, err := eventsByID(s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]FiledMessage, 0, len(events))
+	for _, e := range events {
+		f := byID[e.ID]
+		f.Event = e
+		out = append(out, f)
+	}
+	return out, nil
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestMessageStates(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	msg := func(ts int64, to string) int64 {
+		id, err := s.InsertEvent(&model.Event{AgentID: "bob", LamportTS: ts, Kind: model.EventMsg, Target: to, Body: "thread", CreatedAt: time.Now().UTC()})
+		if err != nil {
+			t.Fatalf("InsertEvent: %v", err)
+		}
+		return id
+	}
+	first, second, third, other := msg(1, "alice"), msg(2, "alice"), msg(3, "alice"), msg(4, "carol")
+
+	if err := s.KeepMessages("alice", []int64{other}); !errors.Is(err, ErrNotInInbox) {
+		t.Fatalf("keeping carol's message: err = %v", err)
+	}
+	if err := s.KeepMessages("alice", []int64{first, second, third}); err != nil {
+		t.Fatalf("KeepMessages: %v", err)
+	}
+	if err := s.SetMessageState("alice", []int64{second}, StateFlagged); err != nil {
+		t.Fatalf("flag: %v", err)
+	}
+	if err := s.SetMessageState("alice", []int64{third}, StateArchived); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	// Keeping again does not move a filed message back to the inbox.
+	if err := s.KeepMessages("alice", []int64{second, third}); err != nil {
+		t.Fatalf("KeepMessages again: %v", err)
+	}
+
+	all, err := s.ListMessages("alice")
+	if err != nil || len(all) != 3 || all[0].State != StateInbox || all[1].State != StateFlagged || all[2].State != StateArchived {
+		t.Fatalf("ListMessages = %+v, %v", all, err)
+	}
+	open, _ := s.ListMessages("alice", StateInbox, StateFlagged)
+	if len(open) != 2 || open[0].Event.ID != first || open[1].Event.ID != second || open[1].Event.Body != "thread" {
+		t.Fatalf("inbox and flagged = %+v", open)
+	}
+	if none, _ := s.ListMessages("bob"); len(none) != 0 {
+		t.Fatalf("bob has filed nothing, got %+v", none)
+	}
+
+	// Kept and flagged messages survive compaction; archived ones do not.
+	s.SetCursor("alice", 10)
+	s.SetCursor("carol", 10)
+	if _, err := s.CompactEvents(CompactOptions{}); err != nil {
+		t.Fatalf("CompactEvents: %v", err)
+	}
+	all, _ = s.ListMessages("alice")
+	if len(all) != 2 || all[0].Event.ID != first || all[1].Event.ID != second {
+		t.Fatalf("after gc: %+v", all)
+	}
+
+	if _, err := ParseMessageState("starred"); err == nil {
+		t.Fatal("ParseMessageState accepted an unknown state")
+	}
+}
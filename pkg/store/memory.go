@@ -0,0 +1,123 @@
+// memory.go opens SQLite databases that live only in memory, selected
+// with the path ":memory:" (CLOCKMAIL_DB=:memory:). They suit tests of
+// tools built on clockmail and short-lived demo sessions: nothing
+// touches the disk, and the database is gone when the store is closed.
+//
+// A plain ":memory:" database is private to the connection that opened
+// it, and the pool opens several. Each store therefore gets its own
+// named shared-cache database that all of its connections attach to,
+// and keeps one extra connection open for its lifetime, since SQLite
+// drops a memory database when its last connection closes.
+//
+// Only this process can write to an in-memory database, so its Watchers
+// are woken directly rather than through a notify file.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryPath is the database path that selects an in-memory database.
+const memoryPath = ":memory:"
+
+var memoryDBs atomic.Int64
+
+func newMemory(migrate bool) (*Store, error) {
+	dsn := fmt.Sprintf("file:clockmail-%d-%d?mode=memory&cache=shared&_pragma=busy_timeout(60000)",
+		os.Getpid(), memoryDBs.Add(1))
+	keep, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+	keep.SetMaxOpenConns(1)
+	if err := keep.Ping(); err != nil {
+		keep.Close()
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		keep.Close()
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+	db.SetMaxOpenConns(defaultMaxOpenConns)
+	db.SetMaxIdleConns(2)
+	db.SetConnMaxLifetime(30 * time.Minute)
+
+	s := &Store{db: &conn{DB: db, dialect: dialectSQLite, dsn: dsn, keep: keep}, memNotify: newMemoryNotify()}
+	if !migrate {
+		return s, nil
+	}
+	if err := s.migrate(); err != nil {
+		s.db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	if err := s.db.prepareHot(); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// memoryNotify wakes the Watchers of an in-memory store.
+type memoryNotify struct {
+	mu  sync.Mutex
+	gen int64
+	ch  chan struct{} // closed and replaced on each write
+}
+
+func newMemoryNotify() *memoryNotify { return &memoryNotify{ch: make(chan struct{})} }
+
+func (n *memoryNotify) bump() {
+	n.mu.Lock()
+	n.gen++
+	close(n.ch)
+	n.ch = make(chan struct{})
+	n.mu.Unlock()
+}
+
+func (n *memoryNotify) waiter() *memoryWaiter {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &memoryWaiter{n: n, last: n.gen, closed: make(chan struct{})}
+}
+
+// memoryWaiter is the notifyWaiter of an in-memory store.
+type memoryWaiter struct {
+	n      *memoryNotify
+	last   int64
+	closed chan struct{}
+}
+
+func (w *memoryWaiter) wait(timeout time.Duration) bool {
+	w.n.mu.Lock()
+	if w.n.gen != w.last {
+		w.last = w.n.gen
+		w.n.mu.Unlock()
+		return true
+	}
+	ch := w.n.ch
+	w.n.mu.Unlock()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	select {
+	case <-ch:
+		w.n.mu.Lock()
+		w.last = w.n.gen
+		w.n.mu.Unlock()
+		return true
+	case <-deadline.C:
+		return false
+	case <-w.closed:
+		return false
+	}
+}
+
+func (w *memoryWaiter) close() error {
+	close(w.closed)
+	return nil
+}
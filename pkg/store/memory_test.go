@@ -0,0 +1,65 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	other, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	w, err := s.Watch()
+	if err != nil {
+		t.Fatalf("Watch on a memory store: %v", err)
+	}
+	defer w.Close()
+
+	// Writes from concurrent connections all land in the one database.
+	if _, err := s.RegisterAgent("alice"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := s.TickAgent("alice"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if a, err := s.GetAgent("alice"); err != nil || a.Clock != 20 {
+		t.Fatalf("alice = %+v, %v; want clock 20", a, err)
+	}
+
+	if _, err := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 21, Kind: model.EventMsg,
+		Target: "bob", Body: "hi", CreatedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Wait(time.Second) {
+		t.Fatal("memory store watcher did not wake after a write")
+	}
+	if w.Wait(20 * time.Millisecond) {
+		t.Fatal("memory store watcher woke with nothing new written")
+	}
+
+	// Each memory store is a database of its own.
+	if agents, err := other.ListAgents(); err != nil || len(agents) != 0 {
+		t.Fatalf("second memory store has agents %+v, %v", agents, err)
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// Aggregates behind cm metrics. Each is a single GROUP BY over the log, so
+// a scrape costs a few queries however long the log has grown.
+
+// LockDeniedPrefix starts the body of a lock_req event whose request was
+// refused because another agent held the lock.
+const LockDeniedPrefix = "denied"
+
+// CountEventsByKind returns how many events of each kind are in the log.
+// Compaction (cm gc) lowers the counts.
+func (s *Store) CountEventsByKind() (map[model.EventKind]int64, error) {
+	rows, err := s.db.Query(`SELECT kind, COUNT(*) FROM events GROUP BY kind`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byName, err := scanCounts(rows)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[model.EventKind]int64, len(byName))
+	for kind, n := range byName {
+		counts[model.EventKind(kind)] = n
+	}
+	return counts, nil
+}
+
+// CountUnread returns, for each registered agent with anything waiting,
+// how many inbox events it has not received yet.
+func (s *Store) CountUnread() (map[string]int64, error) {
+	rows, err := s.db.Query(
+		`SELECT e.target, COUNT(*) FROM events e
+		 WHERE e.target IN (SELECT id FROM agents) AND ` + unreadCond + `
+		 GROUP BY e.target`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanCounts(rows)
+}
+
+// CountDeniedLocks returns, for each agent that was refused a lock, how
+// many of its lock requests in the log were denied.
+func (s *Store) CountDeniedLocks() (map[string]int64, error) {
+	rows, err := s.db.Query(
+		`SELECT agent_id, COUNT(*) FROM events
+		 WHERE kind = ? AND body LIKE ?
+		 GROUP BY agent_id`,
+		string(model.EventLockReq), LockDeniedPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanCounts(rows)
+}
+
+// LastEventAt returns when each agent that has events in the log wrote
+// its latest one: the last time its clock ticked on its own account.
+func (s *Store) LastEventAt() (map[string]time.Time, error) {
+	rows, err := s.db.Query(
+		`SELECT agent_id, created_at FROM events
+		 WHERE id IN (SELECT MAX(id) FROM events GROUP BY agent_id)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	last := make(map[string]time.Time)
+	for rows.Next() {
+		var agent, createdStr string
+		if err := rows.Scan(&agent, &createdStr); err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, createdStr)
+		if err != nil {
+			return nil, fmt.Errorf("parse created_at time for %s's latest event: %w", agent, err)
+		}
+		last[agent] = t
+	}
+	return last, rows.Err()
+}
+
+// scanCounts reads (key, count) rows.
+func scanCounts(rows *sql.Rows) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var key string
+		var n int64
+		if err := rows.Scan(&key, &n); err != nil {
+			return nil, err
+		}
+		counts[key] = n
+	}
+	return counts, rows.Err()
+}
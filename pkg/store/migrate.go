@@ -0,0 +1,613 @@
+// migrate.go versions the schema. Each migration has a number and runs
+// once, in its own transaction; the schema_version table records which
+// have been applied, so a database created by an older release is brought
+// up to date in place when a newer cm opens it.
+//
+// Databases from before versioning have no schema_version rows. The first
+// migrations are written to be safe on them (CREATE TABLE IF NOT EXISTS,
+// adding only missing columns), so they simply run again. Schema changes
+// go in a new migration appended to migrations, never in an existing one.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrDowngrade is returned when asked to migrate to a version older than
+// the database's. Migrations only go forward.
+var ErrDowngrade = errors.New("schema downgrades are not supported")
+
+// migration is one step of the schema's history.
+type migration struct {
+	version     int
+	description string
+	up          func(d dialect, db dbtx) error
+}
+
+var migrations = []migration{
+	{1, "base schema", func(d dialect, db dbtx) error { return d.execSchema(db, baseSchema) }},
+	{2, "add columns missing from tables created by older releases", func(d dialect, db dbtx) error {
+		return d.addColumns(db, addedColumns)
+	}},
+	{3, "per-sender recv cursors", func(d dialect, db dbtx) error { return d.migrateCursors(db) }},
+	{4, "backfill permalinks", func(_ dialect, db dbtx) error { return backfillPermalinks(db) }},
+	{5, "backfill reviews", func(_ dialect, db dbtx) error { return backfillReviews(db) }},
+	{6, "attachments for large message bodies", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS attachments (
+			id         TEXT PRIMARY KEY,
+			body       TEXT NOT NULL,
+			size       INTEGER NOT NULL,
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL
+		);`)
+	}},
+	{7, "agent public keys for sealed messages", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS agent_keys (
+			agent_id   TEXT PRIMARY KEY,
+			pubkey     TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		);`)
+	}},
+	{8, "signed events", func(d dialect, db dbtx) error {
+		if err := d.addColumns(db, addedColumns); err != nil {
+			return err
+		}
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS signing_keys (
+			agent_id      TEXT PRIMARY KEY,
+			pubkey        TEXT NOT NULL,
+			registered_at TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS settings (
+			key   TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);`)
+	}},
+	{9, "hash-chained event log", func(d dialect, db dbtx) error {
+		if err := d.addColumns(db, addedColumns); err != nil {
+			return err
+		}
+		return backfillChain(db)
+	}},
+	{10, "agent roles", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS roles (
+			agent_id TEXT NOT NULL,
+			role     TEXT NOT NULL,
+			PRIMARY KEY (agent_id, role)
+		);
+		CREATE INDEX IF NOT EXISTS idx_roles_name ON roles(role);`)
+	}},
+	{11, "dead letters for undeliverable messages", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS dead_letters (
+			id                INTEGER PRIMARY KEY AUTOINCREMENT,
+			from_agent        TEXT NOT NULL,
+			to_agent          TEXT NOT NULL,
+			body              TEXT NOT NULL,
+			priority          TEXT NOT NULL DEFAULT '',
+			lamport_ts        INTEGER NOT NULL,
+			epoch             INTEGER NOT NULL,
+			round             INTEGER NOT NULL,
+			reason            TEXT NOT NULL,
+			created_at        TEXT NOT NULL,
+			redelivered_to    TEXT NOT NULL DEFAULT '',
+			redelivered_event INTEGER NOT NULL DEFAULT 0,
+			redelivered_at    TEXT NOT NULL DEFAULT ''
+		);`)
+	}},
+	{12, "handoffs of files between agents", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS handoffs (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			from_agent  TEXT NOT NULL,
+			to_agent    TEXT NOT NULL,
+			files       TEXT NOT NULL,
+			summary     TEXT NOT NULL,
+			epoch       INTEGER NOT NULL,
+			event_id    INTEGER NOT NULL DEFAULT 0,
+			released    TEXT NOT NULL DEFAULT '',
+			reserved    TEXT NOT NULL DEFAULT '',
+			created_at  TEXT NOT NULL,
+			accepted_at TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS idx_handoffs_to ON handoffs(to_agent);`)
+	}},
+	{13, "ownership claims", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS ownership (
+			path       TEXT PRIMARY KEY,
+			agent_id   TEXT NOT NULL,
+			note       TEXT NOT NULL DEFAULT '',
+			claimed_at TEXT NOT NULL
+		);`)
+	}},
+	{14, "queued lock intents", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS lock_intents (
+			path       TEXT NOT NULL,
+			agent_id   TEXT NOT NULL,
+			lamport_ts INTEGER NOT NULL,
+			queued_at  TEXT NOT NULL,
+			expires_at TEXT NOT NULL,
+			PRIMARY KEY (path, agent_id)
+		);`)
+	}},
+	{15, "agent sessions", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS sessions (
+			agent_id   TEXT PRIMARY KEY,
+			token_hash TEXT NOT NULL,
+			started_at TEXT NOT NULL
+		);`)
+	}},
+	{16, "send idempotency keys", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS send_keys (
+			agent_id   TEXT NOT NULL,
+			key        TEXT NOT NULL,
+			lamport_ts INTEGER NOT NULL,
+			event_ids  TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL,
+			PRIMARY KEY (agent_id, key)
+		);`)
+	}},
+	{17, "per-recipient message states", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS message_state (
+			event_id   INTEGER PRIMARY KEY,
+			agent_id   TEXT NOT NULL,
+			state      TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_state_agent ON message_state(agent_id, state);`)
+	}},
+	{18, "scheduled message delivery", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS schedules (
+			event_id      INTEGER PRIMARY KEY,
+			deliver_after TEXT NOT NULL DEFAULT '',
+			deliver_epoch INTEGER NOT NULL DEFAULT -1
+		);`)
+	}},
+	{19, "scheduled delivery at a round", func(d dialect, db dbtx) error {
+		return d.addColumns(db, []column{
+			{table: "schedules", name: "deliver_round", decl: "INTEGER NOT NULL DEFAULT 9223372036854775807"},
+		})
+	}},
+	{20, "agent positions below the round", func(d dialect, db dbtx) error {
+		return d.addColumns(db, []column{
+			{table: "agents", name: "steps", decl: "TEXT NOT NULL DEFAULT ''"},
+		})
+	}},
+	{21, "agent scopes", func(d dialect, db dbtx) error {
+		return d.addColumns(db, []column{
+			{table: "agents", name: "scope", decl: "TEXT NOT NULL DEFAULT ''"},
+		})
+	}},
+	{22, "votes", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS votes (
+			id         TEXT PRIMARY KEY,
+			agent_id   TEXT NOT NULL,
+			question   TEXT NOT NULL,
+			options    TEXT NOT NULL,
+			quorum     INTEGER NOT NULL,
+			lamport_ts INTEGER NOT NULL,
+			created_at TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS ballots (
+			vote_id    TEXT NOT NULL,
+			agent_id   TEXT NOT NULL,
+			choice     TEXT NOT NULL,
+			lamport_ts INTEGER NOT NULL,
+			cast_at    TEXT NOT NULL,
+			PRIMARY KEY (vote_id, agent_id)
+		);`)
+	}},
+	{23, "shared key-value scratchpad", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS kv (
+			key        TEXT PRIMARY KEY,
+			value      TEXT NOT NULL,
+			agent_id   TEXT NOT NULL,
+			lamport_ts INTEGER NOT NULL,
+			updated_at TEXT NOT NULL
+		);`)
+	}},
+	{24, "grow-only counters and sets", func(d dialect, db dbtx) error {
+		return d.execSchema(db, `
+		CREATE TABLE IF NOT EXISTS crdt_counters (
+			name       TEXT NOT NULL,
+			agent_id   TEXT NOT NULL,
+			count      INTEGER NOT NULL,
+			updated_at TEXT NOT NULL,
+			PRIMARY KEY (name, agent_id)
+		);
+		CREATE TABLE IF NOT EXISTS crdt_sets (
+			name       TEXT NOT NULL,
+			element    TEXT NOT NULL,
+			agent_id   TEXT NOT NULL,
+			lamport_ts INTEGER NOT NULL,
+			added_at   TEXT NOT NULL,
+			PRIMARY KEY (name, element)
+		);`)
+	}},
+	{25, "git branch namespaces", func(d dialect, db dbtx) error {
+		return d.addColumns(db, []column{
+			{table: "events", name: "branch", decl: "TEXT NOT NULL DEFAULT ''"},
+			{table: "locks", name: "branch", decl: "TEXT NOT NULL DEFAULT ''"},
+		})
+	}},
+	{26, "lock paths in the holder's worktree", func(d dialect, db dbtx) error {
+		return d.addColumns(db, []column{
+			{table: "locks", name: "abs_path", decl: "TEXT NOT NULL DEFAULT ''"},
+		})
+	}},
+}
+
+// MigrationStatus describes a migration and whether the database has it.
+type MigrationStatus struct {
+	Version     int        `json:"version"`
+	Description string     `json:"description"`
+	AppliedAt   *time.Time `json:"applied_at,omitempty"`
+}
+
+// LatestSchemaVersion returns the schema version this build migrates to.
+func LatestSchemaVersion() int { return migrations[len(migrations)-1].version }
+
+// SchemaVersion returns the database's schema version: the newest applied
+// migration, or 0 for a database from before versioning.
+func (s *Store) SchemaVersion() (int, error) {
+	return schemaVersion(s.db.dialect, s.db)
+}
+
+func schemaVersion(d dialect, db dbtx) (int, error) {
+	ok, err := d.hasTable(db, "schema_version")
+	if err != nil || !ok {
+		return 0, err
+	}
+	var v int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&v)
+	return v, err
+}
+
+// Migrations returns every migration this build knows, oldest first, with
+// when it was applied to the database (nil if pending).
+func (s *Store) Migrations() ([]MigrationStatus, error) {
+	applied := make(map[int]time.Time)
+	ok, err := s.db.dialect.hasTable(s.db, "schema_version")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		rows, err := s.db.Query(`SELECT version, applied_at FROM schema_version`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var v int
+			var at string
+			if err := rows.Scan(&v, &at); err != nil {
+				return nil, err
+			}
+			if applied[v], err = time.Parse(time.RFC3339Nano, at); err != nil {
+				return nil, fmt.Errorf("parse applied_at for schema version %d: %w", v, err)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		out[i] = MigrationStatus{Version: m.version, Description: m.description}
+		if at, ok := applied[m.version]; ok {
+			out[i].AppliedAt = &at
+		}
+	}
+	return out, nil
+}
+
+// MigrateTo applies the pending migrations up to and including version,
+// and returns the ones it applied. Concurrent callers are safe: each
+// migration runs once, whoever gets to it first.
+func (s *Store) MigrateTo(version int) ([]MigrationStatus, error) {
+	if version < 0 || version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("unknown schema version %d (latest is %d)", version, LatestSchemaVersion())
+	}
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version < current {
+		return nil, fmt.Errorf("%w: database is at version %d", ErrDowngrade, current)
+	}
+	if current == version {
+		return nil, nil
+	}
+	if err := s.withMigrationLock(func(tx *txn) error {
+		_, err := tx.Exec(s.db.dialect.ddl(`CREATE TABLE IF NOT EXISTS schema_version (
+			version     INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at  TEXT NOT NULL
+		)`))
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("create schema_version: %w", err)
+	}
+
+	var applied []MigrationStatus
+	for _, m := range migrations {
+		if m.version <= current || m.version > version {
+			continue
+		}
+		var ran bool
+		err := s.withMigrationLock(func(tx *txn) error {
+			ran = false
+			v, err := schemaVersion(s.db.dialect, tx)
+			if err != nil || v >= m.version {
+				return err
+			}
+			if err := m.up(s.db.dialect, tx); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.description, time.Now().UTC().Format(time.RFC3339Nano),
+			); err != nil {
+				return err
+			}
+			ran = true
+			return nil
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		if ran {
+			now := time.Now().UTC()
+			applied = append(applied, MigrationStatus{Version: m.version, Description: m.description, AppliedAt: &now})
+		}
+	}
+	return applied, nil
+}
+
+// withMigrationLock runs fn in a transaction that excludes other
+// migrating processes, committing if fn succeeds.
+func (s *Store) withMigrationLock(fn func(tx *txn) error) error {
+	return retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := tx.advisoryLock("clockmail:migrate"); err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// migrate brings the schema up to the latest version.
+func (s *Store) migrate() error {
+	_, err := s.MigrateTo(LatestSchemaVersion())
+	return err
+}
+
+// execSchema runs schema statements, translated for the dialect.
+// PostgreSQL takes one statement per Exec.
+func (d dialect) execSchema(db dbtx, schema string) error {
+	if d != dialectPostgres {
+		_, err := db.Exec(schema)
+		return err
+	}
+	for _, stmt := range strings.Split(d.ddl(schema), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("%w (statement: %s)", err, strings.TrimSpace(stmt))
+		}
+	}
+	return nil
+}
+
+// hasTable reports whether the database has a table called name.
+func (d dialect) hasTable(db dbtx, name string) (bool, error) {
+	q := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	if d == dialectPostgres {
+		q = `SELECT COUNT(*) FROM information_schema.tables
+		     WHERE table_schema = current_schema() AND table_name = ?`
+	}
+	var n int
+	if err := db.QueryRow(q, name).Scan(&n); err != nil {
+		return false, fmt.Errorf("inspect %s: %w", name, err)
+	}
+	return n > 0, nil
+}
+
+// baseSchema is the schema as of version 1. Later changes are separate
+// migrations.
+const baseSchema = `
+	CREATE TABLE IF NOT EXISTS agents (
+		id           TEXT PRIMARY KEY,
+		clock        INTEGER NOT NULL DEFAULT 0,
+		epoch        INTEGER NOT NULL DEFAULT 0,
+		round        INTEGER NOT NULL DEFAULT 0,
+		registered   TEXT NOT NULL,
+		last_seen    TEXT NOT NULL,
+		departed_at  TEXT NOT NULL DEFAULT '',
+		parent_id    TEXT NOT NULL DEFAULT '',
+		retire_epoch INTEGER NOT NULL DEFAULT -1,
+		ttl          INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS events (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		agent_id   TEXT NOT NULL REFERENCES agents(id),
+		lamport_ts INTEGER NOT NULL,
+		epoch      INTEGER NOT NULL DEFAULT 0,
+		round      INTEGER NOT NULL DEFAULT 0,
+		kind       TEXT NOT NULL,
+		target     TEXT,
+		body       TEXT,
+		created_at TEXT NOT NULL,
+		priority   TEXT NOT NULL DEFAULT '',
+		tool       TEXT NOT NULL DEFAULT '',
+		run_id     TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_events_lamport ON events(lamport_ts);
+	CREATE INDEX IF NOT EXISTS idx_events_agent ON events(agent_id, lamport_ts);
+	CREATE INDEX IF NOT EXISTS idx_events_kind_target ON events(kind, target);
+	CREATE INDEX IF NOT EXISTS idx_events_epoch_round ON events(epoch, round);
+
+	CREATE TABLE IF NOT EXISTS locks (
+		path       TEXT NOT NULL,
+		agent_id   TEXT NOT NULL REFERENCES agents(id),
+		lamport_ts INTEGER NOT NULL,
+		epoch      INTEGER NOT NULL DEFAULT 0,
+		exclusive  INTEGER NOT NULL DEFAULT 1,
+		expires_at TEXT NOT NULL,
+		PRIMARY KEY (path, agent_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_locks_agent ON locks(agent_id);
+
+	CREATE TABLE IF NOT EXISTS inbox_cursors (
+		agent_id   TEXT NOT NULL,
+		sender     TEXT NOT NULL DEFAULT '',
+		since_ts   INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (agent_id, sender)
+	);
+
+	CREATE TABLE IF NOT EXISTS workflows (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		body       TEXT NOT NULL,
+		applied_by TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS sagas (
+		id         TEXT PRIMARY KEY,
+		agent_id   TEXT NOT NULL,
+		name       TEXT NOT NULL DEFAULT '',
+		status     TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS saga_steps (
+		saga_id      TEXT NOT NULL,
+		seq          INTEGER NOT NULL,
+		agent_id     TEXT NOT NULL,
+		action       TEXT NOT NULL,
+		compensation TEXT NOT NULL DEFAULT '',
+		locks        TEXT NOT NULL DEFAULT '',
+		lamport_ts   INTEGER NOT NULL,
+		created_at   TEXT NOT NULL,
+		PRIMARY KEY (saga_id, seq)
+	);
+
+	CREATE TABLE IF NOT EXISTS deliveries (
+		event_id     INTEGER PRIMARY KEY,
+		agent_id     TEXT NOT NULL,
+		clock        INTEGER NOT NULL,
+		delivered_at TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_deliveries_at ON deliveries(delivered_at);
+
+	CREATE TABLE IF NOT EXISTS permalinks (
+		link     TEXT PRIMARY KEY,
+		event_id INTEGER NOT NULL,
+		snapshot TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_permalinks_event ON permalinks(event_id);
+
+	CREATE TABLE IF NOT EXISTS capabilities (
+		agent_id   TEXT NOT NULL,
+		capability TEXT NOT NULL,
+		PRIMARY KEY (agent_id, capability)
+	);
+	CREATE INDEX IF NOT EXISTS idx_capabilities_name ON capabilities(capability);
+
+	CREATE TABLE IF NOT EXISTS reviews (
+		commit_sha   TEXT NOT NULL,
+		reviewer     TEXT NOT NULL,
+		requested_by TEXT NOT NULL DEFAULT '',
+		state        TEXT NOT NULL,
+		files        TEXT NOT NULL DEFAULT '',
+		comment      TEXT NOT NULL DEFAULT '',
+		request_ts   INTEGER NOT NULL DEFAULT 0,
+		verdict_ts   INTEGER NOT NULL DEFAULT 0,
+		requested_at TEXT NOT NULL,
+		updated_at   TEXT NOT NULL,
+		PRIMARY KEY (commit_sha, reviewer)
+	);
+	CREATE INDEX IF NOT EXISTS idx_reviews_reviewer ON reviews(reviewer, state);
+
+	CREATE TABLE IF NOT EXISTS epochs (
+		epoch       INTEGER PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT '',
+		status      TEXT NOT NULL,
+		opened_by   TEXT NOT NULL,
+		opened_at   TEXT NOT NULL,
+		closed_by   TEXT NOT NULL DEFAULT '',
+		closed_at   TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE IF NOT EXISTS frontier_history (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		epoch       INTEGER NOT NULL,
+		frontier    TEXT NOT NULL,
+		active      INTEGER NOT NULL,
+		recorded_at TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_frontier_history_at ON frontier_history(recorded_at);
+
+	CREATE TABLE IF NOT EXISTS deferrals (
+		event_id    INTEGER PRIMARY KEY,
+		agent_id    TEXT NOT NULL,
+		until       TEXT NOT NULL DEFAULT '',
+		deferred_at TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_deferrals_agent ON deferrals(agent_id);
+
+	CREATE TABLE IF NOT EXISTS wip (
+		agent_id    TEXT PRIMARY KEY,
+		description TEXT NOT NULL,
+		files       TEXT NOT NULL DEFAULT '',
+		epoch       INTEGER NOT NULL DEFAULT 0,
+		updated_at  TEXT NOT NULL
+	);
+	`
+
+// addedColumns lists columns added to tables after their first release.
+// CREATE TABLE IF NOT EXISTS leaves existing tables alone, so databases
+// created by older versions get these columns from migration 2. New
+// tables already declare them.
+//
+// events.signature and events.prev_hash arrived with migrations 8 and 9,
+// and events.branch with migration 25, which add them to databases past
+// version 2. They are listed here too because the backfills in migrations
+// 4 and 5 read events with every column scanEvents expects.
+var addedColumns = []column{
+	{table: "events", name: "priority", decl: "TEXT NOT NULL DEFAULT ''"},
+	{table: "agents", name: "departed_at", decl: "TEXT NOT NULL DEFAULT ''"},
+	{table: "events", name: "tool", decl: "TEXT NOT NULL DEFAULT ''"},
+	{table: "events", name: "run_id", decl: "TEXT NOT NULL DEFAULT ''"},
+	{table: "agents", name: "parent_id", decl: "TEXT NOT NULL DEFAULT ''"},
+	{table: "agents", name: "retire_epoch", decl: "INTEGER NOT NULL DEFAULT -1"},
+	{table: "agents", name: "ttl", decl: "INTEGER NOT NULL DEFAULT 0"},
+	{table: "events", name: "signature", decl: "TEXT NOT NULL DEFAULT ''"},
+	{table: "events", name: "prev_hash", decl: "TEXT NOT NULL DEFAULT ''"},
+	{table: "events", name: "branch", decl: "TEXT NOT NULL DEFAULT ''"},
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate_NewDatabaseIsLatest(t *testing.T) {
+	s := newTestStore(t)
+	if v, err := s.SchemaVersion(); err != nil || v != LatestSchemaVersion() {
+		t.Fatalf("SchemaVersion = %d, %v; want %d", v, err, LatestSchemaVersion())
+	}
+	ms, err := s.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range ms {
+		if m.AppliedAt == nil {
+			t.Errorf("migration %d (%s) not applied", m.Version, m.Description)
+		}
+	}
+}
+
+func TestMigrate_StepByStep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := OpenUnmigrated(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.SchemaVersion(); err != nil || v != 0 {
+		t.Fatalf("unmigrated SchemaVersion = %d, %v", v, err)
+	}
+
+	applied, err := s.MigrateTo(2)
+	if err != nil || len(applied) != 2 || applied[0].Version != 1 || applied[1].Version != 2 {
+		t.Fatalf("MigrateTo(2) = %+v, %v", applied, err)
+	}
+	ms, _ := s.Migrations()
+	if ms[1].AppliedAt == nil || ms[2].AppliedAt != nil {
+		t.Fatalf("Migrations after MigrateTo(2) = %+v", ms)
+	}
+	if _, err := s.MigrateTo(1); !errors.Is(err, ErrDowngrade) {
+		t.Fatalf("MigrateTo(1) err = %v, want ErrDowngrade", err)
+	}
+	if _, err := s.MigrateTo(LatestSchemaVersion() + 1); err == nil {
+		t.Fatal("MigrateTo past the latest version should fail")
+	}
+	s.Close()
+
+	// Opening normally applies the rest.
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, _ := s.SchemaVersion(); v != LatestSchemaVersion() {
+		t.Fatalf("SchemaVersion after Open = %d", v)
+	}
+	if applied, err := s.MigrateTo(LatestSchemaVersion()); err != nil || len(applied) != 0 {
+		t.Fatalf("MigrateTo(latest) when up to date = %+v, %v", applied, err)
+	}
+}
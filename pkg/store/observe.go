@@ -0,0 +1,222 @@
+// observe.go provides a middleware layer around StoreInterface: Observe
+// wraps a store so that callbacks run after each successful write, letting
+// the daemon, projections, webhooks and embedders react to events and lock
+// changes in-process instead of polling the tables they just wrote.
+package store
+
+import (
+	"slices"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// LockAction is what happened to a lock.
+type LockAction string
+
+const (
+	LockAcquired LockAction = "acquired"
+	LockRenewed  LockAction = "renewed"
+	LockReleased LockAction = "released"
+	// LockEvicted means a request with a lower (lamport_ts, agent_id)
+	// took the lock from its holder.
+	LockEvicted LockAction = "evicted"
+)
+
+// LockChange describes one change to the locks table.
+type LockChange struct {
+	Action LockAction `json:"action"`
+	// Lock is the lock after the change, or as it was before a release or
+	// eviction.
+	Lock model.Lock `json:"lock"`
+	// By is the agent whose request evicted Lock (evicted only).
+	By string `json:"by,omitempty"`
+}
+
+// Hooks are the callbacks an Observed store runs. Either may be nil.
+//
+// Callbacks run synchronously on the writing goroutine, after the write
+// has committed, and only when it succeeded; a slow callback slows the
+// writer down, so hand long work to a goroutine. They see writes made
+// through the Observed store only, not those of other processes sharing
+// the database.
+type Hooks struct {
+	// OnInsertEvent is called with each event written, in log order. The
+	// event's ID is 0 for the heartbeat SyncAtomic writes, which the store
+	// does not report.
+	OnInsertEvent func(e model.Event)
+
+	// OnLockChange is called when a lock is acquired, renewed, released
+	// (including by DepartAgent) or evicted. Locks that simply expire are
+	// not reported.
+	OnLockChange func(c LockChange)
+}
+
+// Observed is a StoreInterface that runs hooks after writes to the store
+// it wraps. Methods that do not write pass straight through. Observed
+// stores nest, so independent subscribers can each add a layer.
+type Observed struct {
+	StoreInterface
+	hooks Hooks
+}
+
+// Compile-time check that *Observed implements StoreInterface.
+var _ StoreInterface = (*Observed)(nil)
+
+// Observe wraps inner so that hooks run after each successful write.
+func Observe(inner StoreInterface, hooks Hooks) *Observed {
+	return &Observed{StoreInterface: inner, hooks: hooks}
+}
+
+func (o *Observed) event(e model.Event) {
+	if o.hooks.OnInsertEvent != nil {
+		o.hooks.OnInsertEvent(e)
+	}
+}
+
+func (o *Observed) lock(action LockAction, l model.Lock, by string) {
+	if o.hooks.OnLockChange != nil {
+		o.hooks.OnLockChange(LockChange{Action: action, Lock: l, By: by})
+	}
+}
+
+// InsertEvent appends an event and reports it with its new ID.
+func (o *Observed) InsertEvent(e *model.Event) (int64, error) {
+	id, err := o.StoreInterface.InsertEvent(e)
+	if err == nil {
+		ev := *e
+		ev.ID = id
+		o.event(ev)
+	}
+	return id, err
+}
+
+// ImportEvents replays exported events and reports those that were not
+// already in the log.
+func (o *Observed) ImportEvents(events []model.Event, markDelivered bool) (*ImportResult, error) {
+	if o.hooks.OnInsertEvent == nil {
+		return o.StoreInterface.ImportEvents(events, markDelivered)
+	}
+	before := o.StoreInterface.MaxEventID()
+	res, err := o.StoreInterface.ImportEvents(events, markDelivered)
+	if err != nil || res.Imported == 0 {
+		return res, err
+	}
+	// The import does not return the rows it wrote, so read back the new
+	// ones, skipping any written concurrently by someone else.
+	type key struct {
+		agent  string
+		ts     int64
+		kind   model.EventKind
+		target string
+		at     time.Time
+	}
+	imported := make(map[key]bool, len(events))
+	for _, e := range events {
+		imported[key{e.AgentID, e.LamportTS, e.Kind, e.Target, e.CreatedAt.UTC()}] = true
+	}
+	for found := 0; found < res.Imported; {
+		written, err := o.StoreInterface.ListEventsSinceID(before, 500)
+		if err != nil || len(written) == 0 {
+			break
+		}
+		for _, e := range written {
+			if imported[key{e.AgentID, e.LamportTS, e.Kind, e.Target, e.CreatedAt.UTC()}] {
+				o.event(e)
+				found++
+			}
+		}
+		before = written[len(written)-1].ID
+	}
+	return res, nil
+}
+
+// SyncAtomic records a heartbeat and receives messages, reporting the
+// heartbeat's progress event.
+func (o *Observed) SyncAtomic(agentID string, epoch, round int64, limit int, prov model.Provenance) (*SyncResult, error) {
+	res, err := o.StoreInterface.SyncAtomic(agentID, epoch, round, limit, prov)
+	if err == nil {
+		o.event(model.Event{
+			AgentID: agentID, LamportTS: res.HeartbeatTS, Epoch: epoch, Round: round,
+			Kind: model.EventProgress, CreatedAt: time.Now().UTC(), Provenance: prov,
+		})
+	}
+	return res, err
+}
+
+// AcquireLock attempts to acquire a lock, reporting the grant and the
+// eviction of any holder it displaced.
+func (o *Observed) AcquireLock(path, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) (*model.Lock, *model.Lock, error) {
+	if o.hooks.OnLockChange == nil {
+		return o.StoreInterface.AcquireLock(path, agentID, lamportTS, epoch, exclusive, ttl)
+	}
+	var holder *model.Lock
+	if locks, err := o.StoreInterface.ListLocks(); err == nil {
+		if i := slices.IndexFunc(locks, func(l model.Lock) bool {
+			return l.Path == path && l.AgentID != agentID && l.Exclusive
+		}); i >= 0 {
+			holder = &locks[i]
+		}
+	}
+	granted, conflict, err := o.StoreInterface.AcquireLock(path, agentID, lamportTS, epoch, exclusive, ttl)
+	if err == nil && granted != nil {
+		if holder != nil {
+			o.lock(LockEvicted, *holder, agentID)
+		}
+		o.lock(LockAcquired, *granted, "")
+	}
+	return granted, conflict, err
+}
+
+// ReleaseLock releases a lock, reporting it if agentID held it.
+func (o *Observed) ReleaseLock(path, agentID string) error {
+	if o.hooks.OnLockChange == nil {
+		return o.StoreInterface.ReleaseLock(path, agentID)
+	}
+	held, _ := o.StoreInterface.ListLocksForAgent(agentID)
+	if err := o.StoreInterface.ReleaseLock(path, agentID); err != nil {
+		return err
+	}
+	for _, l := range held {
+		if l.Path == path {
+			o.lock(LockReleased, l, "")
+		}
+	}
+	return nil
+}
+
+// ForceReleaseLock releases a path's locks and reports each.
+func (o *Observed) ForceReleaseLock(path string) ([]model.Lock, error) {
+	released, err := o.StoreInterface.ForceReleaseLock(path)
+	for _, l := range released {
+		o.lock(LockReleased, l, "")
+	}
+	return released, err
+}
+
+// RenewLock extends a lock and reports its new expiry.
+func (o *Observed) RenewLock(path, agentID string, ttl time.Duration) (*model.Lock, error) {
+	l, err := o.StoreInterface.RenewLock(path, agentID, ttl)
+	if err == nil {
+		o.lock(LockRenewed, *l, "")
+	}
+	return l, err
+}
+
+// DepartAgent marks an agent departed and reports each lock it released.
+func (o *Observed) DepartAgent(agentID string) (*Departure, error) {
+	if o.hooks.OnLockChange == nil {
+		return o.StoreInterface.DepartAgent(agentID)
+	}
+	held, _ := o.StoreInterface.ListLocksForAgent(agentID)
+	d, err := o.StoreInterface.DepartAgent(agentID)
+	if err != nil {
+		return d, err
+	}
+	for _, l := range held {
+		if slices.Contains(d.Locks, l.Path) {
+			o.lock(LockReleased, l, "")
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// recorder collects what an Observed store reports.
+type recorder struct {
+	events []model.Event
+	locks  []LockChange
+}
+
+func (r *recorder) hooks() Hooks {
+	return Hooks{
+		OnInsertEvent: func(e model.Event) { r.events = append(r.events, e) },
+		OnLockChange:  func(c LockChange) { r.locks = append(r.locks, c) },
+	}
+}
+
+func TestObserve_Events(t *testing.T) {
+	var rec recorder
+	s := newTestStore(t)
+	o := Observe(s, rec.hooks())
+	o.RegisterAgent("alice")
+
+	id, err := o.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, Target: "bob", Body: "hi", CreatedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("InsertEvent: %v", err)
+	}
+	if len(rec.events) != 1 || rec.events[0].ID != id || rec.events[0].Body != "hi" {
+		t.Fatalf("events = %+v", rec.events)
+	}
+
+	if _, err := o.SyncAtomic("alice", 2, 1, 10, model.Provenance{}); err != nil {
+		t.Fatalf("SyncAtomic: %v", err)
+	}
+	if len(rec.events) != 2 || rec.events[1].Kind != model.EventProgress || rec.events[1].Epoch != 2 {
+		t.Fatalf("events = %+v", rec.events)
+	}
+
+	// Importing reports new events only, with their IDs.
+	rec.events = nil
+	fixture := importFixture()
+	if _, err := o.ImportEvents(fixture, true); err != nil {
+		t.Fatalf("ImportEvents: %v", err)
+	}
+	if len(rec.events) != len(fixture) || rec.events[0].ID == 0 {
+		t.Fatalf("imported events = %+v", rec.events)
+	}
+	rec.events = nil
+	if _, err := o.ImportEvents(fixture, true); err != nil || len(rec.events) != 0 {
+		t.Fatalf("duplicate import reported %+v, %v", rec.events, err)
+	}
+
+	// Failed writes report nothing; reads pass through.
+	if _, err := o.RenewLock("a.go", "alice", time.Hour); err == nil || len(rec.locks) != 0 {
+		t.Fatalf("renewing an unheld lock: err = %v, reported %+v", err, rec.locks)
+	}
+	if n := o.CountEvents(); n != s.CountEvents() {
+		t.Fatalf("CountEvents = %d, want %d", n, s.CountEvents())
+	}
+}
+
+func TestObserve_Locks(t *testing.T) {
+	var rec recorder
+	s := newTestStore(t)
+	o := Observe(s, rec.hooks())
+	for _, id := range []string{"alice", "bob"} {
+		o.RegisterAgent(id)
+	}
+
+	o.AcquireLock("a.go", "bob", 5, 0, true, time.Hour)
+	if _, conflict, _ := o.AcquireLock("a.go", "carol", 9, 0, true, time.Hour); conflict == nil {
+		t.Fatal("carol should lose to bob")
+	}
+	// alice's lower timestamp wins: bob is evicted.
+	o.AcquireLock("a.go", "alice", 3, 0, true, time.Hour)
+	o.RenewLock("a.go", "alice", 2*time.Hour)
+	o.ReleaseLock("a.go", "alice")
+	o.ReleaseLock("a.go", "alice") // no longer held: not reported
+	o.AcquireLock("b.go", "bob", 7, 0, true, time.Hour)
+	if _, err := o.DepartAgent("bob"); err != nil {
+		t.Fatalf("DepartAgent: %v", err)
+	}
+
+	want := []struct {
+		action LockAction
+		path   string
+		agent  string
+		by     string
+	}{
+		{LockAcquired, "a.go", "bob", ""},
+		{LockEvicted, "a.go", "bob", "alice"},
+		{LockAcquired, "a.go", "alice", ""},
+		{LockRenewed, "a.go", "alice", ""},
+		{LockReleased, "a.go", "alice", ""},
+		{LockAcquired, "b.go", "bob", ""},
+		{LockReleased, "b.go", "bob", ""},
+	}
+	if len(rec.locks) != len(want) {
+		t.Fatalf("lock changes = %+v", rec.locks)
+	}
+	for i, w := range want {
+		c := rec.locks[i]
+		if c.Action != w.action || c.Lock.Path != w.path || c.Lock.AgentID != w.agent || c.By != w.by {
+			t.Errorf("change %d = %+v, want %+v", i, c, w)
+		}
+	}
+	if rec.locks[3].Lock.ExpiresAt.Sub(rec.locks[2].Lock.ExpiresAt) < 30*time.Minute {
+		t.Errorf("renewal should report the new expiry: %v -> %v", rec.locks[2].Lock.ExpiresAt, rec.locks[3].Lock.ExpiresAt)
+	}
+}
+
+func TestObserve_Nested(t *testing.T) {
+	var inner, outer recorder
+	o := Observe(Observe(newTestStore(t), inner.hooks()), Hooks{OnInsertEvent: outer.hooks().OnInsertEvent})
+	o.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, CreatedAt: time.Now().UTC()})
+	o.AcquireLock("a.go", "alice", 2, 0, true, time.Hour)
+	if len(inner.events) != 1 || len(outer.events) != 1 || len(inner.locks) != 1 {
+		t.Fatalf("inner = %+v, outer = %+v", inner, outer)
+	}
+}
@@ -0,0 +1,99 @@
+// ownership.go keeps ownership claims: long-lived, advisory statements
+// that an agent looks after a file or directory. One agent owns a path at
+// a time; claims never expire and survive cm bye.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// ClaimOwnership records agentID as the owner of path. If another agent
+// owns exactly path, nothing changes and their claim is returned as the
+// second result, unless force, which takes the claim over. Claiming a
+// path you already own updates the note.
+func (s *Store) ClaimOwnership(path, agentID, note string, force bool) (*model.Ownership, *model.Ownership, error) {
+	o := &model.Ownership{Path: path, AgentID: agentID, Note: note, ClaimedAt: time.Now().UTC()}
+	var held *model.Ownership
+	err := retryOnContention(func() error {
+		held = nil
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		rows, err := tx.Query(`SELECT `+ownershipColumns+` FROM ownership WHERE path = ?`, path)
+		if err != nil {
+			return err
+		}
+		existing, err := scanOwnership(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 && existing[0].AgentID != agentID && !force {
+			held = &existing[0]
+			return nil
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO ownership (path, agent_id, note, claimed_at) VALUES (?, ?, ?, ?)
+			 ON CONFLICT(path) DO UPDATE SET
+			   agent_id = excluded.agent_id, note = excluded.note, claimed_at = excluded.claimed_at`,
+			path, agentID, note, o.ClaimedAt.Format(time.RFC3339Nano),
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil || held != nil {
+		return nil, held, err
+	}
+	return o, nil, nil
+}
+
+// ReleaseOwnership drops agentID's claim on path, reporting whether it
+// had one.
+func (s *Store) ReleaseOwnership(path, agentID string) (bool, error) {
+	var n int64
+	err := retryOnContention(func() error {
+		res, err := s.db.Exec(`DELETE FROM ownership WHERE path = ? AND agent_id = ?`, path, agentID)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return n > 0, err
+}
+
+// ListOwnership returns every claim, ordered by path.
+func (s *Store) ListOwnership() ([]model.Ownership, error) {
+	rows, err := s.db.Query(`SELECT ` + ownershipColumns + ` FROM ownership ORDER BY path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanOwnership(rows)
+}
+
+const ownershipColumns = `path, agent_id, note, claimed_at`
+
+func scanOwnership(rows *sql.Rows) ([]model.Ownership, error) {
+	var out []model.Ownership
+	for rows.Next() {
+		var o model.Ownership
+		var claimed string
+		if err := rows.Scan(&o.Path, &o.AgentID, &o.Note, &claimed); err != nil {
+			return nil, err
+		}
+		var err error
+		if o.ClaimedAt, err = time.Parse(time.RFC3339Nano, claimed); err != nil {
+			return nil, fmt.Errorf("parse claimed_at for %s: %w", o.Path, err)
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,28 @@
+package store
+
+import "testing"
+
+func TestOwnership(t *testing.T) {
+	s := newTestStore(t)
+	if o, held, err := s.ClaimOwnership("src/parser", "alice", "grammar", false); err != nil || held != nil || o.AgentID != "alice" {
+		t.Fatalf("claim = %+v, %+v, %v", o, held, err)
+	}
+	// Someone else's path: refused without force.
+	if o, held, err := s.ClaimOwnership("src/parser", "bob", "", false); err != nil || o != nil || held == nil || held.AgentID != "alice" || held.Note != "grammar" {
+		t.Fatalf("conflicting claim = %+v, %+v, %v", o, held, err)
+	}
+	if ok, _ := s.ReleaseOwnership("src/parser", "bob"); ok {
+		t.Fatal("bob released alice's claim")
+	}
+	if o, held, err := s.ClaimOwnership("src/parser", "bob", "", true); err != nil || held != nil || o.AgentID != "bob" {
+		t.Fatalf("forced claim = %+v, %+v, %v", o, held, err)
+	}
+	s.ClaimOwnership("docs", "alice", "", false)
+	all, err := s.ListOwnership()
+	if err != nil || len(all) != 2 || all[0].Path != "docs" || all[1].AgentID != "bob" {
+		t.Fatalf("ListOwnership = %+v, %v", all, err)
+	}
+	if ok, err := s.ReleaseOwnership("src/parser", "bob"); err != nil || !ok {
+		t.Fatalf("release = %v, %v", ok, err)
+	}
+}
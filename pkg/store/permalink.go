@@ -0,0 +1,145 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// Every event gets a row in the permalinks reference table when it is
+// written. CompactEvents keeps those rows and stores a snapshot of the
+// event in them, so a permalink quoted in a message or an archive still
+// resolves after the event itself has been deleted.
+
+// insertPermalink records link as a reference to eventID. A link that is
+// already known keeps its original target.
+func insertPermalink(db dbtx, link string, eventID int64) error {
+	_, err := db.Exec(
+		`INSERT INTO permalinks (link, event_id) VALUES (?, ?) ON CONFLICT(link) DO NOTHING`,
+		link, eventID,
+	)
+	return err
+}
+
+const insertEventSQL = `INSERT INTO events (agent_id, lamport_ts, epoch, round, kind, target, body, created_at, priority, tool, run_id, branch, signature, prev_hash)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// insertEvent inserts e at the head of the hash chain (see chain.go) with
+// its permalink, and updates the reviews table for review events. It
+// returns the new row ID.
+func (d dialect) insertEvent(db *txn, e *model.Event) (int64, error) {
+	if err := linkEvent(db, e); err != nil {
+		return 0, err
+	}
+	id, err := d.insertReturningID(db, insertEventSQL,
+		e.AgentID, e.LamportTS, e.Epoch, e.Round, string(e.Kind), e.Target, e.Body,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano), storedPriority(e.Priority), e.Tool, e.RunID, e.Branch, e.Signature, e.PrevHash,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if err := setChainHead(db, e.ChainHash()); err != nil {
+		return 0, fmt.Errorf("chain head: %w", err)
+	}
+	if err := insertPermalink(db, model.Permalink(e.AgentID, id, e.LamportTS), id); err != nil {
+		return 0, fmt.Errorf("permalink: %w", err)
+	}
+	if err := applyReviewEvent(db, e); err != nil {
+		return 0, fmt.Errorf("review: %w", err)
+	}
+	return id, nil
+}
+
+// backfillPermalinks adds references for events written before the
+// permalinks table existed.
+func backfillPermalinks(db dbtx) error {
+	rows, err := db.Query(
+		`SELECT e.id, e.agent_id, e.lamport_ts FROM events e
+		 LEFT JOIN permalinks p ON p.event_id = e.id
+		 WHERE p.event_id IS NULL`,
+	)
+	if err != nil {
+		return err
+	}
+	type ref struct {
+		id, ts  int64
+		agentID string
+	}
+	var refs []ref
+	for rows.Next() {
+		var r ref
+		if err := rows.Scan(&r.id, &r.agentID, &r.ts); err != nil {
+			rows.Close()
+			return err
+		}
+		refs = append(refs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if err := insertPermalink(db, model.Permalink(r.agentID, r.id, r.ts), r.id); err != nil {
+			return fmt.Errorf("backfill permalink for event %d: %w", r.id, err)
+		}
+	}
+	return nil
+}
+
+// snapshotPermalinks stores a copy of each event in its permalink rows
+// ahead of the event being deleted.
+func snapshotPermalinks(tx *txn, events []model.Event) error {
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE permalinks SET snapshot = ? WHERE event_id = ?`, string(data), e.ID); err != nil {
+			return fmt.Errorf("snapshot event %d: %w", e.ID, err)
+		}
+	}
+	return nil
+}
+
+// ResolvePermalink returns the event a permalink refers to. Events that
+// have since been compacted are returned from their snapshot. A link that
+// was never issued by this database returns sql.ErrNoRows.
+func (s *Store) ResolvePermalink(link string) (*model.Event, error) {
+	link = strings.ToLower(strings.TrimSpace(link))
+	var eventID int64
+	var snapshot string
+	if err := s.db.QueryRow(
+		`SELECT event_id, snapshot FROM permalinks WHERE link = ?`, link,
+	).Scan(&eventID, &snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot != "" {
+		var e model.Event
+		if err := json.Unmarshal([]byte(snapshot), &e); err != nil {
+			return nil, fmt.Errorf("decode snapshot for %s: %w", link, err)
+		}
+		return &e, nil
+	}
+
+	rows, err := s.db.Query(
+		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events WHERE id = ?`, eventID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events, err := scanEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &events[0], nil
+}
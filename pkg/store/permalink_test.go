@@ -0,0 +1,69 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestResolvePermalink_LiveEvent(t *testing.T) {
+	s := newTestStore(t)
+	id, _ := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 3, Kind: model.EventMsg, Target: "bob", Body: "hi", CreatedAt: time.Now().UTC()})
+
+	link := model.Permalink("alice", id, 3)
+	e, err := s.ResolvePermalink(link)
+	if err != nil {
+		t.Fatalf("ResolvePermalink: %v", err)
+	}
+	if e.ID != id || e.Body != "hi" || e.Permalink != link {
+		t.Fatalf("resolved %+v", e)
+	}
+	if _, err := s.ResolvePermalink("0000000000000000"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("unknown link: err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestResolvePermalink_SurvivesCompaction(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("bob")
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	id, _ := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, Target: "bob", Body: "old news", CreatedAt: old})
+	s.SetCursor("bob", 2)
+	s.InsertEvent(&model.Event{AgentID: "bob", LamportTS: 5, Kind: model.EventProgress, CreatedAt: time.Now().UTC()})
+
+	res, err := s.CompactEvents(CompactOptions{Before: time.Now().UTC().Add(-24 * time.Hour)})
+	if err != nil || res.Deleted != 1 {
+		t.Fatalf("CompactEvents = %+v, %v; want 1 deleted", res, err)
+	}
+
+	e, err := s.ResolvePermalink(model.Permalink("alice", id, 1))
+	if err != nil {
+		t.Fatalf("ResolvePermalink after compaction: %v", err)
+	}
+	if e.ID != id || e.Body != "old news" || !e.CreatedAt.Equal(old) {
+		t.Fatalf("snapshot = %+v", e)
+	}
+}
+
+func TestImportEvents_KeepsSourcePermalink(t *testing.T) {
+	s := newTestStore(t)
+	src := model.Event{ID: 99, AgentID: "alice", LamportTS: 4, Kind: model.EventMsg, Target: "bob", Body: "moved", CreatedAt: time.Now().UTC()}
+	src.Permalink = model.Permalink(src.AgentID, src.ID, src.LamportTS)
+
+	if _, err := s.ImportEvents([]model.Event{src}, false); err != nil {
+		t.Fatalf("ImportEvents: %v", err)
+	}
+	e, err := s.ResolvePermalink(src.Permalink)
+	if err != nil {
+		t.Fatalf("ResolvePermalink(source link): %v", err)
+	}
+	if e.Body != "moved" {
+		t.Fatalf("resolved %+v", e)
+	}
+	if _, err := s.ResolvePermalink(e.Permalink); err != nil {
+		t.Fatalf("ResolvePermalink(new link): %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// pool.go tunes how the store uses its database connections.
+//
+// The statements on the hot paths (event inserts, inbox reads and clock
+// updates) are prepared once when the store opens rather than parsed on
+// every call; conn and txn use the prepared form whenever they are asked
+// to run one of them.
+//
+// Under many concurrent agents, SQLite writers on separate connections
+// of one process mostly wait for each other in busy_timeout, and the
+// ones that give up surface as SQLITE_BUSY. With a dedicated writer, all
+// of the store's writes go through one connection that takes the write
+// lock as soon as a transaction begins, so writers in this process queue
+// in Go instead of contending inside SQLite. Reads keep using the pool.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultMaxOpenConns is the pool size a store opens with.
+const defaultMaxOpenConns = 4
+
+// PoolOptions controls the store's connections.
+type PoolOptions struct {
+	// MaxOpenConns caps the connections the pool may open; 0 keeps the
+	// default of 4.
+	MaxOpenConns int
+	// DedicatedWriter sends every write through a single connection of
+	// its own. Local SQLite only; PostgreSQL and libSQL ignore it.
+	DedicatedWriter bool
+}
+
+// PoolStats reports how busy the store's connections are.
+type PoolStats struct {
+	MaxOpenConns int           `json:"max_open_conns"`
+	Open         int           `json:"open"`
+	InUse        int           `json:"in_use"`
+	Idle         int           `json:"idle"`
+	WaitCount    int64         `json:"wait_count"`
+	WaitDuration time.Duration `json:"wait_duration"`
+	// Writer is the dedicated writer connection's stats, if there is one.
+	Writer *PoolStats `json:"writer,omitempty"`
+	// Prepared is how many statements are prepared.
+	Prepared int `json:"prepared"`
+}
+
+// SetPool applies opts to the store. Call it before the store is used
+// concurrently.
+func (s *Store) SetPool(opts PoolOptions) error {
+	c := s.db
+	hot := c.stmts != nil
+	n := opts.MaxOpenConns
+	if n <= 0 {
+		n = defaultMaxOpenConns
+	}
+	c.DB.SetMaxOpenConns(n)
+	c.DB.SetMaxIdleConns(min(n, 2))
+	if opts.DedicatedWriter && c.dialect == dialectSQLite && !c.remote && c.writer == nil {
+		w, err := sql.Open("sqlite", c.dsn+"&_txlock=immediate")
+		if err != nil {
+			return fmt.Errorf("open writer: %w", err)
+		}
+		w.SetMaxOpenConns(1)
+		w.SetMaxIdleConns(1)
+		w.SetConnMaxLifetime(30 * time.Minute)
+		c.writer = w
+	} else if !opts.DedicatedWriter && c.writer != nil {
+		c.closeStmts()
+		c.writer.Close()
+		c.writer = nil
+	}
+	if hot {
+		return c.prepareHot()
+	}
+	return nil
+}
+
+// PoolStats returns the store's connection statistics.
+func (s *Store) PoolStats() PoolStats {
+	st := poolStats(s.db.DB)
+	if s.db.writer != nil {
+		w := poolStats(s.db.writer)
+		st.Writer = &w
+	}
+	st.Prepared = len(s.db.stmts)
+	return st
+}
+
+func poolStats(db *sql.DB) PoolStats {
+	st := db.Stats()
+	return PoolStats{
+		MaxOpenConns: st.MaxOpenConnections, Open: st.OpenConnections, InUse: st.InUse, Idle: st.Idle,
+		WaitCount: st.WaitCount, WaitDuration: st.WaitDuration,
+	}
+}
+
+// hotStatements are the statements prepared when the store opens.
+func hotStatements(d dialect) []string {
+	insert := insertEventSQL
+	if d == dialectPostgres {
+		insert += " RETURNING id"
+	}
+	return []string{
+		insert,
+		updateAgentClockSQL,
+		advanceAgentClockSQL(d),
+		listInboxSQL,
+		listUnreadSQL(false),
+		listUnreadSQL(true),
+	}
+}
+
+// prepared is a statement prepared on one of the store's databases.
+type prepared struct {
+	stmt *sql.Stmt
+	db   *sql.DB
+}
+
+// prepareHot prepares hotStatements, each on the database that runs it,
+// replacing any prepared before.
+func (c *conn) prepareHot() error {
+	c.closeStmts()
+	stmts := make(map[string]prepared)
+	for _, q := range hotStatements(c.dialect) {
+		q = c.dialect.rebind(q)
+		db := c.dbFor(q)
+		st, err := db.Prepare(q)
+		if err != nil {
+			for _, p := range stmts {
+				p.stmt.Close()
+			}
+			return fmt.Errorf("prepare %.40q: %w", q, err)
+		}
+		stmts[q] = prepared{stmt: st, db: db}
+	}
+	c.stmts = stmts
+	return nil
+}
+
+func (c *conn) closeStmts() {
+	for _, p := range c.stmts {
+		p.stmt.Close()
+	}
+	c.stmts = nil
+}
+
+// dbFor returns the database that runs q: the writer for statements that
+// write, if there is one.
+func (c *conn) dbFor(q string) *sql.DB {
+	if c.writer != nil && isWrite(q) {
+		return c.writer
+	}
+	return c.DB
+}
+
+// isWrite reports whether q modifies the database.
+func isWrite(q string) bool {
+	q = strings.TrimSpace(q)
+	for _, verb := range []string{"INSERT", "UPDATE", "DELETE", "REPLACE"} {
+		if len(q) >= len(verb) && strings.EqualFold(q[:len(verb)], verb) {
+			return true
+		}
+	}
+	return false
+}
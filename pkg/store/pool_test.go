@@ -0,0 +1,64 @@
+package store
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSetPool(t *testing.T) {
+	s := newTestStore(t)
+	if st := s.PoolStats(); st.Prepared != len(hotStatements(dialectSQLite)) || st.Writer != nil {
+		t.Fatalf("PoolStats = %+v; want hot statements prepared, no writer", st)
+	}
+
+	if err := s.SetPool(PoolOptions{MaxOpenConns: 8, DedicatedWriter: true}); err != nil {
+		t.Fatal(err)
+	}
+	st := s.PoolStats()
+	if st.MaxOpenConns != 8 || st.Writer == nil || st.Writer.MaxOpenConns != 1 || st.Prepared == 0 {
+		t.Fatalf("PoolStats = %+v; want 8 conns and a one-connection writer", st)
+	}
+
+	// Concurrent writers all get through the single writer connection.
+	if _, err := s.RegisterAgent("alice"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				err := s.WithTx(func(tx TxStore) error {
+					ts, err := tx.TickAgent("alice")
+					if err == nil {
+						_, err = tx.InsertEvent(benchMsg("alice", "bob", ts))
+					}
+					return err
+				})
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("write through dedicated writer: %v", err)
+	}
+	if msgs, err := s.ListUnread("bob", "", 100); err != nil || len(msgs) != 40 {
+		t.Fatalf("ListUnread = %d messages, %v; want 40", len(msgs), err)
+	}
+	if a, _ := s.GetAgent("alice"); a.Clock != 40 {
+		t.Fatalf("alice's clock = %d, want 40", a.Clock)
+	}
+
+	if err := s.SetPool(PoolOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.PoolStats(); st.MaxOpenConns != defaultMaxOpenConns || st.Writer != nil || st.Prepared == 0 {
+		t.Fatalf("PoolStats after reset = %+v", st)
+	}
+}
@@ -1,4 +1,4 @@
-// retry.go provides automatic retry logic for transient SQLite errors.
+// retry.go provides automatic retry logic for transient database errors.
 //
 // Under high concurrency (4+ agents), WAL-mode SQLite can produce transient
 // errors like SQLITE_BUSY, SQLITE_LOCKED, and IOERR_SHORT_READ (error 522).
@@ -12,6 +12,7 @@ package store
 import (
 	"math/rand"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +30,22 @@ var defaultRetryConfig = retryConfig{
 	maxDelay:   500 * time.Millisecond,
 }
 
+// RetryStats counts contention retries made by every store in the
+// process since it started.
+type RetryStats struct {
+	// Retries is how many times an operation was retried.
+	Retries int64 `json:"retries"`
+	// GaveUp is how many operations still failed after the last retry.
+	GaveUp int64 `json:"gave_up"`
+}
+
+var retries, gaveUp atomic.Int64
+
+// Retries returns the process's contention retry counts.
+func Retries() RetryStats {
+	return RetryStats{Retries: retries.Load(), GaveUp: gaveUp.Load()}
+}
+
 // isTransientSQLiteErr returns true if the error is a transient SQLite error
 // that can be resolved by retrying. This includes:
 //   - SQLITE_BUSY (5) — another connection holds a lock
@@ -58,6 +75,27 @@ func isTransientSQLiteErr(err error) bool {
 	return false
 }
 
+// isTransientPostgresErr returns true for PostgreSQL errors that a retry
+// can resolve: serialization failures (40001), deadlocks (40P01), and
+// lock-acquisition timeouts (55P03).
+func isTransientPostgresErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, code := range []string{"SQLSTATE 40001", "SQLSTATE 40P01", "SQLSTATE 55P03"} {
+		if strings.Contains(msg, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientErr reports whether err is transient on either backend.
+func isTransientErr(err error) bool {
+	return isTransientSQLiteErr(err) || isTransientPostgresErr(err)
+}
+
 // retryOp executes fn with exponential backoff + jitter for transient errors.
 // If fn succeeds or returns a non-transient error, it returns immediately.
 func retryOp(cfg retryConfig, fn func() error) error {
@@ -67,14 +105,18 @@ func retryOp(cfg retryConfig, fn func() error) error {
 		if lastErr == nil {
 			return nil
 		}
-		if !isTransientSQLiteErr(lastErr) {
+		if !isTransientErr(lastErr) {
 			return lastErr
 		}
 		if attempt < cfg.maxRetries {
 			delay := backoffDelay(cfg, attempt)
+			logger.Debug("contention, retrying", "attempt", attempt+1, "delay", delay, "err", lastErr)
+			retries.Add(1)
 			time.Sleep(delay)
 		}
 	}
+	gaveUp.Add(1)
+	logger.Warn("contention, giving up", "attempts", cfg.maxRetries+1, "err", lastErr)
 	return lastErr
 }
 
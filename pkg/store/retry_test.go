@@ -1,7 +1,10 @@
 package store
 
 import (
+	"bytes"
 	"errors"
+	"log/slog"
+	"strings"
 	"testing"
 	"time"
 )
@@ -97,6 +100,33 @@ func TestRetryOpExhaustsRetries(t *testing.T) {
 	}
 }
 
+func TestRetryOpLogsContention(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { SetLogger(nil) })
+
+	cfg := retryConfig{maxRetries: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	retryOp(cfg, func() error { return errors.New("database is locked") })
+	out := buf.String()
+	for _, want := range []string{`level=DEBUG msg="contention, retrying" attempt=1`, `level=WARN msg="contention, giving up" attempts=2`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %q:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.UpdateAgentClock("alice", 7, 2, 1)
+	s.SetCursor("alice", 8)
+	out = buf.String()
+	for _, want := range []string{`msg="clock updated" agent=alice clock=7 epoch=2 round=1`, `msg="cursor moved" agent=alice since_ts=8`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %q:\n%s", want, out)
+		}
+	}
+}
+
 func TestRetryOpIOERRShortRead(t *testing.T) {
 	calls := 0
 	cfg := retryConfig{maxRetries: 2, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond}
@@ -0,0 +1,235 @@
+// review.go keeps the reviews table: one row per (commit, reviewer),
+// maintained from review_req and review_done events as they are written,
+// so outstanding reviews can be listed without scanning the event log.
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// reviewBody is the part of a review event body the store reads. It
+// matches the payload written by cm review-request and cm review-done.
+type reviewBody struct {
+	Commit  string   `json:"commit"`
+	Files   []string `json:"files"`
+	Verdict string   `json:"verdict"`
+	Comment string   `json:"comment"`
+}
+
+// applyReviewEvent updates the reviews table for a review event. Other
+// events, and review events whose body carries no commit, are ignored.
+//
+// A request opens (or reopens) a pending review for its target. A verdict
+// closes the reviewer's review of the commit; the commit may be given as
+// a prefix of the requested SHA or vice versa. A verdict nobody asked for
+// gets a row of its own with no requester. Older events never overwrite
+// newer ones, so replaying a log out of order gives the same table.
+func applyReviewEvent(db dbtx, e *model.Event) error {
+	if e.Kind != model.EventReviewReq && e.Kind != model.EventReviewDone {
+		return nil
+	}
+	var b reviewBody
+	if err := json.Unmarshal([]byte(e.Body), &b); err != nil || b.Commit == "" {
+		return nil
+	}
+	at := e.CreatedAt.UTC().Format(time.RFC3339Nano)
+
+	if e.Kind == model.EventReviewReq {
+		if e.Target == "" {
+			return nil
+		}
+		_, err := db.Exec(
+			`INSERT INTO reviews (commit_sha, reviewer, requested_by, state, files, comment, request_ts, verdict_ts, requested_at, updated_at)
+			 VALUES (?, ?, ?, ?, ?, '', ?, 0, ?, ?)
+			 ON CONFLICT(commit_sha, reviewer) DO UPDATE SET
+			   requested_by = excluded.requested_by, state = excluded.state, files = excluded.files,
+			   comment = '', request_ts = excluded.request_ts,
+			   requested_at = excluded.requested_at, updated_at = excluded.updated_at
+			 WHERE reviews.request_ts <= excluded.request_ts AND reviews.verdict_ts < excluded.request_ts`,
+			b.Commit, e.Target, e.AgentID, string(model.ReviewPending), strings.Join(b.Files, "\n"),
+			e.LamportTS, at, at,
+		)
+		return err
+	}
+
+	var state model.ReviewState
+	switch strings.ToLower(b.Verdict) {
+	case "pass":
+		state = model.ReviewPassed
+	case "fail":
+		state = model.ReviewFailed
+	case "changes":
+		state = model.ReviewChangesRequested
+	default:
+		return nil
+	}
+	commit, err := requestedCommit(db, e.AgentID, b.Commit)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO reviews (commit_sha, reviewer, requested_by, state, files, comment, request_ts, verdict_ts, requested_at, updated_at)
+		 VALUES (?, ?, '', ?, '', ?, 0, ?, ?, ?)
+		 ON CONFLICT(commit_sha, reviewer) DO UPDATE SET
+		   state = excluded.state, comment = excluded.comment,
+		   verdict_ts = excluded.verdict_ts, updated_at = excluded.updated_at
+		 WHERE reviews.verdict_ts <= excluded.verdict_ts AND reviews.request_ts < excluded.verdict_ts`,
+		commit, e.AgentID, string(state), b.Comment, e.LamportTS, at, at,
+	)
+	return err
+}
+
+// requestedCommit finds the commit of reviewer's review that commit
+// refers to: an exact match, or the longest SHA of which one is a prefix
+// of the other. Without one, commit is returned unchanged.
+func requestedCommit(db dbtx, reviewer, commit string) (string, error) {
+	rows, err := db.Query(`SELECT commit_sha FROM reviews WHERE reviewer = ?`, reviewer)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	best := ""
+	for rows.Next() {
+		var sha string
+		if err := rows.Scan(&sha); err != nil {
+			return "", err
+		}
+		if sha == commit {
+			return sha, nil
+		}
+		if (strings.HasPrefix(sha, commit) || strings.HasPrefix(commit, sha)) && len(sha) > len(best) {
+			best = sha
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if best == "" {
+		return commit, nil
+	}
+	return best, nil
+}
+
+// backfillReviews builds the reviews table from the event log for
+// databases written before it existed. It does nothing once the table has
+// rows.
+func backfillReviews(db dbtx) error {
+	var n int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM reviews`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	rows, err := db.Query(
+		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events WHERE kind IN ('review_req', 'review_done') ORDER BY id`,
+	)
+	if err != nil {
+		return err
+	}
+	events, err := scanEvents(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		if err := applyReviewEvent(db, &events[i]); err != nil {
+			return fmt.Errorf("backfill review from event %d: %w", events[i].ID, err)
+		}
+	}
+	return nil
+}
+
+const reviewColumns = `commit_sha, reviewer, requested_by, state, files, comment,
+	request_ts, verdict_ts, requested_at, updated_at`
+
+// ListReviews returns the reviews of commits starting with commit (all
+// reviews if commit is empty), oldest request first.
+func (s *Store) ListReviews(commit string) ([]model.Review, error) {
+	rows, err := s.db.Query(
+		`SELECT `+reviewColumns+` FROM reviews WHERE commit_sha LIKE ? ESCAPE '\'
+		 ORDER BY requested_at ASC, commit_sha ASC, reviewer ASC`,
+		strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(commit)+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanReviews(rows)
+}
+
+// PendingReviews returns the reviews waiting on reviewer, oldest request
+// first.
+func (s *Store) PendingReviews(reviewer string) ([]model.Review, error) {
+	rows, err := s.db.Query(
+		`SELECT `+reviewColumns+` FROM reviews WHERE reviewer = ? AND state = ?
+		 ORDER BY request_ts ASC, commit_sha ASC`,
+		reviewer, string(model.ReviewPending),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanReviews(rows)
+}
+
+// ReviewEvents returns the review events workflow rules evaluate, newest
+// first: the review requests sent by requester (by any agent if empty)
+// and the latest verdict of each review in the reviews table. Earlier
+// verdicts on the same review are left out, since only the latest can
+// decide a rule, so the result grows with the number of reviews rather
+// than with the event log.
+func (s *Store) ReviewEvents(requester string) ([]model.Event, error) {
+	const cols = `e.id, e.agent_id, e.lamport_ts, e.epoch, e.round, e.kind,
+	        COALESCE(e.target,''), COALESCE(e.body,''), e.created_at, e.priority, e.tool, e.run_id, e.branch, e.signature, e.prev_hash`
+	q := `SELECT ` + cols + ` FROM events e WHERE e.kind = 'review_req'`
+	var args []interface{}
+	if requester != "" {
+		q += ` AND e.agent_id = ?`
+		args = append(args, requester)
+	}
+	q += ` UNION ALL
+	 SELECT ` + cols + ` FROM reviews r
+	 JOIN events e ON e.agent_id = r.reviewer AND e.lamport_ts = r.verdict_ts AND e.kind = 'review_done'
+	 WHERE r.verdict_ts > 0
+	 ORDER BY lamport_ts DESC, id DESC`
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEvents(rows)
+}
+
+func scanReviews(rows *sql.Rows) ([]model.Review, error) {
+	var out []model.Review
+	for rows.Next() {
+		var r model.Review
+		var state, files, requested, updated string
+		if err := rows.Scan(&r.Commit, &r.Reviewer, &r.RequestedBy, &state, &files, &r.Comment,
+			&r.RequestTS, &r.VerdictTS, &requested, &updated); err != nil {
+			return nil, err
+		}
+		r.State = model.ReviewState(state)
+		if files != "" {
+			r.Files = strings.Split(files, "\n")
+		}
+		var err error
+		if r.RequestedAt, err = time.Parse(time.RFC3339Nano, requested); err != nil {
+			return nil, fmt.Errorf("parse requested_at for %s: %w", r.Commit, err)
+		}
+		if r.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+			return nil, fmt.Errorf("parse updated_at for %s: %w", r.Commit, err)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
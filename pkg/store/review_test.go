@@ -0,0 +1,158 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func reviewEvent(agent string, ts int64, kind model.EventKind, target, body string) *model.Event {
+	return &model.Event{AgentID: agent, LamportTS: ts, Kind: kind, Target: target, Body: body, CreatedAt: time.Now().UTC()}
+}
+
+func TestReviews_RequestAndVerdict(t *testing.T) {
+	s := newTestStore(t)
+	s.InsertEvent(reviewEvent("alice", 3, model.EventReviewReq, "tester", `{"type":"review-request","commit":"abc1234def","files":["a.go","b.go"]}`))
+	s.InsertEvent(reviewEvent("alice", 3, model.EventReviewReq, "bob", `{"type":"review-request","commit":"abc1234def"}`))
+
+	pending, err := s.PendingReviews("tester")
+	if err != nil {
+		t.Fatalf("PendingReviews: %v", err)
+	}
+	if len(pending) != 1 || pending[0].RequestedBy != "alice" || pending[0].RequestTS != 3 ||
+		len(pending[0].Files) != 2 || pending[0].Files[1] != "b.go" {
+		t.Fatalf("pending = %+v", pending)
+	}
+
+	// The verdict names a short SHA and is sent to every agent: one event
+	// per recipient, all applied.
+	for _, to := range []string{"alice", "bob"} {
+		s.InsertEvent(reviewEvent("tester", 6, model.EventReviewDone, to, `{"type":"review-done","commit":"abc1234","verdict":"fail","comment":"nil deref"}`))
+	}
+	if pending, _ := s.PendingReviews("tester"); len(pending) != 0 {
+		t.Fatalf("tester's review should be closed, got %+v", pending)
+	}
+	reviews, err := s.ListReviews("abc")
+	if err != nil {
+		t.Fatalf("ListReviews: %v", err)
+	}
+	if len(reviews) != 2 {
+		t.Fatalf("reviews = %+v", reviews)
+	}
+	var tr model.Review
+	for _, r := range reviews {
+		if r.Reviewer == "tester" {
+			tr = r
+		}
+	}
+	if tr.Commit != "abc1234def" || tr.State != model.ReviewFailed || tr.Comment != "nil deref" || tr.VerdictTS != 6 {
+		t.Fatalf("tester's review = %+v", tr)
+	}
+
+	// A new request after the fix reopens the review; the pass closes it.
+	s.InsertEvent(reviewEvent("alice", 8, model.EventReviewReq, "tester", `{"type":"review-request","commit":"abc1234def"}`))
+	if pending, _ := s.PendingReviews("tester"); len(pending) != 1 || pending[0].Comment != "" {
+		t.Fatalf("re-request should reopen the review, got %+v", pending)
+	}
+	s.InsertEvent(reviewEvent("tester", 10, model.EventReviewDone, "alice", `{"type":"review-done","commit":"abc1234def","verdict":"pass"}`))
+	reviews, _ = s.ListReviews("abc1234def")
+	for _, r := range reviews {
+		if r.Reviewer == "tester" && r.State != model.ReviewPassed {
+			t.Fatalf("tester's review = %+v", r)
+		}
+	}
+
+	// A late-arriving (older) request does not reopen it.
+	s.InsertEvent(reviewEvent("alice", 4, model.EventReviewReq, "tester", `{"type":"review-request","commit":"abc1234def"}`))
+	if pending, _ := s.PendingReviews("tester"); len(pending) != 0 {
+		t.Fatalf("older request should not reopen the review, got %+v", pending)
+	}
+}
+
+func TestReviews_UnrequestedAndMalformed(t *testing.T) {
+	s := newTestStore(t)
+	s.InsertEvent(reviewEvent("carol", 2, model.EventReviewDone, "alice", `{"commit":"ffff","verdict":"pass"}`))
+	s.InsertEvent(reviewEvent("carol", 3, model.EventReviewDone, "alice", `not json`))
+	s.InsertEvent(reviewEvent("carol", 4, model.EventReviewReq, "bob", `{"files":["x.go"]}`))
+
+	reviews, err := s.ListReviews("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reviews) != 1 || reviews[0].Reviewer != "carol" || reviews[0].RequestedBy != "" || reviews[0].State != model.ReviewPassed {
+		t.Fatalf("reviews = %+v", reviews)
+	}
+}
+
+func TestReviews_Backfill(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	s, err := New(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.InsertEvent(reviewEvent("alice", 1, model.EventReviewReq, "tester", `{"commit":"abc"}`))
+	// Simulate a database from before the reviews table (and versioning).
+	for _, q := range []string{`DELETE FROM reviews`, `DROP TABLE schema_version`} {
+		if _, err := s.db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	s, err = New(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if pending, _ := s.PendingReviews("tester"); len(pending) != 1 || pending[0].Commit != "abc" {
+		t.Fatalf("reopening should rebuild reviews from the log, got %+v", pending)
+	}
+}
+
+func TestReviews_ChangesRequested(t *testing.T) {
+	s := newTestStore(t)
+	s.InsertEvent(reviewEvent("alice", 2, model.EventReviewReq, "tester", `{"type":"review-request","commit":"c0ffee"}`))
+	s.InsertEvent(reviewEvent("tester", 4, model.EventReviewDone, "alice",
+		`{"type":"review-done","commit":"c0ffee","verdict":"changes","comment":"see notes","comments":[{"file":"a.go","line":3,"body":"nil check"}]}`))
+
+	reviews, err := s.ListReviews("c0ffee")
+	if err != nil {
+		t.Fatalf("ListReviews: %v", err)
+	}
+	if len(reviews) != 1 || reviews[0].State != model.ReviewChangesRequested || reviews[0].Comment != "see notes" {
+		t.Fatalf("reviews = %+v", reviews)
+	}
+	if pending, _ := s.PendingReviews("tester"); len(pending) != 0 {
+		t.Fatalf("requesting changes should close the review, got %+v", pending)
+	}
+}
+
+func TestReviews_ReviewEvents(t *testing.T) {
+	s := newTestStore(t)
+	s.InsertEvent(reviewEvent("alice", 2, model.EventReviewReq, "tester", `{"commit":"abc1234def"}`))
+	s.InsertEvent(reviewEvent("bob", 3, model.EventReviewReq, "tester", `{"commit":"fff0000"}`))
+	s.InsertEvent(reviewEvent("tester", 5, model.EventReviewDone, "alice", `{"commit":"abc1234","verdict":"fail"}`))
+	s.InsertEvent(reviewEvent("tester", 7, model.EventReviewDone, "alice", `{"commit":"abc1234","verdict":"pass"}`))
+	s.InsertEvent(reviewEvent("alice", 8, model.EventMsg, "bob", "unrelated"))
+
+	events, err := s.ReviewEvents("alice")
+	if err != nil {
+		t.Fatalf("ReviewEvents: %v", err)
+	}
+	// Newest first: the latest verdict, then alice's request. bob's
+	// request, the superseded fail and the message are left out.
+	if len(events) != 2 || events[0].LamportTS != 7 || events[0].Kind != model.EventReviewDone ||
+		events[1].LamportTS != 2 || events[1].AgentID != "alice" {
+		t.Fatalf("events = %+v", events)
+	}
+
+	all, err := s.ReviewEvents("")
+	if err != nil {
+		t.Fatalf("ReviewEvents: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("all = %+v", all)
+	}
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// SetRoles replaces the roles agentID holds. Pass the output of
+// model.ParseRoles; an empty list clears them. Granting or revoking the
+// admin role is privileged (see admin.go).
+func (s *Store) SetRoles(agentID string, roles []string) error {
+	return retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		var wasAdmin int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM roles WHERE agent_id = ? AND role = ?`,
+			agentID, model.RoleAdmin).Scan(&wasAdmin); err != nil {
+			return err
+		}
+		change := ""
+		switch isAdmin := slices.Contains(roles, model.RoleAdmin); {
+		case isAdmin && wasAdmin == 0:
+			change = "granted admin to " + agentID
+		case !isAdmin && wasAdmin > 0:
+			change = "revoked admin from " + agentID
+		}
+		if change != "" {
+			if err := s.authorize(tx, "admin_role"); err != nil {
+				return err
+			}
+			if err := s.logPrivileged(tx, "admin_role", change); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM roles WHERE agent_id = ?`, agentID); err != nil {
+			return err
+		}
+		for _, r := range roles {
+			if _, err := tx.Exec(`INSERT INTO roles (agent_id, role) VALUES (?, ?)`, agentID, r); err != nil {
+				return fmt.Errorf("add role %q: %w", r, err)
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// AgentsWithRole returns the registered, non-departed agents holding
+// role, ordered by ID.
+func (s *Store) AgentsWithRole(role string) ([]string, error) {
+	rows, err := s.db.Query(
+		`SELECT r.agent_id FROM roles r JOIN agents a ON a.id = r.agent_id
+		 WHERE r.role = ? AND a.departed_at = '' ORDER BY r.agent_id`, role,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// attachRoles fills in Roles for each agent. With a non-empty agentID
+// only that agent's roles are loaded.
+func (s *Store) attachRoles(agents []model.Agent, agentID string) error {
+	q := `SELECT agent_id, role FROM roles`
+	var args []interface{}
+	if agentID != "" {
+		q += ` WHERE agent_id = ?`
+		args = append(args, agentID)
+	}
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return fmt.Errorf("load roles: %w", err)
+	}
+	defer rows.Close()
+	roles := make(map[string][]string)
+	for rows.Next() {
+		var id, r string
+		if err := rows.Scan(&id, &r); err != nil {
+			return err
+		}
+		roles[id] = append(roles[id], r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range agents {
+		list := roles[agents[i].ID]
+		sort.Strings(list)
+		agents[i].Roles = list
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	if err := s.SetRoles("alice", []string{"planner", "tester"}); err != nil {
+		t.Fatalf("SetRoles: %v", err)
+	}
+	s.SetRoles("bob", []string{"tester"})
+
+	if ids, err := s.AgentsWithRole("tester"); err != nil || strings.Join(ids, ",") != "alice,bob" {
+		t.Fatalf("testers = %v, %v", ids, err)
+	}
+	ag, _ := s.GetAgent("alice")
+	if strings.Join(ag.Roles, ",") != "planner,tester" {
+		t.Fatalf("GetAgent roles = %v", ag.Roles)
+	}
+	agents, _ := s.ListAgents()
+	if len(agents) != 2 || strings.Join(agents[1].Roles, ",") != "tester" {
+		t.Fatalf("ListAgents = %+v", agents)
+	}
+
+	// Departed agents are not addressable.
+	s.DepartAgent("bob")
+	if ids, _ := s.AgentsWithRole("tester"); strings.Join(ids, ",") != "alice" {
+		t.Fatalf("testers after bob left = %v", ids)
+	}
+	s.SetRoles("alice", nil)
+	if ids, _ := s.AgentsWithRole("planner"); len(ids) != 0 {
+		t.Fatalf("planners after clearing = %v", ids)
+	}
+}
@@ -0,0 +1,196 @@
+// saga.go persists sagas: multi-step coordinated operations whose steps
+// carry compensation instructions, so any agent can unwind a saga whose
+// owner failed mid-flight.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// BeginSaga opens a new saga owned by agentID.
+func (s *Store) BeginSaga(id, agentID, name string) (*model.Saga, error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	err := retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO sagas (id, agent_id, name, status, created_at, updated_at)
+			 VALUES (?, ?, ?, ?, ?, ?)`,
+			id, agentID, name, string(model.SagaOpen), now, now,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetSaga(id)
+}
+
+// AddSagaStep appends a step to an open saga. The step's Seq is assigned
+// by the store. Returns an error if the saga does not exist or is closed.
+func (s *Store) AddSagaStep(sagaID string, step model.SagaStep) (*model.SagaStep, error) {
+	if step.CreatedAt.IsZero() {
+		step.CreatedAt = time.Now().UTC()
+	}
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := tx.advisoryLock("clockmail:saga:" + sagaID); err != nil {
+			return err
+		}
+
+		var status string
+		if err := tx.QueryRow(`SELECT status FROM sagas WHERE id = ?`, sagaID).Scan(&status); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("saga %q not found", sagaID)
+			}
+			return err
+		}
+		if model.SagaStatus(status) != model.SagaOpen {
+			return fmt.Errorf("saga %q is %s", sagaID, status)
+		}
+		if err := tx.QueryRow(
+			`SELECT COALESCE(MAX(seq), 0) + 1 FROM saga_steps WHERE saga_id = ?`, sagaID,
+		).Scan(&step.Seq); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO saga_steps (saga_id, seq, agent_id, action, compensation, locks, lamport_ts, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			sagaID, step.Seq, step.AgentID, step.Action, step.Compensation,
+			strings.Join(step.Locks, "\n"), step.LamportTS, step.CreatedAt.Format(time.RFC3339Nano),
+		); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE sagas SET updated_at = ? WHERE id = ?`,
+			step.CreatedAt.Format(time.RFC3339Nano), sagaID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &step, nil
+}
+
+// FinishSaga moves an open saga to status (committed or aborted) and
+// returns it with its steps. Only one agent can finish a saga: a second
+// commit or abort fails.
+func (s *Store) FinishSaga(sagaID string, status model.SagaStatus) (*model.Saga, error) {
+	if status != model.SagaCommitted && status != model.SagaAborted {
+		return nil, fmt.Errorf("invalid final saga status %q", status)
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var affected int64
+	err := retryOnContention(func() error {
+		res, err := s.db.Exec(
+			`UPDATE sagas SET status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+			string(status), now, sagaID, string(model.SagaOpen),
+		)
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	saga, err := s.GetSaga(sagaID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("saga %q not found", sagaID)
+		}
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, fmt.Errorf("saga %q is already %s", sagaID, saga.Status)
+	}
+	return saga, nil
+}
+
+// GetSaga returns a saga and its steps in order.
+func (s *Store) GetSaga(id string) (*model.Saga, error) {
+	var g model.Saga
+	var status, created, updated string
+	if err := s.db.QueryRow(
+		`SELECT id, agent_id, name, status, created_at, updated_at FROM sagas WHERE id = ?`, id,
+	).Scan(&g.ID, &g.AgentID, &g.Name, &status, &created, &updated); err != nil {
+		return nil, err
+	}
+	g.Status = model.SagaStatus(status)
+	var err error
+	if g.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+		return nil, fmt.Errorf("parse created_at for saga %s: %w", id, err)
+	}
+	if g.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+		return nil, fmt.Errorf("parse updated_at for saga %s: %w", id, err)
+	}
+
+	rows, err := s.db.Query(
+		`SELECT seq, agent_id, action, compensation, locks, lamport_ts, created_at
+		 FROM saga_steps WHERE saga_id = ? ORDER BY seq ASC`, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var st model.SagaStep
+		var locks, createdStr string
+		if err := rows.Scan(&st.Seq, &st.AgentID, &st.Action, &st.Compensation, &locks,
+			&st.LamportTS, &createdStr); err != nil {
+			return nil, err
+		}
+		if locks != "" {
+			st.Locks = strings.Split(locks, "\n")
+		}
+		if st.CreatedAt, err = time.Parse(time.RFC3339Nano, createdStr); err != nil {
+			return nil, fmt.Errorf("parse created_at for saga %s step %d: %w", id, st.Seq, err)
+		}
+		g.Steps = append(g.Steps, st)
+	}
+	return &g, rows.Err()
+}
+
+// ListSagas returns sagas ordered by creation time, optionally only the
+// open ones. Steps are not loaded; use GetSaga for details.
+func (s *Store) ListSagas(openOnly bool) ([]model.Saga, error) {
+	query := `SELECT id, agent_id, name, status, created_at, updated_at FROM sagas`
+	var args []interface{}
+	if openOnly {
+		query += ` WHERE status = ?`
+		args = append(args, string(model.SagaOpen))
+	}
+	rows, err := s.db.Query(query+` ORDER BY created_at ASC, id ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sagas []model.Saga
+	for rows.Next() {
+		var g model.Saga
+		var status, created, updated string
+		if err := rows.Scan(&g.ID, &g.AgentID, &g.Name, &status, &created, &updated); err != nil {
+			return nil, err
+		}
+		g.Status = model.SagaStatus(status)
+		var parseErr error
+		if g.CreatedAt, parseErr = time.Parse(time.RFC3339Nano, created); parseErr != nil {
+			return nil, fmt.Errorf("parse created_at for saga %s: %w", g.ID, parseErr)
+		}
+		if g.UpdatedAt, parseErr = time.Parse(time.RFC3339Nano, updated); parseErr != nil {
+			return nil, fmt.Errorf("parse updated_at for saga %s: %w", g.ID, parseErr)
+		}
+		sagas = append(sagas, g)
+	}
+	return sagas, rows.Err()
+}
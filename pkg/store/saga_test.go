@@ -0,0 +1,84 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestSaga_Lifecycle(t *testing.T) {
+	s := newTestStore(t)
+	g, err := s.BeginSaga("alice-1", "alice", "refactor")
+	if err != nil {
+		t.Fatalf("BeginSaga: %v", err)
+	}
+	if g.Status != model.SagaOpen || g.Name != "refactor" {
+		t.Fatalf("new saga = %+v", g)
+	}
+
+	st1, err := s.AddSagaStep("alice-1", model.SagaStep{AgentID: "alice", Action: "lock", Locks: []string{"a.go", "b.go"}, LamportTS: 2})
+	if err != nil {
+		t.Fatalf("AddSagaStep: %v", err)
+	}
+	st2, _ := s.AddSagaStep("alice-1", model.SagaStep{AgentID: "bob", Action: "commit", Compensation: "git revert x", LamportTS: 5})
+	if st1.Seq != 1 || st2.Seq != 2 {
+		t.Fatalf("seqs = %d, %d; want 1, 2", st1.Seq, st2.Seq)
+	}
+
+	g, err = s.GetSaga("alice-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Steps) != 2 || strings.Join(g.Steps[0].Locks, ",") != "a.go,b.go" || g.Steps[1].Compensation != "git revert x" {
+		t.Fatalf("steps = %+v", g.Steps)
+	}
+	comp := g.Compensations()
+	if comp[0].Seq != 2 || comp[1].Seq != 1 {
+		t.Fatalf("compensations should run last step first, got %d, %d", comp[0].Seq, comp[1].Seq)
+	}
+
+	done, err := s.FinishSaga("alice-1", model.SagaAborted)
+	if err != nil || done.Status != model.SagaAborted {
+		t.Fatalf("FinishSaga: %+v, %v", done, err)
+	}
+}
+
+func TestSaga_ClosedRejectsChanges(t *testing.T) {
+	s := newTestStore(t)
+	s.BeginSaga("alice-1", "alice", "")
+	if _, err := s.FinishSaga("alice-1", model.SagaCommitted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddSagaStep("alice-1", model.SagaStep{AgentID: "alice", Action: "late"}); err == nil {
+		t.Error("step on committed saga should fail")
+	}
+	if _, err := s.FinishSaga("alice-1", model.SagaAborted); err == nil {
+		t.Error("aborting a committed saga should fail")
+	}
+	if _, err := s.FinishSaga("nope", model.SagaAborted); err == nil {
+		t.Error("finishing a missing saga should fail")
+	}
+	if _, err := s.FinishSaga("alice-1", model.SagaOpen); err == nil {
+		t.Error("open is not a final status")
+	}
+}
+
+func TestListSagas_OpenOnly(t *testing.T) {
+	s := newTestStore(t)
+	s.BeginSaga("a-1", "alice", "")
+	s.BeginSaga("b-1", "bob", "")
+	s.FinishSaga("a-1", model.SagaCommitted)
+
+	open, err := s.ListSagas(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 1 || open[0].ID != "b-1" {
+		t.Fatalf("open sagas = %+v, want b-1 only", open)
+	}
+	all, _ := s.ListSagas(false)
+	if len(all) != 2 {
+		t.Fatalf("all sagas = %d, want 2", len(all))
+	}
+}
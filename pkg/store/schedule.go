@@ -0,0 +1,63 @@
+// schedule.go holds messages back from their recipients until a time has
+// passed or the frontier has moved past a timestamp (cm send
+// --deliver-after, --deliver-at-epoch, --when-safe). A held message is in the log from the start, at
+// its sender's timestamp; the inbox queries leave it out until
+// visibleCond holds. Its recipient's cursor may move past it meanwhile,
+// so once released it counts as unread until it has been delivered,
+// wherever the cursor is (see unreadCond).
+package store
+
+import (
+	"math"
+	"time"
+)
+
+// Schedule is when a held message becomes visible to its recipient: once
+// After has passed, if set, and, if HasEpoch, once (Epoch, Round) is safe
+// as cm gate sees it: every active agent other than the sender has moved
+// past it. A Round of math.MaxInt64 waits for the whole epoch.
+type Schedule struct {
+	After    time.Time `json:"after,omitempty"`
+	Epoch    int64     `json:"epoch,omitempty"`
+	Round    int64     `json:"round,omitempty"`
+	HasEpoch bool      `json:"has_epoch,omitempty"`
+}
+
+// visibleCond is the SQL condition, on events aliased e, for an event that
+// is not held back and is in the store's branch namespace (see SetBranch).
+// It takes visibleArgs. Agents count toward the frontier as they do for
+// GetActivePointstamps, within the store's ActiveWindow.
+const visibleCond = `NOT EXISTS (SELECT 1 FROM schedules sc WHERE sc.event_id = e.id
+	AND (sc.deliver_after > ? OR (sc.deliver_epoch >= 0 AND EXISTS (
+		SELECT 1 FROM agents a WHERE a.id <> e.agent_id AND a.departed_at = '' AND a.last_seen >= ?
+		  AND (a.epoch < sc.deliver_epoch OR (a.epoch = sc.deliver_epoch AND a.round <= sc.deliver_round))))))
+	AND (? = '' OR e.branch = '' OR e.branch = ?)`
+
+// visibleArgs are the arguments of visibleCond at now.
+func (s *Store) visibleArgs(now time.Time) []interface{} {
+	return []interface{}{
+		now.UTC().Format(time.RFC3339Nano),
+		now.Add(-s.ActiveWindow()).UTC().Format(time.RFC3339Nano),
+		s.viewBranch(), s.viewBranch(),
+	}
+}
+
+func scheduleDeliveries(db dbtx, ids []int64, sc Schedule) error {
+	var after string
+	if !sc.After.IsZero() {
+		after = sc.After.UTC().Format(time.RFC3339Nano)
+	}
+	epoch, round := int64(-1), int64(math.MaxInt64)
+	if sc.HasEpoch {
+		epoch, round = sc.Epoch, sc.Round
+	}
+	for _, id := range ids {
+		if _, err := db.Exec(
+			`INSERT INTO schedules (event_id, deliver_after, deliver_epoch, deliver_round) VALUES (?, ?, ?, ?)`,
+			id, after, epoch, round,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
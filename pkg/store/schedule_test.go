@@ -0,0 +1,90 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestScheduledDelivery(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	s.UpdateAgentClock("alice", 1, 2, 0)
+	s.UpdateAgentClock("bob", 1, 2, 0)
+	send := func(ts int64, body string, sc *Schedule) int64 {
+		var id int64
+		err := s.WithTx(func(tx TxStore) error {
+			var err error
+			if id, err = tx.InsertEvent(&model.Event{AgentID: "alice", LamportTS: ts, Kind: model.EventMsg, Target: "bob", Body: body, CreatedAt: time.Now().UTC()}); err != nil || sc == nil {
+				return err
+			}
+			return tx.ScheduleDeliveries([]int64{id}, *sc)
+		})
+		if err != nil {
+			t.Fatalf("send %q: %v", body, err)
+		}
+		return id
+	}
+	atEpoch := send(2, "epoch 3 closed", &Schedule{Epoch: 3, HasEpoch: true})
+	send(3, "later", &Schedule{After: time.Now().Add(time.Hour)})
+	send(4, "due", &Schedule{After: time.Now().Add(-time.Second)})
+	send(5, "now", nil)
+
+	bodies := func(events []model.Event) (out []string) {
+		for _, e := range events {
+			out = append(out, e.Body)
+		}
+		return out
+	}
+	unread, err := s.ListUnread("bob", "", 10)
+	if got := bodies(unread); err != nil || len(got) != 2 || got[0] != "due" || got[1] != "now" {
+		t.Fatalf("ListUnread = %q, %v", got, err)
+	}
+	if all, _ := s.ListEventsForAgent("bob", 0, 10); len(all) != 2 {
+		t.Fatalf("ListEventsForAgent shows held messages: %q", bodies(all))
+	}
+
+	// bob receives what is visible; his cursor moves past the held ones.
+	err = s.WithTx(func(tx TxStore) error {
+		if err := tx.RecordDeliveries("bob", 5, unread); err != nil {
+			return err
+		}
+		return tx.AdvanceCursor("bob", 6)
+	})
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if unread, _ := s.ListUnread("bob", "", 10); len(unread) != 0 {
+		t.Fatalf("after receiving: %q", bodies(unread))
+	}
+	// Held messages survive compaction.
+	if _, err := s.CompactEvents(CompactOptions{}); err != nil {
+		t.Fatalf("CompactEvents: %v", err)
+	}
+
+	// Once every agent is past epoch 3 the message shows up, behind the
+	// cursor, and receiving it does not move the cursor back.
+	s.UpdateAgentClock("alice", 6, 4, 0)
+	s.UpdateAgentClock("bob", 6, 4, 0)
+	unread, _ = s.ListUnread("bob", "", 10)
+	if len(unread) != 1 || unread[0].ID != atEpoch {
+		t.Fatalf("after the frontier passed epoch 3: %q", bodies(unread))
+	}
+	err = s.WithTx(func(tx TxStore) error {
+		if err := tx.RecordDeliveries("bob", 6, unread); err != nil {
+			return err
+		}
+		return tx.AdvanceCursor("bob", 3)
+	})
+	if err != nil {
+		t.Fatalf("receive released: %v", err)
+	}
+	if c := s.GetCursor("bob"); c != 6 {
+		t.Fatalf("cursor = %d, want it left at 6", c)
+	}
+	if unread, _ := s.ListUnread("bob", "", 10); len(unread) != 0 {
+		t.Fatalf("released message still unread: %q", bodies(unread))
+	}
+}
@@ -0,0 +1,90 @@
+// session.go keeps each agent to a single writer. Registering an agent
+// mints a session token; only its SHA-256 is stored. Once an agent has a
+// session, the store refuses clock updates and events for it from any
+// process that cannot present the token, so two processes started with
+// the same CLOCKMAIL_AGENT cannot interleave writes to one clock.
+// Registering again takes the session over.
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSessionMismatch is returned for a write in the name of an agent
+// whose session token this process does not hold.
+var ErrSessionMismatch = errors.New("agent is held by another session")
+
+// Sessions returns the session token this process holds for agentID, or
+// "" if it holds none.
+type Sessions func(agentID string) (string, error)
+
+// SetSessions makes the store present the tokens fn returns when writing
+// for an agent that has a session.
+func (s *Store) SetSessions(fn Sessions) { s.sessions = fn }
+
+// StartSession mints a new session token for agentID, replacing any
+// earlier one, and returns it. Processes holding the old token can no
+// longer write for the agent.
+func (s *Store) StartSession(agentID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	err := retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO sessions (agent_id, token_hash, started_at) VALUES (?, ?, ?)
+			 ON CONFLICT(agent_id) DO UPDATE SET token_hash = excluded.token_hash, started_at = excluded.started_at`,
+			agentID, hashToken(token), time.Now().UTC().Format(time.RFC3339Nano),
+		)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// EndSession drops agentID's session, so any process may write for it
+// again. It is not an error if the agent has none.
+func (s *Store) EndSession(agentID string) error {
+	return retryOnContention(func() error {
+		_, err := s.db.Exec(`DELETE FROM sessions WHERE agent_id = ?`, agentID)
+		return err
+	})
+}
+
+// checkSession refuses a write for agentID if the agent has a session and
+// this process does not hold its token.
+func (s *Store) checkSession(db dbtx, agentID string) error {
+	var want string
+	err := db.QueryRow(`SELECT token_hash FROM sessions WHERE agent_id = ?`, agentID).Scan(&want)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var token string
+	if s.sessions != nil {
+		if token, err = s.sessions(agentID); err != nil {
+			return fmt.Errorf("session for %s: %w", agentID, err)
+		}
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(want)) != 1 {
+		return fmt.Errorf("%s: %w (register it again to take the session over)", agentID, ErrSessionMismatch)
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
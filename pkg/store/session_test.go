@@ -0,0 +1,68 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestSessions(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.RegisterAgent("alice"); err != nil {
+		t.Fatal(err)
+	}
+	msg := func() *model.Event {
+		return &model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, Target: "bob", Body: "hi", CreatedAt: time.Now().UTC()}
+	}
+
+	// Without a session anyone may write as alice.
+	if _, err := s.TickAgent("alice"); err != nil {
+		t.Fatalf("TickAgent before session: %v", err)
+	}
+
+	token, err := s.StartSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := token
+	s.SetSessions(func(string) (string, error) { return held, nil })
+	if _, err := s.InsertEvent(msg()); err != nil {
+		t.Fatalf("InsertEvent with token: %v", err)
+	}
+
+	// A second registration takes the session over.
+	if _, err := s.StartSession("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InsertEvent(msg()); !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("InsertEvent with stale token: err = %v, want ErrSessionMismatch", err)
+	}
+	if _, err := s.TickAgent("alice"); !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("TickAgent with stale token: err = %v, want ErrSessionMismatch", err)
+	}
+	if err := s.WithTx(func(tx TxStore) error {
+		return tx.UpdateAgentClock("alice", 50, 0, 0)
+	}); !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("UpdateAgentClock in tx with stale token: err = %v, want ErrSessionMismatch", err)
+	}
+	s.SetSessions(nil)
+	if _, err := s.SyncAtomic("alice", 0, 0, 10, model.Provenance{}); !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("SyncAtomic without token: err = %v, want ErrSessionMismatch", err)
+	}
+
+	// Other agents are unaffected, and ending the session lifts the check.
+	if _, err := s.RegisterAgent("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TickAgent("bob"); err != nil {
+		t.Fatalf("TickAgent bob: %v", err)
+	}
+	if err := s.EndSession("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TickAgent("alice"); err != nil {
+		t.Fatalf("TickAgent after EndSession: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+// signing.go checks who wrote events (see package sign). Agents register
+// an Ed25519 public key once; the first key registered for an agent is
+// the one its events are checked against. Events written through a Store
+// with a Signer are signed as they are inserted, and in strict mode the
+// store refuses events that do not verify.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/sign"
+)
+
+var (
+	// ErrUnsigned is returned by VerifyEvent for events with no signature.
+	ErrUnsigned = errors.New("event is not signed")
+	// ErrNoSigningKey is returned by VerifyEvent when the event's agent
+	// has not registered a signing key.
+	ErrNoSigningKey = errors.New("agent has no registered signing key")
+)
+
+// Signer returns the signature for an event, or "" if it holds no key
+// for the event's agent.
+type Signer func(e *model.Event) (string, error)
+
+// SetSigner makes the store sign unsigned events it inserts with fn.
+// Imported events keep the signatures they came with.
+func (s *Store) SetSigner(fn Signer) { s.signer = fn }
+
+// RegisterSigningKey registers pub as agentID's signing key unless the
+// agent already has one, and returns the key registered for the agent.
+func (s *Store) RegisterSigningKey(agentID, pub string) (string, error) {
+	err := retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO signing_keys (agent_id, pubkey, registered_at) VALUES (?, ?, ?)
+			 ON CONFLICT(agent_id) DO NOTHING`,
+			agentID, pub, time.Now().UTC().Format(time.RFC3339Nano),
+		)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return s.SigningKey(agentID)
+}
+
+// SigningKey returns agentID's registered signing key, or sql.ErrNoRows.
+func (s *Store) SigningKey(agentID string) (string, error) {
+	return signingKey(s.db, agentID)
+}
+
+func signingKey(db dbtx, agentID string) (string, error) {
+	var k string
+	err := db.QueryRow(`SELECT pubkey FROM signing_keys WHERE agent_id = ?`, agentID).Scan(&k)
+	return k, err
+}
+
+// SetStrictSignatures turns strict mode on or off. In strict mode every
+// event written, imported ones included, must carry a valid signature by
+// its agent's registered key.
+func (s *Store) SetStrictSignatures(on bool) error {
+	v := "off"
+	if on {
+		v = "on"
+	}
+	return retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO settings (key, value) VALUES ('strict_signatures', ?)
+			 ON CONFLICT(key) DO UPDATE SET value = excluded.value`, v,
+		)
+		return err
+	})
+}
+
+// StrictSignatures reports whether strict mode is on.
+func (s *Store) StrictSignatures() (bool, error) { return strictSignatures(s.db) }
+
+func strictSignatures(db dbtx) (bool, error) {
+	var v string
+	err := db.QueryRow(`SELECT value FROM settings WHERE key = 'strict_signatures'`).Scan(&v)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return v == "on", err
+}
+
+// VerifyEvent checks e's signature against its agent's registered key. It
+// returns nil, ErrUnsigned, ErrNoSigningKey or sign.ErrBadSignature.
+func (s *Store) VerifyEvent(e model.Event) error { return verifyEvent(s.db, e) }
+
+func verifyEvent(db dbtx, e model.Event) error {
+	if e.Signature == "" {
+		return ErrUnsigned
+	}
+	pub, err := signingKey(db, e.AgentID)
+	if err == sql.ErrNoRows {
+		return ErrNoSigningKey
+	}
+	if err != nil {
+		return err
+	}
+	return sign.Verify(pub, e.SigningPayload(), e.Signature)
+}
+
+// signEvent signs e with the store's signer, if it has one and e is not
+// signed yet.
+func (s *Store) signEvent(e *model.Event) error {
+	if s.signer == nil || e.Signature != "" {
+		return nil
+	}
+	sig, err := s.signer(e)
+	if err != nil {
+		return fmt.Errorf("sign event: %w", err)
+	}
+	e.Signature = sig
+	return nil
+}
+
+// checkStrict refuses e if strict mode is on and e does not verify.
+func checkStrict(db dbtx, e *model.Event) error {
+	on, err := strictSignatures(db)
+	if err != nil || !on {
+		return err
+	}
+	if err := verifyEvent(db, *e); err != nil {
+		return fmt.Errorf("strict signatures: refusing %s event from %s: %w", e.Kind, e.AgentID, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/sign"
+)
+
+// signWith returns a Signer holding priv for agentID only.
+func signWith(agentID, priv string) Signer {
+	return func(e *model.Event) (string, error) {
+		if e.AgentID != agentID {
+			return "", nil
+		}
+		return sign.Sign(priv, e.SigningPayload())
+	}
+}
+
+func TestSigning_VerifyAndTamper(t *testing.T) {
+	s := newTestStore(t)
+	priv, pub, _ := sign.GenerateKey()
+	if k, err := s.RegisterSigningKey("alice", pub); err != nil || k != pub {
+		t.Fatalf("RegisterSigningKey = %q, %v", k, err)
+	}
+	// The first key registered stays.
+	_, other, _ := sign.GenerateKey()
+	if k, _ := s.RegisterSigningKey("alice", other); k != pub {
+		t.Fatalf("second registration replaced the key: %q", k)
+	}
+	s.SetSigner(signWith("alice", priv))
+
+	now := time.Now().UTC()
+	s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, Target: "bob", Body: "hi", CreatedAt: now})
+	s.InsertEvent(&model.Event{AgentID: "bob", LamportTS: 2, Kind: model.EventMsg, Target: "alice", Body: "yo", CreatedAt: now})
+	s.SyncAtomic("alice", 1, 0, 3, model.Provenance{})
+
+	events, _ := s.ListEvents(0, 10)
+	if len(events) != 3 {
+		t.Fatalf("events = %+v", events)
+	}
+	for _, e := range events {
+		err := s.VerifyEvent(e)
+		switch e.AgentID {
+		case "alice":
+			if err != nil {
+				t.Errorf("alice's %s event: %v", e.Kind, err)
+			}
+		case "bob":
+			if err != ErrUnsigned {
+				t.Errorf("bob's event: err = %v, want ErrUnsigned", err)
+			}
+		}
+	}
+
+	if _, err := s.db.Exec(`UPDATE events SET body = 'forged' WHERE agent_id = 'alice' AND kind = 'msg'`); err != nil {
+		t.Fatal(err)
+	}
+	events, _ = s.ListEvents(0, 1)
+	if err := s.VerifyEvent(events[0]); !errors.Is(err, sign.ErrBadSignature) {
+		t.Fatalf("tampered event: err = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestSigning_Strict(t *testing.T) {
+	s := newTestStore(t)
+	priv, pub, _ := sign.GenerateKey()
+	s.RegisterSigningKey("alice", pub)
+	if err := s.SetStrictSignatures(true); err != nil {
+		t.Fatalf("SetStrictSignatures: %v", err)
+	}
+	if on, _ := s.StrictSignatures(); !on {
+		t.Fatal("strict mode should be on")
+	}
+
+	now := time.Now().UTC()
+	if _, err := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, CreatedAt: now}); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("unsigned insert: err = %v", err)
+	}
+	forged := &model.Event{AgentID: "alice", LamportTS: 2, Kind: model.EventMsg, Body: "trust me", CreatedAt: now}
+	otherPriv, _, _ := sign.GenerateKey()
+	forged.Signature, _ = sign.Sign(otherPriv, forged.SigningPayload())
+	if _, err := s.InsertEvent(forged); !errors.Is(err, sign.ErrBadSignature) {
+		t.Fatalf("forged insert: err = %v", err)
+	}
+	if n := s.CountEvents(); n != 0 {
+		t.Fatalf("refused events were stored: %d", n)
+	}
+
+	s.SetSigner(signWith("alice", priv))
+	if _, err := s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 3, Kind: model.EventMsg, CreatedAt: now}); err != nil {
+		t.Fatalf("signed insert: %v", err)
+	}
+	if _, err := s.InsertEvent(&model.Event{AgentID: "bob", LamportTS: 4, Kind: model.EventMsg, CreatedAt: now}); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("bob without a key: err = %v", err)
+	}
+
+	s.SetStrictSignatures(false)
+	if _, err := s.InsertEvent(&model.Event{AgentID: "bob", LamportTS: 5, Kind: model.EventMsg, CreatedAt: now}); err != nil {
+		t.Fatalf("insert with strict mode off: %v", err)
+	}
+}
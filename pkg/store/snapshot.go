@@ -0,0 +1,126 @@
+// snapshot.go copies a SQLite database to a file and back with SQLite's
+// online backup API, which reads a consistent copy while other processes
+// keep writing (WAL included) and restores into the live database in one
+// step, so agents' clocks, locks and messages roll back together.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"modernc.org/sqlite"
+)
+
+// ErrNoSnapshots is returned by Snapshot and Restore for stores that are
+// not a local SQLite database.
+var ErrNoSnapshots = errors.New("snapshots need a local SQLite database")
+
+// backuper is the part of the SQLite driver's connection that runs online
+// backups.
+type backuper interface {
+	NewBackup(dstURI string) (*sqlite.Backup, error)
+	NewRestore(srcURI string) (*sqlite.Backup, error)
+}
+
+// Snapshot writes a consistent copy of the database to dst, replacing any
+// file there once the copy is complete.
+func (s *Store) Snapshot(dst string) error {
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	err := s.withBackuper(s.db.DB, func(b backuper) error {
+		bk, err := b.NewBackup(tmp)
+		if err != nil {
+			return err
+		}
+		return runBackup(bk)
+	})
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Restore replaces the database's contents with the snapshot at src and
+// brings its schema up to date. A snapshot taken by a newer release is
+// refused with ErrDowngrade before anything is changed.
+func (s *Store) Restore(src string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	v, err := snapshotVersion(src)
+	if err != nil {
+		return fmt.Errorf("read snapshot %s: %w", src, err)
+	}
+	if v > LatestSchemaVersion() {
+		return fmt.Errorf("%w: snapshot is at schema version %d, this build knows %d", ErrDowngrade, v, LatestSchemaVersion())
+	}
+
+	db := s.db.DB
+	if s.db.writer != nil {
+		db = s.db.writer
+	}
+	err = s.withBackuper(db, func(b backuper) error {
+		bk, err := b.NewRestore(src)
+		if err != nil {
+			return err
+		}
+		return runBackup(bk)
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.migrate(); err != nil {
+		return fmt.Errorf("migrate restored database: %w", err)
+	}
+	s.bump()
+	return nil
+}
+
+// withBackuper runs fn on a connection from db as the SQLite driver sees
+// it.
+func (s *Store) withBackuper(db *sql.DB, fn func(backuper) error) error {
+	if s.db.dialect != dialectSQLite || s.db.remote {
+		return ErrNoSnapshots
+	}
+	c, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Raw(func(dc interface{}) error {
+		b, ok := dc.(backuper)
+		if !ok {
+			return ErrNoSnapshots
+		}
+		return fn(b)
+	})
+}
+
+// runBackup copies every page and releases bk.
+func runBackup(bk *sqlite.Backup) error {
+	for {
+		more, err := bk.Step(-1)
+		if err != nil {
+			bk.Finish()
+			return err
+		}
+		if !more {
+			return bk.Finish()
+		}
+	}
+}
+
+// snapshotVersion returns the schema version of the database at path,
+// opened read-only.
+func snapshotVersion(path string) (int, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return schemaVersion(dialectSQLite, db)
+}
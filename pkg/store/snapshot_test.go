@@ -0,0 +1,47 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestSnapshot_RestoreRollsBack(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	if _, _, err := s.SetKV(model.KVEntry{Key: "phase", Value: "safe", AgentID: "alice", LamportTS: 1}); err != nil {
+		t.Fatal(err)
+	}
+	snap := filepath.Join(t.TempDir(), "before.db")
+	if err := s.Snapshot(snap); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	// The risky phase: new agents, values and locks.
+	s.RegisterAgent("bob")
+	s.SetKV(model.KVEntry{Key: "phase", Value: "risky", AgentID: "bob", LamportTS: 5})
+	if _, _, err := s.AcquireLock("a.go", "bob", 5, 0, true, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if e, err := s.GetKV("phase"); err != nil || e.Value != "safe" {
+		t.Fatalf("phase = %+v, %v; want safe", e, err)
+	}
+	if agents, _ := s.ListAgents(); len(agents) != 1 || agents[0].ID != "alice" {
+		t.Fatalf("agents = %+v, want only alice", agents)
+	}
+	if locks, _ := s.ListLocks(); len(locks) != 0 {
+		t.Fatalf("locks = %+v, want none", locks)
+	}
+
+	if err := s.Restore(filepath.Join(t.TempDir(), "missing.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("restore of a missing snapshot: err = %v", err)
+	}
+}
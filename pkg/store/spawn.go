@@ -0,0 +1,136 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// ErrAgentActive is returned by SpawnAgent when the child ID belongs to an
+// agent that is still active under another parent (or none).
+var ErrAgentActive = errors.New("agent is already active")
+
+// Lifecycle says when a spawned agent is retired automatically.
+type Lifecycle struct {
+	// Ephemeral retires the child once its parent moves past the epoch it
+	// was spawned in.
+	Ephemeral bool
+	// TTL retires the child after this long without activity; zero means
+	// no limit.
+	TTL time.Duration
+}
+
+// SpawnAgent registers childID as a sub-agent of parentID. The child starts
+// at the parent's position and in its scope, with clock clk, the Lamport
+// timestamp of the parent's spawn event, so everything the child does
+// follows the spawn.
+//
+// Spawning an ID that has departed reuses it under the new parent, which
+// lets orchestrators recycle worker names. Spawning a live agent is only
+// allowed to refresh it under the same parent. See RetirableSubAgents for
+// how life is applied.
+func (s *Store) SpawnAgent(childID, parentID string, clk int64, life Lifecycle) (*model.Agent, error) {
+	if childID == parentID {
+		return nil, fmt.Errorf("agent %s cannot spawn itself", childID)
+	}
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+
+		var epoch, round int64
+		var departed, steps, scope string
+		if err := tx.QueryRow(
+			`SELECT epoch, round, departed_at, steps, scope FROM agents WHERE id = ?`, parentID,
+		).Scan(&epoch, &round, &departed, &steps, &scope); err == sql.ErrNoRows || (err == nil && departed != "") {
+			return fmt.Errorf("parent %w: %s", ErrNotRegistered, parentID)
+		} else if err != nil {
+			return err
+		}
+
+		// The child must not be an ancestor of its new parent.
+		for id := parentID; id != ""; {
+			var next string
+			if err := tx.QueryRow(`SELECT parent_id FROM agents WHERE id = ?`, id).Scan(&next); err != nil {
+				if err == sql.ErrNoRows {
+					break
+				}
+				return err
+			}
+			if next == childID {
+				return fmt.Errorf("agent %s is an ancestor of %s", childID, parentID)
+			}
+			id = next
+		}
+
+		var oldParent string
+		err = tx.QueryRow(
+			`SELECT parent_id, departed_at FROM agents WHERE id = ?`, childID,
+		).Scan(&oldParent, &departed)
+		if err == nil && departed == "" && oldParent != parentID {
+			return fmt.Errorf("%w: %s", ErrAgentActive, childID)
+		} else if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		retireEpoch := int64(-1)
+		if life.Ephemeral {
+			retireEpoch = epoch
+		}
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		if _, err := tx.Exec(
+			`INSERT INTO agents (id, clock, epoch, round, registered, last_seen, parent_id, retire_epoch, ttl, steps, scope)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			 ON CONFLICT(id) DO UPDATE SET
+			   clock = CASE WHEN agents.clock < excluded.clock THEN excluded.clock ELSE agents.clock END,
+			   epoch = excluded.epoch,
+			   round = excluded.round,
+			   last_seen = excluded.last_seen,
+			   departed_at = '',
+			   parent_id = excluded.parent_id,
+			   retire_epoch = excluded.retire_epoch,
+			   ttl = excluded.ttl,
+			   steps = excluded.steps,
+			   scope = excluded.scope`,
+			childID, clk, epoch, round, now, now, parentID, retireEpoch, int64(life.TTL/time.Second), steps, scope,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetAgent(childID)
+}
+
+// RetirableSubAgents returns the live children of parentID whose lifecycle
+// has ended now that the parent is at epoch: ephemeral children spawned in
+// an earlier epoch, and children idle for longer than their TTL.
+func (s *Store) RetirableSubAgents(parentID string, epoch int64) ([]string, error) {
+	rows, err := s.db.Query(
+		`SELECT id, clock, epoch, round, registered, last_seen, departed_at, parent_id, retire_epoch, ttl, steps, scope
+		 FROM agents WHERE parent_id = ? AND departed_at = '' AND (retire_epoch >= 0 OR ttl > 0)
+		 ORDER BY id`, parentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		ag, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		if ag.Retired(epoch, time.Now()) {
+			ids = append(ids, ag.ID)
+		}
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSpawnAgent(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("orch")
+	s.UpdateAgentClock("orch", 4, 2, 1)
+
+	child, err := s.SpawnAgent("w1", "orch", 5, Lifecycle{})
+	if err != nil {
+		t.Fatalf("SpawnAgent: %v", err)
+	}
+	if child.ParentID != "orch" || child.Clock != 5 || child.Epoch != 2 || child.Round != 1 {
+		t.Fatalf("child = %+v, want parent orch at clock 5, epoch 2, round 1", child)
+	}
+
+	agents, _ := s.ListAgents()
+	if len(agents) != 2 || agents[1].ID != "w1" || agents[1].ParentID != "orch" {
+		t.Fatalf("ListAgents should carry parent_id, got %+v", agents)
+	}
+}
+
+func TestSpawnAgent_Rejects(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("orch")
+	s.RegisterAgent("other")
+	s.SpawnAgent("w1", "orch", 1, Lifecycle{})
+
+	if _, err := s.SpawnAgent("w2", "ghost", 1, Lifecycle{}); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("unknown parent: err = %v, want ErrNotRegistered", err)
+	}
+	if _, err := s.SpawnAgent("w1", "other", 1, Lifecycle{}); !errors.Is(err, ErrAgentActive) {
+		t.Errorf("live child under another parent: err = %v, want ErrAgentActive", err)
+	}
+	if _, err := s.SpawnAgent("orch", "w1", 1, Lifecycle{}); err == nil {
+		t.Error("spawning an ancestor under its descendant should fail")
+	}
+	if _, err := s.SpawnAgent("orch", "orch", 1, Lifecycle{}); err == nil {
+		t.Error("spawning an agent under itself should fail")
+	}
+}
+
+func TestSpawnAgent_ReusesDepartedID(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("orch")
+	s.RegisterAgent("other")
+	s.SpawnAgent("w1", "orch", 9, Lifecycle{})
+	s.DepartAgent("w1")
+
+	child, err := s.SpawnAgent("w1", "other", 3, Lifecycle{})
+	if err != nil {
+		t.Fatalf("respawn departed child: %v", err)
+	}
+	if child.ParentID != "other" || child.DepartedAt != nil || child.Clock != 9 {
+		t.Fatalf("child = %+v, want live under other with clock kept at 9", child)
+	}
+}
+
+func TestRetirableSubAgents(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("orch")
+	s.UpdateAgentClock("orch", 1, 2, 0)
+	s.SpawnAgent("eph", "orch", 2, Lifecycle{Ephemeral: true})
+	s.SpawnAgent("keep", "orch", 3, Lifecycle{})
+	s.SpawnAgent("short", "orch", 4, Lifecycle{TTL: time.Second})
+
+	if ids, _ := s.RetirableSubAgents("orch", 2); len(ids) != 0 {
+		t.Fatalf("nothing should retire while orch is still at epoch 2, got %v", ids)
+	}
+	ids, err := s.RetirableSubAgents("orch", 3)
+	if err != nil {
+		t.Fatalf("RetirableSubAgents: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "eph" {
+		t.Fatalf("leaving epoch 2 should retire eph only, got %v", ids)
+	}
+
+	// Age the TTL child past its limit.
+	old := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+	s.db.Exec(`UPDATE agents SET last_seen = ? WHERE id = 'short'`, old)
+	ids, _ = s.RetirableSubAgents("orch", 2)
+	if len(ids) != 1 || ids[0] != "short" {
+		t.Fatalf("idle child past its TTL should retire, got %v", ids)
+	}
+
+	s.DepartAgent("short")
+	if ids, _ := s.RetirableSubAgents("orch", 2); len(ids) != 0 {
+		t.Fatalf("departed children are not retired twice, got %v", ids)
+	}
+}
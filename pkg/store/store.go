@@ -1,42 +1,96 @@
-// Package store manages all SQLite persistence for clockmail.
+// Package store manages all persistence for clockmail.
 //
 // SQLite in WAL mode serves as the broadcast medium: instead of Lamport's
 // all-to-all message passing, agents read and write a shared database.
-// The database IS the communication channel.
+// The database IS the communication channel. Teams spread over several
+// machines can point every agent at one PostgreSQL database instead (see
+// dialect.go).
 package store
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/clock"
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
+	"github.com/daviddao/clockmail/pkg/trace"
 
 	_ "modernc.org/sqlite"
 )
 
-// Store manages all SQLite operations with WAL mode for concurrent access.
+// Store manages all database operations. On SQLite it uses WAL mode for
+// concurrent access.
 type Store struct {
-	db *sql.DB
+	db *conn
+	// notifyPath is the file bumped after each event write (see
+	// watch.go), or "" if the database has none.
+	notifyPath string
+	// memNotify wakes Watchers instead for an in-memory database.
+	memNotify *memoryNotify
+	// signer signs the events the store inserts (see signing.go).
+	signer Signer
+	// sessions supplies this process's agent session tokens (see
+	// session.go).
+	sessions Sessions
+	// tracer records spans for coordination operations; nil is off.
+	tracer *trace.Tracer
+	// activeWindow overrides DefaultActiveWindow (see SetActiveWindow).
+	activeWindow time.Duration
+	// branch and allBranches scope locks and inboxes to a git branch
+	// (see SetBranch).
+	branch      string
+	allBranches bool
+	// worktree is the root of the git working tree repository-relative
+	// lock paths are in (see SetWorktree).
+	worktree string
+	// actor is the agent privileged operations are done by (see
+	// SetActor).
+	actor string
 }
 
+// SetTracer makes the store record a span for each event insert, inbox
+// read, delivery and lock acquisition.
+func (s *Store) SetTracer(t *trace.Tracer) { s.tracer = t }
+
 // New opens (or creates) the SQLite database and initializes the schema.
-func New(path string) (*Store, error) {
+func New(path string) (*Store, error) { return newSQLite(path, true) }
+
+func newSQLite(path string, migrate bool) (*Store, error) {
+	if path == memoryPath {
+		return newMemory(migrate)
+	}
 	dsn := path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(60000)&_pragma=synchronous(NORMAL)"
 	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open db: %w", err)
 	}
-	db.SetMaxOpenConns(4)
+	db.SetMaxOpenConns(defaultMaxOpenConns)
 	db.SetMaxIdleConns(2)
 	db.SetConnMaxLifetime(30 * time.Minute)
 
-	s := &Store{db: db}
+	s := &Store{db: &conn{DB: db, dialect: dialectSQLite, dsn: dsn}, notifyPath: notifyPathFor(path)}
+	if !migrate {
+		return s, nil
+	}
 	if err := s.migrate(); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("migrate: %w", err)
 	}
+	if err := s.db.prepareHot(); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -50,66 +104,19 @@ func retryOnContention(fn func() error) error {
 	return retryOp(defaultRetryConfig, fn)
 }
 
-func (s *Store) migrate() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS agents (
-		id         TEXT PRIMARY KEY,
-		clock      INTEGER NOT NULL DEFAULT 0,
-		epoch      INTEGER NOT NULL DEFAULT 0,
-		round      INTEGER NOT NULL DEFAULT 0,
-		registered TEXT NOT NULL,
-		last_seen  TEXT NOT NULL
-	);
-
-	CREATE TABLE IF NOT EXISTS events (
-		id         INTEGER PRIMARY KEY AUTOINCREMENT,
-		agent_id   TEXT NOT NULL REFERENCES agents(id),
-		lamport_ts INTEGER NOT NULL,
-		epoch      INTEGER NOT NULL DEFAULT 0,
-		round      INTEGER NOT NULL DEFAULT 0,
-		kind       TEXT NOT NULL,
-		target     TEXT,
-		body       TEXT,
-		created_at TEXT NOT NULL
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_events_lamport ON events(lamport_ts);
-	CREATE INDEX IF NOT EXISTS idx_events_agent ON events(agent_id, lamport_ts);
-	CREATE INDEX IF NOT EXISTS idx_events_kind_target ON events(kind, target);
-	CREATE INDEX IF NOT EXISTS idx_events_epoch_round ON events(epoch, round);
-
-	CREATE TABLE IF NOT EXISTS locks (
-		path       TEXT NOT NULL,
-		agent_id   TEXT NOT NULL REFERENCES agents(id),
-		lamport_ts INTEGER NOT NULL,
-		epoch      INTEGER NOT NULL DEFAULT 0,
-		exclusive  INTEGER NOT NULL DEFAULT 1,
-		expires_at TEXT NOT NULL,
-		PRIMARY KEY (path, agent_id)
-	);
-	CREATE INDEX IF NOT EXISTS idx_locks_agent ON locks(agent_id);
-
-	CREATE TABLE IF NOT EXISTS cursors (
-		agent_id   TEXT PRIMARY KEY REFERENCES agents(id),
-		since_ts   INTEGER NOT NULL DEFAULT 0
-	);
-	`
-	_, err := s.db.Exec(schema)
-	return err
-}
-
 // ---------------------------------------------------------------------------
 // Agents
 // ---------------------------------------------------------------------------
 
 // RegisterAgent creates or updates an agent. Idempotent via ON CONFLICT.
+// Registering a departed agent brings it back.
 func (s *Store) RegisterAgent(id string) (*model.Agent, error) {
 	now := time.Now().UTC().Format(time.RFC3339Nano)
 	err := retryOnContention(func() error {
 		_, err := s.db.Exec(
 			`INSERT INTO agents (id, clock, epoch, round, registered, last_seen)
 			 VALUES (?, 0, 0, 0, ?, ?)
-			 ON CONFLICT(id) DO UPDATE SET last_seen = excluded.last_seen`,
+			 ON CONFLICT(id) DO UPDATE SET last_seen = excluded.last_seen, departed_at = ''`,
 			id, now, now,
 		)
 		return err
@@ -123,27 +130,138 @@ func (s *Store) RegisterAgent(id string) (*model.Agent, error) {
 // GetAgent retrieves an agent by ID.
 func (s *Store) GetAgent(id string) (*model.Agent, error) {
 	row := s.db.QueryRow(
-		`SELECT id, clock, epoch, round, registered, last_seen FROM agents WHERE id = ?`, id,
+		`SELECT id, clock, epoch, round, registered, last_seen, departed_at, parent_id, retire_epoch, ttl, steps, scope FROM agents WHERE id = ?`, id,
 	)
-	return scanAgent(row)
+	ag, err := scanAgent(row)
+	if err != nil {
+		return nil, err
+	}
+	agents := []model.Agent{*ag}
+	if err := s.attachCapabilities(agents, id); err != nil {
+		return nil, err
+	}
+	if err := s.attachRoles(agents, id); err != nil {
+		return nil, err
+	}
+	return &agents[0], nil
 }
 
 // UpdateAgentClock persists the agent's current Lamport clock and position.
 func (s *Store) UpdateAgentClock(id string, clk, epoch, round int64) error {
-	now := time.Now().UTC().Format(time.RFC3339Nano)
+	err := retryOnContention(func() error {
+		if err := s.checkSession(s.db, id); err != nil {
+			return err
+		}
+		return updateAgentClock(s.db, id, clk, epoch, round)
+	})
+	if err == nil {
+		logger.Debug("clock updated", "agent", id, "clock", clk, "epoch", epoch, "round", round)
+	}
+	return err
+}
+
+// keepStepsSQL keeps an agent's steps while its epoch and round stay
+// (the two arguments), and clears them when it moves: a position given
+// as (epoch, round) only is at step 0 of the round.
+const keepStepsSQL = `steps = CASE WHEN epoch = ? AND round = ? THEN steps ELSE '' END`
+
+const updateAgentClockSQL = `UPDATE agents SET clock = ?, epoch = ?, round = ?, ` + keepStepsSQL + `, last_seen = ? WHERE id = ?`
+
+func updateAgentClock(db dbtx, id string, clk, epoch, round int64) error {
+	_, err := db.Exec(updateAgentClockSQL,
+		clk, epoch, round, epoch, round, time.Now().UTC().Format(time.RFC3339Nano), id,
+	)
+	return err
+}
+
+// SetAgentPosition moves the agent to (epoch, round) without touching its
+// clock, for use after TickAgent or ReceiveAgent. Its steps are kept if
+// the epoch and round do not change, and cleared otherwise.
+func (s *Store) SetAgentPosition(id string, epoch, round int64) error {
+	return retryOnContention(func() error {
+		return setAgentPosition(s.db, id, epoch, round)
+	})
+}
+
+func setAgentPosition(db dbtx, id string, epoch, round int64) error {
+	_, err := db.Exec(
+		`UPDATE agents SET epoch = ?, round = ?, `+keepStepsSQL+`, last_seen = ? WHERE id = ?`,
+		epoch, round, epoch, round, time.Now().UTC().Format(time.RFC3339Nano), id,
+	)
+	return err
+}
+
+// SetAgentAt moves the agent to ts, steps included, without touching its
+// clock.
+func (s *Store) SetAgentAt(id string, ts model.Timestamp) error {
 	return retryOnContention(func() error {
 		_, err := s.db.Exec(
-			`UPDATE agents SET clock = ?, epoch = ?, round = ?, last_seen = ? WHERE id = ?`,
-			clk, epoch, round, now, id,
+			`UPDATE agents SET epoch = ?, round = ?, steps = ?, last_seen = ? WHERE id = ?`,
+			ts.Epoch, ts.Round, model.FormatSteps(ts.Steps), time.Now().UTC().Format(time.RFC3339Nano), id,
 		)
 		return err
 	})
 }
 
+// SetAgentScope records the part of the repository the agent works on;
+// "" means anywhere.
+func (s *Store) SetAgentScope(id, scope string) error {
+	return retryOnContention(func() error {
+		res, err := s.db.Exec(`UPDATE agents SET scope = ? WHERE id = ?`, scope, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("%w: %s", ErrNotRegistered, id)
+		}
+		return nil
+	})
+}
+
+// TickAgent applies IR1 to agentID's clock in the database and returns
+// the new value. The increment happens in one statement, so two processes
+// acting as the same agent can never hand out the same timestamp.
+func (s *Store) TickAgent(id string) (int64, error) {
+	return s.ReceiveAgent(id, 0)
+}
+
+// ReceiveAgent applies IR2 to agentID's clock in the database for a
+// message stamped ts, setting it to max(clock, ts) + 1, and returns the
+// new value. Like TickAgent it is a single atomic statement.
+func (s *Store) ReceiveAgent(id string, ts int64) (int64, error) {
+	var clk int64
+	err := retryOnContention(func() error {
+		if err := s.checkSession(s.db, id); err != nil {
+			return err
+		}
+		var err error
+		clk, err = advanceAgentClock(s.db.dialect, s.db, id, ts)
+		return err
+	})
+	return clk, err
+}
+
+func advanceAgentClockSQL(d dialect) string {
+	return `UPDATE agents SET clock = ` + d.greatest("clock", "?") + ` + 1, last_seen = ? WHERE id = ? RETURNING clock`
+}
+
+// advanceAgentClock sets agentID's clock to max(clock, ts) + 1; ts = 0
+// is a plain tick. It returns ErrNotRegistered for an unknown agent.
+func advanceAgentClock(d dialect, db dbtx, id string, ts int64) (int64, error) {
+	var clk int64
+	err := db.QueryRow(advanceAgentClockSQL(d),
+		ts, time.Now().UTC().Format(time.RFC3339Nano), id,
+	).Scan(&clk)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", id, ErrNotRegistered)
+	}
+	return clk, err
+}
+
 // ListAgents returns all registered agents ordered by ID.
 func (s *Store) ListAgents() ([]model.Agent, error) {
 	rows, err := s.db.Query(
-		`SELECT id, clock, epoch, round, registered, last_seen FROM agents ORDER BY id`,
+		`SELECT id, clock, epoch, round, registered, last_seen, departed_at, parent_id, retire_epoch, ttl, steps, scope FROM agents ORDER BY id`,
 	)
 	if err != nil {
 		return nil, err
@@ -152,31 +270,51 @@ func (s *Store) ListAgents() ([]model.Agent, error) {
 
 	var agents []model.Agent
 	for rows.Next() {
-		var a model.Agent
-		var regStr, lsStr string
-		if err := rows.Scan(&a.ID, &a.Clock, &a.Epoch, &a.Round, &regStr, &lsStr); err != nil {
+		a, err := scanAgent(rows)
+		if err != nil {
 			return nil, err
 		}
-		var parseErr error
-		a.Registered, parseErr = time.Parse(time.RFC3339Nano, regStr)
-		if parseErr != nil {
-			return nil, fmt.Errorf("parse registered time for agent %s: %w", a.ID, parseErr)
-		}
-		a.LastSeen, parseErr = time.Parse(time.RFC3339Nano, lsStr)
-		if parseErr != nil {
-			return nil, fmt.Errorf("parse last_seen time for agent %s: %w", a.ID, parseErr)
-		}
-		agents = append(agents, a)
+		agents = append(agents, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	return agents, rows.Err()
+	if err := s.attachCapabilities(agents, ""); err != nil {
+		return nil, err
+	}
+	if err := s.attachRoles(agents, ""); err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
+
+// scanner is satisfied by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
 }
 
-func scanAgent(row *sql.Row) (*model.Agent, error) {
+func scanAgent(row scanner) (*model.Agent, error) {
 	var a model.Agent
-	var regStr, lsStr string
-	if err := row.Scan(&a.ID, &a.Clock, &a.Epoch, &a.Round, &regStr, &lsStr); err != nil {
+	var regStr, lsStr, departedStr, steps string
+	var retireEpoch int64
+	if err := row.Scan(&a.ID, &a.Clock, &a.Epoch, &a.Round, &regStr, &lsStr, &departedStr,
+		&a.ParentID, &retireEpoch, &a.TTL, &steps, &a.Scope); err != nil {
 		return nil, err
 	}
+	var err error
+	if a.Steps, err = model.ParseSteps(steps); err != nil {
+		return nil, fmt.Errorf("agent %s: %w", a.ID, err)
+	}
+	if retireEpoch >= 0 {
+		a.RetireEpoch = &retireEpoch
+	}
+	if departedStr != "" {
+		t, err := time.Parse(time.RFC3339Nano, departedStr)
+		if err != nil {
+			return nil, fmt.Errorf("parse departed_at time for agent %s: %w", a.ID, err)
+		}
+		a.DepartedAt = &t
+	}
 	var parseErr error
 	a.Registered, parseErr = time.Parse(time.RFC3339Nano, regStr)
 	if parseErr != nil {
@@ -189,56 +327,60 @@ func scanAgent(row *sql.Row) (*model.Agent, error) {
 	return &a, nil
 }
 
-// ---------------------------------------------------------------------------
-// Cursors
-// ---------------------------------------------------------------------------
-
-// GetCursor returns the stored recv cursor for an agent (0 if unset).
-func (s *Store) GetCursor(agentID string) int64 {
-	var ts int64
-	if err := s.db.QueryRow(
-		`SELECT since_ts FROM cursors WHERE agent_id = ?`, agentID,
-	).Scan(&ts); err != nil {
-		return 0
-	}
-	return ts
-}
-
-// SetCursor updates the recv cursor for an agent.
-func (s *Store) SetCursor(agentID string, sinceTS int64) error {
-	return retryOnContention(func() error {
-		_, err := s.db.Exec(
-			`INSERT INTO cursors (agent_id, since_ts) VALUES (?, ?)
-			 ON CONFLICT(agent_id) DO UPDATE SET since_ts = excluded.since_ts`,
-			agentID, sinceTS,
-		)
-		return err
-	})
-}
-
 // ---------------------------------------------------------------------------
 // Events
 // ---------------------------------------------------------------------------
 
 // InsertEvent appends an event to the log. Returns the auto-generated row ID.
 func (s *Store) InsertEvent(e *model.Event) (int64, error) {
+	span := s.tracer.Start("store.insert_event",
+		trace.String("clockmail.kind", string(e.Kind)), trace.String("clockmail.agent", e.AgentID),
+		trace.Int("clockmail.lamport_ts", e.LamportTS))
+	if err := s.signEvent(e); err != nil {
+		span.End(err)
+		return 0, err
+	}
 	var lastID int64
 	err := retryOnContention(func() error {
-		res, err := s.db.Exec(
-			`INSERT INTO events (agent_id, lamport_ts, epoch, round, kind, target, body, created_at)
-			 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-			e.AgentID, e.LamportTS, e.Epoch, e.Round, string(e.Kind), e.Target, e.Body,
-			e.CreatedAt.Format(time.RFC3339Nano),
-		)
+		tx, err := s.db.Begin()
 		if err != nil {
 			return err
 		}
-		lastID, err = res.LastInsertId()
-		return err
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := s.checkSession(tx, e.AgentID); err != nil {
+			return err
+		}
+		if err := checkStrict(tx, e); err != nil {
+			return err
+		}
+		if lastID, err = s.db.dialect.insertEvent(tx, e); err != nil {
+			return err
+		}
+		return tx.Commit()
 	})
+	if err == nil {
+		s.bump()
+	}
+	span.End(err)
 	return lastID, err
 }
 
+// InsertEvents appends events to the log in one transaction, in order,
+// and returns their row IDs. Either all of them are written or none is,
+// so the copies of a broadcast share their Lamport timestamp in the log
+// or are not there at all.
+func (s *Store) InsertEvents(events []*model.Event) ([]int64, error) {
+	span := s.tracer.Start("store.insert_events", trace.Int("clockmail.events", int64(len(events))))
+	var ids []int64
+	err := s.WithTx(func(tx TxStore) error {
+		var err error
+		ids, err = tx.InsertEvents(events)
+		return err
+	})
+	span.End(err)
+	return ids, err
+}
+
 // ListEvents returns events with lamport_ts >= sinceTS, ordered by total order.
 func (s *Store) ListEvents(sinceTS int64, limit int) ([]model.Event, error) {
 	if limit <= 0 {
@@ -246,7 +388,7 @@ func (s *Store) ListEvents(sinceTS int64, limit int) ([]model.Event, error) {
 	}
 	rows, err := s.db.Query(
 		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
-		        COALESCE(target,''), COALESCE(body,''), created_at
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
 		 FROM events WHERE lamport_ts >= ?
 		 ORDER BY lamport_ts ASC, id ASC LIMIT ?`,
 		sinceTS, limit,
@@ -267,7 +409,7 @@ func (s *Store) ListEventsSinceID(sinceID int64, limit int) ([]model.Event, erro
 	}
 	rows, err := s.db.Query(
 		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
-		        COALESCE(target,''), COALESCE(body,''), created_at
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
 		 FROM events WHERE id > ?
 		 ORDER BY id ASC LIMIT ?`,
 		sinceID, limit,
@@ -300,17 +442,75 @@ func (s *Store) CountEvents() int64 {
 
 // ListEventsForAgent returns messages targeted to agentID since sinceTS.
 // Includes regular messages and review events (review_req, review_done),
-// all of which are delivered to the target agent's inbox.
+// all of which are delivered to the target agent's inbox. Messages still
+// held back by a schedule are left out.
 func (s *Store) ListEventsForAgent(agentID string, sinceTS int64, limit int) ([]model.Event, error) {
+	return s.listInbox(s.db, agentID, sinceTS, limit)
+}
+
+const listInboxSQL = `SELECT id, agent_id, lamport_ts, epoch, round, kind,
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events e WHERE target = ? AND kind IN ('msg', 'review_req', 'review_done') AND lamport_ts >= ?
+		   AND ` + visibleCond + `
+		 ORDER BY lamport_ts ASC, id ASC LIMIT ?`
+
+func (s *Store) listInbox(db dbtx, agentID string, sinceTS int64, limit int) ([]model.Event, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	args := append([]interface{}{agentID, sinceTS}, s.visibleArgs(time.Now())...)
+	rows, err := db.Query(listInboxSQL, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEvents(rows)
+}
+
+// ListEventsByKind returns events of the given kinds with lamport_ts >=
+// sinceTS, ordered by total order.
+func (s *Store) ListEventsByKind(kinds []model.EventKind, sinceTS int64, limit int) ([]model.Event, error) {
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	args := make([]interface{}, 0, len(kinds)+2)
+	placeholders := make([]string, len(kinds))
+	for i, k := range kinds {
+		placeholders[i] = "?"
+		args = append(args, string(k))
+	}
+	args = append(args, sinceTS, limit)
+	rows, err := s.db.Query(
+		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events WHERE kind IN (`+strings.Join(placeholders, ",")+`) AND lamport_ts >= ?
+		 ORDER BY lamport_ts ASC, id ASC LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEvents(rows)
+}
+
+// QueryEvents returns events matching q with lamport_ts >= sinceTS,
+// ordered by total order. A nil q matches every event.
+func (s *Store) QueryEvents(q *query.Query, sinceTS int64, limit int) ([]model.Event, error) {
 	if limit <= 0 {
 		limit = 100
 	}
+	where, args := q.Where("")
+	args = append(args, sinceTS, limit)
 	rows, err := s.db.Query(
 		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
-		        COALESCE(target,''), COALESCE(body,''), created_at
-		 FROM events WHERE target = ? AND kind IN ('msg', 'review_req', 'review_done') AND lamport_ts >= ?
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events WHERE `+where+` AND lamport_ts >= ?
 		 ORDER BY lamport_ts ASC, id ASC LIMIT ?`,
-		agentID, sinceTS, limit,
+		args...,
 	)
 	if err != nil {
 		return nil, err
@@ -319,16 +519,49 @@ func (s *Store) ListEventsForAgent(agentID string, sinceTS int64, limit int) ([]
 	return scanEvents(rows)
 }
 
+// QueryEventsSinceID returns events matching q with row ID > sinceID,
+// ordered by ID, for tailing a filtered log.
+func (s *Store) QueryEventsSinceID(q *query.Query, sinceID int64, limit int) ([]model.Event, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	where, args := q.Where("")
+	args = append(args, sinceID, limit)
+	rows, err := s.db.Query(
+		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events WHERE `+where+` AND id > ?
+		 ORDER BY id ASC LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEvents(rows)
+}
+
+// storedPriority maps normal priority to the empty string, so that only
+// messages sent with a non-default priority carry one in the log.
+func storedPriority(p model.Priority) string {
+	if p == model.PriorityNormal {
+		return ""
+	}
+	return string(p)
+}
+
 func scanEvents(rows *sql.Rows) ([]model.Event, error) {
 	var events []model.Event
 	for rows.Next() {
 		var e model.Event
-		var kindStr, createdStr string
+		var kindStr, createdStr, priorityStr string
 		if err := rows.Scan(&e.ID, &e.AgentID, &e.LamportTS, &e.Epoch, &e.Round,
-			&kindStr, &e.Target, &e.Body, &createdStr); err != nil {
+			&kindStr, &e.Target, &e.Body, &createdStr, &priorityStr, &e.Tool, &e.RunID, &e.Branch, &e.Signature, &e.PrevHash); err != nil {
 			return nil, err
 		}
 		e.Kind = model.EventKind(kindStr)
+		e.Priority = model.Priority(priorityStr)
+		e.Permalink = model.Permalink(e.AgentID, e.ID, e.LamportTS)
 		var parseErr error
 		e.CreatedAt, parseErr = time.Parse(time.RFC3339Nano, createdStr)
 		if parseErr != nil {
@@ -339,6 +572,150 @@ func scanEvents(rows *sql.Rows) ([]model.Event, error) {
 	return events, rows.Err()
 }
 
+// CompactOptions controls which events CompactEvents removes.
+type CompactOptions struct {
+	// Before limits compaction to events created before this time.
+	// The zero value places no age limit.
+	Before time.Time
+	// KeepEvents always preserves the newest N events by row ID.
+	KeepEvents int
+	// Archive, if set, receives each removed event as a JSON line once
+	// the deletion has committed.
+	Archive io.Writer
+	// DryRun reports what would be removed without deleting anything.
+	DryRun bool
+}
+
+// CompactResult reports the outcome of CompactEvents.
+type CompactResult struct {
+	Deleted   int64 `json:"deleted"`
+	Remaining int64 `json:"remaining"`
+	DryRun    bool  `json:"dry_run,omitempty"`
+}
+
+// CompactEvents deletes old events to bound the size of the log. It never
+// removes events that are still needed for coordination:
+//
+//   - each agent's latest progress event (its last reported position),
+//   - inbox events (msg, review_req, review_done) their recipient has
+//     not received yet (see cursor.go),
+//   - messages their recipient deferred (cm recv --defer),
+//   - messages their recipient kept in the inbox or flagged,
+//   - events newer than every agent's cursor,
+//   - the newest KeepEvents events.
+//
+// Deletion runs in a single transaction so readers never observe a
+// partially archived log. The archive is written only after it commits,
+// so a deletion that fails or is retried never archives events twice or
+// archives events still in the log.
+func (s *Store) CompactEvents(opts CompactOptions) (*CompactResult, error) {
+	if !opts.DryRun {
+		if err := s.authorize(s.db, "gc"); err != nil {
+			return nil, err
+		}
+	}
+	var maxCursor sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(since_ts) FROM inbox_cursors`).Scan(&maxCursor); err != nil {
+		return nil, fmt.Errorf("read cursors: %w", err)
+	}
+	cursorCeiling := int64(math.MaxInt64)
+	if maxCursor.Valid {
+		cursorCeiling = maxCursor.Int64
+	}
+
+	ageCond := ""
+	args := []interface{}{cursorCeiling}
+	if !opts.Before.IsZero() {
+		ageCond = ` AND e.created_at < ?`
+		args = append(args, opts.Before.UTC().Format(time.RFC3339Nano))
+	}
+	args = append(args, max(opts.KeepEvents, 0))
+	rows, err := s.db.Query(
+		`SELECT e.id, e.agent_id, e.lamport_ts, e.epoch, e.round, e.kind,
+		        COALESCE(e.target,''), COALESCE(e.body,''), e.created_at, e.priority, e.tool, e.run_id, e.branch, e.signature, e.prev_hash
+		 FROM events e
+		 WHERE e.lamport_ts < ?`+ageCond+`
+		   AND e.id NOT IN (SELECT id FROM events ORDER BY id DESC LIMIT ?)
+		   AND NOT (e.kind = 'progress' AND e.id =
+		        (SELECT MAX(p.id) FROM events p WHERE p.agent_id = e.agent_id AND p.kind = 'progress'))
+		   AND NOT (`+unreadCond+`)
+		   AND e.id NOT IN (SELECT event_id FROM deferrals)
+		   AND e.id NOT IN (SELECT event_id FROM message_state WHERE state <> 'archived')
+		 ORDER BY e.id ASC`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select candidates: %w", err)
+	}
+	victims, err := scanEvents(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CompactResult{Deleted: int64(len(victims)), DryRun: opts.DryRun}
+	if opts.DryRun || len(victims) == 0 {
+		res.Remaining = s.CountEvents() - res.Deleted
+		return res, nil
+	}
+
+	var archived bytes.Buffer
+	if opts.Archive != nil {
+		enc := json.NewEncoder(&archived)
+		for _, e := range victims {
+			if err := enc.Encode(e); err != nil {
+				return nil, fmt.Errorf("archive event %d: %w", e.ID, err)
+			}
+		}
+	}
+
+	err = retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := snapshotPermalinks(tx, victims); err != nil {
+			return err
+		}
+		const batch = 500
+		for i := 0; i < len(victims); i += batch {
+			end := min(i+batch, len(victims))
+			args := make([]interface{}, 0, end-i)
+			for _, e := range victims[i:end] {
+				args = append(args, e.ID)
+			}
+			placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+			if _, err := tx.Exec(`DELETE FROM events WHERE id IN (`+placeholders+`)`, args...); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM deliveries WHERE event_id IN (`+placeholders+`)`, args...); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM message_state WHERE event_id IN (`+placeholders+`)`, args...); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM schedules WHERE event_id IN (`+placeholders+`)`, args...); err != nil {
+				return err
+			}
+		}
+		if err := s.logPrivileged(tx, "gc", fmt.Sprintf("deleted %d events", len(victims))); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("delete events: %w", err)
+	}
+	if opts.Archive != nil {
+		if _, err := opts.Archive.Write(archived.Bytes()); err != nil {
+			return nil, fmt.Errorf("archive %d deleted events: %w", len(victims), err)
+		}
+	}
+	res.Remaining = s.CountEvents()
+	return res, nil
+}
+
 // ---------------------------------------------------------------------------
 // Locks
 // ---------------------------------------------------------------------------
@@ -351,9 +728,21 @@ func scanEvents(rows *sql.Rows) ([]model.Event, error) {
 // The entire check-and-grant sequence runs inside a transaction to prevent
 // TOCTOU races when two agents request the same lock concurrently.
 func (s *Store) AcquireLock(path, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) (*model.Lock, *model.Lock, error) {
-	now := time.Now().UTC()
-	expiresAt := now.Add(ttl)
+	span := s.tracer.Start("store.acquire_lock",
+		trace.String("clockmail.lock.path", path), trace.String("clockmail.agent", agentID),
+		trace.Int("clockmail.lamport_ts", lamportTS))
+	lock, conflict, err := s.acquireLock(path, agentID, lamportTS, epoch, exclusive, ttl)
+	switch {
+	case conflict != nil:
+		span.Set(trace.String("clockmail.lock.outcome", "conflict"), trace.String("clockmail.lock.holder", conflict.AgentID))
+	case lock != nil:
+		span.Set(trace.String("clockmail.lock.outcome", "granted"))
+	}
+	span.End(err)
+	return lock, conflict, err
+}
 
+func (s *Store) acquireLock(path, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) (*model.Lock, *model.Lock, error) {
 	// Expire stale locks outside the transaction (best-effort cleanup).
 	s.expireStaleLocks()
 
@@ -363,15 +752,92 @@ func (s *Store) AcquireLock(path, agentID string, lamportTS, epoch int64, exclus
 	}
 	defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
 
+	lock, conflict, err := s.grantLock(tx, path, agentID, lamportTS, epoch, exclusive, time.Now().UTC().Add(ttl))
+	if err != nil || conflict != nil {
+		return nil, conflict, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("commit lock: %w", err)
+	}
+	return lock, nil, nil
+}
+
+// AcquireLocks acquires every path for agentID in one transaction, or
+// none of them: if any path is held by an agent with priority, nothing is
+// granted and that holder's lock is returned. Paths are taken in sorted
+// order, so two agents locking overlapping sets cannot deadlock. The
+// granted locks are returned in that order.
+func (s *Store) AcquireLocks(paths []string, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) ([]model.Lock, *model.Lock, error) {
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	sorted = slices.Compact(sorted)
+	span := s.tracer.Start("store.acquire_locks",
+		trace.Int("clockmail.lock.paths", int64(len(sorted))), trace.String("clockmail.agent", agentID),
+		trace.Int("clockmail.lamport_ts", lamportTS))
+	locks, conflict, err := s.acquireLocks(sorted, agentID, lamportTS, epoch, exclusive, ttl)
+	switch {
+	case conflict != nil:
+		span.Set(trace.String("clockmail.lock.outcome", "conflict"), trace.String("clockmail.lock.holder", conflict.AgentID),
+			trace.String("clockmail.lock.path", conflict.Path))
+	case err == nil:
+		span.Set(trace.String("clockmail.lock.outcome", "granted"))
+	}
+	span.End(err)
+	return locks, conflict, err
+}
+
+func (s *Store) acquireLocks(paths []string, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) ([]model.Lock, *model.Lock, error) {
+	s.expireStaleLocks()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+
+	locks, conflict, err := s.grantLocks(tx, paths, agentID, lamportTS, epoch, exclusive, time.Now().UTC().Add(ttl))
+	if err != nil || conflict != nil {
+		return nil, conflict, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("commit locks: %w", err)
+	}
+	return locks, nil, nil
+}
+
+// grantLocks runs grantLock for each of the sorted paths within tx,
+// stopping at the first conflict. The caller must not commit tx then.
+func (s *Store) grantLocks(tx *txn, paths []string, agentID string, lamportTS, epoch int64, exclusive bool, expiresAt time.Time) ([]model.Lock, *model.Lock, error) {
+	locks := make([]model.Lock, 0, len(paths))
+	for _, path := range paths {
+		lock, conflict, err := s.grantLock(tx, path, agentID, lamportTS, epoch, exclusive, expiresAt)
+		if err != nil || conflict != nil {
+			return nil, conflict, err
+		}
+		locks = append(locks, *lock)
+	}
+	return locks, nil, nil
+}
+
+// grantLock is the check-and-grant step of AcquireLock within tx: it
+// returns the lock granted, or the conflicting lock if another agent holds
+// path with a lower (lamport_ts, agent_id). A holder the requester beats
+// is evicted. Holders outside the store's branch namespace are ignored.
+func (s *Store) grantLock(tx *txn, path, agentID string, lamportTS, epoch int64, exclusive bool, expiresAt time.Time) (*model.Lock, *model.Lock, error) {
+	if err := tx.advisoryLock("clockmail:lock:" + path); err != nil {
+		return nil, nil, fmt.Errorf("advisory lock: %w", err)
+	}
+
 	// Check for conflicts using Lamport total order.
 	var conflict model.Lock
 	var conflictExpires string
-	err = tx.QueryRow(
-		`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at
-		 FROM locks WHERE path = ? AND agent_id != ? AND exclusive = 1`,
-		path, agentID,
+	err := tx.QueryRow(
+		`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at, branch, abs_path
+		 FROM locks WHERE path = ? AND agent_id != ? AND exclusive = 1 AND `+branchCond+`
+		 ORDER BY lamport_ts ASC, agent_id ASC LIMIT 1`,
+		path, agentID, s.viewBranch(), s.viewBranch(),
 	).Scan(&conflict.Path, &conflict.AgentID, &conflict.LamportTS, &conflict.Epoch,
-		&conflict.Exclusive, &conflictExpires)
+		&conflict.Exclusive, &conflictExpires, &conflict.Branch, &conflict.AbsPath)
 
 	if err == nil {
 		var parseErr error
@@ -380,9 +846,10 @@ func (s *Store) AcquireLock(path, agentID string, lamportTS, epoch int64, exclus
 			return nil, nil, fmt.Errorf("parse lock expires_at for %s: %w", conflict.Path, parseErr)
 		}
 		if clock.TotalOrderLess(lamportTS, agentID, conflict.LamportTS, conflict.AgentID) {
-			// Requester wins — evict the existing lock.
-			if _, err := tx.Exec(`DELETE FROM locks WHERE path = ? AND agent_id = ?`,
-				path, conflict.AgentID); err != nil {
+			// Requester wins — evict the existing lock, and any a
+			// requester seeing several branches beats along with it.
+			if _, err := tx.Exec(`DELETE FROM locks WHERE path = ? AND agent_id != ? AND exclusive = 1 AND `+branchCond,
+				path, agentID, s.viewBranch(), s.viewBranch()); err != nil {
 				return nil, nil, fmt.Errorf("evict lock: %w", err)
 			}
 		} else {
@@ -392,6 +859,10 @@ func (s *Store) AcquireLock(path, agentID string, lamportTS, epoch int64, exclus
 	}
 
 	// Grant the lock.
+	var absPath string
+	if s.worktree != "" && !filepath.IsAbs(path) {
+		absPath = filepath.Join(s.worktree, filepath.FromSlash(path))
+	}
 	lock := model.Lock{
 		Path:      path,
 		AgentID:   agentID,
@@ -399,24 +870,28 @@ func (s *Store) AcquireLock(path, agentID string, lamportTS, epoch int64, exclus
 		Epoch:     epoch,
 		Exclusive: exclusive,
 		ExpiresAt: expiresAt,
+		Branch:    s.branch,
+		AbsPath:   absPath,
 	}
 	_, err = tx.Exec(
-		`INSERT INTO locks (path, agent_id, lamport_ts, epoch, exclusive, expires_at)
-		 VALUES (?, ?, ?, ?, ?, ?)
+		`INSERT INTO locks (path, agent_id, lamport_ts, epoch, exclusive, expires_at, branch, abs_path)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 		 ON CONFLICT(path, agent_id) DO UPDATE SET
 		   lamport_ts = excluded.lamport_ts,
 		   epoch = excluded.epoch,
 		   exclusive = excluded.exclusive,
-		   expires_at = excluded.expires_at`,
+		   expires_at = excluded.expires_at,
+		   branch = excluded.branch,
+		   abs_path = excluded.abs_path`,
 		path, agentID, lamportTS, epoch, boolToInt(exclusive),
-		expiresAt.Format(time.RFC3339Nano),
+		expiresAt.Format(time.RFC3339Nano), s.branch, absPath,
 	)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	if err := tx.Commit(); err != nil {
-		return nil, nil, fmt.Errorf("commit lock: %w", err)
+	// The agent is no longer waiting for the lock it now holds.
+	if _, err := tx.Exec(`DELETE FROM lock_intents WHERE path = ? AND agent_id = ?`, path, agentID); err != nil {
+		return nil, nil, fmt.Errorf("drop lock intent: %w", err)
 	}
 	return &lock, nil, nil
 }
@@ -429,12 +904,124 @@ func (s *Store) ReleaseLock(path, agentID string) error {
 	})
 }
 
-// ListLocks returns all active (non-expired) locks.
+// ForceReleaseLock releases every lock on path in the store's branch
+// view, whoever holds it, along with the holders' intents for path, and
+// returns the locks it released. It is the operator's way out when a
+// holder has crashed mid-edit, and privileged (see admin.go).
+func (s *Store) ForceReleaseLock(path string) ([]model.Lock, error) {
+	var released []model.Lock
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		locks, err := s.forceReleaseIn(tx, path)
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		released = locks
+		return nil
+	})
+	if err == nil && len(released) > 0 {
+		s.bump()
+	}
+	return released, err
+}
+
+// forceReleaseIn is ForceReleaseLock within tx.
+func (s *Store) forceReleaseIn(tx *txn, path string) ([]model.Lock, error) {
+	if err := s.authorize(tx, "force_unlock"); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(
+		`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at, branch, abs_path
+		 FROM locks WHERE path = ? AND expires_at >= ? AND `+branchCond+`
+		 ORDER BY lamport_ts ASC, agent_id ASC`,
+		path, time.Now().UTC().Format(time.RFC3339Nano), s.viewBranch(), s.viewBranch(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	locks, err := scanLocks(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	holders := make([]string, len(locks))
+	for i, l := range locks {
+		if _, err := tx.Exec(`DELETE FROM locks WHERE path = ? AND agent_id = ?`, path, l.AgentID); err != nil {
+			return nil, err
+		}
+		// As with cm unlock, the holder leaves the path's queue too.
+		if _, err := tx.Exec(`DELETE FROM lock_intents WHERE path = ? AND agent_id = ?`, path, l.AgentID); err != nil {
+			return nil, err
+		}
+		holders[i] = l.AgentID
+	}
+	if len(locks) > 0 {
+		detail := fmt.Sprintf("released %s from %s", path, strings.Join(holders, ", "))
+		if err := s.logPrivileged(tx, "force_unlock", detail); err != nil {
+			return nil, err
+		}
+	}
+	return locks, nil
+}
+
+// ErrLockNotHeld is returned by RenewLock when the agent does not hold an
+// unexpired lock on the path.
+var ErrLockNotHeld = errors.New("lock not held")
+
+// RenewLock pushes the expiry of a lock held by agentID to ttl from now.
+// The lock keeps its Lamport timestamp, so renewal never changes who wins
+// a conflict. A lock that has already expired cannot be renewed: another
+// agent may have taken it since, and the caller must re-acquire it.
+func (s *Store) RenewLock(path, agentID string, ttl time.Duration) (*model.Lock, error) {
+	now := time.Now().UTC()
+	var lock *model.Lock
+	err := retryOnContention(func() error {
+		r, err := s.db.Exec(
+			`UPDATE locks SET expires_at = ? WHERE path = ? AND agent_id = ? AND expires_at >= ?`,
+			now.Add(ttl).Format(time.RFC3339Nano), path, agentID, now.Format(time.RFC3339Nano),
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := r.RowsAffected(); n == 0 {
+			return fmt.Errorf("%w: %s", ErrLockNotHeld, path)
+		}
+		rows, err := s.db.Query(
+			`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at, branch, abs_path
+			 FROM locks WHERE path = ? AND agent_id = ?`, path, agentID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		locks, err := scanLocks(rows)
+		if err != nil {
+			return err
+		}
+		if len(locks) == 0 {
+			return fmt.Errorf("%w: %s", ErrLockNotHeld, path)
+		}
+		lock = &locks[0]
+		return nil
+	})
+	return lock, err
+}
+
+// ListLocks returns all active (non-expired) locks in the store's branch
+// namespace.
 func (s *Store) ListLocks() ([]model.Lock, error) {
 	s.expireStaleLocks()
 	rows, err := s.db.Query(
-		`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at
-		 FROM locks ORDER BY lamport_ts ASC`,
+		`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at, branch, abs_path
+		 FROM locks WHERE `+branchCond+` ORDER BY lamport_ts ASC`,
+		s.viewBranch(), s.viewBranch(),
 	)
 	if err != nil {
 		return nil, err
@@ -447,7 +1034,7 @@ func (s *Store) ListLocks() ([]model.Lock, error) {
 func (s *Store) ListLocksForAgent(agentID string) ([]model.Lock, error) {
 	s.expireStaleLocks()
 	rows, err := s.db.Query(
-		`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at
+		`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at, branch, abs_path
 		 FROM locks WHERE agent_id = ? ORDER BY lamport_ts ASC`, agentID,
 	)
 	if err != nil {
@@ -457,42 +1044,210 @@ func (s *Store) ListLocksForAgent(agentID string) ([]model.Lock, error) {
 	return scanLocks(rows)
 }
 
+// LocksOnPath returns the unexpired locks on path in the store's branch
+// namespace, in total order. Unlike ListLocks it changes nothing: expired
+// locks are skipped rather than deleted, for cm lock --dry-run.
+func (s *Store) LocksOnPath(path string) ([]model.Lock, error) {
+	rows, err := s.db.Query(
+		`SELECT path, agent_id, lamport_ts, epoch, exclusive, expires_at, branch, abs_path
+		 FROM locks WHERE path = ? AND expires_at >= ? AND `+branchCond+`
+		 ORDER BY lamport_ts ASC, agent_id ASC`,
+		path, time.Now().UTC().Format(time.RFC3339Nano), s.viewBranch(), s.viewBranch(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanLocks(rows)
+}
+
+// ListLockRequests returns lock_req events recorded at or after since,
+// in total order. Unlike ListLocks it includes locks that have since been
+// released or have expired.
+func (s *Store) ListLockRequests(since time.Time) ([]model.Event, error) {
+	rows, err := s.db.Query(
+		`SELECT id, agent_id, lamport_ts, epoch, round, kind,
+		        COALESCE(target,''), COALESCE(body,''), created_at, priority, tool, run_id, branch, signature, prev_hash
+		 FROM events WHERE kind = ? AND created_at >= ?
+		 ORDER BY lamport_ts ASC, id ASC`,
+		string(model.EventLockReq), since.UTC().Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEvents(rows)
+}
+
+// DefaultActiveWindow is how recently an agent must have been seen to
+// count toward the frontier, unless SetActiveWindow says otherwise.
+const DefaultActiveWindow = 10 * time.Minute
+
+// SetActiveWindow changes how recently an agent must have been seen to
+// count toward the frontier: in GetActivePointstamps with no window of its
+// own, the frontier history, and messages held for an epoch. d <= 0
+// restores DefaultActiveWindow.
+func (s *Store) SetActiveWindow(d time.Duration) { s.activeWindow = d }
+
+// SetBranch scopes the store to a git branch's namespace: locks it grants
+// are tagged with branch, and locks and inbox messages tagged with another
+// branch are invisible to it, so they neither conflict with its locks nor
+// are received, unless allBranches. Untagged locks and messages belong to
+// every branch. An empty branch turns scoping off. Events are tagged by
+// their writer, in Provenance.Branch.
+func (s *Store) SetBranch(branch string, allBranches bool) {
+	s.branch, s.allBranches = branch, allBranches
+}
+
+// SetWorktree records root as the git working tree the store's caller
+// works in: locks it grants on paths relative to the repository root also
+// record where the file is in that worktree (Lock.AbsPath), so agents in
+// other worktrees see which copy the holder is editing.
+func (s *Store) SetWorktree(root string) { s.worktree = root }
+
+// viewBranch is the branch whose namespace the store sees, or "" for all
+// of them.
+func (s *Store) viewBranch() string {
+	if s.allBranches {
+		return ""
+	}
+	return s.branch
+}
+
+// ActiveWindow returns the window set by SetActiveWindow, or
+// DefaultActiveWindow.
+func (s *Store) ActiveWindow() time.Duration {
+	if s.activeWindow > 0 {
+		return s.activeWindow
+	}
+	return DefaultActiveWindow
+}
+
 // GetActivePointstamps returns a Pointstamp per agent representing their
-// current working position — used for frontier computation. Only includes
-// agents seen within the last 10 minutes (considered alive).
-func (s *Store) GetActivePointstamps() ([]model.Pointstamp, error) {
+// current working position — used for frontier computation — followed by
+// one per message still in flight: unread by its recipient, at the
+// sender's epoch and round when it was sent (see inFlightPointstamps).
+// Only includes agents seen within window (considered alive); window <= 0
+// uses ActiveWindow.
+func (s *Store) GetActivePointstamps(window time.Duration) ([]model.Pointstamp, error) {
+	if window <= 0 {
+		window = s.ActiveWindow()
+	}
 	agents, err := s.ListAgents()
 	if err != nil {
 		return nil, err
 	}
 	var ps []model.Pointstamp
 	for _, a := range agents {
-		if time.Since(a.LastSeen) < 10*time.Minute {
+		if a.DepartedAt == nil && time.Since(a.LastSeen) < window {
 			ps = append(ps, model.Pointstamp{
-				Timestamp: model.Timestamp{Epoch: a.Epoch, Round: a.Round},
+				Timestamp: a.Position(),
 				AgentID:   a.ID,
 			})
 		}
 	}
-	return ps, nil
+	msgs, err := s.inFlightPointstamps(window)
+	if err != nil {
+		return nil, fmt.Errorf("in-flight messages: %w", err)
+	}
+	return append(ps, msgs...), nil
+}
+
+// inFlightPointstamps returns a Pointstamp for each inbox message its
+// recipient has not received, located at the recipient and tagged with
+// the message's event ID. Only recipients seen within window count, as
+// for positions, so that a crashed agent's inbox cannot hold an epoch
+// open forever; held messages (schedule.go) count once released.
+func (s *Store) inFlightPointstamps(window time.Duration) ([]model.Pointstamp, error) {
+	now := time.Now()
+	args := append([]interface{}{now.Add(-window).UTC().Format(time.RFC3339Nano)}, s.visibleArgs(now)...)
+	rows, err := s.db.Query(
+		`SELECT e.id, e.target, e.epoch, e.round FROM events e JOIN agents r ON r.id = e.target
+		 WHERE r.departed_at = '' AND r.last_seen >= ? AND `+unreadCond+` AND `+visibleCond+`
+		 ORDER BY e.lamport_ts ASC, e.id ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ps []model.Pointstamp
+	for rows.Next() {
+		var p model.Pointstamp
+		if err := rows.Scan(&p.EventID, &p.AgentID, &p.Timestamp.Epoch, &p.Timestamp.Round); err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, rows.Err()
+}
+
+// ---------------------------------------------------------------------------
+// Workflow
+// ---------------------------------------------------------------------------
+
+// SetWorkflow records body as the active workflow definition. Earlier
+// definitions are kept for history; the most recent one wins.
+func (s *Store) SetWorkflow(body, appliedBy string) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO workflows (body, applied_by, applied_at) VALUES (?, ?, ?)`,
+			body, appliedBy, now,
+		)
+		return err
+	})
+}
+
+// GetWorkflow returns the active workflow definition, or "" if none has
+// been applied.
+func (s *Store) GetWorkflow() (string, error) {
+	var body string
+	err := s.db.QueryRow(`SELECT body FROM workflows ORDER BY id DESC LIMIT 1`).Scan(&body)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return body, err
 }
 
 // ---------------------------------------------------------------------------
 // Helpers
 // ---------------------------------------------------------------------------
 
+// insertReturningID runs an INSERT into a table with an "id" key and
+// returns the new row's ID. PostgreSQL drivers do not support
+// LastInsertId, so the ID comes back through RETURNING there.
+func (d dialect) insertReturningID(db dbtx, query string, args ...interface{}) (int64, error) {
+	var id int64
+	if d == dialectPostgres {
+		err := db.QueryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
 func (s *Store) expireStaleLocks() {
-	now := time.Now().UTC().Format(time.RFC3339Nano)
-	_, _ = s.db.Exec(`DELETE FROM locks WHERE expires_at < ?`, now)
+	_ = expireLocks(s.db)
 }
 
+func expireLocks(db dbtx) error {
+	_, err := db.Exec(`DELETE FROM locks WHERE expires_at < ?`, time.Now().UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// branchCond is the SQL condition for a lock in the namespace of a
+// branch, or of every branch if it is empty. It takes the branch twice.
+const branchCond = `(? = '' OR branch = '' OR branch = ?)`
+
 func scanLocks(rows *sql.Rows) ([]model.Lock, error) {
 	var locks []model.Lock
 	for rows.Next() {
 		var l model.Lock
 		var expStr string
 		var excl int
-		if err := rows.Scan(&l.Path, &l.AgentID, &l.LamportTS, &l.Epoch, &excl, &expStr); err != nil {
+		if err := rows.Scan(&l.Path, &l.AgentID, &l.LamportTS, &l.Epoch, &excl, &expStr, &l.Branch, &l.AbsPath); err != nil {
 			return nil, err
 		}
 		l.Exclusive = excl != 0
@@ -1,15 +1,20 @@
 package store
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/query"
 )
 
-func newTestStore(t *testing.T) *Store {
+func newTestStore(t testing.TB) *Store {
 	t.Helper()
 	dbPath := filepath.Join(t.TempDir(), "test.db")
 	s, err := New(dbPath)
@@ -76,6 +81,51 @@ func TestUpdateAgentClock(t *testing.T) {
 	}
 }
 
+func TestSetAgentAt_Steps(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+
+	at := model.Timestamp{Epoch: 3, Round: 2, Steps: []int64{7}}
+	if err := s.SetAgentAt("alice", at); err != nil {
+		t.Fatalf("SetAgentAt: %v", err)
+	}
+	ag, _ := s.GetAgent("alice")
+	if !ag.Position().Equal(at) {
+		t.Fatalf("position = %s, want %s", ag.Position(), at)
+	}
+
+	// Staying in the round keeps the steps; leaving it clears them.
+	s.SetAgentPosition("alice", 3, 2)
+	if ag, _ = s.GetAgent("alice"); !ag.Position().Equal(at) {
+		t.Fatalf("after same-round move, position = %s, want %s", ag.Position(), at)
+	}
+	s.UpdateAgentClock("alice", 5, 3, 3)
+	if ag, _ = s.GetAgent("alice"); ag.Steps != nil {
+		t.Fatalf("after moving to round 3, steps = %v, want none", ag.Steps)
+	}
+}
+
+func TestSetAgentScope(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+
+	if err := s.SetAgentScope("alice", "pkg/store"); err != nil {
+		t.Fatalf("SetAgentScope: %v", err)
+	}
+	if ag, _ := s.GetAgent("alice"); ag.Scope != "pkg/store" {
+		t.Fatalf("scope = %q, want pkg/store", ag.Scope)
+	}
+	if _, err := s.SpawnAgent("alice/1", "alice", 1, Lifecycle{}); err != nil {
+		t.Fatal(err)
+	}
+	if ag, _ := s.GetAgent("alice/1"); ag.Scope != "pkg/store" {
+		t.Fatalf("sub-agent scope = %q, want its parent's", ag.Scope)
+	}
+	if err := s.SetAgentScope("ghost", "pkg/web"); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("SetAgentScope(ghost) = %v, want ErrNotRegistered", err)
+	}
+}
+
 func TestListAgents_Ordered(t *testing.T) {
 	s := newTestStore(t)
 	s.RegisterAgent("carol")
@@ -213,6 +263,69 @@ func TestListEventsSinceID(t *testing.T) {
 	}
 }
 
+func TestQueryEvents(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now().UTC()
+	for _, e := range []model.Event{
+		{AgentID: "alice", LamportTS: 1, Epoch: 1, Kind: model.EventMsg, Target: "bob", Body: "start the Refactor", CreatedAt: now.Add(-2 * time.Hour)},
+		{AgentID: "alice", LamportTS: 2, Epoch: 3, Kind: model.EventMsg, Target: "bob", Body: "refactor done", CreatedAt: now, Priority: model.PriorityUrgent},
+		{AgentID: "bob", LamportTS: 3, Epoch: 3, Kind: model.EventLockReq, Target: "pkg/a.go", CreatedAt: now},
+		{AgentID: "bob", LamportTS: 4, Epoch: 4, Kind: model.EventMsg, Target: "alice", Body: "100%_sure", CreatedAt: now},
+		{AgentID: "carol", LamportTS: 5, Epoch: 4, Kind: model.EventProgress, CreatedAt: now},
+	} {
+		e := e
+		if _, err := s.InsertEvent(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, _ := s.ListEvents(0, 100)
+
+	cases := []struct {
+		src  string
+		want []int64 // Lamport timestamps
+	}{
+		{`kind=msg and agent=alice and body~"refactor" and epoch>=3`, []int64{2}},
+		{`body~refactor`, []int64{1, 2}},
+		{`kind=msg and not agent=alice`, []int64{4}},
+		{`(kind=lock_req or kind=progress) and ts>3`, []int64{5}},
+		{`target~"pkg/" or priority=urgent`, []int64{2, 3}},
+		{`priority=normal and kind=msg`, []int64{1, 4}},
+		{`body~"0%_"`, []int64{4}},
+		{`body~"0%x"`, nil},
+		{`age>1h`, []int64{1}},
+		{`body!~refactor and kind=msg`, []int64{4}},
+	}
+	for _, c := range cases {
+		q, err := query.Parse(c.src)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", c.src, err)
+		}
+		events, err := s.QueryEvents(q, 0, 100)
+		if err != nil {
+			t.Fatalf("QueryEvents(%q): %v", c.src, err)
+		}
+		var got, matched []int64
+		for _, e := range events {
+			got = append(got, e.LamportTS)
+		}
+		for _, e := range all {
+			if q.Match(e) {
+				matched = append(matched, e.LamportTS)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: got ts %v, want %v", c.src, got, c.want)
+		}
+		if fmt.Sprint(matched) != fmt.Sprint(got) {
+			t.Errorf("%s: Match selects %v but SQL selects %v", c.src, matched, got)
+		}
+	}
+
+	if events, _ := s.QueryEvents(nil, 4, 100); len(events) != 2 {
+		t.Fatalf("nil query since ts 4: got %d events, want 2", len(events))
+	}
+}
+
 func TestMaxEventID_Empty(t *testing.T) {
 	s := newTestStore(t)
 	if id := s.MaxEventID(); id != 0 {
@@ -236,6 +349,39 @@ func TestMaxEventID_WithEvents(t *testing.T) {
 	}
 }
 
+func TestInsertEvents(t *testing.T) {
+	s := newTestStore(t)
+	batch := func(from string, targets ...string) []*model.Event {
+		var out []*model.Event
+		for _, to := range targets {
+			out = append(out, &model.Event{AgentID: from, LamportTS: 5, Kind: model.EventMsg,
+				Target: to, Body: "all hands", CreatedAt: time.Now().UTC()})
+		}
+		return out
+	}
+
+	ids, err := s.InsertEvents(batch("alice", "bob", "carol", "dave"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[1] != ids[0]+1 || ids[2] != ids[1]+1 {
+		t.Fatalf("InsertEvents ids = %v; want three consecutive IDs", ids)
+	}
+
+	// A batch that fails part-way writes nothing: erin's session token is
+	// not held here, so her second copy is refused.
+	if _, err := s.StartSession("erin"); err != nil {
+		t.Fatal(err)
+	}
+	mixed := append(batch("alice", "bob"), batch("erin", "bob")...)
+	if _, err := s.InsertEvents(mixed); !errors.Is(err, ErrSessionMismatch) {
+		t.Fatalf("InsertEvents with a refused event: err = %v, want ErrSessionMismatch", err)
+	}
+	if n := s.CountEvents(); n != 3 {
+		t.Fatalf("CountEvents = %d after a failed batch, want 3", n)
+	}
+}
+
 func TestListEventsForAgent(t *testing.T) {
 	s := newTestStore(t)
 	s.RegisterAgent("alice")
@@ -296,6 +442,39 @@ func TestCursor_Update(t *testing.T) {
 	}
 }
 
+func TestCursor_PerSender(t *testing.T) {
+	s := newTestStore(t)
+	for i, from := range []string{"bob", "carol", "bob", "carol"} {
+		s.InsertEvent(&model.Event{AgentID: from, LamportTS: int64(i + 1), Kind: model.EventMsg, Target: "alice", CreatedAt: time.Now().UTC()})
+	}
+
+	// Reading bob's messages leaves carol's unread.
+	if err := s.SetSenderCursor("alice", "bob", 4); err != nil {
+		t.Fatal(err)
+	}
+	unread, err := s.ListUnread("alice", "", 10)
+	if err != nil || len(unread) != 2 || unread[0].AgentID != "carol" || unread[1].AgentID != "carol" {
+		t.Fatalf("ListUnread = %+v, %v", unread, err)
+	}
+	if bob, _ := s.ListUnread("alice", "bob", 10); len(bob) != 0 {
+		t.Fatalf("bob's unread = %+v", bob)
+	}
+	// A sender cursor never moves back.
+	s.SetSenderCursor("alice", "bob", 2)
+	if sc, _ := s.SenderCursors("alice"); sc["bob"] != 4 {
+		t.Fatalf("SenderCursors = %v, want bob=4", sc)
+	}
+
+	// The all-senders cursor catching up drops the sender cursor.
+	s.SetCursor("alice", 5)
+	if sc, _ := s.SenderCursors("alice"); len(sc) != 0 {
+		t.Fatalf("SenderCursors after catch-up = %v", sc)
+	}
+	if unread, _ := s.ListUnread("alice", "", 10); len(unread) != 0 {
+		t.Fatalf("unread after catch-up = %+v", unread)
+	}
+}
+
 // --- Lock tests ---
 
 func TestAcquireLock_Success(t *testing.T) {
@@ -384,6 +563,84 @@ func TestReleaseLock(t *testing.T) {
 	}
 }
 
+func TestForceReleaseLock(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	s.AcquireLock("file.go", "alice", 1, 0, false, time.Hour)
+	s.AcquireLock("file.go", "bob", 2, 0, false, time.Hour)
+	s.AcquireLock("other.go", "bob", 3, 0, true, time.Hour)
+	s.QueueLockIntent("file.go", "bob", 2, time.Hour)
+	s.QueueLockIntent("file.go", "carol", 4, time.Hour)
+
+	released, err := s.ForceReleaseLock("file.go")
+	if err != nil {
+		t.Fatalf("ForceReleaseLock: %v", err)
+	}
+	if len(released) != 2 || released[0].AgentID != "alice" || released[1].AgentID != "bob" {
+		t.Fatalf("released = %+v, want alice's and bob's", released)
+	}
+	if locks, _ := s.ListLocks(); len(locks) != 1 || locks[0].Path != "other.go" {
+		t.Fatalf("locks left = %+v, want other.go alone", locks)
+	}
+	if intents, _ := s.ListLockIntents(); len(intents) != 1 || intents[0].AgentID != "carol" {
+		t.Fatalf("intents left = %+v, want carol's alone", intents)
+	}
+	if released, err := s.ForceReleaseLock("file.go"); err != nil || len(released) != 0 {
+		t.Errorf("second ForceReleaseLock = %+v, %v", released, err)
+	}
+}
+
+func TestRenewLock(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.AcquireLock("file.go", "alice", 7, 0, true, time.Minute)
+
+	lock, err := s.RenewLock("file.go", "alice", time.Hour)
+	if err != nil {
+		t.Fatalf("RenewLock: %v", err)
+	}
+	if time.Until(lock.ExpiresAt) < 59*time.Minute {
+		t.Fatalf("expires_at = %v, want about an hour from now", lock.ExpiresAt)
+	}
+	if lock.LamportTS != 7 {
+		t.Fatalf("renewal must keep the lock's timestamp, got ts=%d", lock.LamportTS)
+	}
+}
+
+func TestRenewLock_NotHeld(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	s.AcquireLock("file.go", "alice", 1, 0, true, time.Hour)
+	s.AcquireLock("old.go", "bob", 2, 0, true, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := s.RenewLock("file.go", "bob", time.Hour); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("renewing another agent's lock: err = %v, want ErrLockNotHeld", err)
+	}
+	if _, err := s.RenewLock("old.go", "bob", time.Hour); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("renewing an expired lock: err = %v, want ErrLockNotHeld", err)
+	}
+}
+
+func TestListLockRequests(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	now := time.Now().UTC()
+	s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventLockReq, Target: "old.go", CreatedAt: now.Add(-2 * time.Hour)})
+	s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 2, Kind: model.EventLockReq, Target: "new.go", CreatedAt: now})
+	s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 3, Kind: model.EventLockRel, Target: "new.go", CreatedAt: now})
+
+	events, err := s.ListLockRequests(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("ListLockRequests: %v", err)
+	}
+	if len(events) != 1 || events[0].Target != "new.go" {
+		t.Fatalf("got %+v, want only the recent lock_req for new.go", events)
+	}
+}
+
 func TestListLocks_ExpiresStale(t *testing.T) {
 	s := newTestStore(t)
 	s.RegisterAgent("alice")
@@ -418,6 +675,92 @@ func TestListLocksForAgent(t *testing.T) {
 	}
 }
 
+func TestAcquireLock_BranchScoped(t *testing.T) {
+	s := newTestStore(t)
+	for _, id := range []string{"alice", "bob", "carol", "dave"} {
+		s.RegisterAgent(id)
+	}
+
+	s.SetBranch("feature/a", false)
+	if _, conflict, err := s.AcquireLock("file.go", "alice", 1, 0, true, time.Hour); err != nil || conflict != nil {
+		t.Fatalf("alice on feature/a: conflict %+v, %v", conflict, err)
+	}
+	// Another branch does not see alice's lock.
+	s.SetBranch("feature/b", false)
+	lock, conflict, err := s.AcquireLock("file.go", "bob", 2, 0, true, time.Hour)
+	if err != nil || conflict != nil || lock.Branch != "feature/b" {
+		t.Fatalf("bob on feature/b: lock %+v, conflict %+v, %v", lock, conflict, err)
+	}
+	if locks, _ := s.ListLocks(); len(locks) != 1 || locks[0].AgentID != "bob" {
+		t.Fatalf("feature/b locks = %+v, want only bob's", locks)
+	}
+
+	// Unscoped, every branch's locks count.
+	s.SetBranch("", false)
+	if _, conflict, _ := s.AcquireLock("file.go", "carol", 3, 0, true, time.Hour); conflict == nil || conflict.AgentID != "alice" {
+		t.Fatalf("unscoped carol: conflict %+v, want alice's lock", conflict)
+	}
+	if locks, _ := s.ListLocks(); len(locks) != 2 {
+		t.Fatalf("unscoped locks = %+v, want both branches'", locks)
+	}
+
+	// Looking across branches, a winner evicts every holder it beats.
+	s.SetBranch("feature/b", true)
+	if _, conflict, err := s.AcquireLock("file.go", "dave", 0, 0, true, time.Hour); err != nil || conflict != nil {
+		t.Fatalf("dave across branches: conflict %+v, %v", conflict, err)
+	}
+	if locks, _ := s.ListLocks(); len(locks) != 1 || locks[0].AgentID != "dave" {
+		t.Fatalf("locks after eviction = %+v, want only dave's", locks)
+	}
+}
+
+func TestAcquireLock_Worktree(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.SetWorktree("/src/wt1")
+
+	lock, _, err := s.AcquireLock("pkg/a.go", "alice", 1, 0, true, time.Hour)
+	if err != nil || lock.AbsPath != filepath.Join("/src/wt1", "pkg", "a.go") {
+		t.Fatalf("lock = %+v, %v; want the path in alice's worktree", lock, err)
+	}
+	s.AcquireLock("/etc/hosts", "alice", 2, 0, true, time.Hour)
+	locks, _ := s.ListLocks()
+	if len(locks) != 2 || locks[0].AbsPath != lock.AbsPath || locks[1].AbsPath != "" {
+		t.Fatalf("locks = %+v; an absolute path needs no second form", locks)
+	}
+}
+
+func TestListUnread_BranchScoped(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	now := time.Now().UTC()
+	for ts, branch := range map[int64]string{1: "feature/a", 2: "feature/b", 3: ""} {
+		s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: ts, Kind: model.EventMsg, Target: "bob",
+			Body: "m", CreatedAt: now, Provenance: model.Provenance{Branch: branch}})
+	}
+
+	s.SetBranch("feature/b", false)
+	msgs, err := s.ListUnread("bob", "", 10)
+	if err != nil || len(msgs) != 2 || msgs[0].LamportTS != 2 || msgs[1].LamportTS != 3 {
+		t.Fatalf("feature/b inbox = %+v, %v; want ts 2 and 3", msgs, err)
+	}
+	if msgs[0].Branch != "feature/b" {
+		t.Fatalf("branch = %q, want feature/b", msgs[0].Branch)
+	}
+	// Receiving moves bob's cursor past feature/a's message too, but it
+	// stays unread until bob looks across branches.
+	s.RecordDeliveries("bob", 4, msgs)
+	s.SetCursor("bob", 4)
+	if msgs, _ := s.ListUnread("bob", "", 10); len(msgs) != 0 {
+		t.Fatalf("feature/b inbox after recv = %+v, want empty", msgs)
+	}
+	s.SetBranch("feature/b", true)
+	if msgs, _ := s.ListUnread("bob", "", 10); len(msgs) != 1 || msgs[0].LamportTS != 1 {
+		t.Fatalf("inbox across branches = %+v, want feature/a's message", msgs)
+	}
+}
+
 // --- Pointstamp / frontier integration ---
 
 func TestGetActivePointstamps(t *testing.T) {
@@ -427,7 +770,7 @@ func TestGetActivePointstamps(t *testing.T) {
 	s.UpdateAgentClock("alice", 5, 1, 0)
 	s.UpdateAgentClock("bob", 3, 0, 1)
 
-	ps, err := s.GetActivePointstamps()
+	ps, err := s.GetActivePointstamps(0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -436,6 +779,84 @@ func TestGetActivePointstamps(t *testing.T) {
 	}
 }
 
+func TestGetActivePointstamps_Window(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("thinker")
+	old := time.Now().Add(-25 * time.Minute).UTC().Format(time.RFC3339Nano)
+	s.db.Exec(`UPDATE agents SET last_seen = ? WHERE id = 'thinker'`, old)
+
+	if ps, _ := s.GetActivePointstamps(0); len(ps) != 1 || ps[0].AgentID != "alice" {
+		t.Fatalf("default window: got %+v", ps)
+	}
+	if ps, _ := s.GetActivePointstamps(30 * time.Minute); len(ps) != 2 {
+		t.Fatalf("30m window: got %+v", ps)
+	}
+
+	s.SetActiveWindow(time.Hour)
+	if s.ActiveWindow() != time.Hour {
+		t.Fatalf("ActiveWindow = %v", s.ActiveWindow())
+	}
+	if ps, _ := s.GetActivePointstamps(0); len(ps) != 2 {
+		t.Fatalf("store window 1h: got %+v", ps)
+	}
+	if ps, _ := s.GetActivePointstamps(time.Minute); len(ps) != 1 {
+		t.Fatalf("explicit window wins: got %+v", ps)
+	}
+	s.SetActiveWindow(0)
+	if s.ActiveWindow() != DefaultActiveWindow {
+		t.Fatalf("reset: ActiveWindow = %v", s.ActiveWindow())
+	}
+}
+
+func TestGetActivePointstamps_InFlightMessages(t *testing.T) {
+	s := newTestStore(t)
+	for _, id := range []string{"alice", "bob", "carol"} {
+		s.RegisterAgent(id)
+		s.UpdateAgentClock(id, 1, 3, 0)
+	}
+	send := func(ts int64, to string, epoch int64, sc *Schedule) int64 {
+		var id int64
+		err := s.WithTx(func(tx TxStore) error {
+			var err error
+			if id, err = tx.InsertEvent(&model.Event{AgentID: "alice", LamportTS: ts, Epoch: epoch, Kind: model.EventMsg, Target: to, CreatedAt: time.Now().UTC()}); err != nil || sc == nil {
+				return err
+			}
+			return tx.ScheduleDeliveries([]int64{id}, *sc)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	read := send(2, "bob", 1, nil)
+	unread := send(3, "bob", 2, nil)
+	send(4, "bob", 1, &Schedule{After: time.Now().Add(time.Hour)}) // held: not in flight yet
+	send(5, "carol", 1, nil)                                       // carol leaves: not in flight
+	s.SetCursor("bob", 3)
+	s.DepartAgent("carol")
+
+	ps, err := s.GetActivePointstamps(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []model.Pointstamp
+	for _, p := range ps {
+		if p.EventID != 0 {
+			msgs = append(msgs, p)
+		}
+	}
+	if len(ps) != 3 || len(msgs) != 1 {
+		t.Fatalf("pointstamps = %+v, want alice, bob and one message", ps)
+	}
+	if m := msgs[0]; m.AgentID != "bob" || m.EventID != unread || m.EventID == read || !m.Timestamp.Equal(model.Timestamp{Epoch: 2}) {
+		t.Fatalf("in-flight message = %+v, want #%d to bob at epoch 2", m, unread)
+	}
+	if got := msgs[0].Who(); got != fmt.Sprintf("unread message #%d to bob", unread) {
+		t.Fatalf("Who = %q", got)
+	}
+}
+
 // --- Retry logic tests ---
 
 func TestIsTransientSQLiteError_BusyError(t *testing.T) {
@@ -554,6 +975,245 @@ func TestCountEvents_WithEvents(t *testing.T) {
 	}
 }
 
+// --- ListEventsByKind tests ---
+
+func TestListEventsByKind(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	for i, k := range []model.EventKind{model.EventMsg, model.EventReviewReq, model.EventProgress, model.EventReviewDone} {
+		s.InsertEvent(&model.Event{
+			AgentID: "alice", LamportTS: int64(i + 1), Kind: k,
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+	events, err := s.ListEventsByKind([]model.EventKind{model.EventReviewReq, model.EventReviewDone}, 0, 10)
+	if err != nil {
+		t.Fatalf("ListEventsByKind: %v", err)
+	}
+	if len(events) != 2 || events[0].Kind != model.EventReviewReq || events[1].Kind != model.EventReviewDone {
+		t.Fatalf("got %+v, want review_req then review_done", events)
+	}
+	if events, _ := s.ListEventsByKind(nil, 0, 10); len(events) != 0 {
+		t.Fatalf("no kinds should return no events, got %d", len(events))
+	}
+}
+
+func TestInsertEvent_Provenance(t *testing.T) {
+	s := newTestStore(t)
+	s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, Target: "bob",
+		CreatedAt: time.Now().UTC(), Provenance: model.Provenance{Tool: "edit", RunID: "r1"}})
+	s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 2, Kind: model.EventMsg, Target: "bob", CreatedAt: time.Now().UTC()})
+
+	events, err := s.ListEventsForAgent("bob", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[0].Tool != "edit" || events[0].RunID != "r1" {
+		t.Errorf("first event provenance = %+v", events[0].Provenance)
+	}
+	if events[1].Provenance != (model.Provenance{}) {
+		t.Errorf("second event provenance = %+v, want empty", events[1].Provenance)
+	}
+}
+
+// --- CompactEvents tests ---
+
+func insertAt(t *testing.T, s *Store, agent string, ts int64, kind model.EventKind, target string, created time.Time) int64 {
+	t.Helper()
+	id, err := s.InsertEvent(&model.Event{
+		AgentID: agent, LamportTS: ts, Kind: kind, Target: target, CreatedAt: created,
+	})
+	if err != nil {
+		t.Fatalf("InsertEvent: %v", err)
+	}
+	return id
+}
+
+func eventIDs(t *testing.T, s *Store) map[int64]bool {
+	t.Helper()
+	events, err := s.ListEventsSinceID(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int64]bool)
+	for _, e := range events {
+		ids[e.ID] = true
+	}
+	return ids
+}
+
+func TestCompactEvents_KeepsUndeliveredMessages(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	old := time.Now().UTC().Add(-48 * time.Hour)
+
+	read := insertAt(t, s, "alice", 1, model.EventMsg, "bob", old)
+	unread := insertAt(t, s, "alice", 5, model.EventMsg, "bob", old)
+	s.SetCursor("bob", 3) // bob has read ts < 3 only
+	s.SetCursor("alice", 10)
+
+	res, err := s.CompactEvents(CompactOptions{Before: time.Now().UTC().Add(-24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("CompactEvents: %v", err)
+	}
+	ids := eventIDs(t, s)
+	if ids[read] {
+		t.Error("delivered message should be compacted")
+	}
+	if !ids[unread] {
+		t.Error("undelivered message must survive compaction")
+	}
+	if res.Deleted != 1 || res.Remaining != 1 {
+		t.Errorf("result = %+v, want 1 deleted, 1 remaining", res)
+	}
+}
+
+func TestCompactEvents_KeepsEventsPastEveryCursor(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	below := insertAt(t, s, "alice", 2, model.EventLockReq, "a.go", old)
+	above := insertAt(t, s, "alice", 9, model.EventLockReq, "a.go", old)
+	s.SetCursor("alice", 5)
+
+	if _, err := s.CompactEvents(CompactOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ids := eventIDs(t, s)
+	if ids[below] || !ids[above] {
+		t.Fatalf("want only the event past every cursor kept, got %v", ids)
+	}
+}
+
+func TestCompactEvents_KeepsLatestProgressPerAgent(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	a1 := insertAt(t, s, "alice", 1, model.EventProgress, "", old)
+	a2 := insertAt(t, s, "alice", 2, model.EventProgress, "", old)
+	b1 := insertAt(t, s, "bob", 3, model.EventProgress, "", old)
+
+	if _, err := s.CompactEvents(CompactOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ids := eventIDs(t, s)
+	if ids[a1] || !ids[a2] || !ids[b1] {
+		t.Fatalf("want latest progress per agent kept, got %v", ids)
+	}
+}
+
+func TestCompactEvents_RespectsAgeAndCountFloors(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	var ids []int64
+	for i := int64(1); i <= 4; i++ {
+		ids = append(ids, insertAt(t, s, "alice", i, model.EventLockRel, "a.go", old))
+	}
+	recent := insertAt(t, s, "alice", 5, model.EventLockRel, "a.go", time.Now().UTC())
+
+	res, err := s.CompactEvents(CompactOptions{Before: time.Now().UTC().Add(-24 * time.Hour), KeepEvents: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := eventIDs(t, s)
+	if kept[ids[0]] || kept[ids[1]] || kept[ids[2]] {
+		t.Errorf("old events outside the keep window should be removed: %v", kept)
+	}
+	if !kept[ids[3]] || !kept[recent] {
+		t.Errorf("newest 2 events must be kept: %v", kept)
+	}
+	if res.Deleted != 3 {
+		t.Errorf("Deleted = %d, want 3", res.Deleted)
+	}
+}
+
+func TestCompactEvents_DryRunAndArchive(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	insertAt(t, s, "alice", 1, model.EventLockReq, "a.go", old)
+	insertAt(t, s, "alice", 2, model.EventLockRel, "a.go", old)
+
+	res, err := s.CompactEvents(CompactOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Deleted != 2 || s.CountEvents() != 2 {
+		t.Fatalf("dry run: result %+v, count %d; want 2 reported, nothing deleted", res, s.CountEvents())
+	}
+
+	var buf bytes.Buffer
+	if _, err := s.CompactEvents(CompactOptions{Archive: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"kind":"lock_req"`) {
+		t.Fatalf("archive should hold 2 JSON lines, got %q", buf.String())
+	}
+	if s.CountEvents() != 0 {
+		t.Fatalf("CountEvents after compaction = %d, want 0", s.CountEvents())
+	}
+}
+
+// countingArchive records how many events the store held when the
+// archive was written.
+type countingArchive struct {
+	s     *Store
+	count int64
+	buf   bytes.Buffer
+}
+
+func (w *countingArchive) Write(p []byte) (int, error) {
+	w.count = w.s.CountEvents()
+	return w.buf.Write(p)
+}
+
+func TestCompactEvents_ArchivesAfterDelete(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	insertAt(t, s, "alice", 1, model.EventLockReq, "a.go", old)
+	insertAt(t, s, "alice", 2, model.EventLockRel, "a.go", old)
+
+	w := &countingArchive{s: s}
+	if _, err := s.CompactEvents(CompactOptions{Archive: w}); err != nil {
+		t.Fatal(err)
+	}
+	if w.count != 0 || strings.Count(w.buf.String(), "\n") != 2 {
+		t.Fatalf("archive written with %d events still stored: %q", w.count, w.buf.String())
+	}
+}
+
+// --- Workflow tests ---
+
+func TestWorkflow_EmptyByDefault(t *testing.T) {
+	s := newTestStore(t)
+	body, err := s.GetWorkflow()
+	if err != nil || body != "" {
+		t.Fatalf("GetWorkflow on fresh store: got %q, err=%v", body, err)
+	}
+}
+
+func TestWorkflow_LatestWins(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.SetWorkflow(`{"version":1}`, "alice"); err != nil {
+		t.Fatalf("SetWorkflow: %v", err)
+	}
+	if err := s.SetWorkflow(`{"version":1,"epochs":[]}`, "bob"); err != nil {
+		t.Fatalf("SetWorkflow: %v", err)
+	}
+	body, err := s.GetWorkflow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"version":1,"epochs":[]}` {
+		t.Fatalf("GetWorkflow = %q, want latest definition", body)
+	}
+}
+
 // --- Helper tests ---
 
 func TestBoolToInt(t *testing.T) {
@@ -564,3 +1224,70 @@ func TestBoolToInt(t *testing.T) {
 		t.Fatal("boolToInt(false) should be 0")
 	}
 }
+
+func TestAcquireLocks_AllOrNothing(t *testing.T) {
+	s := newTestStore(t)
+	if _, conflict, err := s.AcquireLock("b.go", "alice", 1, 0, true, time.Hour); err != nil || conflict != nil {
+		t.Fatalf("AcquireLock: %v, %v", conflict, err)
+	}
+
+	// b.go is alice's with priority: bob gets none of the three.
+	locks, conflict, err := s.AcquireLocks([]string{"c.go", "a.go", "b.go"}, "bob", 5, 0, true, time.Hour)
+	if err != nil || locks != nil || conflict == nil || conflict.Path != "b.go" || conflict.AgentID != "alice" {
+		t.Fatalf("AcquireLocks = %+v, %+v, %v", locks, conflict, err)
+	}
+	if held, _ := s.ListLocksForAgent("bob"); len(held) != 0 {
+		t.Fatalf("bob holds %+v after a failed batch", held)
+	}
+
+	// Once alice lets go, the batch goes through in sorted order.
+	s.ReleaseLock("b.go", "alice")
+	locks, conflict, err = s.AcquireLocks([]string{"c.go", "a.go", "b.go", "a.go"}, "bob", 6, 0, true, time.Hour)
+	if err != nil || conflict != nil || len(locks) != 3 || locks[0].Path != "a.go" || locks[2].Path != "c.go" {
+		t.Fatalf("AcquireLocks = %+v, %+v, %v", locks, conflict, err)
+	}
+}
+
+func TestTickAgent_Concurrent(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+
+	// Two processes acting as alice must never get the same timestamp.
+	const n = 20
+	got := make(chan int64, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts, err := s.TickAgent("alice")
+			if err != nil {
+				t.Error(err)
+			}
+			got <- ts
+		}()
+	}
+	wg.Wait()
+	close(got)
+	seen := map[int64]bool{}
+	for ts := range got {
+		if seen[ts] {
+			t.Fatalf("timestamp %d handed out twice", ts)
+		}
+		seen[ts] = true
+	}
+	if ag, _ := s.GetAgent("alice"); ag.Clock != n {
+		t.Fatalf("clock = %d after %d ticks", ag.Clock, n)
+	}
+
+	// IR2: max(clock, ts) + 1.
+	if ts, err := s.ReceiveAgent("alice", 100); err != nil || ts != 101 {
+		t.Fatalf("ReceiveAgent(100) = %d, %v; want 101", ts, err)
+	}
+	if ts, err := s.ReceiveAgent("alice", 50); err != nil || ts != 102 {
+		t.Fatalf("ReceiveAgent(50) = %d, %v; want 102", ts, err)
+	}
+	if _, err := s.TickAgent("nobody"); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("TickAgent(nobody) = %v; want ErrNotRegistered", err)
+	}
+}
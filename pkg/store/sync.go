@@ -0,0 +1,119 @@
+// sync.go implements the heartbeat-and-receive step of cm sync as a single
+// transaction.
+//
+// Done as separate statements, a crash between advancing the recv cursor
+// and persisting the IR2 clock update loses the fact that the messages
+// were received: they will never be delivered again, yet the agent's
+// clock does not reflect them, so its next event can carry a timestamp
+// lower than a message it has already acted on.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/clock"
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// SyncResult reports the outcome of SyncAtomic.
+type SyncResult struct {
+	// HeartbeatTS is the timestamp of the progress event (IR1).
+	HeartbeatTS int64 `json:"heartbeat_ts"`
+	// Clock is the agent's clock after receiving Messages (IR2).
+	Clock int64 `json:"clock"`
+	// Messages are the inbox events received, in Lamport order.
+	Messages []model.Event `json:"messages"`
+	// Registered is false if agentID has no agent row; its clock and
+	// position are then not persisted, exactly as with UpdateAgentClock.
+	Registered bool `json:"registered"`
+}
+
+// SyncAtomic records a heartbeat for agentID at (epoch, round), tagged
+// with prov, and receives up to limit pending inbox events, all in one
+// transaction: the progress event, the clock update, the recv cursor, and
+// the delivery records commit together or not at all.
+func (s *Store) SyncAtomic(agentID string, epoch, round int64, limit int, prov model.Provenance) (*SyncResult, error) {
+	var res *SyncResult
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := tx.advisoryLock("clockmail:agent:" + agentID); err != nil {
+			return err
+		}
+
+		r := &SyncResult{Registered: true}
+		var c clock.Clock
+		var clk int64
+		switch err := tx.QueryRow(`SELECT clock FROM agents WHERE id = ?`, agentID).Scan(&clk); err {
+		case nil:
+			c.Set(clk)
+		case sql.ErrNoRows:
+			r.Registered = false
+		default:
+			return err
+		}
+
+		// Heartbeat (IR1).
+		now := time.Now().UTC()
+		r.HeartbeatTS = c.Tick()
+		progress := &model.Event{
+			AgentID: agentID, LamportTS: r.HeartbeatTS, Epoch: epoch, Round: round,
+			Kind: model.EventProgress, CreatedAt: now, Provenance: prov,
+		}
+		if err := s.signEvent(progress); err != nil {
+			return err
+		}
+		if err := s.checkSession(tx, agentID); err != nil {
+			return err
+		}
+		if err := checkStrict(tx, progress); err != nil {
+			return err
+		}
+		if _, err := s.db.dialect.insertEvent(tx, progress); err != nil {
+			return fmt.Errorf("progress event: %w", err)
+		}
+
+		// Receive (IR2).
+		r.Messages, err = s.listUnread(tx, agentID, "", limit)
+		if err != nil {
+			return fmt.Errorf("recv: %w", err)
+		}
+		if err := recordDeliveries(tx, agentID, c.Value(), r.Messages); err != nil {
+			return fmt.Errorf("deliveries: %w", err)
+		}
+		var maxTS int64
+		for _, e := range r.Messages {
+			c.Receive(e.LamportTS)
+			maxTS = max(maxTS, e.LamportTS)
+		}
+		r.Clock = c.Value()
+
+		if _, err := tx.Exec(
+			`UPDATE agents SET clock = ?, epoch = ?, round = ?, `+keepStepsSQL+`, last_seen = ? WHERE id = ?`,
+			r.Clock, epoch, round, epoch, round, now.Format(time.RFC3339Nano), agentID,
+		); err != nil {
+			return fmt.Errorf("update clock: %w", err)
+		}
+		if maxTS > 0 {
+			if err := advanceCursor(tx, agentID, maxTS+1); err != nil {
+				return fmt.Errorf("advance cursor: %w", err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		res = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.bump()
+	return res, nil
+}
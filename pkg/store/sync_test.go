@@ -0,0 +1,80 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestSyncAtomic(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("bob")
+	s.UpdateAgentClock("bob", 3, 0, 0)
+	for _, ts := range []int64{10, 7} {
+		s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: ts, Kind: model.EventMsg, Target: "bob", Body: "hi", CreatedAt: time.Now().UTC()})
+	}
+
+	res, err := s.SyncAtomic("bob", 2, 1, 100, model.Provenance{})
+	if err != nil {
+		t.Fatalf("SyncAtomic: %v", err)
+	}
+	if !res.Registered {
+		t.Error("expected bob to be registered")
+	}
+	if res.HeartbeatTS != 4 {
+		t.Errorf("heartbeat ts = %d, want 4", res.HeartbeatTS)
+	}
+	if len(res.Messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(res.Messages))
+	}
+	// IR2: max(4, 7)+1 = 8, then max(8, 10)+1 = 11.
+	if res.Clock != 11 {
+		t.Errorf("clock = %d, want 11", res.Clock)
+	}
+
+	ag, _ := s.GetAgent("bob")
+	if ag.Clock != 11 || ag.Epoch != 2 || ag.Round != 1 {
+		t.Errorf("agent = %+v, want clock=11 epoch=2 round=1", ag)
+	}
+	if c := s.GetCursor("bob"); c != 11 {
+		t.Errorf("cursor = %d, want 11", c)
+	}
+	progress, _ := s.ListEvents(0, 100)
+	var found bool
+	for _, e := range progress {
+		found = found || (e.Kind == model.EventProgress && e.AgentID == "bob" && e.LamportTS == 4)
+	}
+	if !found {
+		t.Error("expected progress event at ts=4")
+	}
+	if ds, _ := s.ListDeliveries(time.Time{}); len(ds) != 2 {
+		t.Errorf("got %d deliveries, want 2", len(ds))
+	}
+
+	// A second sync sees no messages and keeps the cursor.
+	res, err = s.SyncAtomic("bob", 2, 1, 100, model.Provenance{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Messages) != 0 || res.Clock != 12 {
+		t.Errorf("second sync: %d messages, clock %d; want 0, 12", len(res.Messages), res.Clock)
+	}
+	if c := s.GetCursor("bob"); c != 11 {
+		t.Errorf("cursor = %d, want 11", c)
+	}
+}
+
+func TestSyncAtomic_Unregistered(t *testing.T) {
+	s := newTestStore(t)
+	res, err := s.SyncAtomic("ghost", 0, 0, 100, model.Provenance{})
+	if err != nil {
+		t.Fatalf("SyncAtomic: %v", err)
+	}
+	if res.Registered || res.Clock != 1 {
+		t.Errorf("result = %+v, want unregistered at clock 1", res)
+	}
+	if _, err := s.GetAgent("ghost"); err == nil {
+		t.Error("sync should not register the agent")
+	}
+}
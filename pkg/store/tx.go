@@ -0,0 +1,227 @@
+// tx.go lets a command make all of its writes in one transaction.
+//
+// A command such as cm send moves the agent's clock, advances its inbox
+// cursor and appends to the log. Done as separate store calls, a crash
+// between them leaves the clock and the log disagreeing: messages marked
+// received that the clock does not reflect, or a clock that was ticked
+// for an event that never made it into the log. WithTx runs them all in
+// one transaction instead, like SyncAtomic does for cm sync.
+package store
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/trace"
+)
+
+// TxStore is the part of the store a WithTx callback can write through.
+// Its methods behave like the Store methods of the same names, except
+// that nothing they write is visible to others until the transaction
+// commits, and nothing at all is written if it does not.
+type TxStore interface {
+	UpdateAgentClock(id string, clk, epoch, round int64) error
+	SetAgentPosition(id string, epoch, round int64) error
+	TickAgent(id string) (int64, error)
+	ReceiveAgent(id string, ts int64) (int64, error)
+	InsertEvent(e *model.Event) (int64, error)
+	InsertEvents(events []*model.Event) ([]int64, error)
+	SetCursor(agentID string, sinceTS int64) error
+	AdvanceCursor(agentID string, sinceTS int64) error
+	SetSenderCursor(agentID, sender string, sinceTS int64) error
+	RecordDeliveries(agentID string, clock int64, events []model.Event) error
+	ScheduleDeliveries(ids []int64, sc Schedule) error
+	AcquireLock(path, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) (*model.Lock, *model.Lock, error)
+	AcquireLocks(paths []string, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) ([]model.Lock, *model.Lock, error)
+	ForceReleaseLock(path string) ([]model.Lock, error)
+	AddDeadLetter(d *DeadLetter) (int64, error)
+	SendKey(agentID, key string) (*SendKey, error)
+	RecordSendKey(k *SendKey) error
+	DepartAgent(agentID string) (*Departure, error)
+}
+
+// WithTx runs fn in a transaction and commits it if fn returns nil. If
+// the database is contended the transaction is retried from the start,
+// so fn may run more than once: it should compute everything it writes
+// beforehand and have no effects outside tx. fn must not call the Store
+// itself, whose writes would wait for this transaction to finish.
+func (s *Store) WithTx(fn func(tx TxStore) error) error {
+	var inserted bool
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		ts := &txStore{s: s, tx: tx}
+		if err := fn(ts); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		inserted = ts.inserted
+		return nil
+	})
+	if err == nil && inserted {
+		s.bump()
+	}
+	return err
+}
+
+// txStore implements TxStore on an open transaction.
+type txStore struct {
+	s  *Store
+	tx *txn
+	// inserted is set once an event is appended, to wake watchers after
+	// the commit.
+	inserted bool
+}
+
+func (t *txStore) UpdateAgentClock(id string, clk, epoch, round int64) error {
+	if err := t.s.checkSession(t.tx, id); err != nil {
+		return err
+	}
+	return updateAgentClock(t.tx, id, clk, epoch, round)
+}
+
+func (t *txStore) SetAgentPosition(id string, epoch, round int64) error {
+	return setAgentPosition(t.tx, id, epoch, round)
+}
+
+func (t *txStore) TickAgent(id string) (int64, error) {
+	return t.ReceiveAgent(id, 0)
+}
+
+func (t *txStore) ReceiveAgent(id string, ts int64) (int64, error) {
+	if err := t.s.checkSession(t.tx, id); err != nil {
+		return 0, err
+	}
+	return advanceAgentClock(t.s.db.dialect, t.tx, id, ts)
+}
+
+func (t *txStore) InsertEvent(e *model.Event) (int64, error) {
+	span := t.s.tracer.Start("store.insert_event",
+		trace.String("clockmail.kind", string(e.Kind)), trace.String("clockmail.agent", e.AgentID),
+		trace.Int("clockmail.lamport_ts", e.LamportTS))
+	id, err := t.s.insertSigned(t.tx, e)
+	if err == nil {
+		t.inserted = true
+	}
+	span.End(err)
+	return id, err
+}
+
+func (t *txStore) InsertEvents(events []*model.Event) ([]int64, error) {
+	ids := make([]int64, 0, len(events))
+	for _, e := range events {
+		id, err := t.InsertEvent(e)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (t *txStore) SetCursor(agentID string, sinceTS int64) error {
+	return setCursor(t.tx, agentID, sinceTS)
+}
+
+// AdvanceCursor is SetCursor that never moves the cursor back.
+func (t *txStore) AdvanceCursor(agentID string, sinceTS int64) error {
+	return advanceCursor(t.tx, agentID, sinceTS)
+}
+
+func (t *txStore) SetSenderCursor(agentID, sender string, sinceTS int64) error {
+	return setSenderCursor(t.tx, agentID, sender, sinceTS)
+}
+
+func (t *txStore) RecordDeliveries(agentID string, clock int64, events []model.Event) error {
+	return recordDeliveries(t.tx, agentID, clock, events)
+}
+
+// ScheduleDeliveries holds the messages ids back until sc holds.
+func (t *txStore) ScheduleDeliveries(ids []int64, sc Schedule) error {
+	return scheduleDeliveries(t.tx, ids, sc)
+}
+
+// AcquireLock grants the lock within the transaction. A conflict leaves
+// the transaction as it was, so the caller may still record the denial.
+func (t *txStore) AcquireLock(path, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) (*model.Lock, *model.Lock, error) {
+	span := t.s.tracer.Start("store.acquire_lock",
+		trace.String("clockmail.lock.path", path), trace.String("clockmail.agent", agentID),
+		trace.Int("clockmail.lamport_ts", lamportTS))
+	var lock, conflict *model.Lock
+	err := expireLocks(t.tx)
+	if err == nil {
+		lock, conflict, err = t.s.grantLock(t.tx, path, agentID, lamportTS, epoch, exclusive, time.Now().UTC().Add(ttl))
+	}
+	switch {
+	case conflict != nil:
+		span.Set(trace.String("clockmail.lock.outcome", "conflict"), trace.String("clockmail.lock.holder", conflict.AgentID))
+	case lock != nil:
+		span.Set(trace.String("clockmail.lock.outcome", "granted"))
+	}
+	span.End(err)
+	return lock, conflict, err
+}
+
+// AcquireLocks grants every path or none. On a conflict, locks granted
+// for earlier paths are undone before it returns.
+func (t *txStore) AcquireLocks(paths []string, agentID string, lamportTS, epoch int64, exclusive bool, ttl time.Duration) ([]model.Lock, *model.Lock, error) {
+	if err := expireLocks(t.tx); err != nil {
+		return nil, nil, err
+	}
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	sorted = slices.Compact(sorted)
+	if _, err := t.tx.Exec(`SAVEPOINT acquire_locks`); err != nil {
+		return nil, nil, err
+	}
+	locks, conflict, err := t.s.grantLocks(t.tx, sorted, agentID, lamportTS, epoch, exclusive, time.Now().UTC().Add(ttl))
+	if err != nil || conflict != nil {
+		if _, rbErr := t.tx.Exec(`ROLLBACK TO SAVEPOINT acquire_locks`); err == nil {
+			err = rbErr
+		}
+		return nil, conflict, err
+	}
+	_, err = t.tx.Exec(`RELEASE SAVEPOINT acquire_locks`)
+	return locks, nil, err
+}
+
+func (t *txStore) ForceReleaseLock(path string) ([]model.Lock, error) {
+	locks, err := t.s.forceReleaseIn(t.tx, path)
+	if err == nil && len(locks) > 0 {
+		// Watchers see the released locks as they see new events.
+		t.inserted = true
+	}
+	return locks, err
+}
+
+func (t *txStore) AddDeadLetter(d *DeadLetter) (int64, error) {
+	id, err := addDeadLetter(t.s.db.dialect, t.tx, d)
+	if err == nil {
+		d.ID = id
+	}
+	return id, err
+}
+
+func (t *txStore) SendKey(agentID, key string) (*SendKey, error) {
+	return sendKey(t.tx, agentID, key)
+}
+
+func (t *txStore) RecordSendKey(k *SendKey) error {
+	return recordSendKey(t.tx, k)
+}
+
+func (t *txStore) DepartAgent(agentID string) (*Departure, error) {
+	d, err := t.s.departIn(t.tx, agentID)
+	if err == nil {
+		// Watchers see departures as they see new events.
+		t.inserted = true
+	}
+	return d, err
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestWithTx_CommitsTogether(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+
+	err := s.WithTx(func(tx TxStore) error {
+		if err := tx.UpdateAgentClock("alice", 3, 1, 0); err != nil {
+			return err
+		}
+		if _, err := tx.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 3, Epoch: 1, Kind: model.EventMsg,
+			Target: "bob", Body: "hi", CreatedAt: time.Now().UTC()}); err != nil {
+			return err
+		}
+		if err := tx.SetCursor("alice", 4); err != nil {
+			return err
+		}
+		_, conflict, err := tx.AcquireLock("a.go", "alice", 3, 1, true, time.Hour)
+		if conflict != nil {
+			t.Errorf("conflict on a free path: %+v", conflict)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if ag, _ := s.GetAgent("alice"); ag.Clock != 3 || ag.Epoch != 1 {
+		t.Fatalf("alice = clock %d epoch %d; want 3, 1", ag.Clock, ag.Epoch)
+	}
+	if c := s.GetCursor("alice"); c != 4 {
+		t.Fatalf("cursor = %d; want 4", c)
+	}
+	if msgs, _ := s.ListUnread("bob", "", 10); len(msgs) != 1 {
+		t.Fatalf("bob has %d unread; want 1", len(msgs))
+	}
+	if locks, _ := s.ListLocksForAgent("alice"); len(locks) != 1 {
+		t.Fatalf("alice holds %d locks; want 1", len(locks))
+	}
+}
+
+func TestWithTx_ErrorWritesNothing(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	events := s.CountEvents()
+
+	crash := errors.New("crash")
+	err := s.WithTx(func(tx TxStore) error {
+		if err := tx.UpdateAgentClock("alice", 9, 2, 0); err != nil {
+			return err
+		}
+		if _, err := tx.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 9, Kind: model.EventMsg,
+			Target: "bob", Body: "lost", CreatedAt: time.Now().UTC()}); err != nil {
+			return err
+		}
+		if _, err := tx.DepartAgent("bob"); err != nil {
+			return err
+		}
+		return crash
+	})
+	if !errors.Is(err, crash) {
+		t.Fatalf("WithTx = %v; want %v", err, crash)
+	}
+	if ag, _ := s.GetAgent("alice"); ag.Clock != 0 || ag.Epoch != 0 {
+		t.Fatalf("alice = clock %d epoch %d after a failed transaction", ag.Clock, ag.Epoch)
+	}
+	if n := s.CountEvents(); n != events {
+		t.Fatalf("failed transaction wrote %d event(s)", n-events)
+	}
+	if ag, _ := s.GetAgent("bob"); ag.DepartedAt != nil {
+		t.Fatal("bob departed in a failed transaction")
+	}
+}
+
+func TestWithTx_AcquireLocksUndoesPartialBatch(t *testing.T) {
+	s := newTestStore(t)
+	s.AcquireLock("b.go", "alice", 1, 0, true, time.Hour)
+
+	err := s.WithTx(func(tx TxStore) error {
+		locks, conflict, err := tx.AcquireLocks([]string{"c.go", "a.go", "b.go"}, "bob", 5, 0, true, time.Hour)
+		if err != nil {
+			return err
+		}
+		if locks != nil || conflict == nil || conflict.Path != "b.go" {
+			t.Errorf("AcquireLocks = %+v, %+v", locks, conflict)
+		}
+		// The denial is still recorded in the same transaction.
+		_, err = tx.InsertEvent(&model.Event{AgentID: "bob", LamportTS: 5, Kind: model.EventLockReq,
+			Target: "b.go", Body: LockDeniedPrefix, CreatedAt: time.Now().UTC()})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if held, _ := s.ListLocksForAgent("bob"); len(held) != 0 {
+		t.Fatalf("bob holds %+v after a denied batch", held)
+	}
+	if n := s.CountEvents(); n != 1 {
+		t.Fatalf("%d events; want the one lock_req", n)
+	}
+}
@@ -0,0 +1,126 @@
+// vote.go persists votes: group decisions whose ballots are totally
+// ordered by Lamport timestamp, so every agent tallies the same result.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// ErrAlreadyVoted is returned by CastBallot when the agent has already
+// cast a ballot in the vote. Ballots cannot be changed.
+var ErrAlreadyVoted = errors.New("already voted")
+
+// OpenVote records a new vote. v.ID must be unique.
+func (s *Store) OpenVote(v *model.Vote) error {
+	if len(v.Options) == 0 {
+		return fmt.Errorf("vote %q has no options", v.ID)
+	}
+	if v.CreatedAt.IsZero() {
+		v.CreatedAt = time.Now().UTC()
+	}
+	return retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO votes (id, agent_id, question, options, quorum, lamport_ts, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			v.ID, v.AgentID, v.Question, strings.Join(v.Options, "\n"), v.Quorum, v.LamportTS,
+			v.CreatedAt.Format(time.RFC3339Nano),
+		)
+		return err
+	})
+}
+
+// CastBallot records b in the vote and returns the vote with its ballots.
+// Returns ErrAlreadyVoted if b.AgentID has voted in it before, and an
+// error if the vote does not exist or b.Choice is not one of its options.
+func (s *Store) CastBallot(voteID string, b model.Ballot) (*model.Vote, error) {
+	if b.CastAt.IsZero() {
+		b.CastAt = time.Now().UTC()
+	}
+	err := retryOnContention(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck // rollback after commit is a no-op
+		if err := tx.advisoryLock("clockmail:vote:" + voteID); err != nil {
+			return err
+		}
+
+		var options string
+		if err := tx.QueryRow(`SELECT options FROM votes WHERE id = ?`, voteID).Scan(&options); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("vote %q not found", voteID)
+			}
+			return err
+		}
+		if !slices.Contains(strings.Split(options, "\n"), b.Choice) {
+			return fmt.Errorf("%q is not an option of vote %q (options: %s)",
+				b.Choice, voteID, strings.ReplaceAll(options, "\n", ", "))
+		}
+		var n int
+		if err := tx.QueryRow(
+			`SELECT COUNT(*) FROM ballots WHERE vote_id = ? AND agent_id = ?`, voteID, b.AgentID,
+		).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%w in %s: %s", ErrAlreadyVoted, voteID, b.AgentID)
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO ballots (vote_id, agent_id, choice, lamport_ts, cast_at) VALUES (?, ?, ?, ?, ?)`,
+			voteID, b.AgentID, b.Choice, b.LamportTS, b.CastAt.Format(time.RFC3339Nano),
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetVote(voteID)
+}
+
+// GetVote returns a vote and its ballots in total order: by Lamport
+// timestamp, then agent ID.
+func (s *Store) GetVote(id string) (*model.Vote, error) {
+	var v model.Vote
+	var options, created string
+	if err := s.db.QueryRow(
+		`SELECT id, agent_id, question, options, quorum, lamport_ts, created_at FROM votes WHERE id = ?`, id,
+	).Scan(&v.ID, &v.AgentID, &v.Question, &options, &v.Quorum, &v.LamportTS, &created); err != nil {
+		return nil, err
+	}
+	v.Options = strings.Split(options, "\n")
+	var err error
+	if v.CreatedAt, err = time.Parse(time.RFC3339Nano, created); err != nil {
+		return nil, fmt.Errorf("parse created_at for vote %s: %w", id, err)
+	}
+
+	rows, err := s.db.Query(
+		`SELECT agent_id, choice, lamport_ts, cast_at FROM ballots
+		 WHERE vote_id = ? ORDER BY lamport_ts ASC, agent_id ASC`, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b model.Ballot
+		var cast string
+		if err := rows.Scan(&b.AgentID, &b.Choice, &b.LamportTS, &cast); err != nil {
+			return nil, err
+		}
+		if b.CastAt, err = time.Parse(time.RFC3339Nano, cast); err != nil {
+			return nil, fmt.Errorf("parse cast_at for vote %s ballot of %s: %w", id, b.AgentID, err)
+		}
+		v.Ballots = append(v.Ballots, b)
+	}
+	return &v, rows.Err()
+}
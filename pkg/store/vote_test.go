@@ -0,0 +1,50 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestVote_Lifecycle(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.OpenVote(&model.Vote{ID: "alice-1", AgentID: "alice", Question: "merge now?",
+		Options: []string{"yes", "no"}, Quorum: 3, LamportTS: 1}); err != nil {
+		t.Fatalf("OpenVote: %v", err)
+	}
+
+	// Cast out of timestamp order: the store keeps ballots in total order.
+	for _, b := range []model.Ballot{
+		{AgentID: "carol", Choice: "no", LamportTS: 7},
+		{AgentID: "bob", Choice: "yes", LamportTS: 4},
+		{AgentID: "alice", Choice: "no", LamportTS: 4},
+	} {
+		if _, err := s.CastBallot("alice-1", b); err != nil {
+			t.Fatalf("CastBallot(%s): %v", b.AgentID, err)
+		}
+	}
+	v, err := s.GetVote("alice-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Ballots) != 3 || v.Ballots[0].AgentID != "alice" || v.Ballots[1].AgentID != "bob" || v.Ballots[2].AgentID != "carol" {
+		t.Fatalf("ballots = %+v, want alice, bob, carol", v.Ballots)
+	}
+	if v.Question != "merge now?" || len(v.Options) != 2 || v.Quorum != 3 {
+		t.Fatalf("vote = %+v", v)
+	}
+
+	if _, err := s.CastBallot("alice-1", model.Ballot{AgentID: "bob", Choice: "no", LamportTS: 9}); !errors.Is(err, ErrAlreadyVoted) {
+		t.Fatalf("second ballot: err = %v, want ErrAlreadyVoted", err)
+	}
+	if _, err := s.CastBallot("alice-1", model.Ballot{AgentID: "dave", Choice: "maybe", LamportTS: 9}); err == nil {
+		t.Fatal("ballot for an unknown option should fail")
+	}
+	if _, err := s.CastBallot("nope", model.Ballot{AgentID: "dave", Choice: "yes", LamportTS: 9}); err == nil {
+		t.Fatal("ballot in an unknown vote should fail")
+	}
+	if err := s.OpenVote(&model.Vote{ID: "empty", AgentID: "alice"}); err == nil {
+		t.Fatal("vote without options should fail")
+	}
+}
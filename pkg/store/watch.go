@@ -0,0 +1,127 @@
+// watch.go lets readers wake as soon as an event is written instead of
+// polling the events table.
+//
+// A SQLite store keeps a small notify file next to the database (path +
+// "-notify") and rewrites it after every committed event write, from any
+// process. A Watcher waits for that file to change: through inotify on
+// Linux, elsewhere by checking it every few milliseconds, which is still
+// far cheaper than querying the database. PostgreSQL and in-memory stores
+// have no notify file; callers keep polling there.
+package store
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoNotify is returned by Watch for stores without a notify file.
+var ErrNoNotify = errors.New("store has no notify file")
+
+// notifyPathFor returns the notify file for the SQLite database at path,
+// or "" for in-memory databases.
+func notifyPathFor(path string) string {
+	if path == "" || strings.Contains(path, ":memory:") || strings.Contains(path, "mode=memory") {
+		return ""
+	}
+	return strings.TrimPrefix(path, "file:") + "-notify"
+}
+
+// bump rewrites the notify file so that Watchers wake. Failing to bump
+// only costs watchers latency, so errors are ignored.
+func (s *Store) bump() {
+	if s.memNotify != nil {
+		s.memNotify.bump()
+	}
+	if s.notifyPath == "" {
+		return
+	}
+	_ = os.WriteFile(s.notifyPath, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), 0o644)
+}
+
+// Watcher wakes when events are written to a store, by this or any other
+// process. It may wake spuriously, so readers still query for what is
+// new. A Watcher is not safe for concurrent use.
+type Watcher struct {
+	w notifyWaiter
+}
+
+// notifyWaiter is the platform-specific part of a Watcher.
+type notifyWaiter interface {
+	// wait blocks until the notify file changes (true) or timeout
+	// elapses (false).
+	wait(timeout time.Duration) bool
+	close() error
+}
+
+// Watch returns a Watcher for the store's event writes, or ErrNoNotify
+// if the store has no notify file. Close it when done.
+func (s *Store) Watch() (*Watcher, error) {
+	if s.memNotify != nil {
+		return &Watcher{w: s.memNotify.waiter()}, nil
+	}
+	if s.notifyPath == "" {
+		return nil, ErrNoNotify
+	}
+	// The file must exist to be watched; a store that has not written
+	// any event yet has not created it.
+	f, err := os.OpenFile(s.notifyPath, os.O_RDONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	w, err := newNotifyWaiter(s.notifyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{w: w}, nil
+}
+
+// Wait blocks until an event may have been written, returning true, or
+// until timeout elapses, returning false.
+func (w *Watcher) Wait(timeout time.Duration) bool { return w.w.wait(timeout) }
+
+// Close releases the Watcher. A Wait in progress returns.
+func (w *Watcher) Close() error { return w.w.close() }
+
+// pollWaiter checks the notify file's contents at a short interval. It is
+// used where inotify is not available.
+type pollWaiter struct {
+	path   string
+	last   string
+	closed chan struct{}
+}
+
+const notifyPollInterval = 10 * time.Millisecond
+
+func newPollWaiter(path string) *pollWaiter {
+	b, _ := os.ReadFile(path)
+	return &pollWaiter{path: path, last: string(b), closed: make(chan struct{})}
+}
+
+func (p *pollWaiter) wait(timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(notifyPollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			return false
+		case <-p.closed:
+			return false
+		case <-tick.C:
+			if b, err := os.ReadFile(p.path); err == nil && string(b) != p.last {
+				p.last = string(b)
+				return true
+			}
+		}
+	}
+}
+
+func (p *pollWaiter) close() error {
+	close(p.closed)
+	return nil
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// inotifyWaiter waits for writes to the notify file with inotify. The
+// descriptor is non-blocking, so os.File hands it to the runtime poller
+// and read deadlines work.
+type inotifyWaiter struct {
+	f *os.File
+}
+
+func newNotifyWaiter(path string) (notifyWaiter, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return newPollWaiter(path), nil
+	}
+	if _, err := syscall.InotifyAddWatch(fd, path, syscall.IN_CLOSE_WRITE); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+	return &inotifyWaiter{f: os.NewFile(uintptr(fd), "inotify:"+path)}, nil
+}
+
+func (w *inotifyWaiter) wait(timeout time.Duration) bool {
+	if err := w.f.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		time.Sleep(timeout)
+		return false
+	}
+	// One read drains every queued event: several bumps wake once.
+	var buf [4096]byte
+	_, err := w.f.Read(buf[:])
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, os.ErrClosed) {
+		time.Sleep(timeout) // do not spin on a broken descriptor
+	}
+	return false
+}
+
+func (w *inotifyWaiter) close() error { return w.f.Close() }
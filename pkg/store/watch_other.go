@@ -0,0 +1,7 @@
+//go:build !linux
+
+package store
+
+func newNotifyWaiter(path string) (notifyWaiter, error) {
+	return newPollWaiter(path), nil
+}
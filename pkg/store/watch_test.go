@@ -0,0 +1,74 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func TestWatch_WakesOnWriteFromOtherStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	reader, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer reader.Close()
+	writer, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer writer.Close()
+
+	w, err := reader.Watch()
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer w.Close()
+	if w.Wait(50 * time.Millisecond) {
+		t.Fatal("woke with nothing written")
+	}
+
+	done := make(chan bool)
+	start := time.Now()
+	go func() { done <- w.Wait(5 * time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	writer.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, CreatedAt: time.Now().UTC()})
+	if !<-done {
+		t.Fatal("Wait timed out after a write")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("woke after %s", d)
+	}
+
+	// A sync writes a progress event too.
+	writer.RegisterAgent("bob")
+	w.Wait(10 * time.Millisecond) // anything queued so far
+	writer.SyncAtomic("bob", 1, 0, 10, model.Provenance{})
+	if !w.Wait(5 * time.Second) {
+		t.Fatal("no wake after SyncAtomic")
+	}
+}
+
+func TestWatch_PollWaiter(t *testing.T) {
+	s := newTestStore(t)
+	p := newPollWaiter(s.notifyPath)
+	defer p.close()
+	if p.wait(30 * time.Millisecond) {
+		t.Fatal("woke with nothing written")
+	}
+	s.InsertEvent(&model.Event{AgentID: "alice", LamportTS: 1, Kind: model.EventMsg, CreatedAt: time.Now().UTC()})
+	if !p.wait(time.Second) {
+		t.Fatal("no wake after a write")
+	}
+}
+
+func TestWatch_InMemory(t *testing.T) {
+	if notifyPathFor(":memory:") != "" || notifyPathFor("file::memory:?cache=shared") != "" {
+		t.Fatal("in-memory databases should have no notify file")
+	}
+	if got := notifyPathFor("/tmp/x.db"); got != "/tmp/x.db-notify" {
+		t.Fatalf("notifyPathFor = %q", got)
+	}
+}
@@ -0,0 +1,96 @@
+// wip.go stores work-in-progress declarations: one per agent, saying what
+// it is working on and which files it expects to touch, so that others
+// can steer clear before any lock is contended.
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// SetWIP declares what agentID is working on at epoch, replacing any
+// earlier declaration.
+func (s *Store) SetWIP(agentID, desc string, files []string, epoch int64) (*model.WIP, error) {
+	w := &model.WIP{AgentID: agentID, Description: desc, Files: files, Epoch: epoch, UpdatedAt: time.Now().UTC()}
+	err := retryOnContention(func() error {
+		_, err := s.db.Exec(
+			`INSERT INTO wip (agent_id, description, files, epoch, updated_at) VALUES (?, ?, ?, ?, ?)
+			 ON CONFLICT(agent_id) DO UPDATE SET
+			   description = excluded.description, files = excluded.files,
+			   epoch = excluded.epoch, updated_at = excluded.updated_at`,
+			agentID, desc, strings.Join(files, "\n"), epoch, w.UpdatedAt.Format(time.RFC3339Nano),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ClearWIP removes agentID's declaration, reporting whether it had one.
+func (s *Store) ClearWIP(agentID string) (bool, error) {
+	var n int64
+	err := retryOnContention(func() error {
+		res, err := s.db.Exec(`DELETE FROM wip WHERE agent_id = ?`, agentID)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return n > 0, err
+}
+
+// GetWIP returns agentID's declaration, or sql.ErrNoRows if it has none.
+func (s *Store) GetWIP(agentID string) (*model.WIP, error) {
+	rows, err := s.db.Query(`SELECT `+wipColumns+` FROM wip WHERE agent_id = ?`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ws, err := scanWIP(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(ws) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &ws[0], nil
+}
+
+// ListWIP returns every declaration, ordered by agent.
+func (s *Store) ListWIP() ([]model.WIP, error) {
+	rows, err := s.db.Query(`SELECT ` + wipColumns + ` FROM wip ORDER BY agent_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanWIP(rows)
+}
+
+const wipColumns = `agent_id, description, files, epoch, updated_at`
+
+func scanWIP(rows *sql.Rows) ([]model.WIP, error) {
+	var out []model.WIP
+	for rows.Next() {
+		var w model.WIP
+		var files, updated string
+		if err := rows.Scan(&w.AgentID, &w.Description, &files, &w.Epoch, &updated); err != nil {
+			return nil, err
+		}
+		if files != "" {
+			w.Files = strings.Split(files, "\n")
+		}
+		var err error
+		if w.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+			return nil, fmt.Errorf("parse updated_at for wip of %s: %w", w.AgentID, err)
+		}
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestWIP(t *testing.T) {
+	s := newTestStore(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+
+	if _, err := s.GetWIP("alice"); err != sql.ErrNoRows {
+		t.Fatalf("GetWIP before set: err = %v", err)
+	}
+	if _, err := s.SetWIP("alice", "refactoring store", []string{"pkg/store/store.go", "pkg/store/sync.go"}, 2); err != nil {
+		t.Fatalf("SetWIP: %v", err)
+	}
+	s.SetWIP("bob", "docs", nil, 1)
+	w, err := s.GetWIP("alice")
+	if err != nil || w.Description != "refactoring store" || len(w.Files) != 2 || w.Files[1] != "pkg/store/sync.go" || w.Epoch != 2 {
+		t.Fatalf("GetWIP = %+v, %v", w, err)
+	}
+
+	// Setting again replaces the declaration.
+	s.SetWIP("alice", "store tests", []string{"pkg/store/store_test.go"}, 3)
+	ws, err := s.ListWIP()
+	if err != nil || len(ws) != 2 || ws[0].AgentID != "alice" || ws[0].Description != "store tests" || len(ws[0].Files) != 1 || ws[1].Files != nil {
+		t.Fatalf("ListWIP = %+v, %v", ws, err)
+	}
+
+	if ok, err := s.ClearWIP("bob"); err != nil || !ok {
+		t.Fatalf("ClearWIP = %v, %v", ok, err)
+	}
+	if ok, _ := s.ClearWIP("bob"); ok {
+		t.Fatal("clearing twice reported a declaration")
+	}
+
+	// Departing clears the agent's declaration.
+	if _, err := s.DepartAgent("alice"); err != nil {
+		t.Fatalf("DepartAgent: %v", err)
+	}
+	if ws, _ := s.ListWIP(); len(ws) != 0 {
+		t.Fatalf("after departure: %+v", ws)
+	}
+}
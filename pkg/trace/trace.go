@@ -0,0 +1,297 @@
+// Package trace records OpenTelemetry spans for coordination operations
+// (sending, receiving, locking, gating) and exports them to a collector
+// over OTLP/HTTP with the JSON encoding, so the time agents spend waiting
+// on each other shows up next to their own traces.
+//
+// It is deliberately small: one process, one tracer, spans nested by the
+// order they are started and ended rather than through a context. That
+// matches how cm runs (one command per process) and keeps the OpenTelemetry
+// SDK out of the dependency tree.
+//
+// Every method is safe on a nil *Tracer and a nil *Span and does nothing,
+// so callers instrument unconditionally and tracing costs nothing when no
+// endpoint is configured.
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvEndpoint names the environment variable holding the collector's
+// OTLP/HTTP endpoint, e.g. http://localhost:4318.
+const EnvEndpoint = "CLOCKMAIL_OTEL_ENDPOINT"
+
+// maxBuffered is how many ended spans are kept before they are exported
+// without waiting for Flush, so long-running commands (watch, web) do not
+// grow without bound.
+const maxBuffered = 256
+
+// Attr is a span attribute.
+type Attr struct {
+	Key   string
+	Value interface{} // string, int64, float64 or bool
+}
+
+// String returns a string attribute.
+func String(key, v string) Attr { return Attr{key, v} }
+
+// Int returns an integer attribute.
+func Int(key string, v int64) Attr { return Attr{key, v} }
+
+// Float returns a floating-point attribute.
+func Float(key string, v float64) Attr { return Attr{key, v} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, v bool) Attr { return Attr{key, v} }
+
+// Tracer collects spans and exports them to one endpoint.
+type Tracer struct {
+	url      string
+	service  string
+	version  string
+	client   *http.Client
+	traceID  string // from TRACEPARENT, or fresh per root span
+	parentID string // span ID from TRACEPARENT, parent of root spans
+
+	mu    sync.Mutex
+	open  []*Span // started and not yet ended, innermost last
+	ended []*Span
+}
+
+// New returns a tracer exporting to endpoint, the collector's base URL
+// (/v1/traces is appended unless the path already names it). A W3C
+// traceparent (as in the TRACEPARENT environment variable) makes root
+// spans children of the caller's span; pass "" to start new traces.
+func New(endpoint, service, version, traceparent string) *Tracer {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	t := &Tracer{url: endpoint, service: service, version: version, client: &http.Client{Timeout: 3 * time.Second}}
+	t.traceID, t.parentID, _ = ParseTraceparent(traceparent)
+	return t
+}
+
+// FromEnv returns a tracer for the endpoint in CLOCKMAIL_OTEL_ENDPOINT,
+// joined to the trace in TRACEPARENT if set, or nil when tracing is off.
+func FromEnv(service, version string) *Tracer {
+	endpoint := strings.TrimSpace(os.Getenv(EnvEndpoint))
+	if endpoint == "" {
+		return nil
+	}
+	return New(endpoint, service, version, os.Getenv("TRACEPARENT"))
+}
+
+// ParseTraceparent splits a W3C traceparent header value
+// (00-<trace id>-<span id>-<flags>) into its trace and span IDs.
+func ParseTraceparent(s string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	for _, p := range parts[1:3] {
+		if _, err := hex.DecodeString(p); err != nil || strings.Trim(p, "0") == "" {
+			return "", "", false
+		}
+	}
+	return strings.ToLower(parts[1]), strings.ToLower(parts[2]), true
+}
+
+// Span is one timed operation.
+type Span struct {
+	t        *Tracer
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    []Attr
+	errMsg   string
+	failed   bool
+}
+
+// Start begins a span named name as a child of the innermost span still
+// open, or of the TRACEPARENT span if none is.
+func (t *Tracer) Start(name string, attrs ...Attr) *Span {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &Span{t: t, name: name, spanID: randomHex(8), start: time.Now(), attrs: attrs}
+	if n := len(t.open); n > 0 {
+		s.traceID, s.parentID = t.open[n-1].traceID, t.open[n-1].spanID
+	} else if t.traceID != "" {
+		s.traceID, s.parentID = t.traceID, t.parentID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	t.open = append(t.open, s)
+	return s
+}
+
+// Set adds attributes to the span.
+func (s *Span) Set(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.t.mu.Unlock()
+}
+
+// Fail marks the span as failed with msg.
+func (s *Span) Fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	s.failed, s.errMsg = true, msg
+	s.t.mu.Unlock()
+}
+
+// End finishes the span, marking it failed if err is non-nil. Ending a
+// span twice has no effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.Fail(err.Error())
+	}
+	t := s.t
+	t.mu.Lock()
+	if !s.end.IsZero() {
+		t.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	for i := len(t.open) - 1; i >= 0; i-- {
+		if t.open[i] == s {
+			t.open = append(t.open[:i], t.open[i+1:]...)
+			break
+		}
+	}
+	t.ended = append(t.ended, s)
+	full := len(t.ended) >= maxBuffered
+	t.mu.Unlock()
+	if full {
+		if err := t.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "cm: otel: %v\n", err)
+		}
+	}
+}
+
+// Traceparent returns the W3C traceparent naming this span, for passing
+// to child processes so their spans nest under it.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + s.traceID + "-" + s.spanID + "-01"
+}
+
+// Flush exports every ended span. Spans still open are left for a later
+// flush.
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans := t.ended
+	t.ended = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(t.payload(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("export %d span(s): %w", len(spans), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("export %d span(s): %s returned %s", len(spans), t.url, resp.Status)
+	}
+	return nil
+}
+
+// payload builds an OTLP ExportTraceServiceRequest in its JSON mapping:
+// IDs are hex, 64-bit integers are decimal strings.
+func (t *Tracer) payload(spans []*Span) map[string]interface{} {
+	out := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.attrs),
+		}
+		if s.parentID != "" {
+			span["parentSpanId"] = s.parentID
+		}
+		if s.failed {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.errMsg} // STATUS_CODE_ERROR
+		}
+		out[i] = span
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttrs([]Attr{
+				String("service.name", t.service),
+				String("service.version", t.version),
+			})},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/daviddao/clockmail", "version": t.version},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+func otlpAttrs(attrs []Attr) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch x := a.Value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": x}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": x}
+		case bool:
+			v = map[string]interface{}{"boolValue": x}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, map[string]interface{}{"key": a.Key, "value": v})
+	}
+	return out
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
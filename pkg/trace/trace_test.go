@@ -0,0 +1,129 @@
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// collector records the spans posted to it, by name.
+func collector(t *testing.T) (*httptest.Server, map[string]map[string]interface{}) {
+	t.Helper()
+	spans := map[string]map[string]interface{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("export to %s (%s)", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("bad payload: %v", err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s["name"].(string)] = s
+				}
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, spans
+}
+
+func TestTracer_NestsAndExports(t *testing.T) {
+	srv, spans := collector(t)
+	tr := New(srv.URL, "clockmail", "test", "")
+	root := tr.Start("cm lock", String("clockmail.command", "lock"))
+	child := tr.Start("store.acquire_lock")
+	child.Set(String("clockmail.lock.outcome", "conflict"), Int("clockmail.lamport_ts", 7))
+	child.End(nil)
+	failed := tr.Start("store.insert_event")
+	failed.End(errors.New("database is locked"))
+	root.End(nil)
+	root.End(nil) // no-op
+	if err := tr.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if len(spans) != 3 {
+		t.Fatalf("exported %d spans, want 3", len(spans))
+	}
+	r, c, f := spans["cm lock"], spans["store.acquire_lock"], spans["store.insert_event"]
+	if r["parentSpanId"] != nil {
+		t.Errorf("root span has parent %v", r["parentSpanId"])
+	}
+	if c["parentSpanId"] != r["spanId"] || f["parentSpanId"] != r["spanId"] || c["traceId"] != r["traceId"] {
+		t.Errorf("children not nested under root: %v / %v", c, f)
+	}
+	if got := c["attributes"].([]interface{})[1].(map[string]interface{})["value"]; got.(map[string]interface{})["intValue"] != "7" {
+		t.Errorf("int attribute = %v, want intValue \"7\"", got)
+	}
+	if st, _ := f["status"].(map[string]interface{}); st == nil || st["message"] != "database is locked" {
+		t.Errorf("failed span status = %v", f["status"])
+	}
+	if c["status"] != nil {
+		t.Errorf("ok span has status %v", c["status"])
+	}
+}
+
+func TestTracer_JoinsTraceparent(t *testing.T) {
+	srv, spans := collector(t)
+	tr := New(srv.URL+"/v1/traces", "clockmail", "test", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	s := tr.Start("cm gate")
+	if tp := s.Traceparent(); !strings.HasPrefix(tp, "00-0af7651916cd43dd8448eb211c80319c-") || strings.Contains(tp, "b7ad6b7169203331") {
+		t.Errorf("Traceparent = %q, want the caller's trace with this span's ID", tp)
+	}
+	s.End(nil)
+	if err := tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := spans["cm gate"]
+	if got["traceId"] != "0af7651916cd43dd8448eb211c80319c" || got["parentSpanId"] != "b7ad6b7169203331" {
+		t.Errorf("span not joined to TRACEPARENT: %v", got)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, bad := range []string{"", "00-abc-def-01", "00-00000000000000000000000000000000-b7ad6b7169203331-01", "00-0af7651916cd43dd8448eb211c80319c-zzzzzzzzzzzzzzzz-01"} {
+		if _, _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("ParseTraceparent(%q) accepted", bad)
+		}
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	t.Setenv(EnvEndpoint, "")
+	tr := FromEnv("clockmail", "test")
+	if tr != nil {
+		t.Fatal("FromEnv without an endpoint should return nil")
+	}
+	s := tr.Start("x", Bool("b", true))
+	s.Set(Float("f", 1))
+	s.End(errors.New("ignored"))
+	if s.Traceparent() != "" || tr.Flush() != nil {
+		t.Fatal("nil tracer should do nothing")
+	}
+}
+
+func TestFlush_ReportsCollectorErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	tr := New(strings.TrimPrefix(srv.URL, "http://"), "clockmail", "test", "")
+	tr.Start("x").End(nil)
+	if err := tr.Flush(); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("Flush = %v, want the collector's 400", err)
+	}
+}
@@ -0,0 +1,248 @@
+package web
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+// A report is a standalone HTML page: one agent per swimlane, events
+// placed by Lamport timestamp, messages drawn as arrows from send to
+// receipt, locks as bars from request to release, and review markers. The
+// SVG is laid out here rather than in script so the file renders anywhere,
+// including mail clients and archives that strip JavaScript.
+
+//go:embed report.html
+var reportHTML string
+
+var reportTmpl = template.Must(template.New("report").Parse(reportHTML))
+
+// Report layout, in pixels.
+const (
+	reportLeft     = 140 // lane labels
+	reportRight    = 40
+	reportTop      = 30
+	reportLane     = 56 // vertical distance between lanes
+	reportBarGap   = 7  // vertical distance between stacked lock bars
+	reportMaxWidth = 1400
+	reportMinStep  = 4  // horizontal pixels per Lamport tick, at least
+	reportMaxStep  = 40 // and at most
+)
+
+// Report is a laid-out coordination timeline.
+type Report struct {
+	Title       string
+	Epoch       *int64
+	GeneratedAt time.Time
+	Width       int
+	Height      int
+	MinTS       int64
+	MaxTS       int64
+	Lanes       []Lane
+	Arrows      []Arrow
+	Bars        []Bar
+	Marks       []Mark
+	Events      []model.Event
+	Stats       ReportStats
+}
+
+// ReportStats summarizes the events in a report.
+type ReportStats struct {
+	Agents   int
+	Events   int
+	Messages int
+	Locks    int
+	Reviews  int
+	From     time.Time
+	To       time.Time
+}
+
+// Lane is an agent's swimlane.
+type Lane struct {
+	AgentID string
+	Y       int
+}
+
+// Arrow is a message from one lane to another. Pending arrows were never
+// received and end one tick after the send.
+type Arrow struct {
+	X1, Y1, X2, Y2 int
+	Kind           model.EventKind
+	Pending        bool
+	Title          string
+}
+
+// Bar is a lock held from request to release. Open bars have no recorded
+// release and run to the end of the report.
+type Bar struct {
+	X, Y, W int
+	Path    string
+	Open    bool
+	Title   string
+}
+
+// Mark is a single event on its agent's lane.
+type Mark struct {
+	X, Y  int
+	Kind  model.EventKind
+	Class string // CSS class: the event kind, plus pass/fail for verdicts
+	Title string
+}
+
+// BuildReport lays out events as a timeline. With epoch set only events
+// recorded in that epoch are shown; log is the whole event log, used to
+// find the releases of locks taken during the epoch. deliveries place the
+// receiving end of message arrows.
+func BuildReport(title string, epoch *int64, log []model.Event, deliveries []model.Delivery) *Report {
+	r := &Report{Title: title, Epoch: epoch, GeneratedAt: time.Now().UTC()}
+	for _, e := range log {
+		if epoch == nil || e.Epoch == *epoch {
+			r.Events = append(r.Events, e)
+		}
+	}
+	if len(r.Events) == 0 {
+		r.Width, r.Height = reportLeft+reportRight, reportTop
+		return r
+	}
+
+	r.MinTS, r.MaxTS = r.Events[0].LamportTS, r.Events[0].LamportTS
+	lanes := make(map[string]int)
+	for _, e := range r.Events {
+		r.MinTS, r.MaxTS = min(r.MinTS, e.LamportTS), max(r.MaxTS, e.LamportTS)
+		if _, ok := lanes[e.AgentID]; !ok {
+			lanes[e.AgentID] = reportTop + len(r.Lanes)*reportLane
+			r.Lanes = append(r.Lanes, Lane{AgentID: e.AgentID, Y: lanes[e.AgentID]})
+		}
+	}
+	span := r.MaxTS - r.MinTS + 1
+	step := int64(max(reportMinStep, min(reportMaxStep, (reportMaxWidth-reportLeft-reportRight)/int(span))))
+	x := func(ts int64) int { return reportLeft + int((min(max(ts, r.MinTS), r.MaxTS+1)-r.MinTS)*step) }
+	r.Width = x(r.MaxTS+1) + reportRight
+	r.Height = reportTop + len(r.Lanes)*reportLane
+
+	received := make(map[int64]int64) // event ID -> recipient clock after receipt
+	for _, d := range deliveries {
+		received[d.EventID] = max(d.Clock, d.SendTS) + 1
+	}
+
+	for _, e := range r.Events {
+		y := lanes[e.AgentID]
+		class := string(e.Kind)
+		if e.Kind == model.EventReviewDone {
+			class += " " + verdict(e.Body)
+		}
+		r.Marks = append(r.Marks, Mark{X: x(e.LamportTS), Y: y, Kind: e.Kind, Class: class, Title: eventTitle(e)})
+
+		switch e.Kind {
+		case model.EventMsg, model.EventReviewReq, model.EventReviewDone:
+			ty, ok := lanes[e.Target]
+			if !ok || e.Target == e.AgentID {
+				continue
+			}
+			a := Arrow{X1: x(e.LamportTS), Y1: y, Y2: ty, Kind: e.Kind, Title: eventTitle(e)}
+			if ts, ok := received[e.ID]; ok {
+				a.X2 = x(ts)
+			} else {
+				a.X2, a.Pending = x(e.LamportTS+1), true
+			}
+			r.Arrows = append(r.Arrows, a)
+		case model.EventLockReq:
+			r.Stats.Locks++
+		}
+	}
+	r.Bars = lockBars(r, log, lanes, x)
+
+	r.Stats.Agents = len(r.Lanes)
+	r.Stats.Events = len(r.Events)
+	r.Stats.From, r.Stats.To = r.Events[0].CreatedAt, r.Events[0].CreatedAt
+	for _, e := range r.Events {
+		switch e.Kind {
+		case model.EventMsg:
+			r.Stats.Messages++
+		case model.EventReviewReq, model.EventReviewDone:
+			r.Stats.Reviews++
+		}
+		if e.CreatedAt.Before(r.Stats.From) {
+			r.Stats.From = e.CreatedAt
+		}
+		if e.CreatedAt.After(r.Stats.To) {
+			r.Stats.To = e.CreatedAt
+		}
+	}
+	return r
+}
+
+// lockBars pairs each lock request in the report with the requester's
+// next release of the same path (or departure) anywhere in log. Bars that
+// overlap on one lane are stacked below it.
+func lockBars(r *Report, log []model.Event, lanes map[string]int, x func(int64) int) []Bar {
+	var bars []Bar
+	ends := make(map[string][]int) // agent -> right edge of the last bar in each stack row
+	for _, req := range r.Events {
+		if req.Kind != model.EventLockReq {
+			continue
+		}
+		end, open := r.MaxTS+1, true
+		for _, e := range log {
+			if e.AgentID != req.AgentID || e.LamportTS <= req.LamportTS {
+				continue
+			}
+			if (e.Kind == model.EventLockRel && e.Target == req.Target) || e.Kind == model.EventDeparted || e.Kind == model.EventReaped {
+				if open || e.LamportTS < end {
+					end, open = e.LamportTS, false
+				}
+			}
+		}
+		x1, x2 := x(req.LamportTS), max(x(end), x(req.LamportTS)+2)
+		row := 0
+		for row < len(ends[req.AgentID]) && ends[req.AgentID][row] > x1 {
+			row++
+		}
+		if row == len(ends[req.AgentID]) {
+			ends[req.AgentID] = append(ends[req.AgentID], 0)
+		}
+		ends[req.AgentID][row] = x2
+
+		title := fmt.Sprintf("%s locked %s at ts=%d", req.AgentID, req.Target, req.LamportTS)
+		if open {
+			title += ", no release recorded"
+		} else {
+			title += fmt.Sprintf(", released at ts=%d", end)
+		}
+		bars = append(bars, Bar{
+			X: x1, Y: lanes[req.AgentID] + 8 + row*reportBarGap, W: x2 - x1,
+			Path: req.Target, Open: open, Title: title,
+		})
+	}
+	return bars
+}
+
+// verdict extracts pass, fail or changes from a review_done body.
+func verdict(body string) string {
+	var p struct {
+		Verdict string `json:"verdict"`
+	}
+	_ = json.Unmarshal([]byte(body), &p)
+	return p.Verdict
+}
+
+func eventTitle(e model.Event) string {
+	s := fmt.Sprintf("[ts=%d] %s %s", e.LamportTS, e.AgentID, e.Kind)
+	if e.Target != "" {
+		s += " -> " + e.Target
+	}
+	if e.Body != "" {
+		s += ": " + e.Body
+	}
+	return s
+}
+
+// WriteHTML renders the report as a standalone HTML page.
+func (r *Report) WriteHTML(w io.Writer) error {
+	return reportTmpl.Execute(w, r)
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+func reportEvents() []model.Event {
+	now := time.Now().UTC()
+	ev := func(id int64, agent string, ts, epoch int64, kind model.EventKind, target, body string) model.Event {
+		return model.Event{ID: id, AgentID: agent, LamportTS: ts, Epoch: epoch, Kind: kind,
+			Target: target, Body: body, CreatedAt: now.Add(time.Duration(id) * time.Second)}
+	}
+	return []model.Event{
+		ev(1, "alice", 1, 0, model.EventLockReq, "a.go", ""),
+		ev(2, "alice", 2, 0, model.EventMsg, "bob", "taking a.go"),
+		ev(3, "bob", 4, 1, model.EventMsg, "alice", "ack"),
+		ev(4, "alice", 5, 1, model.EventLockRel, "a.go", ""),
+		ev(5, "alice", 6, 1, model.EventReviewReq, "bob", `{"commit":"abc"}`),
+		ev(6, "bob", 7, 1, model.EventReviewDone, "alice", `{"commit":"abc","verdict":"fail"}`),
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	deliveries := []model.Delivery{{EventID: 2, AgentID: "bob", SenderID: "alice", SendTS: 2, Clock: 0}}
+	r := BuildReport("run", nil, reportEvents(), deliveries)
+
+	if len(r.Lanes) != 2 || r.Lanes[0].AgentID != "alice" || r.Lanes[1].AgentID != "bob" {
+		t.Fatalf("lanes = %+v", r.Lanes)
+	}
+	if r.MinTS != 1 || r.MaxTS != 7 {
+		t.Fatalf("ts range = %d..%d", r.MinTS, r.MaxTS)
+	}
+	if len(r.Arrows) != 4 {
+		t.Fatalf("arrows = %+v", r.Arrows)
+	}
+	// alice's message was received at bob's clock max(0, 2)+1 = 3.
+	if a := r.Arrows[0]; a.Pending || a.Y1 != r.Lanes[0].Y || a.Y2 != r.Lanes[1].Y || a.X2 <= a.X1 {
+		t.Fatalf("delivered arrow = %+v", a)
+	}
+	if !r.Arrows[1].Pending {
+		t.Fatalf("undelivered message should be pending: %+v", r.Arrows[1])
+	}
+	if len(r.Bars) != 1 || r.Bars[0].Open || r.Bars[0].Path != "a.go" {
+		t.Fatalf("bars = %+v", r.Bars)
+	}
+	if got := r.Marks[5].Class; got != "review_done fail" {
+		t.Fatalf("review_done class = %q", got)
+	}
+	if r.Stats.Messages != 2 || r.Stats.Locks != 1 || r.Stats.Reviews != 2 || r.Stats.Events != 6 {
+		t.Fatalf("stats = %+v", r.Stats)
+	}
+}
+
+func TestBuildReportEpoch(t *testing.T) {
+	epoch := int64(0)
+	r := BuildReport("run", &epoch, reportEvents(), nil)
+	if len(r.Events) != 2 || len(r.Lanes) != 1 {
+		t.Fatalf("events = %+v, lanes = %+v", r.Events, r.Lanes)
+	}
+	// The release happened in epoch 1 but still closes the bar.
+	if len(r.Bars) != 1 || r.Bars[0].Open {
+		t.Fatalf("bars = %+v", r.Bars)
+	}
+	// bob has no lane in epoch 0, so alice's message gets no arrow.
+	if len(r.Arrows) != 0 {
+		t.Fatalf("arrows = %+v", r.Arrows)
+	}
+
+	epoch = 9
+	if r := BuildReport("run", &epoch, reportEvents(), nil); len(r.Events) != 0 || len(r.Lanes) != 0 {
+		t.Fatalf("empty epoch report = %+v", r)
+	}
+}
+
+func TestBuildReportOpenLock(t *testing.T) {
+	r := BuildReport("run", nil, reportEvents()[:3], nil)
+	if len(r.Bars) != 1 || !r.Bars[0].Open {
+		t.Fatalf("bars = %+v", r.Bars)
+	}
+	if !strings.Contains(r.Bars[0].Title, "no release recorded") {
+		t.Fatalf("title = %q", r.Bars[0].Title)
+	}
+}
+
+func TestReportWriteHTML(t *testing.T) {
+	epoch := int64(1)
+	var buf bytes.Buffer
+	if err := BuildReport("nightly <run>", &epoch, reportEvents(), nil).WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{"nightly &lt;run&gt;", "epoch 1", "<svg", `class="arrow msg pending"`, "review_done fail"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("report missing %q", want)
+		}
+	}
+	if strings.Contains(html, "<script") {
+		t.Error("report should not need JavaScript")
+	}
+
+	buf.Reset()
+	if err := BuildReport("empty", nil, nil, nil).WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "No events") {
+		t.Errorf("empty report = %s", buf.String())
+	}
+}
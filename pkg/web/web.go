@@ -0,0 +1,199 @@
+// Package web serves a read-only dashboard for humans supervising a swarm.
+//
+// The dashboard is a single embedded page. It renders an initial snapshot
+// of the store (agents, locks, frontier, recent events) and then follows a
+// Server-Sent Events stream: every poll interval the server pushes new log
+// entries as "log" events and a fresh snapshot as a "snapshot" event.
+//
+// Like `cm watch --all`, the dashboard is a passive observer: it never
+// ticks clocks or advances cursors.
+package web
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/frontier"
+	"github.com/daviddao/clockmail/pkg/metrics"
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+//go:embed index.html
+var indexHTML string
+
+var indexTmpl = template.Must(template.New("index").Parse(indexHTML))
+
+// recentEvents is how many log entries a snapshot carries for the timeline.
+const recentEvents = 300
+
+// Server serves the dashboard backed by a store.
+type Server struct {
+	store    store.StoreInterface
+	interval time.Duration
+	title    string
+}
+
+// New returns a dashboard server that polls st every interval.
+func New(st store.StoreInterface, interval time.Duration, title string) *Server {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &Server{store: st, interval: interval, title: title}
+}
+
+// AgentView is an agent as shown on the dashboard.
+type AgentView struct {
+	model.Agent
+	Presence string `json:"presence"`
+}
+
+// Snapshot is the dashboard's view of the store at one moment.
+type Snapshot struct {
+	Agents      []AgentView        `json:"agents"`
+	Locks       []model.Lock       `json:"locks"`
+	Frontier    []model.Pointstamp `json:"frontier"`
+	Events      []model.Event      `json:"events"`
+	LastEventID int64              `json:"last_event_id"`
+	GeneratedAt time.Time          `json:"generated_at"`
+}
+
+// Snapshot reads the current state from the store.
+func (s *Server) Snapshot() (*Snapshot, error) {
+	agents, err := s.store.ListAgents()
+	if err != nil {
+		return nil, fmt.Errorf("list agents: %w", err)
+	}
+	locks, err := s.store.ListLocks()
+	if err != nil {
+		return nil, fmt.Errorf("list locks: %w", err)
+	}
+	active, err := s.store.GetActivePointstamps(0)
+	if err != nil {
+		return nil, fmt.Errorf("active pointstamps: %w", err)
+	}
+
+	lastID := s.store.MaxEventID()
+	events, err := s.store.ListEventsSinceID(max(lastID-recentEvents, 0), recentEvents)
+	if err != nil {
+		return nil, fmt.Errorf("list events: %w", err)
+	}
+
+	now := time.Now().UTC()
+	snap := &Snapshot{
+		Agents:      make([]AgentView, 0, len(agents)),
+		Locks:       locks,
+		Frontier:    frontier.ComputeFrontier(active),
+		Events:      events,
+		LastEventID: lastID,
+		GeneratedAt: now,
+	}
+	for _, ag := range agents {
+		snap.Agents = append(snap.Agents, AgentView{Agent: ag, Presence: ag.Presence(now)})
+	}
+	return snap, nil
+}
+
+// Handler returns the dashboard's HTTP routes:
+//
+//	GET /               the dashboard page
+//	GET /api/snapshot   the current Snapshot as JSON
+//	GET /events         SSE stream of "log" and "snapshot" events
+//	GET /metrics        Prometheus metrics (see package metrics)
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /api/snapshot", s.handleSnapshot)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.Handle("GET /metrics", metrics.Handler(s.store, nil))
+	return mux
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	snap, err := s.Snapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTmpl.Execute(w, map[string]interface{}{
+		"Title":    s.title,
+		"Snapshot": snap,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	snap, err := s.Snapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(snap)
+}
+
+// handleEvents streams new log entries and snapshots until the client
+// disconnects. Clients may resume with ?since=<event id> (or the standard
+// Last-Event-ID header, which EventSource sends on reconnect).
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := s.store.MaxEventID()
+	for _, v := range []string{r.URL.Query().Get("since"), r.Header.Get("Last-Event-ID")} {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			lastID = id
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		events, err := s.store.ListEventsSinceID(lastID, 500)
+		if err != nil {
+			writeSSE(w, "error", "", err.Error())
+		}
+		for _, e := range events {
+			lastID = e.ID
+			writeSSE(w, "log", strconv.FormatInt(e.ID, 10), e)
+		}
+		if snap, err := s.Snapshot(); err == nil {
+			writeSSE(w, "snapshot", "", snap)
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeSSE writes one Server-Sent Event with a JSON payload.
+func writeSSE(w http.ResponseWriter, event, id string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+}
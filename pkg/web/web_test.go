@@ -0,0 +1,160 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daviddao/clockmail/pkg/model"
+	"github.com/daviddao/clockmail/pkg/store"
+)
+
+func newTestServer(t *testing.T) (*store.Store, *httptest.Server) {
+	t.Helper()
+	s, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("store.New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(New(s, 10*time.Millisecond, "test swarm").Handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func sendMsg(t *testing.T, s *store.Store, from, to string, ts int64) {
+	t.Helper()
+	if _, err := s.InsertEvent(&model.Event{AgentID: from, LamportTS: ts, Kind: model.EventMsg,
+		Target: to, Body: "hi", CreatedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s, srv := newTestServer(t)
+	s.RegisterAgent("alice")
+	s.RegisterAgent("bob")
+	s.AcquireLock("a.go", "alice", 1, 0, true, time.Hour)
+	sendMsg(t, s, "alice", "bob", 2)
+
+	resp, err := http.Get(srv.URL + "/api/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var snap Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		t.Fatalf("decode snapshot: %v", err)
+	}
+	if len(snap.Agents) != 2 || snap.Agents[0].Presence != "online" {
+		t.Fatalf("agents = %+v", snap.Agents)
+	}
+	if len(snap.Locks) != 1 || len(snap.Events) != 1 || snap.LastEventID != snap.Events[0].ID {
+		t.Fatalf("snapshot = %+v", snap)
+	}
+	if len(snap.Frontier) == 0 {
+		t.Fatal("frontier should include active agents")
+	}
+}
+
+func TestIndex_EmbedsSnapshot(t *testing.T) {
+	s, srv := newTestServer(t)
+	s.RegisterAgent("<script>")
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	page := string(body)
+	if !strings.Contains(page, "<title>test swarm</title>") {
+		t.Fatal("page should carry the title")
+	}
+	if !strings.Contains(page, `\u003cscript\u003e`) || strings.Contains(page, `"<script>"`) {
+		t.Fatal("initial snapshot should be embedded with agent IDs escaped")
+	}
+
+	if resp, _ := http.Get(srv.URL + "/nope"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown path: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestEvents_StreamsNewLogEntries(t *testing.T) {
+	s, srv := newTestServer(t)
+	s.RegisterAgent("alice")
+	sendMsg(t, s, "alice", "bob", 1) // before the stream starts: not replayed
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	sendMsg(t, s, "alice", "bob", 7)
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 1<<20), 1<<20)
+	var sawSnapshot bool
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "event: snapshot" {
+			sawSnapshot = true
+		}
+		if line == "event: log" {
+			sc.Scan() // data line
+			var e model.Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(sc.Text(), "data: ")), &e); err != nil {
+				t.Fatalf("decode log event: %v", err)
+			}
+			if e.LamportTS != 7 {
+				t.Fatalf("streamed event ts = %d, want 7 (earlier events must not replay)", e.LamportTS)
+			}
+			if !sawSnapshot {
+				t.Fatal("a snapshot should be sent before any later log entries")
+			}
+			return
+		}
+	}
+	t.Fatalf("stream ended without a log event: %v", sc.Err())
+}
+
+func TestEvents_ResumeFromID(t *testing.T) {
+	s, srv := newTestServer(t)
+	sendMsg(t, s, "alice", "bob", 1)
+	sendMsg(t, s, "alice", "bob", 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 1<<20), 1<<20)
+	for sc.Scan() {
+		if sc.Text() == "id: 2" {
+			return
+		}
+		if strings.HasPrefix(sc.Text(), "id: ") {
+			t.Fatalf("unexpected event %q after resuming from 1", sc.Text())
+		}
+	}
+	t.Fatal("stream should resume with event 2")
+}
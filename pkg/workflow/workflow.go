@@ -0,0 +1,473 @@
+// Package workflow loads and enforces declarative coordination protocols.
+//
+// A workflow file (.clockmail/workflow.yaml) turns the conventions agents
+// otherwise follow by hand — "workers implement in epoch 1, the tester
+// reviews before anyone moves on" — into rules that cm checks whenever an
+// agent changes epoch:
+//
+//	version: 1
+//	roles:
+//	  worker: [alice, bob]
+//	  reviewer: [tester]
+//	epochs:
+//	  - epoch: 1
+//	    name: implement
+//	    roles: [worker]        # only workers may enter epoch 1
+//	    review:
+//	      by: reviewer         # closing epoch 1 needs a reviewer pass
+//	      for: [worker]
+//	  - epoch: 2
+//	    name: test
+//	    gate: [worker]         # entering epoch 2 waits for all workers
+//	max_epochs_ahead: 1        # no agent may run more than 1 epoch past the slowest
+//
+// Evaluation is pure: callers supply the agents, active pointstamps, and
+// review events, so the rules can be checked without a database.
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/daviddao/clockmail/pkg/model"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the workflow schema version understood by this package.
+const Version = 1
+
+// Workflow is a parsed workflow definition.
+type Workflow struct {
+	Version int                 `yaml:"version" json:"version"`
+	Roles   map[string][]string `yaml:"roles" json:"roles"`
+	Epochs  []Epoch             `yaml:"epochs" json:"epochs"`
+
+	// MaxEpochsAhead caps how far an agent may run ahead of the slowest
+	// active agent. Zero disables the check.
+	MaxEpochsAhead int64 `yaml:"max_epochs_ahead,omitempty" json:"max_epochs_ahead,omitempty"`
+}
+
+// Epoch declares the rules attached to a single epoch.
+type Epoch struct {
+	Epoch  int64    `yaml:"epoch" json:"epoch"`
+	Name   string   `yaml:"name,omitempty" json:"name,omitempty"`
+	Roles  []string `yaml:"roles,omitempty" json:"roles,omitempty"`   // roles allowed to enter (empty = any)
+	Gate   []string `yaml:"gate,omitempty" json:"gate,omitempty"`     // roles that must finish the previous epoch first
+	Review *Review  `yaml:"review,omitempty" json:"review,omitempty"` // review required before closing
+}
+
+// Review requires a passing review-done from an agent holding role By
+// before agents holding any role in For may advance past the epoch.
+// An empty For applies the requirement to every agent except reviewers.
+type Review struct {
+	By  string   `yaml:"by" json:"by"`
+	For []string `yaml:"for,omitempty" json:"for,omitempty"`
+}
+
+// Violation describes a rule that blocks an epoch transition.
+type Violation struct {
+	Rule    string `json:"rule"` // "role", "gate", "review", or "ahead"
+	Epoch   int64  `json:"epoch"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string { return v.Message }
+
+// Parse decodes and validates a workflow definition. Unknown keys are
+// rejected so that typos do not silently disable a rule.
+func Parse(data []byte) (*Workflow, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var w Workflow
+	if err := dec.Decode(&w); err != nil {
+		return nil, fmt.Errorf("parse workflow: %w", err)
+	}
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// Load reads and parses a workflow file.
+func Load(path string) (*Workflow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Validate checks the definition for internal consistency. All problems
+// are reported at once, joined into a single error.
+func (w *Workflow) Validate() error {
+	var errs []error
+	if w.Version != Version {
+		errs = append(errs, fmt.Errorf("unsupported version %d (want %d)", w.Version, Version))
+	}
+	if w.MaxEpochsAhead < 0 {
+		errs = append(errs, fmt.Errorf("max_epochs_ahead: must be >= 0, got %d", w.MaxEpochsAhead))
+	}
+	for _, role := range sortedKeys(w.Roles) {
+		if strings.TrimSpace(role) == "" {
+			errs = append(errs, errors.New("role with empty name"))
+		}
+		members := make(map[string]bool)
+		for _, ag := range w.Roles[role] {
+			if ag == "" {
+				errs = append(errs, fmt.Errorf("role %q: empty agent ID", role))
+			} else if members[ag] {
+				errs = append(errs, fmt.Errorf("role %q: agent %q listed twice", role, ag))
+			}
+			members[ag] = true
+		}
+	}
+	seen := make(map[int64]bool)
+	for _, ep := range w.Epochs {
+		if ep.Epoch < 0 {
+			errs = append(errs, fmt.Errorf("epoch %d: must be >= 0", ep.Epoch))
+		}
+		if seen[ep.Epoch] {
+			errs = append(errs, fmt.Errorf("epoch %d: declared twice", ep.Epoch))
+		}
+		seen[ep.Epoch] = true
+		for _, r := range ep.Roles {
+			errs = append(errs, w.checkRole(ep.Epoch, "roles", r)...)
+		}
+		for _, r := range ep.Gate {
+			errs = append(errs, w.checkRole(ep.Epoch, "gate", r)...)
+		}
+		if ep.Review != nil {
+			if ep.Review.By == "" {
+				errs = append(errs, fmt.Errorf("epoch %d: review.by is required", ep.Epoch))
+			} else {
+				errs = append(errs, w.checkRole(ep.Epoch, "review.by", ep.Review.By)...)
+			}
+			for _, r := range ep.Review.For {
+				errs = append(errs, w.checkRole(ep.Epoch, "review.for", r)...)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *Workflow) checkRole(epoch int64, field, role string) []error {
+	if _, ok := w.Roles[role]; !ok {
+		return []error{fmt.Errorf("epoch %d: %s references undefined role %q", epoch, field, role)}
+	}
+	return nil
+}
+
+// Marshal encodes the workflow as JSON for storage in the shared database.
+func (w *Workflow) Marshal() (string, error) {
+	b, err := json.Marshal(w)
+	return string(b), err
+}
+
+// Unmarshal decodes a workflow previously encoded with Marshal.
+func Unmarshal(s string) (*Workflow, error) {
+	var w Workflow
+	if err := json.Unmarshal([]byte(s), &w); err != nil {
+		return nil, fmt.Errorf("decode workflow: %w", err)
+	}
+	return &w, nil
+}
+
+// RolesOf returns the roles held by agentID, sorted by name.
+func (w *Workflow) RolesOf(agentID string) []string {
+	var roles []string
+	for _, role := range sortedKeys(w.Roles) {
+		if w.HasRole(agentID, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// HasRole reports whether agentID is a member of role.
+func (w *Workflow) HasRole(agentID, role string) bool {
+	for _, ag := range w.Roles[role] {
+		if ag == agentID {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Workflow) hasAnyRole(agentID string, roles []string) bool {
+	for _, r := range roles {
+		if w.HasRole(agentID, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// EpochDef returns the declaration for epoch n, or nil if undeclared.
+func (w *Workflow) EpochDef(n int64) *Epoch {
+	for i := range w.Epochs {
+		if w.Epochs[i].Epoch == n {
+			return &w.Epochs[i]
+		}
+	}
+	return nil
+}
+
+// previousEpoch returns the highest declared epoch strictly below n.
+func (w *Workflow) previousEpoch(n int64) (int64, bool) {
+	var prev int64
+	found := false
+	for _, ep := range w.Epochs {
+		if ep.Epoch < n && (!found || ep.Epoch > prev) {
+			prev, found = ep.Epoch, true
+		}
+	}
+	return prev, found
+}
+
+// reviewApplies reports whether the epoch's review requirement binds agentID.
+func (w *Workflow) reviewApplies(ep *Epoch, agentID string) bool {
+	if ep.Review == nil {
+		return false
+	}
+	if len(ep.Review.For) == 0 {
+		return !w.HasRole(agentID, ep.Review.By)
+	}
+	return w.hasAnyRole(agentID, ep.Review.For)
+}
+
+// State is the coordination state a workflow is evaluated against.
+type State struct {
+	Active  []model.Pointstamp // active agent positions and in-flight messages (see store.GetActivePointstamps)
+	Reviews []model.Event      // review_req and review_done events
+}
+
+// CheckTransition returns the violations that would result from agentID
+// moving from epoch `from` to epoch `to`. An empty result means the move
+// is allowed. Moving to the same epoch is always allowed.
+func (w *Workflow) CheckTransition(agentID string, from, to int64, st State) []Violation {
+	if from == to {
+		return nil
+	}
+	var vs []Violation
+
+	// Closing `from`: reviews must have passed.
+	if to > from {
+		if ep := w.EpochDef(from); ep != nil && w.reviewApplies(ep, agentID) {
+			if _, ok := w.reviewVerdict(agentID, from, ep.Review.By, st.Reviews); !ok {
+				vs = append(vs, Violation{
+					Rule:  "review",
+					Epoch: from,
+					Message: fmt.Sprintf("cannot close epoch %d: no passing review from role %q "+
+						"(run: cm review-request <commit>)", from, ep.Review.By),
+				})
+			}
+		}
+	}
+
+	// Entering `to`: must not run too far ahead of the slowest agent.
+	if to > from && w.MaxEpochsAhead > 0 {
+		if low, ok := slowest(agentID, st.Active); ok && to-low.Timestamp.Epoch > w.MaxEpochsAhead {
+			vs = append(vs, Violation{
+				Rule:  "ahead",
+				Epoch: to,
+				Message: fmt.Sprintf("cannot enter epoch %d: %d epochs ahead of the frontier minimum "+
+					"(%s@%d), max_epochs_ahead is %d", to, to-low.Timestamp.Epoch,
+					low.AgentID, low.Timestamp.Epoch, w.MaxEpochsAhead),
+			})
+		}
+	}
+
+	ep := w.EpochDef(to)
+	if ep == nil {
+		return vs
+	}
+
+	// Entering `to`: role restriction.
+	if len(ep.Roles) > 0 && !w.hasAnyRole(agentID, ep.Roles) {
+		vs = append(vs, Violation{
+			Rule:  "role",
+			Epoch: to,
+			Message: fmt.Sprintf("cannot enter epoch %d: requires role %s",
+				to, strings.Join(ep.Roles, " or ")),
+		})
+	}
+
+	// Entering `to`: gated roles must have finished the previous epoch.
+	if blockers := w.gateBlockers(agentID, ep, st.Active); len(blockers) > 0 {
+		prev, _ := w.previousEpoch(to)
+		var names []string
+		for _, b := range blockers {
+			names = append(names, fmt.Sprintf("%s@%d", b.AgentID, b.Timestamp.Epoch))
+		}
+		vs = append(vs, Violation{
+			Rule:  "gate",
+			Epoch: to,
+			Message: fmt.Sprintf("cannot enter epoch %d: waiting for %s to finish epoch %d (%s)",
+				to, strings.Join(ep.Gate, ","), prev, strings.Join(names, ", ")),
+		})
+	}
+	return vs
+}
+
+// gateBlockers returns the active pointstamps of gated agents (other than
+// agentID) still at or before the epoch preceding ep.
+func (w *Workflow) gateBlockers(agentID string, ep *Epoch, active []model.Pointstamp) []model.Pointstamp {
+	if len(ep.Gate) == 0 {
+		return nil
+	}
+	prev, ok := w.previousEpoch(ep.Epoch)
+	if !ok {
+		return nil
+	}
+	var blockers []model.Pointstamp
+	for _, p := range active {
+		if p.AgentID == agentID || !w.hasAnyRole(p.AgentID, ep.Gate) {
+			continue
+		}
+		if p.Timestamp.Epoch <= prev {
+			blockers = append(blockers, p)
+		}
+	}
+	return blockers
+}
+
+// slowest returns the active agent position with the lowest epoch,
+// ignoring agentID itself and in-flight messages. Ties go to the lowest agent ID so messages are stable.
+func slowest(agentID string, active []model.Pointstamp) (model.Pointstamp, bool) {
+	var low model.Pointstamp
+	found := false
+	for _, p := range active {
+		if p.AgentID == agentID || p.EventID != 0 {
+			continue
+		}
+		if !found || p.Timestamp.Epoch < low.Timestamp.Epoch ||
+			(p.Timestamp.Epoch == low.Timestamp.Epoch && p.AgentID < low.AgentID) {
+			low, found = p, true
+		}
+	}
+	return low, found
+}
+
+// reviewVerdict finds the latest verdict from a reviewer holding role `by`
+// on any commit agentID submitted for review while at epoch. A verdict
+// only counts if its Lamport timestamp follows the request, which proves
+// the review happened after the submission. Returns the commit and true
+// when the latest verdict is a pass.
+func (w *Workflow) reviewVerdict(agentID string, epoch int64, by string, events []model.Event) (string, bool) {
+	requested := make(map[string]int64) // commit -> earliest request ts
+	for _, e := range events {
+		if e.Kind != model.EventReviewReq || e.AgentID != agentID || e.Epoch != epoch {
+			continue
+		}
+		c := parseReview(e.Body).Commit
+		if c == "" {
+			continue
+		}
+		if ts, ok := requested[c]; !ok || e.LamportTS < ts {
+			requested[c] = e.LamportTS
+		}
+	}
+
+	var latest *model.Event
+	var latestCommit, latestVerdict string
+	for i := range events {
+		e := &events[i]
+		if e.Kind != model.EventReviewDone || !w.HasRole(e.AgentID, by) {
+			continue
+		}
+		p := parseReview(e.Body)
+		for c, ts := range requested {
+			if !sameCommit(c, p.Commit) || e.LamportTS <= ts {
+				continue
+			}
+			if latest == nil || e.LamportTS > latest.LamportTS {
+				latest, latestCommit, latestVerdict = e, c, p.Verdict
+			}
+		}
+	}
+	return latestCommit, latest != nil && latestVerdict == "pass"
+}
+
+// reviewBody mirrors the fields cm review-request/review-done embed in
+// review event bodies.
+type reviewBody struct {
+	Commit  string `json:"commit"`
+	Verdict string `json:"verdict"`
+}
+
+func parseReview(body string) reviewBody {
+	var p reviewBody
+	_ = json.Unmarshal([]byte(body), &p)
+	return p
+}
+
+// sameCommit treats abbreviated and full SHAs of the same commit as equal.
+func sameCommit(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// EpochStatus summarizes a declared epoch for cm workflow status.
+type EpochStatus struct {
+	Epoch    int64              `json:"epoch"`
+	Name     string             `json:"name,omitempty"`
+	Agents   []string           `json:"agents"`
+	GateOpen bool               `json:"gate_open"`
+	Blockers []model.Pointstamp `json:"gate_blocked_by,omitempty"`
+	Reviews  []ReviewStatus     `json:"reviews,omitempty"`
+}
+
+// ReviewStatus is the review state of one agent bound by an epoch's
+// review requirement.
+type ReviewStatus struct {
+	AgentID string `json:"agent_id"`
+	Commit  string `json:"commit,omitempty"`
+	Passed  bool   `json:"passed"`
+}
+
+// Status evaluates every declared epoch against the current state.
+func (w *Workflow) Status(agents []model.Agent, st State) []EpochStatus {
+	epochs := append([]Epoch(nil), w.Epochs...)
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i].Epoch < epochs[j].Epoch })
+
+	out := make([]EpochStatus, 0, len(epochs))
+	for i := range epochs {
+		ep := &epochs[i]
+		es := EpochStatus{Epoch: ep.Epoch, Name: ep.Name, Agents: []string{}}
+		for _, ag := range agents {
+			if ag.Epoch == ep.Epoch {
+				es.Agents = append(es.Agents, ag.ID)
+			}
+		}
+		es.Blockers = w.gateBlockers("", ep, st.Active)
+		es.GateOpen = len(es.Blockers) == 0
+		if ep.Review != nil {
+			for _, ag := range agents {
+				if ag.Epoch != ep.Epoch || !w.reviewApplies(ep, ag.ID) {
+					continue
+				}
+				commit, passed := w.reviewVerdict(ag.ID, ep.Epoch, ep.Review.By, st.Reviews)
+				es.Reviews = append(es.Reviews, ReviewStatus{AgentID: ag.ID, Commit: commit, Passed: passed})
+			}
+		}
+		out = append(out, es)
+	}
+	return out
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,278 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daviddao/clockmail/pkg/model"
+)
+
+const sample = `
+version: 1
+roles:
+  worker: [alice, bob]
+  reviewer: [tester]
+epochs:
+  - epoch: 1
+    name: implement
+    roles: [worker]
+    review:
+      by: reviewer
+      for: [worker]
+  - epoch: 2
+    name: test
+    gate: [worker]
+`
+
+func mustParse(t *testing.T, src string) *Workflow {
+	t.Helper()
+	w, err := Parse([]byte(src))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return w
+}
+
+func ps(agent string, epoch int64) model.Pointstamp {
+	return model.Pointstamp{AgentID: agent, Timestamp: model.Timestamp{Epoch: epoch}}
+}
+
+func reviewReq(agent string, ts, epoch int64, commit string) model.Event {
+	return model.Event{AgentID: agent, LamportTS: ts, Epoch: epoch, Kind: model.EventReviewReq,
+		Body: `{"type":"review-request","commit":"` + commit + `"}`}
+}
+
+func reviewDone(agent string, ts int64, commit, verdict string) model.Event {
+	return model.Event{AgentID: agent, LamportTS: ts, Kind: model.EventReviewDone,
+		Body: `{"type":"review-done","commit":"` + commit + `","verdict":"` + verdict + `"}`}
+}
+
+// --- Parse / Validate tests ---
+
+func TestParse_Sample(t *testing.T) {
+	w := mustParse(t, sample)
+	if len(w.Roles) != 2 || len(w.Epochs) != 2 {
+		t.Fatalf("got %d roles, %d epochs; want 2, 2", len(w.Roles), len(w.Epochs))
+	}
+	if got := w.RolesOf("tester"); len(got) != 1 || got[0] != "reviewer" {
+		t.Fatalf("RolesOf(tester) = %v, want [reviewer]", got)
+	}
+	if w.EpochDef(2).Name != "test" {
+		t.Fatalf("EpochDef(2).Name = %q, want test", w.EpochDef(2).Name)
+	}
+	if w.EpochDef(7) != nil {
+		t.Fatal("EpochDef(7) should be nil")
+	}
+}
+
+func TestParse_UnknownField(t *testing.T) {
+	_, err := Parse([]byte("version: 1\nepochs:\n  - epoch: 1\n    reveiw: {by: x}\n"))
+	if err == nil {
+		t.Fatal("expected error for misspelled field")
+	}
+}
+
+func TestValidate_ReportsAllProblems(t *testing.T) {
+	_, err := Parse([]byte(`
+version: 2
+roles:
+  worker: [alice, alice]
+epochs:
+  - epoch: 1
+    roles: [ghost]
+  - epoch: 1
+    review: {}
+`))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"unsupported version", "listed twice", "undefined role \"ghost\"",
+		"declared twice", "review.by is required"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q missing %q", err, want)
+		}
+	}
+}
+
+func TestLoad_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workflow.yaml")
+	if err := os.WriteFile(path, []byte(sample), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("Load of missing file should fail")
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	w := mustParse(t, sample)
+	s, err := w.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := Unmarshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w2.EpochDef(1).Review.By != "reviewer" || !w2.HasRole("bob", "worker") {
+		t.Fatalf("round trip lost data: %+v", w2)
+	}
+}
+
+// --- CheckTransition tests ---
+
+func TestCheckTransition_SameEpochAllowed(t *testing.T) {
+	w := mustParse(t, sample)
+	if vs := w.CheckTransition("tester", 1, 1, State{}); len(vs) != 0 {
+		t.Fatalf("same epoch should be allowed, got %v", vs)
+	}
+}
+
+func TestCheckTransition_RoleRestriction(t *testing.T) {
+	w := mustParse(t, sample)
+	vs := w.CheckTransition("tester", 0, 1, State{})
+	if len(vs) != 1 || vs[0].Rule != "role" {
+		t.Fatalf("tester entering worker epoch: got %v, want one role violation", vs)
+	}
+	if vs := w.CheckTransition("alice", 0, 1, State{}); len(vs) != 0 {
+		t.Fatalf("alice entering epoch 1 should be allowed, got %v", vs)
+	}
+}
+
+func TestCheckTransition_ReviewRequired(t *testing.T) {
+	w := mustParse(t, sample)
+	st := State{Active: []model.Pointstamp{ps("alice", 1), ps("bob", 2)}}
+	vs := w.CheckTransition("alice", 1, 2, st)
+	if len(vs) != 1 || vs[0].Rule != "review" || vs[0].Epoch != 1 {
+		t.Fatalf("closing without review: got %v, want one review violation", vs)
+	}
+}
+
+func TestCheckTransition_ReviewPassed(t *testing.T) {
+	w := mustParse(t, sample)
+	st := State{
+		Active: []model.Pointstamp{ps("alice", 1), ps("bob", 2)},
+		Reviews: []model.Event{
+			reviewReq("alice", 5, 1, "abc123"),
+			reviewDone("tester", 8, "abc123def", "pass"),
+		},
+	}
+	if vs := w.CheckTransition("alice", 1, 2, st); len(vs) != 0 {
+		t.Fatalf("closing after pass should be allowed, got %v", vs)
+	}
+}
+
+func TestCheckTransition_ReviewFromWrongRoleIgnored(t *testing.T) {
+	w := mustParse(t, sample)
+	st := State{Reviews: []model.Event{
+		reviewReq("alice", 5, 1, "abc123"),
+		reviewDone("bob", 8, "abc123", "pass"),
+	}}
+	vs := w.CheckTransition("alice", 1, 3, st)
+	if len(vs) != 1 || vs[0].Rule != "review" {
+		t.Fatalf("pass from non-reviewer should not count, got %v", vs)
+	}
+}
+
+func TestCheckTransition_ReviewBeforeRequestIgnored(t *testing.T) {
+	w := mustParse(t, sample)
+	st := State{Reviews: []model.Event{
+		reviewDone("tester", 3, "abc123", "pass"),
+		reviewReq("alice", 5, 1, "abc123"),
+	}}
+	if vs := w.CheckTransition("alice", 1, 3, st); len(vs) != 1 {
+		t.Fatalf("verdict causally before request should not count, got %v", vs)
+	}
+}
+
+func TestCheckTransition_LatestVerdictWins(t *testing.T) {
+	w := mustParse(t, sample)
+	st := State{Reviews: []model.Event{
+		reviewReq("alice", 5, 1, "abc123"),
+		reviewDone("tester", 8, "abc123", "pass"),
+		reviewDone("tester", 12, "abc123", "fail"),
+	}}
+	if vs := w.CheckTransition("alice", 1, 3, st); len(vs) != 1 {
+		t.Fatalf("later fail should override pass, got %v", vs)
+	}
+}
+
+func TestCheckTransition_GateBlocksUntilWorkersFinish(t *testing.T) {
+	w := mustParse(t, sample)
+	st := State{Active: []model.Pointstamp{ps("alice", 1), ps("bob", 2), ps("tester", 0)}}
+	vs := w.CheckTransition("tester", 0, 2, st)
+	if len(vs) != 1 || vs[0].Rule != "gate" || !strings.Contains(vs[0].Message, "alice@1") {
+		t.Fatalf("gate should block on alice, got %v", vs)
+	}
+
+	st.Active[0] = ps("alice", 2)
+	if vs := w.CheckTransition("tester", 0, 2, st); len(vs) != 0 {
+		t.Fatalf("gate should open once workers finish, got %v", vs)
+	}
+}
+
+func TestCheckTransition_UndeclaredEpochsUnrestricted(t *testing.T) {
+	w := mustParse(t, sample)
+	if vs := w.CheckTransition("tester", 5, 6, State{}); len(vs) != 0 {
+		t.Fatalf("undeclared epochs should be unrestricted, got %v", vs)
+	}
+}
+
+func TestCheckTransition_MaxEpochsAhead(t *testing.T) {
+	w := mustParse(t, "version: 1\nmax_epochs_ahead: 2\n")
+	st := State{Active: []model.Pointstamp{ps("alice", 5), ps("bob", 1), ps("carol", 1)}}
+
+	vs := w.CheckTransition("alice", 3, 4, st)
+	if len(vs) != 1 || vs[0].Rule != "ahead" || !strings.Contains(vs[0].Message, "bob@1") {
+		t.Fatalf("4 epochs past bob should be refused, got %v", vs)
+	}
+	if vs := w.CheckTransition("alice", 2, 3, st); len(vs) != 0 {
+		t.Fatalf("2 epochs ahead is within the limit, got %v", vs)
+	}
+	if vs := w.CheckTransition("alice", 6, 5, st); len(vs) != 0 {
+		t.Fatalf("moving back should always be allowed, got %v", vs)
+	}
+	alone := State{Active: []model.Pointstamp{ps("alice", 0)}}
+	if vs := w.CheckTransition("alice", 0, 9, alone); len(vs) != 0 {
+		t.Fatalf("an agent's own position must not count, got %v", vs)
+	}
+}
+
+func TestValidate_NegativeMaxEpochsAhead(t *testing.T) {
+	if _, err := Parse([]byte("version: 1\nmax_epochs_ahead: -1\n")); err == nil ||
+		!strings.Contains(err.Error(), "max_epochs_ahead") {
+		t.Fatalf("negative max_epochs_ahead should be rejected, got %v", err)
+	}
+}
+
+// --- Status tests ---
+
+func TestStatus(t *testing.T) {
+	w := mustParse(t, sample)
+	agents := []model.Agent{{ID: "alice", Epoch: 1}, {ID: "bob", Epoch: 1}, {ID: "tester", Epoch: 0}}
+	st := State{
+		Active: []model.Pointstamp{ps("alice", 1), ps("bob", 1), ps("tester", 0)},
+		Reviews: []model.Event{
+			reviewReq("alice", 5, 1, "abc"),
+			reviewDone("tester", 8, "abc", "pass"),
+		},
+	}
+	out := w.Status(agents, st)
+	if len(out) != 2 {
+		t.Fatalf("got %d epoch statuses, want 2", len(out))
+	}
+	if len(out[0].Agents) != 2 || len(out[0].Reviews) != 2 {
+		t.Fatalf("epoch 1: %+v", out[0])
+	}
+	if !out[0].Reviews[0].Passed || out[0].Reviews[1].Passed {
+		t.Fatalf("epoch 1 reviews: alice should pass, bob should not: %+v", out[0].Reviews)
+	}
+	if out[1].GateOpen || len(out[1].Blockers) != 2 {
+		t.Fatalf("epoch 2 gate should be blocked by both workers: %+v", out[1])
+	}
+}
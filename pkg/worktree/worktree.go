@@ -0,0 +1,220 @@
+// Package worktree inspects a git working tree by running the git CLI, so
+// that cm can compare the files an agent has actually changed with the
+// locks recorded in the shared database.
+package worktree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Repo is a git working tree.
+type Repo struct {
+	Root string // absolute path of the top-level directory
+}
+
+// Open returns the working tree containing dir.
+func Open(dir string) (*Repo, error) {
+	out, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	return &Repo{Root: strings.TrimSpace(string(out))}, nil
+}
+
+// Changed returns the files, relative to Root and sorted, that differ from
+// HEAD in the index or working tree, including untracked files. Renamed
+// files are reported under both names. If base is not empty, files changed
+// between base and the working tree are included as well, which covers
+// work that has already been committed.
+func (r *Repo) Changed(base string) ([]string, error) {
+	out, err := git(r.Root, "status", "--porcelain=v1", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	entries := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if len(e) < 4 {
+			continue
+		}
+		set[e[3:]] = true
+		// Renames and copies are followed by their source path.
+		if (e[0] == 'R' || e[0] == 'C') && i+1 < len(entries) {
+			i++
+			set[entries[i]] = true
+		}
+	}
+
+	if base != "" {
+		out, err := git(r.Root, "diff", "--name-only", "-z", base, "--")
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range strings.Split(string(out), "\x00") {
+			if p != "" {
+				set[p] = true
+			}
+		}
+	}
+
+	files := make([]string, 0, len(set))
+	for p := range set {
+		files = append(files, p)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Staged returns the files, relative to Root and sorted, whose changes are
+// staged in the index: what the next commit will contain. Renames are
+// reported under both names.
+func (r *Repo) Staged() ([]string, error) {
+	out, err := git(r.Root, "diff", "--cached", "--name-only", "--no-renames", "-z")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p != "" {
+			files = append(files, p)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// HooksDir returns the absolute path of the directory git runs hooks from,
+// honoring core.hooksPath.
+func (r *Repo) HooksDir() (string, error) {
+	out, err := git(r.Root, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+	dir := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(r.Root, dir)
+	}
+	return dir, nil
+}
+
+// Branch returns the short name of the checked-out branch, such as
+// "main" or "feature/x". It is an error if HEAD is detached.
+func (r *Repo) Branch() (string, error) {
+	out, err := git(r.Root, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Commit is a commit read from the history by Log.
+type Commit struct {
+	SHA     string
+	Author  string
+	Email   string
+	Time    time.Time // author date
+	Subject string
+	Files   []string // relative to Root
+}
+
+// Log returns the non-merge commits reachable from HEAD that were made
+// after since (anything git log --since accepts, such as "1 week" or
+// "2024-05-01"; empty for all history), oldest first. At most max commits
+// are returned, the most recent ones, if max > 0.
+func (r *Repo) Log(since string, max int) ([]Commit, error) {
+	args := []string{"-c", "core.quotePath=false", "log", "--no-merges", "--name-only",
+		"--format=%x1e%H%x1f%an%x1f%ae%x1f%at%x1f%s"}
+	if since != "" {
+		args = append(args, "--since="+since)
+	}
+	if max > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%d", max))
+	}
+	out, err := git(r.Root, args...)
+	if err != nil {
+		return nil, err
+	}
+	var commits []Commit
+	for _, rec := range strings.Split(string(out), "\x1e") {
+		if strings.TrimSpace(rec) == "" {
+			continue
+		}
+		header, files, _ := strings.Cut(rec, "\n")
+		f := strings.Split(header, "\x1f")
+		if len(f) != 5 {
+			return nil, fmt.Errorf("git log: unexpected record %q", header)
+		}
+		secs, err := strconv.ParseInt(f[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("git log: bad date in %s: %w", f[0], err)
+		}
+		c := Commit{SHA: f[0], Author: f[1], Email: f[2], Time: time.Unix(secs, 0).UTC(), Subject: f[4]}
+		for _, p := range strings.Split(files, "\n") {
+			if p != "" {
+				c.Files = append(c.Files, p)
+			}
+		}
+		commits = append(commits, c)
+	}
+	// git log lists newest first.
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+	return commits, nil
+}
+
+// Show returns the contents of path (relative to Root) as of rev.
+func (r *Repo) Show(rev, path string) ([]byte, error) {
+	return git(r.Root, "show", rev+":"+filepath.ToSlash(path))
+}
+
+// Rel converts path, absolute or relative to dir, into a slash-separated
+// path relative to Root. It reports false for paths outside the tree.
+func (r *Repo) Rel(dir, path string) (string, bool) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	rel, err := filepath.Rel(r.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// Covers reports whether a lock on lockPath covers file: the paths are
+// equal, or lockPath is a directory containing file. Both are relative to
+// the repository root.
+func Covers(lockPath, file string) bool {
+	if lockPath == "." {
+		return true
+	}
+	return file == lockPath || strings.HasPrefix(file, strings.TrimSuffix(lockPath, "/")+"/")
+}
+
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	name := args[0]
+	if name == "-c" && len(args) > 2 {
+		name = args[2]
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("git %s: %s", name, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("git %s: %w", name, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,222 @@
+package worktree
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newRepo creates a git repository with one committed file, a.go.
+func newRepo(t *testing.T) *Repo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	run(t, dir, "init", "-q")
+	write(t, dir, "a.go", "package a\n")
+	write(t, dir, "old.go", "package a\n")
+	run(t, dir, "add", ".")
+	run(t, dir, "commit", "-q", "-m", "init")
+	run(t, dir, "tag", "base")
+
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return r
+}
+
+func run(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@example.com",
+		"GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@example.com")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func write(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	r := newRepo(t)
+	if files, err := r.Changed(""); err != nil || len(files) != 0 {
+		t.Fatalf("clean tree: got %v, %v", files, err)
+	}
+
+	write(t, r.Root, "a.go", "package a\n\nvar x int\n")
+	write(t, r.Root, "pkg/new file.go", "package pkg\n")
+	run(t, r.Root, "mv", "old.go", "renamed.go")
+
+	files, err := r.Changed("")
+	if err != nil {
+		t.Fatalf("Changed: %v", err)
+	}
+	want := []string{"a.go", "old.go", "pkg/new file.go", "renamed.go"}
+	if !slices.Equal(files, want) {
+		t.Fatalf("Changed = %q, want %q", files, want)
+	}
+}
+
+func TestChanged_Base(t *testing.T) {
+	r := newRepo(t)
+	write(t, r.Root, "b.go", "package a\n")
+	run(t, r.Root, "add", "b.go")
+	run(t, r.Root, "commit", "-q", "-m", "b")
+	if files, _ := r.Changed(""); len(files) != 0 {
+		t.Fatalf("committed work is not in git status, got %v", files)
+	}
+	if files, err := r.Changed("base"); err != nil || !slices.Equal(files, []string{"b.go"}) {
+		t.Fatalf("Changed(base) = %v, %v; want [b.go]", files, err)
+	}
+	if _, err := r.Changed("no-such-rev"); err == nil {
+		t.Fatal("unknown base should fail")
+	}
+}
+
+func TestStaged(t *testing.T) {
+	r := newRepo(t)
+	write(t, r.Root, "a.go", "package a\n\nvar x int\n")
+	write(t, r.Root, "b.go", "package a\n")
+	run(t, r.Root, "add", "b.go")
+	run(t, r.Root, "mv", "old.go", "renamed.go")
+
+	files, err := r.Staged()
+	if err != nil {
+		t.Fatalf("Staged: %v", err)
+	}
+	// a.go is modified but not staged.
+	want := []string{"b.go", "old.go", "renamed.go"}
+	if !slices.Equal(files, want) {
+		t.Fatalf("Staged = %q, want %q", files, want)
+	}
+}
+
+func TestHooksDir(t *testing.T) {
+	r := newRepo(t)
+	dir, err := r.HooksDir()
+	if err != nil || dir != filepath.Join(r.Root, ".git", "hooks") {
+		t.Fatalf("HooksDir = %q, %v", dir, err)
+	}
+	run(t, r.Root, "config", "core.hooksPath", "ci/hooks")
+	if dir, _ := r.HooksDir(); dir != filepath.Join(r.Root, "ci", "hooks") {
+		t.Fatalf("HooksDir with core.hooksPath = %q", dir)
+	}
+}
+
+func TestBranch(t *testing.T) {
+	r := newRepo(t)
+	run(t, r.Root, "checkout", "-q", "-b", "feature/x")
+	if b, err := r.Branch(); err != nil || b != "feature/x" {
+		t.Fatalf("Branch = %q, %v", b, err)
+	}
+	run(t, r.Root, "checkout", "-q", "--detach")
+	if b, err := r.Branch(); err == nil {
+		t.Fatalf("Branch on a detached HEAD = %q, want an error", b)
+	}
+}
+
+func TestOpen_NotARepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	if _, err := Open(t.TempDir()); err == nil {
+		t.Fatal("Open outside a repository should fail")
+	}
+}
+
+func TestRel(t *testing.T) {
+	r := &Repo{Root: "/src/app"}
+	cases := []struct {
+		dir, path, want string
+		ok              bool
+	}{
+		{"/src/app", "a.go", "a.go", true},
+		{"/src/app/pkg", "b.go", "pkg/b.go", true},
+		{"/src/app", "./pkg/", "pkg", true},
+		{"/elsewhere", "/src/app/c.go", "c.go", true},
+		{"/src/app", "../x.go", "", false},
+	}
+	for _, c := range cases {
+		got, ok := r.Rel(c.dir, c.path)
+		if got != c.want || ok != c.ok {
+			t.Errorf("Rel(%q, %q) = %q, %v; want %q, %v", c.dir, c.path, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	cases := []struct {
+		lock, file string
+		want       bool
+	}{
+		{"a.go", "a.go", true},
+		{"pkg", "pkg/b.go", true},
+		{"pkg/", "pkg/sub/c.go", true},
+		{"pkg", "pkgx/b.go", false},
+		{"a.go", "b.go", false},
+		{".", "anything.go", true},
+	}
+	for _, c := range cases {
+		if got := Covers(c.lock, c.file); got != c.want {
+			t.Errorf("Covers(%q, %q) = %v, want %v", c.lock, c.file, got, c.want)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	r := newRepo(t)
+	write(t, r.Root, "pkg/b.go", "package pkg\n")
+	write(t, r.Root, "a.go", "package a\n\nvar y int\n")
+	run(t, r.Root, "add", ".")
+	run(t, r.Root, "commit", "-q", "-m", "second: touch a and b")
+
+	commits, err := r.Log("", 0)
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("got %d commits, want 2", len(commits))
+	}
+	first, second := commits[0], commits[1]
+	if first.Subject != "init" || !slices.Equal(first.Files, []string{"a.go", "old.go"}) {
+		t.Fatalf("first commit = %+v", first)
+	}
+	if second.Subject != "second: touch a and b" || second.Author != "t" || second.Email != "t@example.com" ||
+		len(second.SHA) != 40 || second.Time.IsZero() || !slices.Equal(second.Files, []string{"a.go", "pkg/b.go"}) {
+		t.Fatalf("second commit = %+v", second)
+	}
+
+	if commits, _ := r.Log("", 1); len(commits) != 1 || commits[0].SHA != second.SHA {
+		t.Fatalf("max 1 should keep the newest commit, got %+v", commits)
+	}
+	if commits, _ := r.Log("2000-01-01", 0); len(commits) != 2 {
+		t.Fatalf("since 2000: got %d commits", len(commits))
+	}
+}
+
+func TestShow(t *testing.T) {
+	r := newRepo(t)
+	write(t, r.Root, "a.go", "package a\n\nvar y int\n")
+	run(t, r.Root, "commit", "-q", "-am", "second")
+
+	if data, err := r.Show("base", "a.go"); err != nil || string(data) != "package a\n" {
+		t.Fatalf("Show(base) = %q, %v", data, err)
+	}
+	if data, err := r.Show("HEAD", "a.go"); err != nil || string(data) != "package a\n\nvar y int\n" {
+		t.Fatalf("Show(HEAD) = %q, %v", data, err)
+	}
+	if _, err := r.Show("HEAD", "missing.go"); err == nil {
+		t.Fatal("Show of a missing file should fail")
+	}
+}